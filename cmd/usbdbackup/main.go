@@ -0,0 +1,344 @@
+//usbdbackup backs up files and block devices, such as an NBD device exported by
+// usbdsrvd, to a deduplicating repository in a directory or an object store (see
+// pkg/backup), and restores them
+//
+// Usage:
+//	usbdbackup [options] init
+//	usbdbackup [options] [-name SNAPSHOT] backup DEVICE
+//	usbdbackup [options] restore SNAPSHOT DEVICE
+//	usbdbackup [options] list
+//	usbdbackup [options] forget SNAPSHOT...
+//	usbdbackup [options] [-keep N] prune
+//	usbdbackup [options] [-data] verify [SNAPSHOT]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/backup"
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/objstore"
+	"github.com/tarndt/usbd/pkg/devices/objstore/compress"
+	"github.com/tarndt/usbd/pkg/devices/objstore/encrypt"
+
+	"github.com/dustin/go-humanize"
+	"github.com/graymeta/stow"
+)
+
+type storeFlags struct {
+	dir, kind, cfgJSON, container string
+}
+
+func main() {
+	var store storeFlags
+	flag.StringVar(&store.dir, "repo", "", "Directory of the repository (or use -objstore-kind)")
+	flag.StringVar(&store.kind, "objstore-kind", "", "Type of objectstore holding the repository: 's3', 'b2', 'local', 'azure', 'swift', 'google', 'oracle' or 'sftp'")
+	flag.StringVar(&store.cfgJSON, "objstore-cfg", "{}", "JSON configuration of the objectstore")
+	flag.StringVar(&store.container, "objstore-container", "usbdbackup", "Container of the objectstore holding the repository")
+	keySrc := flag.String("key", "", "AES key of an encrypted repository: key:<value>, file:<path>, env:<varname>")
+	chunkSize := flag.String("chunk-size", humanize.IBytes(backup.DefChunkBytes), "When initializing; size of the chunks devices are divided into (ex. 256 KiB, 4 MiB)")
+	compressName := flag.String("compress", compress.ModeS2Name, "When initializing; compression mode: '"+compress.ModeIdentityName+"', '"+compress.ModeS2Name+"' or '"+compress.ModeGzipName+"'")
+	encryptName := flag.String("aesmode", "", "When initializing; encryption mode: '"+encrypt.ModeIdentityName+"', '"+encrypt.ModeAESCTRName+"', '"+encrypt.ModeAESCFBName+"' or '"+encrypt.ModeAESOFBName+"' (default '"+encrypt.ModeAESCTRName+"' if a key is provided)")
+	name := flag.String("name", "", "When backing up; name of the snapshot (default is the current time)")
+	keep := flag.Int("keep", -1, "When pruning; forget all but this many of the newest snapshots first (-1 keeps all)")
+	readData := flag.Bool("data", false, "When verifying; read and check the contents of every chunk, rather than that they exist")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n\t%[1]s [options] init\n\t%[1]s [options] backup DEVICE\n\t%[1]s [options] restore SNAPSHOT DEVICE\n"+
+			"\t%[1]s [options] list\n\t%[1]s [options] forget SNAPSHOT...\n\t%[1]s [options] prune\n\t%[1]s [options] verify [SNAPSHOT]\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	key, err := readKey(*keySrc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if len(args) == 1 && args[0] == "init" {
+		if err = initRepo(store, key, *chunkSize, *compressName, *encryptName); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var repo *backup.Repository
+	switch {
+	case len(args) == 2 && args[0] == "backup":
+		if repo, err = openRepo(store, key); err == nil {
+			err = backupDevice(ctx, repo, args[1], *name)
+		}
+	case len(args) == 3 && args[0] == "restore":
+		if repo, err = openRepo(store, key); err == nil {
+			err = restoreDevice(ctx, repo, args[1], args[2])
+		}
+	case len(args) == 1 && args[0] == "list":
+		if repo, err = openRepo(store, key); err == nil {
+			err = list(repo)
+		}
+	case len(args) >= 2 && args[0] == "forget":
+		if repo, err = openRepo(store, key); err == nil {
+			for _, snapName := range args[1:] {
+				if err = repo.Forget(snapName); err != nil {
+					break
+				}
+			}
+		}
+	case len(args) == 1 && args[0] == "prune":
+		if repo, err = openRepo(store, key); err == nil {
+			err = prune(ctx, repo, *keep)
+		}
+	case len(args) <= 2 && args[0] == "verify":
+		if repo, err = openRepo(store, key); err == nil {
+			err = verify(ctx, repo, args[1:], *readData)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+//readKey reads a key from a source in the form used by usbdsrvd -objstore-aeskey
+func readKey(keySrc string) ([]byte, error) {
+	switch {
+	case keySrc == "":
+		return nil, nil
+	case strings.HasPrefix(keySrc, "file:"):
+		keyFile := strings.TrimPrefix(keySrc, "file:")
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read AES key file %q: %w", keyFile, err)
+		}
+		return key, nil
+	case strings.HasPrefix(keySrc, "key:"):
+		return []byte(strings.TrimPrefix(keySrc, "key:")), nil
+	case strings.HasPrefix(keySrc, "env:"):
+		envName := strings.TrimPrefix(keySrc, "env:")
+		envVal, exists := os.LookupEnv(envName)
+		if !exists {
+			return nil, fmt.Errorf("Could not read AES key from non-existent environment variable %q", envName)
+		}
+		return []byte(envVal), nil
+	}
+	return nil, fmt.Errorf("AES key source %q is not valid", keySrc)
+}
+
+//openStore opens the directory or objectstore container holding the repository,
+// creating it when the repository is being initialized
+func openStore(flags storeFlags, create bool) (backup.Store, error) {
+	switch {
+	case flags.dir != "" && flags.kind != "":
+		return nil, fmt.Errorf("Only one of -repo and -objstore-kind may be provided")
+	case flags.dir != "":
+		if _, err := os.Stat(flags.dir); err != nil && !create {
+			return nil, fmt.Errorf("Could not open repository directory: %w", err)
+		}
+		return backup.NewDirStore(flags.dir)
+	case flags.kind == "":
+		return nil, fmt.Errorf("No repository was provided (use -repo=DIR or -objstore-kind=KIND)")
+	}
+
+	var cfg stow.ConfigMap
+	if err := json.Unmarshal([]byte(flags.cfgJSON), &cfg); err != nil {
+		return nil, fmt.Errorf("Could not parse objectstore configuration JSON: %w", err)
+	}
+	if err := objstore.ValidateConfig(flags.kind, cfg); err != nil {
+		return nil, fmt.Errorf("Objectstore configuration is not valid: %w", err)
+	}
+	loc, err := objstore.NewStore(flags.kind, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to objectstore: %w", err)
+	}
+	container, err := loc.Container(flags.container)
+	if errors.Is(err, stow.ErrNotFound) && create {
+		container, err = loc.CreateContainer(flags.container)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not open objectstore container %q: %w", flags.container, err)
+	}
+	return backup.NewStowStore(container), nil
+}
+
+func openRepo(flags storeFlags, key []byte) (*backup.Repository, error) {
+	store, err := openStore(flags, false)
+	if err != nil {
+		return nil, err
+	}
+	return backup.OpenRepository(store, key)
+}
+
+func initRepo(flags storeFlags, key []byte, chunkSize, compressName, encryptName string) error {
+	chunkBytes, err := humanize.ParseBytes(chunkSize)
+	if err != nil {
+		return fmt.Errorf("Could not parse chunk size %q: %w", chunkSize, err)
+	}
+	compressMode := compress.ModeFromName(compressName)
+	if compressMode == compress.ModeUnknown {
+		return fmt.Errorf("Unknown compression mode %q was provided", compressName)
+	}
+	if encryptName == "" && len(key) > 0 {
+		encryptName = encrypt.ModeAESCTRName
+	}
+	encryptMode := encrypt.ModeFromName(encryptName)
+	if encryptMode == encrypt.ModeUnknown {
+		return fmt.Errorf("Unknown encryption mode %q was provided", encryptName)
+	}
+
+	store, err := openStore(flags, true)
+	if err != nil {
+		return err
+	}
+	options := []backup.Option{backup.OptChunkBytes(chunkBytes), backup.OptCompress(compressMode), backup.OptEncrypt(encryptMode)}
+	if _, err = backup.InitRepository(store, key, options...); err != nil {
+		return fmt.Errorf("Could not initialize repository: %w", err)
+	}
+	fmt.Printf("Initialized repository with %s chunks, %s compression and %s encryption\n", humanize.IBytes(chunkBytes), compressMode.AlgoName(), encryptMode.AlgoName())
+	return nil
+}
+
+//openDevice opens a file or block device, if size is positive and the file is
+// empty it is extended to that size
+func openDevice(devFile string, flags int, size int64) (*filedisk.FileDisk, error) {
+	f, err := os.OpenFile(devFile, flags, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open device %q: %w", devFile, err)
+	}
+	devBytes, err := f.Seek(0, io.SeekEnd) //Unlike Stat this works for block devices
+	if err == nil && devBytes == 0 && size > 0 {
+		if err = f.Truncate(size); err == nil {
+			devBytes = size
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Could not determine size of device %q: %w", devFile, err)
+	}
+	return &filedisk.FileDisk{File: f, SizeBytes: devBytes}, nil
+}
+
+func backupDevice(ctx context.Context, repo *backup.Repository, devFile, name string) error {
+	if name == "" {
+		name = time.Now().UTC().Format("20060102T150405Z")
+	}
+	dev, err := openDevice(devFile, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	start := time.Now()
+	snap, err := repo.Backup(ctx, dev, name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %s (%s) to snapshot %q in %s: %d chunks, %d of zeros, %d new (%s stored)\n",
+		devFile, humanize.IBytes(uint64(snap.DeviceBytes)), snap.Name, time.Since(start).Round(time.Millisecond),
+		snap.Chunks, snap.ZeroChunks, snap.NewChunks, humanize.IBytes(uint64(snap.StoredBytes)),
+	)
+	return nil
+}
+
+func restoreDevice(ctx context.Context, repo *backup.Repository, name, devFile string) error {
+	snap, err := repo.Snapshot(name)
+	if err != nil {
+		return err
+	}
+	dev, err := openDevice(devFile, os.O_RDWR|os.O_CREATE, snap.DeviceBytes)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	start := time.Now()
+	if err = repo.Restore(ctx, name, dev); err != nil {
+		return err
+	}
+	fmt.Printf("Restored snapshot %q (%s) to %s in %s\n", name, humanize.IBytes(uint64(snap.DeviceBytes)), devFile, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func list(repo *backup.Repository) error {
+	snaps, err := repo.Snapshots()
+	if err != nil {
+		return err
+	}
+	for _, snap := range snaps {
+		fmt.Printf("%s\t%s\t%s\t%d chunks (%d new, %s stored)\n", snap.Name, snap.Created.Local().Format("2006-01-02 15:04:05 MST"),
+			humanize.IBytes(uint64(snap.DeviceBytes)), snap.Chunks, snap.NewChunks, humanize.IBytes(uint64(snap.StoredBytes)),
+		)
+	}
+	return nil
+}
+
+func prune(ctx context.Context, repo *backup.Repository, keep int) error {
+	if keep >= 0 {
+		snaps, err := repo.Snapshots()
+		if err != nil {
+			return err
+		}
+		for len(snaps) > keep {
+			if err = repo.Forget(snaps[0].Name); err != nil {
+				return err
+			}
+			fmt.Printf("Forgot snapshot %q\n", snaps[0].Name)
+			snaps = snaps[1:]
+		}
+	}
+
+	stats, err := repo.Prune(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %d of %d chunks, %d remain referenced\n", stats.Deleted, stats.Chunks, stats.Referenced)
+	return nil
+}
+
+//verify verifies the named snapshot, or all snapshots if none is named
+func verify(ctx context.Context, repo *backup.Repository, names []string, readData bool) error {
+	if len(names) == 0 {
+		snaps, err := repo.Snapshots()
+		if err != nil {
+			return err
+		}
+		for _, snap := range snaps {
+			names = append(names, snap.Name)
+		}
+	}
+
+	failed := 0
+	for _, name := range names {
+		stats, err := repo.Verify(ctx, name, readData)
+		switch {
+		case errors.Is(err, backup.ErrCorrupt):
+			failed++
+			fmt.Printf("%s: FAILED: %s\n", name, err)
+		case err != nil:
+			return err
+		default:
+			fmt.Printf("%s: OK (%d chunks)\n", name, stats.Chunks)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d snapshots failed verification", failed, len(names))
+	}
+	return nil
+}
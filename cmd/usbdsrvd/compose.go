@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tarndt/usbd/cmd/usbdsrvd/conf"
+	"github.com/tarndt/usbd/pkg/devices/compose"
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/nbdclient"
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+func composeFromCfg(cfg *conf.Config) (usbdlib.Device, error) {
+	members := make([]usbdlib.Device, 0, len(cfg.ComposeConfig.Members))
+	closeMembers := func() {
+		for _, member := range members {
+			member.Close()
+		}
+	}
+
+	for i, memberCfg := range cfg.ComposeConfig.Members {
+		member, err := memberFromCfg(&memberCfg)
+		if err != nil {
+			closeMembers()
+			return nil, fmt.Errorf("composeFromCfg: Could not create member %d (%s); Details: %w", i, memberCfg.String(), err)
+		}
+		members = append(members, member)
+	}
+
+	var device *compose.Composite
+	var err error
+	if cfg.BackingMode == conf.DevStripe {
+		device, err = compose.Stripe(int64(cfg.ComposeConfig.StripeChunkBytes), members...)
+	} else {
+		device, err = compose.Concat(members...)
+	}
+	if err != nil {
+		closeMembers()
+		return nil, fmt.Errorf("composeFromCfg: Could not create %s; Details: %w", cfg.BackingMode, err)
+	}
+	return device, nil
+}
+
+func memberFromCfg(memberCfg *conf.MemberConfig) (usbdlib.Device, error) {
+	switch memberCfg.Kind {
+	case conf.DevMem:
+		return ramdisk.NewRAMDisk(int64(memberCfg.Bytes)), nil
+	case conf.DevFile:
+		return filedisk.NewFileDisk(memberCfg.Path, int64(memberCfg.Bytes))
+	case conf.DevNBDClient:
+		nbdcfg := memberCfg.NBDClientConfig
+		return nbdclient.NewClient(context.Background(), nbdcfg.Network, nbdcfg.Addr, nbdclient.OptExportName(nbdcfg.ExportName))
+	}
+	return nil, fmt.Errorf("Unsupported member type: %s", memberCfg.Kind)
+}
@@ -11,6 +11,10 @@ const (
 	DevFile
 	DevDedupFile
 	DevObjStore
+	DevNBDClient
+	DevConcat
+	DevStripe
+	DevThinPool
 )
 
 //BackingDevice type represents the available device implementations
@@ -27,6 +31,14 @@ func NewBackingDevice(devDesc string) BackingDevice {
 		return DevDedupFile
 	case "osbd", "objstore":
 		return DevObjStore
+	case "nbd", "nbdclient", "remote-nbd":
+		return DevNBDClient
+	case "concat", "linear":
+		return DevConcat
+	case "stripe", "raid0":
+		return DevStripe
+	case "thin", "thinpool":
+		return DevThinPool
 	default:
 		return DevUnknown
 	}
@@ -43,6 +55,14 @@ func (bd BackingDevice) String() string {
 		return "deduplicated-filedisk"
 	case DevObjStore:
 		return "locally-cached objectstore"
+	case DevNBDClient:
+		return "remote NBD export"
+	case DevConcat:
+		return "concatenation"
+	case DevStripe:
+		return "stripe (RAID0)"
+	case DevThinPool:
+		return "thin provisioned pool"
 	default:
 		return "unknown"
 	}
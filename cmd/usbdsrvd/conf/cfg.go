@@ -23,6 +23,10 @@ type Config struct {
 	StorageBytes     Capacity
 	DedupConfig
 	ObjStoreConfig
+	NBDClientConfig
+	ComposeConfig
+	ThinPoolConfig
+	TraceConfig
 }
 
 //String generates human-readable prose describing a configuration
@@ -38,11 +42,22 @@ func (cfg *Config) String() string {
 		driverParams = " " + cfg.DedupConfig.String()
 	case DevObjStore:
 		driverParams = " " + cfg.ObjStoreConfig.String()
+	case DevNBDClient:
+		driverParams = " " + cfg.NBDClientConfig.String()
+	case DevConcat, DevStripe:
+		driverParams = " " + cfg.ComposeConfig.String()
+	case DevThinPool:
+		driverParams = " " + cfg.ThinPoolConfig.String()
 	}
 
-	return fmt.Sprintf("Exporting %s volume %q as %s with local storage at %q using driver %s%s.",
+	traceParams := ""
+	if cfg.TraceConfig.File != "" {
+		traceParams = ", " + cfg.TraceConfig.String()
+	}
+
+	return fmt.Sprintf("Exporting %s volume %q as %s with local storage at %q using driver %s%s%s.",
 		humanize.IBytes(uint64(cfg.StorageBytes)), cfg.StorageName,
-		devName, cfg.StorageDirectory, cfg.BackingMode, driverParams,
+		devName, cfg.StorageDirectory, cfg.BackingMode, driverParams, traceParams,
 	)
 }
 
@@ -93,6 +108,22 @@ func (c *ObjStoreConfig) String() string {
 	)
 }
 
+//NBDClientConfig is the remote NBD export specific configuration parameters
+type NBDClientConfig struct {
+	Network    string
+	Addr       string
+	ExportName string
+}
+
+//String generates human-readable prose describing a NBDClientConfig
+func (c *NBDClientConfig) String() string {
+	exportName := "the default export"
+	if c.ExportName != "" {
+		exportName = fmt.Sprintf("export %q", c.ExportName)
+	}
+	return fmt.Sprintf("proxying %s of the NBD server at %s %q", exportName, c.Network, c.Addr)
+}
+
 func stowCfgStr(cm stow.ConfigMap) string {
 	var str bytes.Buffer
 	for k, v := range cm {
@@ -0,0 +1,101 @@
+package conf
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+//ComposeConfig is the configuration parameters of devices built from several
+// member devices (concatenation and striping)
+type ComposeConfig struct {
+	Members          []MemberConfig
+	StripeChunkBytes Capacity
+}
+
+//String generates human-readable prose describing a ComposeConfig
+func (c *ComposeConfig) String() string {
+	members := make([]string, len(c.Members))
+	for i := range c.Members {
+		members[i] = c.Members[i].String()
+	}
+	return fmt.Sprintf("with %s chunks (if striped) of members: %s", humanize.IBytes(uint64(c.StripeChunkBytes)), strings.Join(members, ", "))
+}
+
+//MemberConfig describes a single member of a composed device, only memory, file
+// and remote NBD members are supported
+type MemberConfig struct {
+	Kind  BackingDevice
+	Path  string
+	Bytes Capacity
+	NBDClientConfig
+}
+
+//String generates human-readable prose describing a MemberConfig
+func (c *MemberConfig) String() string {
+	switch c.Kind {
+	case DevMem:
+		return fmt.Sprintf("%s %s", humanize.IBytes(uint64(c.Bytes)), c.Kind)
+	case DevFile:
+		return fmt.Sprintf("%s %s %q", humanize.IBytes(uint64(c.Bytes)), c.Kind, c.Path)
+	}
+	return fmt.Sprintf("%s %s", c.Kind, c.NBDClientConfig.String())
+}
+
+//parseMemberSpecs parses a comma separated list of member specifications:
+// mem[@<size>], file:<path>[@<size>] or nbdclient:<addr>[#<export>]
+// Members without a size are given defBytes, relative paths are relative to dir.
+func parseMemberSpecs(specs string, defBytes Capacity, dir string) ([]MemberConfig, error) {
+	var members []MemberConfig
+	for _, spec := range strings.Split(specs, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+
+		member, kind := MemberConfig{Bytes: defBytes}, spec
+		if idx := strings.IndexAny(spec, ":@"); idx >= 0 {
+			kind = spec[:idx]
+		}
+		arg := strings.TrimPrefix(strings.TrimPrefix(spec, kind), ":")
+		if member.Kind = NewBackingDevice(kind); member.Kind == DevMem || member.Kind == DevFile {
+			if idx := strings.LastIndex(arg, "@"); idx >= 0 {
+				if err := member.Bytes.Set(arg[idx+1:]); err != nil {
+					return nil, fmt.Errorf("Member %q has an invalid size: %w", spec, err)
+				}
+				arg = arg[:idx]
+			}
+		}
+
+		switch member.Kind {
+		case DevMem:
+		case DevFile:
+			if arg == "" {
+				return nil, fmt.Errorf("File member %q has no path", spec)
+			}
+			if member.Path = arg; !filepath.IsAbs(arg) {
+				member.Path = filepath.Join(dir, arg)
+			}
+		case DevNBDClient:
+			if idx := strings.LastIndex(arg, "#"); idx >= 0 {
+				arg, member.ExportName = arg[:idx], arg[idx+1:]
+			}
+			if arg == "" {
+				return nil, fmt.Errorf("NBD client member %q has no address", spec)
+			}
+			member.Network, member.Addr = "tcp", arg
+			if strings.HasPrefix(arg, "unix:") {
+				member.Network, member.Addr = "unix", strings.TrimPrefix(arg, "unix:")
+			}
+		default:
+			return nil, fmt.Errorf("Member %q is not of a supported type (mem, file or nbdclient)", spec)
+		}
+		members = append(members, member)
+	}
+
+	if len(members) < 1 {
+		return nil, fmt.Errorf("No members were provided")
+	}
+	return members, nil
+}
@@ -23,10 +23,12 @@ import (
 )
 
 const (
-	defKeyFile    = "key.aes"
-	oneGiB        = 1024 * 1024 * 1024
-	defStoreSize  = oneGiB
-	defObjectSize = 64 * 1024 * 1024
+	defKeyFile     = "key.aes"
+	oneGiB         = 1024 * 1024 * 1024
+	defStoreSize   = oneGiB
+	defObjectSize  = 64 * 1024 * 1024
+	defStripeChunk = 64 * 1024
+	defThinChunk   = 64 * 1024
 )
 
 //MustGetConfig successful reads configuration from command-line arguments and
@@ -38,7 +40,7 @@ func MustGetConfig() *Config {
 	cfg := new(Config)
 
 	//General options
-	flag.StringVar(&devKind, "dev-type", "mem", "Type of device to back block device with: 'mem', 'file', 'dedup', 'objstore'.")
+	flag.StringVar(&devKind, "dev-type", "mem", "Type of device to back block device with: 'mem', 'file', 'dedup', 'objstore', 'nbdclient', 'concat', 'stripe', 'thinpool'.")
 	flag.UintVar(&cfg.NBDDevCount, "nbd-max-devs", usbdlib.DefMaxNBDDevices, "If the NBD kernel module is loaded by this deamon how many NBD devices should it create")
 	flag.StringVar(&cfg.StorageDirectory, "store-dir", "./", "Location to create new backing disk files in")
 	flag.StringVar(&cfg.StorageName, "store-name", "test-lun", "File base name to use for new backing disk files")
@@ -71,6 +73,28 @@ func MustGetConfig() *Config {
 	flag.UintVar(&cfg.ObjStoreConfig.ConcurFlush, "objstore-concurflush", 0, "Maximum number of dirty local objects to concurrently upload to the remote objectstore (0 implies use heuristic)")
 	flag.DurationVar(&cfg.ObjStoreConfig.FlushInterval, "objstore-flushevery", time.Second*10, "Frequency in which dirty local objects are uploaded to the remote objectstore (0 disables autoflush)")
 
+	//NBD client
+	var nbdClientAddr string
+	flag.StringVar(&nbdClientAddr, "nbdclient-addr", "127.0.0.1:10809", "Address of the remote NBD server to proxy (ex. host:10809 or unix:/run/nbd.sock)")
+	flag.StringVar(&cfg.NBDClientConfig.ExportName, "nbdclient-export", "", "Name of the export on the remote NBD server to proxy (empty implies the default export)")
+
+	//Concatenation and striping
+	var composeMembers string
+	flag.StringVar(&composeMembers, "compose-members", "", "Comma separated members of a concat or stripe device: mem[@<size>], file:<path>[@<size>] or nbdclient:<addr>[#<export>] (members without a size use store-size divided by the member count)")
+	flagCapacityVar(&cfg.ComposeConfig.StripeChunkBytes, "compose-chunk", defStripeChunk, "Size of the chunks distributed across the members of a stripe device (ex. 64 KiB, 1 MiB)")
+
+	//Thin pool
+	var thinVolumes string
+	flagCapacityVar(&cfg.ThinPoolConfig.DataBytes, "thinpool-size", 0, "Size of the thin pool data file when it is created (0 implies store-size)")
+	flagCapacityVar(&cfg.ThinPoolConfig.ChunkBytes, "thinpool-chunk", defThinChunk, "Size of the chunks a new thin pool allocates to volumes (ex. 64 KiB, 1 MiB)")
+	flagCapacityVar(&cfg.ThinPoolConfig.LowWaterBytes, "thinpool-lowwater", 0, "Log a warning when the free space of the thin pool falls below this (0 disables)")
+	flag.StringVar(&thinVolumes, "thinpool-volumes", "", "Comma separated volumes of the thin pool to export, created if absent: <name>[@<size>[/<limit>]] (empty implies a volume named store-name, volumes without a size use store-size)")
+
+	//Tracing
+	flag.StringVar(&cfg.TraceConfig.File, "trace-file", "", "Record the operations performed on the device to this trace file for replay by usbdtrace (empty disables, thin pool volumes after the first are recorded to <file>.<volume>)")
+	flag.BoolVar(&cfg.TraceConfig.Hashes, "trace-hashes", false, "If tracing; record the hash of the data of each read and write")
+	flag.BoolVar(&cfg.TraceConfig.Payloads, "trace-payloads", false, "If tracing; record the data of each write, so it can be replayed exactly (the trace will be as large as all data written)")
+
 	//Process args set
 	flag.Parse()
 
@@ -80,7 +104,11 @@ func MustGetConfig() *Config {
 			"\tExample:\n"+"\t\t1 GiB device backed with by memory: ./usbdsrvd\n"+
 			"\t\t8 GiB device backed by a file and exported specifically on /dev/nbd5: ./usbdsrvd -dev-type=file -store-dir=/tmp -store-name=testfilevol -store-size=8GiB /dev/nbd5\n"+
 			"\t\t12 GiB device backed by file deduplicated using PebbleDB: ./usbdsrvd -dev-type=file -store-dir=/tmp -store-name=testdedupvol -store-size=12GiB\n"+
-			"\t\t20 GiB device backed by a locally running S3/minio objectstore: ./usbdsrvd -dev-type=objstore -store-dir=/tmp -store-name=testobjvol -store-size=20GiB\n\n", os.Args[0])
+			"\t\t20 GiB device backed by a locally running S3/minio objectstore: ./usbdsrvd -dev-type=objstore -store-dir=/tmp -store-name=testobjvol -store-size=20GiB\n"+
+			"\t\tDevice proxying an export of a remote NBD server: ./usbdsrvd -dev-type=nbdclient -nbdclient-addr=nbdhost:10809 -nbdclient-export=vol1\n"+
+			"\t\tDevice striped across two files: ./usbdsrvd -dev-type=stripe -store-dir=/tmp -compose-members=file:a.bin@4GiB,file:b.bin@4GiB\n"+
+			"\t\tTwo volumes exported from a 50 GiB thin pool: ./usbdsrvd -dev-type=thinpool -store-dir=/tmp -store-name=pool -thinpool-size=50GiB -thinpool-volumes=vol1@40GiB,vol2@40GiB/20GiB\n"+
+			"\t\t1 GiB device backed by memory, recording a trace of its operations: ./usbdsrvd -trace-file=/tmp/test-lun.trace -trace-hashes\n\n", os.Args[0])
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
@@ -95,7 +123,7 @@ func MustGetConfig() *Config {
 		log.Fatalf("No volume name was provided (use -store-name=X)")
 	}
 
-	if cfg.BackingMode != DevMem {
+	if cfg.BackingMode != DevMem && cfg.BackingMode != DevNBDClient {
 		if cfg.StorageDirectory == "" {
 			log.Fatalf("No storage directory was provided (use -store-dir=X)")
 		}
@@ -124,10 +152,62 @@ func MustGetConfig() *Config {
 
 	case DevObjStore:
 		mustGetObjStoreConfig(cfg, objStoreConfigJSON, AESMode, AESKey, Compress)
+
+	case DevNBDClient:
+		if nbdClientAddr == "" {
+			log.Fatalf("No remote NBD server address was provided (use -nbdclient-addr=X)")
+		}
+		cfg.NBDClientConfig.Network, cfg.NBDClientConfig.Addr = "tcp", nbdClientAddr
+		if strings.HasPrefix(nbdClientAddr, "unix:") {
+			cfg.NBDClientConfig.Network, cfg.NBDClientConfig.Addr = "unix", strings.TrimPrefix(nbdClientAddr, "unix:")
+		}
+
+	case DevConcat, DevStripe:
+		mustGetComposeConfig(cfg, composeMembers)
+
+	case DevThinPool:
+		mustGetThinPoolConfig(cfg, thinVolumes)
 	}
 	return cfg
 }
 
+func mustGetThinPoolConfig(cfg *Config, thinVolumes string) {
+	if cfg.ThinPoolConfig.DataBytes == 0 {
+		cfg.ThinPoolConfig.DataBytes = cfg.StorageBytes
+	}
+	if cfg.ThinPoolConfig.ChunkBytes < 1 {
+		log.Fatalf("Thin pool chunk size must be positive (use -thinpool-chunk=X)")
+	}
+	if thinVolumes == "" {
+		thinVolumes = cfg.StorageName
+	}
+	volumes, err := parseThinVolumeSpecs(thinVolumes, cfg.StorageBytes)
+	if err != nil {
+		log.Fatalf("Could not parse thin pool volumes (-thinpool-volumes=%q): %s", thinVolumes, err)
+	}
+	cfg.ThinPoolConfig.Volumes = volumes
+}
+
+func mustGetComposeConfig(cfg *Config, composeMembers string) {
+	if composeMembers == "" {
+		log.Fatalf("No members were provided for %s device (use -compose-members=X)", cfg.BackingMode)
+	}
+	members, err := parseMemberSpecs(composeMembers, 0, cfg.StorageDirectory)
+	if err != nil {
+		log.Fatalf("Could not parse %s device members (-compose-members=%q): %s", cfg.BackingMode, composeMembers, err)
+	}
+	for i := range members {
+		if members[i].Bytes == 0 {
+			members[i].Bytes = cfg.StorageBytes / Capacity(len(members))
+		}
+	}
+	cfg.ComposeConfig.Members = members
+
+	if cfg.BackingMode == DevStripe && cfg.ComposeConfig.StripeChunkBytes < 1 {
+		log.Fatalf("Stripe chunk size must be positive (use -compose-chunk=X)")
+	}
+}
+
 func mustGetObjStoreConfig(cfg *Config, objStoreConfigJSON, AESMode, AESKey, Compress string) {
 	switch strings.ToLower(cfg.ObjStoreConfig.Kind) {
 	case "s3", "b2", "local", "azure", "swift", "google", "oracle", "sftp":
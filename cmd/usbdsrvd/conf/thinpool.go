@@ -0,0 +1,89 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+//ThinPoolConfig is the configuration parameters of a thin provisioned pool from
+// which one or more volumes are exported
+type ThinPoolConfig struct {
+	DataBytes     Capacity
+	ChunkBytes    Capacity
+	LowWaterBytes Capacity
+	Volumes       []ThinVolumeConfig
+}
+
+//String generates human-readable prose describing a ThinPoolConfig
+func (c *ThinPoolConfig) String() string {
+	volumes := make([]string, len(c.Volumes))
+	for i := range c.Volumes {
+		volumes[i] = c.Volumes[i].String()
+	}
+	lowWater := "no low watermark"
+	if c.LowWaterBytes > 0 {
+		lowWater = fmt.Sprintf("a %s low watermark", humanize.IBytes(uint64(c.LowWaterBytes)))
+	}
+	return fmt.Sprintf("with a pool of %s (if new) allocated in %s chunks with %s, exporting volumes: %s",
+		humanize.IBytes(uint64(c.DataBytes)), humanize.IBytes(uint64(c.ChunkBytes)), lowWater, strings.Join(volumes, ", "),
+	)
+}
+
+//ThinVolumeConfig describes a single volume of a thin pool
+type ThinVolumeConfig struct {
+	Name       string
+	Bytes      Capacity
+	LimitBytes Capacity
+}
+
+//String generates human-readable prose describing a ThinVolumeConfig
+func (c *ThinVolumeConfig) String() string {
+	if c.LimitBytes > 0 {
+		return fmt.Sprintf("%q (%s, limited to %s)", c.Name, humanize.IBytes(uint64(c.Bytes)), humanize.IBytes(uint64(c.LimitBytes)))
+	}
+	return fmt.Sprintf("%q (%s)", c.Name, humanize.IBytes(uint64(c.Bytes)))
+}
+
+//parseThinVolumeSpecs parses a comma separated list of volume specifications:
+// <name>[@<size>[/<limit>]] Volumes without a size are given defBytes.
+func parseThinVolumeSpecs(specs string, defBytes Capacity) ([]ThinVolumeConfig, error) {
+	var volumes []ThinVolumeConfig
+	seen := make(map[string]bool)
+	for _, spec := range strings.Split(specs, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+
+		volume, sizes := ThinVolumeConfig{Name: spec, Bytes: defBytes}, ""
+		if idx := strings.LastIndex(spec, "@"); idx >= 0 {
+			volume.Name, sizes = spec[:idx], spec[idx+1:]
+		}
+		if sizes != "" {
+			if idx := strings.Index(sizes, "/"); idx >= 0 {
+				if err := volume.LimitBytes.Set(sizes[idx+1:]); err != nil {
+					return nil, fmt.Errorf("Volume %q has an invalid limit: %w", spec, err)
+				}
+				sizes = sizes[:idx]
+			}
+			if err := volume.Bytes.Set(sizes); err != nil {
+				return nil, fmt.Errorf("Volume %q has an invalid size: %w", spec, err)
+			}
+		}
+
+		switch {
+		case volume.Name == "":
+			return nil, fmt.Errorf("Volume %q has no name", spec)
+		case seen[volume.Name]:
+			return nil, fmt.Errorf("Volume %q was provided more than once", volume.Name)
+		}
+		seen[volume.Name] = true
+		volumes = append(volumes, volume)
+	}
+
+	if len(volumes) < 1 {
+		return nil, fmt.Errorf("No volumes were provided")
+	}
+	return volumes, nil
+}
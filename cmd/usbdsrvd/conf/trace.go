@@ -0,0 +1,30 @@
+package conf
+
+import (
+	"fmt"
+)
+
+//TraceConfig is the configuration parameters of recording the operations
+// performed on exported devices to a trace (see pkg/devices/iotrace)
+type TraceConfig struct {
+	File     string
+	Hashes   bool
+	Payloads bool
+}
+
+//String generates human-readable prose describing a TraceConfig
+func (c *TraceConfig) String() string {
+	if c.File == "" {
+		return "not recording a trace"
+	}
+	contents := ""
+	switch {
+	case c.Hashes && c.Payloads:
+		contents = " with data hashes and payloads"
+	case c.Hashes:
+		contents = " with data hashes"
+	case c.Payloads:
+		contents = " with payloads"
+	}
+	return fmt.Sprintf("recording a trace%s to %q", contents, c.File)
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/tarndt/usbd/cmd/usbdsrvd/conf"
 	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/nbdclient"
 	"github.com/tarndt/usbd/pkg/devices/ramdisk"
 	"github.com/tarndt/usbd/pkg/usbdlib"
 )
@@ -24,38 +25,87 @@ func main() {
 	log.Printf(deamonName+" using config: %s", cfg)
 	defer log.Println(deamonName + " terminated normally.")
 
-	device := mustGetDevice(cfg)
+	var devices []usbdlib.Device
+	if cfg.BackingMode == conf.DevThinPool {
+		pool, volumes, err := thinPoolFromCfg(cfg)
+		if err != nil {
+			log.Fatalf("Could not create thin provisioned virtual disks: %s", err)
+		}
+		defer pool.Close()
+		devices = volumes
+	} else {
+		devices = []usbdlib.Device{mustGetDevice(cfg)}
+	}
+	if cfg.TraceConfig.File != "" {
+		var err error
+		if devices, err = traceFromCfg(cfg, devices); err != nil {
+			log.Fatalf("Could not record trace: %s", err)
+		}
+	}
+	defer closeDevices(devices) //Recorders close the devices they wrap, then the pool is closed
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
 	defer cancel()
 
+	//The first device is exported on the requested NBD device (if any), others on
+	// the next available
+	errCh := make(chan error, len(devices))
+	for i, device := range devices {
+		nbdDevName := ""
+		if i == 0 {
+			nbdDevName = cfg.NBDDevName
+		}
+		ndbStream, nbdDevName, cleanup := mustExport(ctx, cfg, device, nbdDevName)
+		defer cleanup()
+
+		log.Printf(deamonName+" is processing requests for %q.", nbdDevName)
+		go func() {
+			errCh <- ndbStream.ProcessRequests()
+		}()
+	}
+	for range devices {
+		if err := <-errCh; err != nil {
+			log.Fatalf("Request processing failed: %s", err)
+		}
+	}
+}
+
+//closeDevices closes the provided devices, logging any failures
+func closeDevices(devices []usbdlib.Device) {
+	for i, device := range devices {
+		if err := device.Close(); err != nil {
+			log.Printf("Warning: Could not close device %d: %s", i, err)
+		}
+	}
+}
+
+//mustExport creates a NBD user-space device for the provided device, using the
+// provided NBD device if any or otherwise the next available
+func mustExport(ctx context.Context, cfg *conf.Config, device usbdlib.Device, nbdDevName string) (*usbdlib.NbdStream, string, func()) {
 	var (
 		ndbStream *usbdlib.NbdStream
+		cleanup   = func() {}
 		err       error
 	)
-	if cfg.NBDDevName != "" {
-		if ndbStream, _, err = usbdlib.NewNbdHandler(ctx, device, cfg.NBDDevName); err != nil {
-			err = fmt.Errorf("Could not use existing NBD device %q: %w", cfg.NBDDevName, err)
+	if nbdDevName != "" {
+		if ndbStream, _, err = usbdlib.NewNbdHandler(ctx, device, nbdDevName); err != nil {
+			err = fmt.Errorf("Could not use existing NBD device %q: %w", nbdDevName, err)
 		}
 	} else {
-		if ndbStream, cfg.NBDDevName, err = usbdlib.NewNbdHandler(ctx, device, cfg.NBDDevCount); err != nil {
+		if ndbStream, nbdDevName, err = usbdlib.NewNbdHandler(ctx, device, cfg.NBDDevCount); err != nil {
 			err = fmt.Errorf("Could not create new NBD device: %w", err)
 		} else {
-			defer func() {
-				if err := os.Remove(cfg.NBDDevName); err != nil {
-					log.Printf("Warning: Could not remove autocreated NBD device %q: %s", cfg.NBDDevName, err)
+			cleanup = func() {
+				if err := os.Remove(nbdDevName); err != nil {
+					log.Printf("Warning: Could not remove autocreated NBD device %q: %s", nbdDevName, err)
 				}
-			}()
+			}
 		}
 	}
 	if err != nil {
 		log.Fatalf("Could not create NDB user-space device: %s", err)
 	}
-
-	log.Printf(deamonName+" is processing requests for %q.", cfg.NBDDevName)
-	if err := ndbStream.ProcessRequests(); err != nil {
-		log.Fatalf("Request processing failed: %s", err)
-	}
+	return ndbStream, nbdDevName, cleanup
 }
 
 func mustGetDevice(cfg *conf.Config) (device usbdlib.Device) {
@@ -84,6 +134,19 @@ func mustGetDevice(cfg *conf.Config) (device usbdlib.Device) {
 			log.Fatalf("Could not create object storage backed virtual disk: %s", err)
 		}
 
+	case conf.DevNBDClient:
+		nbdcfg := cfg.NBDClientConfig
+		device, err = nbdclient.NewClient(context.Background(), nbdcfg.Network, nbdcfg.Addr, nbdclient.OptExportName(nbdcfg.ExportName))
+		if err != nil {
+			log.Fatalf("Could not connect to remote NBD export: %s", err)
+		}
+
+	case conf.DevConcat, conf.DevStripe:
+		device, err = composeFromCfg(cfg)
+		if err != nil {
+			log.Fatalf("Could not create composite virtual disk: %s", err)
+		}
+
 	default:
 		log.Fatalf("Bug: Could not create store: unknown backing device mode enum: %d", cfg.BackingMode)
 	}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/tarndt/usbd/cmd/usbdsrvd/conf"
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/thinpool"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+
+	"github.com/dustin/go-humanize"
+)
+
+//thinPoolFromCfg opens (or creates) the configured thin pool and opens each of the
+// configured volumes, creating those that do not yet exist
+func thinPoolFromCfg(cfg *conf.Config) (*thinpool.Pool, []usbdlib.Device, error) {
+	poolCfg := &cfg.ThinPoolConfig
+	data, err := filedisk.NewFileDisk(filepath.Join(cfg.StorageDirectory, cfg.StorageName+".pool"), int64(poolCfg.DataBytes))
+	if err != nil {
+		return nil, nil, fmt.Errorf("thinPoolFromCfg: Could not create pool data file; Details: %w", err)
+	}
+
+	onLowWater := func(stats thinpool.Stats) {
+		log.Printf("Warning: Thin pool %q has only %s of %s free (%s allocated to volumes totaling %s)", cfg.StorageName,
+			humanize.IBytes(uint64(stats.FreeBytes)), humanize.IBytes(uint64(stats.TotalBytes)),
+			humanize.IBytes(uint64(stats.AllocatedBytes)), humanize.IBytes(uint64(stats.VirtualBytes)),
+		)
+	}
+	pool, err := thinpool.NewPool(data, filepath.Join(cfg.StorageDirectory, cfg.StorageName+".idx"),
+		thinpool.OptChunkBytes(poolCfg.ChunkBytes), thinpool.OptLowWaterBytes(poolCfg.LowWaterBytes), thinpool.OptLowWaterCallback(onLowWater),
+	)
+	if err != nil {
+		data.Close()
+		return nil, nil, fmt.Errorf("thinPoolFromCfg: Could not open pool; Details: %w", err)
+	}
+
+	volumes := make([]usbdlib.Device, 0, len(poolCfg.Volumes))
+	for _, volCfg := range poolCfg.Volumes {
+		err = pool.CreateVolume(volCfg.Name, int64(volCfg.Bytes), int64(volCfg.LimitBytes))
+		switch {
+		case err == nil:
+			log.Printf("Created thin volume %s", volCfg.String())
+		case errors.Is(err, thinpool.ErrVolumeExists):
+		default:
+			pool.Close()
+			return nil, nil, fmt.Errorf("thinPoolFromCfg: Could not create volume %s; Details: %w", volCfg.String(), err)
+		}
+
+		volume, err := pool.OpenVolume(volCfg.Name)
+		if err != nil {
+			pool.Close()
+			return nil, nil, fmt.Errorf("thinPoolFromCfg: Could not open volume %q; Details: %w", volCfg.Name, err)
+		}
+		volumes = append(volumes, volume)
+	}
+
+	stats := pool.Stats()
+	log.Printf("Thin pool %q has %s of %s free with %d volumes totaling %s", cfg.StorageName,
+		humanize.IBytes(uint64(stats.FreeBytes)), humanize.IBytes(uint64(stats.TotalBytes)), stats.Volumes, humanize.IBytes(uint64(stats.VirtualBytes)),
+	)
+	return pool, volumes, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/tarndt/usbd/cmd/usbdsrvd/conf"
+	"github.com/tarndt/usbd/pkg/devices/iotrace"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+//traceFromCfg wraps the provided devices so the operations performed on them are
+// recorded to the configured trace file. The first device is recorded to the
+// file itself, any others (thin pool volumes) to the file suffixed with their
+// volume name.
+func traceFromCfg(cfg *conf.Config, devices []usbdlib.Device) ([]usbdlib.Device, error) {
+	traceCfg := &cfg.TraceConfig
+	options := []iotrace.Option{iotrace.OptHashes(traceCfg.Hashes), iotrace.OptPayloads(traceCfg.Payloads)}
+
+	traced := make([]usbdlib.Device, len(devices))
+	for i, device := range devices {
+		filename := traceCfg.File
+		if i > 0 {
+			filename += "." + cfg.ThinPoolConfig.Volumes[i].Name
+		}
+		traceOut, err := os.Create(filename)
+		if err != nil {
+			return nil, fmt.Errorf("traceFromCfg: Could not create trace file; Details: %w", err)
+		}
+		if traced[i], err = iotrace.NewRecorder(device, traceOut, options...); err != nil {
+			traceOut.Close()
+			return nil, fmt.Errorf("traceFromCfg: Could not start trace %q; Details: %w", filename, err)
+		}
+	}
+	return traced, nil
+}
@@ -0,0 +1,410 @@
+//usbdsync compares devices using hash trees (see pkg/blocksync) and copies only
+// the blocks that differ, to seed and reseed replicas or to check a backup
+// restored to one device against another in use. Devices may be files or block
+// devices, exports of NBD servers or volumes in an objectstore:
+//	PATH or file:PATH
+//	nbdclient:ADDR[#EXPORT] (ex. nbdclient:host:10809#vol1, nbdclient:unix:/run/nbd.sock)
+//	objstore:CONTAINER (see the -objstore options)
+// Saved hash trees, tree:FILE, may be compared in place of a device.
+//
+// Usage:
+//	usbdsync [options] [-list] diff SOURCE DESTINATION
+//	usbdsync [options] sync SOURCE DESTINATION
+//	usbdsync [options] tree DEVICE FILE
+//
+// diff reports the differences without changing anything and exits with status 1
+// if there are any.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/blocksync"
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/nbdclient"
+	"github.com/tarndt/usbd/pkg/devices/objstore"
+	"github.com/tarndt/usbd/pkg/devices/objstore/compress"
+	"github.com/tarndt/usbd/pkg/devices/objstore/encrypt"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+
+	"github.com/dustin/go-humanize"
+	"github.com/graymeta/stow"
+)
+
+type objstoreFlags struct {
+	kind, cfgJSON, objSize, size, cacheDir, aesMode, aesKey, compress string
+}
+
+func main() {
+	var osFlags objstoreFlags
+	blockSize := flag.String("block-size", humanize.IBytes(blocksync.DefBlockBytes), "Size of the blocks hashed and copied (ex. 4 KiB, 1 MiB)")
+	fanout := flag.Int("fanout", blocksync.DefFanout, "Number of hashes combined into each node of the hash trees")
+	concurrency := flag.Int("concurrency", 0, "Number of reads or writes issued at once (0 implies the number of CPUs)")
+	verbose := flag.Bool("list", false, "When diffing; list each differing extent")
+	flag.StringVar(&osFlags.kind, "objstore-kind", "", "Type of objectstore of objstore: devices: 's3', 'b2', 'local', 'azure', 'swift', 'google', 'oracle' or 'sftp'")
+	flag.StringVar(&osFlags.cfgJSON, "objstore-cfg", "{}", "JSON configuration of the objectstore")
+	flag.StringVar(&osFlags.objSize, "objstore-objsize", "64 MiB", "Size of the remote objects of objstore: devices")
+	flag.StringVar(&osFlags.size, "objstore-size", "", "Size of objstore: devices (default is the size of the source when one is the destination)")
+	flag.StringVar(&osFlags.cacheDir, "objstore-cachedir", "", "Directory to cache remote objects in (default is a temporary directory)")
+	flag.StringVar(&osFlags.aesMode, "objstore-aesmode", encrypt.ModeIdentityName, "AES encryption mode of remote objects: '"+encrypt.ModeIdentityName+"', '"+encrypt.ModeAESCTRName+"', '"+encrypt.ModeAESCFBName+"', '"+encrypt.ModeAESOFBName+"' or '"+encrypt.ModeAESRecName+"'")
+	flag.StringVar(&osFlags.aesKey, "objstore-aeskey", "", "AES key of remote objects: key:<value>, file:<path>, env:<varname>")
+	flag.StringVar(&osFlags.compress, "objstore-compress", compress.ModeS2Name, "Compression of remote objects: '"+compress.ModeIdentityName+"', '"+compress.ModeS2Name+"' or '"+compress.ModeGzipName+"'")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n\t%[1]s [options] diff SOURCE DESTINATION\n\t%[1]s [options] sync SOURCE DESTINATION\n\t%[1]s [options] tree DEVICE FILE\n"+
+			"Devices:\n\tPATH or file:PATH\n\tnbdclient:ADDR[#EXPORT]\n\tobjstore:CONTAINER\n\ttree:FILE (saved hash tree, diff only)\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 3 || (args[0] != "diff" && args[0] != "sync" && args[0] != "tree") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	blockBytes, err := humanize.ParseBytes(*blockSize)
+	if err != nil {
+		log.Fatalf("Could not parse block size %q: %s", *blockSize, err)
+	}
+	options := []blocksync.Option{blocksync.OptBlockBytes(blockBytes), blocksync.OptFanout(*fanout)}
+	if *concurrency > 0 {
+		options = append(options, blocksync.OptConcurrency(*concurrency))
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	opener := &devOpener{ctx: ctx, objstore: osFlags}
+	defer opener.closeAll()
+	switch args[0] {
+	case "diff":
+		var differs bool
+		if differs, err = diff(ctx, opener, args[1], args[2], options, *verbose); err == nil && differs {
+			opener.closeAll()
+			os.Exit(1)
+		}
+	case "sync":
+		err = syncDevices(ctx, opener, args[1], args[2], options)
+	case "tree":
+		err = saveTree(ctx, opener, args[1], args[2], options)
+	}
+	if err != nil {
+		opener.closeAll()
+		log.Fatal(err)
+	}
+}
+
+//diff reports the extents of the source that differ from the destination
+func diff(ctx context.Context, opener *devOpener, srcSpec, dstSpec string, options []blocksync.Option, verbose bool) (bool, error) {
+	start := time.Now()
+	src, srcTree, err := opener.openOrLoad(srcSpec, 0)
+	if err != nil {
+		return false, err
+	}
+	dstSize := int64(0)
+	if src != nil {
+		dstSize = src.Size()
+	}
+	dst, dstTree, err := opener.openOrLoad(dstSpec, dstSize)
+	if err != nil {
+		return false, err
+	}
+
+	var extents []blocksync.Extent
+	var stats blocksync.DiffStats
+	switch {
+	case src != nil && dst != nil:
+		extents, stats, err = blocksync.Compare(ctx, src, dst, options...)
+	default:
+		if src != nil {
+			srcTree, err = blocksync.BuildTree(ctx, src, options...)
+		} else if dst != nil {
+			dstTree, err = blocksync.BuildTree(ctx, dst, append(options, blocksync.OptLength(srcTree.Length()))...)
+		}
+		if err == nil {
+			extents, stats, err = blocksync.Diff(srcTree, dstTree)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if verbose {
+		for _, ext := range extents {
+			desc := "differs"
+			if ext.Zero {
+				desc = "differs (zeros in source)"
+			}
+			fmt.Printf("%d\t+%d\t%s\n", ext.Pos, ext.Bytes, desc)
+		}
+	}
+	fmt.Printf("%d of %d blocks differ (%s, %s of which are zeros in the source), found with %d comparisons in %s\n",
+		stats.DifferingBlocks, stats.Blocks, humanize.IBytes(uint64(stats.DifferingBytes)), humanize.IBytes(uint64(stats.ZeroBytes)),
+		stats.Comparisons, time.Since(start).Round(time.Millisecond),
+	)
+	return stats.DifferingBlocks > 0, nil
+}
+
+//syncDevices copies the blocks of the source that differ to the destination
+func syncDevices(ctx context.Context, opener *devOpener, srcSpec, dstSpec string, options []blocksync.Option) error {
+	start := time.Now()
+	src, err := opener.open(srcSpec, 0, false)
+	if err != nil {
+		return err
+	}
+	dst, err := opener.open(dstSpec, src.Size(), true)
+	if err != nil {
+		return err
+	}
+
+	stats, err := blocksync.Sync(ctx, src, dst, options...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Synced %s: %d of %d blocks differed, copied %s and zeroed %s in %s\n",
+		humanize.IBytes(uint64(src.Size())), stats.DifferingBlocks, stats.Blocks, humanize.IBytes(uint64(stats.CopiedBytes)),
+		humanize.IBytes(uint64(stats.ZeroedBytes)), time.Since(start).Round(time.Millisecond),
+	)
+	return nil
+}
+
+//saveTree saves the hash tree of a device to a file
+func saveTree(ctx context.Context, opener *devOpener, devSpec, treeFile string, options []blocksync.Option) error {
+	dev, err := opener.open(devSpec, 0, false)
+	if err != nil {
+		return err
+	}
+	tree, err := blocksync.BuildTree(ctx, dev, options...)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(treeFile)
+	if err != nil {
+		return fmt.Errorf("Could not create hash tree file: %w", err)
+	}
+	if _, err = tree.WriteTo(f); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(treeFile)
+		return fmt.Errorf("Could not save hash tree to %q: %w", treeFile, err)
+	}
+	fmt.Printf("Saved hash tree of %d blocks of %s to %s, root: %x\n", tree.Blocks(), humanize.IBytes(uint64(tree.BlockBytes())), treeFile, tree.Root())
+	return nil
+}
+
+//devOpener opens devices from their specifications and closes them when done
+type devOpener struct {
+	ctx      context.Context
+	objstore objstoreFlags
+	opened   []usbdlib.Device
+	tempDirs []string
+}
+
+//openOrLoad opens a device or loads a saved hash tree
+func (opener *devOpener) openOrLoad(spec string, size int64) (usbdlib.Device, *blocksync.Tree, error) {
+	if !strings.HasPrefix(spec, "tree:") {
+		dev, err := opener.open(spec, size, false)
+		return dev, nil, err
+	}
+
+	treeFile := strings.TrimPrefix(spec, "tree:")
+	f, err := os.Open(treeFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not open hash tree file: %w", err)
+	}
+	defer f.Close()
+	tree, err := blocksync.ReadTree(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not load hash tree %q: %w", treeFile, err)
+	}
+	return nil, tree, nil
+}
+
+//open opens the specified device; size is used to create files and objstore
+// volumes that do not exist when writable
+func (opener *devOpener) open(spec string, size int64, writable bool) (usbdlib.Device, error) {
+	var dev usbdlib.Device
+	var err error
+	switch {
+	case strings.HasPrefix(spec, "tree:"):
+		return nil, fmt.Errorf("Saved hash tree %q can only be diffed", spec)
+	case strings.HasPrefix(spec, "nbdclient:"):
+		addr, options := strings.TrimPrefix(spec, "nbdclient:"), []nbdclient.Option{}
+		if idx := strings.LastIndex(addr, "#"); idx >= 0 {
+			addr, options = addr[:idx], append(options, nbdclient.OptExportName(addr[idx+1:]))
+		}
+		network := "tcp"
+		if strings.HasPrefix(addr, "unix:") {
+			network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+		}
+		if dev, err = nbdclient.NewClient(opener.ctx, network, addr, options...); err != nil {
+			return nil, fmt.Errorf("Could not connect to NBD server %q: %w", addr, err)
+		}
+	case strings.HasPrefix(spec, "objstore:"):
+		if dev, err = opener.openObjstore(strings.TrimPrefix(spec, "objstore:"), size, writable); err != nil {
+			return nil, err
+		}
+	default:
+		if dev, err = openFile(strings.TrimPrefix(spec, "file:"), size, writable); err != nil {
+			return nil, err
+		}
+	}
+	opener.opened = append(opener.opened, dev)
+	return dev, nil
+}
+
+//openFile opens a file or block device, if size is positive and the file is
+// empty or does not exist it is extended to that size
+func openFile(devFile string, size int64, writable bool) (*filedisk.FileDisk, error) {
+	flags := os.O_RDONLY
+	if writable {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	f, err := os.OpenFile(devFile, flags, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open device %q: %w", devFile, err)
+	}
+	devBytes, err := f.Seek(0, io.SeekEnd) //Unlike Stat this works for block devices
+	if err == nil && devBytes == 0 && size > 0 && writable {
+		if err = f.Truncate(size); err == nil {
+			devBytes = size
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Could not determine size of device %q: %w", devFile, err)
+	}
+	return &filedisk.FileDisk{File: f, SizeBytes: devBytes}, nil
+}
+
+//openObjstore opens a volume in an objectstore container, creating the container
+// if it is the destination
+func (opener *devOpener) openObjstore(containerName string, size int64, writable bool) (usbdlib.Device, error) {
+	cfgFlags := opener.objstore
+	switch {
+	case cfgFlags.kind == "":
+		return nil, fmt.Errorf("An objectstore kind must be provided (-objstore-kind=X)")
+	case cfgFlags.size != "":
+		sizeBytes, err := humanize.ParseBytes(cfgFlags.size)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse objectstore volume size %q: %w", cfgFlags.size, err)
+		}
+		size = int64(sizeBytes)
+	case size < 1:
+		return nil, fmt.Errorf("The size of objectstore volume %q must be provided (-objstore-size=X)", containerName)
+	}
+	objBytes, err := humanize.ParseBytes(cfgFlags.objSize)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse objectstore object size %q: %w", cfgFlags.objSize, err)
+	}
+
+	var cfg stow.ConfigMap
+	if err = json.Unmarshal([]byte(cfgFlags.cfgJSON), &cfg); err != nil {
+		return nil, fmt.Errorf("Could not parse objectstore configuration JSON: %w", err)
+	}
+	if err = objstore.ValidateConfig(cfgFlags.kind, cfg); err != nil {
+		return nil, fmt.Errorf("Objectstore configuration is not valid: %w", err)
+	}
+	loc, err := objstore.NewStore(cfgFlags.kind, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to objectstore: %w", err)
+	}
+	container, err := loc.Container(containerName)
+	if errors.Is(err, stow.ErrNotFound) && writable {
+		container, err = loc.CreateContainer(containerName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not open objectstore container %q: %w", containerName, err)
+	}
+
+	options := []objstore.Option{}
+	if !objstore.SupportsMetaData(cfgFlags.kind) {
+		options = append(options, objstore.OptNoMetadataSupport(true))
+	}
+	compressMode := compress.ModeFromName(cfgFlags.compress)
+	if compressMode == compress.ModeUnknown {
+		return nil, fmt.Errorf("Unknown compression mode %q was provided", cfgFlags.compress)
+	}
+	if compressMode != compress.ModeIdentity {
+		options = append(options, objstore.OptCompressRemoteObjects(compressMode))
+	}
+	aesMode := encrypt.ModeFromName(cfgFlags.aesMode)
+	if aesMode == encrypt.ModeUnknown {
+		return nil, fmt.Errorf("Unknown encryption mode %q was provided", cfgFlags.aesMode)
+	}
+	if aesMode != encrypt.ModeIdentity {
+		key, err := readKey(cfgFlags.aesKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) == 0 {
+			return nil, fmt.Errorf("An AES key must be provided for encryption mode %q (-objstore-aeskey=X)", cfgFlags.aesMode)
+		}
+		options = append(options, objstore.OptEncrypt{Mode: aesMode, Key: key})
+	}
+
+	cacheDir := cfgFlags.cacheDir
+	if cacheDir == "" {
+		if cacheDir, err = os.MkdirTemp("", "usbdsync-"); err != nil {
+			return nil, fmt.Errorf("Could not create cache directory: %w", err)
+		}
+		opener.tempDirs = append(opener.tempDirs, cacheDir)
+	}
+	dev, err := objstore.NewDevice(opener.ctx, container, cacheDir, uint(size), uint(objBytes), options...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open objectstore volume %q: %w", containerName, err)
+	}
+	return dev, nil
+}
+
+//closeAll closes the devices opened, in reverse order, and removes temporary
+// cache directories
+func (opener *devOpener) closeAll() {
+	for i := len(opener.opened) - 1; i >= 0; i-- {
+		if err := opener.opened[i].Close(); err != nil {
+			log.Printf("WARNING: Could not close device; Details: %s", err)
+		}
+	}
+	opener.opened = nil
+	for _, dir := range opener.tempDirs {
+		os.RemoveAll(dir)
+	}
+	opener.tempDirs = nil
+}
+
+//readKey reads a key from a source in the form used by usbdsrvd -objstore-aeskey
+func readKey(keySrc string) ([]byte, error) {
+	switch {
+	case keySrc == "":
+		return nil, nil
+	case strings.HasPrefix(keySrc, "file:"):
+		keyFile := strings.TrimPrefix(keySrc, "file:")
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read AES key file %q: %w", keyFile, err)
+		}
+		return key, nil
+	case strings.HasPrefix(keySrc, "key:"):
+		return []byte(strings.TrimPrefix(keySrc, "key:")), nil
+	case strings.HasPrefix(keySrc, "env:"):
+		envName := strings.TrimPrefix(keySrc, "env:")
+		envVal, exists := os.LookupEnv(envName)
+		if !exists {
+			return nil, fmt.Errorf("Could not read AES key from non-existent environment variable %q", envName)
+		}
+		return []byte(envVal), nil
+	}
+	return nil, fmt.Errorf("AES key source %q is not valid", keySrc)
+}
@@ -0,0 +1,127 @@
+//usbdtrace summarizes I/O traces recorded by usbdsrvd -trace-file (see
+// pkg/devices/iotrace) and replays them against files or block devices, such as
+// an NBD device exported by usbdsrvd with a candidate configuration
+//
+// Usage:
+//	usbdtrace info TRACE
+//	usbdtrace [-speed X] [-concurrency N] [-skip-writes] replay TRACE DEVICE
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/iotrace"
+
+	"github.com/dustin/go-humanize"
+)
+
+func main() {
+	speed := flag.Float64("speed", 1, "Multiple of the recorded speed to replay at (ex. 1 is the original timing, 2 is twice as fast), 0 is as fast as possible")
+	concurrency := flag.Int("concurrency", 32, "Maximum number of operations in progress at once")
+	skipWrites := flag.Bool("skip-writes", false, "Skip writes and trims, preserving the contents of the device")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n\t%[1]s info TRACE\n\t%[1]s [options] replay TRACE DEVICE\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+
+	var err error
+	switch {
+	case len(args) == 2 && args[0] == "info":
+		err = info(args[1])
+	case len(args) == 3 && args[0] == "replay":
+		options := []iotrace.ReplayOption{iotrace.OptSpeed(*speed), iotrace.OptConcurrency(*concurrency), iotrace.OptSkipWrites(*skipWrites)}
+		err = replay(args[1], args[2], options)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+//info prints the header of a trace and a summary of the operations it recorded
+func info(traceFile string) error {
+	trace, closeTrace, err := openTrace(traceFile)
+	if err != nil {
+		return err
+	}
+	defer closeTrace()
+
+	hdr := trace.Header()
+	fmt.Printf("Trace of a %s device with %s blocks started %s", humanize.IBytes(uint64(hdr.DeviceBytes)), humanize.IBytes(uint64(hdr.BlockBytes)), hdr.Start.Format("2006-01-02 15:04:05 MST"))
+	if hdr.Flags&iotrace.FlagHashes != 0 {
+		fmt.Print(", with hashes")
+	}
+	if hdr.Flags&iotrace.FlagPayloads != 0 {
+		fmt.Print(", with payloads")
+	}
+	fmt.Println()
+
+	report, err := iotrace.Summarize(trace)
+	if err != nil {
+		return fmt.Errorf("Could not read trace %q: %w", traceFile, err)
+	}
+	fmt.Print(report)
+	return nil
+}
+
+//replay replays a trace against a file or block device and prints a report
+func replay(traceFile, devFile string, options []iotrace.ReplayOption) error {
+	trace, closeTrace, err := openTrace(traceFile)
+	if err != nil {
+		return err
+	}
+	defer closeTrace()
+
+	f, err := os.OpenFile(devFile, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("Could not open device %q: %w", devFile, err)
+	}
+	size, err := f.Seek(0, io.SeekEnd) //Unlike Stat this works for block devices
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Could not determine size of device %q: %w", devFile, err)
+	}
+	dev := &filedisk.FileDisk{File: f, SizeBytes: size}
+	defer dev.Close()
+	if hdrBytes := trace.Header().DeviceBytes; size < hdrBytes {
+		log.Printf("Warning: Device %q (%s) is smaller than the traced device (%s), operations beyond its end will fail",
+			devFile, humanize.IBytes(uint64(size)), humanize.IBytes(uint64(hdrBytes)),
+		)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	report, err := iotrace.Replay(ctx, dev, trace, options...)
+	if err != nil {
+		return fmt.Errorf("Could not replay trace %q: %w", traceFile, err)
+	}
+	if err = dev.Flush(); err != nil {
+		return fmt.Errorf("Could not flush device %q: %w", devFile, err)
+	}
+	fmt.Print(report)
+	return nil
+}
+
+func openTrace(traceFile string) (*iotrace.Reader, func() error, error) {
+	f, err := os.Open(traceFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not open trace: %w", err)
+	}
+	trace, err := iotrace.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("Could not read trace %q: %w", traceFile, err)
+	}
+	return trace, f.Close, nil
+}
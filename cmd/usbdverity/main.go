@@ -0,0 +1,124 @@
+//usbdverity builds and checks the hash trees used by verity devices
+// (see pkg/devices/verity) offline
+//
+// Usage:
+//	usbdverity [-block-bytes N] [-salt HEX] format IMAGE HASHTREE
+//	usbdverity verify IMAGE HASHTREE ROOTHASH
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/verity"
+)
+
+func main() {
+	blockBytes := flag.Int64("block-bytes", verity.DefBlockBytes, "Size of the blocks hashed, a power of two of at least 512 bytes")
+	saltHex := flag.String("salt", "", "Salt in hex (at most 64 bytes), random if not provided")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n\t%[1]s [options] format IMAGE HASHTREE\n\t%[1]s verify IMAGE HASHTREE ROOTHASH\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+
+	var err error
+	switch {
+	case len(args) == 3 && args[0] == "format":
+		options := []verity.Option{verity.OptBlockBytes(*blockBytes)}
+		if *saltHex != "" {
+			salt, decodeErr := hex.DecodeString(*saltHex)
+			if decodeErr != nil {
+				log.Fatalf("Salt is not valid hex: %s", decodeErr)
+			}
+			options = append(options, verity.OptSalt(salt))
+		}
+		err = format(args[1], args[2], options)
+	case len(args) == 4 && args[0] == "verify":
+		err = verify(args[1], args[2], args[3])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+//format builds the hash tree of an image in a new file and prints the root hash
+func format(imageFile, hashFile string, options []verity.Option) error {
+	image, err := openExisting(imageFile)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	hashSize, err := verity.HashSize(image.Size(), options...)
+	if err != nil {
+		return fmt.Errorf("Could not build hash tree of %q: %w", imageFile, err)
+	}
+	if _, err = os.Stat(hashFile); err == nil {
+		return fmt.Errorf("Hash tree file %q already exists", hashFile)
+	}
+	hashDev, err := filedisk.NewFileDisk(hashFile, hashSize)
+	if err != nil {
+		return err
+	}
+	defer hashDev.Close()
+
+	root, err := verity.Format(image, hashDev, options...)
+	if err != nil {
+		os.Remove(hashFile)
+		return fmt.Errorf("Could not build hash tree of %q: %w", imageFile, err)
+	}
+	fmt.Println(hex.EncodeToString(root))
+	return nil
+}
+
+//verify reads an entire image through a verity device
+func verify(imageFile, hashFile, rootHex string) error {
+	root, err := hex.DecodeString(rootHex)
+	if err != nil {
+		return fmt.Errorf("Root hash is not valid hex: %w", err)
+	}
+	image, err := openExisting(imageFile)
+	if err != nil {
+		return err
+	}
+	hashDev, err := openExisting(hashFile)
+	if err != nil {
+		image.Close()
+		return err
+	}
+	dev, err := verity.NewVerity(image, hashDev, root)
+	if err != nil {
+		image.Close()
+		hashDev.Close()
+		return fmt.Errorf("Could not open %q with hash tree %q: %w", imageFile, hashFile, err)
+	}
+	defer dev.Close()
+
+	buf := make([]byte, 1024*1024)
+	for pos := int64(0); pos < dev.Size(); pos += int64(len(buf)) {
+		if _, err = dev.ReadAt(buf, pos); err != nil && err != io.EOF {
+			return fmt.Errorf("Verification of %q failed: %w", imageFile, err)
+		}
+	}
+	fmt.Printf("%s: OK\n", imageFile)
+	return nil
+}
+
+//openExisting opens a file disk, failing rather than creating it if it does not
+// exist
+func openExisting(filename string) (*filedisk.FileDisk, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, fmt.Errorf("Could not open %q: %w", filename, err)
+	}
+	return filedisk.NewFileDisk(filename, 0)
+}
@@ -5,6 +5,7 @@ go 1.17
 replace github.com/graymeta/stow => github.com/tarndt/stow v0.2.8-0.20220119010100-e5705480d170
 
 require (
+	github.com/cespare/xxhash/v2 v2.1.1
 	github.com/cockroachdb/pebble v0.0.0-20220120225425-b510eb6b70c9
 	github.com/dustin/go-humanize v1.0.0
 	github.com/graymeta/stow v0.0.0-00010101000000-000000000000
@@ -12,6 +13,7 @@ require (
 	github.com/klauspost/compress v1.14.1
 	github.com/pmorjan/kmod v1.0.0
 	github.com/tarndt/sema v0.0.0-20220219212302-c67df5cf21d0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/sys v0.0.0-20220114195835-da31bd327af9
 	launchpad.net/gommap v0.0.0-20121012075617-000000000015
 )
@@ -26,7 +28,6 @@ require (
 	github.com/Azure/go-autorest/tracing v0.5.0 // indirect
 	github.com/DataDog/zstd v1.4.5 // indirect
 	github.com/aws/aws-sdk-go v1.23.4 // indirect
-	github.com/cespare/xxhash/v2 v2.1.1 // indirect
 	github.com/cockroachdb/errors v1.8.1 // indirect
 	github.com/cockroachdb/logtags v0.0.0-20190617123548-eb05cc24525f // indirect
 	github.com/cockroachdb/redact v1.0.8 // indirect
@@ -53,7 +54,6 @@ require (
 	github.com/satori/go.uuid v1.2.0 // indirect
 	github.com/shabbyrobe/gocovmerge v0.0.0-20180507124511-f6ea450bfb63 // indirect
 	go.opencensus.io v0.21.0 // indirect
-	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
 	golang.org/x/exp v0.0.0-20200513190911-00229845015e // indirect
 	golang.org/x/net v0.0.0-20201021035429-f5854403a974 // indirect
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45 // indirect
@@ -0,0 +1,169 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util"
+)
+
+//Backup reads the provided device, stores the chunks of it not already in the
+// repository and records them as a snapshot with the provided name, which is
+// returned. The device should not be written while it is backed up; use a
+// snapshot of it if it is in use.
+func (repo *Repository) Backup(ctx context.Context, dev usbdlib.Device, name string) (Snapshot, error) {
+	if err := validName(name); err != nil {
+		return Snapshot{}, err
+	}
+	if _, err := repo.store.Get(snapshotPrefix + name); err == nil {
+		return Snapshot{}, fmt.Errorf("Could not backup to snapshot %q: %w", name, ErrSnapshotExists)
+	} else if !errors.Is(err, ErrNotExist) {
+		return Snapshot{}, fmt.Errorf("Could not check for existing snapshot %q: %w", name, err)
+	}
+
+	size := dev.Size()
+	man := &manifest{Snapshot: Snapshot{
+		Name:        name,
+		Created:     time.Now().UTC(),
+		DeviceBytes: size,
+		ChunkBytes:  repo.cfg.ChunkBytes,
+		Chunks:      (size + repo.cfg.ChunkBytes - 1) / repo.cfg.ChunkBytes,
+	}}
+	man.ids = make([]ChunkID, man.Chunks)
+
+	err := repo.forEachChunk(ctx, &man.Snapshot, func(idx int64, buf []byte) error {
+		if _, err := dev.ReadAt(buf, idx*repo.cfg.ChunkBytes); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("Could not read chunk %d from device: %w", idx, err)
+		}
+		if util.IsZeros(buf) {
+			atomic.AddInt64(&man.ZeroChunks, 1)
+			return nil
+		}
+
+		id, storedBytes, err := repo.putChunk(buf)
+		if err != nil {
+			return err
+		}
+		man.ids[idx] = id
+		if storedBytes > 0 {
+			atomic.AddInt64(&man.NewChunks, 1)
+			atomic.AddInt64(&man.StoredBytes, storedBytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("Could not backup to snapshot %q: %w", name, err)
+	}
+	if err = repo.putManifest(man); err != nil {
+		return Snapshot{}, err
+	}
+	return man.Snapshot, nil
+}
+
+//Restore writes the contents of the named snapshot to the provided device, which
+// must be at least as large as the device backed up. Every chunk is verified
+// before it is written. Chunks of zeros are only written if the device does not
+// already contain zeros there, so restoring to a sparse file or thinly provisioned
+// device does not allocate them.
+func (repo *Repository) Restore(ctx context.Context, name string, dev usbdlib.Device) error {
+	if usbdlib.IsReadOnly(dev) {
+		return fmt.Errorf("Could not restore snapshot %q: device is read-only", name)
+	}
+	man, err := repo.loadManifest(name)
+	if err != nil {
+		return err
+	}
+	if size := dev.Size(); size < man.DeviceBytes {
+		return fmt.Errorf("Could not restore snapshot %q of %d bytes to a device of %d bytes", name, man.DeviceBytes, size)
+	}
+
+	var zeroID ChunkID
+	err = repo.forEachChunk(ctx, &man.Snapshot, func(idx int64, buf []byte) error {
+		pos := idx * man.ChunkBytes
+		if man.ids[idx] == zeroID {
+			if _, err := dev.ReadAt(buf, pos); err != nil && !errors.Is(err, io.EOF) {
+				return fmt.Errorf("Could not read chunk %d from device: %w", idx, err)
+			}
+			if util.IsZeros(buf) {
+				return nil
+			}
+			util.ZeroFill(buf)
+		} else {
+			data, err := repo.getChunk(man.ids[idx])
+			if err != nil {
+				return err
+			} else if len(data) != len(buf) {
+				return fmt.Errorf("Chunk %s is %d bytes rather than %d: %w", man.ids[idx], len(data), len(buf), ErrCorrupt)
+			}
+			buf = data
+		}
+
+		if _, err := dev.WriteAt(buf, pos); err != nil {
+			return fmt.Errorf("Could not write chunk %d to device: %w", idx, err)
+		}
+		return nil
+	})
+	if err == nil {
+		err = dev.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("Could not restore snapshot %q: %w", name, err)
+	}
+	return nil
+}
+
+//forEachChunk concurrently invokes fn for every chunk of a snapshot with a buffer
+// the size of the chunk. The first error, or the context being done, stops
+// further invocations and is returned.
+func (repo *Repository) forEachChunk(ctx context.Context, snap *Snapshot, fn func(idx int64, buf []byte) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		next     int64 = -1
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	worker := func() {
+		defer wg.Done()
+		buf := make([]byte, snap.ChunkBytes)
+		for ctx.Err() == nil {
+			idx := atomic.AddInt64(&next, 1)
+			if idx >= snap.Chunks {
+				return
+			}
+			chunk := buf
+			if remaining := snap.DeviceBytes - idx*snap.ChunkBytes; remaining < snap.ChunkBytes {
+				chunk = buf[:remaining]
+			}
+			if err := fn(idx, chunk); err != nil {
+				errOnce.Do(func() { firstErr = err })
+				cancel()
+				return
+			}
+		}
+	}
+
+	workers := runtime.NumCPU()
+	if int64(workers) > snap.Chunks {
+		workers = int(snap.Chunks)
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go worker()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
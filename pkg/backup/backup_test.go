@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/objstore/compress"
+	"github.com/tarndt/usbd/pkg/devices/objstore/encrypt"
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+
+	"github.com/graymeta/stow"
+	"github.com/graymeta/stow/local"
+)
+
+const (
+	chunkBytes = 64 * 1024
+	sizeBytes  = 64*chunkBytes + 4096 //Ends with a partial chunk
+)
+
+func TestBackup(t *testing.T) {
+	t.Run("dir", func(t *testing.T) {
+		store, err := NewDirStore(t.TempDir())
+		if err != nil {
+			t.Fatalf("Could not create directory store: %s", err)
+		}
+		testRoundTrip(t, store, nil)
+	})
+
+	t.Run("stow-local", func(t *testing.T) {
+		loc, err := stow.Dial(local.Kind, stow.ConfigMap{local.ConfigKeyPath: t.TempDir()})
+		if err != nil {
+			t.Fatalf("Could not create local object store: %s", err)
+		}
+		container, err := loc.CreateContainer("backup")
+		if err != nil {
+			t.Fatalf("Could not create container: %s", err)
+		}
+		testRoundTrip(t, NewStowStore(container), nil)
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		store, err := NewDirStore(t.TempDir())
+		if err != nil {
+			t.Fatalf("Could not create directory store: %s", err)
+		}
+		key, err := encrypt.MakeRandomAESKey()
+		if err != nil {
+			t.Fatalf("Could not create key: %s", err)
+		}
+		testRoundTrip(t, store, key, OptEncrypt(encrypt.ModeAESCTR), OptCompress(compress.ModeGzip))
+
+		if _, err = OpenRepository(store, nil); err == nil {
+			t.Fatalf("Encrypted repository was opened without a key")
+		}
+		key[0] ^= 0xff
+		if _, err = OpenRepository(store, key); !errors.Is(err, ErrWrongKey) {
+			t.Fatalf("Opening with the wrong key returned %v rather than %s", err, ErrWrongKey)
+		}
+	})
+}
+
+//testRoundTrip backs up devices to a new repository, checking chunks are
+// deduplicated and zeros are not stored, and restores them
+func testRoundTrip(t *testing.T, store Store, key []byte, options ...Option) {
+	ctx := testutil.CreateContext(t)
+	repo, err := InitRepository(store, key, append(options, OptChunkBytes(chunkBytes))...)
+	if err != nil {
+		t.Fatalf("Could not initialize repository: %s", err)
+	}
+	if _, err = InitRepository(store, key); err == nil {
+		t.Fatalf("Repository was initialized twice")
+	}
+
+	//Half the chunks are random, then 8 copies of one chunk, the rest are zeros
+	orig := ramdisk.NewRAMDisk(sizeBytes)
+	rnd := rand.New(rand.NewSource(1))
+	buf := make([]byte, chunkBytes)
+	for i := int64(0); i < 32; i++ {
+		rnd.Read(buf)
+		orig.WriteAt(buf, i*chunkBytes)
+	}
+	for i := int64(32); i < 40; i++ {
+		orig.WriteAt(buf, i*chunkBytes)
+	}
+	orig.WriteAt(buf[:4096], 64*chunkBytes)
+
+	snap, err := repo.Backup(ctx, orig, "first")
+	if err != nil {
+		t.Fatalf("Could not backup device: %s", err)
+	}
+	if snap.Chunks != 65 || snap.ZeroChunks != 24 || snap.NewChunks != 33 || snap.DeviceBytes != sizeBytes {
+		t.Fatalf("Snapshot was not as expected: %+v", snap)
+	}
+	if _, err = repo.Backup(ctx, orig, "first"); !errors.Is(err, ErrSnapshotExists) {
+		t.Fatalf("Backup to an existing snapshot returned %v rather than %s", err, ErrSnapshotExists)
+	}
+
+	//A second backup only stores the chunks changed
+	rnd.Read(buf)
+	orig.WriteAt(buf, 0)
+	repo, err = OpenRepository(store, key)
+	if err != nil {
+		t.Fatalf("Could not open repository: %s", err)
+	}
+	if snap, err = repo.Backup(ctx, orig, "second"); err != nil {
+		t.Fatalf("Could not backup device: %s", err)
+	} else if snap.NewChunks != 1 || snap.ZeroChunks != 24 {
+		t.Fatalf("Second snapshot was not as expected: %+v", snap)
+	}
+
+	//Restore to a device with other contents, zero chunks must be overwritten
+	restored := ramdisk.NewRAMDisk(sizeBytes)
+	rnd.Read(buf)
+	restored.WriteAt(buf, 60*chunkBytes)
+	if err = repo.Restore(ctx, "second", restored); err != nil {
+		t.Fatalf("Could not restore snapshot: %s", err)
+	}
+	expectSame(t, orig, restored)
+	if err = repo.Restore(ctx, "second", ramdisk.NewRAMDisk(sizeBytes-1)); err == nil {
+		t.Fatalf("Snapshot was restored to a smaller device")
+	}
+
+	snaps, err := repo.Snapshots()
+	if err != nil {
+		t.Fatalf("Could not list snapshots: %s", err)
+	} else if len(snaps) != 2 || snaps[0].Name != "first" || snaps[1].Name != "second" {
+		t.Fatalf("Snapshots were not as expected: %+v", snaps)
+	}
+	if _, err = repo.Verify(ctx, "first", true); err != nil {
+		t.Fatalf("Could not verify snapshot: %s", err)
+	}
+
+	//Forgetting the first snapshot and pruning deletes only the chunk it alone held
+	if err = repo.Forget("first"); err != nil {
+		t.Fatalf("Could not forget snapshot: %s", err)
+	} else if err = repo.Forget("first"); !errors.Is(err, ErrNoSnapshot) {
+		t.Fatalf("Forgetting a forgotten snapshot returned %v rather than %s", err, ErrNoSnapshot)
+	}
+	stats, err := repo.Prune(ctx)
+	if err != nil {
+		t.Fatalf("Could not prune repository: %s", err)
+	} else if stats != (PruneStats{Chunks: 34, Referenced: 33, Deleted: 1}) {
+		t.Fatalf("Prune was not as expected: %+v", stats)
+	}
+	restored = ramdisk.NewRAMDisk(sizeBytes)
+	if err = repo.Restore(ctx, "second", restored); err != nil {
+		t.Fatalf("Could not restore snapshot after pruning: %s", err)
+	}
+	expectSame(t, orig, restored)
+}
+
+func expectSame(t *testing.T, expected, actual usbdlib.Device) {
+	t.Helper()
+
+	expBuf, actBuf := make([]byte, sizeBytes), make([]byte, sizeBytes)
+	expected.ReadAt(expBuf, 0)
+	actual.ReadAt(actBuf, 0)
+	if !bytes.Equal(expBuf, actBuf) {
+		t.Fatalf("Restored device does not match the original")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx := testutil.CreateContext(t)
+	dir := t.TempDir()
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatalf("Could not create directory store: %s", err)
+	}
+	repo, err := InitRepository(store, nil, OptChunkBytes(chunkBytes), OptCompress(compress.ModeIdentity))
+	if err != nil {
+		t.Fatalf("Could not initialize repository: %s", err)
+	}
+
+	dev := ramdisk.NewRAMDisk(sizeBytes)
+	buf := make([]byte, sizeBytes)
+	rand.New(rand.NewSource(1)).Read(buf)
+	dev.WriteAt(buf, 0)
+	if _, err = repo.Backup(ctx, dev, "snap"); err != nil {
+		t.Fatalf("Could not backup device: %s", err)
+	}
+
+	var chunkFiles []string
+	filepath.Walk(filepath.Join(dir, "chunks"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			chunkFiles = append(chunkFiles, path)
+		}
+		return nil
+	})
+	if len(chunkFiles) != 65 {
+		t.Fatalf("Repository has %d chunks rather than 65", len(chunkFiles))
+	}
+
+	//Corruption is only found when reading data, missing chunks always
+	data, _ := os.ReadFile(chunkFiles[0])
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(chunkFiles[0], data, 0600)
+	if _, err = repo.Verify(ctx, "snap", false); err != nil {
+		t.Fatalf("Could not verify snapshot without reading data: %s", err)
+	}
+	if stats, err := repo.Verify(ctx, "snap", true); !errors.Is(err, ErrCorrupt) || stats.Corrupt != 1 {
+		t.Fatalf("Verify of a corrupt chunk returned %+v, %v", stats, err)
+	}
+	if err = repo.Restore(ctx, "snap", ramdisk.NewRAMDisk(sizeBytes)); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Restore of a corrupt chunk returned %v rather than %s", err, ErrCorrupt)
+	}
+
+	os.Remove(chunkFiles[1])
+	if stats, err := repo.Verify(ctx, "snap", false); !errors.Is(err, ErrCorrupt) || stats.Missing != 1 {
+		t.Fatalf("Verify of a missing chunk returned %+v, %v", stats, err)
+	}
+
+	//Corrupt manifests are detected
+	manFile := filepath.Join(dir, "snapshots", "snap")
+	data, _ = os.ReadFile(manFile)
+	data[len(data)/2] ^= 0xff
+	os.WriteFile(manFile, data, 0600)
+	if _, err = repo.Snapshot("snap"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Reading a corrupt manifest returned %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package backup
+
+import (
+	"github.com/tarndt/usbd/pkg/devices/objstore/compress"
+	"github.com/tarndt/usbd/pkg/devices/objstore/encrypt"
+)
+
+//Option is a repository option, options are only used when a repository is
+// initialized; they are recorded in its configuration thereafter
+type Option interface {
+	apply(*Repository)
+}
+
+//OptChunkBytes instructs a repository to divide devices into chunks of this size,
+// which must be a multiple of 4096. Smaller chunks deduplicate better at the cost
+// of more objects and larger snapshot manifests (32 bytes per chunk).
+type OptChunkBytes int64
+
+func (size OptChunkBytes) apply(repo *Repository) {
+	repo.cfg.ChunkBytes = int64(size)
+}
+
+//OptCompress instructs a repository to compress chunks and manifests with the
+// provided mode, by default compress.ModeS2 is used
+type OptCompress compress.Mode
+
+func (mode OptCompress) apply(repo *Repository) {
+	repo.compressMode = compress.Mode(mode)
+}
+
+//OptEncrypt instructs a repository to encrypt chunks and manifests with the
+// provided mode, by default they are not encrypted
+type OptEncrypt encrypt.Mode
+
+func (mode OptEncrypt) apply(repo *Repository) {
+	repo.encryptMode = encrypt.Mode(mode)
+}
@@ -0,0 +1,152 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+//PruneStats describes the chunks removed by Prune
+type PruneStats struct {
+	Chunks     int64 //Chunks in the repository before pruning
+	Referenced int64 //Chunks referenced by a snapshot, which are kept
+	Deleted    int64 //Chunks no snapshot referenced, which were deleted
+}
+
+//Prune deletes all chunks that are not referenced by any snapshot, such as those
+// only referenced by forgotten snapshots. It must not be run while a backup to the
+// repository is in progress, as the chunks stored by it are not yet referenced.
+func (repo *Repository) Prune(ctx context.Context) (PruneStats, error) {
+	var stats PruneStats
+	names, err := repo.snapshotNames()
+	if err != nil {
+		return stats, err
+	}
+	referenced := make(map[ChunkID]struct{})
+	for _, name := range names {
+		man, err := repo.loadManifest(name)
+		if err != nil {
+			return stats, fmt.Errorf("Could not prune, snapshot references are unknown: %w", err)
+		}
+		for _, id := range man.ids {
+			referenced[id] = struct{}{}
+		}
+	}
+
+	repo.mu.Lock()
+	repo.known = nil //List what is actually stored
+	repo.mu.Unlock()
+	known, err := repo.listChunks()
+	if err != nil {
+		return stats, err
+	}
+
+	repo.mu.Lock()
+	stats.Chunks = int64(len(known))
+	var unreferenced []ChunkID
+	for id := range known {
+		if _, ok := referenced[id]; ok {
+			stats.Referenced++
+		} else {
+			unreferenced = append(unreferenced, id)
+		}
+	}
+	repo.mu.Unlock()
+
+	for _, id := range unreferenced {
+		if err = ctx.Err(); err != nil {
+			return stats, err
+		}
+		if err = repo.store.Delete(id.objectName()); err != nil {
+			return stats, fmt.Errorf("Could not delete chunk %s: %w", id, err)
+		}
+		repo.mu.Lock()
+		delete(known, id)
+		repo.mu.Unlock()
+		stats.Deleted++
+	}
+	return stats, nil
+}
+
+//VerifyStats describes the chunks checked by Verify
+type VerifyStats struct {
+	Chunks  int64 //Distinct chunks referenced by the snapshot
+	Missing int64 //Chunks not in the repository
+	Corrupt int64 //Chunks that could not be read or did not match their ID
+}
+
+//Verify checks that every chunk the named snapshot references is in the
+// repository, and if readData is set that each can be read and matches its ID. A
+// snapshot with missing or corrupt chunks returns an error wrapping ErrCorrupt.
+func (repo *Repository) Verify(ctx context.Context, name string, readData bool) (VerifyStats, error) {
+	var stats VerifyStats
+	man, err := repo.loadManifest(name)
+	if err != nil {
+		return stats, err
+	}
+
+	repo.mu.Lock()
+	repo.known = nil //List what is actually stored
+	repo.mu.Unlock()
+	known, err := repo.listChunks()
+	if err != nil {
+		return stats, err
+	}
+
+	var zeroID ChunkID
+	seen := make(map[ChunkID]struct{})
+	var present []ChunkID
+	repo.mu.Lock()
+	for _, id := range man.ids {
+		if _, dup := seen[id]; dup || id == zeroID {
+			continue
+		}
+		seen[id] = struct{}{}
+		stats.Chunks++
+		if _, ok := known[id]; ok {
+			present = append(present, id)
+		} else {
+			stats.Missing++
+		}
+	}
+	repo.mu.Unlock()
+
+	if readData {
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			idCh    = make(chan ChunkID)
+			workers = runtime.NumCPU()
+		)
+		wg.Add(workers)
+		for i := 0; i < workers; i++ {
+			go func() {
+				defer wg.Done()
+				for id := range idCh {
+					if _, err := repo.getChunk(id); err != nil {
+						mu.Lock()
+						stats.Corrupt++
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		for _, id := range present {
+			if ctx.Err() != nil {
+				break
+			}
+			idCh <- id
+		}
+		close(idCh)
+		wg.Wait()
+		if err = ctx.Err(); err != nil {
+			return stats, err
+		}
+	}
+
+	if stats.Missing > 0 || stats.Corrupt > 0 {
+		return stats, fmt.Errorf("Snapshot %q has %d missing and %d corrupt chunks of %d: %w", name, stats.Missing, stats.Corrupt, stats.Chunks, ErrCorrupt)
+	}
+	return stats, nil
+}
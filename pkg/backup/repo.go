@@ -0,0 +1,349 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/objstore/compress"
+	"github.com/tarndt/usbd/pkg/devices/objstore/encrypt"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	//ErrWrongKey is returned when opening an encrypted repository with the wrong key
+	ErrWrongKey = consterr.ConstErr("Key does not match repository")
+	//ErrCorrupt is wrapped by the errors of objects that fail verification
+	ErrCorrupt = consterr.ConstErr("Repository object is corrupt")
+
+	//DefChunkBytes is the default size of the chunks devices are divided into
+	DefChunkBytes = 1024 * 1024
+
+	repoVersion    = 1
+	configName     = "config"
+	chunkPrefix    = "chunks/"
+	snapshotPrefix = "snapshots/"
+	objMagic       = "USBDBKO1"
+	keyCheckLabel  = "usbdbackup key check"
+	chunkIDLabel   = "usbdbackup chunk id"
+)
+
+//ChunkID is the content address of a chunk: its SHA-256, or for encrypted
+// repositories its HMAC-SHA256 so that IDs do not reveal the contents of chunks
+type ChunkID [sha256.Size]byte
+
+func (id ChunkID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+//objectName returns the name of the object holding the chunk, chunks are spread
+// across subdirectories by the first byte of their ID
+func (id ChunkID) objectName() string {
+	str := id.String()
+	return chunkPrefix + str[:2] + "/" + str
+}
+
+//repoConfig is the unencrypted description of a repository
+type repoConfig struct {
+	Version    int       `json:"version"`
+	Created    time.Time `json:"created"`
+	ChunkBytes int64     `json:"chunkBytes"`
+	Compress   string    `json:"compress"`
+	Encrypt    string    `json:"encrypt"`
+	KeyCheck   string    `json:"keyCheck,omitempty"`
+}
+
+//Repository is a content-addressed store of device chunks and snapshot manifests
+// describing the chunks each device held when it was backed up. Each chunk is
+// stored once no matter how many snapshots, or offsets of them, hold it. Chunks of
+// zeros are not stored at all. Chunks and manifests are compressed and encrypted
+// as configured when the repository was initialized; the configuration is stored
+// unencrypted.
+type Repository struct {
+	store        Store
+	cfg          repoConfig
+	compressMode compress.Mode
+	encryptMode  encrypt.Mode
+	key, idKey   []byte
+
+	mu    sync.Mutex
+	known map[ChunkID]struct{} //Chunks known to be stored, nil until listed
+}
+
+//InitRepository initializes a new repository in the provided store. A key is
+// required if, and only if, the repository is encrypted (see OptEncrypt).
+func InitRepository(store Store, key []byte, options ...Option) (*Repository, error) {
+	if _, err := store.Get(configName); err == nil {
+		return nil, fmt.Errorf("Repository already exists")
+	} else if !errors.Is(err, ErrNotExist) {
+		return nil, fmt.Errorf("Could not check for existing repository: %w", err)
+	}
+
+	repo := &Repository{
+		store:        store,
+		cfg:          repoConfig{Version: repoVersion, Created: time.Now().UTC(), ChunkBytes: DefChunkBytes},
+		compressMode: compress.ModeS2,
+		encryptMode:  encrypt.ModeIdentity,
+		known:        make(map[ChunkID]struct{}),
+	}
+	for _, opt := range options {
+		opt.apply(repo)
+	}
+	repo.cfg.Compress, repo.cfg.Encrypt = repo.compressMode.AlgoName(), repo.encryptMode.AlgoName()
+
+	switch {
+	case repo.cfg.ChunkBytes < 4096 || repo.cfg.ChunkBytes%4096 != 0:
+		return nil, fmt.Errorf("Chunk size %d is not a positive multiple of 4096", repo.cfg.ChunkBytes)
+	case repo.compressMode == compress.ModeUnknown:
+		return nil, fmt.Errorf("Unknown compression mode")
+	case repo.encryptMode == encrypt.ModeUnknown:
+		return nil, fmt.Errorf("Unknown encryption mode")
+	}
+	if err := repo.setKey(key); err != nil {
+		return nil, err
+	}
+
+	cfgData, err := json.MarshalIndent(&repo.cfg, "", "\t")
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode repository configuration: %w", err)
+	}
+	if err = store.Put(configName, cfgData); err != nil {
+		return nil, fmt.Errorf("Could not write repository configuration: %w", err)
+	}
+	return repo, nil
+}
+
+//OpenRepository opens an existing repository in the provided store, the key must be
+// provided if the repository is encrypted
+func OpenRepository(store Store, key []byte) (*Repository, error) {
+	cfgData, err := store.Get(configName)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read repository configuration: %w", err)
+	}
+
+	repo := &Repository{store: store}
+	if err = json.Unmarshal(cfgData, &repo.cfg); err != nil {
+		return nil, fmt.Errorf("Could not decode repository configuration: %w", err)
+	}
+	repo.compressMode, repo.encryptMode = compress.ModeFromName(repo.cfg.Compress), encrypt.ModeFromName(repo.cfg.Encrypt)
+	switch {
+	case repo.cfg.Version != repoVersion:
+		return nil, fmt.Errorf("Repository version %d is not supported", repo.cfg.Version)
+	case repo.cfg.ChunkBytes < 1:
+		return nil, fmt.Errorf("Repository chunk size %d is invalid", repo.cfg.ChunkBytes)
+	case repo.compressMode == compress.ModeUnknown:
+		return nil, fmt.Errorf("Repository compression mode %q is not supported", repo.cfg.Compress)
+	case repo.encryptMode == encrypt.ModeUnknown:
+		return nil, fmt.Errorf("Repository encryption mode %q is not supported", repo.cfg.Encrypt)
+	}
+	if err = repo.setKey(key); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+//setKey validates the key against the repository configuration, recording its
+// check value if it has none, and derives the chunk ID key from it
+func (repo *Repository) setKey(key []byte) error {
+	if repo.encryptMode == encrypt.ModeIdentity {
+		if len(key) > 0 {
+			return fmt.Errorf("A key was provided but the repository is not encrypted")
+		}
+		return nil
+	}
+	if err := encrypt.ValidAESKey(key); err != nil {
+		return fmt.Errorf("Repository is encrypted with %s: %w", repo.encryptMode, err)
+	}
+
+	keyCheck := hex.EncodeToString(keyedHash(key, []byte(keyCheckLabel)))
+	if repo.cfg.KeyCheck == "" {
+		repo.cfg.KeyCheck = keyCheck
+	} else if !hmac.Equal([]byte(keyCheck), []byte(repo.cfg.KeyCheck)) {
+		return ErrWrongKey
+	}
+	repo.key, repo.idKey = key, keyedHash(key, []byte(chunkIDLabel))
+	return nil
+}
+
+func keyedHash(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+//ChunkBytes returns the size of the chunks devices are divided into
+func (repo *Repository) ChunkBytes() int64 {
+	return repo.cfg.ChunkBytes
+}
+
+//chunkID returns the content address of the provided data
+func (repo *Repository) chunkID(data []byte) (id ChunkID) {
+	if repo.idKey != nil {
+		copy(id[:], keyedHash(repo.idKey, data))
+		return id
+	}
+	return sha256.Sum256(data)
+}
+
+//listChunks returns the set of stored chunks, listing them on first use
+func (repo *Repository) listChunks() (map[ChunkID]struct{}, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if repo.known != nil {
+		return repo.known, nil
+	}
+	names, err := repo.store.List(chunkPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list chunks: %w", err)
+	}
+	known := make(map[ChunkID]struct{}, len(names))
+	for _, name := range names {
+		var id ChunkID
+		if decoded, err := hex.DecodeString(name[len(name)-2*len(id):]); err == nil && len(decoded) == len(id) {
+			copy(id[:], decoded)
+			known[id] = struct{}{}
+		}
+	}
+	repo.known = known
+	return known, nil
+}
+
+//putChunk stores a chunk if it is not already stored and returns its ID and the
+// number of bytes stored, 0 if it was already
+func (repo *Repository) putChunk(data []byte) (ChunkID, int64, error) {
+	id := repo.chunkID(data)
+	known, err := repo.listChunks()
+	if err != nil {
+		return id, 0, err
+	}
+	repo.mu.Lock()
+	_, exists := known[id]
+	repo.mu.Unlock()
+	if exists {
+		return id, 0, nil
+	}
+
+	obj, err := repo.seal(data)
+	if err != nil {
+		return id, 0, err
+	}
+	if err = repo.store.Put(id.objectName(), obj); err != nil {
+		return id, 0, fmt.Errorf("Could not store chunk %s: %w", id, err)
+	}
+	repo.mu.Lock()
+	known[id] = struct{}{}
+	repo.mu.Unlock()
+	return id, int64(len(obj)), nil
+}
+
+//getChunk retrieves a chunk and verifies its contents match its ID
+func (repo *Repository) getChunk(id ChunkID) ([]byte, error) {
+	obj, err := repo.store.Get(id.objectName())
+	if err != nil {
+		return nil, fmt.Errorf("Could not read chunk %s: %w", id, err)
+	}
+	data, err := repo.unseal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read chunk %s: %w", id, err)
+	}
+	if repo.chunkID(data) != id {
+		return nil, fmt.Errorf("Chunk %s does not match its ID: %w", id, ErrCorrupt)
+	}
+	return data, nil
+}
+
+//seal compresses and encrypts data for storage. Objects are prefixed with a header
+// recording the compression and encryption modes, and the initialization vector.
+func (repo *Repository) seal(data []byte) ([]byte, error) {
+	var body bytes.Buffer
+	encWtr, initVect, err := repo.encryptMode.NewWriter(nopWriteCloser{&body}, repo.key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create %s encryptor: %w", repo.encryptMode, err)
+	}
+	cmpWtr, err := repo.compressMode.NewWriter(encWtr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create %s compressor: %w", repo.compressMode, err)
+	}
+	if _, err = cmpWtr.Write(data); err == nil {
+		if err = cmpWtr.Close(); err == nil {
+			err = encWtr.Close()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not compress and encrypt object: %w", err)
+	}
+
+	cmpName, encName := repo.compressMode.AlgoName(), repo.encryptMode.AlgoName()
+	obj := make([]byte, 0, len(objMagic)+3+len(cmpName)+len(encName)+len(initVect)+body.Len())
+	obj = append(obj, objMagic...)
+	obj = append(append(obj, byte(len(cmpName))), cmpName...)
+	obj = append(append(obj, byte(len(encName))), encName...)
+	obj = append(append(obj, byte(len(initVect))), initVect...)
+	return append(obj, body.Bytes()...), nil
+}
+
+//unseal decrypts and decompresses an object sealed by seal
+func (repo *Repository) unseal(obj []byte) ([]byte, error) {
+	if len(obj) < len(objMagic) || string(obj[:len(objMagic)]) != objMagic {
+		return nil, fmt.Errorf("Object header is missing: %w", ErrCorrupt)
+	}
+	rest := obj[len(objMagic):]
+	field := func() ([]byte, error) {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, fmt.Errorf("Object header is truncated: %w", ErrCorrupt)
+		}
+		val := rest[1 : 1+int(rest[0])]
+		rest = rest[1+int(rest[0]):]
+		return val, nil
+	}
+	cmpName, err := field()
+	if err != nil {
+		return nil, err
+	}
+	encName, err := field()
+	if err != nil {
+		return nil, err
+	}
+	initVect, err := field()
+	if err != nil {
+		return nil, err
+	}
+
+	cmpMode, encMode := compress.ModeFromName(string(cmpName)), encrypt.ModeFromName(string(encName))
+	switch {
+	case cmpMode == compress.ModeUnknown:
+		return nil, fmt.Errorf("Object compression mode %q is not supported", cmpName)
+	case encMode == encrypt.ModeUnknown:
+		return nil, fmt.Errorf("Object encryption mode %q is not supported", encName)
+	case encMode != encrypt.ModeIdentity && repo.key == nil:
+		return nil, fmt.Errorf("Object is encrypted with %s but no key was provided", encMode)
+	}
+
+	decRdr, err := encMode.NewReader(bytes.NewReader(rest), repo.key, initVect)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create %s decryptor: %w", encMode, err)
+	}
+	cmpRdr, err := cmpMode.NewReader(decRdr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create %s decompressor: %w (%s)", cmpMode, ErrCorrupt, err)
+	}
+	data, err := io.ReadAll(cmpRdr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decompress and decrypt object: %w (%s)", ErrCorrupt, err)
+	}
+	return data, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,205 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	//ErrNoSnapshot is returned when a named snapshot does not exist
+	ErrNoSnapshot = consterr.ConstErr("No such snapshot")
+	//ErrSnapshotExists is returned when backing up to a snapshot name in use
+	ErrSnapshotExists = consterr.ConstErr("Snapshot already exists")
+
+	maxNameBytes = 255
+)
+
+//Snapshot describes the backup of a device at a point in time
+type Snapshot struct {
+	Name        string    `json:"name"`
+	Created     time.Time `json:"created"`
+	DeviceBytes int64     `json:"deviceBytes"`
+	ChunkBytes  int64     `json:"chunkBytes"`
+	Chunks      int64     `json:"chunks"`      //Chunks the device was divided into
+	ZeroChunks  int64     `json:"zeroChunks"`  //Chunks of zeros, which are not stored
+	NewChunks   int64     `json:"newChunks"`   //Chunks not already in the repository
+	StoredBytes int64     `json:"storedBytes"` //Bytes of new chunks after compression
+}
+
+//manifest is a snapshot and the IDs of its chunks in device order, chunks of zeros
+// have the zero ID
+type manifest struct {
+	Snapshot
+	ids []ChunkID
+}
+
+//encode serializes the manifest as a line of JSON describing the snapshot
+// followed by the chunk IDs and a checksum of everything before it
+func (man *manifest) encode() ([]byte, error) {
+	hdr, err := json.Marshal(&man.Snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode snapshot %q: %w", man.Name, err)
+	}
+	data := make([]byte, 0, len(hdr)+1+len(man.ids)*len(ChunkID{})+sha256.Size)
+	data = append(append(data, hdr...), '\n')
+	for _, id := range man.ids {
+		data = append(data, id[:]...)
+	}
+	sum := sha256.Sum256(data)
+	return append(data, sum[:]...), nil
+}
+
+//decodeManifest is the inverse of manifest.encode
+func decodeManifest(data []byte) (*manifest, error) {
+	if len(data) < sha256.Size {
+		return nil, fmt.Errorf("Manifest is truncated: %w", ErrCorrupt)
+	}
+	body := data[:len(data)-sha256.Size]
+	if sum := sha256.Sum256(body); !bytes.Equal(sum[:], data[len(body):]) {
+		return nil, fmt.Errorf("Manifest checksum mismatch: %w", ErrCorrupt)
+	}
+	eol := bytes.IndexByte(body, '\n')
+	if eol < 0 {
+		return nil, fmt.Errorf("Manifest header is missing: %w", ErrCorrupt)
+	}
+
+	man := new(manifest)
+	if err := json.Unmarshal(body[:eol], &man.Snapshot); err != nil {
+		return nil, fmt.Errorf("Could not decode manifest header: %w (%s)", ErrCorrupt, err)
+	}
+	idData := body[eol+1:]
+	if int64(len(idData)) != man.Chunks*int64(len(ChunkID{})) {
+		return nil, fmt.Errorf("Manifest has %d bytes of chunk IDs rather than %d for %d chunks: %w", len(idData), man.Chunks*int64(len(ChunkID{})), man.Chunks, ErrCorrupt)
+	}
+	man.ids = make([]ChunkID, man.Chunks)
+	for i := range man.ids {
+		copy(man.ids[i][:], idData[i*len(ChunkID{}):])
+	}
+	return man, nil
+}
+
+//validName checks a snapshot name can be used as an object name
+func validName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("Snapshot name is empty")
+	case len(name) > maxNameBytes:
+		return fmt.Errorf("Snapshot name %q is longer than %d bytes", name, maxNameBytes)
+	case strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, "."):
+		return fmt.Errorf("Snapshot name %q may not contain slashes or start with a period", name)
+	}
+	return nil
+}
+
+//loadManifest reads and decodes the named snapshot's manifest
+func (repo *Repository) loadManifest(name string) (*manifest, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+	obj, err := repo.store.Get(snapshotPrefix + name)
+	switch {
+	case errors.Is(err, ErrNotExist):
+		return nil, fmt.Errorf("Could not read snapshot %q: %w", name, ErrNoSnapshot)
+	case err != nil:
+		return nil, fmt.Errorf("Could not read snapshot %q: %w", name, err)
+	}
+
+	data, err := repo.unseal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read snapshot %q: %w", name, err)
+	}
+	man, err := decodeManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read snapshot %q: %w", name, err)
+	}
+	if man.Name != name {
+		return nil, fmt.Errorf("Snapshot %q is named %q in its manifest: %w", name, man.Name, ErrCorrupt)
+	}
+	return man, nil
+}
+
+//putManifest stores a snapshot's manifest
+func (repo *Repository) putManifest(man *manifest) error {
+	data, err := man.encode()
+	if err != nil {
+		return err
+	}
+	obj, err := repo.seal(data)
+	if err != nil {
+		return fmt.Errorf("Could not store snapshot %q: %w", man.Name, err)
+	}
+	if err = repo.store.Put(snapshotPrefix+man.Name, obj); err != nil {
+		return fmt.Errorf("Could not store snapshot %q: %w", man.Name, err)
+	}
+	return nil
+}
+
+//snapshotNames lists the names of all snapshots
+func (repo *Repository) snapshotNames() ([]string, error) {
+	objNames, err := repo.store.List(snapshotPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list snapshots: %w", err)
+	}
+	names := make([]string, 0, len(objNames))
+	for _, objName := range objNames {
+		names = append(names, strings.TrimPrefix(objName, snapshotPrefix))
+	}
+	return names, nil
+}
+
+//Snapshots returns all snapshots in the repository, oldest first
+func (repo *Repository) Snapshots() ([]Snapshot, error) {
+	names, err := repo.snapshotNames()
+	if err != nil {
+		return nil, err
+	}
+	snaps := make([]Snapshot, 0, len(names))
+	for _, name := range names {
+		man, err := repo.loadManifest(name)
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, man.Snapshot)
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		if snaps[i].Created.Equal(snaps[j].Created) {
+			return snaps[i].Name < snaps[j].Name
+		}
+		return snaps[i].Created.Before(snaps[j].Created)
+	})
+	return snaps, nil
+}
+
+//Snapshot returns the named snapshot
+func (repo *Repository) Snapshot(name string) (Snapshot, error) {
+	man, err := repo.loadManifest(name)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return man.Snapshot, nil
+}
+
+//Forget deletes the named snapshot, chunks only it referenced remain in the
+// repository until it is pruned (see Prune)
+func (repo *Repository) Forget(name string) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	if _, err := repo.store.Get(snapshotPrefix + name); errors.Is(err, ErrNotExist) {
+		return fmt.Errorf("Could not forget snapshot %q: %w", name, ErrNoSnapshot)
+	} else if err != nil {
+		return fmt.Errorf("Could not forget snapshot %q: %w", name, err)
+	}
+	if err := repo.store.Delete(snapshotPrefix + name); err != nil {
+		return fmt.Errorf("Could not forget snapshot %q: %w", name, err)
+	}
+	return nil
+}
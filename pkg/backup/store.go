@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+
+	"github.com/graymeta/stow"
+)
+
+//ErrNotExist is returned by a Store when an object does not exist
+const ErrNotExist = consterr.ConstErr("Object does not exist")
+
+//Store holds the objects of a repository. Object names are slash separated paths.
+type Store interface {
+	//Get returns the contents of the named object, or ErrNotExist
+	Get(name string) ([]byte, error)
+	//Put creates or replaces the named object
+	Put(name string, data []byte) error
+	//Delete removes the named object
+	Delete(name string) error
+	//List returns the names of all objects starting with the provided prefix
+	List(prefix string) ([]string, error)
+}
+
+//dirStore is a Store keeping each object in a file beneath a directory
+type dirStore struct {
+	dir string
+}
+
+//NewDirStore constructs a Store keeping objects in files beneath the provided
+// directory, which is created if it does not exist
+func NewDirStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Could not create repository directory %q: %w", dir, err)
+	}
+	return dirStore{dir: dir}, nil
+}
+
+func (ds dirStore) path(name string) string {
+	return filepath.Join(ds.dir, filepath.FromSlash(name))
+}
+
+func (ds dirStore) Get(name string) ([]byte, error) {
+	data, err := os.ReadFile(ds.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("Could not read %q: %w", name, ErrNotExist)
+	}
+	return data, err
+}
+
+func (ds dirStore) Put(name string, data []byte) error {
+	path := ds.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Could not create directory for %q: %w", name, err)
+	}
+	return util.WriteFileAtomic(path, data, 0600)
+}
+
+func (ds dirStore) Delete(name string) error {
+	if err := os.Remove(ds.path(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (ds dirStore) List(prefix string) ([]string, error) {
+	//Only walk the deepest directory the prefix is within
+	root := ds.dir
+	if idx := strings.LastIndexByte(prefix, '/'); idx >= 0 {
+		root = ds.path(prefix[:idx])
+	}
+
+	var names []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		case entry.IsDir() || strings.HasPrefix(entry.Name(), "."): //Skip temporary files
+			return nil
+		}
+		rel, err := filepath.Rel(ds.dir, path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+//stowStore is a Store keeping each object as an item in a stow container
+type stowStore struct {
+	container stow.Container
+}
+
+//NewStowStore constructs a Store keeping objects as items in the provided container
+// of an object store
+func NewStowStore(container stow.Container) Store {
+	return stowStore{container: container}
+}
+
+func (ss stowStore) Get(name string) ([]byte, error) {
+	item, err := ss.container.Item(name)
+	if errors.Is(err, stow.ErrNotFound) {
+		return nil, fmt.Errorf("Could not read %q: %w", name, ErrNotExist)
+	} else if err != nil {
+		return nil, err
+	}
+
+	rdr, err := item.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	return io.ReadAll(rdr)
+}
+
+func (ss stowStore) Put(name string, data []byte) error {
+	_, err := ss.container.Put(name, bytes.NewReader(data), int64(len(data)), nil)
+	return err
+}
+
+func (ss stowStore) Delete(name string) error {
+	//Items are removed by ID, which for some kinds of store differs from their name
+	item, err := ss.container.Item(name)
+	if errors.Is(err, stow.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = ss.container.RemoveItem(item.ID()); err != nil && !errors.Is(err, stow.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (ss stowStore) List(prefix string) ([]string, error) {
+	var names []string
+	err := stow.Walk(ss.container, prefix, 1000, func(item stow.Item, err error) error {
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(item.Name()))
+		return nil
+	})
+	return names, err
+}
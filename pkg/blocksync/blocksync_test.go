@@ -0,0 +1,164 @@
+package blocksync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const (
+	sizeBytes  = 8*1024*1024 + 1000 //Not a multiple of the block size
+	blockBytes = 4096
+	fanout     = 8
+)
+
+func TestSync(t *testing.T) {
+	ctx := testutil.CreateContext(t)
+	rnd := rand.New(rand.NewSource(1))
+	options := []Option{OptBlockBytes(blockBytes), OptFanout(fanout)}
+
+	//The source is mostly random with some zeros, the destination is larger and
+	// starts as a copy of it
+	contents := make([]byte, sizeBytes)
+	rnd.Read(contents)
+	copy(contents[1024*1024:], make([]byte, 512*1024))
+	src, dst := ramdisk.NewRAMDisk(sizeBytes), ramdisk.NewRAMDisk(sizeBytes+1024*1024)
+	src.WriteAt(contents, 0)
+	dst.WriteAt(contents, 0)
+	expectDiff(t, src, dst, options, nil)
+
+	//A single differing block is found with few comparisons
+	dst.WriteAt([]byte{1}, 3*blockBytes+7)
+	extents, stats, err := Compare(ctx, src, dst, options...)
+	if err != nil {
+		t.Fatalf("Could not compare devices: %s", err)
+	}
+	if len(extents) != 1 || extents[0] != (Extent{Pos: 3 * blockBytes, Bytes: blockBytes}) {
+		t.Fatalf("Differing extents were not as expected: %+v", extents)
+	}
+	if maxComparisons := int64(fanout * 6); stats.Comparisons > maxComparisons {
+		t.Fatalf("Finding a single differing block took %d comparisons, more than %d", stats.Comparisons, maxComparisons)
+	}
+
+	//Differences including zeros in the source and the short last block
+	dst.WriteAt(bytes.Repeat([]byte{7}, 64*1024), 1024*1024-32*1024)
+	dst.WriteAt([]byte{1}, sizeBytes-1)
+	dst.WriteAt([]byte{1}, sizeBytes) //Beyond the source is ignored
+	expected := []Extent{
+		{Pos: 3 * blockBytes, Bytes: blockBytes},
+		{Pos: 1024*1024 - 32*1024, Bytes: 32 * 1024},
+		{Pos: 1024 * 1024, Bytes: 32 * 1024, Zero: true},
+		{Pos: sizeBytes - 1000, Bytes: 1000},
+	}
+	expectDiff(t, src, dst, options, expected)
+
+	syncStats, err := Sync(ctx, src, dst, options...)
+	if err != nil {
+		t.Fatalf("Could not sync devices: %s", err)
+	}
+	if syncStats.DifferingBytes != syncStats.CopiedBytes+syncStats.ZeroedBytes || syncStats.ZeroedBytes != 32*1024 || syncStats.DifferingBlocks != 18 {
+		t.Fatalf("Sync stats were not as expected: %+v", syncStats)
+	}
+	expectDiff(t, src, dst, options, nil)
+	actual := make([]byte, sizeBytes)
+	dst.ReadAt(actual, 0)
+	if !bytes.Equal(contents, actual) {
+		t.Fatalf("Destination does not match source after sync")
+	}
+
+	if _, _, err = Compare(ctx, dst, src, options...); err == nil {
+		t.Fatalf("Devices of different sizes were compared in the wrong order")
+	}
+}
+
+func expectDiff(t *testing.T, src, dst usbdlib.Device, options []Option, expected []Extent) {
+	t.Helper()
+
+	extents, _, err := Compare(testutil.CreateContext(t), src, dst, options...)
+	if err != nil {
+		t.Fatalf("Could not compare devices: %s", err)
+	}
+	if len(extents) != len(expected) {
+		t.Fatalf("Differing extents were %+v rather than %+v", extents, expected)
+	}
+	for i := range extents {
+		if extents[i] != expected[i] {
+			t.Fatalf("Differing extents were %+v rather than %+v", extents, expected)
+		}
+	}
+}
+
+//eofDev returns io.EOF with reads that end at the end of the device, as
+// io.ReaderAt allows
+type eofDev struct {
+	usbdlib.Device
+}
+
+func (dev eofDev) ReadAt(buf []byte, pos int64) (int, error) {
+	n, err := dev.Device.ReadAt(buf, pos)
+	if err == nil && pos+int64(n) == dev.Size() {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func TestTree(t *testing.T) {
+	ctx := testutil.CreateContext(t)
+	rnd := rand.New(rand.NewSource(2))
+	contents := make([]byte, sizeBytes)
+	rnd.Read(contents)
+	dev := ramdisk.NewRAMDisk(sizeBytes)
+	dev.WriteAt(contents, 0)
+
+	tree, err := BuildTree(ctx, dev, OptBlockBytes(blockBytes), OptFanout(fanout), OptConcurrency(3))
+	if err != nil {
+		t.Fatalf("Could not build hash tree: %s", err)
+	}
+	if tree.Blocks() != sizeBytes/blockBytes+1 || tree.Length() != sizeBytes || tree.BlockBytes() != blockBytes || tree.Fanout() != fanout {
+		t.Fatalf("Hash tree was not as expected: %d blocks of %d bytes", tree.Blocks(), tree.BlockBytes())
+	}
+
+	//Saved trees are the same once loaded
+	var buf bytes.Buffer
+	if _, err = tree.WriteTo(&buf); err != nil {
+		t.Fatalf("Could not save hash tree: %s", err)
+	}
+	saved := buf.Bytes()
+	loaded, err := ReadTree(bytes.NewReader(saved))
+	if err != nil {
+		t.Fatalf("Could not load hash tree: %s", err)
+	}
+	if loaded.Root() != tree.Root() {
+		t.Fatalf("Loaded hash tree has a different root")
+	}
+	if _, stats, err := Diff(tree, loaded); err != nil || stats.DifferingBlocks != 0 || stats.Comparisons != 1 {
+		t.Fatalf("Loaded hash tree differs: %+v, %v", stats, err)
+	}
+
+	saved[len(saved)/2] ^= 1
+	if _, err = ReadTree(bytes.NewReader(saved)); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Loading a corrupt hash tree returned %v rather than %s", err, ErrCorrupt)
+	}
+
+	//Devices may return io.EOF with reads that end at the end of the device
+	eofTree, err := BuildTree(ctx, eofDev{dev}, OptBlockBytes(blockBytes), OptFanout(fanout))
+	if err != nil {
+		t.Fatalf("Could not build hash tree of device returning io.EOF: %s", err)
+	} else if eofTree.Root() != tree.Root() {
+		t.Fatalf("Hash tree of device returning io.EOF has a different root")
+	}
+
+	other, err := BuildTree(ctx, dev, OptBlockBytes(2*blockBytes), OptFanout(fanout))
+	if err != nil {
+		t.Fatalf("Could not build hash tree: %s", err)
+	}
+	if _, _, err = Diff(tree, other); err == nil {
+		t.Fatalf("Hash trees of different block sizes were compared")
+	}
+}
@@ -0,0 +1,138 @@
+package blocksync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+//Extent is a run of blocks that differ between two devices
+type Extent struct {
+	Pos   int64
+	Bytes int64
+	Zero  bool //The source is all zeros here
+}
+
+//DiffStats describes the differences found between two hash trees
+type DiffStats struct {
+	Blocks          int64 //Compared
+	DifferingBlocks int64
+	DifferingBytes  int64
+	ZeroBytes       int64 //Differing bytes that are zeros in the source
+	Comparisons     int64 //Of hashes needed to find the differences
+}
+
+//Diff compares the hash tree of a source device to that of a destination and
+// returns the extents of the source that differ. Only nodes whose hashes differ
+// are descended into, so finding c differing blocks of n takes O(c*log(n))
+// comparisons. The trees must have the same block size and fanout; they are
+// compared over the length of the source tree and blocks the destination tree
+// does not have in full are differing.
+func Diff(src, dst *Tree) ([]Extent, DiffStats, error) {
+	switch {
+	case src.blockBytes != dst.blockBytes:
+		return nil, DiffStats{}, fmt.Errorf("Hash trees of %d and %d byte blocks can not be compared", src.blockBytes, dst.blockBytes)
+	case src.fanout != dst.fanout:
+		return nil, DiffStats{}, fmt.Errorf("Hash trees with fanouts of %d and %d can not be compared", src.fanout, dst.fanout)
+	}
+
+	stats := DiffStats{Blocks: src.Blocks()}
+	zeroFull, zeroTail := src.zeroHashes()
+	var extents []Extent
+	addBlock := func(block int64) {
+		length := src.blockLen(block)
+		zero := src.levels[0][block] == zeroFull || (length < src.blockBytes && src.levels[0][block] == zeroTail)
+		pos := block * src.blockBytes
+		stats.DifferingBlocks++
+		stats.DifferingBytes += length
+		if zero {
+			stats.ZeroBytes += length
+		}
+		if last := len(extents) - 1; last >= 0 && extents[last].Zero == zero && extents[last].Pos+extents[last].Bytes == pos {
+			extents[last].Bytes += length
+			return
+		}
+		extents = append(extents, Extent{Pos: pos, Bytes: length, Zero: zero})
+	}
+
+	var walk func(level int, idx int64)
+	walk = func(level int, idx int64) {
+		if level < len(dst.levels) && idx < int64(len(dst.levels[level])) && !dst.partial(level, idx, src.length) {
+			stats.Comparisons++
+			if src.levels[level][idx] == dst.levels[level][idx] {
+				return
+			}
+		}
+		if level == 0 {
+			addBlock(idx)
+			return
+		}
+		first, end := idx*int64(src.fanout), (idx+1)*int64(src.fanout)
+		if below := int64(len(src.levels[level-1])); end > below {
+			end = below
+		}
+		for child := first; child < end; child++ {
+			walk(level-1, child)
+		}
+	}
+	if src.Blocks() > 0 {
+		walk(len(src.levels)-1, 0)
+	}
+	return extents, stats, nil
+}
+
+//partial returns if the provided node covers a different part of the device than
+// the node of a tree of the provided length, so can not be compared with it
+func (tree *Tree) partial(level int, idx int64, length int64) bool {
+	if tree.length == length {
+		return false
+	}
+	span := tree.blockBytes
+	for i := 0; i < level; i++ {
+		span *= int64(tree.fanout)
+	}
+	end := (idx + 1) * span
+	return end > tree.length || end > length
+}
+
+//Compare builds the hash trees of the source device and of the same length of
+// the destination device, concurrently, and returns the extents of the source
+// that differ; see Diff
+func Compare(ctx context.Context, src, dst usbdlib.Device, options ...Option) ([]Extent, DiffStats, error) {
+	srcTree, dstTree, err := buildTrees(ctx, src, dst, options)
+	if err != nil {
+		return nil, DiffStats{}, err
+	}
+	return Diff(srcTree, dstTree)
+}
+
+func buildTrees(ctx context.Context, src, dst usbdlib.Device, options []Option) (srcTree, dstTree *Tree, err error) {
+	if dst.Size() < src.Size() {
+		return nil, nil, fmt.Errorf("Destination device of %d bytes is smaller than the %d byte source device", dst.Size(), src.Size())
+	}
+	options = append(append([]Option(nil), options...), OptLength(src.Size()))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dstDone := make(chan error, 1)
+	go func() {
+		var err error
+		dstTree, err = BuildTree(ctx, dst, options...)
+		if err != nil {
+			cancel()
+			err = fmt.Errorf("Could not hash destination device: %w", err)
+		}
+		dstDone <- err
+	}()
+	srcTree, err = BuildTree(ctx, src, options...)
+	if err != nil {
+		cancel()
+		<-dstDone
+		return nil, nil, fmt.Errorf("Could not hash source device: %w", err)
+	}
+	if err = <-dstDone; err != nil {
+		return nil, nil, err
+	}
+	return srcTree, dstTree, nil
+}
@@ -0,0 +1,46 @@
+package blocksync
+
+//Option is a hash tree or sync option
+type Option interface {
+	apply(*config)
+}
+
+type config struct {
+	blockBytes  int64
+	fanout      int
+	length      int64 //Negative for the whole device
+	concurrency int
+}
+
+//OptBlockBytes instructs BuildTree to hash blocks of the provided size, the
+// default is DefBlockBytes. Differences are found, and copied, at this
+// granularity.
+type OptBlockBytes int64
+
+func (size OptBlockBytes) apply(cfg *config) {
+	cfg.blockBytes = int64(size)
+}
+
+//OptFanout instructs BuildTree to hash this many nodes of each level of the tree
+// into each node of the level above, the default is DefFanout
+type OptFanout int
+
+func (fanout OptFanout) apply(cfg *config) {
+	cfg.fanout = int(fanout)
+}
+
+//OptLength instructs BuildTree to hash only the first bytes of the device, the
+// default is the whole device
+type OptLength int64
+
+func (length OptLength) apply(cfg *config) {
+	cfg.length = int64(length)
+}
+
+//OptConcurrency instructs BuildTree and Sync to issue up to this many reads or
+// writes at once, the default is the number of CPUs
+type OptConcurrency int
+
+func (count OptConcurrency) apply(cfg *config) {
+	cfg.concurrency = int(count)
+}
@@ -0,0 +1,89 @@
+package blocksync
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+//SyncStats describes the differences found and copied by Sync
+type SyncStats struct {
+	DiffStats
+	CopiedBytes int64 //Read from the source and written to the destination
+	ZeroedBytes int64 //Written to the destination as zeros without reading the source
+}
+
+//Sync makes the start of the destination device, up to the size of the source
+// device, the same as the source by copying only the blocks that differ, as
+// found by Compare. Differing blocks that are zeros in the source are written
+// as zeros without being read again. The destination is flushed once the copy
+// completes. The source must not be written to during the sync.
+func Sync(ctx context.Context, src, dst usbdlib.Device, options ...Option) (SyncStats, error) {
+	extents, diffStats, err := Compare(ctx, src, dst, options...)
+	if err != nil {
+		return SyncStats{}, err
+	}
+	stats := SyncStats{DiffStats: diffStats}
+	if err = Apply(ctx, src, dst, extents, &stats, options...); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+//Apply copies the provided extents of the source device to the destination
+// device, as returned by Diff, and then flushes the destination. The bytes
+// copied and zeroed are added to stats as they are written.
+func Apply(ctx context.Context, src, dst usbdlib.Device, extents []Extent, stats *SyncStats, options ...Option) error {
+	cfg := newConfig(options)
+
+	//Extents are split into runs of at most readBytes so they can be copied
+	// concurrently
+	type run struct {
+		pos, bytes int64
+		zero       bool
+	}
+	var runs []run
+	for _, ext := range extents {
+		for pos, end := ext.Pos, ext.Pos+ext.Bytes; pos < end; pos += readBytes {
+			length := end - pos
+			if length > readBytes {
+				length = readBytes
+			}
+			runs = append(runs, run{pos: pos, bytes: length, zero: ext.Zero})
+		}
+	}
+
+	zeros := make([]byte, readBytes)
+	err := forEach(ctx, int64(len(runs)), cfg.concurrency, func() func(int64) error {
+		buf := make([]byte, readBytes)
+		return func(idx int64) error {
+			r := runs[idx]
+			if r.zero {
+				if _, err := dst.WriteAt(zeros[:r.bytes], r.pos); err != nil {
+					return fmt.Errorf("Could not write %d bytes of zeros at %d to destination: %w", r.bytes, r.pos, err)
+				}
+				atomic.AddInt64(&stats.ZeroedBytes, r.bytes)
+				return nil
+			}
+
+			data := buf[:r.bytes]
+			if _, err := src.ReadAt(data, r.pos); err != nil {
+				return fmt.Errorf("Could not read %d bytes at %d from source: %w", r.bytes, r.pos, err)
+			}
+			if _, err := dst.WriteAt(data, r.pos); err != nil {
+				return fmt.Errorf("Could not write %d bytes at %d to destination: %w", r.bytes, r.pos, err)
+			}
+			atomic.AddInt64(&stats.CopiedBytes, r.bytes)
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err = dst.Flush(); err != nil {
+		return fmt.Errorf("Could not flush destination: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package blocksync
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	//ErrCorrupt is returned when a saved hash tree is damaged
+	ErrCorrupt = consterr.ConstErr("Hash tree is corrupt")
+
+	//DefBlockBytes is the default size of the blocks hashed
+	DefBlockBytes = 64 * 1024
+	//DefFanout is the default number of nodes hashed into each node of the level
+	// above
+	DefFanout = 16
+
+	treeMagic = "USBDHTR1"
+	readBytes = 1024 * 1024 //Blocks are read in runs of about this size
+)
+
+//Hash of a block or of the hashes of the nodes beneath a node of a Tree
+type Hash [sha256.Size]byte
+
+//Tree is a hash tree of the contents of a device: the leaves are the hashes of
+// each block and each node above them is the hash of up to fanout nodes beneath
+// it. The trees of two devices can be compared to find the blocks that differ
+// without comparing most of their hashes.
+type Tree struct {
+	blockBytes int64
+	fanout     int
+	length     int64
+	levels     [][]Hash //Leaves first, the root is last
+}
+
+//BuildTree reads the provided device and builds its hash tree. Blocks of zeros
+// are recognized without hashing them.
+func BuildTree(ctx context.Context, dev usbdlib.Device, options ...Option) (*Tree, error) {
+	cfg := newConfig(options)
+	if cfg.length < 0 || cfg.length > dev.Size() {
+		cfg.length = dev.Size()
+	}
+	tree, err := newTree(cfg.blockBytes, cfg.fanout, cfg.length)
+	if err != nil {
+		return nil, err
+	}
+
+	leaves := tree.levels[0]
+	blocks := int64(len(leaves))
+	runBlocks := readBytes / tree.blockBytes
+	if runBlocks < 1 {
+		runBlocks = 1
+	}
+	runs := (blocks + runBlocks - 1) / runBlocks
+	zeroFull, zeroTail := tree.zeroHashes()
+
+	err = forEach(ctx, runs, cfg.concurrency, func() func(int64) error {
+		buf := make([]byte, runBlocks*tree.blockBytes)
+		return func(run int64) error {
+			pos := run * runBlocks * tree.blockBytes
+			data := buf
+			if remaining := tree.length - pos; remaining < int64(len(data)) {
+				data = data[:remaining]
+			}
+			if n, err := dev.ReadAt(data, pos); err != nil && !(err == io.EOF && n == len(data)) {
+				return fmt.Errorf("Could not read %d bytes at %d: %w", len(data), pos, err)
+			}
+			for block := run * runBlocks; len(data) > 0; block++ {
+				blockData := data
+				if int64(len(blockData)) > tree.blockBytes {
+					blockData = blockData[:tree.blockBytes]
+				}
+				switch {
+				case !util.IsZeros(blockData):
+					leaves[block] = sha256.Sum256(blockData)
+				case int64(len(blockData)) == tree.blockBytes:
+					leaves[block] = zeroFull
+				default:
+					leaves[block] = zeroTail
+				}
+				data = data[len(blockData):]
+			}
+			return nil
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not build hash tree: %w", err)
+	}
+	tree.buildLevels()
+	return tree, nil
+}
+
+func newConfig(options []Option) config {
+	cfg := config{
+		blockBytes:  DefBlockBytes,
+		fanout:      DefFanout,
+		length:      -1,
+		concurrency: runtime.NumCPU(),
+	}
+	for _, opt := range options {
+		opt.apply(&cfg)
+	}
+	if cfg.concurrency < 1 {
+		cfg.concurrency = 1
+	}
+	return cfg
+}
+
+//newTree constructs a tree with space for its leaves
+func newTree(blockBytes int64, fanout int, length int64) (*Tree, error) {
+	switch {
+	case blockBytes < 1:
+		return nil, fmt.Errorf("Block size must be at least one byte")
+	case fanout < 2:
+		return nil, fmt.Errorf("Fanout must be at least 2")
+	case length < 0:
+		return nil, fmt.Errorf("Length can not be negative")
+	}
+	tree := &Tree{blockBytes: blockBytes, fanout: fanout, length: length}
+	tree.levels = [][]Hash{make([]Hash, (length+blockBytes-1)/blockBytes)}
+	return tree, nil
+}
+
+//buildLevels hashes the leaves into the levels above them
+func (tree *Tree) buildLevels() {
+	tree.levels = tree.levels[:1]
+	buf := make([]byte, 0, tree.fanout*len(Hash{}))
+	for below := tree.levels[0]; len(below) > 1; below = tree.levels[len(tree.levels)-1] {
+		level := make([]Hash, (len(below)+tree.fanout-1)/tree.fanout)
+		for i := range level {
+			children := below[i*tree.fanout:]
+			if len(children) > tree.fanout {
+				children = children[:tree.fanout]
+			}
+			buf = buf[:0]
+			for _, child := range children {
+				buf = append(buf, child[:]...)
+			}
+			level[i] = sha256.Sum256(buf)
+		}
+		tree.levels = append(tree.levels, level)
+	}
+}
+
+//zeroHashes returns the hashes of a block of zeros and of the final block if
+// it is all zeros
+func (tree *Tree) zeroHashes() (full, tail Hash) {
+	zeros := make([]byte, tree.blockBytes)
+	full, tail = sha256.Sum256(zeros), sha256.Sum256(zeros[:tree.blockLen(tree.Blocks()-1)])
+	return full, tail
+}
+
+//blockLen returns the length of the provided block
+func (tree *Tree) blockLen(block int64) int64 {
+	if remaining := tree.length - block*tree.blockBytes; remaining < tree.blockBytes {
+		return remaining
+	}
+	return tree.blockBytes
+}
+
+//BlockBytes returns the size of the blocks hashed
+func (tree *Tree) BlockBytes() int64 {
+	return tree.blockBytes
+}
+
+//Fanout returns the number of nodes hashed into each node of the level above
+func (tree *Tree) Fanout() int {
+	return tree.fanout
+}
+
+//Length returns the number of bytes of the device hashed
+func (tree *Tree) Length() int64 {
+	return tree.length
+}
+
+//Blocks returns the number of blocks hashed, the last may be short
+func (tree *Tree) Blocks() int64 {
+	return int64(len(tree.levels[0]))
+}
+
+//Root returns the hash at the root of the tree, which two trees have in common
+// only if the contents hashed are the same
+func (tree *Tree) Root() Hash {
+	top := tree.levels[len(tree.levels)-1]
+	if len(top) == 0 {
+		return Hash{}
+	}
+	return top[0]
+}
+
+//WriteTo saves the tree to the provided writer, fulfilling io.WriterTo, so the
+// tree of a device can be compared without reading it again
+func (tree *Tree) WriteTo(w io.Writer) (int64, error) {
+	digest := sha256.New()
+	bufWtr := bufio.NewWriter(io.MultiWriter(w, digest))
+	var header [len(treeMagic) + 20]byte
+	copy(header[:], treeMagic)
+	binary.BigEndian.PutUint64(header[len(treeMagic):], uint64(tree.blockBytes))
+	binary.BigEndian.PutUint32(header[len(treeMagic)+8:], uint32(tree.fanout))
+	binary.BigEndian.PutUint64(header[len(treeMagic)+12:], uint64(tree.length))
+	bufWtr.Write(header[:])
+	for _, leaf := range tree.levels[0] {
+		bufWtr.Write(leaf[:])
+	}
+	if err := bufWtr.Flush(); err != nil {
+		return 0, fmt.Errorf("Could not write hash tree: %w", err)
+	}
+	if _, err := w.Write(digest.Sum(nil)); err != nil {
+		return 0, fmt.Errorf("Could not write hash tree: %w", err)
+	}
+	return int64(len(header)) + int64(len(tree.levels[0])+1)*int64(len(Hash{})), nil
+}
+
+//ReadTree loads a tree saved by WriteTo
+func ReadTree(r io.Reader) (*Tree, error) {
+	digest := sha256.New()
+	bufRdr := io.TeeReader(bufio.NewReader(r), digest)
+	var header [len(treeMagic) + 20]byte
+	if _, err := io.ReadFull(bufRdr, header[:]); err != nil {
+		return nil, fmt.Errorf("Could not read hash tree header: %w", err)
+	}
+	if string(header[:len(treeMagic)]) != treeMagic {
+		return nil, fmt.Errorf("Not a hash tree: %w", ErrCorrupt)
+	}
+	blockBytes := int64(binary.BigEndian.Uint64(header[len(treeMagic):]))
+	fanout := int(binary.BigEndian.Uint32(header[len(treeMagic)+8:]))
+	length := int64(binary.BigEndian.Uint64(header[len(treeMagic)+12:]))
+	if blockBytes < 1 || length < 0 || length/blockBytes > 1<<40 {
+		return nil, fmt.Errorf("Hash tree header is not valid: %w", ErrCorrupt)
+	}
+	tree, err := newTree(blockBytes, fanout, length)
+	if err != nil {
+		return nil, fmt.Errorf("Hash tree header is not valid: %s: %w", err, ErrCorrupt)
+	}
+
+	for i := range tree.levels[0] {
+		if _, err = io.ReadFull(bufRdr, tree.levels[0][i][:]); err != nil {
+			return nil, fmt.Errorf("Could not read hash tree: %w", err)
+		}
+	}
+	expected, actual := digest.Sum(nil), make([]byte, sha256.Size)
+	if _, err = io.ReadFull(bufRdr, actual); err != nil {
+		return nil, fmt.Errorf("Could not read hash tree checksum: %w", err)
+	}
+	if string(expected) != string(actual) {
+		return nil, fmt.Errorf("Hash tree checksum does not match: %w", ErrCorrupt)
+	}
+	tree.buildLevels()
+	return tree, nil
+}
+
+//forEach concurrently invokes a function made by each worker for every index
+// less than count. The first error, or the context being done, stops further
+// invocations and is returned.
+func forEach(ctx context.Context, count int64, workers int, newWorker func() func(int64) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		next     int64 = -1
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	worker := func() {
+		defer wg.Done()
+		fn := newWorker()
+		for ctx.Err() == nil {
+			idx := atomic.AddInt64(&next, 1)
+			if idx >= count {
+				return
+			}
+			if err := fn(idx); err != nil {
+				errOnce.Do(func() { firstErr = err })
+				cancel()
+				return
+			}
+		}
+	}
+
+	if int64(workers) > count {
+		workers = int(count)
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go worker()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
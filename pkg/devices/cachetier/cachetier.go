@@ -0,0 +1,684 @@
+package cachetier
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed = consterr.ConstErr("Device is shutdown")
+
+	//DefBlockBytes is the default size of cached blocks
+	DefBlockBytes = 64 * 1024
+	//DefSequentialCutoff is the default length of sequential streams that bypass the cache
+	DefSequentialCutoff = 4 * 1024 * 1024
+	//DefWritebackPercent is the default percentage of dirty blocks retained in the cache
+	DefWritebackPercent = 10
+	//DefDirtyMaxPercent is the default percentage of dirty blocks at which writes are throttled
+	DefDirtyMaxPercent = 50
+
+	lockStripes = 256
+)
+
+type slotState uint8
+
+const (
+	slotFree slotState = iota
+	slotValid
+	slotReleasing //Evicted, free once the metadata no longer records it
+)
+
+type slot struct {
+	block      int64
+	pins       int32
+	state      slotState
+	dirty, ref bool
+}
+
+//Stats describes the state and effectiveness of a cache tier
+type Stats struct {
+	Mode         Mode
+	Slots        int64
+	CachedBlocks int64
+	DirtyBlocks  int64
+	Hits         int64
+	Misses       int64
+	Bypassed     int64
+	WrittenBack  int64
+}
+
+//CacheTier is a device placing a fast cache device in front of a slow backing
+// device. The backing device is cached in blocks held in slots of the cache device
+// which are replaced using the CLOCK algorithm. Which block each slot holds is
+// persisted to a metadata file whenever the device is flushed (and as needed to
+// reuse evicted slots) so that the cache, including dirty blocks, survives restarts.
+type CacheTier struct {
+	backing, cache   usbdlib.Device
+	metaFile         string
+	size, blockBytes int64
+	blockCount       int64
+	atomicMode       uint32
+	writebackPercent int
+	dirtyMaxPercent  int
+	writebackRate    int64
+	seq              seqDetector
+	blockLocks       [lockStripes]sync.RWMutex
+	ioMu             sync.RWMutex //Held exclusively to close or detach
+	persistMu        sync.Mutex
+	atomicOnline     uint64
+
+	mu                           sync.Mutex
+	slots                        []slot
+	index                        map[int64]int32
+	free, releasing              []int32
+	clockHand, writebackHand     int
+	dirtyCount                   int64
+	backingDirty                 bool
+	cleaned                      *sync.Cond //Broadcast as dirty blocks are written back
+	hits, misses, bypassed       int64
+	writtenBack                  int64
+	writebackKick, writebackStop chan struct{}
+	writebackUrgent              chan struct{} //Writes are being throttled
+	writebackDone                chan struct{}
+}
+
+var _ usbdlib.Device = (*CacheTier)(nil)
+
+//NewCacheTier constructs a cache tier caching the backing device on the cache
+// device. If a metadata file is provided the cache index is loaded from it, if it
+// exists, and persisted to it; otherwise the cache is volatile and all dirty blocks
+// are written back when the device is closed. The device owns both the backing and
+// cache devices and closes them when it is closed.
+func NewCacheTier(backing, cache usbdlib.Device, metaFile string, options ...Option) (*CacheTier, error) {
+	dev := &CacheTier{
+		backing:          backing,
+		cache:            cache,
+		metaFile:         metaFile,
+		size:             backing.Size(),
+		blockBytes:       DefBlockBytes,
+		atomicMode:       uint32(ModeWriteBack),
+		writebackPercent: DefWritebackPercent,
+		dirtyMaxPercent:  DefDirtyMaxPercent,
+		atomicOnline:     1,
+		seq:              seqDetector{cutoff: DefSequentialCutoff},
+		writebackKick:    make(chan struct{}, 1),
+		writebackUrgent:  make(chan struct{}, 1),
+		writebackStop:    make(chan struct{}),
+		writebackDone:    make(chan struct{}),
+	}
+	for _, opt := range options {
+		opt.apply(dev)
+	}
+	dev.cleaned = sync.NewCond(&dev.mu)
+
+	slotCount := cache.Size() / dev.blockBytes
+	switch {
+	case dev.blockBytes < 1 || dev.blockBytes%backing.BlockSize() != 0 || dev.blockBytes%cache.BlockSize() != 0:
+		return nil, fmt.Errorf("Block size %d is not a multiple of the backing and cache device block sizes (%d and %d)", dev.blockBytes, backing.BlockSize(), cache.BlockSize())
+	case slotCount < 1:
+		return nil, fmt.Errorf("Cache device of %d bytes is smaller than a single %d byte block", cache.Size(), dev.blockBytes)
+	case Mode(dev.atomicMode) > ModeWriteAround:
+		return nil, fmt.Errorf("Unknown cache mode %d", dev.atomicMode)
+	case dev.dirtyMaxPercent < 1 || dev.dirtyMaxPercent > 100:
+		return nil, fmt.Errorf("Maximum dirty percentage %d is not between 1 and 100", dev.dirtyMaxPercent)
+	case dev.writebackPercent < 0 || dev.writebackPercent >= dev.dirtyMaxPercent:
+		return nil, fmt.Errorf("Writeback percentage %d is not between 0 and the maximum dirty percentage %d", dev.writebackPercent, dev.dirtyMaxPercent)
+	}
+
+	dev.blockCount = (dev.size + dev.blockBytes - 1) / dev.blockBytes
+	dev.slots, dev.index = make([]slot, slotCount), make(map[int64]int32)
+	dev.free = make([]int32, slotCount)
+	for i := range dev.slots {
+		dev.slots[i].block, dev.free[i] = -1, int32(i)
+	}
+
+	if metaFile != "" {
+		if err := dev.loadMeta(); err != nil {
+			return nil, err
+		}
+		if err := dev.persist(false); err != nil { //Record that the cache is in use
+			return nil, err
+		}
+	}
+
+	go dev.writebackLoop()
+	if dev.dirtyCount > dev.writebackTarget() {
+		dev.kickWriteback()
+	}
+	return dev, nil
+}
+
+//Size of this device in bytes
+func (dev *CacheTier) Size() int64 {
+	return dev.size
+}
+
+//BlockSize of this device is that of the backing device
+func (dev *CacheTier) BlockSize() int64 {
+	return dev.backing.BlockSize()
+}
+
+//Mode returns the current cache mode
+func (dev *CacheTier) Mode() Mode {
+	return Mode(atomic.LoadUint32(&dev.atomicMode))
+}
+
+//SetMode changes the cache mode, dirty blocks cached in write-back mode continue to
+// be written back after changing to another mode
+func (dev *CacheTier) SetMode(mode Mode) error {
+	if mode > ModeWriteAround {
+		return fmt.Errorf("Unknown cache mode %d", mode)
+	}
+	atomic.StoreUint32(&dev.atomicMode, uint32(mode))
+	if mode != ModeWriteBack {
+		dev.kickWriteback()
+	}
+	return nil
+}
+
+//Stats returns the current state of the cache
+func (dev *CacheTier) Stats() Stats {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	return Stats{
+		Mode:         dev.Mode(),
+		Slots:        int64(len(dev.slots)),
+		CachedBlocks: int64(len(dev.index)),
+		DirtyBlocks:  dev.dirtyCount,
+		Hits:         dev.hits,
+		Misses:       dev.misses,
+		Bypassed:     dev.bypassed,
+		WrittenBack:  dev.writtenBack,
+	}
+}
+
+//blockLen returns the length of a block, the final block may be short
+func (dev *CacheTier) blockLen(idx int64) int64 {
+	if end := (idx + 1) * dev.blockBytes; end > dev.size {
+		return dev.size - idx*dev.blockBytes
+	}
+	return dev.blockBytes
+}
+
+//eachBlock invokes the provided function for each block spanned by a range with
+// the block number, the offset within the block and the portion of the buffer
+func (dev *CacheTier) eachBlock(buf []byte, pos int64, fn func(idx, offset int64, part []byte) error) (count int, err error) {
+	for count < len(buf) {
+		idx, offset := (pos+int64(count))/dev.blockBytes, (pos+int64(count))%dev.blockBytes
+		n := len(buf) - count
+		if remaining := dev.blockBytes - offset; int64(n) > remaining {
+			n = int(remaining)
+		}
+		if err = fn(idx, offset, buf[count:count+n]); err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (dev *CacheTier) ReadAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case pos >= dev.size:
+		return 0, io.EOF
+	}
+	var eof error
+	if end := pos + int64(len(buf)); end > dev.size {
+		buf, eof = buf[:dev.size-pos], io.EOF
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	bypass := dev.seq.observe(pos, int64(len(buf)))
+	count, err = dev.eachBlock(buf, pos, func(idx, offset int64, part []byte) error {
+		return dev.readBlock(idx, offset, part, bypass)
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, eof
+}
+
+func (dev *CacheTier) readBlock(idx, offset int64, part []byte, bypass bool) error {
+	lock := &dev.blockLocks[idx%lockStripes]
+	lock.RLock()
+	if sl, hit := dev.pin(idx); hit {
+		err := dev.readSlot(sl, offset, part)
+		dev.unpin(sl)
+		lock.RUnlock()
+		return err
+	}
+	lock.RUnlock()
+
+	if bypass {
+		dev.count(&dev.bypassed)
+		return readFull(dev.backing, part, idx*dev.blockBytes+offset)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if sl, hit := dev.pin(idx); hit { //Filled while unlocked
+		defer dev.unpin(sl)
+		return dev.readSlot(sl, offset, part)
+	}
+	dev.count(&dev.misses)
+
+	sl, allocated := dev.allocate()
+	if !allocated {
+		return readFull(dev.backing, part, idx*dev.blockBytes+offset)
+	}
+	block := make([]byte, dev.blockLen(idx))
+	if err := readFull(dev.backing, block, idx*dev.blockBytes); err != nil {
+		dev.unallocate(sl)
+		return err
+	}
+	if err := dev.writeSlot(sl, 0, block); err != nil {
+		dev.unallocate(sl)
+		return err
+	}
+	dev.install(sl, idx, false)
+	copy(part, block[offset:])
+	return nil
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (dev *CacheTier) WriteAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case pos+int64(len(buf)) > dev.size:
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	bypass := dev.seq.observe(pos, int64(len(buf)))
+	return dev.eachBlock(buf, pos, func(idx, offset int64, part []byte) error {
+		return dev.writeBlock(idx, offset, part, bypass)
+	})
+}
+
+//writeBlock writes within a single block. Blocks that are already cached are
+// always updated in the cache (and unless dirty or in write-back mode, also the
+// backing device). Uncached blocks are only cached by write-back writes, and full
+// block write-through writes, that are not bypassing the cache.
+func (dev *CacheTier) writeBlock(idx, offset int64, part []byte, bypass bool) error {
+	mode := dev.Mode()
+	if mode == ModeWriteBack {
+		dev.throttle(idx)
+	}
+
+	lock := &dev.blockLocks[idx%lockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	pos := idx*dev.blockBytes + offset
+	if sl, hit := dev.pin(idx); hit {
+		defer dev.unpin(sl)
+		if mode != ModeWriteBack && !dev.isDirty(sl) {
+			if err := dev.writeBacking(part, pos); err != nil {
+				return err
+			}
+			return dev.updateSlot(sl, offset, part, false)
+		}
+		return dev.updateSlot(sl, offset, part, true)
+	}
+
+	full := int64(len(part)) == dev.blockLen(idx)
+	switch {
+	case bypass:
+		dev.count(&dev.bypassed)
+		return dev.writeBacking(part, pos)
+	case mode == ModeWriteAround || (mode == ModeWriteThrough && !full):
+		dev.count(&dev.misses)
+		return dev.writeBacking(part, pos)
+	}
+	dev.count(&dev.misses)
+
+	if mode == ModeWriteThrough {
+		if err := dev.writeBacking(part, pos); err != nil {
+			return err
+		}
+	}
+	sl, allocated := dev.allocate()
+	if !allocated { //Nothing can be evicted, write-through instead
+		if mode == ModeWriteThrough {
+			return nil
+		}
+		return dev.writeBacking(part, pos)
+	}
+
+	block := part
+	if !full {
+		block = make([]byte, dev.blockLen(idx))
+		if err := readFull(dev.backing, block, idx*dev.blockBytes); err != nil {
+			dev.unallocate(sl)
+			return err
+		}
+		copy(block[offset:], part)
+	}
+	if err := dev.writeSlot(sl, 0, block); err != nil {
+		dev.unallocate(sl)
+		return err
+	}
+	dev.install(sl, idx, mode == ModeWriteBack)
+	return nil
+}
+
+func (dev *CacheTier) writeBacking(part []byte, pos int64) error {
+	if _, err := dev.backing.WriteAt(part, pos); err != nil {
+		return fmt.Errorf("Could not write %d bytes at offset %d of backing device: %w", len(part), pos, err)
+	}
+	dev.mu.Lock()
+	dev.backingDirty = true
+	dev.mu.Unlock()
+	return nil
+}
+
+//updateSlot writes to a cached block, marking it dirty if requested
+func (dev *CacheTier) updateSlot(sl int32, offset int64, part []byte, dirty bool) error {
+	if err := dev.writeSlot(sl, offset, part); err != nil {
+		return err
+	}
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	slt := &dev.slots[sl]
+	if dirty && !slt.dirty {
+		slt.dirty = true
+		dev.dirtyCount++
+		if dev.dirtyCount > dev.writebackTarget() {
+			dev.kickWriteback()
+		}
+	}
+	return nil
+}
+
+func (dev *CacheTier) readSlot(sl int32, offset int64, part []byte) error {
+	if err := readFull(dev.cache, part, int64(sl)*dev.blockBytes+offset); err != nil {
+		return fmt.Errorf("Could not read cache slot %d: %w", sl, err)
+	}
+	return nil
+}
+
+func (dev *CacheTier) writeSlot(sl int32, offset int64, part []byte) error {
+	if _, err := dev.cache.WriteAt(part, int64(sl)*dev.blockBytes+offset); err != nil {
+		return fmt.Errorf("Could not write cache slot %d: %w", sl, err)
+	}
+	return nil
+}
+
+func readFull(src io.ReaderAt, buf []byte, pos int64) error {
+	if n, err := src.ReadAt(buf, pos); err != nil && !(err == io.EOF && n == len(buf)) {
+		return fmt.Errorf("Could not read %d bytes at offset %d: %w", len(buf), pos, err)
+	}
+	return nil
+}
+
+func (dev *CacheTier) count(counter *int64) {
+	dev.mu.Lock()
+	*counter++
+	dev.mu.Unlock()
+}
+
+//pin returns the slot caching a block, if any, preventing its eviction until unpinned
+func (dev *CacheTier) pin(idx int64) (int32, bool) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	sl, hit := dev.index[idx]
+	if hit {
+		dev.slots[sl].pins++
+		dev.slots[sl].ref = true
+		dev.hits++
+	}
+	return sl, hit
+}
+
+func (dev *CacheTier) unpin(sl int32) {
+	dev.mu.Lock()
+	dev.slots[sl].pins--
+	dev.mu.Unlock()
+}
+
+func (dev *CacheTier) isDirty(sl int32) bool {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return dev.slots[sl].dirty
+}
+
+//allocate returns a pinned free slot, evicting clean blocks if needed. Evicted slots
+// may only be reused once the metadata no longer records them, so the metadata is
+// persisted after evicting a batch of blocks.
+func (dev *CacheTier) allocate() (int32, bool) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	for persisted := false; ; persisted = true {
+		if last := len(dev.free) - 1; last >= 0 {
+			sl := dev.free[last]
+			dev.free = dev.free[:last]
+			dev.slots[sl].pins++
+			return sl, true
+		}
+		if persisted || (dev.evictLocked() < 1 && len(dev.releasing) < 1) {
+			return 0, false
+		}
+
+		dev.mu.Unlock()
+		err := dev.persist(false)
+		dev.mu.Lock()
+		if err != nil {
+			log.Printf("CacheTier::allocate(): WARNING: Could not persist metadata to reuse evicted slots; Details: %s", err)
+			return 0, false
+		}
+	}
+}
+
+//evictLocked evicts a batch of clean unpinned blocks, the caller must hold mu
+func (dev *CacheTier) evictLocked() (evicted int) {
+	batch := len(dev.slots) / 32
+	if batch < 1 {
+		batch = 1
+	}
+	for scanned := 0; scanned < 2*len(dev.slots) && evicted < batch; scanned++ {
+		slt := &dev.slots[dev.clockHand]
+		sl := int32(dev.clockHand)
+		if dev.clockHand++; dev.clockHand == len(dev.slots) {
+			dev.clockHand = 0
+		}
+
+		switch {
+		case slt.state != slotValid || slt.dirty || slt.pins > 0:
+		case slt.ref:
+			slt.ref = false
+		default:
+			delete(dev.index, slt.block)
+			slt.state, slt.block = slotReleasing, -1
+			dev.releasing = append(dev.releasing, sl)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+//unallocate returns a slot obtained from allocate that was never installed
+func (dev *CacheTier) unallocate(sl int32) {
+	dev.mu.Lock()
+	dev.slots[sl].pins--
+	dev.free = append(dev.free, sl)
+	dev.mu.Unlock()
+}
+
+//install records that a slot obtained from allocate holds a block and unpins it
+func (dev *CacheTier) install(sl int32, idx int64, dirty bool) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	slt := &dev.slots[sl]
+	slt.state, slt.block, slt.dirty, slt.ref = slotValid, idx, dirty, true
+	slt.pins--
+	dev.index[idx] = sl
+	if dirty {
+		if dev.dirtyCount++; dev.dirtyCount > dev.writebackTarget() {
+			dev.kickWriteback()
+		}
+	}
+}
+
+//Trim drops all blocks entirely within the provided range from the cache, even if
+// dirty, and trims the range of the backing device
+func (dev *CacheTier) Trim(pos int64, count int) error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	first, last := (pos+dev.blockBytes-1)/dev.blockBytes, (pos+int64(count))/dev.blockBytes
+	if pos+int64(count) >= dev.size { //The final block may be short
+		last = dev.blockCount
+	}
+	for idx := first; idx < last; idx++ {
+		dev.dropBlock(idx)
+	}
+
+	if err := dev.backing.Trim(pos, count); err != nil {
+		return fmt.Errorf("Could not trim backing device: %w", err)
+	}
+	return nil
+}
+
+func (dev *CacheTier) dropBlock(idx int64) {
+	lock := &dev.blockLocks[idx%lockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	sl, cached := dev.index[idx]
+	if !cached {
+		return
+	}
+	slt := &dev.slots[sl]
+	if slt.dirty {
+		dev.dirtyCount--
+		dev.cleaned.Broadcast()
+	}
+	delete(dev.index, idx)
+	slt.state, slt.block, slt.dirty = slotReleasing, -1, false
+	dev.releasing = append(dev.releasing, sl)
+}
+
+//Flush persists the cache metadata after flushing the cache device, and the
+// backing device if it has been written to. Volatile caches first write back all
+// dirty blocks.
+func (dev *CacheTier) Flush() error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	if dev.metaFile == "" {
+		if err := dev.writeback(true); err != nil {
+			return err
+		}
+	}
+	return dev.persist(false)
+}
+
+//persist flushes the devices and then persists the cache metadata, slots evicted
+// before the metadata is persisted become free once it has been. Clean is recorded
+// in the metadata on shutdown to indicate no unrecorded writes were made.
+func (dev *CacheTier) persist(clean bool) error {
+	dev.persistMu.Lock()
+	defer dev.persistMu.Unlock()
+
+	dev.mu.Lock()
+	var meta []byte
+	if dev.metaFile != "" {
+		meta = dev.encodeMeta(clean)
+	}
+	releasing, flushBacking := dev.releasing, dev.backingDirty
+	dev.releasing, dev.backingDirty = nil, false
+	dev.mu.Unlock()
+
+	//The backing device must hold written back blocks before they are recorded as
+	// clean or evicted
+	var err error
+	if flushBacking {
+		if err = dev.backing.Flush(); err != nil {
+			err = fmt.Errorf("Could not flush backing device: %w", err)
+		}
+	}
+	if err == nil {
+		if err = dev.cache.Flush(); err != nil {
+			err = fmt.Errorf("Could not flush cache device: %w", err)
+		}
+	}
+	if err == nil && meta != nil {
+		if err = util.WriteFileAtomic(dev.metaFile, meta, 0600); err != nil {
+			err = fmt.Errorf("Could not persist cache metadata: %w", err)
+		}
+	}
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	if err != nil {
+		dev.releasing = append(dev.releasing, releasing...)
+		dev.backingDirty = dev.backingDirty || flushBacking
+		return err
+	}
+	for _, sl := range releasing {
+		dev.slots[sl].state = slotFree
+		dev.free = append(dev.free, sl)
+	}
+	return nil
+}
+
+//Close writes back all dirty blocks if the cache is volatile, persists the cache
+// metadata and closes the cache and backing devices
+func (dev *CacheTier) Close() error {
+	if !atomic.CompareAndSwapUint64(&dev.atomicOnline, 1, 0) {
+		return errClosed
+	}
+
+	dev.ioMu.Lock() //Wait for outstanding IO
+	defer dev.ioMu.Unlock()
+
+	dev.stopWriteback()
+	var err error
+	if dev.metaFile == "" {
+		err = dev.writeback(true)
+	}
+	if err == nil {
+		err = dev.persist(true)
+	}
+	if closeErr := dev.cache.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("Could not close cache device: %w", closeErr)
+	}
+	if closeErr := dev.backing.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("Could not close backing device: %w", closeErr)
+	}
+	return err
+}
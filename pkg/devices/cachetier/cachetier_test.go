@@ -0,0 +1,216 @@
+package cachetier
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const blockBytes = 64 * 1024
+
+func TestCacheTier(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	for _, mode := range []Mode{ModeWriteThrough, ModeWriteBack, ModeWriteAround} {
+		mode := mode
+		t.Run(mode.String(), func(t *testing.T) {
+			testutil.TestUserspace(t, createVolatile(t, sizeBytes, mode), sizeBytes)
+			testutil.TestNBD(t, createVolatile(t, sizeBytes, mode), sizeBytes)
+		})
+	}
+}
+
+//createVolatile creates a cache tier with a cache a quarter of the size of the
+// backing device so blocks are evicted
+func createVolatile(t *testing.T, sizeBytes int64, mode Mode) usbdlib.Device {
+	t.Helper()
+
+	dev, err := NewCacheTier(ramdisk.NewRAMDisk(sizeBytes), ramdisk.NewRAMDisk(sizeBytes/4), "",
+		OptMode(mode), OptBlockBytes(blockBytes))
+	if err != nil {
+		t.Fatalf("Could not create cache tier: %s", err)
+	}
+	return dev
+}
+
+//fileTier is a cache tier with both devices and its metadata in files
+type fileTier struct {
+	backingFile, cacheFile, metaFile string
+	backingBytes, cacheBytes         int64
+}
+
+func newFileTier(t *testing.T, backingBytes, cacheBytes int64) fileTier {
+	dir := t.TempDir()
+	return fileTier{
+		backingFile:  filepath.Join(dir, "backing"),
+		cacheFile:    filepath.Join(dir, "cache"),
+		metaFile:     filepath.Join(dir, "cache.meta"),
+		backingBytes: backingBytes,
+		cacheBytes:   cacheBytes,
+	}
+}
+
+func (ft fileTier) open(t *testing.T, options ...Option) *CacheTier {
+	t.Helper()
+
+	backing, cache := ft.openBacking(t), ft.openDisk(t, ft.cacheFile, ft.cacheBytes)
+	dev, err := NewCacheTier(backing, cache, ft.metaFile, append([]Option{OptBlockBytes(blockBytes)}, options...)...)
+	if err != nil {
+		t.Fatalf("Could not open cache tier: %s", err)
+	}
+	return dev
+}
+
+func (ft fileTier) openBacking(t *testing.T) usbdlib.Device {
+	t.Helper()
+	return ft.openDisk(t, ft.backingFile, ft.backingBytes)
+}
+
+func (ft fileTier) openDisk(t *testing.T, filename string, size int64) usbdlib.Device {
+	t.Helper()
+
+	disk, err := filedisk.NewFileDisk(filename, size)
+	if err != nil {
+		t.Fatalf("Could not open file disk %q: %s", filename, err)
+	}
+	return disk
+}
+
+func TestPersistence(t *testing.T) {
+	const backingBytes, cacheBytes = 64 * blockBytes, 16 * blockBytes
+
+	ft := newFileTier(t, backingBytes, cacheBytes)
+	options := []Option{OptMode(ModeWriteBack), OptWritebackPercent(90), OptDirtyMaxPercent(100)}
+	dev := ft.open(t, options...)
+	data := testutil.WriteRandom(t, dev, blockBytes/2, 8*blockBytes, 1)
+	if stats := dev.Stats(); stats.DirtyBlocks != 9 {
+		t.Fatalf("Cache had %d dirty blocks rather than 9", stats.DirtyBlocks)
+	}
+	testutil.TestClose(t, dev)
+
+	//Dirty blocks survive a restart without being written back
+	backing := ft.openBacking(t)
+	testutil.ExpectContents(t, "backing device before writeback", backing, blockBytes/2, make([]byte, len(data)))
+	backing.Close()
+
+	dev = ft.open(t, options...)
+	if stats := dev.Stats(); stats.DirtyBlocks != 9 || stats.CachedBlocks != 9 {
+		t.Fatalf("Reopened cache had %d cached and %d dirty blocks rather than 9 of each", stats.CachedBlocks, stats.DirtyBlocks)
+	}
+	testutil.ExpectContents(t, "reopened cache tier", dev, blockBytes/2, data)
+	if stats := dev.Stats(); stats.Misses != 0 {
+		t.Fatalf("Reopened cache had %d misses reading cached blocks", stats.Misses)
+	}
+
+	//Detaching writes back all dirty blocks
+	backing, err := dev.Detach()
+	if err != nil {
+		t.Fatalf("Could not detach cache: %s", err)
+	}
+	testutil.ExpectContents(t, "detached backing device", backing, blockBytes/2, data)
+	testutil.TestClose(t, backing)
+
+	dev = ft.open(t, options...)
+	if stats := dev.Stats(); stats.CachedBlocks != 0 {
+		t.Fatalf("Cache had %d cached blocks after being detached", stats.CachedBlocks)
+	}
+	testutil.ExpectContents(t, "cache tier after detach", dev, blockBytes/2, data)
+	testutil.TestClose(t, dev)
+}
+
+func TestUncleanShutdown(t *testing.T) {
+	const backingBytes, cacheBytes = 64 * blockBytes, 16 * blockBytes
+
+	ft := newFileTier(t, backingBytes, cacheBytes)
+	options := []Option{OptMode(ModeWriteThrough)}
+	dev := ft.open(t, options...)
+	data := testutil.WriteRandom(t, dev, 0, 4*blockBytes, 2)
+	if err := dev.Flush(); err != nil {
+		t.Fatalf("Could not flush cache tier: %s", err)
+	}
+	if err := dev.SetMode(ModeWriteBack); err != nil {
+		t.Fatalf("Could not change cache mode: %s", err)
+	}
+	copy(data[blockBytes:], testutil.WriteRandom(t, dev, blockBytes, blockBytes, 3))
+
+	//Open the same files again as if the first tier had crashed, all cached blocks are
+	// written back as any may have been written after the last flush
+	crashed := ft.open(t, options...)
+	if stats := crashed.Stats(); stats.CachedBlocks != 4 || stats.DirtyBlocks != 4 {
+		t.Fatalf("Cache had %d cached and %d dirty blocks rather than 4 of each", stats.CachedBlocks, stats.DirtyBlocks)
+	}
+	testutil.ExpectContents(t, "recovered cache tier", crashed, 0, data)
+	backing, err := crashed.Detach()
+	if err != nil {
+		t.Fatalf("Could not detach cache: %s", err)
+	}
+	testutil.ExpectContents(t, "recovered backing device", backing, 0, data)
+	testutil.TestClose(t, backing)
+}
+
+func TestSequentialBypass(t *testing.T) {
+	const sizeBytes, cutoff = 64 * blockBytes, 4 * blockBytes
+
+	dev, err := NewCacheTier(ramdisk.NewRAMDisk(sizeBytes), ramdisk.NewRAMDisk(sizeBytes/2), "",
+		OptBlockBytes(blockBytes), OptSequentialCutoff(cutoff))
+	if err != nil {
+		t.Fatalf("Could not create cache tier: %s", err)
+	}
+
+	data := make([]byte, 0, 16*blockBytes)
+	for pos := int64(0); pos < 16*blockBytes; pos += blockBytes / 2 {
+		data = append(data, testutil.WriteRandom(t, dev, pos, blockBytes/2, pos)...)
+	}
+	//Random IO is still cached
+	testutil.WriteRandom(t, dev, 40*blockBytes, blockBytes, 4)
+	testutil.WriteRandom(t, dev, 20*blockBytes, blockBytes, 5)
+
+	stats := dev.Stats()
+	if stats.CachedBlocks != 4+2 {
+		t.Fatalf("Cache had %d cached blocks rather than %d", stats.CachedBlocks, 4+2)
+	}
+	if stats.Bypassed != 24 {
+		t.Fatalf("%d writes bypassed the cache rather than 24", stats.Bypassed)
+	}
+	testutil.ExpectContents(t, "sequentially written data", dev, 0, data)
+	testutil.TestClose(t, dev)
+}
+
+func TestWritebackThrottle(t *testing.T) {
+	const sizeBytes, slots = 256 * blockBytes, 32
+	const dirtyMax = slots / 4
+
+	dev, err := NewCacheTier(ramdisk.NewRAMDisk(sizeBytes), ramdisk.NewRAMDisk(slots*blockBytes), "",
+		OptBlockBytes(blockBytes), OptSequentialCutoff(0), OptWritebackPercent(0), OptDirtyMaxPercent(25),
+		OptWritebackRate(4*blockBytes))
+	if err != nil {
+		t.Fatalf("Could not create cache tier: %s", err)
+	}
+
+	rnd := rand.New(rand.NewSource(6))
+	for i := 0; i < 64; i++ {
+		testutil.WriteRandom(t, dev, rnd.Int63n(sizeBytes-blockBytes), blockBytes/4, int64(i))
+		if stats := dev.Stats(); stats.DirtyBlocks > dirtyMax {
+			t.Fatalf("Cache had %d dirty blocks, more than the maximum of %d", stats.DirtyBlocks, dirtyMax)
+		}
+	}
+	if stats := dev.Stats(); stats.WrittenBack < 64-dirtyMax {
+		t.Fatalf("Only %d blocks were written back", stats.WrittenBack)
+	}
+
+	if err = dev.SetMode(ModeWriteThrough); err != nil {
+		t.Fatalf("Could not change cache mode: %s", err)
+	}
+	if err = dev.Flush(); err != nil {
+		t.Fatalf("Could not flush cache tier: %s", err)
+	}
+	if stats := dev.Stats(); stats.DirtyBlocks != 0 {
+		t.Fatalf("Cache had %d dirty blocks after flushing a volatile cache", stats.DirtyBlocks)
+	}
+	testutil.TestClose(t, dev)
+}
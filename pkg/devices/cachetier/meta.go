@@ -0,0 +1,103 @@
+package cachetier
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+)
+
+const (
+	metaMagic     = "USBDCTR1"
+	metaHdrBytes  = len(metaMagic) + 8 + 8 + 8 + 1
+	metaSlotBytes = 8 + 1
+
+	flagDirty = 1
+)
+
+//encodeMeta serializes the cache index, the caller must hold mu. Only valid slots
+// are recorded, the contents of all others are unused.
+func (dev *CacheTier) encodeMeta(clean bool) []byte {
+	meta := make([]byte, metaHdrBytes+len(dev.slots)*metaSlotBytes+4)
+	copy(meta, metaMagic)
+	binary.LittleEndian.PutUint64(meta[len(metaMagic):], uint64(dev.blockBytes))
+	binary.LittleEndian.PutUint64(meta[len(metaMagic)+8:], uint64(dev.size))
+	binary.LittleEndian.PutUint64(meta[len(metaMagic)+16:], uint64(len(dev.slots)))
+	if clean {
+		meta[metaHdrBytes-1] = 1
+	}
+
+	rec := meta[metaHdrBytes:]
+	for i := range dev.slots {
+		block, flags := int64(-1), byte(0)
+		if sl := &dev.slots[i]; sl.state == slotValid {
+			block = sl.block
+			if sl.dirty {
+				flags |= flagDirty
+			}
+		}
+		binary.LittleEndian.PutUint64(rec, uint64(block))
+		rec[8] = flags
+		rec = rec[metaSlotBytes:]
+	}
+	binary.LittleEndian.PutUint32(rec, crc32.ChecksumIEEE(meta[:len(meta)-4]))
+	return meta
+}
+
+//loadMeta restores the cache index from the metadata file if it exists. If the
+// cache was not shutdown cleanly every cached block is treated as dirty, as blocks
+// may have been written after the metadata was last persisted.
+func (dev *CacheTier) loadMeta() error {
+	meta, err := os.ReadFile(dev.metaFile)
+	switch {
+	case os.IsNotExist(err):
+		return nil //New cache
+	case err != nil:
+		return fmt.Errorf("Could not read cache metadata file %q: %w", dev.metaFile, err)
+	}
+
+	switch expected := metaHdrBytes + len(dev.slots)*metaSlotBytes + 4; {
+	case len(meta) < metaHdrBytes || string(meta[:len(metaMagic)]) != metaMagic:
+		return fmt.Errorf("File %q is not cache metadata", dev.metaFile)
+	case len(meta) != expected:
+		return fmt.Errorf("Cache metadata file %q is %d bytes; expected %d", dev.metaFile, len(meta), expected)
+	case crc32.ChecksumIEEE(meta[:len(meta)-4]) != binary.LittleEndian.Uint32(meta[len(meta)-4:]):
+		return fmt.Errorf("Cache metadata file %q is corrupt (checksum mismatch)", dev.metaFile)
+	}
+	if blockBytes := int64(binary.LittleEndian.Uint64(meta[len(metaMagic):])); blockBytes != dev.blockBytes {
+		return fmt.Errorf("Cache metadata file %q has a block size of %d rather than %d", dev.metaFile, blockBytes, dev.blockBytes)
+	}
+	if size := int64(binary.LittleEndian.Uint64(meta[len(metaMagic)+8:])); size != dev.size {
+		return fmt.Errorf("Cache metadata file %q is for a backing device of %d bytes rather than %d", dev.metaFile, size, dev.size)
+	}
+
+	clean := meta[metaHdrBytes-1] == 1
+	if !clean {
+		log.Printf("CacheTier::loadMeta(): WARNING: Cache %q was not shutdown cleanly, all cached blocks will be written back", dev.metaFile)
+	}
+
+	dev.free = dev.free[:0]
+	rec := meta[metaHdrBytes:]
+	for i := range dev.slots {
+		block, flags := int64(binary.LittleEndian.Uint64(rec)), rec[8]
+		rec = rec[metaSlotBytes:]
+		if block == -1 {
+			dev.free = append(dev.free, int32(i))
+			continue
+		}
+		if block < 0 || block >= dev.blockCount {
+			return fmt.Errorf("Cache metadata file %q maps slot %d to block %d beyond the end of the backing device", dev.metaFile, i, block)
+		}
+		if _, dup := dev.index[block]; dup {
+			return fmt.Errorf("Cache metadata file %q maps block %d more than once", dev.metaFile, block)
+		}
+		sl := &dev.slots[i]
+		sl.state, sl.block, sl.dirty = slotValid, block, flags&flagDirty != 0 || !clean
+		if sl.dirty {
+			dev.dirtyCount++
+		}
+		dev.index[block] = int32(i)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package cachetier
+
+//Mode determines how writes are handled by a cache tier
+type Mode uint32
+
+const (
+	//ModeWriteThrough writes to both the backing and cache devices
+	ModeWriteThrough Mode = iota
+	//ModeWriteBack writes only to the cache device, dirty blocks are written to the
+	// backing device in the background
+	ModeWriteBack
+	//ModeWriteAround writes to the backing device, blocks are only cached when read
+	ModeWriteAround
+)
+
+func (mode Mode) String() string {
+	switch mode {
+	case ModeWriteThrough:
+		return "write-through"
+	case ModeWriteBack:
+		return "write-back"
+	case ModeWriteAround:
+		return "write-around"
+	}
+	return "unknown"
+}
+
+//Option is a cache tier option
+type Option interface {
+	apply(*CacheTier)
+}
+
+//OptMode instructs a CacheTier to start in the provided mode
+type OptMode Mode
+
+func (mode OptMode) apply(dev *CacheTier) {
+	dev.atomicMode = uint32(mode)
+}
+
+//OptBlockBytes instructs a CacheTier to cache the backing device in blocks of this
+// size; it must be a multiple of the block sizes of both devices and match that of
+// any persisted cache metadata.
+type OptBlockBytes int64
+
+func (size OptBlockBytes) apply(dev *CacheTier) {
+	dev.blockBytes = int64(size)
+}
+
+//OptSequentialCutoff instructs a CacheTier to bypass the cache for sequential IO
+// once a stream of this many bytes has been detected, 0 disables bypass
+type OptSequentialCutoff int64
+
+func (size OptSequentialCutoff) apply(dev *CacheTier) {
+	dev.seq.cutoff = int64(size)
+}
+
+//OptWritebackPercent instructs a CacheTier to only write dirty blocks back to the
+// backing device in the background while more than this percentage of the cache
+// is dirty, recently written blocks are retained to absorb rewrites
+type OptWritebackPercent int
+
+func (percent OptWritebackPercent) apply(dev *CacheTier) {
+	dev.writebackPercent = int(percent)
+}
+
+//OptDirtyMaxPercent instructs a CacheTier to throttle writes needing to dirty a
+// block while this percentage of the cache is dirty, until writeback catches up
+type OptDirtyMaxPercent int
+
+func (percent OptDirtyMaxPercent) apply(dev *CacheTier) {
+	dev.dirtyMaxPercent = int(percent)
+}
+
+//OptWritebackRate instructs a CacheTier to limit background writeback to this many
+// bytes per second, unless writes are being throttled. 0 is unlimited.
+type OptWritebackRate int64
+
+func (rate OptWritebackRate) apply(dev *CacheTier) {
+	dev.writebackRate = int64(rate)
+}
@@ -0,0 +1,243 @@
+package cachetier
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const (
+	writebackInterval = time.Second
+	seqStreams        = 16
+)
+
+//writebackTarget is the number of dirty blocks background writeback leaves in the
+// cache, the caller must hold mu
+func (dev *CacheTier) writebackTarget() int64 {
+	if dev.Mode() != ModeWriteBack {
+		return 0
+	}
+	return int64(len(dev.slots)) * int64(dev.writebackPercent) / 100
+}
+
+//dirtyMax is the number of dirty blocks at which writes are throttled
+func (dev *CacheTier) dirtyMax() int64 {
+	max := int64(len(dev.slots)) * int64(dev.dirtyMaxPercent) / 100
+	if max < 1 {
+		return 1
+	}
+	return max
+}
+
+func (dev *CacheTier) kickWriteback() {
+	select {
+	case dev.writebackKick <- struct{}{}:
+	default: //Already pending
+	}
+}
+
+//throttle waits while the cache has too many dirty blocks for a write to dirty
+// another one, rewrites of blocks that are already dirty are not throttled
+func (dev *CacheTier) throttle(idx int64) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	for dev.dirtyCount >= dev.dirtyMax() {
+		if sl, cached := dev.index[idx]; cached && dev.slots[sl].dirty {
+			return
+		}
+		select {
+		case dev.writebackUrgent <- struct{}{}:
+		default: //Already pending
+		}
+		dev.cleaned.Wait()
+	}
+}
+
+func (dev *CacheTier) writebackLoop() {
+	defer close(dev.writebackDone)
+
+	ticker := time.NewTicker(writebackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dev.writebackStop:
+			return
+		case <-dev.writebackKick:
+		case <-dev.writebackUrgent:
+		case <-ticker.C:
+		}
+
+		if err := dev.writeback(false); err != nil {
+			log.Printf("CacheTier::writebackLoop(): WARNING: Background writeback failed; Details: %s", err)
+			dev.mu.Lock()
+			dev.cleaned.Broadcast() //Let throttled writers recheck
+			dev.mu.Unlock()
+		}
+	}
+}
+
+func (dev *CacheTier) stopWriteback() {
+	close(dev.writebackStop)
+	<-dev.writebackDone
+}
+
+//writeback writes dirty blocks back to the backing device until the writeback
+// target is reached, or if all is set until no dirty blocks remain. Unless writing
+// back all blocks or writes are being throttled it is rate limited and stops early
+// if writeback is being stopped.
+func (dev *CacheTier) writeback(all bool) error {
+	for {
+		if !all {
+			select {
+			case <-dev.writebackStop:
+				return nil
+			default:
+			}
+		}
+
+		dev.mu.Lock()
+		target := dev.writebackTarget()
+		if all {
+			target = 0
+		}
+		if dev.dirtyCount <= target {
+			dev.mu.Unlock()
+			return nil
+		}
+		sl, idx := dev.nextDirtyLocked()
+		throttling := dev.dirtyCount >= dev.dirtyMax()
+		dev.mu.Unlock()
+
+		if err := dev.writebackSlot(sl, idx); err != nil {
+			return err
+		}
+
+		if !all && !throttling && dev.writebackRate > 0 {
+			delay := time.Duration(dev.blockLen(idx) * int64(time.Second) / dev.writebackRate)
+			select {
+			case <-dev.writebackStop:
+				return nil
+			case <-dev.writebackUrgent: //Writes are being throttled
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
+//nextDirtyLocked returns the next dirty slot after the writeback hand, the caller
+// must hold mu and there must be at least one dirty block
+func (dev *CacheTier) nextDirtyLocked() (int32, int64) {
+	for {
+		sl := dev.writebackHand
+		if dev.writebackHand++; dev.writebackHand == len(dev.slots) {
+			dev.writebackHand = 0
+		}
+		if slt := &dev.slots[sl]; slt.state == slotValid && slt.dirty {
+			return int32(sl), slt.block
+		}
+	}
+}
+
+//writebackSlot writes a dirty block back to the backing device and marks it clean,
+// unless it was dropped or is no longer dirty by the time its lock is acquired
+func (dev *CacheTier) writebackSlot(sl int32, idx int64) error {
+	lock := &dev.blockLocks[idx%lockStripes]
+	lock.RLock()
+	defer lock.RUnlock()
+
+	dev.mu.Lock()
+	slt := &dev.slots[sl]
+	current := slt.state == slotValid && slt.block == idx && slt.dirty
+	dev.mu.Unlock()
+	if !current {
+		return nil
+	}
+
+	block := make([]byte, dev.blockLen(idx))
+	if err := dev.readSlot(sl, 0, block); err != nil {
+		return err
+	}
+	if _, err := dev.backing.WriteAt(block, idx*dev.blockBytes); err != nil {
+		return fmt.Errorf("Could not write back block %d: %w", idx, err)
+	}
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	slt.dirty, dev.backingDirty = false, true
+	dev.dirtyCount--
+	dev.writtenBack++
+	dev.cleaned.Broadcast()
+	return nil
+}
+
+//Detach writes back all dirty blocks, flushes the backing device, removes the cache
+// metadata and closes the cache device. The backing device is returned and the
+// cache tier is closed.
+func (dev *CacheTier) Detach() (usbdlib.Device, error) {
+	if !atomic.CompareAndSwapUint64(&dev.atomicOnline, 1, 0) {
+		return nil, errClosed
+	}
+
+	dev.ioMu.Lock() //Wait for outstanding IO
+	defer dev.ioMu.Unlock()
+
+	dev.stopWriteback()
+	if err := dev.writeback(true); err != nil {
+		return nil, fmt.Errorf("Could not write back dirty blocks to detach cache: %w", err)
+	}
+	if err := dev.backing.Flush(); err != nil {
+		return nil, fmt.Errorf("Could not flush backing device to detach cache: %w", err)
+	}
+	if dev.metaFile != "" {
+		if err := os.Remove(dev.metaFile); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Could not remove cache metadata file %q: %w", dev.metaFile, err)
+		}
+	}
+	if err := dev.cache.Close(); err != nil {
+		log.Printf("CacheTier::Detach(): WARNING: Could not close cache device; Details: %s", err)
+	}
+	return dev.backing, nil
+}
+
+type seqStream struct {
+	end, run int64
+}
+
+//seqDetector tracks recent IO streams to detect sequential IO which would evict
+// the working set from the cache while gaining little from it
+type seqDetector struct {
+	cutoff  int64
+	mu      sync.Mutex
+	streams [seqStreams]seqStream
+	next    int
+}
+
+//observe records an IO and returns if it is part of a sequential stream that
+// should bypass the cache
+func (det *seqDetector) observe(pos, length int64) bool {
+	if det.cutoff < 1 {
+		return false
+	}
+
+	det.mu.Lock()
+	defer det.mu.Unlock()
+
+	for i := range det.streams {
+		if stream := &det.streams[i]; stream.run > 0 && stream.end == pos {
+			stream.end += length
+			stream.run += length
+			return stream.run >= det.cutoff
+		}
+	}
+	det.streams[det.next] = seqStream{end: pos + length, run: length}
+	det.next = (det.next + 1) % seqStreams
+	return length >= det.cutoff
+}
@@ -0,0 +1,341 @@
+package cbt
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/bitmap"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed = consterr.ConstErr("Device is shutdown")
+
+	//ErrNoCheckpoint is returned when a named checkpoint does not exist
+	ErrNoCheckpoint = consterr.ConstErr("No such checkpoint")
+	//ErrCheckpointExists is returned when creating a checkpoint whose name is in use
+	ErrCheckpointExists = consterr.ConstErr("Checkpoint already exists")
+
+	//DefBlockBytes is the default granularity at which changes are tracked
+	DefBlockBytes = 64 * 1024
+
+	maxNameBytes = 255
+)
+
+//Checkpoint describes a named point in time changes can be listed since
+type Checkpoint struct {
+	Name    string
+	Created time.Time
+}
+
+//Extent is a range of a device
+type Extent struct {
+	Offset, Length int64
+}
+
+//checkpoint is a Checkpoint and the blocks changed after it was created, but
+// before the next checkpoint was created
+type checkpoint struct {
+	Checkpoint
+	changed *bitmap.Bitmap
+}
+
+//CBT wraps a device and tracks which of its blocks are written or trimmed since
+// named checkpoints, so backup tools can copy only the regions changed since their
+// last backup. Tracking begins when the first checkpoint is created. Each
+// checkpoint holds a bitmap of the blocks changed between it and the next
+// checkpoint, so a write only updates the bitmap of the latest, and the changes
+// since a checkpoint are the union of its bitmap and those of all later ones.
+// Bitmaps are persisted to a metadata file when the device is flushed or closed. If
+// the device was not closed cleanly, writes since the last flush are unknown, so
+// every block is considered changed since the latest checkpoint.
+type CBT struct {
+	dev          usbdlib.Device
+	metaFile     string
+	size         int64
+	blockBytes   int64
+	blockCount   int64
+	atomicOnline uint64
+	ioMu         sync.RWMutex //Held exclusively to close
+	persistMu    sync.Mutex
+
+	mu          sync.Mutex
+	checkpoints []*checkpoint //Oldest first
+	dirty       bool          //Changed since last persisted
+}
+
+var (
+	_ usbdlib.Device         = (*CBT)(nil)
+	_ usbdlib.ReadOnlyDevice = (*CBT)(nil)
+)
+
+//NewCBT constructs a device tracking changes to the provided device, which it owns
+// and closes when closed. If a metadata file is provided checkpoints are loaded
+// from it, if it exists, and persisted to it; otherwise they are lost when the
+// device is closed.
+func NewCBT(dev usbdlib.Device, metaFile string, options ...Option) (*CBT, error) {
+	cdev := &CBT{
+		dev:          dev,
+		metaFile:     metaFile,
+		size:         dev.Size(),
+		blockBytes:   DefBlockBytes,
+		atomicOnline: 1,
+	}
+	for _, opt := range options {
+		opt.apply(cdev)
+	}
+	if cdev.blockBytes < 1 || cdev.blockBytes%dev.BlockSize() != 0 {
+		return nil, fmt.Errorf("Tracking block size %d is not a multiple of the device block size %d", cdev.blockBytes, dev.BlockSize())
+	}
+	cdev.blockCount = (cdev.size + cdev.blockBytes - 1) / cdev.blockBytes
+
+	if metaFile != "" {
+		if err := cdev.loadMeta(); err != nil {
+			return nil, err
+		}
+		cdev.dirty = true
+		if err := cdev.persist(false); err != nil { //Record that the device is in use
+			return nil, err
+		}
+	}
+	return cdev, nil
+}
+
+//Size of this device in bytes
+func (cdev *CBT) Size() int64 {
+	return cdev.size
+}
+
+//BlockSize of this device is that of the wrapped device
+func (cdev *CBT) BlockSize() int64 {
+	return cdev.dev.BlockSize()
+}
+
+//TrackingBlockSize returns the granularity at which changes are tracked
+func (cdev *CBT) TrackingBlockSize() int64 {
+	return cdev.blockBytes
+}
+
+//ReadOnly returns if the wrapped device is read-only, fulfilling
+// usbdlib.ReadOnlyDevice
+func (cdev *CBT) ReadOnly() bool {
+	return usbdlib.IsReadOnly(cdev.dev)
+}
+
+//CreateCheckpoint creates a checkpoint with the provided name, from which changes
+// are tracked. It is persisted immediately, so that changes made after it are
+// reported even if the device is not shutdown cleanly.
+func (cdev *CBT) CreateCheckpoint(name string) error {
+	if atomic.LoadUint64(&cdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	cdev.ioMu.RLock()
+	defer cdev.ioMu.RUnlock()
+	switch {
+	case name == "":
+		return fmt.Errorf("Checkpoint name is empty")
+	case len(name) > maxNameBytes:
+		return fmt.Errorf("Checkpoint name %q is longer than %d bytes", name, maxNameBytes)
+	}
+
+	cdev.mu.Lock()
+	if cdev.find(name) >= 0 {
+		cdev.mu.Unlock()
+		return fmt.Errorf("Could not create checkpoint %q: %w", name, ErrCheckpointExists)
+	}
+	cdev.checkpoints = append(cdev.checkpoints, &checkpoint{
+		Checkpoint: Checkpoint{Name: name, Created: time.Now()},
+		changed:    bitmap.New(cdev.blockCount),
+	})
+	cdev.dirty = true
+	cdev.mu.Unlock()
+
+	if cdev.metaFile == "" {
+		return nil
+	}
+	return cdev.persist(false)
+}
+
+//DeleteCheckpoint deletes the named checkpoint, the changes made since it remain
+// recorded as changes since the checkpoint before it
+func (cdev *CBT) DeleteCheckpoint(name string) error {
+	if atomic.LoadUint64(&cdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	cdev.ioMu.RLock()
+	defer cdev.ioMu.RUnlock()
+
+	cdev.mu.Lock()
+	idx := cdev.find(name)
+	if idx < 0 {
+		cdev.mu.Unlock()
+		return fmt.Errorf("Could not delete checkpoint %q: %w", name, ErrNoCheckpoint)
+	}
+	if idx > 0 {
+		cdev.checkpoints[idx-1].changed.Or(cdev.checkpoints[idx].changed)
+	}
+	cdev.checkpoints = append(cdev.checkpoints[:idx], cdev.checkpoints[idx+1:]...)
+	cdev.dirty = true
+	cdev.mu.Unlock()
+
+	if cdev.metaFile == "" {
+		return nil
+	}
+	return cdev.persist(false)
+}
+
+//Checkpoints returns the current checkpoints, oldest first
+func (cdev *CBT) Checkpoints() []Checkpoint {
+	cdev.mu.Lock()
+	defer cdev.mu.Unlock()
+
+	checkpoints := make([]Checkpoint, len(cdev.checkpoints))
+	for i, cp := range cdev.checkpoints {
+		checkpoints[i] = cp.Checkpoint
+	}
+	return checkpoints
+}
+
+//Changes returns the extents of the device written or trimmed since the named
+// checkpoint was created, in order. Extents are aligned to the tracking block size
+// (see OptBlockBytes), except at the end of the device, and adjacent changed blocks
+// are merged into a single extent.
+func (cdev *CBT) Changes(name string) ([]Extent, error) {
+	cdev.mu.Lock()
+	idx := cdev.find(name)
+	if idx < 0 {
+		cdev.mu.Unlock()
+		return nil, fmt.Errorf("Could not list changes since checkpoint %q: %w", name, ErrNoCheckpoint)
+	}
+	changed := cdev.checkpoints[idx].changed.Clone()
+	for _, cp := range cdev.checkpoints[idx+1:] {
+		changed.Or(cp.changed)
+	}
+	cdev.mu.Unlock()
+
+	var extents []Extent
+	for start := changed.NextSet(0); start >= 0; {
+		end := changed.NextClear(start)
+		if end < 0 {
+			end = cdev.blockCount
+		}
+		ext := Extent{Offset: start * cdev.blockBytes, Length: (end - start) * cdev.blockBytes}
+		if ext.Offset+ext.Length > cdev.size {
+			ext.Length = cdev.size - ext.Offset
+		}
+		extents = append(extents, ext)
+		start = changed.NextSet(end)
+	}
+	return extents, nil
+}
+
+//find returns the index of the named checkpoint or -1, the caller must hold mu
+func (cdev *CBT) find(name string) int {
+	for i, cp := range cdev.checkpoints {
+		if cp.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+//track records that the provided range has changed
+func (cdev *CBT) track(pos, count int64) {
+	if count <= 0 {
+		return
+	}
+	cdev.mu.Lock()
+	defer cdev.mu.Unlock()
+
+	if len(cdev.checkpoints) == 0 {
+		return
+	}
+	start, end := pos/cdev.blockBytes, (pos+count+cdev.blockBytes-1)/cdev.blockBytes
+	if start < 0 {
+		start = 0
+	}
+	if end > cdev.blockCount {
+		end = cdev.blockCount
+	}
+	cdev.checkpoints[len(cdev.checkpoints)-1].changed.SetRange(start, end)
+	cdev.dirty = true
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (cdev *CBT) ReadAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&cdev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	cdev.ioMu.RLock()
+	defer cdev.ioMu.RUnlock()
+
+	return cdev.dev.ReadAt(buf, pos)
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device. The range is
+// recorded as changed once the write completes, so a write in progress when a
+// checkpoint is created is reported as a change since it, and even if the write
+// fails as it may have been partially applied.
+func (cdev *CBT) WriteAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&cdev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	cdev.ioMu.RLock()
+	defer cdev.ioMu.RUnlock()
+
+	n, err := cdev.dev.WriteAt(buf, pos)
+	cdev.track(pos, int64(len(buf)))
+	return n, err
+}
+
+//Trim fufills part of usbdlib.Device
+func (cdev *CBT) Trim(pos int64, count int) error {
+	if atomic.LoadUint64(&cdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	cdev.ioMu.RLock()
+	defer cdev.ioMu.RUnlock()
+
+	err := cdev.dev.Trim(pos, count)
+	cdev.track(pos, int64(count))
+	return err
+}
+
+//Flush fufills part of usbdlib.Device, it also persists the changes tracked
+func (cdev *CBT) Flush() error {
+	if atomic.LoadUint64(&cdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	cdev.ioMu.RLock()
+	defer cdev.ioMu.RUnlock()
+
+	if err := cdev.dev.Flush(); err != nil {
+		return err
+	}
+	if cdev.metaFile == "" {
+		return nil
+	}
+	return cdev.persist(false)
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device, it persists the
+// changes tracked and records that the device was shutdown cleanly
+func (cdev *CBT) Close() error {
+	if !atomic.CompareAndSwapUint64(&cdev.atomicOnline, 1, 0) {
+		return errClosed
+	}
+	cdev.ioMu.Lock() //Wait for outstanding IO
+	defer cdev.ioMu.Unlock()
+
+	err := cdev.dev.Flush()
+	if err == nil && cdev.metaFile != "" {
+		err = cdev.persist(true)
+	}
+	if closeErr := cdev.dev.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
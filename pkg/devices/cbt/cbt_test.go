@@ -0,0 +1,176 @@
+package cbt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+func TestCBT(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	testutil.TestUserspace(t, createDevice(t, ramdisk.NewRAMDisk(sizeBytes), ""), sizeBytes)
+	testutil.TestNBD(t, createDevice(t, ramdisk.NewRAMDisk(sizeBytes), ""), sizeBytes)
+}
+
+//createDevice creates a change tracking device with a checkpoint named "base"
+func createDevice(t *testing.T, dev usbdlib.Device, metaFile string, options ...Option) *CBT {
+	t.Helper()
+
+	cdev, err := NewCBT(dev, metaFile, options...)
+	if err != nil {
+		t.Fatalf("Could not create change tracking device: %s", err)
+	}
+	if err = cdev.CreateCheckpoint("base"); err != nil && !errors.Is(err, ErrCheckpointExists) {
+		t.Fatalf("Could not create checkpoint: %s", err)
+	}
+	return cdev
+}
+
+func TestChanges(t *testing.T) {
+	const (
+		blockBytes = 64 * 1024
+		sizeBytes  = 16*blockBytes + 4096
+	)
+	cdev, err := NewCBT(ramdisk.NewRAMDisk(sizeBytes), "", OptBlockBytes(blockBytes))
+	if err != nil {
+		t.Fatalf("Could not create change tracking device: %s", err)
+	}
+	defer cdev.Close()
+	buf := make([]byte, 4096)
+
+	//Changes before the first checkpoint are not tracked
+	cdev.WriteAt(buf, 0)
+	if err = cdev.CreateCheckpoint("a"); err != nil {
+		t.Fatalf("Could not create checkpoint: %s", err)
+	}
+	expectChanges(t, cdev, "a", nil)
+
+	cdev.WriteAt(buf[:10], 0)
+	cdev.WriteAt(buf, blockBytes-100) //Spans two blocks
+	cdev.Trim(16*blockBytes, 4096)    //The partial block at the end of the device
+	expectChanges(t, cdev, "a", []Extent{{0, 2 * blockBytes}, {16 * blockBytes, 4096}})
+
+	if err = cdev.CreateCheckpoint("b"); err != nil {
+		t.Fatalf("Could not create checkpoint: %s", err)
+	}
+	cdev.WriteAt(buf, 5*blockBytes)
+	expectChanges(t, cdev, "b", []Extent{{5 * blockBytes, blockBytes}})
+	expectChanges(t, cdev, "a", []Extent{{0, 2 * blockBytes}, {5 * blockBytes, blockBytes}, {16 * blockBytes, 4096}})
+
+	if err = cdev.CreateCheckpoint("c"); err != nil {
+		t.Fatalf("Could not create checkpoint: %s", err)
+	}
+	cdev.WriteAt(buf, 2*blockBytes)
+	expectChanges(t, cdev, "c", []Extent{{2 * blockBytes, blockBytes}})
+	expectChanges(t, cdev, "b", []Extent{{2 * blockBytes, blockBytes}, {5 * blockBytes, blockBytes}})
+
+	//Deleting a checkpoint retains its changes in the checkpoint before it
+	if err = cdev.DeleteCheckpoint("b"); err != nil {
+		t.Fatalf("Could not delete checkpoint: %s", err)
+	}
+	expectChanges(t, cdev, "a", []Extent{{0, 3 * blockBytes}, {5 * blockBytes, blockBytes}, {16 * blockBytes, 4096}})
+	expectChanges(t, cdev, "c", []Extent{{2 * blockBytes, blockBytes}})
+	if cps := cdev.Checkpoints(); len(cps) != 2 || cps[0].Name != "a" || cps[1].Name != "c" || cps[1].Created.Before(cps[0].Created) {
+		t.Fatalf("Checkpoints were not as expected: %+v", cps)
+	}
+
+	if _, err = cdev.Changes("b"); !errors.Is(err, ErrNoCheckpoint) {
+		t.Fatalf("Changes since a deleted checkpoint returned %v rather than %s", err, ErrNoCheckpoint)
+	} else if err = cdev.DeleteCheckpoint("b"); !errors.Is(err, ErrNoCheckpoint) {
+		t.Fatalf("Deleting a deleted checkpoint returned %v rather than %s", err, ErrNoCheckpoint)
+	} else if err = cdev.CreateCheckpoint("a"); !errors.Is(err, ErrCheckpointExists) {
+		t.Fatalf("Creating an existing checkpoint returned %v rather than %s", err, ErrCheckpointExists)
+	} else if err = cdev.CreateCheckpoint(""); err == nil {
+		t.Fatalf("Checkpoint with an empty name was created")
+	}
+
+	if _, err = NewCBT(ramdisk.NewRAMDisk(sizeBytes), "", OptBlockBytes(1000)); err == nil {
+		t.Fatalf("Tracking block size that is not a multiple of the device block size was accepted")
+	}
+}
+
+func expectChanges(t *testing.T, cdev *CBT, name string, expected []Extent) {
+	t.Helper()
+
+	actual, err := cdev.Changes(name)
+	if err != nil {
+		t.Fatalf("Could not list changes since %q: %s", name, err)
+	} else if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Changes since %q were %v rather than %v", name, actual, expected)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	const sizeBytes = 4 * 1024 * 1024
+
+	dir := t.TempDir()
+	diskFile, metaFile := filepath.Join(dir, "disk.bin"), filepath.Join(dir, "disk.cbt")
+	open := func() (*CBT, usbdlib.Device) {
+		disk, err := filedisk.NewFileDisk(diskFile, sizeBytes)
+		if err != nil {
+			t.Fatalf("Could not open file disk: %s", err)
+		}
+		return createDevice(t, disk, metaFile), disk
+	}
+	buf := make([]byte, 4096)
+
+	//Checkpoints and changes survive a clean shutdown
+	cdev, _ := open()
+	cdev.WriteAt(buf, 0)
+	if err := cdev.Close(); err != nil {
+		t.Fatalf("Could not close device: %s", err)
+	}
+	cdev, disk := open()
+	expectChanges(t, cdev, "base", []Extent{{0, DefBlockBytes}})
+
+	//Checkpoints survive a crash, and as changes made after the last flush are unknown
+	// every block is considered changed since the latest
+	if err := cdev.CreateCheckpoint("next"); err != nil {
+		t.Fatalf("Could not create checkpoint: %s", err)
+	}
+	cdev.WriteAt(buf, DefBlockBytes)
+	if err := cdev.Flush(); err != nil {
+		t.Fatalf("Could not flush device: %s", err)
+	}
+	cdev.WriteAt(buf, 2*DefBlockBytes)
+	disk.Close() //Crash
+
+	cdev, _ = open()
+	expectChanges(t, cdev, "next", []Extent{{0, sizeBytes}})
+	if cps := cdev.Checkpoints(); len(cps) != 2 || cps[0].Name != "base" || cps[1].Name != "next" {
+		t.Fatalf("Checkpoints were not restored: %+v", cps)
+	}
+	if err := cdev.Close(); err != nil {
+		t.Fatalf("Could not close device: %s", err)
+	}
+
+	//Corrupt metadata is detected
+	meta, err := os.ReadFile(metaFile)
+	if err != nil {
+		t.Fatalf("Could not read metadata: %s", err)
+	}
+	meta[len(meta)/2] ^= 0xff
+	if err = os.WriteFile(metaFile, meta, 0600); err != nil {
+		t.Fatalf("Could not write metadata: %s", err)
+	}
+	disk, _ = filedisk.NewFileDisk(diskFile, sizeBytes)
+	defer disk.Close()
+	if _, err = NewCBT(disk, metaFile); err == nil {
+		t.Fatalf("Corrupt metadata was accepted")
+	}
+}
+
+func TestPowerLoss(t *testing.T) {
+	metaFile := filepath.Join(t.TempDir(), "cbt.meta")
+	testutil.TestPowerLoss(t, testutil.CrashConfig{}, func(disk usbdlib.Device, create bool) (usbdlib.Device, error) {
+		return NewCBT(disk, metaFile)
+	})
+}
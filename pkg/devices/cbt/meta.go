@@ -0,0 +1,138 @@
+package cbt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/bitmap"
+)
+
+const (
+	metaMagic    = "USBDCBT1"
+	metaHdrBytes = len(metaMagic) + 8 + 8 + 4 + 1
+)
+
+//encodeMeta serializes the checkpoints, the caller must hold mu. The header is
+// followed by each checkpoint's name, creation time and bitmap, and a checksum.
+func (cdev *CBT) encodeMeta(clean bool) []byte {
+	bitmapBytes := bitmap.MarshaledSize(cdev.blockCount)
+	metaBytes := metaHdrBytes + 4
+	for _, cp := range cdev.checkpoints {
+		metaBytes += 1 + len(cp.Name) + 8 + int(bitmapBytes)
+	}
+
+	meta := make([]byte, metaHdrBytes, metaBytes)
+	copy(meta, metaMagic)
+	binary.LittleEndian.PutUint64(meta[len(metaMagic):], uint64(cdev.blockBytes))
+	binary.LittleEndian.PutUint64(meta[len(metaMagic)+8:], uint64(cdev.size))
+	binary.LittleEndian.PutUint32(meta[len(metaMagic)+16:], uint32(len(cdev.checkpoints)))
+	if clean {
+		meta[metaHdrBytes-1] = 1
+	}
+
+	var scratch [8]byte
+	for _, cp := range cdev.checkpoints {
+		meta = append(meta, byte(len(cp.Name)))
+		meta = append(meta, cp.Name...)
+		binary.LittleEndian.PutUint64(scratch[:], uint64(cp.Created.UnixNano()))
+		meta = append(meta, scratch[:]...)
+		data, _ := cp.changed.MarshalBinary()
+		meta = append(meta, data...)
+	}
+	binary.LittleEndian.PutUint32(scratch[:], crc32.ChecksumIEEE(meta))
+	return append(meta, scratch[:4]...)
+}
+
+//loadMeta restores the checkpoints from the metadata file if it exists. If the
+// device was not shutdown cleanly every block is considered changed since the
+// latest checkpoint, as blocks may have been written after the metadata was last
+// persisted.
+func (cdev *CBT) loadMeta() error {
+	meta, err := os.ReadFile(cdev.metaFile)
+	switch {
+	case os.IsNotExist(err):
+		return nil //New device
+	case err != nil:
+		return fmt.Errorf("Could not read change tracking metadata file %q: %w", cdev.metaFile, err)
+	}
+
+	switch {
+	case len(meta) < metaHdrBytes+4 || string(meta[:len(metaMagic)]) != metaMagic:
+		return fmt.Errorf("File %q is not change tracking metadata", cdev.metaFile)
+	case crc32.ChecksumIEEE(meta[:len(meta)-4]) != binary.LittleEndian.Uint32(meta[len(meta)-4:]):
+		return fmt.Errorf("Change tracking metadata file %q is corrupt (checksum mismatch)", cdev.metaFile)
+	}
+	if blockBytes := int64(binary.LittleEndian.Uint64(meta[len(metaMagic):])); blockBytes != cdev.blockBytes {
+		return fmt.Errorf("Change tracking metadata file %q has a block size of %d rather than %d", cdev.metaFile, blockBytes, cdev.blockBytes)
+	}
+	if size := int64(binary.LittleEndian.Uint64(meta[len(metaMagic)+8:])); size != cdev.size {
+		return fmt.Errorf("Change tracking metadata file %q is for a device of %d bytes rather than %d", cdev.metaFile, size, cdev.size)
+	}
+	count := int(binary.LittleEndian.Uint32(meta[len(metaMagic)+16:]))
+	clean := meta[metaHdrBytes-1] == 1
+
+	bitmapBytes := int(bitmap.MarshaledSize(cdev.blockCount))
+	rec := meta[metaHdrBytes : len(meta)-4]
+	checkpoints := make([]*checkpoint, 0, count)
+	for i := 0; i < count; i++ {
+		if len(rec) < 1 || len(rec) < 1+int(rec[0])+8+bitmapBytes {
+			return fmt.Errorf("Change tracking metadata file %q is truncated at checkpoint %d of %d", cdev.metaFile, i, count)
+		}
+		nameBytes := int(rec[0])
+		cp := &checkpoint{
+			Checkpoint: Checkpoint{
+				Name:    string(rec[1 : 1+nameBytes]),
+				Created: time.Unix(0, int64(binary.LittleEndian.Uint64(rec[1+nameBytes:]))),
+			},
+			changed: new(bitmap.Bitmap),
+		}
+		rec = rec[1+nameBytes+8:]
+		if err = cp.changed.UnmarshalBinary(rec[:bitmapBytes]); err != nil {
+			return fmt.Errorf("Change tracking metadata file %q has an invalid bitmap for checkpoint %q: %w", cdev.metaFile, cp.Name, err)
+		} else if cp.changed.Len() != cdev.blockCount {
+			return fmt.Errorf("Change tracking metadata file %q has a bitmap of %d blocks for checkpoint %q rather than %d", cdev.metaFile, cp.changed.Len(), cp.Name, cdev.blockCount)
+		}
+		rec = rec[bitmapBytes:]
+		checkpoints = append(checkpoints, cp)
+	}
+	if len(rec) != 0 {
+		return fmt.Errorf("Change tracking metadata file %q has %d unexpected trailing bytes", cdev.metaFile, len(rec))
+	}
+
+	if !clean && len(checkpoints) > 0 {
+		latest := checkpoints[len(checkpoints)-1]
+		log.Printf("CBT::loadMeta(): WARNING: Device %q was not shutdown cleanly, all blocks are considered changed since checkpoint %q", cdev.metaFile, latest.Name)
+		latest.changed.SetRange(0, cdev.blockCount)
+	}
+	cdev.checkpoints = checkpoints
+	return nil
+}
+
+//persist writes the checkpoints to the metadata file if they have changed since
+// they were last persisted, or the device is being shutdown cleanly
+func (cdev *CBT) persist(clean bool) error {
+	cdev.persistMu.Lock()
+	defer cdev.persistMu.Unlock()
+
+	cdev.mu.Lock()
+	if !cdev.dirty && !clean {
+		cdev.mu.Unlock()
+		return nil
+	}
+	meta := cdev.encodeMeta(clean)
+	cdev.dirty = false
+	cdev.mu.Unlock()
+
+	if err := util.WriteFileAtomic(cdev.metaFile, meta, 0600); err != nil {
+		cdev.mu.Lock()
+		cdev.dirty = true
+		cdev.mu.Unlock()
+		return fmt.Errorf("Could not persist change tracking metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package cbt
+
+//Option is a changed block tracking device option
+type Option interface {
+	apply(*CBT)
+}
+
+//OptBlockBytes instructs a CBT device to track changes in blocks of this size; it
+// must be a multiple of the device block size and match that of any persisted
+// metadata. Smaller blocks report changes more precisely at the cost of larger
+// bitmaps (one bit per block per checkpoint).
+type OptBlockBytes int64
+
+func (size OptBlockBytes) apply(cdev *CBT) {
+	cdev.blockBytes = int64(size)
+}
@@ -0,0 +1,225 @@
+package compose
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const errClosed = consterr.ConstErr("Device is shutdown")
+
+//extent is the portion of an IO that falls on a single member
+type extent struct {
+	member    int
+	memberPos int64
+	bufOffset int
+	length    int
+}
+
+//layout maps a range of the composite device onto its members
+type layout interface {
+	extents(pos int64, count int) []extent
+	String() string
+}
+
+//Composite is a device built from several member devices per a layout, IO to
+// different members is issued in parallel
+type Composite struct {
+	members         []usbdlib.Device
+	layout          layout
+	size, blockSize int64
+	atomicOnline    uint64
+}
+
+var _ usbdlib.ReadOnlyDevice = (*Composite)(nil)
+
+func newComposite(devs []usbdlib.Device) (*Composite, error) {
+	if len(devs) < 1 {
+		return nil, fmt.Errorf("At least one member device is required")
+	}
+
+	comp := &Composite{members: devs, atomicOnline: 1}
+	for _, dev := range devs {
+		if blockSize := dev.BlockSize(); blockSize > comp.blockSize {
+			comp.blockSize = blockSize
+		}
+	}
+	for i, dev := range devs {
+		if comp.blockSize%dev.BlockSize() != 0 {
+			return nil, fmt.Errorf("Block size %d of member %d is incompatible with block size %d", dev.BlockSize(), i, comp.blockSize)
+		}
+	}
+	return comp, nil
+}
+
+//Size of this device in bytes
+func (comp *Composite) Size() int64 {
+	return comp.size
+}
+
+//BlockSize of this device is the largest member block size
+func (comp *Composite) BlockSize() int64 {
+	return comp.blockSize
+}
+
+//ReadOnly is true if any member is read-only, fulfilling usbdlib.ReadOnlyDevice
+func (comp *Composite) ReadOnly() bool {
+	for _, dev := range comp.members {
+		if usbdlib.IsReadOnly(dev) {
+			return true
+		}
+	}
+	return false
+}
+
+//String describes the layout of the device
+func (comp *Composite) String() string {
+	return comp.layout.String()
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (comp *Composite) ReadAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&comp.atomicOnline) != 1:
+		return 0, errClosed
+	case pos >= comp.size:
+		return 0, io.EOF
+	}
+	var eof error
+	if end := pos + int64(len(buf)); end > comp.size {
+		buf, eof = buf[:comp.size-pos], io.EOF
+	}
+
+	err = comp.each(pos, len(buf), func(dev usbdlib.Device, ext extent) error {
+		part := buf[ext.bufOffset : ext.bufOffset+ext.length]
+		if n, err := dev.ReadAt(part, ext.memberPos); err != nil && !(err == io.EOF && n == len(part)) {
+			return fmt.Errorf("Could not read %d bytes at offset %d of member %d: %w", len(part), ext.memberPos, ext.member, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), eof
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (comp *Composite) WriteAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&comp.atomicOnline) != 1:
+		return 0, errClosed
+	case pos+int64(len(buf)) > comp.size:
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	err = comp.each(pos, len(buf), func(dev usbdlib.Device, ext extent) error {
+		part := buf[ext.bufOffset : ext.bufOffset+ext.length]
+		if _, err := dev.WriteAt(part, ext.memberPos); err != nil {
+			return fmt.Errorf("Could not write %d bytes at offset %d of member %d: %w", len(part), ext.memberPos, ext.member, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+//Trim fufills part of usbdlib.Device by trimming the affected range of each member
+func (comp *Composite) Trim(pos int64, count int) error {
+	switch {
+	case atomic.LoadUint64(&comp.atomicOnline) != 1:
+		return errClosed
+	case pos >= comp.size:
+		return nil
+	}
+	if pos+int64(count) > comp.size {
+		count = int(comp.size - pos)
+	}
+
+	return comp.each(pos, count, func(dev usbdlib.Device, ext extent) error {
+		if err := dev.Trim(ext.memberPos, ext.length); err != nil {
+			return fmt.Errorf("Could not trim %d bytes at offset %d of member %d: %w", ext.length, ext.memberPos, ext.member, err)
+		}
+		return nil
+	})
+}
+
+//each applies an operation to every extent of the provided range. Extents on the
+// same member are processed in order while members are processed in parallel.
+func (comp *Composite) each(pos int64, count int, op func(usbdlib.Device, extent) error) error {
+	extents := comp.layout.extents(pos, count)
+	if len(extents) == 1 {
+		return op(comp.members[extents[0].member], extents[0])
+	}
+
+	byMember := make(map[int][]extent)
+	for _, ext := range extents {
+		byMember[ext.member] = append(byMember[ext.member], ext)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(byMember))
+	for member, memberExtents := range byMember {
+		wg.Add(1)
+		go func(dev usbdlib.Device, memberExtents []extent) {
+			defer wg.Done()
+			for _, ext := range memberExtents {
+				if err := op(dev, ext); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(comp.members[member], memberExtents)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+//Flush fufills part of usbdlib.Device by flushing all members in parallel
+func (comp *Composite) Flush() error {
+	if atomic.LoadUint64(&comp.atomicOnline) != 1 {
+		return errClosed
+	}
+	return comp.all(func(i int, dev usbdlib.Device) error {
+		if err := dev.Flush(); err != nil {
+			return fmt.Errorf("Could not flush member %d: %w", i, err)
+		}
+		return nil
+	})
+}
+
+func (comp *Composite) all(op func(int, usbdlib.Device) error) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(comp.members))
+	wg.Add(len(comp.members))
+	for i, dev := range comp.members {
+		go func(i int, dev usbdlib.Device) {
+			defer wg.Done()
+			if err := op(i, dev); err != nil {
+				errs <- err
+			}
+		}(i, dev)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+//Close closes all members
+func (comp *Composite) Close() error {
+	if !atomic.CompareAndSwapUint64(&comp.atomicOnline, 1, 0) {
+		return errClosed
+	}
+	return comp.all(func(i int, dev usbdlib.Device) error {
+		if err := dev.Close(); err != nil {
+			return fmt.Errorf("Could not close member %d: %w", i, err)
+		}
+		return nil
+	})
+}
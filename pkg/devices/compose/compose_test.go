@@ -0,0 +1,130 @@
+package compose
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const mib = 1024 * 1024
+
+func ramdisks(sizes ...int64) []usbdlib.Device {
+	devs := make([]usbdlib.Device, len(sizes))
+	for i, size := range sizes {
+		devs[i] = ramdisk.NewRAMDisk(size)
+	}
+	return devs
+}
+
+func TestConcat(t *testing.T) {
+	const sizeBytes = 4*mib + 8*mib + 4096*3 //Odd sized member is truncated
+
+	create := func() usbdlib.Device {
+		dev, err := Concat(ramdisks(4*mib, 8*mib, 4096*3+100)...)
+		if err != nil {
+			t.Fatalf("Could not create concatenated device: %s", err)
+		}
+		return dev
+	}
+	testutil.TestUserspace(t, create(), sizeBytes)
+	testutil.TestNBD(t, create(), sizeBytes)
+}
+
+func TestStripe(t *testing.T) {
+	const sizeBytes = 3 * 4 * mib
+
+	create := func() usbdlib.Device {
+		dev, err := Stripe(64*1024, ramdisks(4*mib, 4*mib+64*1024-1, 5*mib)...)
+		if err != nil {
+			t.Fatalf("Could not create striped device: %s", err)
+		}
+		return dev
+	}
+	testutil.TestUserspace(t, create(), sizeBytes)
+	testutil.TestNBD(t, create(), sizeBytes)
+}
+
+func TestLayout(t *testing.T) {
+	const chunkBytes = 8192
+
+	cases := []struct {
+		desc    string
+		members []usbdlib.Device
+		create  func(devs []usbdlib.Device) (*Composite, error)
+		//placement returns the member and member offset of a device offset
+		placement func(pos int64) (int, int64)
+	}{
+		{
+			desc:    "concat",
+			members: ramdisks(mib, 2*mib, mib),
+			create: func(devs []usbdlib.Device) (*Composite, error) {
+				return Concat(devs...)
+			},
+			placement: func(pos int64) (int, int64) {
+				switch {
+				case pos < mib:
+					return 0, pos
+				case pos < 3*mib:
+					return 1, pos - mib
+				}
+				return 2, pos - 3*mib
+			},
+		},
+		{
+			desc:    "stripe",
+			members: ramdisks(mib, mib, mib),
+			create: func(devs []usbdlib.Device) (*Composite, error) {
+				return Stripe(chunkBytes, devs...)
+			},
+			placement: func(pos int64) (int, int64) {
+				chunk := pos / chunkBytes
+				return int(chunk % 3), (chunk/3)*chunkBytes + pos%chunkBytes
+			},
+		},
+	}
+
+	for _, tcase := range cases {
+		t.Run(tcase.desc, func(t *testing.T) {
+			dev, err := tcase.create(tcase.members)
+			if err != nil {
+				t.Fatalf("Could not create device: %s", err)
+			}
+			defer dev.Close()
+
+			//Random writes spanning member and chunk boundaries
+			contents := make([]byte, dev.Size())
+			rnd := rand.New(rand.NewSource(1))
+			for i := 0; i < 200; i++ {
+				data := make([]byte, rnd.Intn(5*chunkBytes)+1)
+				rnd.Read(data)
+				pos := rnd.Int63n(dev.Size() - int64(len(data)))
+				if _, err = dev.WriteAt(data, pos); err != nil {
+					t.Fatalf("Write of %d bytes at %d failed: %s", len(data), pos, err)
+				}
+				copy(contents[pos:], data)
+			}
+
+			actual := make([]byte, len(contents))
+			if _, err = dev.ReadAt(actual, 0); err != nil {
+				t.Fatalf("Read failed: %s", err)
+			} else if !bytes.Equal(actual, contents) {
+				t.Fatalf("Data read did not match data written")
+			}
+
+			//Verify where each block landed
+			block := make([]byte, 4096)
+			for pos := int64(0); pos < dev.Size(); pos += int64(len(block)) {
+				member, memberPos := tcase.placement(pos)
+				if _, err = tcase.members[member].ReadAt(block, memberPos); err != nil {
+					t.Fatalf("Could not read member %d: %s", member, err)
+				} else if !bytes.Equal(block, contents[pos:pos+int64(len(block))]) {
+					t.Fatalf("Block at %d was not at offset %d of member %d", pos, memberPos, member)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package compose
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+
+	"github.com/dustin/go-humanize"
+)
+
+//concatLayout places members one after another
+type concatLayout struct {
+	starts []int64 //Offset at which each member begins, plus the total size
+}
+
+//Concat constructs a device that is the linear concatenation of the provided
+// devices. Members are truncated to a multiple of the largest member block size.
+func Concat(devs ...usbdlib.Device) (*Composite, error) {
+	comp, err := newComposite(devs)
+	if err != nil {
+		return nil, err
+	}
+
+	lay := &concatLayout{starts: make([]int64, 0, len(devs)+1)}
+	for i, dev := range devs {
+		memberSize := dev.Size() - dev.Size()%comp.blockSize
+		if memberSize < 1 {
+			return nil, fmt.Errorf("Member %d is smaller than a block", i)
+		}
+		lay.starts = append(lay.starts, comp.size)
+		comp.size += memberSize
+	}
+	lay.starts = append(lay.starts, comp.size)
+	comp.layout = lay
+	return comp, nil
+}
+
+func (lay *concatLayout) extents(pos int64, count int) []extent {
+	//Find the last member starting at or before pos
+	member := sort.Search(len(lay.starts), func(i int) bool { return lay.starts[i] > pos }) - 1
+
+	var extents []extent
+	for bufOffset := 0; bufOffset < count; member++ {
+		memberPos := pos + int64(bufOffset) - lay.starts[member]
+		length := count - bufOffset
+		if remaining := lay.starts[member+1] - lay.starts[member] - memberPos; int64(length) > remaining {
+			length = int(remaining)
+		}
+		extents = append(extents, extent{member: member, memberPos: memberPos, bufOffset: bufOffset, length: length})
+		bufOffset += length
+	}
+	return extents
+}
+
+func (lay *concatLayout) String() string {
+	return fmt.Sprintf("concatenation of %d members totaling %s", len(lay.starts)-1, humanize.IBytes(uint64(lay.starts[len(lay.starts)-1])))
+}
@@ -0,0 +1,68 @@
+package compose
+
+import (
+	"fmt"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+
+	"github.com/dustin/go-humanize"
+)
+
+//stripeLayout distributes consecutive chunks across members round-robin
+type stripeLayout struct {
+	chunkBytes  int64
+	memberCount int64
+	memberBytes int64
+}
+
+//Stripe constructs a RAID0 device that distributes chunks of the provided size
+// across the provided devices. The chunk size must be a multiple of the largest
+// member block size and each member contributes as many chunks as the smallest.
+func Stripe(chunkBytes int64, devs ...usbdlib.Device) (*Composite, error) {
+	comp, err := newComposite(devs)
+	if err != nil {
+		return nil, err
+	}
+	if chunkBytes < comp.blockSize || chunkBytes%comp.blockSize != 0 {
+		return nil, fmt.Errorf("Chunk size %d is not a multiple of the block size %d", chunkBytes, comp.blockSize)
+	}
+
+	lay := &stripeLayout{chunkBytes: chunkBytes, memberCount: int64(len(devs)), memberBytes: devs[0].Size()}
+	for _, dev := range devs[1:] {
+		if size := dev.Size(); size < lay.memberBytes {
+			lay.memberBytes = size
+		}
+	}
+	if lay.memberBytes -= lay.memberBytes % chunkBytes; lay.memberBytes < 1 {
+		return nil, fmt.Errorf("Smallest member is smaller than a chunk (%d bytes)", chunkBytes)
+	}
+
+	comp.size, comp.layout = lay.memberBytes*lay.memberCount, lay
+	return comp, nil
+}
+
+func (lay *stripeLayout) extents(pos int64, count int) []extent {
+	var extents []extent
+	for bufOffset := 0; bufOffset < count; {
+		offset := pos + int64(bufOffset)
+		chunk, inChunk := offset/lay.chunkBytes, offset%lay.chunkBytes
+		length := count - bufOffset
+		if remaining := lay.chunkBytes - inChunk; int64(length) > remaining {
+			length = int(remaining)
+		}
+
+		extents = append(extents, extent{
+			member:    int(chunk % lay.memberCount),
+			memberPos: (chunk/lay.memberCount)*lay.chunkBytes + inChunk,
+			bufOffset: bufOffset,
+			length:    length,
+		})
+		bufOffset += length
+	}
+	return extents
+}
+
+func (lay *stripeLayout) String() string {
+	return fmt.Sprintf("stripe of %d members with %s chunks totaling %s", lay.memberCount,
+		humanize.IBytes(uint64(lay.chunkBytes)), humanize.IBytes(uint64(lay.memberBytes*lay.memberCount)))
+}
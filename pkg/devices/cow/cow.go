@@ -0,0 +1,494 @@
+package cow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/bitmap"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed = consterr.ConstErr("Device is shutdown")
+
+	metaMagic     = "USBDCOW1"
+	metaHdrBytes  = len(metaMagic) + 8 + 8
+	lockStripes   = 64
+	copyChunkSize = 1024 * 1024
+)
+
+type blockState uint8
+
+const (
+	stateBase blockState = iota
+	stateOverlay
+	stateZero
+)
+
+//COW is a copy-on-write device layering a writable overlay device over a base
+// device that is never written to until the overlay is committed. Which blocks
+// have been overwritten (or trimmed) is tracked in bitmaps that are persisted to
+// a metadata file whenever the device is flushed.
+type COW struct {
+	base, overlay     usbdlib.Device
+	metaFile          string
+	size, blockBytes  int64
+	blockCount        int64
+	blockLocks        [lockStripes]sync.Mutex
+	ioMu              sync.RWMutex //Held exclusively to commit or discard
+	persistMu         sync.Mutex
+	atomicOnline      uint64
+	mapMu             sync.Mutex
+	allocated, zeroed *bitmap.Bitmap
+	dirty             bool
+}
+
+//NewCOW constructs a copy-on-write device over the provided base device. The
+// overlay device must be at least as large as the base and receives all writes.
+// If a metadata file is provided the overlay's allocation bitmap is loaded from
+// it, if it exists, and persisted to it on every flush; otherwise (ex. a RAMDisk
+// overlay) the overlay is discarded when the device is closed. The COW device
+// owns both the base and overlay devices and closes them when it is closed.
+func NewCOW(base, overlay usbdlib.Device, metaFile string, options ...Option) (*COW, error) {
+	dev := &COW{
+		base:         base,
+		overlay:      overlay,
+		metaFile:     metaFile,
+		size:         base.Size(),
+		blockBytes:   base.BlockSize(),
+		atomicOnline: 1,
+	}
+	for _, opt := range options {
+		opt.apply(dev)
+	}
+
+	switch {
+	case dev.blockBytes < 1 || dev.blockBytes%base.BlockSize() != 0:
+		return nil, fmt.Errorf("Block size %d is not a multiple of the base device block size %d", dev.blockBytes, base.BlockSize())
+	case overlay.Size() < dev.size:
+		return nil, fmt.Errorf("Overlay device size %d is smaller than the base device size %d", overlay.Size(), dev.size)
+	}
+
+	dev.blockCount = (dev.size + dev.blockBytes - 1) / dev.blockBytes
+	dev.allocated, dev.zeroed = bitmap.New(dev.blockCount), bitmap.New(dev.blockCount)
+	if metaFile != "" {
+		if err := dev.loadMeta(); err != nil {
+			return nil, err
+		}
+	}
+	return dev, nil
+}
+
+//Size of this device in bytes
+func (dev *COW) Size() int64 {
+	return dev.size
+}
+
+//BlockSize of this device is that of the base device
+func (dev *COW) BlockSize() int64 {
+	return dev.base.BlockSize()
+}
+
+//OverlayBlocks returns the number of blocks that have been overwritten and the
+// number that have been trimmed since the overlay was created or last committed
+func (dev *COW) OverlayBlocks() (allocated, zeroed int64) {
+	dev.mapMu.Lock()
+	defer dev.mapMu.Unlock()
+	return dev.allocated.Count(), dev.zeroed.Count()
+}
+
+//stateOf returns where the current contents of a block reside, the caller must
+// hold mapMu
+func (dev *COW) stateOf(idx int64) blockState {
+	switch {
+	case dev.allocated.Test(idx):
+		return stateOverlay
+	case dev.zeroed.Test(idx):
+		return stateZero
+	}
+	return stateBase
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (dev *COW) ReadAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case pos >= dev.size:
+		return 0, io.EOF
+	}
+	var eof error
+	if end := pos + int64(len(buf)); end > dev.size {
+		buf, eof = buf[:dev.size-pos], io.EOF
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	lastIdx := (pos + int64(len(buf)) - 1) / dev.blockBytes
+	for count < len(buf) {
+		//Read runs of blocks that reside in the same place at once
+		offset := pos + int64(count)
+		idx := offset / dev.blockBytes
+		dev.mapMu.Lock()
+		state, runEnd := dev.stateOf(idx), idx+1
+		for runEnd <= lastIdx && dev.stateOf(runEnd) == state {
+			runEnd++
+		}
+		dev.mapMu.Unlock()
+
+		n := len(buf) - count
+		if remaining := runEnd*dev.blockBytes - offset; int64(n) > remaining {
+			n = int(remaining)
+		}
+		part := buf[count : count+n]
+
+		switch state {
+		case stateBase:
+			err = readFull(dev.base, part, offset)
+		case stateOverlay:
+			err = readFull(dev.overlay, part, offset)
+		case stateZero:
+			util.ZeroFill(part)
+		}
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, eof
+}
+
+func readFull(src io.ReaderAt, buf []byte, pos int64) error {
+	if n, err := src.ReadAt(buf, pos); err != nil && !(err == io.EOF && n == len(buf)) {
+		return fmt.Errorf("Could not read %d bytes at offset %d: %w", len(buf), pos, err)
+	}
+	return nil
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (dev *COW) WriteAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case pos+int64(len(buf)) > dev.size:
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	for count < len(buf) {
+		offset := pos + int64(count)
+		idx := offset / dev.blockBytes
+		n := len(buf) - count
+		if remaining := (idx+1)*dev.blockBytes - offset; int64(n) > remaining {
+			n = int(remaining)
+		}
+		if err = dev.writeBlock(idx, buf[count:count+n], offset); err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+//writeBlock writes data within a single block to the overlay, copying up the
+// remainder of the block from the base device if this is the first write to it
+func (dev *COW) writeBlock(idx int64, data []byte, pos int64) error {
+	lock := &dev.blockLocks[idx%lockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	dev.mapMu.Lock()
+	state := dev.stateOf(idx)
+	dev.mapMu.Unlock()
+
+	blockStart, blockEnd := idx*dev.blockBytes, (idx+1)*dev.blockBytes
+	if blockEnd > dev.size {
+		blockEnd = dev.size
+	}
+	if state != stateOverlay && int64(len(data)) != blockEnd-blockStart {
+		block := make([]byte, blockEnd-blockStart)
+		if state == stateBase {
+			if err := readFull(dev.base, block, blockStart); err != nil {
+				return fmt.Errorf("Could not copy up block %d from base device: %w", idx, err)
+			}
+		}
+		copy(block[pos-blockStart:], data)
+		data, pos = block, blockStart
+	}
+
+	if _, err := dev.overlay.WriteAt(data, pos); err != nil {
+		return fmt.Errorf("Could not write %d bytes at offset %d to overlay: %w", len(data), pos, err)
+	}
+	if state != stateOverlay {
+		dev.mapMu.Lock()
+		dev.allocated.Set(idx)
+		dev.zeroed.Clear(idx)
+		dev.dirty = true
+		dev.mapMu.Unlock()
+	}
+	return nil
+}
+
+//Trim marks all blocks entirely within the provided range as zeroed, releasing
+// their space in the overlay; the base device is not modified
+func (dev *COW) Trim(pos int64, count int) error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	first, last := (pos+dev.blockBytes-1)/dev.blockBytes, (pos+int64(count))/dev.blockBytes
+	if pos+int64(count) >= dev.size { //The final block may be short
+		last = dev.blockCount
+	}
+	for idx := first; idx < last; idx++ {
+		if err := dev.zeroBlock(idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dev *COW) zeroBlock(idx int64) error {
+	lock := &dev.blockLocks[idx%lockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	dev.mapMu.Lock()
+	state := dev.stateOf(idx)
+	if state != stateZero {
+		dev.zeroed.Set(idx)
+		dev.allocated.Clear(idx)
+		dev.dirty = true
+	}
+	dev.mapMu.Unlock()
+
+	if state == stateOverlay {
+		blockStart, blockBytes := idx*dev.blockBytes, dev.blockBytes
+		if blockStart+blockBytes > dev.size {
+			blockBytes = dev.size - blockStart
+		}
+		if err := dev.overlay.Trim(blockStart, int(blockBytes)); err != nil {
+			return fmt.Errorf("Could not trim block %d of overlay: %w", idx, err)
+		}
+	}
+	return nil
+}
+
+//Flush flushes the overlay device and then persists the overlay metadata
+func (dev *COW) Flush() error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+	return dev.sync()
+}
+
+//sync flushes the overlay and persists metadata describing only data that was
+// written to the overlay before the flush
+func (dev *COW) sync() error {
+	dev.persistMu.Lock()
+	defer dev.persistMu.Unlock()
+
+	dev.mapMu.Lock()
+	wasDirty := dev.dirty
+	var meta []byte
+	if wasDirty && dev.metaFile != "" {
+		meta = dev.encodeMeta()
+	}
+	dev.dirty = false
+	dev.mapMu.Unlock()
+
+	err := dev.overlay.Flush()
+	if err != nil {
+		err = fmt.Errorf("Could not flush overlay device: %w", err)
+	} else if meta != nil {
+		if err = util.WriteFileAtomic(dev.metaFile, meta, 0600); err != nil {
+			err = fmt.Errorf("Could not persist overlay metadata: %w", err)
+		}
+	}
+	if err != nil && wasDirty {
+		dev.mapMu.Lock()
+		dev.dirty = true
+		dev.mapMu.Unlock()
+	}
+	return err
+}
+
+//encodeMeta serializes the overlay bitmaps, the caller must hold mapMu
+func (dev *COW) encodeMeta() []byte {
+	allocated, _ := dev.allocated.MarshalBinary()
+	zeroed, _ := dev.zeroed.MarshalBinary()
+
+	meta := make([]byte, metaHdrBytes, metaHdrBytes+len(allocated)+len(zeroed)+4)
+	copy(meta, metaMagic)
+	binary.LittleEndian.PutUint64(meta[len(metaMagic):], uint64(dev.blockBytes))
+	binary.LittleEndian.PutUint64(meta[len(metaMagic)+8:], uint64(dev.size))
+	meta = append(append(meta, allocated...), zeroed...)
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(meta))
+	return append(meta, crc...)
+}
+
+func (dev *COW) loadMeta() error {
+	meta, err := os.ReadFile(dev.metaFile)
+	switch {
+	case os.IsNotExist(err):
+		return nil //New overlay
+	case err != nil:
+		return fmt.Errorf("Could not read overlay metadata file %q: %w", dev.metaFile, err)
+	}
+
+	bitmapBytes := bitmap.MarshaledSize(dev.blockCount)
+	switch {
+	case int64(len(meta)) != int64(metaHdrBytes)+2*bitmapBytes+4:
+		return fmt.Errorf("Overlay metadata file %q is %d bytes; expected %d", dev.metaFile, len(meta), int64(metaHdrBytes)+2*bitmapBytes+4)
+	case crc32.ChecksumIEEE(meta[:len(meta)-4]) != binary.LittleEndian.Uint32(meta[len(meta)-4:]):
+		return fmt.Errorf("Overlay metadata file %q is corrupt (checksum mismatch)", dev.metaFile)
+	case string(meta[:len(metaMagic)]) != metaMagic:
+		return fmt.Errorf("File %q is not overlay metadata", dev.metaFile)
+	}
+	if blockBytes := int64(binary.LittleEndian.Uint64(meta[len(metaMagic):])); blockBytes != dev.blockBytes {
+		return fmt.Errorf("Overlay metadata file %q has a block size of %d rather than %d", dev.metaFile, blockBytes, dev.blockBytes)
+	}
+	if size := int64(binary.LittleEndian.Uint64(meta[len(metaMagic)+8:])); size != dev.size {
+		return fmt.Errorf("Overlay metadata file %q is for a base device of %d bytes rather than %d", dev.metaFile, size, dev.size)
+	}
+
+	meta = meta[metaHdrBytes:]
+	if err = dev.allocated.UnmarshalBinary(meta[:bitmapBytes]); err == nil {
+		err = dev.zeroed.UnmarshalBinary(meta[bitmapBytes : 2*bitmapBytes])
+	}
+	if err != nil {
+		return fmt.Errorf("Could not decode overlay metadata file %q: %w", dev.metaFile, err)
+	}
+	return nil
+}
+
+//Commit merges the overlay into the base device, which must be writable, and then
+// empties the overlay. IO is blocked while committing. If interrupted the overlay
+// is left intact and commit can be retried.
+func (dev *COW) Commit() error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	dev.ioMu.Lock()
+	defer dev.ioMu.Unlock()
+
+	chunkBlocks := int64(copyChunkSize) / dev.blockBytes
+	if chunkBlocks < 1 {
+		chunkBlocks = 1
+	}
+	buf := make([]byte, chunkBlocks*dev.blockBytes)
+
+	err := dev.forEachRun(dev.allocated, chunkBlocks, func(start, end int64) error {
+		part := buf[:end-start]
+		if err := readFull(dev.overlay, part, start); err != nil {
+			return fmt.Errorf("Could not read overlay: %w", err)
+		}
+		if _, err := dev.base.WriteAt(part, start); err != nil {
+			return fmt.Errorf("Could not write %d bytes at offset %d to base device: %w", len(part), start, err)
+		}
+		return nil
+	})
+	if err == nil {
+		zeros := make([]byte, len(buf))
+		err = dev.forEachRun(dev.zeroed, chunkBlocks, func(start, end int64) error {
+			if _, err := dev.base.WriteAt(zeros[:end-start], start); err != nil {
+				return fmt.Errorf("Could not zero %d bytes at offset %d of base device: %w", end-start, start, err)
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		if err = dev.base.Flush(); err != nil {
+			err = fmt.Errorf("Could not flush base device: %w", err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Could not commit overlay: %w", err)
+	}
+	return dev.reset()
+}
+
+//forEachRun invokes the provided function with the byte range of each run of at
+// most chunkBlocks set bits
+func (dev *COW) forEachRun(bits *bitmap.Bitmap, chunkBlocks int64, fn func(start, end int64) error) error {
+	for idx := bits.NextSet(0); idx >= 0; idx = bits.NextSet(idx) {
+		runEnd := bits.NextClear(idx)
+		if runEnd < 0 {
+			runEnd = dev.blockCount
+		}
+		for ; idx < runEnd; idx += chunkBlocks {
+			end := idx + chunkBlocks
+			if end > runEnd {
+				end = runEnd
+			}
+			endByte := end * dev.blockBytes
+			if endByte > dev.size {
+				endByte = dev.size
+			}
+			if err := fn(idx*dev.blockBytes, endByte); err != nil {
+				return err
+			}
+		}
+		idx = runEnd
+	}
+	return nil
+}
+
+//Discard throws away all changes made in the overlay
+func (dev *COW) Discard() error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	dev.ioMu.Lock()
+	defer dev.ioMu.Unlock()
+	return dev.reset()
+}
+
+//reset empties the overlay, the caller must hold ioMu exclusively
+func (dev *COW) reset() error {
+	dev.mapMu.Lock()
+	dev.allocated.ClearAll()
+	dev.zeroed.ClearAll()
+	dev.dirty = true
+	dev.mapMu.Unlock()
+
+	if err := dev.overlay.Trim(0, int(dev.size)); err != nil {
+		return fmt.Errorf("Could not trim overlay: %w", err)
+	}
+	return dev.sync()
+}
+
+//Close persists the overlay metadata and closes the overlay and base devices
+func (dev *COW) Close() error {
+	if !atomic.CompareAndSwapUint64(&dev.atomicOnline, 1, 0) {
+		return errClosed
+	}
+
+	dev.ioMu.Lock() //Wait for outstanding IO
+	defer dev.ioMu.Unlock()
+
+	err := dev.sync()
+	if closeErr := dev.overlay.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("Could not close overlay device: %w", closeErr)
+	}
+	if closeErr := dev.base.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("Could not close base device: %w", closeErr)
+	}
+	return err
+}
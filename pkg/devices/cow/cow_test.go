@@ -0,0 +1,179 @@
+package cow
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+func TestCOW(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	testutil.TestUserspace(t, createDevice(t, sizeBytes), sizeBytes)
+	testutil.TestNBD(t, createDevice(t, sizeBytes), sizeBytes)
+}
+
+func createDevice(t *testing.T, sizeBytes int64) usbdlib.Device {
+	dev, err := NewCOW(ramdisk.NewRAMDisk(sizeBytes), ramdisk.NewRAMDisk(sizeBytes), "")
+	if err != nil {
+		t.Fatalf("Could not create copy-on-write test device: %s", err)
+	}
+	return dev
+}
+
+//patternDisk returns a RAMDisk filled with random data and a copy of that data
+func patternDisk(t *testing.T, sizeBytes int64) (*ramdisk.RAMDisk, []byte) {
+	data := make([]byte, sizeBytes)
+	rand.New(rand.NewSource(sizeBytes)).Read(data)
+	base := ramdisk.NewRAMDisk(sizeBytes)
+	if _, err := base.WriteAt(data, 0); err != nil {
+		t.Fatalf("Could not fill base device: %s", err)
+	}
+	return base, data
+}
+
+func expectContents(t *testing.T, desc string, dev usbdlib.Device, expected []byte) {
+	t.Helper()
+
+	actual := make([]byte, len(expected))
+	if _, err := dev.ReadAt(actual, 0); err != nil {
+		t.Fatalf("Could not read %s: %s", desc, err)
+	} else if !bytes.Equal(actual, expected) {
+		t.Fatalf("Contents of %s were not as expected", desc)
+	}
+}
+
+//applyWrites performs random (often unaligned) writes and trims to the device
+// and the provided shadow copy of its expected contents
+func applyWrites(t *testing.T, dev usbdlib.Device, shadow []byte, seed int64) {
+	t.Helper()
+
+	rnd := rand.New(rand.NewSource(seed))
+	for i := 0; i < 100; i++ {
+		pos := rnd.Int63n(int64(len(shadow)))
+		count := rnd.Int63n(3*4096) + 1
+		if pos+count > int64(len(shadow)) {
+			count = int64(len(shadow)) - pos
+		}
+
+		if i%10 == 9 { //Trim whole blocks, partial blocks need not be zeroed
+			const trimBytes = 16 * 1024
+			pos, count = pos/trimBytes*trimBytes, 2*trimBytes
+			if pos+count > int64(len(shadow)) {
+				count = int64(len(shadow)) - pos
+			}
+			if err := dev.Trim(pos, int(count)); err != nil {
+				t.Fatalf("Trim of %d bytes at %d failed: %s", count, pos, err)
+			}
+			copy(shadow[pos:pos+count], make([]byte, count))
+			continue
+		}
+
+		data := make([]byte, count)
+		rnd.Read(data)
+		if _, err := dev.WriteAt(data, pos); err != nil {
+			t.Fatalf("Write of %d bytes at %d failed: %s", count, pos, err)
+		}
+		copy(shadow[pos:], data)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	const sizeBytes = 1024*1024 + 4096*3
+
+	base, baseData := patternDisk(t, sizeBytes)
+	dev, err := NewCOW(base, ramdisk.NewRAMDisk(sizeBytes), "", OptBlockBytes(4*4096))
+	if err != nil {
+		t.Fatalf("Could not create device: %s", err)
+	}
+	defer dev.Close()
+
+	expectContents(t, "new overlay", dev, baseData)
+
+	shadow := append([]byte(nil), baseData...)
+	applyWrites(t, dev, shadow, 1)
+	expectContents(t, "overlay", dev, shadow)
+	expectContents(t, "base device", base, baseData)
+
+	if allocated, zeroed := dev.OverlayBlocks(); allocated < 1 || zeroed < 1 {
+		t.Fatalf("Overlay reported %d allocated and %d zeroed blocks", allocated, zeroed)
+	}
+
+	t.Run("discard", func(t *testing.T) {
+		if err := dev.Discard(); err != nil {
+			t.Fatalf("Discard failed: %s", err)
+		}
+		expectContents(t, "discarded overlay", dev, baseData)
+		if allocated, zeroed := dev.OverlayBlocks(); allocated != 0 || zeroed != 0 {
+			t.Fatalf("Overlay reported %d allocated and %d zeroed blocks after discard", allocated, zeroed)
+		}
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		shadow := append([]byte(nil), baseData...)
+		applyWrites(t, dev, shadow, 2)
+		if err := dev.Commit(); err != nil {
+			t.Fatalf("Commit failed: %s", err)
+		}
+		expectContents(t, "base device after commit", base, shadow)
+		expectContents(t, "committed overlay", dev, shadow)
+		if allocated, zeroed := dev.OverlayBlocks(); allocated != 0 || zeroed != 0 {
+			t.Fatalf("Overlay reported %d allocated and %d zeroed blocks after commit", allocated, zeroed)
+		}
+	})
+}
+
+func TestPersist(t *testing.T) {
+	const sizeBytes = 512 * 1024
+
+	dir := t.TempDir()
+	baseFile, overlayFile, metaFile := filepath.Join(dir, "base.img"), filepath.Join(dir, "overlay.img"), filepath.Join(dir, "overlay.meta")
+	open := func() *COW {
+		base, err := filedisk.NewFileDisk(baseFile, sizeBytes)
+		if err != nil {
+			t.Fatalf("Could not open base device: %s", err)
+		}
+		overlay, err := filedisk.NewFileDisk(overlayFile, sizeBytes)
+		if err != nil {
+			t.Fatalf("Could not open overlay device: %s", err)
+		}
+		dev, err := NewCOW(base, overlay, metaFile)
+		if err != nil {
+			t.Fatalf("Could not create device: %s", err)
+		}
+		return dev
+	}
+
+	shadow := make([]byte, sizeBytes)
+	dev := open()
+	applyWrites(t, dev, shadow, 3)
+	if err := dev.Close(); err != nil {
+		t.Fatalf("Could not close device: %s", err)
+	}
+
+	dev = open()
+	expectContents(t, "reopened overlay", dev, shadow)
+	if err := dev.Close(); err != nil {
+		t.Fatalf("Could not close device: %s", err)
+	}
+
+	//Metadata for a differently sized base device is refused
+	base, overlay := ramdisk.NewRAMDisk(sizeBytes*2), ramdisk.NewRAMDisk(sizeBytes*2)
+	if _, err := NewCOW(base, overlay, metaFile); err == nil {
+		t.Fatalf("Metadata for a different base device was accepted")
+	}
+}
+
+func TestPowerLoss(t *testing.T) {
+	metaFile := filepath.Join(t.TempDir(), "overlay.meta")
+	testutil.TestPowerLoss(t, testutil.CrashConfig{}, func(disk usbdlib.Device, create bool) (usbdlib.Device, error) {
+		parts := testutil.Partitions(disk, 2)
+		return NewCOW(parts[0], parts[1], metaFile)
+	})
+}
@@ -0,0 +1,16 @@
+package cow
+
+//Option is a copy-on-write device option
+type Option interface {
+	apply(*COW)
+}
+
+//OptBlockBytes instructs a COW device to track overwritten regions of the base
+// device at this granularity; it must be a multiple of the base device's block
+// size. Larger blocks reduce metadata size at the cost of copying more of the
+// base device on the first write to each block.
+type OptBlockBytes int64
+
+func (size OptBlockBytes) apply(dev *COW) {
+	dev.blockBytes = int64(size)
+}
@@ -0,0 +1,387 @@
+package crashsim
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed = consterr.ConstErr("Device is shutdown")
+
+	//ErrCrashed is returned by all operations once the device has crashed
+	ErrCrashed = consterr.ConstErr("Device has crashed")
+
+	//SectorBytes is the granularity at which CrashTear cuts writes short
+	SectorBytes = 512
+
+	overlayBytes = 4096      //Granularity of the copy of held writes serving reads
+	mergeBytes   = 64 * 1024 //Limit on merging contiguous writes
+)
+
+//CrashMode decides which of the writes not yet flushed reach the wrapped device
+// when a CrashSim crashes
+type CrashMode uint8
+
+const (
+	//CrashDropAll loses every write since the last flush, as if all of them were
+	// still in a volatile disk cache
+	CrashDropAll CrashMode = iota
+	//CrashKeepAll applies every write since the last flush in order, as if the
+	// process died but the operating system flushed its page cache
+	CrashKeepAll
+	//CrashDropRandom applies a random subset of the writes since the last flush in
+	// the order they were made
+	CrashDropRandom
+	//CrashReorder applies a random subset of the writes since the last flush in a
+	// random order
+	CrashReorder
+	//CrashTear applies a random subset of the writes since the last flush in a
+	// random order, cutting each short after a random number of sectors
+	CrashTear
+)
+
+//CrashModes is every CrashMode
+var CrashModes = []CrashMode{CrashDropAll, CrashKeepAll, CrashDropRandom, CrashReorder, CrashTear}
+
+var crashModeNames = []string{"drop-all", "keep-all", "drop-random", "reorder", "tear"}
+
+func (mode CrashMode) String() string {
+	if int(mode) < len(crashModeNames) {
+		return crashModeNames[mode]
+	}
+	return "unknown"
+}
+
+//pendingOp is a write or trim made since the last flush
+type pendingOp struct {
+	pos   int64
+	data  []byte //nil for trims
+	count int
+}
+
+//CrashSim wraps a device and holds the writes and trims made to it in memory until
+// they are flushed, so it can simulate a power loss by crashing: applying only
+// some of those held to the wrapped device, as decided by a CrashMode, and then
+// failing all further operations. Reads see all writes made, whether flushed or
+// not. Held trims do not affect reads as the contents of trimmed ranges are
+// undefined. A write continuing where the last one held ended is merged with it,
+// up to 64 KB, as a disk's write cache would.
+//
+// The wrapped device is usually a persistent disk (ex. a FileDisk) beneath the
+// device under test, which is reopened on it after the crash to check what
+// survived.
+type CrashSim struct {
+	dev usbdlib.Device
+
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	pending []pendingOp
+	overlay map[int64][]byte //Contents of the blocks written by held writes
+	closed  bool
+	crashed bool
+
+	armOps  int64 //Operations until an armed crash, 0 if not armed
+	armMode CrashMode
+}
+
+var _ usbdlib.Device = (*CrashSim)(nil)
+
+//NewCrashSim constructs a device holding the writes to the provided device, which
+// it owns and closes when closed or crashed, until they are flushed. The seed
+// decides the writes applied by crashes so they can be repeated.
+func NewCrashSim(dev usbdlib.Device, seed int64) *CrashSim {
+	return &CrashSim{
+		dev:     dev,
+		rnd:     rand.New(rand.NewSource(seed)),
+		overlay: make(map[int64][]byte),
+	}
+}
+
+//Size of this device in bytes
+func (sim *CrashSim) Size() int64 {
+	return sim.dev.Size()
+}
+
+//BlockSize of this device is that of the wrapped device
+func (sim *CrashSim) BlockSize() int64 {
+	return sim.dev.BlockSize()
+}
+
+//Pending returns the number of writes and trims held since the last flush
+func (sim *CrashSim) Pending() int {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return len(sim.pending)
+}
+
+//Crashed returns if the device has crashed
+func (sim *CrashSim) Crashed() bool {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return sim.crashed
+}
+
+//ArmCrash crashes the device, using the provided mode, when the nth following
+// write, trim or flush is made instead of making it. This allows crashing part way
+// through an operation of the device above.
+func (sim *CrashSim) ArmCrash(n int, mode CrashMode) error {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	if err := sim.checkOnline(); err != nil {
+		return err
+	} else if n < 1 {
+		return fmt.Errorf("Crash can not be armed %d operations from now", n)
+	}
+	sim.armOps, sim.armMode = int64(n), mode
+	return nil
+}
+
+//Crash applies the writes and trims held since the last flush to the wrapped
+// device, as decided by the provided mode, then flushes and closes it. All further
+// operations fail with ErrCrashed. The number of held operations applied, in part
+// or whole, is returned.
+func (sim *CrashSim) Crash(mode CrashMode) (int, error) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	if err := sim.checkOnline(); err != nil {
+		return 0, err
+	}
+	return sim.crash(mode)
+}
+
+//crash implements Crash, the caller must hold mu
+func (sim *CrashSim) crash(mode CrashMode) (int, error) {
+	if int(mode) >= len(crashModeNames) {
+		return 0, fmt.Errorf("Unknown crash mode %d", mode)
+	}
+	sim.crashed, sim.armOps = true, 0
+
+	var applied []pendingOp
+	switch mode {
+	case CrashKeepAll:
+		applied = sim.pending
+	case CrashDropRandom, CrashReorder, CrashTear:
+		for _, op := range sim.pending {
+			if sim.rnd.Intn(2) == 0 {
+				applied = append(applied, op)
+			}
+		}
+	}
+	if mode == CrashReorder || mode == CrashTear {
+		sim.rnd.Shuffle(len(applied), func(i, j int) {
+			applied[i], applied[j] = applied[j], applied[i]
+		})
+	}
+	if mode == CrashTear {
+		for i, op := range applied {
+			if sectors := len(op.data) / SectorBytes; op.data != nil && sectors > 0 {
+				applied[i].data = op.data[:sim.rnd.Intn(sectors+1)*SectorBytes]
+			}
+		}
+	}
+	log.Printf("CrashSim::Crash(): Crashing with %s, applying %d of %d operations since the last flush", mode, len(applied), len(sim.pending))
+	sim.pending, sim.overlay = nil, nil
+
+	err := sim.apply(applied)
+	if err == nil {
+		err = sim.dev.Flush()
+	}
+	if closeErr := sim.dev.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return len(applied), fmt.Errorf("Could not persist the state of the crash: %w", err)
+	}
+	return len(applied), nil
+}
+
+//apply makes held operations to the wrapped device in the order provided, the
+// caller must hold mu
+func (sim *CrashSim) apply(ops []pendingOp) error {
+	for _, op := range ops {
+		if op.data == nil {
+			if err := sim.dev.Trim(op.pos, op.count); err != nil {
+				return fmt.Errorf("Could not trim %d bytes at offset %d: %w", op.count, op.pos, err)
+			}
+		} else if _, err := sim.dev.WriteAt(op.data, op.pos); err != nil {
+			return fmt.Errorf("Could not write %d bytes at offset %d: %w", len(op.data), op.pos, err)
+		}
+	}
+	return nil
+}
+
+//checkOnline returns the error for operations on a closed or crashed device, the
+// caller must hold mu
+func (sim *CrashSim) checkOnline() error {
+	switch {
+	case sim.crashed:
+		return ErrCrashed
+	case sim.closed:
+		return errClosed
+	}
+	return nil
+}
+
+//admit checks a write, trim or flush may be made, crashing the device if an armed
+// crash is due; the caller must hold mu
+func (sim *CrashSim) admit() error {
+	if err := sim.checkOnline(); err != nil {
+		return err
+	}
+	if sim.armOps > 0 {
+		if sim.armOps--; sim.armOps == 0 {
+			if _, err := sim.crash(sim.armMode); err != nil {
+				log.Printf("CrashSim::admit(): WARNING: Armed crash failed; Details: %s", err)
+			}
+			return ErrCrashed
+		}
+	}
+	return nil
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (sim *CrashSim) ReadAt(buf []byte, pos int64) (int, error) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	if err := sim.checkOnline(); err != nil {
+		return 0, err
+	}
+	n, err := sim.dev.ReadAt(buf, pos)
+	if err != nil {
+		return n, err
+	}
+
+	//Overlay the contents of blocks written by held writes
+	end := pos + int64(len(buf))
+	for block := pos / overlayBytes; block*overlayBytes < end; block++ {
+		data, found := sim.overlay[block]
+		if !found {
+			continue
+		}
+		blockPos := block * overlayBytes
+		start, stop := maxInt64(blockPos, pos), minInt64(blockPos+int64(len(data)), end)
+		copy(buf[start-pos:stop-pos], data[start-blockPos:stop-blockPos])
+	}
+	return n, nil
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (sim *CrashSim) WriteAt(buf []byte, pos int64) (int, error) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	if err := sim.admit(); err != nil {
+		return 0, err
+	}
+	if pos < 0 || pos+int64(len(buf)) > sim.dev.Size() {
+		return 0, fmt.Errorf("Write of %d bytes at offset %d is out of bounds", len(buf), pos)
+	}
+	if err := sim.updateOverlay(buf, pos); err != nil {
+		return 0, err
+	}
+
+	if last := len(sim.pending) - 1; last >= 0 {
+		prev := &sim.pending[last]
+		if prev.data != nil && prev.pos+int64(len(prev.data)) == pos && len(prev.data)+len(buf) <= mergeBytes {
+			prev.data = append(prev.data, buf...)
+			return len(buf), nil
+		}
+	}
+	sim.pending = append(sim.pending, pendingOp{pos: pos, data: append([]byte(nil), buf...)})
+	return len(buf), nil
+}
+
+//updateOverlay copies a write into the contents of the blocks it touches, reading
+// those not yet written from the wrapped device; the caller must hold mu
+func (sim *CrashSim) updateOverlay(buf []byte, pos int64) error {
+	end := pos + int64(len(buf))
+	for block := pos / overlayBytes; block*overlayBytes < end; block++ {
+		blockPos := block * overlayBytes
+		data, found := sim.overlay[block]
+		if !found {
+			data = make([]byte, minInt64(overlayBytes, sim.dev.Size()-blockPos))
+			if _, err := sim.dev.ReadAt(data, blockPos); err != nil {
+				return fmt.Errorf("Could not read block at offset %d: %w", blockPos, err)
+			}
+			sim.overlay[block] = data
+		}
+		start, stop := maxInt64(blockPos, pos), minInt64(blockPos+int64(len(data)), end)
+		copy(data[start-blockPos:stop-blockPos], buf[start-pos:stop-pos])
+	}
+	return nil
+}
+
+//Trim fufills part of usbdlib.Device
+func (sim *CrashSim) Trim(pos int64, count int) error {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	if err := sim.admit(); err != nil {
+		return err
+	}
+	sim.pending = append(sim.pending, pendingOp{pos: pos, count: count})
+	return nil
+}
+
+//Flush fufills part of usbdlib.Device, applying all held writes and trims in the
+// order they were made before flushing the wrapped device
+func (sim *CrashSim) Flush() error {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	if err := sim.admit(); err != nil {
+		return err
+	}
+	if err := sim.apply(sim.pending); err != nil {
+		return err
+	}
+	sim.pending, sim.overlay = nil, make(map[int64][]byte)
+	return sim.dev.Flush()
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device; unlike a crash it
+// flushes all held writes and trims first
+func (sim *CrashSim) Close() error {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	if err := sim.checkOnline(); err != nil {
+		return err
+	}
+	sim.closed = true
+
+	err := sim.apply(sim.pending)
+	sim.pending, sim.overlay = nil, nil
+	if err == nil {
+		err = sim.dev.Flush()
+	}
+	if closeErr := sim.dev.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Could not flush and close device: %w", err)
+	}
+	return nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,136 @@
+package crashsim_test //testutil imports crashsim, this avoids a circular dependency
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/crashsim"
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+func TestCrashSim(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	testutil.TestUserspace(t, crashsim.NewCrashSim(ramdisk.NewRAMDisk(sizeBytes), 1), sizeBytes)
+	testutil.TestNBD(t, crashsim.NewCrashSim(ramdisk.NewRAMDisk(sizeBytes), 1), sizeBytes)
+}
+
+func TestCrashModes(t *testing.T) {
+	const (
+		sizeBytes  = 1024 * 1024
+		blockBytes = 4096
+		blocks     = 32
+	)
+
+	for _, mode := range crashsim.CrashModes {
+		t.Run(mode.String(), func(t *testing.T) {
+			diskPath := filepath.Join(t.TempDir(), "disk.bin")
+			disk := openDisk(t, diskPath, sizeBytes)
+			sim := crashsim.NewCrashSim(disk, int64(mode))
+
+			oldData, newData := bytes.Repeat([]byte{1}, blockBytes), bytes.Repeat([]byte{2}, blockBytes)
+			for i := int64(0); i < blocks; i++ {
+				sim.WriteAt(oldData, i*blockBytes)
+			}
+			if err := sim.Flush(); err != nil {
+				t.Fatalf("Could not flush: %s", err)
+			}
+			for i := int64(blocks - 1); i >= 0; i-- { //Backwards so the writes are not merged
+				sim.WriteAt(newData, i*blockBytes)
+			}
+
+			//Reads see writes not yet flushed
+			buf := make([]byte, blockBytes)
+			if _, err := sim.ReadAt(buf, blockBytes); err != nil || !bytes.Equal(buf, newData) {
+				t.Fatalf("Read of held write returned %v or the wrong data", err)
+			}
+			if pending := sim.Pending(); pending != blocks {
+				t.Fatalf("%d writes were held rather than %d", pending, blocks)
+			}
+
+			applied, err := sim.Crash(mode)
+			if err != nil {
+				t.Fatalf("Could not crash: %s", err)
+			}
+			if _, err = sim.ReadAt(buf, 0); !errors.Is(err, crashsim.ErrCrashed) {
+				t.Fatalf("Read after crash returned %v rather than %s", err, crashsim.ErrCrashed)
+			}
+			switch {
+			case mode == crashsim.CrashDropAll && applied != 0:
+				t.Fatalf("%s applied %d writes", mode, applied)
+			case mode == crashsim.CrashKeepAll && applied != blocks:
+				t.Fatalf("%s applied %d of %d writes", mode, applied, blocks)
+			case applied > blocks:
+				t.Fatalf("%s applied %d of %d writes", mode, applied, blocks)
+			}
+
+			//Every sector holds the old or new data, only tearing splits blocks
+			disk = openDisk(t, diskPath, sizeBytes)
+			defer disk.Close()
+			newSectors, torn := 0, false
+			for i := int64(0); i < blocks; i++ {
+				disk.ReadAt(buf, i*blockBytes)
+				blockNew := 0
+				for j := 0; j < blockBytes; j += crashsim.SectorBytes {
+					switch sector := buf[j : j+crashsim.SectorBytes]; {
+					case bytes.Equal(sector, newData[:crashsim.SectorBytes]):
+						blockNew++
+					case !bytes.Equal(sector, oldData[:crashsim.SectorBytes]):
+						t.Fatalf("Block %d holds neither old nor new data", i)
+					}
+				}
+				newSectors += blockNew
+				torn = torn || (blockNew > 0 && blockNew < blockBytes/crashsim.SectorBytes)
+			}
+			switch {
+			case torn && mode != crashsim.CrashTear:
+				t.Fatalf("%s tore writes", mode)
+			case mode == crashsim.CrashDropAll && newSectors != 0:
+				t.Fatalf("%s kept new data", mode)
+			case mode == crashsim.CrashKeepAll && newSectors != blocks*blockBytes/crashsim.SectorBytes:
+				t.Fatalf("%s lost new data", mode)
+			}
+		})
+	}
+}
+
+func TestArmCrash(t *testing.T) {
+	sim := crashsim.NewCrashSim(ramdisk.NewRAMDisk(1024*1024), 1)
+	if err := sim.ArmCrash(3, crashsim.CrashDropAll); err != nil {
+		t.Fatalf("Could not arm crash: %s", err)
+	}
+
+	buf := make([]byte, 4096)
+	for i := 0; i < 2; i++ {
+		if _, err := sim.WriteAt(buf, 0); err != nil {
+			t.Fatalf("Write %d before the crash failed: %s", i, err)
+		}
+	}
+	if err := sim.Flush(); !errors.Is(err, crashsim.ErrCrashed) || !sim.Crashed() {
+		t.Fatalf("Flush returned %v rather than crashing", err)
+	}
+	if err := sim.Close(); err == nil {
+		t.Fatalf("Crashed device closed without error")
+	}
+}
+
+func TestPowerLoss(t *testing.T) {
+	testutil.TestPowerLoss(t, testutil.CrashConfig{Rounds: 16}, func(disk usbdlib.Device, create bool) (usbdlib.Device, error) {
+		return disk, nil
+	})
+}
+
+func openDisk(t *testing.T, filename string, sizeBytes int64) *filedisk.FileDisk {
+	t.Helper()
+
+	disk, err := filedisk.NewFileDisk(filename, sizeBytes)
+	if err != nil {
+		t.Fatalf("Could not create file backed disk: %s", err)
+	}
+	return disk
+}
@@ -0,0 +1,494 @@
+package cryptdev
+
+import (
+	"crypto/aes"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+
+	"golang.org/x/crypto/xts"
+)
+
+const (
+	errClosed = consterr.ConstErr("Device is shutdown")
+
+	//ErrNotFormatted is returned when opening a device without a header
+	ErrNotFormatted = consterr.ConstErr("Device is not formatted as an encrypted device")
+	//ErrBadKey is returned when no key slot can be unlocked with the provided key
+	ErrBadKey = consterr.ConstErr("No key slot could be unlocked with the provided key")
+
+	//DefSectorBytes is the default size of independently encrypted sectors
+	DefSectorBytes = 512
+
+	chunkBytes  = 64 * 1024
+	lockStripes = 64
+)
+
+//CryptDev is a device encrypting an underlying device with AES-256-XTS, each
+// sector using its number as the tweak. The underlying device starts with a header
+// holding key slots, each of which seals the master key with a key derived from a
+// passphrase or key file, so the device exposes PayloadOffset fewer bytes.
+type CryptDev struct {
+	dev           usbdlib.Device
+	size          int64
+	sectorBytes   int64
+	allowDiscards bool
+	chunkLocks    [lockStripes]sync.RWMutex
+	ioMu          sync.RWMutex //Held exclusively to close
+	atomicOnline  uint64
+
+	rekeyMu sync.Mutex //Held while re-keying
+	hdrMu   sync.Mutex //Guards hdr and serializes header updates
+	hdr     *diskHeader
+
+	keyMu              sync.RWMutex
+	master, nextMaster []byte
+	cur, next          *xts.Cipher //next is used below rekeyedBytes while re-keying
+	rekeyedBytes       int64
+}
+
+var _ usbdlib.Device = (*CryptDev)(nil)
+
+//Format writes a new header to the underlying device, with a random master key
+// sealed in key slot 0 by the provided key. Any existing contents of the device
+// are rendered unreadable and, unless disabled with OptWipe, overwritten.
+func Format(dev usbdlib.Device, key Key, options ...Option) error {
+	cfg := newConfig(options)
+	switch {
+	case cfg.sectorBytes != 512 && cfg.sectorBytes != 4096:
+		return fmt.Errorf("Sector size %d is not 512 or 4096", cfg.sectorBytes)
+	case cfg.sectorBytes%dev.BlockSize() != 0 && dev.BlockSize()%cfg.sectorBytes != 0:
+		return fmt.Errorf("Sector size %d is incompatible with the device block size %d", cfg.sectorBytes, dev.BlockSize())
+	case dev.Size() < PayloadOffset+cfg.sectorBytes:
+		return fmt.Errorf("Device of %d bytes is too small to hold the %d byte header", dev.Size(), PayloadOffset)
+	}
+	if err := cfg.kdf.validate(); err != nil {
+		return err
+	}
+
+	hdr := &diskHeader{Version: headerVersion, SectorBytes: uint32(cfg.sectorBytes), PayloadOffset: PayloadOffset}
+	copy(hdr.Magic[:], headerMagic)
+	if err := randomBytes(hdr.UUID[:]); err != nil {
+		return err
+	}
+	master := make([]byte, masterKeyBytes)
+	if err := randomBytes(master); err != nil {
+		return err
+	}
+	slot, err := sealSlot(hdr.UUID[:], master, key, cfg.kdf)
+	if err != nil {
+		return fmt.Errorf("Could not create key slot: %w", err)
+	}
+	hdr.Slots[0] = slot
+
+	if cfg.wipe {
+		if err = wipe(dev, master, cfg.sectorBytes); err != nil {
+			return err
+		}
+	}
+
+	//Write both copies so any previous header is overwritten
+	if err = writeHeader(dev, hdr); err != nil {
+		return err
+	}
+	return writeHeader(dev, hdr)
+}
+
+//wipe encrypts zeros over the payload of a device being formatted
+func wipe(dev usbdlib.Device, master []byte, sectorBytes int64) error {
+	c, err := newCipher(master)
+	if err != nil {
+		return err
+	}
+
+	size := (dev.Size() - PayloadOffset) / sectorBytes * sectorBytes
+	buf := make([]byte, rekeyChunkBytes)
+	for pos := int64(0); pos < size; pos += int64(len(buf)) {
+		if remaining := size - pos; remaining < int64(len(buf)) {
+			buf = buf[:remaining]
+		}
+		for off := int64(0); off < int64(len(buf)); off += sectorBytes {
+			sector := buf[off : off+sectorBytes]
+			util.ZeroFill(sector)
+			c.Encrypt(sector, sector, uint64((pos+off)/sectorBytes))
+		}
+		if _, err = dev.WriteAt(buf, PayloadOffset+pos); err != nil {
+			return fmt.Errorf("Could not wipe device: %w", err)
+		}
+	}
+	if err = dev.Flush(); err != nil {
+		return fmt.Errorf("Could not flush wiped device: %w", err)
+	}
+	return nil
+}
+
+//Open unlocks an encrypted device with the provided key, trying every active key
+// slot. If the device was being re-keyed the interrupted chunk is recovered and
+// ResumeRekey should be called to complete it.
+func Open(dev usbdlib.Device, key Key, options ...Option) (*CryptDev, error) {
+	cfg := newConfig(options)
+	hdr, err := readHeader(dev)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := key.secret()
+	if err != nil {
+		return nil, err
+	}
+
+	master, err := unlock(hdr, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	cd := &CryptDev{
+		dev:           dev,
+		sectorBytes:   int64(hdr.SectorBytes),
+		allowDiscards: cfg.allowDiscards,
+		atomicOnline:  1,
+		hdr:           hdr,
+		master:        master,
+	}
+	cd.size = (dev.Size() - PayloadOffset) / cd.sectorBytes * cd.sectorBytes
+	if cd.size < cd.sectorBytes {
+		return nil, fmt.Errorf("Device of %d bytes is too small to hold the %d byte header", dev.Size(), PayloadOffset)
+	}
+	if cd.cur, err = newCipher(master); err != nil {
+		return nil, err
+	}
+
+	if hdr.RekeyActive != 0 {
+		newMaster, err := open(rekeyKEK(master), hdr.RekeyNonce[:], hdr.RekeySealed[:], hdr.UUID[:])
+		if err != nil {
+			return nil, fmt.Errorf("Could not unseal the new master key of the interrupted re-key: %w", err)
+		}
+		if cd.next, err = newCipher(newMaster); err != nil {
+			return nil, err
+		}
+		cd.nextMaster = newMaster
+		cd.rekeyedBytes = int64(hdr.RekeyOffset)
+		if err = cd.recoverJournal(); err != nil {
+			return nil, err
+		}
+	}
+	return cd, nil
+}
+
+//unlock returns the master key from the first key slot the secret unseals
+func unlock(hdr *diskHeader, secret []byte) ([]byte, error) {
+	for i := range hdr.Slots {
+		if hdr.Slots[i].Active == 0 {
+			continue
+		}
+		master, err := unsealSlot(hdr.UUID[:], &hdr.Slots[i], secret)
+		switch {
+		case err == nil:
+			return master, nil
+		case err != ErrBadKey:
+			return nil, fmt.Errorf("Could not unlock key slot %d: %w", i, err)
+		}
+	}
+	return nil, ErrBadKey
+}
+
+func newCipher(master []byte) (*xts.Cipher, error) {
+	c, err := xts.NewCipher(aes.NewCipher, master)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create XTS cipher: %w", err)
+	}
+	return c, nil
+}
+
+//Size of this device in bytes, that of the underlying device less the header
+func (cd *CryptDev) Size() int64 {
+	return cd.size
+}
+
+//BlockSize of this device is the larger of the sector size and that of the
+// underlying device
+func (cd *CryptDev) BlockSize() int64 {
+	if blockSize := cd.dev.BlockSize(); blockSize > cd.sectorBytes {
+		return blockSize
+	}
+	return cd.sectorBytes
+}
+
+//KeySlots returns the indexes of the active key slots
+func (cd *CryptDev) KeySlots() []int {
+	cd.hdrMu.Lock()
+	defer cd.hdrMu.Unlock()
+
+	var active []int
+	for i := range cd.hdr.Slots {
+		if cd.hdr.Slots[i].Active != 0 {
+			active = append(active, i)
+		}
+	}
+	return active
+}
+
+//AddKey seals the master key in a free key slot with the provided key, returning
+// the slot used
+func (cd *CryptDev) AddKey(key Key, options ...Option) (int, error) {
+	if atomic.LoadUint64(&cd.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	cfg := newConfig(options)
+
+	cd.hdrMu.Lock()
+	defer cd.hdrMu.Unlock()
+
+	idx := -1
+	for i := range cd.hdr.Slots {
+		if cd.hdr.Slots[i].Active == 0 {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return 0, fmt.Errorf("All %d key slots are in use", KeySlotCount)
+	}
+
+	slot, err := sealSlot(cd.hdr.UUID[:], cd.master, key, cfg.kdf)
+	if err != nil {
+		return 0, fmt.Errorf("Could not create key slot: %w", err)
+	}
+	hdr := *cd.hdr
+	hdr.Slots[idx] = slot
+	if err = cd.updateHeader(&hdr); err != nil {
+		return 0, err
+	}
+	return idx, nil
+}
+
+//RemoveKey wipes a key slot, the last active key slot cannot be removed
+func (cd *CryptDev) RemoveKey(idx int) error {
+	if atomic.LoadUint64(&cd.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	cd.hdrMu.Lock()
+	defer cd.hdrMu.Unlock()
+
+	if idx < 0 || idx >= KeySlotCount || cd.hdr.Slots[idx].Active == 0 {
+		return fmt.Errorf("Key slot %d is not active", idx)
+	}
+	active := 0
+	for i := range cd.hdr.Slots {
+		if cd.hdr.Slots[i].Active != 0 {
+			active++
+		}
+	}
+	if active < 2 {
+		return fmt.Errorf("Key slot %d is the last active key slot", idx)
+	}
+
+	hdr := *cd.hdr
+	hdr.Slots[idx] = diskSlot{}
+	return cd.updateHeader(&hdr)
+}
+
+//updateHeader writes a modified copy of the header and adopts it once written,
+// the caller must hold hdrMu
+func (cd *CryptDev) updateHeader(hdr *diskHeader) error {
+	if err := writeHeader(cd.dev, hdr); err != nil {
+		return err
+	}
+	cd.hdr = hdr
+	return nil
+}
+
+//ciphers returns the cipher for sectors below the re-keyed offset and the cipher
+// for those at or above it
+func (cd *CryptDev) ciphers() (below, above *xts.Cipher, rekeyedBytes int64) {
+	cd.keyMu.RLock()
+	defer cd.keyMu.RUnlock()
+	return cd.next, cd.cur, cd.rekeyedBytes
+}
+
+//crypt encrypts or decrypts whole sectors in place, pos is their offset
+func (cd *CryptDev) crypt(buf []byte, pos int64, encrypt bool) {
+	below, above, rekeyedBytes := cd.ciphers()
+	for off := int64(0); off < int64(len(buf)); off += cd.sectorBytes {
+		sector := buf[off : off+cd.sectorBytes]
+		c := above
+		if pos+off < rekeyedBytes {
+			c = below
+		}
+		num := uint64((pos + off) / cd.sectorBytes)
+		if encrypt {
+			c.Encrypt(sector, sector, num)
+		} else {
+			c.Decrypt(sector, sector, num)
+		}
+	}
+}
+
+//eachChunk invokes the provided function for each chunk spanned by a range with
+// the chunk number, the offset within the chunk and the portion of the buffer
+func (cd *CryptDev) eachChunk(buf []byte, pos int64, fn func(chunk, offset int64, part []byte) error) (count int, err error) {
+	for count < len(buf) {
+		chunk, offset := (pos+int64(count))/chunkBytes, (pos+int64(count))%chunkBytes
+		n := len(buf) - count
+		if remaining := chunkBytes - offset; int64(n) > remaining {
+			n = int(remaining)
+		}
+		if err = fn(chunk, offset, buf[count:count+n]); err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+//sectorSpan returns the sector aligned range containing a range within a chunk
+func (cd *CryptDev) sectorSpan(chunk, offset int64, length int) (start, end int64) {
+	start = chunk*chunkBytes + offset/cd.sectorBytes*cd.sectorBytes
+	end = chunk*chunkBytes + (offset+int64(length)+cd.sectorBytes-1)/cd.sectorBytes*cd.sectorBytes
+	return start, end
+}
+
+//readPayload reads ciphertext from the underlying device
+func (cd *CryptDev) readPayload(buf []byte, pos int64) error {
+	if n, err := cd.dev.ReadAt(buf, PayloadOffset+pos); err != nil && !(err == io.EOF && n == len(buf)) {
+		return fmt.Errorf("Could not read %d bytes at offset %d of underlying device: %w", len(buf), PayloadOffset+pos, err)
+	}
+	return nil
+}
+
+func (cd *CryptDev) writePayload(buf []byte, pos int64) error {
+	if _, err := cd.dev.WriteAt(buf, PayloadOffset+pos); err != nil {
+		return fmt.Errorf("Could not write %d bytes at offset %d of underlying device: %w", len(buf), PayloadOffset+pos, err)
+	}
+	return nil
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (cd *CryptDev) ReadAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&cd.atomicOnline) != 1:
+		return 0, errClosed
+	case pos >= cd.size:
+		return 0, io.EOF
+	}
+	var eof error
+	if end := pos + int64(len(buf)); end > cd.size {
+		buf, eof = buf[:cd.size-pos], io.EOF
+	}
+
+	cd.ioMu.RLock()
+	defer cd.ioMu.RUnlock()
+
+	count, err = cd.eachChunk(buf, pos, cd.readChunk)
+	if err != nil {
+		return count, err
+	}
+	return count, eof
+}
+
+func (cd *CryptDev) readChunk(chunk, offset int64, part []byte) error {
+	lock := &cd.chunkLocks[chunk%lockStripes]
+	lock.RLock()
+	defer lock.RUnlock()
+
+	start, end := cd.sectorSpan(chunk, offset, len(part))
+	sectors := make([]byte, end-start)
+	if err := cd.readPayload(sectors, start); err != nil {
+		return err
+	}
+	cd.crypt(sectors, start, false)
+	copy(part, sectors[chunk*chunkBytes+offset-start:])
+	return nil
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (cd *CryptDev) WriteAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&cd.atomicOnline) != 1:
+		return 0, errClosed
+	case pos+int64(len(buf)) > cd.size:
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	cd.ioMu.RLock()
+	defer cd.ioMu.RUnlock()
+
+	return cd.eachChunk(buf, pos, cd.writeChunk)
+}
+
+//writeChunk writes within a single chunk, sectors only partially written are
+// read and decrypted first
+func (cd *CryptDev) writeChunk(chunk, offset int64, part []byte) error {
+	lock := &cd.chunkLocks[chunk%lockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	start, end := cd.sectorSpan(chunk, offset, len(part))
+	sectors := make([]byte, end-start)
+	head := chunk*chunkBytes + offset - start
+	if head != 0 || int64(len(part))%cd.sectorBytes != 0 {
+		//Only the first and last sectors can be partial
+		if err := cd.readPayload(sectors[:cd.sectorBytes], start); err != nil {
+			return err
+		}
+		if len(sectors) > int(cd.sectorBytes) {
+			if err := cd.readPayload(sectors[len(sectors)-int(cd.sectorBytes):], end-cd.sectorBytes); err != nil {
+				return err
+			}
+		}
+		cd.crypt(sectors[:cd.sectorBytes], start, false)
+		if len(sectors) > int(cd.sectorBytes) {
+			cd.crypt(sectors[len(sectors)-int(cd.sectorBytes):], end-cd.sectorBytes, false)
+		}
+	}
+	copy(sectors[head:], part)
+	cd.crypt(sectors, start, true)
+	return cd.writePayload(sectors, start)
+}
+
+//Trim is passed through to the underlying device for whole sectors if discards
+// were allowed when opening the device, and otherwise ignored
+func (cd *CryptDev) Trim(pos int64, count int) error {
+	if atomic.LoadUint64(&cd.atomicOnline) != 1 {
+		return errClosed
+	}
+	if !cd.allowDiscards {
+		return nil
+	}
+
+	start := (pos + cd.sectorBytes - 1) / cd.sectorBytes * cd.sectorBytes
+	end := (pos + int64(count)) / cd.sectorBytes * cd.sectorBytes
+	if end <= start {
+		return nil
+	}
+	return cd.dev.Trim(PayloadOffset+start, int(end-start))
+}
+
+//Flush flushes the underlying device
+func (cd *CryptDev) Flush() error {
+	if atomic.LoadUint64(&cd.atomicOnline) != 1 {
+		return errClosed
+	}
+	return cd.dev.Flush()
+}
+
+//Close closes the underlying device, an in progress re-key is interrupted and may
+// be resumed after reopening
+func (cd *CryptDev) Close() error {
+	if !atomic.CompareAndSwapUint64(&cd.atomicOnline, 1, 0) {
+		return errClosed
+	}
+
+	cd.ioMu.Lock() //Wait for outstanding IO
+	defer cd.ioMu.Unlock()
+
+	cd.hdrMu.Lock() //Wait for any re-key chunk
+	defer cd.hdrMu.Unlock()
+
+	return cd.dev.Close()
+}
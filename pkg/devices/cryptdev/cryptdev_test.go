@@ -0,0 +1,197 @@
+package cryptdev
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+//testKDF is cheap so tests are fast, real deployments should use DefKDF
+var testKDF = OptKDF(ScryptKDF(10, 8, 1))
+
+func TestCryptDev(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	testutil.TestUserspace(t, createCryptDev(t, sizeBytes), sizeBytes)
+	testutil.TestNBD(t, createCryptDev(t, sizeBytes), sizeBytes)
+}
+
+func createCryptDev(t *testing.T, sizeBytes int64) usbdlib.Device {
+	t.Helper()
+
+	disk := ramdisk.NewRAMDisk(PayloadOffset + sizeBytes)
+	if err := Format(disk, Passphrase("test"), testKDF); err != nil {
+		t.Fatalf("Could not format device: %s", err)
+	}
+	return openDev(t, disk, Passphrase("test"))
+}
+
+func openDev(t *testing.T, dev usbdlib.Device, key Key) *CryptDev {
+	t.Helper()
+
+	cd, err := Open(dev, key)
+	if err != nil {
+		t.Fatalf("Could not open encrypted device: %s", err)
+	}
+	return cd
+}
+
+func expectBadKey(t *testing.T, dev usbdlib.Device, key Key) {
+	t.Helper()
+
+	if _, err := Open(dev, key); !errors.Is(err, ErrBadKey) {
+		t.Fatalf("Opening with a revoked or incorrect key did not fail with ErrBadKey: %v", err)
+	}
+}
+
+func TestKeySlots(t *testing.T) {
+	const sizeBytes = 1024 * 1024
+
+	disk := testutil.NewUnclosable(ramdisk.NewRAMDisk(PayloadOffset + sizeBytes))
+	if _, err := Open(disk, Passphrase("first")); err != ErrNotFormatted {
+		t.Fatalf("Opening an unformatted device did not fail with ErrNotFormatted: %v", err)
+	}
+	if err := Format(disk, Passphrase("first"), testKDF, OptSectorBytes(4096)); err != nil {
+		t.Fatalf("Could not format device: %s", err)
+	}
+	expectBadKey(t, disk, Passphrase("second"))
+
+	cd := openDev(t, disk, Passphrase("first"))
+	if size := cd.Size(); size != sizeBytes {
+		t.Fatalf("Encrypted device was %d bytes rather than %d", size, sizeBytes)
+	}
+	testutil.ExpectContents(t, "wiped device", cd, 0, make([]byte, sizeBytes))
+	plain := bytes.Repeat([]byte("plaintext"), 1000)
+	if _, err := cd.WriteAt(plain, 100); err != nil {
+		t.Fatalf("Could not write: %s", err)
+	}
+	testutil.ExpectContents(t, "unaligned write", cd, 0, append(make([]byte, 100), plain...))
+	raw := make([]byte, disk.Size())
+	if _, err := disk.ReadAt(raw, 0); err != nil {
+		t.Fatalf("Could not read underlying device: %s", err)
+	} else if bytes.Contains(raw, []byte("plaintext")) {
+		t.Fatalf("Underlying device contained plaintext")
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte{0, 1, 2, 3, 4, 5, 6, 7}, 0600); err != nil {
+		t.Fatalf("Could not write key file: %s", err)
+	}
+	if slot, err := cd.AddKey(KeyFile(keyFile), OptKDF(Argon2idKDF(1, 64, 1))); err != nil {
+		t.Fatalf("Could not add key: %s", err)
+	} else if slot != 1 {
+		t.Fatalf("Key was added to slot %d rather than 1", slot)
+	}
+	if err := cd.RemoveKey(0); err != nil {
+		t.Fatalf("Could not remove key slot: %s", err)
+	}
+	if err := cd.RemoveKey(1); err == nil {
+		t.Fatalf("The last key slot was removed")
+	}
+	if slots := cd.KeySlots(); len(slots) != 1 || slots[0] != 1 {
+		t.Fatalf("Active key slots were %v rather than [1]", slots)
+	}
+	testutil.TestClose(t, cd)
+
+	expectBadKey(t, disk, Passphrase("first"))
+	cd = openDev(t, disk, KeyFile(keyFile))
+	testutil.ExpectContents(t, "data after changing keys", cd, 100, plain)
+	testutil.TestClose(t, cd)
+
+	//KDFs costing more than the limits are refused rather than derived
+	for _, kdf := range []KDF{ScryptKDF(30, 8, 1), ScryptKDF(20, 1<<20, 1), ScryptKDF(10, 8, 1<<20), Argon2idKDF(3, 4*1024*1024, 4)} {
+		if err := Format(ramdisk.NewRAMDisk(PayloadOffset+sizeBytes), Passphrase("first"), OptKDF(kdf)); err == nil {
+			t.Fatalf("Device was formatted with too costly KDF %s", kdf)
+		}
+	}
+	hdr, err := readHeader(disk)
+	if err != nil {
+		t.Fatalf("Could not read header: %s", err)
+	}
+	hdr.Slots[1].KDFParams = [3]uint32{30, 1 << 20, 1 << 20}
+	for i := 0; i < 2; i++ { //Both copies
+		if err = writeHeader(disk, hdr); err != nil {
+			t.Fatalf("Could not write header: %s", err)
+		}
+	}
+	if _, err = Open(disk, KeyFile(keyFile)); err == nil || errors.Is(err, ErrBadKey) {
+		t.Fatalf("Opening with a header with a too costly KDF did not fail as corrupt: %v", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	const sizeBytes = 4 * rekeyChunkBytes
+
+	disk := testutil.NewUnclosable(ramdisk.NewRAMDisk(PayloadOffset + sizeBytes))
+	if err := Format(disk, Passphrase("first"), testKDF); err != nil {
+		t.Fatalf("Could not format device: %s", err)
+	}
+	cd := openDev(t, disk, Passphrase("first"))
+	if _, err := cd.AddKey(Passphrase("second"), testKDF); err != nil {
+		t.Fatalf("Could not add key: %s", err)
+	}
+	data := testutil.WriteRandom(t, cd, 0, sizeBytes, 1)
+
+	//Crash while writing the second re-encrypted chunk: after the header starting the
+	// re-key, the four writes of the first chunk and the journal of the second
+	disk.FailWritesAfter(1 + 4 + 2)
+	if err := cd.Rekey(Passphrase("third"), testKDF); err == nil {
+		t.Fatalf("Re-key did not fail after the simulated crash")
+	}
+	disk.FailWritesAfter(math.MaxInt64)
+
+	//The device can be opened with the old keys and its contents are intact
+	cd = openDev(t, disk, Passphrase("second"))
+	if !cd.Rekeying() {
+		t.Fatalf("Interrupted re-key was not detected")
+	}
+	testutil.ExpectContents(t, "partially re-keyed device", cd, 0, data)
+	copy(data[rekeyChunkBytes/2:], testutil.WriteRandom(t, cd, rekeyChunkBytes/2, rekeyChunkBytes*2, 2))
+	if err := cd.ResumeRekey(); err != nil {
+		t.Fatalf("Could not resume re-key: %s", err)
+	}
+	if cd.Rekeying() {
+		t.Fatalf("Re-key was still in progress after being resumed")
+	}
+	testutil.ExpectContents(t, "re-keyed device", cd, 0, data)
+	testutil.TestClose(t, cd)
+
+	expectBadKey(t, disk, Passphrase("first"))
+	expectBadKey(t, disk, Passphrase("second"))
+	cd = openDev(t, disk, Passphrase("third"))
+	testutil.ExpectContents(t, "reopened re-keyed device", cd, 0, data)
+
+	//Re-key again while writing concurrently
+	errCh := make(chan error, 1)
+	go func() { errCh <- cd.Rekey(Passphrase("fourth"), testKDF) }()
+	for i := int64(0); i < 16; i++ {
+		pos := (i * 7919 * 512) % (sizeBytes - 4096)
+		copy(data[pos:], testutil.WriteRandom(t, cd, pos, 4096, i))
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Could not re-key: %s", err)
+	}
+	testutil.TestClose(t, cd)
+
+	cd = openDev(t, disk, Passphrase("fourth"))
+	testutil.ExpectContents(t, "device re-keyed during writes", cd, 0, data)
+	testutil.TestClose(t, cd)
+}
+
+func TestPowerLoss(t *testing.T) {
+	testutil.TestPowerLoss(t, testutil.CrashConfig{}, func(disk usbdlib.Device, create bool) (usbdlib.Device, error) {
+		if create {
+			if err := Format(disk, Passphrase("test"), testKDF); err != nil {
+				return nil, err
+			}
+		}
+		return Open(disk, Passphrase("test"))
+	})
+}
@@ -0,0 +1,209 @@
+package cryptdev
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const (
+	headerMagic   = "USBDCRPT"
+	headerVersion = 1
+
+	//KeySlotCount is the number of key slots in a header
+	KeySlotCount = 8
+	//PayloadOffset is the number of bytes reserved at the start of the underlying
+	// device for the header copies and the re-encryption journal
+	PayloadOffset = 1024 * 1024
+
+	headerCopyBytes = 4096 //Two copies are stored, updates alternate between them
+	journalOffset   = 64 * 1024
+	rekeyChunkBytes = 256 * 1024
+
+	masterKeyBytes = 64 //AES-256-XTS
+	nonceBytes     = 12
+	sealedBytes    = masterKeyBytes + 16
+)
+
+//diskSlot is a key slot, the master key sealed with a key derived from a Key
+type diskSlot struct {
+	Active    uint8
+	KDFAlgo   uint8
+	KDFParams [3]uint32
+	Salt      [saltBytes]byte
+	Nonce     [nonceBytes]byte
+	Sealed    [sealedBytes]byte
+}
+
+//diskHeader is the header of an encrypted device. While re-keying, the new master
+// key is stored sealed with the old one and a slot sealing it with the Key provided
+// to Rekey is pending; the journal holds the ciphertext of the chunk being
+// re-encrypted.
+type diskHeader struct {
+	Magic         [len(headerMagic)]byte
+	Version       uint16
+	SectorBytes   uint32
+	PayloadOffset uint64
+	Seq           uint64
+	UUID          [16]byte
+	Slots         [KeySlotCount]diskSlot
+	RekeyActive   uint8
+	RekeyOffset   uint64
+	RekeyNonce    [nonceBytes]byte
+	RekeySealed   [sealedBytes]byte
+	RekeyPending  diskSlot
+	JournalActive uint8
+	JournalPos    uint64
+	JournalLen    uint32
+	JournalCRC    uint32
+}
+
+func (hdr *diskHeader) marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(headerCopyBytes)
+	if err := binary.Write(&buf, binary.LittleEndian, hdr); err != nil {
+		return nil, fmt.Errorf("Could not encode header: %w", err)
+	}
+	raw := make([]byte, headerCopyBytes)
+	copy(raw, buf.Bytes())
+	binary.LittleEndian.PutUint32(raw[headerCopyBytes-4:], crc32.ChecksumIEEE(raw[:headerCopyBytes-4]))
+	return raw, nil
+}
+
+func (hdr *diskHeader) unmarshal(raw []byte) error {
+	switch {
+	case len(raw) != headerCopyBytes || string(raw[:len(headerMagic)]) != headerMagic:
+		return ErrNotFormatted
+	case crc32.ChecksumIEEE(raw[:headerCopyBytes-4]) != binary.LittleEndian.Uint32(raw[headerCopyBytes-4:]):
+		return fmt.Errorf("Header is corrupt (checksum mismatch)")
+	}
+	if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, hdr); err != nil {
+		return fmt.Errorf("Could not decode header: %w", err)
+	}
+	switch {
+	case hdr.Version != headerVersion:
+		return fmt.Errorf("Header version %d is not supported", hdr.Version)
+	case hdr.SectorBytes != 512 && hdr.SectorBytes != 4096:
+		return fmt.Errorf("Header has an unsupported sector size of %d", hdr.SectorBytes)
+	case hdr.PayloadOffset != PayloadOffset:
+		return fmt.Errorf("Header has an unsupported payload offset of %d", hdr.PayloadOffset)
+	}
+	for i := range hdr.Slots {
+		if err := hdr.Slots[i].validate(); err != nil {
+			return fmt.Errorf("Header is corrupt (key slot %d): %w", i, err)
+		}
+	}
+	if hdr.RekeyActive != 0 {
+		if err := hdr.RekeyPending.validate(); err != nil {
+			return fmt.Errorf("Header is corrupt (pending key slot): %w", err)
+		}
+	}
+	return nil
+}
+
+//validate checks the KDF of an active key slot
+func (slot *diskSlot) validate() error {
+	if slot.Active == 0 {
+		return nil
+	}
+	return KDF{algo: KDFAlgo(slot.KDFAlgo), params: slot.KDFParams}.validate()
+}
+
+//readHeader reads both header copies from the underlying device and returns the
+// most recent valid one
+func readHeader(dev usbdlib.Device) (*diskHeader, error) {
+	var latest *diskHeader
+	var firstErr error
+	for i := int64(0); i < 2; i++ {
+		raw := make([]byte, headerCopyBytes)
+		if n, err := dev.ReadAt(raw, i*headerCopyBytes); err != nil && !(err == io.EOF && n == len(raw)) {
+			return nil, fmt.Errorf("Could not read header copy %d: %w", i, err)
+		}
+		hdr := new(diskHeader)
+		if err := hdr.unmarshal(raw); err != nil {
+			if firstErr == nil || firstErr == ErrNotFormatted {
+				firstErr = err
+			}
+			continue
+		}
+		if latest == nil || hdr.Seq > latest.Seq {
+			latest = hdr
+		}
+	}
+	if latest == nil {
+		return nil, firstErr
+	}
+	return latest, nil
+}
+
+//writeHeader increments the sequence number of a header and writes it over the
+// older copy, so the other remains valid should the write be interrupted
+func writeHeader(dev usbdlib.Device, hdr *diskHeader) error {
+	hdr.Seq++
+	raw, err := hdr.marshal()
+	if err != nil {
+		return err
+	}
+	pos := int64(hdr.Seq%2) * headerCopyBytes
+	if _, err = dev.WriteAt(raw, pos); err != nil {
+		return fmt.Errorf("Could not write header: %w", err)
+	}
+	if err = dev.Flush(); err != nil {
+		return fmt.Errorf("Could not flush header: %w", err)
+	}
+	return nil
+}
+
+//sealSlot creates a key slot sealing the master key with a key derived from the
+// provided Key
+func sealSlot(uuid []byte, master []byte, key Key, kdf KDF) (diskSlot, error) {
+	slot := diskSlot{Active: 1, KDFAlgo: uint8(kdf.algo), KDFParams: kdf.params}
+	secret, err := key.secret()
+	if err != nil {
+		return slot, err
+	}
+	if err = randomBytes(slot.Salt[:]); err != nil {
+		return slot, err
+	}
+	if err = randomBytes(slot.Nonce[:]); err != nil {
+		return slot, err
+	}
+	kek, err := kdf.derive(secret, slot.Salt[:])
+	if err != nil {
+		return slot, fmt.Errorf("Could not derive key slot key: %w", err)
+	}
+	sealed, err := seal(kek, slot.Nonce[:], master, uuid)
+	if err != nil {
+		return slot, fmt.Errorf("Could not seal master key: %w", err)
+	}
+	copy(slot.Sealed[:], sealed)
+	return slot, nil
+}
+
+//unsealSlot returns the master key sealed in a key slot, or ErrBadKey if it
+// cannot be unsealed with the provided secret
+func unsealSlot(uuid []byte, slot *diskSlot, secret []byte) ([]byte, error) {
+	kdf := KDF{algo: KDFAlgo(slot.KDFAlgo), params: slot.KDFParams}
+	kek, err := kdf.derive(secret, slot.Salt[:])
+	if err != nil {
+		return nil, fmt.Errorf("Could not derive key slot key: %w", err)
+	}
+	master, err := open(kek, slot.Nonce[:], slot.Sealed[:], uuid)
+	if err != nil {
+		return nil, ErrBadKey
+	}
+	return master, nil
+}
+
+//rekeyKEK derives the key sealing the new master key with the old one
+func rekeyKEK(master []byte) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte("usbd cryptdev rekey"))
+	return mac.Sum(nil)
+}
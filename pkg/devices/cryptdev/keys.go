@@ -0,0 +1,183 @@
+package cryptdev
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	maxKeyFileBytes = 8 * 1024 * 1024
+	kekBytes        = 32
+	saltBytes       = 32
+)
+
+//Key unlocks a key slot
+type Key interface {
+	secret() ([]byte, error)
+}
+
+//Passphrase is a Key derived from a passphrase
+type Passphrase string
+
+func (pass Passphrase) secret() ([]byte, error) {
+	if len(pass) < 1 {
+		return nil, fmt.Errorf("Passphrase is empty")
+	}
+	return []byte(pass), nil
+}
+
+//KeyFile is a Key derived from the contents of a file
+type KeyFile string
+
+func (filename KeyFile) secret() ([]byte, error) {
+	fin, err := os.Open(string(filename))
+	if err != nil {
+		return nil, fmt.Errorf("Could not open key file: %w", err)
+	}
+	defer fin.Close()
+
+	secret, err := io.ReadAll(io.LimitReader(fin, maxKeyFileBytes+1))
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("Could not read key file %q: %w", filename, err)
+	case len(secret) < 1:
+		return nil, fmt.Errorf("Key file %q is empty", filename)
+	case len(secret) > maxKeyFileBytes:
+		return nil, fmt.Errorf("Key file %q is larger than %d bytes", filename, maxKeyFileBytes)
+	}
+	return secret, nil
+}
+
+//KDFAlgo identifies a key derivation function
+type KDFAlgo uint8
+
+//Enumerate available key derivation functions
+const (
+	KDFScrypt KDFAlgo = iota + 1
+	KDFArgon2id
+)
+
+func (algo KDFAlgo) String() string {
+	switch algo {
+	case KDFScrypt:
+		return "scrypt"
+	case KDFArgon2id:
+		return "argon2id"
+	}
+	return "unknown"
+}
+
+//KDF is a key derivation function and its cost parameters, used to derive the key
+// encrypting the master key in a key slot from a Key. KDFs requiring more than 1
+// GiB of memory are refused.
+type KDF struct {
+	algo   KDFAlgo
+	params [3]uint32
+}
+
+//DefKDF is the default key derivation function: argon2id with 3 passes over 64 MiB
+// using 4 threads
+var DefKDF = Argon2idKDF(3, 64*1024, 4)
+
+//ScryptKDF constructs a scrypt KDF with a cost of 2^logN
+func ScryptKDF(logN, r, p uint32) KDF {
+	return KDF{algo: KDFScrypt, params: [3]uint32{logN, r, p}}
+}
+
+//Argon2idKDF constructs an argon2id KDF
+func Argon2idKDF(passes, memoryKiB uint32, threads uint8) KDF {
+	return KDF{algo: KDFArgon2id, params: [3]uint32{passes, memoryKiB, uint32(threads)}}
+}
+
+//Algo returns the algorithm of the KDF
+func (kdf KDF) Algo() KDFAlgo {
+	return kdf.algo
+}
+
+func (kdf KDF) String() string {
+	switch kdf.algo {
+	case KDFScrypt:
+		return fmt.Sprintf("scrypt(N=2^%d, r=%d, p=%d)", kdf.params[0], kdf.params[1], kdf.params[2])
+	case KDFArgon2id:
+		return fmt.Sprintf("argon2id(t=%d, m=%dKiB, p=%d)", kdf.params[0], kdf.params[1], kdf.params[2])
+	}
+	return "unknown"
+}
+
+//Limits on KDF costs, well above what is practical to unlock a device with, so a
+// corrupt header can not exhaust memory or time before a key is checked
+const (
+	maxScryptLogN     = 22
+	maxScryptP        = 16
+	maxKDFMemoryBytes = 1 << 30
+	maxArgon2Passes   = 64
+)
+
+func (kdf KDF) validate() error {
+	switch p := kdf.params; kdf.algo {
+	case KDFScrypt:
+		if p[0] < 1 || p[0] > maxScryptLogN || p[1] < 1 || p[2] < 1 || p[2] > maxScryptP || 128*uint64(p[1])<<p[0] > maxKDFMemoryBytes {
+			return fmt.Errorf("Invalid KDF parameters: %s", kdf)
+		}
+	case KDFArgon2id:
+		if p[0] < 1 || p[0] > maxArgon2Passes || p[1] < 8*p[2] || uint64(p[1])*1024 > maxKDFMemoryBytes || p[2] < 1 || p[2] > 255 {
+			return fmt.Errorf("Invalid KDF parameters: %s", kdf)
+		}
+	default:
+		return fmt.Errorf("Unknown KDF algorithm %d", kdf.algo)
+	}
+	return nil
+}
+
+//derive a key encryption key from a secret
+func (kdf KDF) derive(secret, salt []byte) ([]byte, error) {
+	if err := kdf.validate(); err != nil {
+		return nil, err
+	}
+	switch p := kdf.params; kdf.algo {
+	case KDFScrypt:
+		return scrypt.Key(secret, salt, 1<<p[0], int(p[1]), int(p[2]), kekBytes)
+	default:
+		return argon2.IDKey(secret, salt, p[0], p[1], uint8(p[2]), kekBytes), nil
+	}
+}
+
+//seal encrypts and authenticates a key with a 256-bit key encryption key
+func seal(kek, nonce, key, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, key, aad), nil
+}
+
+//open decrypts a key sealed with seal, failing if the key encryption key is wrong
+func open(kek, nonce, sealed, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, sealed, aad)
+}
+
+func newAEAD(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create key encryption cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(buf []byte) error {
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return fmt.Errorf("Could not generate random bytes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package cryptdev
+
+//Option is an option for formatting, opening or adding keys to an encrypted device
+type Option interface {
+	apply(*config)
+}
+
+type config struct {
+	kdf           KDF
+	sectorBytes   int64
+	allowDiscards bool
+	wipe          bool
+}
+
+func newConfig(options []Option) config {
+	cfg := config{kdf: DefKDF, sectorBytes: DefSectorBytes, wipe: true}
+	for _, opt := range options {
+		opt.apply(&cfg)
+	}
+	return cfg
+}
+
+//OptKDF instructs key slots to be created using the provided key derivation
+// function rather than DefKDF
+type OptKDF KDF
+
+func (kdf OptKDF) apply(cfg *config) {
+	cfg.kdf = KDF(kdf)
+}
+
+//OptSectorBytes instructs Format to encrypt in sectors of this size (512 or
+// 4096 bytes) rather than DefSectorBytes
+type OptSectorBytes int64
+
+func (size OptSectorBytes) apply(cfg *config) {
+	cfg.sectorBytes = int64(size)
+}
+
+//OptAllowDiscards instructs Open to pass trims through to the underlying device,
+// which reveals which sectors are unused
+type OptAllowDiscards bool
+
+func (allow OptAllowDiscards) apply(cfg *config) {
+	cfg.allowDiscards = bool(allow)
+}
+
+//OptWipe instructs Format whether to encrypt zeros over the whole device (the
+// default) so that it initially reads as zeros, rather than as random data. Not
+// wiping is faster but reveals which sectors have been written.
+type OptWipe bool
+
+func (wipe OptWipe) apply(cfg *config) {
+	cfg.wipe = bool(wipe)
+}
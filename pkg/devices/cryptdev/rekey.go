@@ -0,0 +1,226 @@
+package cryptdev
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"sync/atomic"
+)
+
+//Rekeying returns if a re-key is in progress
+func (cd *CryptDev) Rekeying() bool {
+	cd.hdrMu.Lock()
+	defer cd.hdrMu.Unlock()
+	return cd.hdr.RekeyActive != 0
+}
+
+//Rekey re-encrypts the device with a new master key while it remains in use. Once
+// complete the new master key is sealed only in key slot 0 with the provided key,
+// all other key slots are removed. Each chunk re-encrypted is journaled first so
+// an interrupted re-key can be resumed, with ResumeRekey, after reopening the
+// device with a key from any of the old key slots.
+func (cd *CryptDev) Rekey(key Key, options ...Option) error {
+	if atomic.LoadUint64(&cd.atomicOnline) != 1 {
+		return errClosed
+	}
+	cfg := newConfig(options)
+
+	cd.rekeyMu.Lock()
+	defer cd.rekeyMu.Unlock()
+
+	if err := cd.startRekey(key, cfg.kdf); err != nil {
+		return err
+	}
+	return cd.resumeRekey()
+}
+
+func (cd *CryptDev) startRekey(key Key, kdf KDF) error {
+	cd.hdrMu.Lock()
+	defer cd.hdrMu.Unlock()
+
+	if cd.hdr.RekeyActive != 0 {
+		return fmt.Errorf("A re-key is already in progress, it must be resumed")
+	}
+	newMaster := make([]byte, masterKeyBytes)
+	if err := randomBytes(newMaster); err != nil {
+		return err
+	}
+	next, err := newCipher(newMaster)
+	if err != nil {
+		return err
+	}
+
+	hdr := *cd.hdr
+	if hdr.RekeyPending, err = sealSlot(hdr.UUID[:], newMaster, key, kdf); err != nil {
+		return fmt.Errorf("Could not create key slot for new master key: %w", err)
+	}
+	if err = randomBytes(hdr.RekeyNonce[:]); err != nil {
+		return err
+	}
+	sealed, err := seal(rekeyKEK(cd.master), hdr.RekeyNonce[:], newMaster, hdr.UUID[:])
+	if err != nil {
+		return fmt.Errorf("Could not seal new master key: %w", err)
+	}
+	copy(hdr.RekeySealed[:], sealed)
+	hdr.RekeyActive, hdr.RekeyOffset = 1, 0
+	if err = cd.updateHeader(&hdr); err != nil {
+		return err
+	}
+
+	cd.keyMu.Lock()
+	cd.next, cd.nextMaster, cd.rekeyedBytes = next, newMaster, 0
+	cd.keyMu.Unlock()
+	return nil
+}
+
+//ResumeRekey completes a re-key that was interrupted, if any
+func (cd *CryptDev) ResumeRekey() error {
+	if atomic.LoadUint64(&cd.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	cd.rekeyMu.Lock()
+	defer cd.rekeyMu.Unlock()
+
+	if !cd.Rekeying() {
+		return nil
+	}
+	return cd.resumeRekey()
+}
+
+//resumeRekey re-encrypts the remaining chunks and then adopts the new master key,
+// the caller must hold rekeyMu
+func (cd *CryptDev) resumeRekey() error {
+	for {
+		_, _, pos := cd.ciphers()
+		if pos >= cd.size {
+			break
+		}
+		n := cd.size - pos
+		if n > rekeyChunkBytes {
+			n = rekeyChunkBytes
+		}
+		if err := cd.rekeyChunk(pos, n); err != nil {
+			return fmt.Errorf("Could not re-encrypt %d bytes at offset %d: %w", n, pos, err)
+		}
+	}
+	return cd.completeRekey()
+}
+
+//rekeyChunk journals and then re-encrypts a chunk, preventing IO to it meanwhile
+func (cd *CryptDev) rekeyChunk(pos, n int64) error {
+	cd.ioMu.RLock()
+	defer cd.ioMu.RUnlock()
+	if atomic.LoadUint64(&cd.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	cd.hdrMu.Lock()
+	defer cd.hdrMu.Unlock()
+
+	for chunk := pos / chunkBytes; chunk*chunkBytes < pos+n; chunk++ {
+		lock := &cd.chunkLocks[chunk%lockStripes]
+		lock.Lock()
+		defer lock.Unlock()
+	}
+
+	old := make([]byte, n)
+	if err := cd.readPayload(old, pos); err != nil {
+		return err
+	}
+	if _, err := cd.dev.WriteAt(old, journalOffset); err != nil {
+		return fmt.Errorf("Could not write journal: %w", err)
+	}
+	if err := cd.dev.Flush(); err != nil {
+		return fmt.Errorf("Could not flush journal: %w", err)
+	}
+	hdr := *cd.hdr
+	hdr.JournalActive, hdr.JournalPos, hdr.JournalLen, hdr.JournalCRC = 1, uint64(pos), uint32(n), crc32.ChecksumIEEE(old)
+	if err := cd.updateHeader(&hdr); err != nil {
+		return err
+	}
+
+	cd.keyMu.RLock()
+	cur, next := cd.cur, cd.next
+	cd.keyMu.RUnlock()
+	buf := make([]byte, n)
+	for off := int64(0); off < n; off += cd.sectorBytes {
+		num := uint64((pos + off) / cd.sectorBytes)
+		cur.Decrypt(buf[off:off+cd.sectorBytes], old[off:off+cd.sectorBytes], num)
+		next.Encrypt(buf[off:off+cd.sectorBytes], buf[off:off+cd.sectorBytes], num)
+	}
+
+	err := cd.writePayload(buf, pos)
+	if err == nil {
+		if err = cd.dev.Flush(); err != nil {
+			err = fmt.Errorf("Could not flush underlying device: %w", err)
+		}
+	}
+	if err == nil {
+		hdr = *cd.hdr
+		hdr.JournalActive, hdr.RekeyOffset = 0, uint64(pos+n)
+		err = cd.updateHeader(&hdr)
+	}
+	if err != nil { //Restore the chunk so it matches the re-keyed offset in memory
+		if restoreErr := cd.writePayload(old, pos); restoreErr != nil {
+			log.Printf("CryptDev::rekeyChunk(): WARNING: Could not restore chunk at offset %d after failing to re-encrypt it, reopen the device to recover it from the journal; Details: %s", pos, restoreErr)
+		}
+		return err
+	}
+
+	cd.keyMu.Lock()
+	cd.rekeyedBytes = pos + n
+	cd.keyMu.Unlock()
+	return nil
+}
+
+//completeRekey replaces the key slots with the one sealing the new master key
+func (cd *CryptDev) completeRekey() error {
+	cd.hdrMu.Lock()
+	defer cd.hdrMu.Unlock()
+
+	hdr := *cd.hdr
+	hdr.Slots = [KeySlotCount]diskSlot{hdr.RekeyPending}
+	hdr.RekeyActive, hdr.RekeyOffset, hdr.RekeyPending = 0, 0, diskSlot{}
+	hdr.RekeyNonce, hdr.RekeySealed = [nonceBytes]byte{}, [sealedBytes]byte{}
+	if err := cd.updateHeader(&hdr); err != nil {
+		return err
+	}
+
+	cd.keyMu.Lock()
+	defer cd.keyMu.Unlock()
+	cd.cur, cd.master = cd.next, cd.nextMaster
+	cd.next, cd.nextMaster, cd.rekeyedBytes = nil, nil, 0
+	return nil
+}
+
+//recoverJournal restores the chunk being re-encrypted when a re-key was
+// interrupted, so it is entirely encrypted with the old master key
+func (cd *CryptDev) recoverJournal() error {
+	if cd.hdr.JournalActive == 0 {
+		return nil
+	}
+
+	pos, n := int64(cd.hdr.JournalPos), int64(cd.hdr.JournalLen)
+	if n > rekeyChunkBytes || pos+n > cd.size {
+		return fmt.Errorf("Re-key journal of %d bytes at offset %d is invalid", n, pos)
+	}
+	old := make([]byte, n)
+	if m, err := cd.dev.ReadAt(old, journalOffset); err != nil && !(err == io.EOF && m == len(old)) {
+		return fmt.Errorf("Could not read re-key journal: %w", err)
+	}
+	if crc32.ChecksumIEEE(old) != cd.hdr.JournalCRC {
+		return fmt.Errorf("Re-key journal is corrupt (checksum mismatch)")
+	}
+	if err := cd.writePayload(old, pos); err != nil {
+		return fmt.Errorf("Could not restore chunk from re-key journal: %w", err)
+	}
+	if err := cd.dev.Flush(); err != nil {
+		return fmt.Errorf("Could not flush underlying device: %w", err)
+	}
+
+	hdr := *cd.hdr
+	hdr.JournalActive = 0
+	return cd.updateHeader(&hdr)
+}
@@ -164,7 +164,7 @@ func (dd *dedupDisk) WriteAt(buf []byte, pos int64) (count int, err error) {
 			if dedupID, err = dd.blockStore.PutBlock(buf); err != nil {
 				return 0, fmt.Errorf("Addition of dedup block %d to block store failed: %w", dedupID, err)
 			}
-			if dd.idStore.PutID(hash, dedupID); err != nil {
+			if err = dd.idStore.PutID(hash, dedupID); err != nil {
 				return 0, fmt.Errorf("Addition of dedup block %d to idStore store failed: %w", dedupID, err)
 			}
 		} else if err != nil {
@@ -191,24 +191,17 @@ func (dd *dedupDisk) Flush() error {
 		return errShutdown
 	}
 
-	errCh := make(chan error, 6)
-	var wg sync.WaitGroup
-	wg.Add(3)
-	flush := func(resouce FlushClose) {
-		defer wg.Done()
-		if err := resouce.Flush(); err != nil {
-			errCh <- err
+	return dd.flush()
+}
+
+//flush persists the block store, ID store and then LUN map, the order they are
+// written in, so a crash never leaves an ID referring to a block that was lost
+func (dd *dedupDisk) flush() error {
+	for _, resource := range []FlushClose{dd.blockStore, dd.idStore, dd.lunMap} {
+		if err := resource.Flush(); err != nil {
+			return fmt.Errorf("Could not flush: %w", err)
 		}
 	}
-	go flush(dd.lunMap)
-	go flush(dd.idStore)
-	go flush(dd.blockStore)
-	wg.Wait()
-	select { //return first error
-	case err := <-errCh:
-		return fmt.Errorf("One or more errors occurred: %w", err)
-	default:
-	}
 	return nil
 }
 
@@ -225,14 +218,13 @@ func (dd *dedupDisk) Close() (err error) {
 }
 
 func (dd *dedupDisk) close() error {
-	errCh := make(chan error, 6)
+	flushErr := dd.flush()
+
+	errCh := make(chan error, 3)
 	var wg sync.WaitGroup
 	wg.Add(3)
 	cleanup := func(resource FlushClose) {
 		defer wg.Done()
-		if err := resource.Flush(); err != nil {
-			errCh <- err
-		}
 		if err := resource.Close(); err != nil {
 			errCh <- err
 		}
@@ -241,6 +233,9 @@ func (dd *dedupDisk) close() error {
 	go cleanup(dd.idStore)
 	go cleanup(dd.blockStore)
 	wg.Wait()
+	if flushErr != nil {
+		return flushErr
+	}
 	select { //return first error
 	case err := <-errCh:
 		return fmt.Errorf("One or more errors occurred: %w", err)
@@ -2,6 +2,7 @@ package dedupdisk_test
 
 import (
 	"errors"
+	"fmt"
 	"path/filepath"
 	"testing"
 
@@ -23,35 +24,57 @@ func TestDedupDisk(t *testing.T) {
 	}
 }
 
+func TestCrash(t *testing.T) {
+	const sizeBytes = 8 * 1024 * 1024 //8 MB
+
+	for _, bs := range blockStoreConstructors() {
+		t.Run("with-"+bs.name, func(t *testing.T) {
+			createDevice(t, sizeBytes, bs.newBlockStore).Close() //Skips expirmental block stores
+			testutil.TestProcessKill(t, testutil.CrashConfig{}, func(dir string, create bool) (usbdlib.Device, error) {
+				return openDevice(dir, sizeBytes, bs.newBlockStore)
+			})
+		})
+	}
+}
+
 type blockStoreConstructor func(filename string, blockSize int64) (dedupdisk.BlockStore, error)
 
 func createDevice(t *testing.T, sizeBytes uint, newBlockStore blockStoreConstructor) usbdlib.Device {
+	dev, err := openDevice(t.TempDir(), sizeBytes, newBlockStore)
+	if err != nil {
+		if errors.Is(err, consterr.ErrNotImplemented) {
+			t.Skip("Skipping expirmental block store")
+		}
+		t.Fatalf("Could not create device: %s", err)
+	}
+	return dev
+}
+
+//openDevice opens the device stored in the provided directory, creating it if it
+// does not exist
+func openDevice(storeDir string, sizeBytes uint, newBlockStore blockStoreConstructor) (usbdlib.Device, error) {
 	cacheSize := sizeBytes / 4
 	if cacheSize < 1 {
 		cacheSize = sizeBytes
 	}
 	blockSize := new(usbdlib.DefaultBlockSize).BlockSize()
-	storeDir := t.TempDir()
 
 	lunMap, err := impls.NewMmapLUNmap(filepath.Join(storeDir, "test.map"), blockSize, int64(sizeBytes))
 	if err != nil {
-		t.Fatalf("Could not create LUN map; Details: %s", err)
+		return nil, fmt.Errorf("Could not create LUN map; Details: %w", err)
 	}
 
 	idStore, err := impls.NewPebbleIDStore(filepath.Join(storeDir, "test.ids"), int(cacheSize), 5)
 	if err != nil {
-		t.Fatalf("Could not create ID store; Details: %s", err)
+		return nil, fmt.Errorf("Could not create ID store; Details: %w", err)
 	}
 
 	blockStore, err := newBlockStore(filepath.Join(storeDir, "test.blks"), blockSize)
 	if err != nil {
-		if errors.Is(err, consterr.ErrNotImplemented) {
-			t.Skip("Skipping expirmental block store")
-		}
-		t.Fatalf("Could not create block store; Details: %s", err)
+		return nil, fmt.Errorf("Could not create block store; Details: %w", err)
 	}
 
-	return dedupdisk.NewDedupDisk(lunMap, idStore, blockStore)
+	return dedupdisk.NewDedupDisk(lunMap, idStore, blockStore), nil
 }
 
 type blockStore struct {
@@ -42,7 +42,9 @@ func NewFileBlockStore(filename string, blockSize int64) (dedupdisk.BlockStore,
 	if err != nil {
 		return nil, fmt.Errorf("Could not stat backing file %q: %w", filename, err)
 	}
+	//Blocks are appended, a partial block left by a crash is overwritten
 	fbs.nextID = uint64(info.Size() / blockSize)
+	fbs.nextPos = int64(fbs.nextID) * blockSize
 	go fbs.fsyncWorker()
 	return fbs, nil
 }
@@ -0,0 +1,173 @@
+package faulty
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+//ControlRequest changes or queries the state of a Faulty device. Sent to a control
+// socket it is encoded as JSON, for example:
+//	{"cmd": "add", "rule": {"action": "error", "ops": ["read"], "start": 4096, "end": 8192}}
+//	{"cmd": "add", "rule": {"action": "delay", "dist": "normal", "latency": "20ms", "jitter": "5ms"}}
+//	{"cmd": "remove", "name": "rule-1"}
+//	{"cmd": "freeze"}
+type ControlRequest struct {
+	//Cmd is one of "add", "remove", "set", "clear", "list", "freeze" or "thaw"
+	Cmd   string `json:"cmd"`
+	Rule  *Rule  `json:"rule,omitempty"`  //For add
+	Rules []Rule `json:"rules,omitempty"` //For set
+	Name  string `json:"name,omitempty"`  //For remove
+}
+
+//ControlResponse is the state of a Faulty device after a ControlRequest
+type ControlResponse struct {
+	Error  string       `json:"error,omitempty"`
+	Frozen bool         `json:"frozen"`
+	Rules  []RuleStatus `json:"rules"`
+}
+
+//Control applies a request to the device and returns its resulting state
+func (dev *Faulty) Control(req ControlRequest) (resp ControlResponse) {
+	var err error
+	switch req.Cmd {
+	case "add":
+		if req.Rule == nil {
+			err = fmt.Errorf("No rule provided to add")
+		} else {
+			_, err = dev.AddRule(*req.Rule)
+		}
+	case "remove":
+		if !dev.RemoveRule(req.Name) {
+			err = fmt.Errorf("Rule %q does not exist", req.Name)
+		}
+	case "set":
+		err = dev.SetRules(req.Rules)
+	case "clear":
+		dev.ClearRules()
+	case "list":
+	case "freeze":
+		dev.Freeze()
+	case "thaw":
+		dev.Thaw()
+	default:
+		err = fmt.Errorf("Unknown command %q", req.Cmd)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Frozen, resp.Rules = dev.Frozen(), dev.Rules()
+	return resp
+}
+
+//ListenAndServeControl listens on the provided network address (ex. "unix",
+// "/run/faulty.sock") and serves control requests until the device is closed
+func (dev *Faulty) ListenAndServeControl(network, addr string) error {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("Could not listen on %s %q: %w", network, addr, err)
+	}
+	return dev.ServeControl(ln)
+}
+
+//ServeControl accepts connections on the provided listener and serves control
+// requests until the device is closed. Each connection sends a stream of JSON
+// encoded ControlRequests and receives a line of JSON encoded ControlResponse
+// for each.
+func (dev *Faulty) ServeControl(ln net.Listener) error {
+	dev.ctlMu.Lock()
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		dev.ctlMu.Unlock()
+		ln.Close()
+		return errClosed
+	}
+	dev.listeners[ln] = struct{}{}
+	dev.ctlMu.Unlock()
+
+	defer func() {
+		dev.ctlMu.Lock()
+		delete(dev.listeners, ln)
+		dev.ctlMu.Unlock()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				continue
+			}
+			return fmt.Errorf("Could not accept connection: %w", err)
+		}
+
+		dev.ctlMu.Lock()
+		if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+			dev.ctlMu.Unlock()
+			conn.Close()
+			return nil
+		}
+		dev.conns[conn] = struct{}{}
+		dev.connWg.Add(1)
+		dev.ctlMu.Unlock()
+
+		go func() {
+			defer func() {
+				conn.Close()
+				dev.ctlMu.Lock()
+				delete(dev.conns, conn)
+				dev.ctlMu.Unlock()
+				dev.connWg.Done()
+			}()
+
+			if err := dev.serveControlConn(conn); err != nil && atomic.LoadUint64(&dev.atomicOnline) == 1 {
+				log.Printf("Faulty::ServeControl(): WARNING: Connection from %s terminated; Details: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (dev *Faulty) serveControlConn(conn net.Conn) error {
+	dec, enc := json.NewDecoder(conn), json.NewEncoder(conn)
+	for {
+		var req ControlRequest
+		var resp ControlResponse
+		if err := dec.Decode(&req); err != nil {
+			var syntaxErr *json.SyntaxError
+			switch {
+			case err == io.EOF:
+				return nil
+			case errors.As(err, &syntaxErr) || err == io.ErrUnexpectedEOF:
+				//The stream can not be resumed, report the error before giving up
+				enc.Encode(ControlResponse{Error: fmt.Sprintf("Could not decode request: %s", err)})
+				return fmt.Errorf("Could not decode request: %w", err)
+			}
+			resp = ControlResponse{Error: fmt.Sprintf("Could not decode request: %s", err), Frozen: dev.Frozen(), Rules: dev.Rules()}
+		} else {
+			resp = dev.Control(req)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return fmt.Errorf("Could not send response: %w", err)
+		}
+	}
+}
+
+//closeControl stops serving control sockets, the device must already be offline
+func (dev *Faulty) closeControl() {
+	dev.ctlMu.Lock()
+	for ln := range dev.listeners {
+		ln.Close()
+	}
+	for conn := range dev.conns {
+		conn.Close()
+	}
+	dev.ctlMu.Unlock()
+	dev.connWg.Wait()
+}
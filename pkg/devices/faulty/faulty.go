@@ -0,0 +1,399 @@
+package faulty
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed = consterr.ConstErr("Device is shutdown")
+
+	//ErrInjected is wrapped by the errors of operations failed by a rule; use
+	// errors.Is to detect it
+	ErrInjected = consterr.ConstErr("Injected fault")
+
+	//SectorBytes is the granularity at which torn and partial writes are cut short
+	SectorBytes = 512
+)
+
+//Faulty wraps a device and injects faults into the operations passed to it as
+// described by a list of rules, which may be changed at any time by its methods
+// or through a control socket (see ServeControl). Each operation is checked
+// against every rule in order: all matching delay rules that fire add their
+// latency and the first other matching rule that fires decides the fault
+// injected. Every fault injected is logged. The device may also be frozen, which
+// blocks all operations until it is thawed.
+type Faulty struct {
+	dev          usbdlib.Device
+	logFaults    bool
+	atomicOnline uint64
+	ioMu         sync.RWMutex  //Held exclusively to close
+	closing      chan struct{} //Closed to release frozen and delayed operations
+
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	rules   []*RuleStatus
+	ruleSeq int
+	initial []Rule        //Provided by OptRules
+	frozen  chan struct{} //Non-nil while frozen, closed when thawed
+
+	ctlMu     sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	connWg    sync.WaitGroup
+}
+
+var (
+	_ usbdlib.Device         = (*Faulty)(nil)
+	_ usbdlib.ReadOnlyDevice = (*Faulty)(nil)
+)
+
+//NewFaulty constructs a device injecting faults into the operations passed to the
+// provided device, which it owns and closes when closed. Until rules are added it
+// passes all operations through unchanged.
+func NewFaulty(dev usbdlib.Device, options ...Option) (*Faulty, error) {
+	faulty := &Faulty{
+		dev:          dev,
+		logFaults:    true,
+		atomicOnline: 1,
+		closing:      make(chan struct{}),
+		rnd:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		listeners:    make(map[net.Listener]struct{}),
+		conns:        make(map[net.Conn]struct{}),
+	}
+	for _, opt := range options {
+		opt.apply(faulty)
+	}
+	if err := faulty.SetRules(faulty.initial); err != nil {
+		return nil, err
+	}
+	return faulty, nil
+}
+
+//AddRule appends a rule to those checked and returns its name, which is assigned
+// if the rule has none
+func (dev *Faulty) AddRule(rule Rule) (string, error) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	status, err := dev.newRule(rule, dev.rules)
+	if err != nil {
+		return "", err
+	}
+	dev.rules = append(dev.rules, status)
+	log.Printf("Faulty::AddRule(): Added rule %q to %s", status.Name, status.Action)
+	return status.Name, nil
+}
+
+//SetRules replaces all rules with those provided, or none if any is invalid
+func (dev *Faulty) SetRules(rules []Rule) error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	replacement := make([]*RuleStatus, 0, len(rules))
+	for _, rule := range rules {
+		status, err := dev.newRule(rule, replacement)
+		if err != nil {
+			return err
+		}
+		replacement = append(replacement, status)
+	}
+	if len(dev.rules) > 0 || len(replacement) > 0 {
+		log.Printf("Faulty::SetRules(): Replaced %d rules with %d", len(dev.rules), len(replacement))
+	}
+	dev.rules = replacement
+	return nil
+}
+
+//newRule validates a rule, assigning it a name if needed, to be added to existing
+// ones; the caller must hold mu
+func (dev *Faulty) newRule(rule Rule, existing []*RuleStatus) (*RuleStatus, error) {
+	if rule.Name == "" {
+		dev.ruleSeq++
+		rule.Name = fmt.Sprintf("rule-%d", dev.ruleSeq)
+	}
+	if err := rule.validate(); err != nil {
+		return nil, err
+	}
+	for _, other := range existing {
+		if other.Name == rule.Name {
+			return nil, fmt.Errorf("Rule %q already exists", rule.Name)
+		}
+	}
+	rule.Ops = append([]Op(nil), rule.Ops...)
+	return &RuleStatus{Rule: rule}, nil
+}
+
+//RemoveRule removes the named rule, returning false if there is no such rule
+func (dev *Faulty) RemoveRule(name string) bool {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	for i, existing := range dev.rules {
+		if existing.Name == name {
+			dev.rules = append(dev.rules[:i:i], dev.rules[i+1:]...)
+			log.Printf("Faulty::RemoveRule(): Removed rule %q which fired %d times", name, existing.Fired)
+			return true
+		}
+	}
+	return false
+}
+
+//ClearRules removes all rules
+func (dev *Faulty) ClearRules() {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	if len(dev.rules) > 0 {
+		log.Printf("Faulty::ClearRules(): Removed %d rules", len(dev.rules))
+	}
+	dev.rules = nil
+}
+
+//Rules returns the current rules, in the order they are checked, and the number
+// of times each has fired
+func (dev *Faulty) Rules() []RuleStatus {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	rules := make([]RuleStatus, len(dev.rules))
+	for i, rule := range dev.rules {
+		rules[i] = *rule
+	}
+	return rules
+}
+
+//Freeze blocks all operations, including those in progress that have not yet
+// reached the wrapped device, until Thaw is called
+func (dev *Faulty) Freeze() {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	if dev.frozen == nil {
+		dev.frozen = make(chan struct{})
+		log.Printf("Faulty::Freeze(): Device frozen")
+	}
+}
+
+//Thaw releases all operations blocked by Freeze
+func (dev *Faulty) Thaw() {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	if dev.frozen != nil {
+		close(dev.frozen)
+		dev.frozen = nil
+		log.Printf("Faulty::Thaw(): Device thawed")
+	}
+}
+
+//Frozen returns if the device is frozen
+func (dev *Faulty) Frozen() bool {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return dev.frozen != nil
+}
+
+//Size of this device in bytes
+func (dev *Faulty) Size() int64 {
+	return dev.dev.Size()
+}
+
+//BlockSize of this device is that of the wrapped device
+func (dev *Faulty) BlockSize() int64 {
+	return dev.dev.BlockSize()
+}
+
+//ReadOnly returns if the wrapped device is read-only, fulfilling
+// usbdlib.ReadOnlyDevice
+func (dev *Faulty) ReadOnly() bool {
+	return usbdlib.IsReadOnly(dev.dev)
+}
+
+//injection is the fault decided for an operation
+type injection struct {
+	delay  time.Duration
+	rule   *Rule //The rule deciding the fault, nil if the operation proceeds
+	prefix int   //Bytes written by torn and partial writes
+}
+
+//inject decides the faults injected into an operation by firing matching rules
+func (dev *Faulty) inject(op Op, pos int64, count int) (inj injection) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	for _, status := range dev.rules {
+		rule := &status.Rule
+		switch {
+		case rule.Count > 0 && status.Fired >= rule.Count:
+			continue
+		case !rule.matches(op, pos, int64(count)):
+			continue
+		case rule.Probability > 0 && rule.Probability < 1 && dev.rnd.Float64() >= rule.Probability:
+			continue
+		}
+		status.Fired++
+
+		var detail string
+		switch rule.Action {
+		case ActionDelay:
+			latency := rule.latency(dev.rnd)
+			inj.delay += latency
+			detail = fmt.Sprintf(" of %s", latency)
+		case ActionTornWrite, ActionPartialWrite:
+			if sectors := count / SectorBytes; sectors > 1 {
+				inj.prefix = dev.rnd.Intn(sectors) * SectorBytes
+			}
+			detail = fmt.Sprintf(" after %d bytes", inj.prefix)
+		}
+		if dev.logFaults {
+			if op == OpFlush {
+				log.Printf("Faulty::inject(): Rule %q injected %s%s into %s", rule.Name, rule.Action, detail, op)
+			} else {
+				log.Printf("Faulty::inject(): Rule %q injected %s%s into %s of %d bytes at offset %d", rule.Name, rule.Action, detail, op, count, pos)
+			}
+		}
+		if rule.Action != ActionDelay {
+			inj.rule = rule
+			break
+		}
+	}
+	return inj
+}
+
+//admit waits while the device is frozen then applies the delay of, and returns,
+// the faults injected into an operation
+func (dev *Faulty) admit(op Op, pos int64, count int) (injection, error) {
+	dev.mu.Lock()
+	frozen := dev.frozen
+	dev.mu.Unlock()
+	if frozen != nil {
+		select {
+		case <-frozen:
+		case <-dev.closing:
+			return injection{}, errClosed
+		}
+	}
+
+	inj := dev.inject(op, pos, count)
+	if inj.delay > 0 {
+		timer := time.NewTimer(inj.delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-dev.closing:
+			return injection{}, errClosed
+		}
+	}
+	return inj, nil
+}
+
+func (inj *injection) err() error {
+	return fmt.Errorf("Rule %q: %w", inj.rule.Name, ErrInjected)
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (dev *Faulty) ReadAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	inj, err := dev.admit(OpRead, pos, len(buf))
+	if err != nil {
+		return 0, err
+	} else if inj.rule != nil {
+		return 0, inj.err()
+	}
+	return dev.dev.ReadAt(buf, pos)
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (dev *Faulty) WriteAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	inj, err := dev.admit(OpWrite, pos, len(buf))
+	if err != nil {
+		return 0, err
+	} else if inj.rule == nil {
+		return dev.dev.WriteAt(buf, pos)
+	}
+
+	switch inj.rule.Action {
+	case ActionTornWrite, ActionPartialWrite:
+		if inj.prefix > 0 {
+			if n, err := dev.dev.WriteAt(buf[:inj.prefix], pos); err != nil {
+				return n, err
+			}
+		}
+		if inj.rule.Action == ActionPartialWrite {
+			return len(buf), nil
+		}
+		return inj.prefix, inj.err()
+	}
+	return 0, inj.err()
+}
+
+//Trim fufills part of usbdlib.Device
+func (dev *Faulty) Trim(pos int64, count int) error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	inj, err := dev.admit(OpTrim, pos, count)
+	if err != nil {
+		return err
+	} else if inj.rule != nil {
+		return inj.err()
+	}
+	return dev.dev.Trim(pos, count)
+}
+
+//Flush fufills part of usbdlib.Device
+func (dev *Faulty) Flush() error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	inj, err := dev.admit(OpFlush, 0, 0)
+	switch {
+	case err != nil:
+		return err
+	case inj.rule == nil:
+		return dev.dev.Flush()
+	case inj.rule.Action == ActionDropFlush:
+		return nil
+	}
+	return inj.err()
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device; it releases any
+// frozen or delayed operations, which fail, and stops serving control sockets
+func (dev *Faulty) Close() error {
+	if !atomic.CompareAndSwapUint64(&dev.atomicOnline, 1, 0) {
+		return errClosed
+	}
+	close(dev.closing)
+	dev.closeControl()
+
+	dev.ioMu.Lock() //Wait for outstanding IO
+	defer dev.ioMu.Unlock()
+	return dev.dev.Close()
+}
@@ -0,0 +1,270 @@
+package faulty
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+func TestFaulty(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	//Rules that never affect the result must not change the device's behavior
+	options := []Option{OptLogFaults(false), OptRules{
+		{Action: ActionDelay, Probability: 0.001, Dist: DistExponential, Latency: Duration(10 * time.Microsecond)},
+		{Action: ActionError, Ops: []Op{OpRead, OpWrite, OpTrim}, Start: 2 * sizeBytes}, //Beyond the end of the device
+	}}
+	testutil.TestUserspace(t, createDevice(t, sizeBytes, options...), sizeBytes)
+	testutil.TestNBD(t, createDevice(t, sizeBytes, options...), sizeBytes)
+}
+
+func createDevice(t *testing.T, sizeBytes int64, options ...Option) *Faulty {
+	t.Helper()
+
+	dev, err := NewFaulty(ramdisk.NewRAMDisk(sizeBytes), options...)
+	if err != nil {
+		t.Fatalf("Could not create faulty device: %s", err)
+	}
+	return dev
+}
+
+//flushCounter counts the flushes reaching the wrapped device
+type flushCounter struct {
+	usbdlib.Device
+	flushes int64
+}
+
+func (dev *flushCounter) Flush() error {
+	atomic.AddInt64(&dev.flushes, 1)
+	return dev.Device.Flush()
+}
+
+func TestRules(t *testing.T) {
+	const sizeBytes = 1024 * 1024
+
+	inner := &flushCounter{Device: ramdisk.NewRAMDisk(sizeBytes)}
+	dev, err := NewFaulty(inner, OptSeed(1))
+	if err != nil {
+		t.Fatalf("Could not create faulty device: %s", err)
+	}
+	defer dev.Close()
+
+	if _, err = dev.AddRule(Rule{Action: ActionTornWrite, Ops: []Op{OpRead}}); err == nil {
+		t.Fatalf("Rule tearing reads was accepted")
+	}
+
+	//A range of bad sectors fails reads and writes overlapping it
+	if _, err = dev.AddRule(Rule{Name: "bad", Action: ActionError, Ops: []Op{OpRead, OpWrite}, Start: 8192, End: 12288}); err != nil {
+		t.Fatalf("Could not add rule: %s", err)
+	}
+	buf := make([]byte, 4096)
+	for _, test := range []struct {
+		pos  int64
+		fail bool
+	}{{0, false}, {4096, false}, {6144, true}, {8192, true}, {10240, true}, {12288, false}} {
+		_, readErr := dev.ReadAt(buf, test.pos)
+		_, writeErr := dev.WriteAt(buf, test.pos)
+		if test.fail != errors.Is(readErr, ErrInjected) || test.fail != errors.Is(writeErr, ErrInjected) {
+			t.Fatalf("Read and write at %d returned %v and %v, expected failure: %t", test.pos, readErr, writeErr, test.fail)
+		}
+	}
+	if err = dev.Trim(8192, 4096); err != nil {
+		t.Fatalf("Trim of the bad range failed: %s", err)
+	}
+	if rules := dev.Rules(); len(rules) != 1 || rules[0].Fired != 6 {
+		t.Fatalf("Rules were not as expected: %+v", rules)
+	}
+	if !dev.RemoveRule("bad") || dev.RemoveRule("bad") {
+		t.Fatalf("Rule was not removed exactly once")
+	}
+
+	//Probabilistic rules fire at roughly their rate and expire after their count
+	if _, err = dev.AddRule(Rule{Action: ActionError, Ops: []Op{OpRead}, Probability: 0.25, Count: 100}); err != nil {
+		t.Fatalf("Could not add rule: %s", err)
+	}
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		if _, err = dev.ReadAt(buf, 0); err != nil {
+			failed++
+		}
+	}
+	if failed != 100 {
+		t.Fatalf("Expiring rule fired %d times rather than 100", failed)
+	}
+	dev.ClearRules()
+	if _, err = dev.AddRule(Rule{Action: ActionError, Ops: []Op{OpRead}, Probability: 0.25}); err != nil {
+		t.Fatalf("Could not add rule: %s", err)
+	}
+	failed = 0
+	for i := 0; i < 1000; i++ {
+		if _, err = dev.ReadAt(buf, 0); err != nil {
+			failed++
+		}
+	}
+	if failed < 175 || failed > 325 {
+		t.Fatalf("Rule with probability 0.25 failed %d of 1000 reads", failed)
+	}
+
+	//Torn writes write a prefix and fail, partial writes write a prefix and succeed
+	for _, action := range []Action{ActionTornWrite, ActionPartialWrite} {
+		dev.SetRules([]Rule{{Action: action, Count: 1}})
+		zeros, data := make([]byte, 64*1024), make([]byte, 64*1024)
+		rand.New(rand.NewSource(int64(action))).Read(data)
+		inner.WriteAt(zeros, 0)
+
+		n, err := dev.WriteAt(data, 0)
+		switch {
+		case action == ActionTornWrite && (!errors.Is(err, ErrInjected) || n >= len(data) || n%SectorBytes != 0):
+			t.Fatalf("Torn write returned %d, %v", n, err)
+		case action == ActionPartialWrite && (err != nil || n != len(data)):
+			t.Fatalf("Partial write returned %d, %v", n, err)
+		}
+		written := dev.Rules()[0].Fired
+		actual := make([]byte, len(data))
+		inner.ReadAt(actual, 0)
+		prefix := 0
+		for prefix < len(data) && actual[prefix] == data[prefix] {
+			prefix++
+		}
+		if prefix -= prefix % SectorBytes; prefix == len(data) || !bytes.Equal(actual[prefix:], zeros[prefix:]) || written != 1 {
+			t.Fatalf("%s wrote more than a prefix of the data", action)
+		}
+		if action == ActionTornWrite && prefix != n {
+			t.Fatalf("Torn write reported %d bytes written but wrote %d", n, prefix)
+		}
+	}
+
+	//Dropped flushes never reach the device
+	dev.SetRules([]Rule{{Action: ActionDropFlush}})
+	before := atomic.LoadInt64(&inner.flushes)
+	if err = dev.Flush(); err != nil || atomic.LoadInt64(&inner.flushes) != before {
+		t.Fatalf("Dropped flush returned %v or reached the device", err)
+	}
+	dev.ClearRules()
+	if err = dev.Flush(); err != nil || atomic.LoadInt64(&inner.flushes) != before+1 {
+		t.Fatalf("Flush returned %v or did not reach the device", err)
+	}
+
+	//Delays are added before operations proceed
+	dev.SetRules([]Rule{{Action: ActionDelay, Dist: DistUniform, Latency: Duration(20 * time.Millisecond), Jitter: Duration(10 * time.Millisecond)}})
+	start := time.Now()
+	if _, err = dev.ReadAt(buf, 0); err != nil {
+		t.Fatalf("Delayed read failed: %s", err)
+	} else if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("Read was only delayed by %s", elapsed)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	dev := createDevice(t, 1024*1024)
+
+	dev.Freeze()
+	done := make(chan error)
+	go func() {
+		_, err := dev.ReadAt(make([]byte, 4096), 0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Read completed while frozen: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	dev.Thaw()
+	if err := <-done; err != nil {
+		t.Fatalf("Read failed after thawing: %s", err)
+	}
+
+	//Closing releases frozen operations
+	dev.Freeze()
+	go func() {
+		done <- dev.Flush()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	testutil.TestClose(t, dev)
+	if err := <-done; !errors.Is(err, errClosed) {
+		t.Fatalf("Frozen flush returned %v rather than %s when closed", err, errClosed)
+	}
+}
+
+func TestControl(t *testing.T) {
+	dev := createDevice(t, 1024*1024)
+
+	sockPath := filepath.Join(t.TempDir(), "faulty.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Could not listen on %q: %s", sockPath, err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- dev.ServeControl(ln)
+	}()
+
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Could not connect to %q: %s", sockPath, err)
+	}
+	defer conn.Close()
+	lines := bufio.NewScanner(conn)
+	send := func(req string) ControlResponse {
+		t.Helper()
+
+		if _, err := conn.Write([]byte(req + "\n")); err != nil {
+			t.Fatalf("Could not send %s: %s", req, err)
+		}
+		var resp ControlResponse
+		if !lines.Scan() {
+			t.Fatalf("No response to %s: %v", req, lines.Err())
+		} else if err := json.Unmarshal(lines.Bytes(), &resp); err != nil {
+			t.Fatalf("Could not decode response to %s: %s", req, err)
+		}
+		return resp
+	}
+
+	resp := send(`{"cmd": "add", "rule": {"name": "eio", "action": "error", "ops": ["read"], "end": 4096}}`)
+	if resp.Error != "" || len(resp.Rules) != 1 || resp.Rules[0].Name != "eio" || resp.Rules[0].Ops[0] != OpRead {
+		t.Fatalf("Unexpected response to add: %+v", resp)
+	}
+	if _, err = dev.ReadAt(make([]byte, 512), 0); !errors.Is(err, ErrInjected) {
+		t.Fatalf("Read returned %v rather than an injected fault", err)
+	}
+	if resp = send(`{"cmd": "list"}`); resp.Rules[0].Fired != 1 {
+		t.Fatalf("Rule fired %d times rather than once", resp.Rules[0].Fired)
+	}
+	if resp = send(`{"cmd": "add", "rule": {"action": "delay", "latency": "soon"}}`); resp.Error == "" {
+		t.Fatalf("Invalid latency was accepted")
+	}
+	if resp = send(`{"cmd": "add", "rule": {"action": "delay", "dist": "normal", "latency": "1ms", "jitter": "500us"}}`); resp.Error != "" || len(resp.Rules) != 2 || time.Duration(resp.Rules[1].Jitter) != 500*time.Microsecond {
+		t.Fatalf("Unexpected response to add: %+v", resp)
+	}
+	if resp = send(`{"cmd": "remove", "name": "eio"}`); resp.Error != "" || len(resp.Rules) != 1 {
+		t.Fatalf("Unexpected response to remove: %+v", resp)
+	}
+	if resp = send(`{"cmd": "freeze"}`); !resp.Frozen || !dev.Frozen() {
+		t.Fatalf("Device was not frozen")
+	}
+	if resp = send(`{"cmd": "thaw"}`); resp.Frozen || dev.Frozen() {
+		t.Fatalf("Device was not thawed")
+	}
+	if resp = send(`{"cmd": "clear"}`); len(resp.Rules) != 0 {
+		t.Fatalf("Rules were not cleared: %+v", resp)
+	}
+	if resp = send(`{"cmd": "explode"}`); resp.Error == "" {
+		t.Fatalf("Unknown command was accepted")
+	}
+
+	testutil.TestClose(t, dev)
+	if err = <-served; err != nil {
+		t.Fatalf("Serving control socket failed: %s", err)
+	}
+}
@@ -0,0 +1,31 @@
+package faulty
+
+import "math/rand"
+
+//Option is a faulty device option
+type Option interface {
+	apply(*Faulty)
+}
+
+//OptSeed instructs a Faulty device to seed the random numbers deciding whether
+// rules fire, and with what latency, so runs can be repeated
+type OptSeed int64
+
+func (seed OptSeed) apply(dev *Faulty) {
+	dev.rnd = rand.New(rand.NewSource(int64(seed)))
+}
+
+//OptLogFaults instructs a Faulty device whether to log each fault injected, the
+// default is true
+type OptLogFaults bool
+
+func (logFaults OptLogFaults) apply(dev *Faulty) {
+	dev.logFaults = bool(logFaults)
+}
+
+//OptRules instructs a Faulty device to start with the provided rules
+type OptRules []Rule
+
+func (rules OptRules) apply(dev *Faulty) {
+	dev.initial = append(dev.initial, rules...)
+}
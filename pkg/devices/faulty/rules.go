@@ -0,0 +1,257 @@
+package faulty
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+//Op is a kind of device operation
+type Op uint8
+
+const (
+	//OpRead is a ReadAt
+	OpRead Op = iota
+	//OpWrite is a WriteAt
+	OpWrite
+	//OpTrim is a Trim
+	OpTrim
+	//OpFlush is a Flush
+	OpFlush
+)
+
+var opNames = []string{"read", "write", "trim", "flush"}
+
+func (op Op) String() string {
+	if int(op) < len(opNames) {
+		return opNames[op]
+	}
+	return "unknown"
+}
+
+//MarshalText encodes the op as its name
+func (op Op) MarshalText() ([]byte, error) {
+	if int(op) >= len(opNames) {
+		return nil, fmt.Errorf("Unknown op %d", op)
+	}
+	return []byte(op.String()), nil
+}
+
+//UnmarshalText decodes an op from its name
+func (op *Op) UnmarshalText(text []byte) error {
+	for i, name := range opNames {
+		if name == string(text) {
+			*op = Op(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown op %q", text)
+}
+
+//Action is what a rule does to the operations it matches
+type Action uint8
+
+const (
+	//ActionError fails the operation without passing it to the device
+	ActionError Action = iota
+	//ActionDelay adds latency, drawn from the rule's distribution, before the
+	// operation is passed to the device
+	ActionDelay
+	//ActionTornWrite writes a random whole number of sectors from the start of
+	// the buffer, less than all of it, and then fails as if power was lost
+	ActionTornWrite
+	//ActionPartialWrite writes a random whole number of sectors from the start of
+	// the buffer, less than all of it, but reports that all of it was written
+	ActionPartialWrite
+	//ActionDropFlush reports success without flushing the device
+	ActionDropFlush
+)
+
+var actionNames = []string{"error", "delay", "torn-write", "partial-write", "drop-flush"}
+
+func (action Action) String() string {
+	if int(action) < len(actionNames) {
+		return actionNames[action]
+	}
+	return "unknown"
+}
+
+//MarshalText encodes the action as its name
+func (action Action) MarshalText() ([]byte, error) {
+	if int(action) >= len(actionNames) {
+		return nil, fmt.Errorf("Unknown action %d", action)
+	}
+	return []byte(action.String()), nil
+}
+
+//UnmarshalText decodes an action from its name
+func (action *Action) UnmarshalText(text []byte) error {
+	for i, name := range actionNames {
+		if name == string(text) {
+			*action = Action(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown action %q", text)
+}
+
+//appliesTo returns if the action can be applied to the provided op
+func (action Action) appliesTo(op Op) bool {
+	switch action {
+	case ActionTornWrite, ActionPartialWrite:
+		return op == OpWrite
+	case ActionDropFlush:
+		return op == OpFlush
+	}
+	return true
+}
+
+//Dist is a distribution of added latency
+type Dist uint8
+
+const (
+	//DistFixed adds exactly Latency
+	DistFixed Dist = iota
+	//DistUniform adds between Latency and Latency+Jitter
+	DistUniform
+	//DistNormal adds a normally distributed latency with a mean of Latency and a
+	// standard deviation of Jitter, never less than zero
+	DistNormal
+	//DistExponential adds an exponentially distributed latency with a mean of
+	// Latency, modelling occasional long stalls
+	DistExponential
+)
+
+var distNames = []string{"fixed", "uniform", "normal", "exponential"}
+
+func (dist Dist) String() string {
+	if int(dist) < len(distNames) {
+		return distNames[dist]
+	}
+	return "unknown"
+}
+
+//MarshalText encodes the distribution as its name
+func (dist Dist) MarshalText() ([]byte, error) {
+	if int(dist) >= len(distNames) {
+		return nil, fmt.Errorf("Unknown distribution %d", dist)
+	}
+	return []byte(dist.String()), nil
+}
+
+//UnmarshalText decodes a distribution from its name
+func (dist *Dist) UnmarshalText(text []byte) error {
+	for i, name := range distNames {
+		if name == string(text) {
+			*dist = Dist(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown distribution %q", text)
+}
+
+//Duration is a time.Duration encoded as text (ex. "15ms") rather than as a number
+// of nanoseconds
+type Duration time.Duration
+
+//MarshalText encodes the duration as text
+func (dur Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(dur).String()), nil
+}
+
+//UnmarshalText decodes a duration from text
+func (dur *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*dur = Duration(parsed)
+	return nil
+}
+
+//Rule describes faults to inject into the operations it matches
+type Rule struct {
+	//Name identifies the rule in logs and to RemoveRule, if empty one is assigned
+	Name string `json:"name"`
+	//Ops the rule matches, empty matches all those its action applies to
+	Ops []Op `json:"ops,omitempty"`
+	//Start and End are the byte range, [Start, End), the rule matches. An End of 0
+	// is the end of the device. Flushes match regardless of range.
+	Start int64 `json:"start,omitempty"`
+	End   int64 `json:"end,omitempty"`
+	//Probability is the chance, from 0 to 1, that each matching operation is
+	// affected; 0 is treated as 1 so rules fire every time by default
+	Probability float64 `json:"probability,omitempty"`
+	//Count is the number of times the rule fires before it expires, 0 is unlimited
+	Count int64 `json:"count,omitempty"`
+
+	Action Action `json:"action"`
+	//Dist, Latency and Jitter describe the latency added by ActionDelay
+	Dist    Dist     `json:"dist,omitempty"`
+	Latency Duration `json:"latency,omitempty"`
+	Jitter  Duration `json:"jitter,omitempty"`
+}
+
+//RuleStatus is a rule and the number of times it has fired
+type RuleStatus struct {
+	Rule
+	Fired int64 `json:"fired"`
+}
+
+func (rule *Rule) validate() error {
+	switch {
+	case int(rule.Action) >= len(actionNames):
+		return fmt.Errorf("Rule %q has unknown action %d", rule.Name, rule.Action)
+	case int(rule.Dist) >= len(distNames):
+		return fmt.Errorf("Rule %q has unknown distribution %d", rule.Name, rule.Dist)
+	case rule.Start < 0 || (rule.End != 0 && rule.End <= rule.Start):
+		return fmt.Errorf("Rule %q has invalid range [%d, %d)", rule.Name, rule.Start, rule.End)
+	case rule.Probability < 0 || rule.Probability > 1:
+		return fmt.Errorf("Rule %q has probability %g outside of [0, 1]", rule.Name, rule.Probability)
+	case rule.Count < 0 || rule.Latency < 0 || rule.Jitter < 0:
+		return fmt.Errorf("Rule %q has a negative count, latency or jitter", rule.Name)
+	}
+	for _, op := range rule.Ops {
+		if int(op) >= len(opNames) {
+			return fmt.Errorf("Rule %q has unknown op %d", rule.Name, op)
+		} else if !rule.Action.appliesTo(op) {
+			return fmt.Errorf("Rule %q action %s can not be applied to %s", rule.Name, rule.Action, op)
+		}
+	}
+	return nil
+}
+
+//matches returns if the rule applies to an operation on the provided range
+func (rule *Rule) matches(op Op, pos, count int64) bool {
+	if !rule.Action.appliesTo(op) {
+		return false
+	}
+	if len(rule.Ops) > 0 {
+		found := false
+		for _, ruleOp := range rule.Ops {
+			found = found || ruleOp == op
+		}
+		if !found {
+			return false
+		}
+	}
+	if op == OpFlush {
+		return true
+	}
+	return pos+count > rule.Start && (rule.End == 0 || pos < rule.End)
+}
+
+//latency draws an added latency from the rule's distribution
+func (rule *Rule) latency(rnd *rand.Rand) time.Duration {
+	latency, jitter := float64(rule.Latency), float64(rule.Jitter)
+	switch rule.Dist {
+	case DistUniform:
+		latency += rnd.Float64() * jitter
+	case DistNormal:
+		latency = math.Max(0, latency+rnd.NormFloat64()*jitter)
+	case DistExponential:
+		latency *= rnd.ExpFloat64()
+	}
+	return time.Duration(latency)
+}
@@ -16,6 +16,14 @@ func TestFileDisk(t *testing.T) {
 	testutil.TestNBD(t, createDevice(t, sizeBytes), sizeBytes)
 }
 
+func TestCrash(t *testing.T) {
+	const sizeBytes = 8 * 1024 * 1024 //8 MB
+
+	testutil.TestProcessKill(t, testutil.CrashConfig{}, func(dir string, create bool) (usbdlib.Device, error) {
+		return filedisk.NewFileDisk(filepath.Join(dir, "test.bin"), sizeBytes)
+	})
+}
+
 func createDevice(t *testing.T, sizeBytes uint) usbdlib.Device {
 	dev, err := filedisk.NewFileDisk(filepath.Join(t.TempDir(), "test.bin"), int64(sizeBytes))
 	if err != nil {
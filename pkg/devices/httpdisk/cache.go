@@ -0,0 +1,135 @@
+package httpdisk
+
+import (
+	"container/list"
+	"sync"
+)
+
+//chunkCache is an LRU cache of fixed size chunks of the remote image. Concurrent
+// misses on the same chunk result in a single fetch and misses while reading
+// sequentially fetch additional chunks in the same request.
+type chunkCache struct {
+	fetch                  func(start, end int64) ([]byte, error)
+	chunkBytes, remoteSize int64
+	chunkCount             int64
+	capacity, readahead    int
+
+	mu        sync.Mutex
+	entries   map[int64]*list.Element
+	lru       *list.List
+	inflight  map[int64]*fetchOp
+	lastChunk int64
+}
+
+type cacheEntry struct {
+	idx  int64
+	data []byte
+}
+
+type fetchOp struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newChunkCache(fetch func(start, end int64) ([]byte, error), chunkBytes, remoteSize int64, capacity, readahead int) *chunkCache {
+	//Readahead must not evict the chunk that triggered it
+	if readahead > capacity-1 {
+		readahead = capacity - 1
+	}
+	return &chunkCache{
+		fetch:      fetch,
+		chunkBytes: chunkBytes,
+		remoteSize: remoteSize,
+		chunkCount: (remoteSize + chunkBytes - 1) / chunkBytes,
+		capacity:   capacity,
+		readahead:  readahead,
+		entries:    make(map[int64]*list.Element),
+		lru:        list.New(),
+		inflight:   make(map[int64]*fetchOp),
+		lastChunk:  -1,
+	}
+}
+
+//read returns the contents of the chunk with the provided index; the final
+// chunk may be shorter than chunkBytes
+func (cache *chunkCache) read(idx int64) ([]byte, error) {
+	if idx >= cache.chunkCount { //Zero padding beyond the end of the image
+		return nil, nil
+	}
+
+	cache.mu.Lock()
+	sequential := idx == cache.lastChunk+1
+	cache.lastChunk = idx
+
+	if elem, cached := cache.entries[idx]; cached {
+		cache.lru.MoveToFront(elem)
+		cache.mu.Unlock()
+		return elem.Value.(*cacheEntry).data, nil
+	}
+	if op, fetching := cache.inflight[idx]; fetching {
+		cache.mu.Unlock()
+		<-op.done
+		return op.data, op.err
+	}
+
+	//Fetch this chunk and, if reading sequentially, the following uncached ones
+	count := int64(1)
+	if sequential {
+		for count <= int64(cache.readahead) && idx+count < cache.chunkCount {
+			if _, cached := cache.entries[idx+count]; cached {
+				break
+			} else if _, fetching := cache.inflight[idx+count]; fetching {
+				break
+			}
+			count++
+		}
+	}
+	ops := make([]*fetchOp, count)
+	for i := range ops {
+		ops[i] = &fetchOp{done: make(chan struct{})}
+		cache.inflight[idx+int64(i)] = ops[i]
+	}
+	cache.mu.Unlock()
+
+	start, end := idx*cache.chunkBytes, (idx+count)*cache.chunkBytes
+	if end > cache.remoteSize {
+		end = cache.remoteSize
+	}
+	data, err := cache.fetch(start, end)
+
+	cache.mu.Lock()
+	for i, op := range ops {
+		chunkIdx := idx + int64(i)
+		delete(cache.inflight, chunkIdx)
+		if op.err = err; err == nil {
+			chunkEnd := int64(i+1) * cache.chunkBytes
+			if chunkEnd > int64(len(data)) {
+				chunkEnd = int64(len(data))
+			}
+			op.data = data[int64(i)*cache.chunkBytes : chunkEnd : chunkEnd]
+			cache.insert(chunkIdx, op.data)
+		}
+		close(op.done)
+	}
+	cache.mu.Unlock()
+	return ops[0].data, ops[0].err
+}
+
+//insert adds a chunk evicting the least recently used ones if over capacity,
+// the caller must hold the lock
+func (cache *chunkCache) insert(idx int64, data []byte) {
+	cache.entries[idx] = cache.lru.PushFront(&cacheEntry{idx: idx, data: data})
+	for cache.lru.Len() > cache.capacity {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).idx)
+	}
+}
+
+func (cache *chunkCache) purge() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.entries = make(map[int64]*list.Element)
+	cache.lru.Init()
+}
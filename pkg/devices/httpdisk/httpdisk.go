@@ -0,0 +1,311 @@
+package httpdisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed   = consterr.ConstErr("Device is shutdown")
+	errReadOnly = consterr.ConstErr("Device is read-only")
+	//ErrImageChanged is returned once the remote image is found to have been
+	// modified (its ETag, Last-Modified or length changed)
+	ErrImageChanged = consterr.ConstErr("Remote image changed")
+)
+
+const (
+	//DefCacheBytes is the default amount of memory used to cache the image
+	DefCacheBytes = 64 * 1024 * 1024
+	//DefChunkBytes is the default size of range requests and cache entries
+	DefChunkBytes = 256 * 1024
+	//DefReadaheadChunks is the default number of chunks read ahead
+	DefReadaheadChunks = 4
+)
+
+//HTTPDisk is a read-only device backed by an image file on an HTTP server that
+// supports range requests. Reads are cached in memory and the image is validated
+// on every request so the device fails rather than returning a mix of old and
+// new data if the image changes.
+type HTTPDisk struct {
+	url                    string
+	client                 *http.Client
+	remoteSize, size       int64
+	etag, lastModified     string
+	cacheBytes, chunkBytes int64
+	readahead              int
+	usbdlib.DefaultBlockSize
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	cache     *chunkCache
+
+	failMu  sync.Mutex
+	failErr error
+}
+
+var _ usbdlib.ReadOnlyDevice = (*HTTPDisk)(nil)
+
+//NewHTTPDisk constructs a device backed by the image at the provided URL. The
+// server must support range requests. If the image size is not a multiple of
+// the block size the device is padded with zeros.
+func NewHTTPDisk(ctx context.Context, url string, options ...Option) (*HTTPDisk, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	disk := &HTTPDisk{
+		url:        url,
+		client:     http.DefaultClient,
+		cacheBytes: DefCacheBytes,
+		chunkBytes: DefChunkBytes,
+		readahead:  DefReadaheadChunks,
+		ctx:        ctx,
+		ctxCancel:  cancel,
+	}
+	for _, opt := range options {
+		opt.apply(disk)
+	}
+
+	switch {
+	case disk.client == nil:
+		cancel()
+		return nil, fmt.Errorf("Provided HTTP client was nil")
+	case disk.chunkBytes < 1:
+		cancel()
+		return nil, fmt.Errorf("Chunk size must be at least one byte")
+	case disk.cacheBytes < disk.chunkBytes:
+		cancel()
+		return nil, fmt.Errorf("Cache size %d must be at least one chunk (%d bytes)", disk.cacheBytes, disk.chunkBytes)
+	}
+
+	if err := disk.probe(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	blockSize := disk.BlockSize()
+	disk.size = (disk.remoteSize + blockSize - 1) / blockSize * blockSize
+	disk.cache = newChunkCache(disk.fetch, disk.chunkBytes, disk.remoteSize, int(disk.cacheBytes/disk.chunkBytes), disk.readahead)
+	return disk, nil
+}
+
+//probe requests the first byte of the image to learn its size and validators
+// and to ensure the server supports range requests
+func (disk *HTTPDisk) probe() error {
+	resp, err := disk.get(0, 1, false)
+	if err != nil {
+		return fmt.Errorf("Could not probe %q: %w", disk.url, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return fmt.Errorf("Server for %q does not support range requests", disk.url)
+	default:
+		return fmt.Errorf("Server for %q replied with unexpected status: %s", disk.url, resp.Status)
+	}
+
+	_, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return fmt.Errorf("Could not determine size of %q: %w", disk.url, err)
+	} else if total < 1 {
+		return fmt.Errorf("Image %q is empty", disk.url)
+	}
+	disk.remoteSize = total
+	disk.etag, disk.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return nil
+}
+
+func (disk *HTTPDisk) get(start, end int64, conditional bool) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(disk.ctx, http.MethodGet, disk.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create request: %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	if conditional {
+		//If the image changed the server sends the whole thing (200) instead
+		if disk.etag != "" && !strings.HasPrefix(disk.etag, "W/") {
+			req.Header.Set("If-Range", disk.etag)
+		} else if disk.lastModified != "" {
+			req.Header.Set("If-Range", disk.lastModified)
+		}
+	}
+	return disk.client.Do(req)
+}
+
+//fetch reads [start, end) of the remote image validating it has not changed
+func (disk *HTTPDisk) fetch(start, end int64) ([]byte, error) {
+	if err := disk.failed(); err != nil {
+		return nil, err
+	}
+
+	resp, err := disk.get(start, end, true)
+	if err != nil {
+		if disk.ctx.Err() != nil {
+			return nil, errClosed
+		}
+		return nil, fmt.Errorf("Range request to %q failed: %w", disk.url, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK, http.StatusRequestedRangeNotSatisfiable, http.StatusPreconditionFailed:
+		return nil, disk.fail(fmt.Errorf("%w: server replied to range request with %s", ErrImageChanged, resp.Status))
+	default:
+		return nil, fmt.Errorf("Range request to %q failed with status: %s", disk.url, resp.Status)
+	}
+
+	rangeStart, rangeEnd, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("Range request to %q returned invalid Content-Range: %w", disk.url, err)
+	case total != disk.remoteSize:
+		return nil, disk.fail(fmt.Errorf("%w: size is now %d rather than %d bytes", ErrImageChanged, total, disk.remoteSize))
+	case disk.etag != "" && resp.Header.Get("ETag") != disk.etag:
+		return nil, disk.fail(fmt.Errorf("%w: ETag is now %q rather than %q", ErrImageChanged, resp.Header.Get("ETag"), disk.etag))
+	case disk.lastModified != "" && resp.Header.Get("Last-Modified") != disk.lastModified:
+		return nil, disk.fail(fmt.Errorf("%w: Last-Modified is now %q rather than %q", ErrImageChanged, resp.Header.Get("Last-Modified"), disk.lastModified))
+	case rangeStart != start || rangeEnd != end:
+		return nil, fmt.Errorf("Range request for bytes %d-%d returned bytes %d-%d", start, end-1, rangeStart, rangeEnd-1)
+	}
+
+	data := make([]byte, end-start)
+	if _, err = io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("Could not read range request body: %w", err)
+	}
+	return data, nil
+}
+
+//parseContentRange parses "bytes <first>-<last>/<total>" returning [start, end)
+func parseContentRange(contentRange string) (start, end, total int64, err error) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(contentRange, prefix) {
+		return 0, 0, 0, fmt.Errorf("Content-Range %q is not a byte range", contentRange)
+	}
+	span := strings.SplitN(strings.TrimPrefix(contentRange, prefix), "/", 2)
+	if len(span) != 2 || span[1] == "*" {
+		return 0, 0, 0, fmt.Errorf("Content-Range %q does not include the total size", contentRange)
+	}
+	bounds := strings.SplitN(span[0], "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, 0, fmt.Errorf("Content-Range %q is malformed", contentRange)
+	}
+
+	if start, err = strconv.ParseInt(bounds[0], 10, 64); err == nil {
+		if end, err = strconv.ParseInt(bounds[1], 10, 64); err == nil {
+			total, err = strconv.ParseInt(span[1], 10, 64)
+		}
+	}
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("Content-Range %q is malformed: %w", contentRange, err)
+	}
+	return start, end + 1, total, nil
+}
+
+//fail records that the image changed, all subsequent reads will fail
+func (disk *HTTPDisk) fail(err error) error {
+	disk.failMu.Lock()
+	defer disk.failMu.Unlock()
+	if disk.failErr == nil {
+		disk.failErr = err
+	}
+	return disk.failErr
+}
+
+func (disk *HTTPDisk) failed() error {
+	disk.failMu.Lock()
+	defer disk.failMu.Unlock()
+	return disk.failErr
+}
+
+//Size of this device in bytes
+func (disk *HTTPDisk) Size() int64 {
+	return disk.size
+}
+
+//ReadOnly is always true, fulfilling usbdlib.ReadOnlyDevice
+func (disk *HTTPDisk) ReadOnly() bool {
+	return true
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (disk *HTTPDisk) ReadAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case disk.ctx.Err() != nil:
+		return 0, errClosed
+	case pos >= disk.size:
+		return 0, io.EOF
+	}
+	if err = disk.failed(); err != nil {
+		return 0, err
+	}
+	if end := pos + int64(len(buf)); end > disk.size {
+		buf, err = buf[:disk.size-pos], io.EOF
+	}
+
+	for count < len(buf) {
+		offset := pos + int64(count)
+		chunk, readErr := disk.cache.read(offset / disk.chunkBytes)
+		if readErr != nil {
+			if errors.Is(readErr, errClosed) || disk.ctx.Err() != nil {
+				return count, errClosed
+			}
+			return count, readErr
+		}
+
+		inChunk := offset % disk.chunkBytes
+		n := len(buf) - count
+		if remaining := int(disk.chunkBytes - inChunk); n > remaining {
+			n = remaining
+		}
+		//The zero padding past the end of the image is not part of the chunk
+		copied := 0
+		if inChunk < int64(len(chunk)) {
+			copied = copy(buf[count:count+n], chunk[inChunk:])
+		}
+		for i := count + copied; i < count+n; i++ {
+			buf[i] = 0
+		}
+		count += n
+	}
+	return count, err
+}
+
+//WriteAt always fails as the device is read-only
+func (disk *HTTPDisk) WriteAt(buf []byte, pos int64) (count int, err error) {
+	if disk.ctx.Err() != nil {
+		return 0, errClosed
+	}
+	return 0, errReadOnly
+}
+
+//Trim always fails as the device is read-only
+func (disk *HTTPDisk) Trim(pos int64, count int) error {
+	if disk.ctx.Err() != nil {
+		return errClosed
+	}
+	return errReadOnly
+}
+
+//Flush is a no-op as the device is read-only
+func (disk *HTTPDisk) Flush() error {
+	if disk.ctx.Err() != nil {
+		return errClosed
+	}
+	return nil
+}
+
+//Close aborts outstanding requests and releases the cache
+func (disk *HTTPDisk) Close() error {
+	disk.ctxCancel()
+	disk.cache.purge()
+	return nil
+}
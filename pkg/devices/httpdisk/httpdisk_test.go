@@ -0,0 +1,197 @@
+package httpdisk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+//imageServer serves an in-memory image with range support via http.ServeContent
+// and counts the requests it receives
+type imageServer struct {
+	mu       sync.Mutex
+	image    []byte
+	etag     string
+	modTime  time.Time
+	requests uint64
+}
+
+func (srv *imageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&srv.requests, 1)
+
+	srv.mu.Lock()
+	image, etag, modTime := srv.image, srv.etag, srv.modTime
+	srv.mu.Unlock()
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	http.ServeContent(w, r, "image.img", modTime, bytes.NewReader(image))
+}
+
+func (srv *imageServer) replace(image []byte, etag string, modTime time.Time) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.image, srv.etag, srv.modTime = image, etag, modTime
+}
+
+func (srv *imageServer) requestCount() uint64 {
+	return atomic.LoadUint64(&srv.requests)
+}
+
+func startImageServer(t *testing.T, image []byte, etag string) (*imageServer, string) {
+	imgSrv := &imageServer{image: image, etag: etag, modTime: time.Now().Add(-time.Hour)}
+	srv := httptest.NewServer(imgSrv)
+	t.Cleanup(srv.Close)
+	return imgSrv, srv.URL + "/image.img"
+}
+
+func randomImage(size int) []byte {
+	image := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(image)
+	return image
+}
+
+func TestHTTPDisk(t *testing.T) {
+	const imageBytes = 1024*1024 + 1234 //Not a multiple of the block size
+
+	image := randomImage(imageBytes)
+	_, url := startImageServer(t, image, `"v1"`)
+
+	disk, err := NewHTTPDisk(testutil.CreateContext(t), url, OptChunkBytes(64*1024), OptCacheBytes(256*1024))
+	if err != nil {
+		t.Fatalf("Could not create device: %s", err)
+	}
+
+	padded := append(append([]byte{}, image...), make([]byte, usbdlib.DefaultBlockSizeBytes-imageBytes%usbdlib.DefaultBlockSizeBytes)...)
+	testutil.TestDevSize(t, disk, uint(len(padded)))
+	if !usbdlib.IsReadOnly(disk) {
+		t.Fatalf("Device is not read-only")
+	}
+
+	t.Run("random-reads", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < 500; i++ {
+			pos := rnd.Int63n(int64(len(padded)))
+			buf := make([]byte, rnd.Intn(200*1024))
+			n, err := disk.ReadAt(buf, pos)
+			expected := padded[pos:]
+			if len(expected) > len(buf) {
+				expected = expected[:len(buf)]
+			} else if err != io.EOF {
+				t.Fatalf("Read past the end of the device returned %v rather than EOF", err)
+			}
+			if err != nil && err != io.EOF {
+				t.Fatalf("Read of %d bytes at %d failed: %s", len(buf), pos, err)
+			} else if !bytes.Equal(buf[:n], expected) {
+				t.Fatalf("Read of %d bytes at %d returned the wrong data", len(buf), pos)
+			}
+		}
+	})
+
+	sum := sha256.Sum256(padded)
+	testutil.TestReadHash(t, disk, sum[:])
+
+	if _, err = disk.WriteAt([]byte{1}, 0); !errors.Is(err, errReadOnly) {
+		t.Fatalf("Write returned %v rather than %s", err, errReadOnly)
+	}
+	if err = disk.Trim(0, 4096); !errors.Is(err, errReadOnly) {
+		t.Fatalf("Trim returned %v rather than %s", err, errReadOnly)
+	}
+	testutil.TestClose(t, disk)
+}
+
+func TestCacheAndReadahead(t *testing.T) {
+	const (
+		chunkBytes = 64 * 1024
+		chunkCount = 32
+	)
+
+	imgSrv, url := startImageServer(t, randomImage(chunkBytes*chunkCount), `"v1"`)
+	disk, err := NewHTTPDisk(testutil.CreateContext(t), url, OptChunkBytes(chunkBytes), OptCacheBytes(chunkBytes*chunkCount), OptReadaheadChunks(7))
+	if err != nil {
+		t.Fatalf("Could not create device: %s", err)
+	}
+	defer disk.Close()
+
+	//Sequential reads should be satisfied by a request per eight chunks
+	before := imgSrv.requestCount()
+	buf := make([]byte, 4096)
+	for pos := int64(0); pos < disk.Size(); pos += int64(len(buf)) {
+		if _, err = disk.ReadAt(buf, pos); err != nil {
+			t.Fatalf("Read at %d failed: %s", pos, err)
+		}
+	}
+	if requests := imgSrv.requestCount() - before; requests > chunkCount/8+1 {
+		t.Fatalf("Sequential read of %d chunks took %d requests", chunkCount, requests)
+	}
+
+	//Everything is now cached
+	before = imgSrv.requestCount()
+	if _, err = disk.ReadAt(make([]byte, disk.Size()), 0); err != nil {
+		t.Fatalf("Read of entire device failed: %s", err)
+	}
+	if requests := imgSrv.requestCount() - before; requests != 0 {
+		t.Fatalf("Reading cached data took %d requests", requests)
+	}
+}
+
+func TestImageChanged(t *testing.T) {
+	const chunkBytes = 64 * 1024
+
+	for _, etag := range []string{`"v1"`, ""} { //Without an ETag Last-Modified is used
+		name := "etag"
+		if etag == "" {
+			name = "last-modified"
+		}
+		t.Run(name, func(t *testing.T) {
+			imgSrv, url := startImageServer(t, randomImage(chunkBytes*8), etag)
+			disk, err := NewHTTPDisk(testutil.CreateContext(t), url, OptChunkBytes(chunkBytes), OptCacheBytes(chunkBytes), OptReadaheadChunks(0))
+			if err != nil {
+				t.Fatalf("Could not create device: %s", err)
+			}
+			defer disk.Close()
+
+			if _, err = disk.ReadAt(make([]byte, 4096), 0); err != nil {
+				t.Fatalf("Read failed: %s", err)
+			}
+
+			newETag := ""
+			if etag != "" {
+				newETag = `"v2"`
+			}
+			imgSrv.replace(randomImage(chunkBytes*8+1), newETag, time.Now())
+
+			if _, err = disk.ReadAt(make([]byte, 4096), chunkBytes*4); !errors.Is(err, ErrImageChanged) {
+				t.Fatalf("Read after the image changed returned %v rather than %s", err, ErrImageChanged)
+			}
+			//Even cached data is no longer served
+			if _, err = disk.ReadAt(make([]byte, 4096), chunkBytes*4); !errors.Is(err, ErrImageChanged) {
+				t.Fatalf("Subsequent read returned %v rather than %s", err, ErrImageChanged)
+			}
+		})
+	}
+}
+
+func TestNoRangeSupport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 8192))
+	}))
+	defer srv.Close()
+
+	if disk, err := NewHTTPDisk(testutil.CreateContext(t), srv.URL); err == nil {
+		disk.Close()
+		t.Fatalf("Server without range support was accepted")
+	}
+}
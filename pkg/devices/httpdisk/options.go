@@ -0,0 +1,44 @@
+package httpdisk
+
+import (
+	"net/http"
+)
+
+//Option is an HTTP disk option
+type Option interface {
+	apply(*HTTPDisk)
+}
+
+//OptCacheBytes instructs an HTTPDisk to cache up to this much of the remote
+// image in memory
+type OptCacheBytes int64
+
+func (size OptCacheBytes) apply(disk *HTTPDisk) {
+	disk.cacheBytes = int64(size)
+}
+
+//OptChunkBytes instructs an HTTPDisk to fetch and cache the remote image in
+// chunks of this size
+type OptChunkBytes int64
+
+func (size OptChunkBytes) apply(disk *HTTPDisk) {
+	disk.chunkBytes = int64(size)
+}
+
+//OptReadaheadChunks instructs an HTTPDisk to fetch this many additional chunks
+// when it detects sequential reads (0 disables readahead)
+type OptReadaheadChunks uint
+
+func (count OptReadaheadChunks) apply(disk *HTTPDisk) {
+	disk.readahead = int(count)
+}
+
+//OptHTTPClient instructs an HTTPDisk to use the provided client rather than
+// http.DefaultClient (ex. to set timeouts, TLS or authentication)
+type OptHTTPClient struct {
+	Client *http.Client
+}
+
+func (opt OptHTTPClient) apply(disk *HTTPDisk) {
+	disk.client = opt.Client
+}
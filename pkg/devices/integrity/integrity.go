@@ -0,0 +1,481 @@
+package integrity
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/bitmap"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed = consterr.ConstErr("Device is shutdown")
+
+	//ErrIntegrity is wrapped by the errors returned when data read from the data
+	// device does not match its checksum, use errors.Is to detect it
+	ErrIntegrity = consterr.ConstErr("Data failed integrity check (checksum mismatch)")
+
+	//DefBlockBytes is the default size of the blocks checksums are kept for
+	DefBlockBytes = 4096
+	//DefRegionBytes is the default size of regions tracked by the write-intent bitmap
+	DefRegionBytes = 4 * 1024 * 1024
+
+	lockStripes = 64
+)
+
+//Stats describes the verification activity of an integrity device
+type Stats struct {
+	Algo           Algo
+	BlockBytes     int64
+	VerifiedBlocks int64 //Blocks read whose checksum matched
+	Mismatches     int64 //Blocks read whose checksum did not match
+	RebuiltBlocks  int64 //Blocks whose checksums were recomputed after a crash
+}
+
+//Integrity is a device that keeps a checksum of each block of a data device on a
+// separate metadata device and verifies every block read against it, so silent
+// corruption of the data device is reported as an error wrapping ErrIntegrity
+// rather than returned as data. Checksums are updated under the same lock as the
+// blocks they cover so they never disagree with the data a reader sees. A
+// write-intent bitmap records the regions written since the last flush, after a
+// crash the checksums of those regions are recomputed as they may not match the
+// data that reached the data device.
+//
+// Integrity devices compose with redundant devices: when used as the members of a
+// mirror.Mirror a block that fails verification on one member is read from
+// another and rewritten, while parity.Parity takes the member out of service and
+// reconstructs the block from the others.
+type Integrity struct {
+	data, meta               usbdlib.Device
+	algo                     Algo
+	size, blockBytes         int64
+	regionBytes              int64
+	hdrCopyBytes, sumsOffset int64
+	scrubInterval            time.Duration
+	scrubRate                int64
+	blockLocks               [lockStripes]sync.RWMutex
+	ioMu                     sync.RWMutex //Held exclusively to close
+	modifyMu                 sync.RWMutex //Held exclusively to flush
+	scrubMu                  sync.Mutex
+	atomicOnline             uint64
+	atomicVerified           int64
+	atomicMismatches         int64
+	atomicRebuilt            int64
+	scrubStop                chan struct{}
+	scrubDone                chan struct{}
+
+	mu        sync.Mutex
+	sums      []byte
+	dirty     *bitmap.Bitmap //Pages of sums not yet written to the metadata device
+	lastScrub ScrubReport
+
+	intentMu sync.Mutex
+	intent   *bitmap.Bitmap
+	seq      uint64
+}
+
+var _ usbdlib.Device = (*Integrity)(nil)
+
+//NewIntegrity constructs an integrity device verifying the provided data device
+// with checksums stored on the provided metadata device, which must be at least
+// MetaSize bytes. If the metadata device is blank (all zeros) checksums of the
+// current contents of the data device are computed first. The device owns both
+// devices and closes them when it is closed.
+func NewIntegrity(data, meta usbdlib.Device, options ...Option) (*Integrity, error) {
+	dev := newIntegrity(data.Size(), options)
+	dev.data, dev.meta = data, meta
+	switch {
+	case dev.algo != AlgoCRC32C && dev.algo != AlgoXXH64:
+		return nil, fmt.Errorf("Checksum algorithm %d is not supported", dev.algo)
+	case dev.blockBytes < 1 || dev.blockBytes%data.BlockSize() != 0:
+		return nil, fmt.Errorf("Block size %d is not a multiple of the data device block size %d", dev.blockBytes, data.BlockSize())
+	case dev.regionBytes < dev.blockBytes || dev.regionBytes%dev.blockBytes != 0:
+		return nil, fmt.Errorf("Region size %d is not a multiple of the block size %d", dev.regionBytes, dev.blockBytes)
+	case dev.size < 1:
+		return nil, fmt.Errorf("Data device is smaller than a block")
+	case meta.Size() < dev.metaSize():
+		return nil, fmt.Errorf("Metadata device is %d bytes, at least %d are required", meta.Size(), dev.metaSize())
+	}
+
+	found, err := dev.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		all := bitmap.New(dev.intent.Len())
+		all.SetRange(0, all.Len())
+		if err = dev.rebuild(all); err != nil {
+			return nil, fmt.Errorf("Could not compute initial checksums: %w", err)
+		}
+		atomic.StoreInt64(&dev.atomicRebuilt, 0)
+		if err = dev.writeHeader(); err != nil {
+			return nil, err
+		}
+	} else {
+		if err = dev.loadSums(); err != nil {
+			return nil, err
+		}
+		if err = dev.recover(); err != nil {
+			return nil, err
+		}
+	}
+
+	if dev.scrubInterval > 0 {
+		go dev.scrubLoop()
+	} else {
+		close(dev.scrubDone)
+	}
+	return dev, nil
+}
+
+//MetaSize returns the number of bytes of metadata device required to verify a
+// data device of the provided size with the provided options
+func MetaSize(dataSize int64, options ...Option) int64 {
+	return newIntegrity(dataSize, options).metaSize()
+}
+
+func newIntegrity(dataSize int64, options []Option) *Integrity {
+	dev := &Integrity{
+		blockBytes:   DefBlockBytes,
+		regionBytes:  DefRegionBytes,
+		atomicOnline: 1,
+		scrubStop:    make(chan struct{}),
+		scrubDone:    make(chan struct{}),
+	}
+	for _, opt := range options {
+		opt.apply(dev)
+	}
+	if dev.blockBytes > 0 && dev.regionBytes > 0 {
+		dev.size = dataSize - dataSize%dev.blockBytes
+		dev.intent = bitmap.New((dev.size + dev.regionBytes - 1) / dev.regionBytes)
+		dev.layout()
+	}
+	return dev
+}
+
+//Size of this device in bytes
+func (dev *Integrity) Size() int64 {
+	return dev.size
+}
+
+//BlockSize of this device is the size of the blocks checksums are kept for
+func (dev *Integrity) BlockSize() int64 {
+	return dev.blockBytes
+}
+
+//Stats returns the verification activity of the device
+func (dev *Integrity) Stats() Stats {
+	return Stats{
+		Algo:           dev.algo,
+		BlockBytes:     dev.blockBytes,
+		VerifiedBlocks: atomic.LoadInt64(&dev.atomicVerified),
+		Mismatches:     atomic.LoadInt64(&dev.atomicMismatches),
+		RebuiltBlocks:  atomic.LoadInt64(&dev.atomicRebuilt),
+	}
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (dev *Integrity) ReadAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case pos >= dev.size:
+		return 0, io.EOF
+	}
+	var eof error
+	if end := pos + int64(len(buf)); end > dev.size {
+		buf, eof = buf[:dev.size-pos], io.EOF
+	}
+	if len(buf) < 1 {
+		return 0, eof
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	first, last := pos/dev.blockBytes, (pos+int64(len(buf))-1)/dev.blockBytes
+	unlock := dev.lockBlocks(first, last, false)
+	defer unlock()
+
+	span, start := buf, first*dev.blockBytes
+	if start != pos || int64(len(buf))%dev.blockBytes != 0 {
+		span = make([]byte, (last-first+1)*dev.blockBytes)
+	}
+	if err = dev.readBlocks(span, first); err != nil {
+		return 0, fmt.Errorf("Could not read %d bytes at offset %d: %w", len(buf), pos, err)
+	}
+	if len(span) != len(buf) {
+		copy(buf, span[pos-start:])
+	}
+	return len(buf), eof
+}
+
+//readBlocks reads whole blocks from the data device and verifies them, the caller
+// must hold their locks
+func (dev *Integrity) readBlocks(span []byte, first int64) error {
+	if n, err := dev.data.ReadAt(span, first*dev.blockBytes); err != nil && !(err == io.EOF && n == len(span)) {
+		return fmt.Errorf("Could not read data device: %w", err)
+	}
+	if bad := dev.badBlocks(span, first); len(bad) > 0 {
+		return fmt.Errorf("Block %d at offset %d: %w", bad[0], bad[0]*dev.blockBytes, ErrIntegrity)
+	}
+	return nil
+}
+
+//badBlocks verifies whole blocks and returns the numbers of those whose checksums
+// do not match
+func (dev *Integrity) badBlocks(span []byte, first int64) (bad []int64) {
+	count := int64(len(span)) / dev.blockBytes
+	for i := int64(0); i < count; i++ {
+		if dev.algo.sum(span[i*dev.blockBytes:(i+1)*dev.blockBytes]) != dev.getSum(first+i) {
+			bad = append(bad, first+i)
+		}
+	}
+	atomic.AddInt64(&dev.atomicVerified, count-int64(len(bad)))
+	atomic.AddInt64(&dev.atomicMismatches, int64(len(bad)))
+	return bad
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (dev *Integrity) WriteAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case pos+int64(len(buf)) > dev.size:
+		return 0, io.ErrUnexpectedEOF
+	case len(buf) < 1:
+		return 0, nil
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	if err = dev.write(buf, pos); err != nil {
+		return 0, fmt.Errorf("Could not write %d bytes at offset %d: %w", len(buf), pos, err)
+	}
+	return len(buf), nil
+}
+
+//write writes to the data device and updates the checksums of the blocks written
+// while they are locked
+func (dev *Integrity) write(buf []byte, pos int64) error {
+	dev.modifyMu.RLock()
+	defer dev.modifyMu.RUnlock()
+
+	end := pos + int64(len(buf))
+	first, last := pos/dev.blockBytes, (end-1)/dev.blockBytes
+	unlock := dev.lockBlocks(first, last, true)
+	defer unlock()
+
+	if err := dev.markRegions(first, last); err != nil {
+		return err
+	}
+
+	//The unmodified parts of partially written blocks are read, and verified, so
+	// the new checksums do not vouch for corrupt data
+	span, start := buf, first*dev.blockBytes
+	if start != pos || int64(len(buf))%dev.blockBytes != 0 {
+		span = make([]byte, (last-first+1)*dev.blockBytes)
+		headRead := pos != start
+		if headRead {
+			if err := dev.readBlocks(span[:dev.blockBytes], first); err != nil {
+				return err
+			}
+		}
+		if end%dev.blockBytes != 0 && !(headRead && first == last) {
+			if err := dev.readBlocks(span[int64(len(span))-dev.blockBytes:], last); err != nil {
+				return err
+			}
+		}
+		copy(span[pos-start:], buf)
+	}
+
+	if _, err := dev.data.WriteAt(buf, pos); err != nil {
+		return fmt.Errorf("Could not write data device: %w", err)
+	}
+	dev.updateSums(span, first)
+	return nil
+}
+
+//Trim fufills part of usbdlib.Device by trimming whole blocks of the data device.
+// The checksums of trimmed blocks are recomputed from whatever the data device
+// then returns for them.
+func (dev *Integrity) Trim(pos int64, count int) error {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return errClosed
+	case count < 1 || pos >= dev.size:
+		return nil
+	}
+	end := pos + int64(count)
+	if end > dev.size {
+		end = dev.size
+	}
+	first, next := (pos+dev.blockBytes-1)/dev.blockBytes, end/dev.blockBytes
+	if first >= next {
+		return nil
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+	dev.modifyMu.RLock()
+	defer dev.modifyMu.RUnlock()
+
+	unlock := dev.lockBlocks(first, next-1, true)
+	defer unlock()
+
+	if err := dev.markRegions(first, next-1); err != nil {
+		return err
+	}
+	if err := dev.data.Trim(first*dev.blockBytes, int((next-first)*dev.blockBytes)); err != nil {
+		return fmt.Errorf("Could not trim %d bytes at offset %d: %w", count, pos, err)
+	}
+	if err := dev.rehash(first, next); err != nil {
+		return fmt.Errorf("Could not checksum trimmed blocks: %w", err)
+	}
+	return nil
+}
+
+//rehash recomputes the checksums of the blocks in [first, next) from the data
+// device, the caller must hold their locks or otherwise prevent IO to them
+func (dev *Integrity) rehash(first, next int64) error {
+	buf := make([]byte, dev.regionBytes)
+	for block := first; block < next; {
+		count := int64(len(buf)) / dev.blockBytes
+		if remaining := next - block; count > remaining {
+			count = remaining
+		}
+		span := buf[:count*dev.blockBytes]
+		if n, err := dev.data.ReadAt(span, block*dev.blockBytes); err != nil && !(err == io.EOF && n == len(span)) {
+			return fmt.Errorf("Could not read data device: %w", err)
+		}
+		dev.updateSums(span, block)
+		block += count
+	}
+	return nil
+}
+
+//lockBlocks locks the stripes covering the blocks in [first, last], returning a
+// function that unlocks them
+func (dev *Integrity) lockBlocks(first, last int64, exclusive bool) (unlock func()) {
+	var stripes []int
+	if last-first+1 >= lockStripes {
+		for i := 0; i < lockStripes; i++ {
+			stripes = append(stripes, i)
+		}
+	} else {
+		for block := first; block <= last; block++ {
+			stripes = append(stripes, int(block%lockStripes))
+		}
+		sort.Ints(stripes) //Consistent order to avoid deadlock
+	}
+
+	for _, stripe := range stripes {
+		if exclusive {
+			dev.blockLocks[stripe].Lock()
+		} else {
+			dev.blockLocks[stripe].RLock()
+		}
+	}
+	return func() {
+		for _, stripe := range stripes {
+			if exclusive {
+				dev.blockLocks[stripe].Unlock()
+			} else {
+				dev.blockLocks[stripe].RUnlock()
+			}
+		}
+	}
+}
+
+//getSum returns the checksum of a block
+func (dev *Integrity) getSum(block int64) uint64 {
+	width := dev.algo.sumBytes()
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	if width == 8 {
+		return binary.LittleEndian.Uint64(dev.sums[block*width:])
+	}
+	return uint64(binary.LittleEndian.Uint32(dev.sums[block*width:]))
+}
+
+//updateSums computes the checksums of whole blocks and marks the pages of the
+// metadata device holding them dirty
+func (dev *Integrity) updateSums(span []byte, first int64) {
+	width, count := dev.algo.sumBytes(), int64(len(span))/dev.blockBytes
+	sums := make([]uint64, count)
+	for i := range sums {
+		sums[i] = dev.algo.sum(span[int64(i)*dev.blockBytes : int64(i+1)*dev.blockBytes])
+	}
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	for i, sum := range sums {
+		off := (first + int64(i)) * width
+		if width == 8 {
+			binary.LittleEndian.PutUint64(dev.sums[off:], sum)
+		} else {
+			binary.LittleEndian.PutUint32(dev.sums[off:], uint32(sum))
+		}
+	}
+	dev.dirty.SetRange(first*width/metaPageBytes, ((first+count)*width-1)/metaPageBytes+1)
+}
+
+//Flush fufills part of usbdlib.Device by flushing the data device and then
+// writing the checksums updated since the last flush
+func (dev *Integrity) Flush() error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+	return dev.flush()
+}
+
+func (dev *Integrity) flush() error {
+	dev.modifyMu.Lock()
+	defer dev.modifyMu.Unlock()
+
+	if err := dev.data.Flush(); err != nil {
+		return fmt.Errorf("Could not flush data device: %w", err)
+	}
+	if err := dev.writeSums(); err != nil {
+		return err
+	}
+	return dev.clearRegions()
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device
+func (dev *Integrity) Close() error {
+	if !atomic.CompareAndSwapUint64(&dev.atomicOnline, 1, 0) {
+		return errClosed
+	}
+
+	close(dev.scrubStop)
+	<-dev.scrubDone
+
+	dev.ioMu.Lock() //Wait for outstanding IO
+	defer dev.ioMu.Unlock()
+
+	err := dev.flush()
+	if err != nil {
+		log.Printf("Integrity::Close(): WARNING: Checksums will be rebuilt when next opened; Details: %s", err)
+	}
+	if closeErr := dev.data.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("Could not close data device: %w", closeErr)
+	}
+	if closeErr := dev.meta.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("Could not close metadata device: %w", closeErr)
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+package integrity
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+func TestIntegrity(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	for _, algo := range []Algo{AlgoCRC32C, AlgoXXH64} {
+		t.Run(algo.String(), func(t *testing.T) {
+			testutil.TestUserspace(t, createDevice(t, sizeBytes, OptAlgo(algo)), sizeBytes)
+			testutil.TestNBD(t, createDevice(t, sizeBytes, OptAlgo(algo)), sizeBytes)
+		})
+	}
+}
+
+func createDevice(t *testing.T, sizeBytes int64, options ...Option) usbdlib.Device {
+	t.Helper()
+
+	data, meta := ramdisk.NewRAMDisk(sizeBytes), ramdisk.NewRAMDisk(MetaSize(sizeBytes, options...))
+	return openDev(t, data, meta, options...)
+}
+
+func openDev(t *testing.T, data, meta usbdlib.Device, options ...Option) *Integrity {
+	t.Helper()
+
+	dev, err := NewIntegrity(data, meta, options...)
+	if err != nil {
+		t.Fatalf("Could not create integrity device: %s", err)
+	}
+	return dev
+}
+
+func expectCorrupt(t *testing.T, desc string, dev usbdlib.Device, pos, count int64) {
+	t.Helper()
+
+	if _, err := dev.ReadAt(make([]byte, count), pos); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("Reading %s did not fail with ErrIntegrity: %v", desc, err)
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	const sizeBytes = 1024 * 1024
+
+	data := ramdisk.NewRAMDisk(sizeBytes)
+	dev := openDev(t, data, ramdisk.NewRAMDisk(MetaSize(sizeBytes)))
+	defer dev.Close()
+
+	contents := testutil.WriteRandom(t, dev, 0, sizeBytes, 1)
+	data.WriteAt([]byte{^contents[10000]}, 10000)
+	data.WriteAt([]byte{^contents[20000]}, 20000)
+
+	expectCorrupt(t, "a corrupt block", dev, 10000, 1)
+	expectCorrupt(t, "a range including a corrupt block", dev, 0, sizeBytes)
+	testutil.ExpectContents(t, "an intact block", dev, 12288, contents[12288:16384])
+	if _, err := dev.WriteAt([]byte{1}, 8192); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("Partially overwriting a corrupt block did not fail with ErrIntegrity: %v", err)
+	}
+	if stats := dev.Stats(); stats.Mismatches != 4 {
+		t.Fatalf("Stats recorded %d mismatches rather than 4", stats.Mismatches)
+	}
+
+	report, err := dev.Scrub()
+	switch {
+	case err != nil:
+		t.Fatalf("Could not scrub: %s", err)
+	case report.ScannedBytes != sizeBytes:
+		t.Fatalf("Scrub scanned %d bytes rather than %d", report.ScannedBytes, sizeBytes)
+	case len(report.BadOffsets) != 2 || report.BadOffsets[0] != 8192 || report.BadOffsets[1] != 16384:
+		t.Fatalf("Scrub found corrupt blocks at %v rather than [8192 16384]", report.BadOffsets)
+	}
+	if last := dev.LastScrub(); !last.Started.Equal(report.Started) {
+		t.Fatalf("Last scrub report was not that of the scrub just completed")
+	}
+
+	//Overwriting whole blocks replaces corrupt data
+	copy(contents[8192:], testutil.WriteRandom(t, dev, 8192, 12288, 2))
+	testutil.ExpectContents(t, "rewritten blocks", dev, 0, contents)
+	if report, err = dev.Scrub(); err != nil || len(report.BadOffsets) > 0 {
+		t.Fatalf("Scrub after rewriting corrupt blocks found %v (error: %v)", report.BadOffsets, err)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	const (
+		sizeBytes   = 1024 * 1024
+		regionBytes = 64 * 1024
+	)
+
+	data := testutil.NewUnclosable(ramdisk.NewRAMDisk(sizeBytes))
+	meta := testutil.NewUnclosable(ramdisk.NewRAMDisk(MetaSize(sizeBytes, OptRegionBytes(regionBytes))))
+	dev := openDev(t, data, meta, OptRegionBytes(regionBytes))
+	contents := testutil.WriteRandom(t, dev, 0, sizeBytes, 1)
+	testutil.TestClose(t, dev)
+
+	//Checksums are persisted by a clean shutdown
+	dev = openDev(t, data, meta, OptRegionBytes(regionBytes))
+	if stats := dev.Stats(); stats.RebuiltBlocks != 0 {
+		t.Fatalf("%d checksums were rebuilt after a clean shutdown", stats.RebuiltBlocks)
+	}
+	testutil.ExpectContents(t, "reopened device", dev, 0, contents)
+	if _, err := NewIntegrity(data, meta, OptAlgo(AlgoXXH64), OptRegionBytes(regionBytes)); err == nil {
+		t.Fatalf("Metadata for a different checksum algorithm was accepted")
+	}
+
+	//Write to region 3 without flushing and then "crash", only it is rebuilt
+	copy(contents[3*regionBytes+100:], testutil.WriteRandom(t, dev, 3*regionBytes+100, 1000, 2))
+	data.WriteAt([]byte{^contents[9*regionBytes]}, 9*regionBytes)
+
+	dev = openDev(t, data, meta, OptRegionBytes(regionBytes))
+	defer dev.Close()
+	if stats := dev.Stats(); stats.RebuiltBlocks != regionBytes/DefBlockBytes {
+		t.Fatalf("%d checksums were rebuilt after a crash rather than %d", stats.RebuiltBlocks, regionBytes/DefBlockBytes)
+	}
+	testutil.ExpectContents(t, "device after a crash", dev, 0, contents[:9*regionBytes])
+	expectCorrupt(t, "corruption outside the rebuilt region", dev, 9*regionBytes, 1)
+}
@@ -0,0 +1,245 @@
+package integrity
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/bitmap"
+)
+
+const (
+	metaMagic     = "USBDINT1"
+	metaVersion   = 1
+	metaHdrBytes  = len(metaMagic) + 2 + 1 + 1 + 4 + 8 + 8 + 8
+	metaPageBytes = 4096
+)
+
+//The metadata device holds two copies of a header, followed by the checksums of
+// every block. Header updates alternate between the copies so one is always
+// intact. The header holds the write-intent bitmap which has a bit per region
+// that is set, and persisted, before any write to the region is issued to the data
+// device. Bits are cleared only once the data device has been flushed and the
+// checksums written, so after a crash the set bits identify the only regions
+// whose checksums may not match the data.
+
+func roundUp(val, to int64) int64 {
+	return (val + to - 1) / to * to
+}
+
+//layout computes the location of the header copies and checksums
+func (dev *Integrity) layout() {
+	dev.hdrCopyBytes = roundUp(int64(metaHdrBytes)+bitmap.MarshaledSize(dev.intent.Len())+4, metaPageBytes)
+	dev.sumsOffset = 2 * dev.hdrCopyBytes
+}
+
+func (dev *Integrity) sumsBytes() int64 {
+	return roundUp(dev.size/dev.blockBytes*dev.algo.sumBytes(), metaPageBytes)
+}
+
+func (dev *Integrity) metaSize() int64 {
+	return dev.sumsOffset + dev.sumsBytes()
+}
+
+//readHeader loads the most recent valid header copy, returning false if the
+// metadata device is blank
+func (dev *Integrity) readHeader() (bool, error) {
+	dev.sums = make([]byte, dev.sumsBytes())
+	dev.dirty = bitmap.New(int64(len(dev.sums)) / metaPageBytes)
+
+	var firstErr error
+	found, blank := false, 0
+	raw := make([]byte, dev.hdrCopyBytes)
+	for i := int64(0); i < 2; i++ {
+		if n, err := dev.meta.ReadAt(raw, i*dev.hdrCopyBytes); err != nil && !(err == io.EOF && n == len(raw)) {
+			return false, fmt.Errorf("Could not read metadata header copy %d: %w", i, err)
+		}
+		if string(raw[:len(metaMagic)]) != metaMagic && util.IsZeros(raw) {
+			blank++
+			continue
+		}
+		seq, intent, err := dev.decodeHeader(raw)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if !found || seq > dev.seq {
+			found, dev.seq, dev.intent = true, seq, intent
+		}
+	}
+
+	switch {
+	case found:
+		return true, nil
+	case blank == 2:
+		return false, nil
+	}
+	return false, firstErr
+}
+
+func (dev *Integrity) decodeHeader(raw []byte) (uint64, *bitmap.Bitmap, error) {
+	end := int64(len(raw)) - 4
+	switch {
+	case string(raw[:len(metaMagic)]) != metaMagic:
+		return 0, nil, fmt.Errorf("Device does not hold integrity metadata")
+	case crc32.ChecksumIEEE(raw[:end]) != binary.LittleEndian.Uint32(raw[end:]):
+		return 0, nil, fmt.Errorf("Integrity metadata header is corrupt (checksum mismatch)")
+	}
+
+	hdr := raw[len(metaMagic):]
+	version, algo := binary.LittleEndian.Uint16(hdr), Algo(hdr[2])
+	blockBytes := int64(binary.LittleEndian.Uint32(hdr[4:]))
+	regionBytes := int64(binary.LittleEndian.Uint64(hdr[8:]))
+	size := int64(binary.LittleEndian.Uint64(hdr[16:]))
+	switch {
+	case version != metaVersion:
+		return 0, nil, fmt.Errorf("Integrity metadata version %d is not supported", version)
+	case algo != dev.algo:
+		return 0, nil, fmt.Errorf("Integrity metadata uses the %s algorithm rather than %s", algo, dev.algo)
+	case blockBytes != dev.blockBytes:
+		return 0, nil, fmt.Errorf("Integrity metadata has a block size of %d rather than %d", blockBytes, dev.blockBytes)
+	case regionBytes != dev.regionBytes:
+		return 0, nil, fmt.Errorf("Integrity metadata has a region size of %d rather than %d", regionBytes, dev.regionBytes)
+	case size != dev.size:
+		return 0, nil, fmt.Errorf("Integrity metadata is for a device of %d bytes rather than %d", size, dev.size)
+	}
+
+	intent := bitmap.New(dev.intent.Len())
+	bits := raw[metaHdrBytes : int64(metaHdrBytes)+bitmap.MarshaledSize(intent.Len())]
+	if err := intent.UnmarshalBinary(bits); err != nil {
+		return 0, nil, fmt.Errorf("Could not decode write-intent bitmap: %w", err)
+	}
+	return binary.LittleEndian.Uint64(hdr[24:]), intent, nil
+}
+
+//writeHeader persists the write-intent bitmap over the older header copy, the
+// caller must hold intentMu or otherwise prevent concurrent header updates
+func (dev *Integrity) writeHeader() error {
+	raw := make([]byte, dev.hdrCopyBytes)
+	copy(raw, metaMagic)
+	hdr := raw[len(metaMagic):]
+	binary.LittleEndian.PutUint16(hdr, metaVersion)
+	hdr[2] = byte(dev.algo)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(dev.blockBytes))
+	binary.LittleEndian.PutUint64(hdr[8:], uint64(dev.regionBytes))
+	binary.LittleEndian.PutUint64(hdr[16:], uint64(dev.size))
+	binary.LittleEndian.PutUint64(hdr[24:], dev.seq+1)
+	bits, _ := dev.intent.MarshalBinary()
+	copy(raw[metaHdrBytes:], bits)
+	end := len(raw) - 4
+	binary.LittleEndian.PutUint32(raw[end:], crc32.ChecksumIEEE(raw[:end]))
+
+	if _, err := dev.meta.WriteAt(raw, int64((dev.seq+1)%2)*dev.hdrCopyBytes); err != nil {
+		return fmt.Errorf("Could not write integrity metadata header: %w", err)
+	}
+	if err := dev.meta.Flush(); err != nil {
+		return fmt.Errorf("Could not flush integrity metadata header: %w", err)
+	}
+	dev.seq++
+	return nil
+}
+
+//loadSums reads all checksums from the metadata device
+func (dev *Integrity) loadSums() error {
+	if n, err := dev.meta.ReadAt(dev.sums, dev.sumsOffset); err != nil && !(err == io.EOF && n == len(dev.sums)) {
+		return fmt.Errorf("Could not read checksums: %w", err)
+	}
+	return nil
+}
+
+//writeSums writes the dirty pages of checksums to the metadata device and flushes
+// it, the caller must prevent checksums from being updated meanwhile
+func (dev *Integrity) writeSums() error {
+	for page := dev.dirty.NextSet(0); page >= 0; {
+		next := dev.dirty.NextClear(page)
+		if next < 0 {
+			next = dev.dirty.Len()
+		}
+		run := dev.sums[page*metaPageBytes : next*metaPageBytes]
+		if _, err := dev.meta.WriteAt(run, dev.sumsOffset+page*metaPageBytes); err != nil {
+			return fmt.Errorf("Could not write checksums: %w", err)
+		}
+		dev.dirty.ClearRange(page, next)
+		page = dev.dirty.NextSet(next)
+	}
+	if err := dev.meta.Flush(); err != nil {
+		return fmt.Errorf("Could not flush checksums: %w", err)
+	}
+	return nil
+}
+
+//markRegions records that the regions covering the blocks in [first, last] are
+// about to be written
+func (dev *Integrity) markRegions(first, last int64) error {
+	dev.intentMu.Lock()
+	defer dev.intentMu.Unlock()
+
+	var newBits []int64
+	for region := first * dev.blockBytes / dev.regionBytes; region <= last*dev.blockBytes/dev.regionBytes; region++ {
+		if !dev.intent.Test(region) {
+			dev.intent.Set(region)
+			newBits = append(newBits, region)
+		}
+	}
+	if len(newBits) > 0 {
+		if err := dev.writeHeader(); err != nil {
+			for _, region := range newBits {
+				dev.intent.Clear(region)
+			}
+			return fmt.Errorf("Could not persist write-intent bitmap: %w", err)
+		}
+	}
+	return nil
+}
+
+//clearRegions clears the write-intent bitmap, the data device must have just been
+// flushed and the checksums written while writes were prevented
+func (dev *Integrity) clearRegions() error {
+	dev.intentMu.Lock()
+	defer dev.intentMu.Unlock()
+
+	if dev.intent.Count() < 1 {
+		return nil
+	}
+	dev.intent.ClearAll()
+	if err := dev.writeHeader(); err != nil {
+		return fmt.Errorf("Could not persist write-intent bitmap: %w", err)
+	}
+	return nil
+}
+
+//recover recomputes the checksums of regions that were being written when the
+// device was last shut down
+func (dev *Integrity) recover() error {
+	if dev.intent.Count() < 1 {
+		return nil
+	}
+	log.Printf("Integrity::recover(): WARNING: Device was not shut down cleanly, rebuilding checksums of %d regions", dev.intent.Count())
+	if err := dev.rebuild(dev.intent); err != nil {
+		return fmt.Errorf("Could not rebuild checksums: %w", err)
+	}
+	return dev.clearRegions()
+}
+
+//rebuild recomputes the checksums of the provided regions and writes them to the
+// metadata device
+func (dev *Integrity) rebuild(regions *bitmap.Bitmap) error {
+	blocksPerRegion, lastBlock := dev.regionBytes/dev.blockBytes, dev.size/dev.blockBytes
+	for region := regions.NextSet(0); region >= 0; region = regions.NextSet(region + 1) {
+		first, next := region*blocksPerRegion, (region+1)*blocksPerRegion
+		if next > lastBlock {
+			next = lastBlock
+		}
+		if err := dev.rehash(first, next); err != nil {
+			return err
+		}
+		atomic.AddInt64(&dev.atomicRebuilt, next-first)
+	}
+	return dev.writeSums()
+}
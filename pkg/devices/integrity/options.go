@@ -0,0 +1,93 @@
+package integrity
+
+import (
+	"hash/crc32"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+//Option is an integrity device option
+type Option interface {
+	apply(*Integrity)
+}
+
+//Algo is a checksum algorithm
+type Algo uint8
+
+const (
+	//AlgoCRC32C is the Castagnoli CRC32, which is hardware accelerated on most CPUs
+	// and stored in 4 bytes per block
+	AlgoCRC32C Algo = iota
+	//AlgoXXH64 is the 64-bit xxHash, stored in 8 bytes per block
+	AlgoXXH64
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func (algo Algo) String() string {
+	switch algo {
+	case AlgoCRC32C:
+		return "crc32c"
+	case AlgoXXH64:
+		return "xxh64"
+	}
+	return "unknown"
+}
+
+//sumBytes returns the size of a checksum in bytes
+func (algo Algo) sumBytes() int64 {
+	if algo == AlgoXXH64 {
+		return 8
+	}
+	return 4
+}
+
+func (algo Algo) sum(block []byte) uint64 {
+	if algo == AlgoXXH64 {
+		return xxhash.Sum64(block)
+	}
+	return uint64(crc32.Checksum(block, crc32cTable))
+}
+
+//OptAlgo instructs an Integrity device to checksum blocks with the provided
+// algorithm; it must match that of any existing metadata
+type OptAlgo Algo
+
+func (algo OptAlgo) apply(dev *Integrity) {
+	dev.algo = Algo(algo)
+}
+
+//OptBlockBytes instructs an Integrity device to checksum blocks of this size; it
+// must be a multiple of the block size of the data device and match that of any
+// existing metadata
+type OptBlockBytes int64
+
+func (size OptBlockBytes) apply(dev *Integrity) {
+	dev.blockBytes = int64(size)
+}
+
+//OptRegionBytes instructs an Integrity device to track writes in its write-intent
+// bitmap at this granularity. Smaller regions mean fewer checksums are rebuilt
+// after a crash at the cost of a larger bitmap and more bitmap updates.
+type OptRegionBytes int64
+
+func (size OptRegionBytes) apply(dev *Integrity) {
+	dev.regionBytes = int64(size)
+}
+
+//OptScrubInterval instructs an Integrity device to scrub itself in the background
+// at this interval, 0 (the default) disables background scrubbing
+type OptScrubInterval time.Duration
+
+func (interval OptScrubInterval) apply(dev *Integrity) {
+	dev.scrubInterval = time.Duration(interval)
+}
+
+//OptScrubRate instructs an Integrity device to limit background scrubbing to this
+// many bytes per second. 0 is unlimited.
+type OptScrubRate int64
+
+func (rate OptScrubRate) apply(dev *Integrity) {
+	dev.scrubRate = int64(rate)
+}
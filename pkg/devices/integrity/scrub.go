@@ -0,0 +1,128 @@
+package integrity
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const scrubChunkBytes = 1024 * 1024
+
+//ScrubReport describes the outcome of a scrub
+type ScrubReport struct {
+	Started      time.Time
+	Duration     time.Duration
+	ScannedBytes int64
+	BadOffsets   []int64 //Offsets of the blocks that failed verification
+}
+
+func (dev *Integrity) scrubLoop() {
+	defer close(dev.scrubDone)
+
+	ticker := time.NewTicker(dev.scrubInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dev.scrubStop:
+			return
+		case <-ticker.C:
+		}
+
+		report, err := dev.scrub(true)
+		switch {
+		case err == errClosed:
+			return
+		case err != nil:
+			log.Printf("Integrity::scrubLoop(): WARNING: Could not scrub device; Details: %s", err)
+		case len(report.BadOffsets) > 0:
+			log.Printf("Integrity::scrubLoop(): WARNING: %d blocks failed verification, first at offset %d", len(report.BadOffsets), report.BadOffsets[0])
+		}
+	}
+}
+
+//Scrub reads and verifies every block of the device, returning a report of those
+// that failed verification. Scrubbing is normally done periodically in the
+// background, this is not rate limited.
+func (dev *Integrity) Scrub() (ScrubReport, error) {
+	return dev.scrub(false)
+}
+
+//LastScrub returns the report of the most recently completed scrub
+func (dev *Integrity) LastScrub() ScrubReport {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	return dev.lastScrub
+}
+
+func (dev *Integrity) scrub(limit bool) (report ScrubReport, err error) {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return report, errClosed
+	}
+
+	dev.scrubMu.Lock()
+	defer dev.scrubMu.Unlock()
+
+	report.Started = time.Now()
+	chunkBytes := scrubChunkBytes / dev.blockBytes * dev.blockBytes
+	if chunkBytes < dev.blockBytes {
+		chunkBytes = dev.blockBytes
+	}
+	buf := make([]byte, chunkBytes)
+	for pos := int64(0); pos < dev.size; pos += chunkBytes {
+		if remaining := dev.size - pos; int64(len(buf)) > remaining {
+			buf = buf[:remaining]
+		}
+		bad, err := dev.scrubChunk(buf, pos)
+		if err != nil {
+			return report, err
+		}
+		for _, block := range bad {
+			report.BadOffsets = append(report.BadOffsets, block*dev.blockBytes)
+		}
+		report.ScannedBytes += int64(len(buf))
+		if !dev.pace(limit, int64(len(buf))) {
+			return report, errClosed
+		}
+	}
+	report.Duration = time.Since(report.Started)
+
+	dev.mu.Lock()
+	dev.lastScrub = report
+	dev.mu.Unlock()
+	return report, nil
+}
+
+//scrubChunk reads and verifies whole blocks while they are locked
+func (dev *Integrity) scrubChunk(buf []byte, pos int64) ([]int64, error) {
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return nil, errClosed
+	}
+
+	first := pos / dev.blockBytes
+	unlock := dev.lockBlocks(first, first+int64(len(buf))/dev.blockBytes-1, false)
+	defer unlock()
+
+	if n, err := dev.data.ReadAt(buf, pos); err != nil && !(err == io.EOF && n == len(buf)) {
+		return nil, fmt.Errorf("Could not read %d bytes at offset %d: %w", len(buf), pos, err)
+	}
+	return dev.badBlocks(buf, first), nil
+}
+
+//pace sleeps to limit background scrubbing to the configured rate, returning false
+// if the device is closed meanwhile
+func (dev *Integrity) pace(limit bool, scanned int64) bool {
+	if !limit || dev.scrubRate < 1 {
+		return true
+	}
+	select {
+	case <-dev.scrubStop:
+		return false
+	case <-time.After(time.Duration(scanned * int64(time.Second) / dev.scrubRate)):
+		return true
+	}
+}
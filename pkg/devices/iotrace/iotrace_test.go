@@ -0,0 +1,237 @@
+package iotrace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+func TestRecorder(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	testutil.TestUserspace(t, createDevice(t, sizeBytes, io.Discard, OptHashes(true)), sizeBytes)
+	testutil.TestNBD(t, createDevice(t, sizeBytes, io.Discard, OptHashes(true)), sizeBytes)
+}
+
+func createDevice(t *testing.T, sizeBytes int64, traceOut io.Writer, options ...Option) *Recorder {
+	t.Helper()
+
+	dev, err := NewRecorder(ramdisk.NewRAMDisk(sizeBytes), traceOut, options...)
+	if err != nil {
+		t.Fatalf("Could not create recording device: %s", err)
+	}
+	return dev
+}
+
+func TestTrace(t *testing.T) {
+	hdr := Header{Flags: FlagHashes | FlagPayloads, DeviceBytes: 1 << 40, BlockBytes: 4096, Start: time.Unix(0, 1234567890)}
+	records := []Record{
+		{Op: OpWrite, Offset: 1 << 39, Length: 3, Start: time.Second, Duration: time.Millisecond, Hash: 42, Payload: []byte{1, 2, 3}},
+		{Op: OpRead, Offset: 4096, Length: 512, Start: time.Second / 2, Duration: time.Microsecond, Failed: true, Hash: 7},
+		{Op: OpTrim, Offset: 0, Length: 1 << 20, Start: 2 * time.Second},
+		{Op: OpFlush, Start: 3 * time.Second, Duration: 5 * time.Millisecond},
+	}
+
+	var buf bytes.Buffer
+	wtr, err := NewWriter(&buf, hdr)
+	if err != nil {
+		t.Fatalf("Could not create trace writer: %s", err)
+	}
+	for i := range records {
+		if err = wtr.Write(&records[i]); err != nil {
+			t.Fatalf("Could not write record %d: %s", i, err)
+		}
+	}
+	if err = wtr.Flush(); err != nil {
+		t.Fatalf("Could not flush trace: %s", err)
+	}
+
+	rdr, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Could not read trace: %s", err)
+	} else if actual := rdr.Header(); actual.Flags != hdr.Flags || actual.DeviceBytes != hdr.DeviceBytes || actual.BlockBytes != hdr.BlockBytes || !actual.Start.Equal(hdr.Start) {
+		t.Fatalf("Header %+v was read back as %+v", hdr, actual)
+	}
+	for i := range records {
+		var rec Record
+		if err = rdr.Next(&rec); err != nil {
+			t.Fatalf("Could not read record %d: %s", i, err)
+		}
+		expected := records[i]
+		if !bytes.Equal(rec.Payload, expected.Payload) {
+			t.Fatalf("Record %d payload %v was read back as %v", i, expected.Payload, rec.Payload)
+		}
+		rec.Payload, expected.Payload = nil, nil
+		if !reflect.DeepEqual(rec, expected) {
+			t.Fatalf("Record %d %+v was read back as %+v", i, expected, rec)
+		}
+	}
+	if err = rdr.Next(new(Record)); err != io.EOF {
+		t.Fatalf("Expected the end of the trace, found: %v", err)
+	}
+
+	if _, err = NewReader(bytes.NewReader(buf.Bytes()[1:])); !errors.Is(err, ErrBadTrace) {
+		t.Fatalf("Corrupt trace returned %v rather than %s", err, ErrBadTrace)
+	}
+	rdr, _ = NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	for err == nil {
+		err = rdr.Next(new(Record))
+	}
+	if !errors.Is(err, ErrBadTrace) {
+		t.Fatalf("Truncated trace returned %v rather than %s", err, ErrBadTrace)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	const sizeBytes = 4 * 1024 * 1024
+
+	//Record a random workload
+	var trace bytes.Buffer
+	dev := createDevice(t, sizeBytes, &trace, OptHashes(true), OptPayloads(true))
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		buf := make([]byte, 512*(1+rnd.Intn(64)))
+		pos := rnd.Int63n(sizeBytes-int64(len(buf))) &^ 511
+		switch rnd.Intn(10) {
+		case 0:
+			dev.Flush()
+		case 1, 2, 3:
+			dev.ReadAt(buf, pos)
+		default:
+			rnd.Read(buf)
+			dev.WriteAt(buf, pos)
+		}
+	}
+	original := make([]byte, sizeBytes)
+	dev.ReadAt(original, 0)
+	if err := dev.Close(); err != nil {
+		t.Fatalf("Could not close recording device: %s", err)
+	}
+
+	rdr, err := NewReader(bytes.NewReader(trace.Bytes()))
+	if err != nil {
+		t.Fatalf("Could not read trace: %s", err)
+	}
+	summary, err := Summarize(rdr)
+	if err != nil {
+		t.Fatalf("Could not summarize trace: %s", err)
+	} else if summary.All.Count != 501 || summary.ByOp[OpRead].Count+summary.ByOp[OpWrite].Count+summary.ByOp[OpFlush].Count != 501 {
+		t.Fatalf("Trace summary was not as expected: %+v", summary)
+	}
+
+	//Replaying it as fast as possible reproduces the device's contents
+	replica := ramdisk.NewRAMDisk(sizeBytes)
+	rdr, _ = NewReader(bytes.NewReader(trace.Bytes()))
+	report, err := Replay(context.Background(), replica, rdr, OptSpeed(0), OptConcurrency(1))
+	if err != nil {
+		t.Fatalf("Could not replay trace: %s", err)
+	} else if report.All.Count != summary.All.Count || report.All.Failed != 0 || report.All.Bytes != summary.All.Bytes {
+		t.Fatalf("Replay report %+v does not match trace summary %+v", report, summary)
+	}
+	t.Logf("Replay:\n%s", report)
+	actual := make([]byte, sizeBytes)
+	replica.ReadAt(actual, 0)
+	if xxhash.Sum64(actual) != xxhash.Sum64(original) {
+		t.Fatalf("Replayed device's contents do not match the original's")
+	}
+
+	//Writes can be skipped
+	rdr, _ = NewReader(bytes.NewReader(trace.Bytes()))
+	if report, err = Replay(context.Background(), replica, rdr, OptSpeed(0), OptSkipWrites(true)); err != nil {
+		t.Fatalf("Could not replay trace: %s", err)
+	} else if report.ByOp[OpWrite].Count != 0 || report.Skipped != summary.ByOp[OpWrite].Count {
+		t.Fatalf("Replay skipping writes performed %d and skipped %d", report.ByOp[OpWrite].Count, report.Skipped)
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	var trace bytes.Buffer
+	wtr, _ := NewWriter(&trace, Header{DeviceBytes: 4096, BlockBytes: 512, Start: time.Now()})
+	for i := 0; i < 5; i++ {
+		wtr.Write(&Record{Op: OpRead, Length: 512, Start: time.Duration(i) * 25 * time.Millisecond})
+	}
+	wtr.Flush()
+
+	for _, test := range []struct {
+		speed    float64
+		min, max time.Duration
+	}{{1, 100 * time.Millisecond, time.Second}, {4, 25 * time.Millisecond, 100 * time.Millisecond}, {0, 0, 25 * time.Millisecond}} {
+		rdr, _ := NewReader(bytes.NewReader(trace.Bytes()))
+		report, err := Replay(context.Background(), ramdisk.NewRAMDisk(4096), rdr, OptSpeed(test.speed))
+		switch {
+		case err != nil:
+			t.Fatalf("Could not replay trace: %s", err)
+		case report.Elapsed < test.min || report.Elapsed > test.max:
+			t.Fatalf("Replay at speed %g took %s, expected between %s and %s", test.speed, report.Elapsed, test.min, test.max)
+		}
+	}
+
+	//Replays can be cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	rdr, _ := NewReader(bytes.NewReader(trace.Bytes()))
+	if _, err := Replay(ctx, ramdisk.NewRAMDisk(4096), rdr); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Cancelled replay returned %v", err)
+	}
+}
+
+//barrierDev fails the test if a flush overlaps a write, writes are slow so they
+// overlap each other
+type barrierDev struct {
+	usbdlib.Device
+	t                             *testing.T
+	atomicWriting, atomicFlushing int32
+}
+
+func (dev *barrierDev) WriteAt(buf []byte, pos int64) (int, error) {
+	atomic.AddInt32(&dev.atomicWriting, 1)
+	defer atomic.AddInt32(&dev.atomicWriting, -1)
+	if atomic.LoadInt32(&dev.atomicFlushing) != 0 {
+		dev.t.Errorf("Write at %d started during a flush", pos)
+	}
+	time.Sleep(time.Millisecond)
+	return dev.Device.WriteAt(buf, pos)
+}
+
+func (dev *barrierDev) Flush() error {
+	atomic.AddInt32(&dev.atomicFlushing, 1)
+	defer atomic.AddInt32(&dev.atomicFlushing, -1)
+	if writing := atomic.LoadInt32(&dev.atomicWriting); writing != 0 {
+		dev.t.Errorf("Flush started with %d writes in progress", writing)
+	}
+	time.Sleep(time.Millisecond)
+	return dev.Device.Flush()
+}
+
+func TestReplayFlushBarrier(t *testing.T) {
+	var trace bytes.Buffer
+	wtr, _ := NewWriter(&trace, Header{DeviceBytes: 64 * 1024, BlockBytes: 512, Start: time.Now()})
+	for i := 0; i < 100; i++ {
+		op := OpWrite
+		if i%10 == 9 {
+			op = OpFlush
+		}
+		wtr.Write(&Record{Op: op, Offset: int64(i%128) * 512, Length: 512})
+	}
+	wtr.Flush()
+
+	rdr, _ := NewReader(bytes.NewReader(trace.Bytes()))
+	dev := &barrierDev{Device: ramdisk.NewRAMDisk(64 * 1024), t: t}
+	if report, err := Replay(context.Background(), dev, rdr, OptSpeed(0), OptConcurrency(8)); err != nil {
+		t.Fatalf("Could not replay trace: %s", err)
+	} else if report.ByOp[OpFlush].Count != 10 || report.All.Failed != 0 {
+		t.Fatalf("Replay report was not as expected: %+v", report)
+	}
+}
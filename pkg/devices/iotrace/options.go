@@ -0,0 +1,63 @@
+package iotrace
+
+//Option is a recorder option
+type Option interface {
+	apply(*Recorder)
+}
+
+//OptHashes instructs a Recorder to record the xxHash64 of the data of each read and
+// write, allowing replays to be checked against the original
+type OptHashes bool
+
+func (hashes OptHashes) apply(rec *Recorder) {
+	if hashes {
+		rec.flags |= FlagHashes
+	} else {
+		rec.flags &^= FlagHashes
+	}
+}
+
+//OptPayloads instructs a Recorder to record the data of each write so replays write
+// the same data, rather than generated data, at the cost of a trace as large as
+// all data written
+type OptPayloads bool
+
+func (payloads OptPayloads) apply(rec *Recorder) {
+	if payloads {
+		rec.flags |= FlagPayloads
+	} else {
+		rec.flags &^= FlagPayloads
+	}
+}
+
+//ReplayOption is an option of Replay
+type ReplayOption interface {
+	applyReplay(*replayer)
+}
+
+//OptSpeed instructs Replay to issue operations at this multiple of the speed they
+// were recorded at (ex. 1 is the original timing, 2 is twice as fast), or if not
+// positive as fast as possible; the default is 1
+type OptSpeed float64
+
+func (speed OptSpeed) applyReplay(rp *replayer) {
+	rp.speed = float64(speed)
+}
+
+//OptConcurrency instructs Replay to have at most this many operations in progress
+// at once; the default is 32. Operations are always issued in the order recorded.
+type OptConcurrency int
+
+func (concurrency OptConcurrency) applyReplay(rp *replayer) {
+	if concurrency > 0 {
+		rp.concurrency = int(concurrency)
+	}
+}
+
+//OptSkipWrites instructs Replay to skip writes and trims so traces can be replayed
+// against devices holding data that must be preserved
+type OptSkipWrites bool
+
+func (skip OptSkipWrites) applyReplay(rp *replayer) {
+	rp.skipWrites = bool(skip)
+}
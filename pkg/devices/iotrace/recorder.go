@@ -0,0 +1,218 @@
+package iotrace
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const errClosed = consterr.ConstErr("Device is shutdown")
+
+//Recorder wraps a device and records each operation passed to it in a trace: its
+// kind, range, start time, duration and whether it failed, and optionally the hash
+// of the data read or written and the data written. If writing the trace fails
+// recording stops, with a warning logged, but operations continue.
+type Recorder struct {
+	dev          usbdlib.Device
+	flags        Flags
+	atomicOnline uint64
+	ioMu         sync.RWMutex //Held exclusively to close
+	start        time.Time
+
+	traceMu  sync.Mutex
+	trace    *Writer
+	traceOut io.Writer
+	traceErr error
+	records  int64
+}
+
+var (
+	_ usbdlib.Device         = (*Recorder)(nil)
+	_ usbdlib.ReadOnlyDevice = (*Recorder)(nil)
+)
+
+//NewRecorder constructs a device recording the operations passed to the provided
+// device, which it owns and closes when closed, in a trace written to the provided
+// writer. The writer is closed when the device is closed if it is an io.Closer.
+func NewRecorder(dev usbdlib.Device, traceOut io.Writer, options ...Option) (*Recorder, error) {
+	rec := &Recorder{
+		dev:          dev,
+		atomicOnline: 1,
+		start:        time.Now(),
+		traceOut:     traceOut,
+	}
+	for _, opt := range options {
+		opt.apply(rec)
+	}
+
+	var err error
+	rec.trace, err = NewWriter(traceOut, Header{
+		Flags:       rec.flags,
+		DeviceBytes: dev.Size(),
+		BlockBytes:  dev.BlockSize(),
+		Start:       rec.start,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+//Size of this device in bytes
+func (rec *Recorder) Size() int64 {
+	return rec.dev.Size()
+}
+
+//BlockSize of this device is that of the wrapped device
+func (rec *Recorder) BlockSize() int64 {
+	return rec.dev.BlockSize()
+}
+
+//ReadOnly returns if the wrapped device is read-only, fulfilling
+// usbdlib.ReadOnlyDevice
+func (rec *Recorder) ReadOnly() bool {
+	return usbdlib.IsReadOnly(rec.dev)
+}
+
+//Records returns the number of operations recorded so far
+func (rec *Recorder) Records() int64 {
+	rec.traceMu.Lock()
+	defer rec.traceMu.Unlock()
+	return rec.records
+}
+
+//record adds an operation that began at the provided time to the trace
+func (rec *Recorder) record(op Op, pos, count int64, began time.Time, err error, data []byte) {
+	entry := Record{
+		Op:       op,
+		Offset:   pos,
+		Length:   count,
+		Start:    began.Sub(rec.start),
+		Duration: time.Since(began),
+		Failed:   err != nil,
+	}
+	if rec.flags&FlagHashes != 0 && data != nil {
+		entry.Hash = xxhash.Sum64(data)
+	}
+	if rec.flags&FlagPayloads != 0 && op == OpWrite {
+		entry.Payload = data
+	}
+
+	rec.traceMu.Lock()
+	defer rec.traceMu.Unlock()
+
+	if rec.traceErr != nil {
+		return
+	}
+	if rec.traceErr = rec.trace.Write(&entry); rec.traceErr != nil {
+		log.Printf("Recorder::record(): WARNING: Recording stopped after %d operations; Details: %s", rec.records, rec.traceErr)
+		return
+	}
+	rec.records++
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (rec *Recorder) ReadAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&rec.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	rec.ioMu.RLock()
+	defer rec.ioMu.RUnlock()
+
+	began := time.Now()
+	n, err := rec.dev.ReadAt(buf, pos)
+	data := buf[:0]
+	if n > 0 {
+		data = buf[:n]
+	}
+	rec.record(OpRead, pos, int64(len(buf)), began, err, data)
+	return n, err
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (rec *Recorder) WriteAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&rec.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	rec.ioMu.RLock()
+	defer rec.ioMu.RUnlock()
+
+	began := time.Now()
+	n, err := rec.dev.WriteAt(buf, pos)
+	rec.record(OpWrite, pos, int64(len(buf)), began, err, buf)
+	return n, err
+}
+
+//Trim fufills part of usbdlib.Device
+func (rec *Recorder) Trim(pos int64, count int) error {
+	if atomic.LoadUint64(&rec.atomicOnline) != 1 {
+		return errClosed
+	}
+	rec.ioMu.RLock()
+	defer rec.ioMu.RUnlock()
+
+	began := time.Now()
+	err := rec.dev.Trim(pos, count)
+	rec.record(OpTrim, pos, int64(count), began, err, nil)
+	return err
+}
+
+//Flush fufills part of usbdlib.Device, it also flushes the trace
+func (rec *Recorder) Flush() error {
+	if atomic.LoadUint64(&rec.atomicOnline) != 1 {
+		return errClosed
+	}
+	rec.ioMu.RLock()
+	defer rec.ioMu.RUnlock()
+
+	began := time.Now()
+	err := rec.dev.Flush()
+	rec.record(OpFlush, 0, 0, began, err, nil)
+
+	rec.traceMu.Lock()
+	defer rec.traceMu.Unlock()
+	if rec.traceErr == nil {
+		if rec.traceErr = rec.trace.Flush(); rec.traceErr != nil {
+			log.Printf("Recorder::Flush(): WARNING: Recording stopped after %d operations; Details: %s", rec.records, rec.traceErr)
+		}
+	}
+	return err
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device, it completes the trace
+func (rec *Recorder) Close() error {
+	if !atomic.CompareAndSwapUint64(&rec.atomicOnline, 1, 0) {
+		return errClosed
+	}
+	rec.ioMu.Lock() //Wait for outstanding IO
+	defer rec.ioMu.Unlock()
+
+	err := rec.dev.Close()
+
+	rec.traceMu.Lock()
+	defer rec.traceMu.Unlock()
+	traceErr := rec.traceErr
+	if traceErr == nil {
+		traceErr = rec.trace.Flush()
+	}
+	if closer, isCloser := rec.traceOut.(io.Closer); isCloser {
+		if closeErr := closer.Close(); traceErr == nil {
+			traceErr = closeErr
+		}
+	}
+	switch {
+	case err != nil:
+		return err
+	case traceErr != nil:
+		return fmt.Errorf("Trace of %d operations is incomplete: %w", rec.records, traceErr)
+	}
+	return nil
+}
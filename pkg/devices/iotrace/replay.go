@@ -0,0 +1,281 @@
+package iotrace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+
+	"github.com/dustin/go-humanize"
+)
+
+//maxOpBytes bounds the length of the reads and writes replayed
+const maxOpBytes = maxPayloadBytes
+
+//Latency summarizes the latencies of a set of operations
+type Latency struct {
+	Mean, P50, P90, P99, P999, Max time.Duration
+}
+
+//OpReport summarizes a kind of operation replayed or recorded
+type OpReport struct {
+	Count, Failed, Bytes int64
+	Latency              Latency
+}
+
+//Report summarizes the operations replayed, or recorded in a trace
+type Report struct {
+	Elapsed time.Duration
+	Skipped int64
+	All     OpReport
+	ByOp    [numOps]OpReport //Indexed by Op
+}
+
+//IOPS returns the number of operations per second
+func (rep *Report) IOPS() float64 {
+	if rep.Elapsed <= 0 {
+		return 0
+	}
+	return float64(rep.All.Count) / rep.Elapsed.Seconds()
+}
+
+//BytesPerSecond returns the number of bytes read and written per second
+func (rep *Report) BytesPerSecond() float64 {
+	if rep.Elapsed <= 0 {
+		return 0
+	}
+	return float64(rep.ByOp[OpRead].Bytes+rep.ByOp[OpWrite].Bytes) / rep.Elapsed.Seconds()
+}
+
+//String generates a human-readable table of the report
+func (rep *Report) String() string {
+	var str strings.Builder
+	fmt.Fprintf(&str, "%d operations in %s: %.1f IOPS, %s/s", rep.All.Count, rep.Elapsed.Round(time.Millisecond), rep.IOPS(), humanize.IBytes(uint64(rep.BytesPerSecond())))
+	if rep.Skipped > 0 {
+		fmt.Fprintf(&str, ", %d skipped", rep.Skipped)
+	}
+	fmt.Fprintf(&str, "\n%-6s %10s %8s %10s %10s %10s %10s %10s %10s %10s\n", "op", "count", "failed", "bytes", "mean", "p50", "p90", "p99", "p99.9", "max")
+	for op := Op(0); op < numOps; op++ {
+		opRep := &rep.ByOp[op]
+		if opRep.Count == 0 {
+			continue
+		}
+		lat := &opRep.Latency
+		fmt.Fprintf(&str, "%-6s %10d %8d %10s %10s %10s %10s %10s %10s %10s\n", op, opRep.Count, opRep.Failed, humanize.IBytes(uint64(opRep.Bytes)),
+			fmtLatency(lat.Mean), fmtLatency(lat.P50), fmtLatency(lat.P90), fmtLatency(lat.P99), fmtLatency(lat.P999), fmtLatency(lat.Max),
+		)
+	}
+	return str.String()
+}
+
+func fmtLatency(dur time.Duration) string {
+	return dur.Round(time.Microsecond).String()
+}
+
+//reportBuilder accumulates the operations of a Report, it is not safe for
+// concurrent use
+type reportBuilder struct {
+	report    Report
+	latencies [numOps][]time.Duration
+}
+
+func (bld *reportBuilder) add(op Op, bytes int64, latency time.Duration, failed bool) {
+	opRep := &bld.report.ByOp[op]
+	opRep.Count++
+	if failed {
+		opRep.Failed++
+	} else if op == OpRead || op == OpWrite {
+		opRep.Bytes += bytes
+	}
+	bld.latencies[op] = append(bld.latencies[op], latency)
+}
+
+func (bld *reportBuilder) build(elapsed time.Duration) *Report {
+	rep := &bld.report
+	rep.Elapsed = elapsed
+
+	var all []time.Duration
+	for op := range bld.latencies {
+		rep.ByOp[op].Latency = summarize(bld.latencies[op])
+		rep.All.Count += rep.ByOp[op].Count
+		rep.All.Failed += rep.ByOp[op].Failed
+		rep.All.Bytes += rep.ByOp[op].Bytes
+		all = append(all, bld.latencies[op]...)
+	}
+	rep.All.Latency = summarize(all)
+	return rep
+}
+
+//summarize sorts the provided latencies and returns their summary
+func summarize(latencies []time.Duration) Latency {
+	if len(latencies) == 0 {
+		return Latency{}
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+	percentile := func(pct float64) time.Duration {
+		return latencies[int(pct*float64(len(latencies)-1))]
+	}
+	return Latency{
+		Mean: total / time.Duration(len(latencies)),
+		P50:  percentile(0.5),
+		P90:  percentile(0.9),
+		P99:  percentile(0.99),
+		P999: percentile(0.999),
+		Max:  latencies[len(latencies)-1],
+	}
+}
+
+//Summarize reads the rest of a trace and returns a report of the operations it
+// recorded, their timing as originally observed
+func Summarize(trace *Reader) (*Report, error) {
+	var bld reportBuilder
+	var rec Record
+	var end time.Duration
+	for {
+		if err := trace.Next(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		bld.add(rec.Op, rec.Length, rec.Duration, rec.Failed)
+		if recEnd := rec.Start + rec.Duration; recEnd > end {
+			end = recEnd
+		}
+	}
+	return bld.build(end), nil
+}
+
+//replayer holds the state of a Replay
+type replayer struct {
+	dev         usbdlib.Device
+	speed       float64
+	concurrency int
+	skipWrites  bool
+
+	mu  sync.Mutex
+	bld reportBuilder
+}
+
+//Replay issues the operations of the rest of a trace to the provided device, in the
+// order they were recorded, and returns a report of their latencies and
+// throughput. Operations are timed as recorded, scaled by OptSpeed, but may be
+// delayed by reaching the limit on operations in progress set by OptConcurrency.
+// Flushes are barriers: each waits for the operations in progress to complete and
+// those after it start once it completes, so data is flushed as it was recorded.
+// Writes use the data recorded if the trace has payloads, otherwise data generated
+// deterministically from their position in the trace, so replays are repeatable.
+// Operations that fail are counted in the report rather than stopping the replay.
+func Replay(ctx context.Context, dev usbdlib.Device, trace *Reader, options ...ReplayOption) (*Report, error) {
+	rp := &replayer{dev: dev, speed: 1, concurrency: 32}
+	for _, opt := range options {
+		opt.applyReplay(rp)
+	}
+
+	slots := make(chan struct{}, rp.concurrency)
+	var pending sync.WaitGroup
+	defer pending.Wait()
+
+	began := time.Now()
+	for idx := int64(0); ; idx++ {
+		var rec Record //Not reused as each is issued concurrently
+		if err := trace.Next(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not read operation %d of trace: %w", idx, err)
+		}
+		if rp.skipWrites && (rec.Op == OpWrite || rec.Op == OpTrim) {
+			rp.mu.Lock()
+			rp.bld.report.Skipped++
+			rp.mu.Unlock()
+			continue
+		}
+
+		if rp.speed > 0 {
+			if wait := time.Until(began.Add(time.Duration(float64(rec.Start) / rp.speed))); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, ctx.Err()
+				}
+			}
+		}
+		if rec.Op == OpFlush {
+			pending.Wait()
+			rp.issue(&rec, idx)
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		pending.Add(1)
+		go func(rec *Record, idx int64) {
+			defer func() {
+				<-slots
+				pending.Done()
+			}()
+			rp.issue(rec, idx)
+		}(&rec, idx)
+	}
+	pending.Wait()
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.bld.build(time.Since(began)), nil
+}
+
+//issue performs a recorded operation and adds its latency to the report
+func (rp *replayer) issue(rec *Record, idx int64) {
+	if (rec.Op == OpRead || rec.Op == OpWrite) && (rec.Length < 0 || rec.Length > maxOpBytes) {
+		rp.mu.Lock()
+		rp.bld.add(rec.Op, rec.Length, 0, true)
+		rp.mu.Unlock()
+		return
+	}
+
+	var buf []byte
+	switch {
+	case rec.Op == OpWrite && rec.Payload != nil:
+		buf = rec.Payload
+	case rec.Op == OpWrite:
+		buf = make([]byte, rec.Length)
+		rand.New(rand.NewSource(idx)).Read(buf)
+	case rec.Op == OpRead:
+		buf = make([]byte, rec.Length)
+	}
+
+	var err error
+	start := time.Now()
+	switch rec.Op {
+	case OpRead:
+		_, err = rp.dev.ReadAt(buf, rec.Offset)
+	case OpWrite:
+		_, err = rp.dev.WriteAt(buf, rec.Offset)
+	case OpTrim:
+		err = rp.dev.Trim(rec.Offset, int(rec.Length))
+	case OpFlush:
+		err = rp.dev.Flush()
+	}
+	latency := time.Since(start)
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.bld.add(rec.Op, rec.Length, latency, err != nil)
+}
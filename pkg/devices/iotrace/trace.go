@@ -0,0 +1,255 @@
+package iotrace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	traceMagic   = "USBDTRC1"
+	traceVersion = 1
+
+	//ErrBadTrace is wrapped by the errors of traces that can not be decoded
+	ErrBadTrace = consterr.ConstErr("Invalid trace")
+)
+
+//Op is a kind of device operation
+type Op uint8
+
+const (
+	//OpRead is a ReadAt
+	OpRead Op = iota
+	//OpWrite is a WriteAt
+	OpWrite
+	//OpTrim is a Trim
+	OpTrim
+	//OpFlush is a Flush
+	OpFlush
+
+	numOps
+)
+
+var opNames = [numOps]string{"read", "write", "trim", "flush"}
+
+func (op Op) String() string {
+	if op < numOps {
+		return opNames[op]
+	}
+	return "unknown"
+}
+
+//Flags describe what a trace records beyond each operation's kind, range and
+// timing
+type Flags uint8
+
+const (
+	//FlagHashes records the xxHash64 of the data read or written
+	FlagHashes Flags = 1 << iota
+	//FlagPayloads records the data written, allowing exact replay of writes
+	FlagPayloads
+)
+
+//Header describes a trace
+type Header struct {
+	Flags       Flags
+	DeviceBytes int64
+	BlockBytes  int64
+	Start       time.Time //When the trace began, records are timed relative to it
+}
+
+//Record is an operation in a trace
+type Record struct {
+	Op       Op
+	Offset   int64
+	Length   int64
+	Start    time.Duration //Since the trace began
+	Duration time.Duration
+	Failed   bool
+	Hash     uint64 //If the trace has FlagHashes and the operation is a read or write
+	Payload  []byte //If the trace has FlagPayloads and the operation is a write, otherwise nil
+}
+
+const (
+	recOpMask     = 0x07
+	recFailed     = 0x08
+	recHasHash    = 0x10
+	recHasPayload = 0x20
+)
+
+//Writer encodes a trace. Each record is a byte holding its op and flags followed by
+// varints of its start relative to the previous record's start, offset, length and
+// duration, then its hash and payload if present.
+type Writer struct {
+	wtr       *bufio.Writer
+	flags     Flags
+	lastStart time.Duration
+	scratch   [1 + 4*binary.MaxVarintLen64 + 8]byte
+}
+
+//NewWriter writes the provided header and returns a Writer encoding records after
+// it
+func NewWriter(wtr io.Writer, hdr Header) (*Writer, error) {
+	tw := &Writer{wtr: bufio.NewWriterSize(wtr, 256*1024), flags: hdr.Flags}
+
+	buf := append(tw.scratch[:0], traceMagic...)
+	buf = append(buf, traceVersion, byte(hdr.Flags))
+	for _, field := range []int64{hdr.DeviceBytes, hdr.BlockBytes, hdr.Start.UnixNano()} {
+		buf = buf[:len(buf)+binary.PutVarint(buf[len(buf):cap(buf)], field)]
+	}
+	if _, err := tw.wtr.Write(buf); err != nil {
+		return nil, fmt.Errorf("Could not write trace header: %w", err)
+	}
+	return tw, nil
+}
+
+//Write encodes a record, it is not safe for concurrent use. The hash and payload
+// of the record are only written if the trace's flags include them.
+func (tw *Writer) Write(rec *Record) error {
+	hasHash := tw.flags&FlagHashes != 0 && (rec.Op == OpRead || rec.Op == OpWrite)
+	hasPayload := tw.flags&FlagPayloads != 0 && rec.Op == OpWrite && rec.Payload != nil
+
+	flags := byte(rec.Op) & recOpMask
+	if rec.Failed {
+		flags |= recFailed
+	}
+	if hasHash {
+		flags |= recHasHash
+	}
+	if hasPayload {
+		flags |= recHasPayload
+	}
+
+	buf := tw.scratch[:]
+	buf[0] = flags
+	n := 1
+	n += binary.PutVarint(buf[n:], int64(rec.Start-tw.lastStart))
+	n += binary.PutUvarint(buf[n:], uint64(rec.Offset))
+	n += binary.PutUvarint(buf[n:], uint64(rec.Length))
+	n += binary.PutUvarint(buf[n:], uint64(rec.Duration))
+	if hasHash {
+		binary.LittleEndian.PutUint64(buf[n:], rec.Hash)
+		n += 8
+	}
+	tw.lastStart = rec.Start
+
+	if _, err := tw.wtr.Write(buf[:n]); err != nil {
+		return fmt.Errorf("Could not write trace record: %w", err)
+	}
+	if hasPayload {
+		if _, err := tw.wtr.Write(rec.Payload); err != nil {
+			return fmt.Errorf("Could not write trace record payload: %w", err)
+		}
+	}
+	return nil
+}
+
+//Flush writes any buffered records to the underlying writer
+func (tw *Writer) Flush() error {
+	if err := tw.wtr.Flush(); err != nil {
+		return fmt.Errorf("Could not flush trace: %w", err)
+	}
+	return nil
+}
+
+//Reader decodes a trace
+type Reader struct {
+	rdr       *bufio.Reader
+	hdr       Header
+	lastStart time.Duration
+}
+
+//NewReader reads the header of a trace and returns a Reader decoding the records
+// after it
+func NewReader(rdr io.Reader) (*Reader, error) {
+	tr := &Reader{rdr: bufio.NewReaderSize(rdr, 256*1024)}
+
+	prefix := make([]byte, len(traceMagic)+2)
+	if _, err := io.ReadFull(tr.rdr, prefix); err != nil {
+		return nil, fmt.Errorf("Could not read trace header: %w", err)
+	} else if string(prefix[:len(traceMagic)]) != traceMagic {
+		return nil, fmt.Errorf("%w: Not a trace", ErrBadTrace)
+	} else if version := prefix[len(traceMagic)]; version != traceVersion {
+		return nil, fmt.Errorf("%w: Unsupported version %d", ErrBadTrace, version)
+	}
+	tr.hdr.Flags = Flags(prefix[len(traceMagic)+1])
+
+	var fields [3]int64
+	for i := range fields {
+		var err error
+		if fields[i], err = binary.ReadVarint(tr.rdr); err != nil {
+			return nil, fmt.Errorf("%w: Could not read header: %s", ErrBadTrace, err)
+		}
+	}
+	tr.hdr.DeviceBytes, tr.hdr.BlockBytes, tr.hdr.Start = fields[0], fields[1], time.Unix(0, fields[2])
+	return tr, nil
+}
+
+//Header returns the header of the trace
+func (tr *Reader) Header() Header {
+	return tr.hdr
+}
+
+//Next decodes the next record into the provided one, returning io.EOF at the end
+// of the trace. Its payload is reused if large enough.
+func (tr *Reader) Next(rec *Record) error {
+	flags, err := tr.rdr.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return fmt.Errorf("Could not read trace record: %w", err)
+	}
+	if Op(flags&recOpMask) >= numOps {
+		return fmt.Errorf("%w: Unknown op %d", ErrBadTrace, flags&recOpMask)
+	}
+
+	startDelta, err := binary.ReadVarint(tr.rdr)
+	var fields [3]uint64
+	for i := 0; i < len(fields) && err == nil; i++ {
+		fields[i], err = binary.ReadUvarint(tr.rdr)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: Truncated record: %s", ErrBadTrace, err)
+	}
+
+	payload := rec.Payload
+	*rec = Record{
+		Op:       Op(flags & recOpMask),
+		Offset:   int64(fields[0]),
+		Length:   int64(fields[1]),
+		Start:    tr.lastStart + time.Duration(startDelta),
+		Duration: time.Duration(fields[2]),
+		Failed:   flags&recFailed != 0,
+	}
+	tr.lastStart = rec.Start
+
+	if flags&recHasHash != 0 {
+		var hash [8]byte
+		if _, err = io.ReadFull(tr.rdr, hash[:]); err != nil {
+			return fmt.Errorf("%w: Truncated record hash: %s", ErrBadTrace, err)
+		}
+		rec.Hash = binary.LittleEndian.Uint64(hash[:])
+	}
+	if flags&recHasPayload != 0 {
+		if rec.Length < 0 || rec.Length > maxPayloadBytes {
+			return fmt.Errorf("%w: Record payload of %d bytes is too large", ErrBadTrace, rec.Length)
+		}
+		if int64(cap(payload)) < rec.Length {
+			payload = make([]byte, rec.Length)
+		}
+		rec.Payload = payload[:rec.Length]
+		if _, err = io.ReadFull(tr.rdr, rec.Payload); err != nil {
+			return fmt.Errorf("%w: Truncated record payload: %s", ErrBadTrace, err)
+		}
+	}
+	return nil
+}
+
+//maxPayloadBytes bounds the payload of a record read to protect against corrupt
+// traces
+const maxPayloadBytes = 64 * 1024 * 1024
@@ -0,0 +1,159 @@
+package migrate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+//ControlRequest changes or queries the state of a Migration. Sent to a control
+// socket it is encoded as JSON, for example:
+//	{"cmd": "status"}
+//	{"cmd": "rate", "rate": 104857600}
+//	{"cmd": "cancel"}
+type ControlRequest struct {
+	//Cmd is one of "status", "pause", "resume", "rate" or "cancel"
+	Cmd  string `json:"cmd"`
+	Rate int64  `json:"rate,omitempty"` //For rate, bytes per second or 0 for unlimited
+}
+
+//ControlResponse is the progress of a Migration after a ControlRequest
+type ControlResponse struct {
+	Error string `json:"error,omitempty"`
+	Progress
+}
+
+//Control applies a request to the migration and returns its resulting progress
+func (mdev *Migration) Control(req ControlRequest) (resp ControlResponse) {
+	var err error
+	switch req.Cmd {
+	case "status":
+	case "pause":
+		err = mdev.Pause()
+	case "resume":
+		err = mdev.Resume()
+	case "rate":
+		err = mdev.SetRate(req.Rate)
+	case "cancel":
+		err = mdev.Cancel()
+	default:
+		err = fmt.Errorf("Unknown command %q", req.Cmd)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Progress = mdev.Progress()
+	return resp
+}
+
+//ListenAndServeControl listens on the provided network address (ex. "unix",
+// "/run/migrate.sock") and serves control requests until the device is closed
+func (mdev *Migration) ListenAndServeControl(network, addr string) error {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("Could not listen on %s %q: %w", network, addr, err)
+	}
+	return mdev.ServeControl(ln)
+}
+
+//ServeControl accepts connections on the provided listener and serves control
+// requests until the device is closed. Each connection sends a stream of JSON
+// encoded ControlRequests and receives a line of JSON encoded ControlResponse
+// for each.
+func (mdev *Migration) ServeControl(ln net.Listener) error {
+	mdev.ctlMu.Lock()
+	if atomic.LoadUint64(&mdev.atomicOnline) != 1 {
+		mdev.ctlMu.Unlock()
+		ln.Close()
+		return errClosed
+	}
+	mdev.listeners[ln] = struct{}{}
+	mdev.ctlMu.Unlock()
+
+	defer func() {
+		mdev.ctlMu.Lock()
+		delete(mdev.listeners, ln)
+		mdev.ctlMu.Unlock()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if atomic.LoadUint64(&mdev.atomicOnline) != 1 {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				continue
+			}
+			return fmt.Errorf("Could not accept connection: %w", err)
+		}
+
+		mdev.ctlMu.Lock()
+		if atomic.LoadUint64(&mdev.atomicOnline) != 1 {
+			mdev.ctlMu.Unlock()
+			conn.Close()
+			return nil
+		}
+		mdev.conns[conn] = struct{}{}
+		mdev.connWg.Add(1)
+		mdev.ctlMu.Unlock()
+
+		go func() {
+			defer func() {
+				conn.Close()
+				mdev.ctlMu.Lock()
+				delete(mdev.conns, conn)
+				mdev.ctlMu.Unlock()
+				mdev.connWg.Done()
+			}()
+
+			if err := mdev.serveControlConn(conn); err != nil && atomic.LoadUint64(&mdev.atomicOnline) == 1 {
+				log.Printf("Migration::ServeControl(): WARNING: Connection from %s terminated; Details: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (mdev *Migration) serveControlConn(conn net.Conn) error {
+	dec, enc := json.NewDecoder(conn), json.NewEncoder(conn)
+	for {
+		var req ControlRequest
+		var resp ControlResponse
+		if err := dec.Decode(&req); err != nil {
+			var syntaxErr *json.SyntaxError
+			switch {
+			case err == io.EOF:
+				return nil
+			case errors.As(err, &syntaxErr) || err == io.ErrUnexpectedEOF:
+				//The stream can not be resumed, report the error before giving up
+				enc.Encode(ControlResponse{Error: fmt.Sprintf("Could not decode request: %s", err)})
+				return fmt.Errorf("Could not decode request: %w", err)
+			}
+			resp = ControlResponse{Error: fmt.Sprintf("Could not decode request: %s", err), Progress: mdev.Progress()}
+		} else {
+			resp = mdev.Control(req)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return fmt.Errorf("Could not send response: %w", err)
+		}
+	}
+}
+
+//closeControl stops serving control sockets, the device must already be offline
+func (mdev *Migration) closeControl() {
+	mdev.ctlMu.Lock()
+	for ln := range mdev.listeners {
+		ln.Close()
+	}
+	for conn := range mdev.conns {
+		conn.Close()
+	}
+	mdev.ctlMu.Unlock()
+	mdev.connWg.Wait()
+}
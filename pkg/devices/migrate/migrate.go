@@ -0,0 +1,653 @@
+package migrate
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/bitmap"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed = consterr.ConstErr("Device is shutdown")
+
+	//DefRegionBytes is the default size of the regions copied one at a time
+	DefRegionBytes = 1024 * 1024
+
+	lockStripes = 64
+)
+
+//State of a migration
+type State string
+
+const (
+	//StateCopying is a migration copying the source to the destination
+	StateCopying State = "copying"
+	//StatePaused is a migration whose copying was paused; writes are still sent to
+	// both devices
+	StatePaused State = "paused"
+	//StateSwitched is a completed migration, all IO is sent to the destination
+	StateSwitched State = "switched"
+	//StateCanceled is a migration canceled before it completed, all IO is sent to
+	// the source
+	StateCanceled State = "canceled"
+	//StateFailed is a migration abandoned after IO to the destination failed, all IO
+	// is sent to the source
+	StateFailed State = "failed"
+)
+
+//Progress describes the state of a migration
+type Progress struct {
+	State       State `json:"state"`
+	Bytes       int64 `json:"bytes"`       //To copy
+	CopiedBytes int64 `json:"copiedBytes"` //Copied so far
+	Rate        int64 `json:"rate"`        //Bytes per second copying is limited to, 0 if unlimited
+	//Throughput is the average bytes per second copied while not paused
+	Throughput int64 `json:"throughput"`
+	//Elapsed is the time spent copying while not paused, in nanoseconds when encoded
+	Elapsed time.Duration `json:"elapsed"`
+	//Remaining is the estimated time until the copy completes at the current
+	// throughput, in nanoseconds when encoded
+	Remaining time.Duration `json:"remaining"`
+	Failure   string        `json:"failure,omitempty"` //Why the migration failed
+}
+
+//Migration is a device that moves its contents from a source device to a
+// destination device while in use. Regions of the source are copied to the
+// destination in the background, at a rate that may be limited, while writes are
+// sent to both devices. Reads of regions already copied are served by the
+// destination. Once every region is copied all IO is atomically switched to the
+// destination and the source is closed. Until then the source remains complete,
+// so the migration may be canceled, or abandoned if the destination fails,
+// without loss. Progress is not persisted; a migration interrupted by closing the
+// device must be started over.
+type Migration struct {
+	src, dst     usbdlib.Device
+	size         int64
+	blockSize    int64
+	regionBytes  int64
+	regions      int64
+	readOnly     bool
+	onSwitch     func()
+	atomicOnline uint64
+	ioMu         sync.RWMutex //Held exclusively to close
+	routeMu      sync.RWMutex //Held exclusively to change which devices IO is sent to
+	regionLocks  [lockStripes]sync.Mutex
+	closing      chan struct{} //Closed to stop copying
+	copyDone     chan struct{} //Closed when copying stops
+	dstOnce      sync.Once     //Closes the destination once abandoned
+
+	mu          sync.Mutex
+	state       State
+	copied      *bitmap.Bitmap //Regions copied
+	copiedBytes int64
+	rate        int64
+	paceStart   time.Time //Since when paceBytes were copied at the current rate
+	paceBytes   int64
+	activeSince time.Time //When copying was last started or resumed
+	activeTime  time.Duration
+	err         error
+	wake        chan struct{} //Closed and replaced when the state or rate changes
+
+	ctlMu     sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	connWg    sync.WaitGroup
+}
+
+var (
+	_ usbdlib.Device         = (*Migration)(nil)
+	_ usbdlib.ReadOnlyDevice = (*Migration)(nil)
+)
+
+//NewMigration constructs a device migrating the contents of the source device to
+// the destination device, which must be at least as large, and starts copying.
+// The migration owns both devices: the source is closed once IO is switched to
+// the destination and the destination is closed if the migration is canceled or
+// fails.
+func NewMigration(src, dst usbdlib.Device, options ...Option) (*Migration, error) {
+	mdev := &Migration{
+		src:          src,
+		dst:          dst,
+		size:         src.Size(),
+		blockSize:    src.BlockSize(),
+		regionBytes:  DefRegionBytes,
+		readOnly:     usbdlib.IsReadOnly(src),
+		atomicOnline: 1,
+		closing:      make(chan struct{}),
+		copyDone:     make(chan struct{}),
+		state:        StateCopying,
+		wake:         make(chan struct{}),
+		listeners:    make(map[net.Listener]struct{}),
+		conns:        make(map[net.Conn]struct{}),
+	}
+	for _, opt := range options {
+		opt.apply(mdev)
+	}
+
+	switch {
+	case dst.Size() < mdev.size:
+		return nil, fmt.Errorf("Destination device of %d bytes is smaller than the %d byte source device", dst.Size(), mdev.size)
+	case usbdlib.IsReadOnly(dst):
+		return nil, fmt.Errorf("Destination device is read-only")
+	case mdev.regionBytes < 1:
+		return nil, fmt.Errorf("Region size must be at least one byte")
+	case mdev.rate < 0:
+		return nil, fmt.Errorf("Copy rate can not be negative")
+	}
+	if dst.BlockSize() > mdev.blockSize {
+		mdev.blockSize = dst.BlockSize()
+	}
+	mdev.regions = (mdev.size + mdev.regionBytes - 1) / mdev.regionBytes
+	mdev.copied = bitmap.New(mdev.regions)
+
+	now := time.Now()
+	mdev.paceStart = now
+	if mdev.state == StateCopying {
+		mdev.activeSince = now
+	}
+	go mdev.copy()
+	return mdev, nil
+}
+
+//Size of this device in bytes, that of the source device
+func (mdev *Migration) Size() int64 {
+	return mdev.size
+}
+
+//BlockSize of this device is the larger of that of the source and destination
+func (mdev *Migration) BlockSize() int64 {
+	return mdev.blockSize
+}
+
+//ReadOnly returns if the source device is read-only, fulfilling
+// usbdlib.ReadOnlyDevice
+func (mdev *Migration) ReadOnly() bool {
+	return mdev.readOnly
+}
+
+//Progress returns the current state of the migration
+func (mdev *Migration) Progress() Progress {
+	mdev.mu.Lock()
+	defer mdev.mu.Unlock()
+
+	progress := Progress{
+		State:       mdev.state,
+		Bytes:       mdev.size,
+		CopiedBytes: mdev.copiedBytes,
+		Rate:        mdev.rate,
+		Elapsed:     mdev.activeTime,
+	}
+	if mdev.state == StateCopying {
+		progress.Elapsed += time.Since(mdev.activeSince)
+	}
+	if progress.Elapsed > 0 {
+		progress.Throughput = int64(float64(progress.CopiedBytes) / progress.Elapsed.Seconds())
+	}
+	if remaining := progress.Bytes - progress.CopiedBytes; remaining > 0 && progress.Throughput > 0 {
+		progress.Remaining = time.Duration(float64(remaining) / float64(progress.Throughput) * float64(time.Second))
+	}
+	if mdev.err != nil {
+		progress.Failure = mdev.err.Error()
+	}
+	return progress
+}
+
+//Done returns a channel that is closed when the migration stops copying because
+// it switched to the destination, was canceled, failed or the device was closed
+func (mdev *Migration) Done() <-chan struct{} {
+	return mdev.copyDone
+}
+
+//Pause stops copying, writes are still sent to both devices
+func (mdev *Migration) Pause() error {
+	mdev.mu.Lock()
+	defer mdev.mu.Unlock()
+
+	switch mdev.state {
+	case StatePaused:
+		return nil
+	case StateCopying:
+		mdev.activeTime += time.Since(mdev.activeSince)
+		mdev.setState(StatePaused)
+		return nil
+	}
+	return fmt.Errorf("Can not pause a migration that has %s", mdev.state)
+}
+
+//Resume continues copying after Pause
+func (mdev *Migration) Resume() error {
+	mdev.mu.Lock()
+	defer mdev.mu.Unlock()
+
+	switch mdev.state {
+	case StateCopying:
+		return nil
+	case StatePaused:
+		mdev.activeSince = time.Now()
+		mdev.setState(StateCopying)
+		return nil
+	}
+	return fmt.Errorf("Can not resume a migration that has %s", mdev.state)
+}
+
+//SetRate limits copying to the provided bytes per second, or removes the limit if
+// 0. Writes sent to both devices are not limited.
+func (mdev *Migration) SetRate(bytesPerSec int64) error {
+	if bytesPerSec < 0 {
+		return fmt.Errorf("Copy rate can not be negative")
+	}
+	mdev.mu.Lock()
+	defer mdev.mu.Unlock()
+
+	mdev.rate = bytesPerSec
+	mdev.setState(mdev.state)
+	return nil
+}
+
+//Cancel stops the migration before it completes: all IO is sent to the source and
+// the destination is closed. A migration that has already switched to the
+// destination can not be canceled.
+func (mdev *Migration) Cancel() error {
+	mdev.mu.Lock()
+	switch mdev.state {
+	case StateSwitched:
+		mdev.mu.Unlock()
+		return fmt.Errorf("Migration has already switched to the destination")
+	case StateCopying, StatePaused:
+		if mdev.state == StateCopying {
+			mdev.activeTime += time.Since(mdev.activeSince)
+		}
+		mdev.setState(StateCanceled)
+		log.Printf("Migration::Cancel(): Migration canceled after copying %d of %d bytes", mdev.copiedBytes, mdev.size)
+	}
+	mdev.mu.Unlock()
+
+	<-mdev.copyDone
+	mdev.abandonDst()
+	return nil
+}
+
+//setState changes the state and wakes the copier, mu must be held
+func (mdev *Migration) setState(state State) {
+	mdev.state = state
+	mdev.paceStart, mdev.paceBytes = time.Now(), 0
+	close(mdev.wake)
+	mdev.wake = make(chan struct{})
+}
+
+//fail abandons the migration after the destination failed
+func (mdev *Migration) fail(err error) {
+	mdev.mu.Lock()
+	defer mdev.mu.Unlock()
+
+	if mdev.state != StateCopying && mdev.state != StatePaused {
+		return
+	}
+	if mdev.state == StateCopying {
+		mdev.activeTime += time.Since(mdev.activeSince)
+	}
+	log.Printf("Migration::fail(): WARNING: Migration abandoned, IO is sent to the source only; Details: %s", err)
+	mdev.err = err
+	mdev.setState(StateFailed)
+	go func() {
+		<-mdev.copyDone
+		mdev.abandonDst()
+	}()
+}
+
+//abandonDst closes the destination once IO is no longer sent to it
+func (mdev *Migration) abandonDst() {
+	mdev.dstOnce.Do(func() {
+		mdev.routeMu.Lock() //Wait for outstanding IO
+		mdev.routeMu.Unlock()
+		if err := mdev.dst.Close(); err != nil {
+			log.Printf("Migration::abandonDst(): WARNING: Could not close destination; Details: %s", err)
+		}
+	})
+}
+
+//route returns the state IO should be sent based on, routeMu must be held
+func (mdev *Migration) route() State {
+	mdev.mu.Lock()
+	defer mdev.mu.Unlock()
+	return mdev.state
+}
+
+//lockRange exclusively locks the regions overlapping the provided range, so that
+// copying and writes of a region never interleave and overlapping writes are
+// applied to both devices in the same order
+func (mdev *Migration) lockRange(pos, count int64) (unlock func()) {
+	first, last := pos/mdev.regionBytes, (pos+count-1)/mdev.regionBytes
+	if last < first {
+		last = first
+	}
+	var stripes []int
+	if last-first+1 >= lockStripes {
+		for i := 0; i < lockStripes; i++ {
+			stripes = append(stripes, i)
+		}
+	} else {
+		for region := first; region <= last; region++ {
+			stripes = append(stripes, int(region%lockStripes))
+		}
+		sort.Ints(stripes) //Consistent order to avoid deadlock
+	}
+
+	for _, stripe := range stripes {
+		mdev.regionLocks[stripe].Lock()
+	}
+	return func() {
+		for _, stripe := range stripes {
+			mdev.regionLocks[stripe].Unlock()
+		}
+	}
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device. Reads are served by
+// the destination if every region they overlap has been copied.
+func (mdev *Migration) ReadAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&mdev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	mdev.ioMu.RLock()
+	defer mdev.ioMu.RUnlock()
+	mdev.routeMu.RLock()
+	defer mdev.routeMu.RUnlock()
+
+	switch mdev.route() {
+	case StateSwitched:
+		return mdev.dst.ReadAt(buf, pos)
+	case StateCopying, StatePaused:
+		if len(buf) > 0 && mdev.isCopied(pos, int64(len(buf))) {
+			return mdev.dst.ReadAt(buf, pos)
+		}
+	}
+	return mdev.src.ReadAt(buf, pos)
+}
+
+//isCopied returns if every region overlapping the provided range has been copied
+func (mdev *Migration) isCopied(pos, count int64) bool {
+	first, last := pos/mdev.regionBytes, (pos+count-1)/mdev.regionBytes
+	if last >= mdev.regions {
+		return false
+	}
+
+	mdev.mu.Lock()
+	defer mdev.mu.Unlock()
+	next := mdev.copied.NextClear(first)
+	return next < 0 || next > last
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device. Until the
+// migration switches to the destination writes are sent to both devices; if the
+// write to the destination fails the migration is abandoned.
+func (mdev *Migration) WriteAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&mdev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	mdev.ioMu.RLock()
+	defer mdev.ioMu.RUnlock()
+	mdev.routeMu.RLock()
+	defer mdev.routeMu.RUnlock()
+	if len(buf) < 1 {
+		return 0, nil
+	}
+
+	switch mdev.route() {
+	case StateSwitched:
+		return mdev.dst.WriteAt(buf, pos)
+	case StateCanceled, StateFailed:
+		return mdev.src.WriteAt(buf, pos)
+	}
+
+	unlock := mdev.lockRange(pos, int64(len(buf)))
+	defer unlock()
+	n, err := mdev.src.WriteAt(buf, pos)
+	if err != nil {
+		return n, err
+	}
+	if _, err = mdev.dst.WriteAt(buf, pos); err != nil {
+		mdev.fail(fmt.Errorf("Could not write to destination: %w", err))
+	}
+	return n, nil
+}
+
+//Trim fufills part of usbdlib.Device
+func (mdev *Migration) Trim(pos int64, count int) error {
+	if atomic.LoadUint64(&mdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	mdev.ioMu.RLock()
+	defer mdev.ioMu.RUnlock()
+	mdev.routeMu.RLock()
+	defer mdev.routeMu.RUnlock()
+	if count < 1 {
+		return nil
+	}
+
+	switch mdev.route() {
+	case StateSwitched:
+		return mdev.dst.Trim(pos, count)
+	case StateCanceled, StateFailed:
+		return mdev.src.Trim(pos, count)
+	}
+
+	unlock := mdev.lockRange(pos, int64(count))
+	defer unlock()
+	if err := mdev.src.Trim(pos, count); err != nil {
+		return err
+	}
+	if err := mdev.dst.Trim(pos, count); err != nil {
+		mdev.fail(fmt.Errorf("Could not trim destination: %w", err))
+	}
+	return nil
+}
+
+//Flush fufills part of usbdlib.Device
+func (mdev *Migration) Flush() error {
+	if atomic.LoadUint64(&mdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	mdev.ioMu.RLock()
+	defer mdev.ioMu.RUnlock()
+	mdev.routeMu.RLock()
+	defer mdev.routeMu.RUnlock()
+
+	switch mdev.route() {
+	case StateSwitched:
+		return mdev.dst.Flush()
+	case StateCanceled, StateFailed:
+		return mdev.src.Flush()
+	}
+
+	if err := mdev.src.Flush(); err != nil {
+		return err
+	}
+	if err := mdev.dst.Flush(); err != nil {
+		mdev.fail(fmt.Errorf("Could not flush destination: %w", err))
+	}
+	return nil
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device. Closing a migration
+// that has not completed closes both devices and the migration must be started
+// over.
+func (mdev *Migration) Close() error {
+	if !atomic.CompareAndSwapUint64(&mdev.atomicOnline, 1, 0) {
+		return errClosed
+	}
+	close(mdev.closing)
+	mdev.closeControl()
+	<-mdev.copyDone
+
+	mdev.ioMu.Lock() //Wait for outstanding IO
+	defer mdev.ioMu.Unlock()
+
+	switch state := mdev.route(); state {
+	case StateSwitched:
+		return mdev.dst.Close()
+	case StateCopying, StatePaused:
+		log.Printf("Migration::Close(): WARNING: Migration closed while %s after copying %d of %d bytes, it must be started over", state, mdev.Progress().CopiedBytes, mdev.size)
+		var dstErr error
+		mdev.dstOnce.Do(func() { dstErr = mdev.dst.Close() })
+		if err := mdev.src.Close(); err != nil {
+			return err
+		}
+		if dstErr != nil {
+			return fmt.Errorf("Could not close destination: %w", dstErr)
+		}
+		return nil
+	}
+	mdev.abandonDst()
+	return mdev.src.Close()
+}
+
+//copy copies each region from the source to the destination and then switches to
+// the destination, unless stopped first
+func (mdev *Migration) copy() {
+	defer close(mdev.copyDone)
+
+	buf, zeros := make([]byte, mdev.regionBytes), make([]byte, mdev.regionBytes)
+	for region := int64(0); region < mdev.regions; region++ {
+		if !mdev.waitCopying() {
+			return
+		}
+		n, err := mdev.copyRegion(region, buf, zeros)
+		if err != nil {
+			mdev.fail(err)
+			return
+		}
+		mdev.pace(n)
+	}
+	for mdev.waitCopying() && !mdev.switchover() {
+	}
+}
+
+//waitCopying waits while the migration is paused and returns if copying should
+// continue
+func (mdev *Migration) waitCopying() bool {
+	for {
+		mdev.mu.Lock()
+		state, wake := mdev.state, mdev.wake
+		mdev.mu.Unlock()
+
+		switch state {
+		case StateCopying:
+			select {
+			case <-mdev.closing:
+				return false
+			default:
+				return true
+			}
+		case StatePaused:
+			select {
+			case <-wake:
+			case <-mdev.closing:
+				return false
+			}
+		default:
+			return false
+		}
+	}
+}
+
+//copyRegion copies a region from the source to the destination and returns its
+// length. Regions of zeros are only written if the destination is not already
+// zeros.
+func (mdev *Migration) copyRegion(region int64, buf, zeros []byte) (int64, error) {
+	pos := region * mdev.regionBytes
+	if remaining := mdev.size - pos; remaining < int64(len(buf)) {
+		buf, zeros = buf[:remaining], zeros[:remaining]
+	}
+
+	unlock := mdev.lockRange(pos, int64(len(buf)))
+	defer unlock()
+	if _, err := mdev.src.ReadAt(buf, pos); err != nil {
+		return 0, fmt.Errorf("Could not read %d bytes at %d from source: %w", len(buf), pos, err)
+	}
+	write := true
+	if util.IsZeros(buf) {
+		if _, err := mdev.dst.ReadAt(buf, pos); err != nil {
+			return 0, fmt.Errorf("Could not read %d bytes at %d from destination: %w", len(buf), pos, err)
+		}
+		write, buf = !util.IsZeros(buf), zeros
+	}
+	if write {
+		if _, err := mdev.dst.WriteAt(buf, pos); err != nil {
+			return 0, fmt.Errorf("Could not write %d bytes at %d to destination: %w", len(buf), pos, err)
+		}
+	}
+
+	mdev.mu.Lock()
+	mdev.copied.Set(region)
+	mdev.copiedBytes += int64(len(buf))
+	mdev.mu.Unlock()
+	return int64(len(buf)), nil
+}
+
+//pace waits as needed after copying the provided bytes to limit the copy rate
+func (mdev *Migration) pace(copied int64) {
+	mdev.mu.Lock()
+	mdev.paceBytes += copied
+	if mdev.rate <= 0 {
+		mdev.mu.Unlock()
+		return
+	}
+	due := mdev.paceStart.Add(time.Duration(float64(mdev.paceBytes) / float64(mdev.rate) * float64(time.Second)))
+	wake := mdev.wake
+	mdev.mu.Unlock()
+
+	if wait := time.Until(due); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-wake: //The pace is restarted
+		case <-mdev.closing:
+		}
+	}
+}
+
+//switchover atomically switches all IO to the destination once every region has
+// been copied, and then closes the source. It returns false if the migration was
+// paused first, and must be retried once resumed.
+func (mdev *Migration) switchover() bool {
+	mdev.routeMu.Lock()
+	if err := mdev.dst.Flush(); err != nil {
+		mdev.routeMu.Unlock()
+		mdev.fail(fmt.Errorf("Could not flush destination: %w", err))
+		return true
+	}
+
+	mdev.mu.Lock()
+	state := mdev.state
+	if state == StateCopying {
+		mdev.activeTime += time.Since(mdev.activeSince)
+		mdev.setState(StateSwitched)
+	}
+	mdev.mu.Unlock()
+	mdev.routeMu.Unlock()
+	if state != StateCopying {
+		return state != StatePaused
+	}
+
+	log.Printf("Migration::switchover(): Migration of %d bytes complete, switched to destination", mdev.size)
+	if err := mdev.src.Flush(); err != nil {
+		log.Printf("Migration::switchover(): WARNING: Could not flush source; Details: %s", err)
+	}
+	if err := mdev.src.Close(); err != nil {
+		log.Printf("Migration::switchover(): WARNING: Could not close source; Details: %s", err)
+	}
+	if mdev.onSwitch != nil {
+		mdev.onSwitch()
+	}
+	return true
+}
@@ -0,0 +1,338 @@
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const (
+	sizeBytes   = 8 * 1024 * 1024 //8 MB
+	regionBytes = 64 * 1024
+)
+
+func TestMigration(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	//Copying is slow enough that the suites run during it
+	options := []Option{OptRegionBytes(regionBytes), OptRate(8 * 1024 * 1024)}
+	testutil.TestUserspace(t, createMigration(t, ramdisk.NewRAMDisk(sizeBytes), ramdisk.NewRAMDisk(sizeBytes), options...), sizeBytes)
+	testutil.TestNBD(t, createMigration(t, ramdisk.NewRAMDisk(sizeBytes), ramdisk.NewRAMDisk(sizeBytes), options...), sizeBytes)
+}
+
+func createMigration(t *testing.T, src, dst usbdlib.Device, options ...Option) *Migration {
+	t.Helper()
+
+	mdev, err := NewMigration(src, dst, options...)
+	if err != nil {
+		t.Fatalf("Could not create migration: %s", err)
+	}
+	return mdev
+}
+
+//closeTracker is a device that records being closed without closing, so it can be
+// inspected after the migration is done with it
+type closeTracker struct {
+	usbdlib.Device
+	closed     int32
+	failWrites int32 //Writes fail when set
+}
+
+func (dev *closeTracker) WriteAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadInt32(&dev.failWrites) != 0 {
+		return 0, errors.New("Injected write failure")
+	}
+	return dev.Device.WriteAt(buf, pos)
+}
+
+func (dev *closeTracker) Close() error {
+	atomic.StoreInt32(&dev.closed, 1)
+	return nil
+}
+
+func (dev *closeTracker) isClosed() bool {
+	return atomic.LoadInt32(&dev.closed) != 0
+}
+
+//randomWrites writes random data to the device and the expected contents, trims
+// are also sent but the ram disks used do not change trimmed contents
+func randomWrites(t *testing.T, dev usbdlib.Device, expected []byte, rnd *rand.Rand, count int) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		buf := make([]byte, 512*(1+rnd.Intn(256)))
+		rnd.Read(buf)
+		pos := rnd.Int63n(dev.Size()-int64(len(buf))) &^ 511
+		if _, err := dev.WriteAt(buf, pos); err != nil {
+			t.Fatalf("Could not write: %s", err)
+		}
+		copy(expected[pos:], buf)
+		if i%10 == 0 {
+			if err := dev.Trim(pos, 4096); err != nil {
+				t.Fatalf("Could not trim: %s", err)
+			}
+		}
+	}
+	if err := dev.Flush(); err != nil {
+		t.Fatalf("Could not flush: %s", err)
+	}
+}
+
+func expectContents(t *testing.T, dev usbdlib.Device, expected []byte, desc string) {
+	t.Helper()
+
+	actual := make([]byte, len(expected))
+	if _, err := dev.ReadAt(actual, 0); err != nil {
+		t.Fatalf("Could not read %s: %s", desc, err)
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Fatalf("Contents of %s were not as expected", desc)
+	}
+}
+
+func waitDone(t *testing.T, mdev *Migration) {
+	t.Helper()
+
+	select {
+	case <-mdev.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Migration did not complete: %+v", mdev.Progress())
+	}
+}
+
+func TestSwitchover(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	expected := make([]byte, sizeBytes)
+	src := &closeTracker{Device: ramdisk.NewRAMDisk(sizeBytes)}
+	randomWrites(t, src, expected, rnd, 100)
+
+	//The destination is larger and not empty
+	dst := &closeTracker{Device: ramdisk.NewRAMDisk(2 * sizeBytes)}
+	garbage := make([]byte, 2*sizeBytes)
+	rnd.Read(garbage)
+	dst.WriteAt(garbage, 0)
+
+	var switched int32
+	mdev := createMigration(t, src, dst, OptRegionBytes(regionBytes), OptRate(16*1024*1024), OptOnSwitch(func() { atomic.StoreInt32(&switched, 1) }))
+	defer mdev.Close()
+	if mdev.Size() != sizeBytes {
+		t.Fatalf("Migration size was %d rather than that of the source, %d", mdev.Size(), sizeBytes)
+	}
+
+	//Writes during the copy are sent to both devices
+	randomWrites(t, mdev, expected, rnd, 200)
+	time.Sleep(50 * time.Millisecond)
+	if progress := mdev.Progress(); progress.State != StateCopying || progress.CopiedBytes == 0 || progress.CopiedBytes == sizeBytes || progress.Throughput == 0 {
+		t.Fatalf("Migration progress was not as expected: %+v", progress)
+	}
+	expectContents(t, mdev, expected, "migration while copying")
+
+	waitDone(t, mdev)
+	progress := mdev.Progress()
+	if progress.State != StateSwitched || progress.CopiedBytes != sizeBytes || progress.Remaining != 0 {
+		t.Fatalf("Migration progress was not as expected: %+v", progress)
+	}
+	if !src.isClosed() || dst.isClosed() || atomic.LoadInt32(&switched) == 0 {
+		t.Fatalf("Source was not closed and the switch recorded")
+	}
+	expectContents(t, dst, expected[:sizeBytes], "destination")
+
+	//After the switch IO is only sent to the destination
+	atomic.StoreInt32(&src.failWrites, 1)
+	randomWrites(t, mdev, expected, rnd, 10)
+	expectContents(t, mdev, expected, "migration after switching")
+	expectContents(t, dst, expected, "destination after switching")
+	if err := mdev.Cancel(); err == nil {
+		t.Fatalf("Migration that switched was canceled")
+	}
+}
+
+func TestCancel(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	expected := make([]byte, sizeBytes)
+	src := &closeTracker{Device: ramdisk.NewRAMDisk(sizeBytes)}
+	dst := &closeTracker{Device: ramdisk.NewRAMDisk(sizeBytes)}
+	mdev := createMigration(t, src, dst, OptRegionBytes(regionBytes), OptPaused(true))
+	defer mdev.Close()
+
+	//Nothing is copied while paused
+	randomWrites(t, mdev, expected, rnd, 50)
+	time.Sleep(20 * time.Millisecond)
+	if progress := mdev.Progress(); progress.State != StatePaused || progress.CopiedBytes != 0 {
+		t.Fatalf("Paused migration copied: %+v", progress)
+	}
+
+	if err := mdev.Cancel(); err != nil {
+		t.Fatalf("Could not cancel migration: %s", err)
+	}
+	if progress := mdev.Progress(); progress.State != StateCanceled || !dst.isClosed() || src.isClosed() {
+		t.Fatalf("Migration was not canceled: %+v", progress)
+	}
+	if err := mdev.Resume(); err == nil {
+		t.Fatalf("Canceled migration was resumed")
+	}
+
+	//The source remains complete and IO is only sent to it
+	atomic.StoreInt32(&dst.failWrites, 1)
+	randomWrites(t, mdev, expected, rnd, 50)
+	expectContents(t, mdev, expected, "canceled migration")
+	expectContents(t, src, expected, "source")
+}
+
+//slowWrites delays writes by a duration decided by their data, so concurrent
+// writes are likely to be reordered
+type slowWrites struct {
+	usbdlib.Device
+}
+
+func (dev slowWrites) WriteAt(buf []byte, pos int64) (int, error) {
+	n, err := dev.Device.WriteAt(buf, pos)
+	if len(buf) > 0 {
+		time.Sleep(time.Duration(buf[0]%4) * time.Millisecond)
+	}
+	return n, err
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	const (
+		writers = 8
+		writes  = 200
+	)
+	src, dst := ramdisk.NewRAMDisk(sizeBytes), ramdisk.NewRAMDisk(sizeBytes)
+	mdev := createMigration(t, &closeTracker{Device: slowWrites{src}}, &closeTracker{Device: dst}, OptRegionBytes(regionBytes), OptPaused(true))
+	defer mdev.Close()
+
+	//Overlapping writes must be applied to both devices in the same order
+	var wg sync.WaitGroup
+	errCh := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			buf := make([]byte, 16*1024)
+			for j := 0; j < writes; j++ {
+				count := 512 * (1 + rnd.Intn(len(buf)/512))
+				rnd.Read(buf[:count])
+				if _, err := mdev.WriteAt(buf[:count], rnd.Int63n(2*regionBytes)&^511); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	close(errCh)
+	if err := <-errCh; err != nil {
+		t.Fatalf("Could not write: %s", err)
+	}
+
+	srcData := make([]byte, sizeBytes)
+	if _, err := src.ReadAt(srcData, 0); err != nil {
+		t.Fatalf("Could not read source: %s", err)
+	}
+	expectContents(t, dst, srcData, "destination after concurrent writes")
+}
+
+func TestFailure(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	expected := make([]byte, sizeBytes)
+	src := &closeTracker{Device: ramdisk.NewRAMDisk(sizeBytes)}
+	dst := &closeTracker{Device: ramdisk.NewRAMDisk(sizeBytes)}
+	mdev := createMigration(t, src, dst, OptRegionBytes(regionBytes), OptRate(16*1024*1024))
+	defer mdev.Close()
+	randomWrites(t, mdev, expected, rnd, 50)
+
+	//The migration is abandoned when the destination fails, but IO succeeds
+	atomic.StoreInt32(&dst.failWrites, 1)
+	randomWrites(t, mdev, expected, rnd, 50)
+	waitDone(t, mdev)
+	if progress := mdev.Progress(); progress.State != StateFailed || progress.Failure == "" {
+		t.Fatalf("Migration did not fail: %+v", progress)
+	}
+	for deadline := time.Now().Add(time.Second); !dst.isClosed(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Destination of failed migration was not closed")
+		}
+	}
+	expectContents(t, mdev, expected, "failed migration")
+}
+
+func TestControl(t *testing.T) {
+	mdev := createMigration(t, ramdisk.NewRAMDisk(sizeBytes), ramdisk.NewRAMDisk(sizeBytes), OptRegionBytes(regionBytes), OptPaused(true))
+
+	sockPath := filepath.Join(t.TempDir(), "migrate.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Could not listen on %q: %s", sockPath, err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- mdev.ServeControl(ln)
+	}()
+
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Could not connect to %q: %s", sockPath, err)
+	}
+	defer conn.Close()
+	lines := bufio.NewScanner(conn)
+	send := func(req string) ControlResponse {
+		t.Helper()
+
+		if _, err := conn.Write([]byte(req + "\n")); err != nil {
+			t.Fatalf("Could not send %s: %s", req, err)
+		}
+		var resp ControlResponse
+		if !lines.Scan() {
+			t.Fatalf("No response to %s: %v", req, lines.Err())
+		} else if err := json.Unmarshal(lines.Bytes(), &resp); err != nil {
+			t.Fatalf("Could not decode response to %s: %s", req, err)
+		}
+		return resp
+	}
+
+	resp := send(`{"cmd": "status"}`)
+	if resp.Error != "" || resp.State != StatePaused || resp.Bytes != sizeBytes || resp.CopiedBytes != 0 {
+		t.Fatalf("Unexpected response to status: %+v", resp)
+	}
+	if resp = send(`{"cmd": "rate", "rate": 1048576}`); resp.Error != "" || resp.Rate != 1024*1024 {
+		t.Fatalf("Unexpected response to rate: %+v", resp)
+	}
+	if resp = send(`{"cmd": "rate", "rate": -1}`); resp.Error == "" {
+		t.Fatalf("Negative rate was accepted")
+	}
+	if resp = send(`{"cmd": "resume"}`); resp.Error != "" || resp.State != StateCopying {
+		t.Fatalf("Unexpected response to resume: %+v", resp)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if resp = send(`{"cmd": "pause"}`); resp.Error != "" || resp.State != StatePaused || resp.CopiedBytes == 0 || resp.CopiedBytes > sizeBytes/8 {
+		t.Fatalf("Rate limited migration did not copy as expected: %+v", resp)
+	}
+	if resp = send(`{"cmd": "cancel"}`); resp.Error != "" || resp.State != StateCanceled {
+		t.Fatalf("Unexpected response to cancel: %+v", resp)
+	}
+	if resp = send(`{"cmd": "resume"}`); resp.Error == "" {
+		t.Fatalf("Canceled migration was resumed")
+	}
+	if resp = send(`{"cmd": "explode"}`); resp.Error == "" {
+		t.Fatalf("Unknown command was accepted")
+	}
+
+	testutil.TestClose(t, mdev)
+	if err = <-served; err != nil {
+		t.Fatalf("Serving control socket failed: %s", err)
+	}
+}
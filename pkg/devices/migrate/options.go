@@ -0,0 +1,44 @@
+package migrate
+
+//Option is a migration option
+type Option interface {
+	apply(*Migration)
+}
+
+//OptRate instructs a Migration to limit copying to the provided bytes per second,
+// the default is unlimited; see SetRate
+type OptRate int64
+
+func (rate OptRate) apply(mdev *Migration) {
+	mdev.rate = int64(rate)
+}
+
+//OptRegionBytes instructs a Migration to copy regions of the provided size, the
+// default is DefRegionBytes. Reads are served by the destination, and writes and
+// copying exclude each other, at this granularity.
+type OptRegionBytes int64
+
+func (size OptRegionBytes) apply(mdev *Migration) {
+	mdev.regionBytes = int64(size)
+}
+
+//OptPaused instructs a Migration to start paused, copying does not begin until
+// Resume is called
+type OptPaused bool
+
+func (paused OptPaused) apply(mdev *Migration) {
+	if paused {
+		mdev.state = StatePaused
+	} else {
+		mdev.state = StateCopying
+	}
+}
+
+//OptOnSwitch instructs a Migration to call the provided function once IO is
+// switched to the destination, for example to record that the destination should
+// be used from now on
+type OptOnSwitch func()
+
+func (onSwitch OptOnSwitch) apply(mdev *Migration) {
+	mdev.onSwitch = onSwitch
+}
@@ -0,0 +1,171 @@
+package mirror
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/bitmap"
+)
+
+const (
+	metaMagic    = "USBDMIR1"
+	metaHdrBytes = len(metaMagic) + 8 + 8 + 4
+)
+
+//The write-intent bitmap has a bit per region that is set, and persisted, before
+// any write to the region is issued to the members. Bits are cleared only once
+// the members have been flushed and all of them are active, so after a crash the
+// set bits identify the only regions in which the members may differ, and while
+// any member is out of service they identify the regions it has missed.
+
+//markRegions records that the regions in [first, last] are about to be written
+func (dev *Mirror) markRegions(first, last int64) error {
+	dev.intentMu.Lock()
+	defer dev.intentMu.Unlock()
+
+	newBits := false
+	for region := first; region <= last; region++ {
+		dev.inflight[region]++
+		if !dev.intent.Test(region) {
+			dev.intent.Set(region)
+			newBits = true
+		}
+	}
+	if newBits {
+		if err := dev.persistLocked(); err != nil {
+			dev.unmarkRegionsLocked(first, last)
+			return fmt.Errorf("Could not persist write-intent bitmap: %w", err)
+		}
+	}
+	return nil
+}
+
+//unmarkRegions records that writes to the regions in [first, last] completed
+func (dev *Mirror) unmarkRegions(first, last int64) {
+	dev.intentMu.Lock()
+	defer dev.intentMu.Unlock()
+	dev.unmarkRegionsLocked(first, last)
+}
+
+func (dev *Mirror) unmarkRegionsLocked(first, last int64) {
+	for region := first; region <= last; region++ {
+		if dev.inflight[region]--; dev.inflight[region] < 1 {
+			delete(dev.inflight, region)
+		}
+	}
+}
+
+//clearRegions clears the bits of regions that are no longer being written if all
+// members are active, the members must have just been flushed
+func (dev *Mirror) clearRegions() error {
+	for _, mbr := range dev.members {
+		if mbr.state() != MemberActive {
+			return nil
+		}
+	}
+
+	dev.intentMu.Lock()
+	defer dev.intentMu.Unlock()
+
+	cleared := false
+	for region := dev.intent.NextSet(0); region >= 0; region = dev.intent.NextSet(region + 1) {
+		if dev.inflight[region] == 0 {
+			dev.intent.Clear(region)
+			cleared = true
+		}
+	}
+	if cleared {
+		if err := dev.persistLocked(); err != nil {
+			return fmt.Errorf("Could not persist write-intent bitmap: %w", err)
+		}
+	}
+	return nil
+}
+
+//updateStates makes a change to the members or their states and persists the
+// result while holding intentMu, so concurrent changes are persisted in the order
+// they are made and never by a snapshot older than one already persisted. The
+// change returns false if it changed nothing, in which case nothing is persisted.
+func (dev *Mirror) updateStates(change func() bool) error {
+	dev.intentMu.Lock()
+	defer dev.intentMu.Unlock()
+	if !change() {
+		return nil
+	}
+	if err := dev.persistLocked(); err != nil {
+		return fmt.Errorf("Could not persist mirror member states: %w", err)
+	}
+	return nil
+}
+
+//persistLocked writes the member states and write-intent bitmap to the metadata
+// file, the caller must hold intentMu
+func (dev *Mirror) persistLocked() error {
+	if dev.metaFile == "" {
+		return nil
+	}
+
+	intent, _ := dev.intent.MarshalBinary()
+	meta := make([]byte, metaHdrBytes, metaHdrBytes+len(dev.members)+len(intent)+4)
+	copy(meta, metaMagic)
+	binary.LittleEndian.PutUint64(meta[len(metaMagic):], uint64(dev.regionBytes))
+	binary.LittleEndian.PutUint64(meta[len(metaMagic)+8:], uint64(dev.size))
+	binary.LittleEndian.PutUint32(meta[len(metaMagic)+16:], uint32(len(dev.members)))
+	for _, mbr := range dev.members {
+		state := mbr.state()
+		if state == MemberSyncing { //If interrupted the sync must start over
+			state = MemberStale
+		}
+		meta = append(meta, byte(state))
+	}
+	meta = append(meta, intent...)
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(meta))
+	return util.WriteFileAtomic(dev.metaFile, append(meta, crc...), 0600)
+}
+
+//loadMeta restores member states and the write-intent bitmap, returning false if
+// there is no metadata file yet
+func (dev *Mirror) loadMeta() (bool, error) {
+	meta, err := os.ReadFile(dev.metaFile)
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("Could not read mirror metadata file %q: %w", dev.metaFile, err)
+	}
+
+	memberCount := int64(len(dev.members))
+	expectedBytes := int64(metaHdrBytes) + memberCount + bitmap.MarshaledSize(dev.intent.Len()) + 4
+	switch {
+	case len(meta) < metaHdrBytes+4 || string(meta[:len(metaMagic)]) != metaMagic:
+		return false, fmt.Errorf("File %q is not mirror metadata", dev.metaFile)
+	case crc32.ChecksumIEEE(meta[:len(meta)-4]) != binary.LittleEndian.Uint32(meta[len(meta)-4:]):
+		return false, fmt.Errorf("Mirror metadata file %q is corrupt (checksum mismatch)", dev.metaFile)
+	case int64(binary.LittleEndian.Uint64(meta[len(metaMagic):])) != dev.regionBytes:
+		return false, fmt.Errorf("Mirror metadata file %q has a region size of %d rather than %d", dev.metaFile, binary.LittleEndian.Uint64(meta[len(metaMagic):]), dev.regionBytes)
+	case int64(binary.LittleEndian.Uint64(meta[len(metaMagic)+8:])) != dev.size:
+		return false, fmt.Errorf("Mirror metadata file %q is for a mirror of %d bytes rather than %d", dev.metaFile, binary.LittleEndian.Uint64(meta[len(metaMagic)+8:]), dev.size)
+	case int64(binary.LittleEndian.Uint32(meta[len(metaMagic)+16:])) != memberCount:
+		return false, fmt.Errorf("Mirror metadata file %q is for %d members rather than %d", dev.metaFile, binary.LittleEndian.Uint32(meta[len(metaMagic)+16:]), memberCount)
+	case int64(len(meta)) != expectedBytes:
+		return false, fmt.Errorf("Mirror metadata file %q is %d bytes; expected %d", dev.metaFile, len(meta), expectedBytes)
+	}
+
+	meta = meta[metaHdrBytes : len(meta)-4]
+	for i, mbr := range dev.members {
+		switch state := MemberState(meta[i]); state {
+		case MemberActive, MemberDegraded, MemberStale:
+			mbr.setState(state)
+		default:
+			return false, fmt.Errorf("Mirror metadata file %q has invalid state %d for member %d", dev.metaFile, state, i)
+		}
+	}
+	if err = dev.intent.UnmarshalBinary(meta[memberCount:]); err != nil {
+		return false, fmt.Errorf("Could not decode write-intent bitmap in %q: %w", dev.metaFile, err)
+	}
+	return true, nil
+}
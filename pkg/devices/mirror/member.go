@@ -0,0 +1,115 @@
+package mirror
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+//MemberState is the state of a single mirror member
+type MemberState uint32
+
+const (
+	//MemberActive members receive all writes and serve reads
+	MemberActive MemberState = iota
+	//MemberSyncing members receive all writes but do not serve reads until they
+	// have been resynced
+	MemberSyncing
+	//MemberDegraded members failed and have been removed from service, they can
+	// be re-added by resyncing only the regions written since
+	MemberDegraded
+	//MemberStale members must be fully resynced before they can be re-added
+	MemberStale
+)
+
+func (state MemberState) String() string {
+	switch state {
+	case MemberActive:
+		return "active"
+	case MemberSyncing:
+		return "syncing"
+	case MemberDegraded:
+		return "degraded"
+	case MemberStale:
+		return "stale"
+	}
+	return "unknown"
+}
+
+//MemberStatus describes a mirror member
+type MemberStatus struct {
+	State MemberState
+	//Err is the failure that caused the member to be degraded, if any
+	Err error
+	//ReadLatency is a moving average of recent reads served by the member
+	ReadLatency time.Duration
+}
+
+type member struct {
+	dev         usbdlib.Device
+	atomicState uint32
+	atomicLatNS uint64
+	errMu       sync.Mutex
+	err         error
+}
+
+func newMember(dev usbdlib.Device, state MemberState) *member {
+	return &member{dev: dev, atomicState: uint32(state)}
+}
+
+func (mbr *member) state() MemberState {
+	return MemberState(atomic.LoadUint32(&mbr.atomicState))
+}
+
+func (mbr *member) setState(state MemberState) {
+	atomic.StoreUint32(&mbr.atomicState, uint32(state))
+}
+
+//writable members receive writes
+func (mbr *member) writable() bool {
+	state := mbr.state()
+	return state == MemberActive || state == MemberSyncing
+}
+
+//fail transitions the member to degraded (unless it is already out of service)
+// returning true if it was in service
+func (mbr *member) fail(err error) bool {
+	for {
+		state := mbr.state()
+		next := MemberDegraded
+		switch state {
+		case MemberDegraded, MemberStale:
+			return false
+		case MemberSyncing: //Partially synced, only a full resync will do
+			next = MemberStale
+		}
+		if atomic.CompareAndSwapUint32(&mbr.atomicState, uint32(state), uint32(next)) {
+			mbr.errMu.Lock()
+			mbr.err = err
+			mbr.errMu.Unlock()
+			return true
+		}
+	}
+}
+
+//recordLatency updates an exponentially weighted moving average of read latency
+func (mbr *member) recordLatency(elapsed time.Duration) {
+	prev := atomic.LoadUint64(&mbr.atomicLatNS)
+	next := uint64(elapsed)
+	if prev != 0 {
+		next = prev - prev/8 + next/8
+	}
+	atomic.StoreUint64(&mbr.atomicLatNS, next)
+}
+
+func (mbr *member) latency() time.Duration {
+	return time.Duration(atomic.LoadUint64(&mbr.atomicLatNS))
+}
+
+func (mbr *member) status() MemberStatus {
+	mbr.errMu.Lock()
+	defer mbr.errMu.Unlock()
+	return MemberStatus{State: mbr.state(), Err: mbr.err, ReadLatency: mbr.latency()}
+}
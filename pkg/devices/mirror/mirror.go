@@ -0,0 +1,424 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/integrity"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/bitmap"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed    = consterr.ConstErr("Device is shutdown")
+	errNoMembers = consterr.ConstErr("No mirror members are in service")
+
+	//DefRegionBytes is the default size of regions tracked by the write-intent bitmap
+	DefRegionBytes = 4 * 1024 * 1024
+
+	lockStripes        = 64
+	fastestSampleEvery = 16
+)
+
+//Mirror is a RAID1 device that writes to all of its member devices and reads from
+// any one of them. Members that fail are removed from service (degraded) while
+// the mirror continues to serve IO from the rest. A write-intent bitmap records
+// which regions may differ between members so that after a crash, or when a
+// degraded member is re-added, only those regions need to be resynced.
+type Mirror struct {
+	size, blockSize, regionBytes int64
+	metaFile                     string
+	readPolicy                   ReadPolicy
+	atomicOnline                 uint64
+	atomicReads                  uint64
+
+	membersMu   sync.RWMutex
+	members     []*member
+	regionLocks [lockStripes]sync.RWMutex //Writes share, resync is exclusive
+	syncMu      sync.Mutex                //Held for the duration of a resync
+
+	intentMu sync.Mutex //Also serializes member state changes with persisting them
+	intent   *bitmap.Bitmap
+	inflight map[int64]int
+}
+
+//NewMirror constructs a mirror of the provided devices, the size of the mirror is
+// that of the smallest member. If a metadata file is provided the member states
+// and write-intent bitmap are persisted to it, and if it already exists regions
+// that were being written when the mirror was last shut down are resynced before
+// returning. Members are identified by their position, so they must be provided
+// in the same order each time. The mirror owns the member devices and closes
+// them when it is closed.
+func NewMirror(members []usbdlib.Device, metaFile string, options ...Option) (*Mirror, error) {
+	if len(members) < 1 {
+		return nil, fmt.Errorf("A mirror requires at least one member")
+	}
+
+	dev := &Mirror{
+		size:         members[0].Size(),
+		metaFile:     metaFile,
+		regionBytes:  DefRegionBytes,
+		atomicOnline: 1,
+		inflight:     make(map[int64]int),
+	}
+	for _, opt := range options {
+		opt.apply(dev)
+	}
+
+	for _, mbrDev := range members {
+		if size := mbrDev.Size(); size < dev.size {
+			dev.size = size
+		}
+		if blockSize := mbrDev.BlockSize(); blockSize > dev.blockSize {
+			dev.blockSize = blockSize
+		}
+	}
+	for i, mbrDev := range members {
+		if dev.blockSize%mbrDev.BlockSize() != 0 {
+			return nil, fmt.Errorf("Block size %d of member %d is incompatible with block size %d", mbrDev.BlockSize(), i, dev.blockSize)
+		}
+		dev.members = append(dev.members, newMember(mbrDev, MemberActive))
+	}
+	dev.size -= dev.size % dev.blockSize
+
+	switch {
+	case dev.size < 1:
+		return nil, fmt.Errorf("Smallest mirror member is smaller than a block")
+	case dev.regionBytes < dev.blockSize || dev.regionBytes%dev.blockSize != 0:
+		return nil, fmt.Errorf("Region size %d is not a multiple of the block size %d", dev.regionBytes, dev.blockSize)
+	}
+	dev.intent = bitmap.New((dev.size + dev.regionBytes - 1) / dev.regionBytes)
+
+	if metaFile != "" {
+		loaded, err := dev.loadMeta()
+		if err != nil {
+			return nil, err
+		}
+		if !loaded {
+			if err = dev.updateStates(func() bool { return true }); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if dev.activeCount() < 1 {
+		return nil, errNoMembers
+	}
+	if err := dev.resyncAfterCrash(); err != nil {
+		return nil, err
+	}
+	return dev, nil
+}
+
+//Size of this device in bytes
+func (dev *Mirror) Size() int64 {
+	return dev.size
+}
+
+//BlockSize of this device is the largest member block size
+func (dev *Mirror) BlockSize() int64 {
+	return dev.blockSize
+}
+
+//Members returns the status of each member in order
+func (dev *Mirror) Members() []MemberStatus {
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+
+	statuses := make([]MemberStatus, len(dev.members))
+	for i, mbr := range dev.members {
+		statuses[i] = mbr.status()
+	}
+	return statuses
+}
+
+//activeCount returns the number of active members, the caller must hold membersMu
+func (dev *Mirror) activeCount() (count int) {
+	for _, mbr := range dev.members {
+		if mbr.state() == MemberActive {
+			count++
+		}
+	}
+	return count
+}
+
+//pickReader selects an active member to read from per the read policy, the
+// caller must hold membersMu
+func (dev *Mirror) pickReader() *member {
+	active := make([]*member, 0, len(dev.members))
+	for _, mbr := range dev.members {
+		if mbr.state() == MemberActive {
+			active = append(active, mbr)
+		}
+	}
+	if len(active) < 1 {
+		return nil
+	}
+
+	readNum := atomic.AddUint64(&dev.atomicReads, 1)
+	if dev.readPolicy != ReadFastest || readNum%fastestSampleEvery == 0 {
+		return active[readNum%uint64(len(active))]
+	}
+	fastest := active[0]
+	for _, mbr := range active[1:] {
+		if mbr.latency() < fastest.latency() {
+			fastest = mbr
+		}
+	}
+	return fastest
+}
+
+//degrade removes a failed member from service, the caller must hold membersMu
+func (dev *Mirror) degrade(mbr *member, err error) {
+	failed, state := false, MemberDegraded
+	persistErr := dev.updateStates(func() bool {
+		failed, state = mbr.fail(err), mbr.state()
+		return failed
+	})
+	if !failed {
+		return
+	}
+	idx := -1
+	for i := range dev.members {
+		if dev.members[i] == mbr {
+			idx = i
+		}
+	}
+	log.Printf("Mirror::degrade(): WARNING: Member %d failed and is now %s; Details: %s", idx, state, err)
+	if persistErr != nil {
+		log.Printf("Mirror::degrade(): ERROR: %s", persistErr)
+	}
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (dev *Mirror) ReadAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case pos >= dev.size:
+		return 0, io.EOF
+	}
+	var eof error
+	if end := pos + int64(len(buf)); end > dev.size {
+		buf, eof = buf[:dev.size-pos], io.EOF
+	}
+
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+	return dev.readMember(buf, pos, eof, false)
+}
+
+//readMember reads from an active member, failing over to another if the read
+// fails or repairing the member if it failed an integrity check; the caller must
+// hold membersMu, and indicate if it holds the region locks exclusively
+func (dev *Mirror) readMember(buf []byte, pos int64, eof error, regionsLocked bool) (int, error) {
+	for {
+		mbr := dev.pickReader()
+		if mbr == nil {
+			return 0, errNoMembers
+		}
+
+		start := time.Now()
+		n, err := mbr.dev.ReadAt(buf, pos)
+		if err == nil || (err == io.EOF && n == len(buf)) {
+			mbr.recordLatency(time.Since(start))
+			return len(buf), eof
+		}
+		if errors.Is(err, integrity.ErrIntegrity) {
+			if _, repairErr := dev.repair(buf, pos, regionsLocked); repairErr == nil {
+				return len(buf), eof
+			}
+		}
+		if dev.activeCount() < 2 { //The last member is never removed from service
+			return n, fmt.Errorf("Could not read %d bytes at offset %d: %w", len(buf), pos, err)
+		}
+		dev.degrade(mbr, err)
+	}
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (dev *Mirror) WriteAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case pos+int64(len(buf)) > dev.size:
+		return 0, io.ErrUnexpectedEOF
+	case len(buf) < 1:
+		return 0, nil
+	}
+
+	err = dev.modify(pos, int64(len(buf)), func(mbrDev usbdlib.Device) error {
+		_, err := mbrDev.WriteAt(buf, pos)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Could not write %d bytes at offset %d: %w", len(buf), pos, err)
+	}
+	return len(buf), nil
+}
+
+//Trim fufills part of usbdlib.Device by trimming all members
+func (dev *Mirror) Trim(pos int64, count int) error {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return errClosed
+	case count < 1 || pos >= dev.size:
+		return nil
+	}
+	if pos+int64(count) > dev.size {
+		count = int(dev.size - pos)
+	}
+
+	err := dev.modify(pos, int64(count), func(mbrDev usbdlib.Device) error {
+		return mbrDev.Trim(pos, count)
+	})
+	if err != nil {
+		return fmt.Errorf("Could not trim %d bytes at offset %d: %w", count, pos, err)
+	}
+	return nil
+}
+
+//modify applies a mutation to all writable members after recording the intent
+// to modify the affected regions
+func (dev *Mirror) modify(pos, count int64, op func(usbdlib.Device) error) error {
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+
+	first, last := pos/dev.regionBytes, (pos+count-1)/dev.regionBytes
+	unlock := dev.lockRegions(first, last, false)
+	defer unlock()
+
+	if err := dev.markRegions(first, last); err != nil {
+		return err
+	}
+	defer dev.unmarkRegions(first, last)
+	return dev.eachWritable(op)
+}
+
+//eachWritable concurrently applies an operation to every writable member. Members
+// that fail are degraded as long as the operation succeeded on an active member,
+// otherwise the error is returned. The caller must hold membersMu.
+func (dev *Mirror) eachWritable(op func(usbdlib.Device) error) error {
+	var targets []*member
+	for _, mbr := range dev.members {
+		if mbr.writable() {
+			targets = append(targets, mbr)
+		}
+	}
+
+	errs := make([]error, len(targets))
+	if len(targets) == 1 {
+		errs[0] = op(targets[0].dev)
+	} else {
+		var wg sync.WaitGroup
+		wg.Add(len(targets))
+		for i := range targets {
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = op(targets[i].dev)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	var firstErr error
+	activeOK := false
+	for i, err := range errs {
+		if err == nil {
+			activeOK = activeOK || targets[i].state() == MemberActive
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	switch {
+	case firstErr == nil:
+		return nil
+	case !activeOK:
+		return firstErr
+	}
+	for i, err := range errs {
+		if err != nil {
+			dev.degrade(targets[i], err)
+		}
+	}
+	return nil
+}
+
+//lockRegions locks the stripes covering the regions in [first, last], shared for
+// writing or exclusively for copying between members, returning a function that
+// unlocks them
+func (dev *Mirror) lockRegions(first, last int64, exclusive bool) (unlock func()) {
+	var stripes []int
+	if last-first+1 >= lockStripes {
+		for i := 0; i < lockStripes; i++ {
+			stripes = append(stripes, i)
+		}
+	} else {
+		for region := first; region <= last; region++ {
+			stripes = append(stripes, int(region%lockStripes))
+		}
+		sort.Ints(stripes) //Consistent order to avoid deadlock
+	}
+
+	for _, stripe := range stripes {
+		if exclusive {
+			dev.regionLocks[stripe].Lock()
+		} else {
+			dev.regionLocks[stripe].RLock()
+		}
+	}
+	return func() {
+		for _, stripe := range stripes {
+			if exclusive {
+				dev.regionLocks[stripe].Unlock()
+			} else {
+				dev.regionLocks[stripe].RUnlock()
+			}
+		}
+	}
+}
+
+//Flush fufills part of usbdlib.Device by flushing all members and then clearing
+// the write-intent bitmap if all members are in sync
+func (dev *Mirror) Flush() error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+	return dev.flush()
+}
+
+//flush is Flush without the online check, the caller must hold membersMu
+func (dev *Mirror) flush() error {
+	if err := dev.eachWritable(usbdlib.Device.Flush); err != nil {
+		return fmt.Errorf("Could not flush members: %w", err)
+	}
+	return dev.clearRegions()
+}
+
+//Close flushes and closes all members
+func (dev *Mirror) Close() error {
+	if !atomic.CompareAndSwapUint64(&dev.atomicOnline, 1, 0) {
+		return errClosed
+	}
+
+	dev.membersMu.Lock() //Wait for outstanding IO
+	defer dev.membersMu.Unlock()
+
+	err := dev.flush()
+	for i, mbr := range dev.members {
+		if closeErr := mbr.dev.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("Could not close member %d: %w", i, closeErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,364 @@
+package mirror
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/integrity"
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+func TestMirror(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	testutil.TestUserspace(t, createDevice(t, sizeBytes), sizeBytes)
+	testutil.TestNBD(t, createDevice(t, sizeBytes), sizeBytes)
+}
+
+func createDevice(t *testing.T, sizeBytes int64) usbdlib.Device {
+	dev, err := NewMirror([]usbdlib.Device{ramdisk.NewRAMDisk(sizeBytes), ramdisk.NewRAMDisk(sizeBytes)}, "")
+	if err != nil {
+		t.Fatalf("Could not create mirror test device: %s", err)
+	}
+	return dev
+}
+
+//newTestMember creates a member that can be made to fail or respond slowly
+func newTestMember(sizeBytes int64) *testutil.FailingDevice {
+	return testutil.NewFailingDevice(ramdisk.NewRAMDisk(sizeBytes))
+}
+
+//writeRandom writes random data at random offsets of the mirror, updating the
+// expected contents of the mirror
+func writeRandom(t *testing.T, dev usbdlib.Device, contents []byte, seed int64, count int) {
+	t.Helper()
+
+	rnd := rand.New(rand.NewSource(seed))
+	for i := 0; i < count; i++ {
+		data := make([]byte, 4096*(1+rnd.Intn(4)))
+		rnd.Read(data)
+		pos := rnd.Int63n(int64(len(contents)-len(data))) / 4096 * 4096
+		if _, err := dev.WriteAt(data, pos); err != nil {
+			t.Fatalf("Write of %d bytes at %d failed: %s", len(data), pos, err)
+		}
+		copy(contents[pos:], data)
+	}
+}
+
+func expectContents(t *testing.T, desc string, dev usbdlib.Device, expected []byte) {
+	t.Helper()
+
+	actual := make([]byte, len(expected))
+	if _, err := dev.ReadAt(actual, 0); err != nil {
+		t.Fatalf("Could not read %s: %s", desc, err)
+	} else if !bytes.Equal(actual, expected) {
+		t.Fatalf("Contents of %s were not as expected", desc)
+	}
+}
+
+func expectStates(t *testing.T, dev *Mirror, expected ...MemberState) {
+	t.Helper()
+
+	statuses := dev.Members()
+	if len(statuses) != len(expected) {
+		t.Fatalf("Mirror has %d members rather than %d", len(statuses), len(expected))
+	}
+	for i, status := range statuses {
+		if status.State != expected[i] {
+			t.Fatalf("Member %d is %s rather than %s (error: %v)", i, status.State, expected[i], status.Err)
+		}
+	}
+}
+
+func TestDegradeAndReadd(t *testing.T) {
+	const (
+		sizeBytes   = 4 * 1024 * 1024
+		regionBytes = 64 * 1024
+	)
+
+	members := []*testutil.FailingDevice{newTestMember(sizeBytes), newTestMember(sizeBytes)}
+	dev, err := NewMirror([]usbdlib.Device{members[0], members[1]}, filepath.Join(t.TempDir(), "mirror.meta"), OptRegionBytes(regionBytes))
+	if err != nil {
+		t.Fatalf("Could not create device: %s", err)
+	}
+	defer dev.Close()
+
+	contents := make([]byte, sizeBytes)
+	writeRandom(t, dev, contents, 1, 100)
+	if err = dev.Flush(); err != nil {
+		t.Fatalf("Flush failed: %s", err)
+	}
+
+	//The mirror keeps serving IO with a failed member
+	members[1].Failing.Set(true)
+	writeRandom(t, dev, contents, 2, 10)
+	expectStates(t, dev, MemberActive, MemberDegraded)
+	expectContents(t, "degraded mirror", dev, contents)
+	if err = dev.Flush(); err != nil {
+		t.Fatalf("Flush of degraded mirror failed: %s", err)
+	}
+
+	//Reads fail over to another member
+	members[1].Failing.Set(false)
+	if err = dev.ReaddMember(1, nil); err != nil {
+		t.Fatalf("Could not re-add member: %s", err)
+	}
+	members[0].Failing.Set(true)
+	for i := 0; i < 2; i++ { //Round-robin ensures member 0 is read from
+		expectContents(t, "mirror after failover", dev, contents)
+	}
+	expectStates(t, dev, MemberDegraded, MemberActive)
+
+	//Only regions written while degraded are resynced
+	members[0].Failing.Set(false)
+	writeRandom(t, dev, contents, 3, 10)
+	var lastSynced, lastTotal int64
+	err = dev.ReaddMember(0, func(synced, total int64) {
+		lastSynced, lastTotal = synced, total
+	})
+	if err != nil {
+		t.Fatalf("Could not re-add member: %s", err)
+	}
+	if lastSynced != lastTotal || lastTotal < 1 || lastTotal > 10*2*regionBytes {
+		t.Fatalf("Resync progress ended at %d of %d bytes", lastSynced, lastTotal)
+	}
+	expectStates(t, dev, MemberActive, MemberActive)
+	expectContents(t, "member 0", members[0].Device, contents)
+	expectContents(t, "member 1", members[1].Device, contents)
+
+	if err = dev.ReaddMember(0, nil); err == nil {
+		t.Fatalf("Re-adding an active member succeeded")
+	}
+}
+
+func TestAddAndReplace(t *testing.T) {
+	const sizeBytes = 2 * 1024 * 1024
+
+	first := newTestMember(sizeBytes)
+	dev, err := NewMirror([]usbdlib.Device{first}, "", OptRegionBytes(256*1024))
+	if err != nil {
+		t.Fatalf("Could not create device: %s", err)
+	}
+	defer dev.Close()
+
+	contents := make([]byte, sizeBytes)
+	writeRandom(t, dev, contents, 1, 100)
+
+	added := newTestMember(sizeBytes)
+	var progressCalls int
+	var lastSynced int64
+	err = dev.AddMember(added, func(synced, total int64) {
+		if total != sizeBytes || synced < lastSynced {
+			t.Errorf("Resync progress was %d of %d bytes after %d", synced, total, lastSynced)
+		}
+		progressCalls, lastSynced = progressCalls+1, synced
+	})
+	if err != nil {
+		t.Fatalf("Could not add member: %s", err)
+	}
+	if progressCalls != 1+sizeBytes/(256*1024) || lastSynced != sizeBytes {
+		t.Fatalf("Progress was reported %d times ending at %d bytes", progressCalls, lastSynced)
+	}
+	expectStates(t, dev, MemberActive, MemberActive)
+	expectContents(t, "added member", added.Device, contents)
+
+	if err = dev.AddMember(ramdisk.NewRAMDisk(sizeBytes/2), nil); err == nil {
+		t.Fatalf("Adding an undersized member succeeded")
+	}
+
+	replacement := newTestMember(sizeBytes)
+	if err = dev.ReplaceMember(0, replacement, nil); err != nil {
+		t.Fatalf("Could not replace member: %s", err)
+	}
+	if _, err = first.Device.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Fatalf("Replaced member was not closed")
+	}
+	writeRandom(t, dev, contents, 2, 10)
+	expectContents(t, "replacement member", replacement.Device, contents)
+	expectContents(t, "mirror", dev, contents)
+
+	//Only one member left in service can not be replaced
+	added.Failing.Set(true)
+	writeRandom(t, dev, contents, 3, 1)
+	if err = dev.ReplaceMember(0, newTestMember(sizeBytes), nil); err == nil {
+		t.Fatalf("Replacing the last active member succeeded")
+	}
+}
+
+func TestCrashResync(t *testing.T) {
+	const (
+		sizeBytes   = 1024 * 1024
+		regionBytes = 64 * 1024
+	)
+
+	metaFile := filepath.Join(t.TempDir(), "mirror.meta")
+	members := []usbdlib.Device{ramdisk.NewRAMDisk(sizeBytes), ramdisk.NewRAMDisk(sizeBytes)}
+	dev, err := NewMirror(members, metaFile, OptRegionBytes(regionBytes))
+	if err != nil {
+		t.Fatalf("Could not create device: %s", err)
+	}
+
+	contents := make([]byte, sizeBytes)
+	writeRandom(t, dev, contents, 1, 20)
+	if err = dev.Flush(); err != nil {
+		t.Fatalf("Flush failed: %s", err)
+	}
+
+	//Write to region 3 and then "crash" with member 1 having missed the write
+	dirty := bytes.Repeat([]byte{0xa5}, 4096)
+	if _, err = dev.WriteAt(dirty, 3*regionBytes); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	copy(contents[3*regionBytes:], dirty)
+	members[1].WriteAt(make([]byte, 4096), 3*regionBytes)
+	//A clean region that differs is not resynced (proving only dirty ones are)
+	members[1].WriteAt(dirty, 9*regionBytes)
+
+	dev, err = NewMirror(members, metaFile, OptRegionBytes(regionBytes))
+	if err != nil {
+		t.Fatalf("Could not reopen device: %s", err)
+	}
+	defer dev.Close()
+
+	expectStates(t, dev, MemberActive, MemberActive)
+	expectContents(t, "member 0", members[0], contents)
+	copy(contents[9*regionBytes:], dirty)
+	expectContents(t, "member 1", members[1], contents)
+
+	if _, err = NewMirror(members[:1], metaFile, OptRegionBytes(regionBytes)); err == nil {
+		t.Fatalf("Metadata for a different number of members was accepted")
+	}
+}
+
+func TestReadFastest(t *testing.T) {
+	const sizeBytes = 256 * 1024
+
+	slow, fast := newTestMember(sizeBytes), newTestMember(sizeBytes)
+	slow.Delay = 2 * time.Millisecond
+	dev, err := NewMirror([]usbdlib.Device{slow, fast}, "", OptReadPolicy(ReadFastest))
+	if err != nil {
+		t.Fatalf("Could not create device: %s", err)
+	}
+	defer dev.Close()
+
+	buf := make([]byte, 4096)
+	for i := 0; i < 200; i++ {
+		if _, err = dev.ReadAt(buf, 0); err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+	}
+	if slowReads, fastReads := slow.Reads(), fast.Reads(); slowReads*4 > fastReads {
+		t.Fatalf("Slow member served %d reads while the fast one served %d", slowReads, fastReads)
+	}
+}
+
+func TestIntegrityRepair(t *testing.T) {
+	const sizeBytes = 1024 * 1024
+
+	var disks []usbdlib.Device
+	var members []*integrity.Integrity
+	for i := 0; i < 2; i++ {
+		disk := ramdisk.NewRAMDisk(sizeBytes)
+		mbr, err := integrity.NewIntegrity(disk, ramdisk.NewRAMDisk(integrity.MetaSize(sizeBytes)))
+		if err != nil {
+			t.Fatalf("Could not create integrity member: %s", err)
+		}
+		disks, members = append(disks, disk), append(members, mbr)
+	}
+	dev, err := NewMirror([]usbdlib.Device{members[0], members[1]}, "")
+	if err != nil {
+		t.Fatalf("Could not create device: %s", err)
+	}
+	defer dev.Close()
+
+	contents := make([]byte, sizeBytes)
+	writeRandom(t, dev, contents, 1, 50)
+
+	//Silently corrupt every other block of member 0, reads are served from and
+	// repair from member 1 rather than degrading member 0
+	for pos := int64(0); pos < sizeBytes; pos += 8192 {
+		disks[0].WriteAt([]byte{^contents[pos+100]}, pos+100)
+	}
+	for i := 0; i < 4; i++ { //Round-robin reads are served by each member
+		expectContents(t, "mirror with a corrupt member", dev, contents)
+	}
+	expectStates(t, dev, MemberActive, MemberActive)
+	if report, err := members[0].Scrub(); err != nil {
+		t.Fatalf("Could not scrub member 0: %s", err)
+	} else if len(report.BadOffsets) > 0 {
+		t.Fatalf("Member 0 still had %d corrupt blocks after being read", len(report.BadOffsets))
+	}
+
+	//Corruption found by scrubbing is repaired explicitly
+	disks[1].WriteAt([]byte{^contents[5000]}, 5000)
+	report, err := members[1].Scrub()
+	if err != nil {
+		t.Fatalf("Could not scrub member 1: %s", err)
+	} else if len(report.BadOffsets) != 1 || report.BadOffsets[0] != 4096 {
+		t.Fatalf("Scrub of member 1 found corrupt blocks at %v rather than [4096]", report.BadOffsets)
+	}
+	if repaired, err := dev.Repair(report.BadOffsets[0], 4096); err != nil {
+		t.Fatalf("Could not repair: %s", err)
+	} else if repaired != 1 {
+		t.Fatalf("Repaired %d members rather than 1", repaired)
+	}
+	expectContents(t, "member 1", members[1], contents)
+}
+
+func TestPowerLoss(t *testing.T) {
+	metaFile := filepath.Join(t.TempDir(), "mirror.meta")
+	testutil.TestPowerLoss(t, testutil.CrashConfig{}, func(disk usbdlib.Device, create bool) (usbdlib.Device, error) {
+		return NewMirror(testutil.Partitions(disk, 2), metaFile, OptRegionBytes(256*1024))
+	})
+}
+
+func TestConcurrentDegrade(t *testing.T) {
+	const sizeBytes = 4 * 1024 * 1024
+
+	disks := make([]*testutil.Unclosable, 3)
+	members := make([]*testutil.FailingDevice, len(disks))
+	devs := make([]usbdlib.Device, len(disks))
+	for i := range disks {
+		disks[i] = testutil.NewUnclosable(ramdisk.NewRAMDisk(sizeBytes))
+		members[i] = testutil.NewFailingDevice(disks[i])
+		devs[i] = members[i]
+	}
+	metaFile := filepath.Join(t.TempDir(), "mirror.meta")
+	dev, err := NewMirror(devs, metaFile, OptRegionBytes(64*1024))
+	if err != nil {
+		t.Fatalf("Could not create device: %s", err)
+	}
+
+	//Two members fail while writes are in progress, both failures are persisted
+	members[1].Failing.Set(true)
+	members[2].Failing.Set(true)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := make([]byte, 4096)
+			for j := 0; j < 16; j++ {
+				dev.WriteAt(data, int64(i*16+j)*4096)
+			}
+		}(i)
+	}
+	wg.Wait()
+	expectStates(t, dev, MemberActive, MemberDegraded, MemberDegraded)
+	if err = dev.Close(); err != nil {
+		t.Fatalf("Could not close device: %s", err)
+	}
+
+	reopened, err := NewMirror([]usbdlib.Device{disks[0], disks[1], disks[2]}, metaFile, OptRegionBytes(64*1024))
+	if err != nil {
+		t.Fatalf("Could not reopen device: %s", err)
+	}
+	defer reopened.Close()
+	expectStates(t, reopened, MemberActive, MemberDegraded, MemberDegraded)
+}
@@ -0,0 +1,44 @@
+package mirror
+
+//Option is a mirror device option
+type Option interface {
+	apply(*Mirror)
+}
+
+//ReadPolicy determines which member of a mirror serves each read
+type ReadPolicy uint8
+
+const (
+	//ReadRoundRobin spreads reads evenly across all in-sync members
+	ReadRoundRobin ReadPolicy = iota
+	//ReadFastest sends reads to the member with the lowest recent read latency,
+	// occasionally sampling the others so their latency estimates stay current
+	ReadFastest
+)
+
+func (policy ReadPolicy) String() string {
+	switch policy {
+	case ReadRoundRobin:
+		return "round-robin"
+	case ReadFastest:
+		return "fastest"
+	}
+	return "unknown"
+}
+
+//OptReadPolicy instructs a Mirror device to select members to read from using
+// the provided policy
+type OptReadPolicy ReadPolicy
+
+func (policy OptReadPolicy) apply(dev *Mirror) {
+	dev.readPolicy = ReadPolicy(policy)
+}
+
+//OptRegionBytes instructs a Mirror device to track writes in its write-intent
+// bitmap at this granularity. Smaller regions mean less data is resynced after
+// a crash or re-add at the cost of a larger bitmap and more bitmap updates.
+type OptRegionBytes int64
+
+func (size OptRegionBytes) apply(dev *Mirror) {
+	dev.regionBytes = int64(size)
+}
@@ -0,0 +1,96 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/devices/integrity"
+)
+
+//Repair reads the provided range from every active member and rewrites it on the
+// members whose copy fails an integrity check (see integrity.Integrity) with the
+// copy of a member whose passes. It returns the number of members repaired. Reads
+// repair members in this way automatically, so this is only needed for ranges
+// found to be corrupt by other means, such as scrubbing the members.
+func (dev *Mirror) Repair(pos, count int64) (repaired int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case count < 1 || pos >= dev.size:
+		return 0, nil
+	}
+	end := pos + count
+	if end > dev.size {
+		end = dev.size
+	}
+
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+
+	buf := make([]byte, dev.regionBytes)
+	for pos < end { //Region by region to bound memory use
+		next := (pos/dev.regionBytes + 1) * dev.regionBytes
+		if next > end {
+			next = end
+		}
+		n, err := dev.repair(buf[:next-pos], pos, false)
+		if repaired += n; err != nil {
+			return repaired, err
+		}
+		pos = next
+	}
+	return repaired, nil
+}
+
+//repair reads the blocks covering a range from every active member, until one
+// passes its integrity check, and rewrites them on those that fail it; buf is
+// filled from the intact copy. Writes to the range are blocked meanwhile, the
+// caller must hold membersMu and indicate if it already holds the region locks
+// exclusively.
+func (dev *Mirror) repair(buf []byte, pos int64, regionsLocked bool) (repaired int, err error) {
+	if !regionsLocked {
+		unlock := dev.lockRegions(pos/dev.regionBytes, (pos+int64(len(buf))-1)/dev.regionBytes, true)
+		defer unlock()
+	}
+
+	//Whole blocks are rewritten as members verify partially written blocks
+	start := pos - pos%dev.blockSize
+	end := (pos + int64(len(buf)) + dev.blockSize - 1) / dev.blockSize * dev.blockSize
+	span, scratch := make([]byte, end-start), make([]byte, end-start)
+
+	var corrupt []int
+	intact := false
+	for i, mbr := range dev.members {
+		if mbr.state() != MemberActive {
+			continue
+		}
+		dst := span
+		if intact {
+			dst = scratch
+		}
+		n, err := mbr.dev.ReadAt(dst, start)
+		switch {
+		case err == nil || (err == io.EOF && n == len(dst)):
+			intact = true
+		case errors.Is(err, integrity.ErrIntegrity):
+			corrupt = append(corrupt, i)
+		}
+	}
+	if !intact {
+		return 0, fmt.Errorf("No member has an intact copy of %d bytes at offset %d", len(buf), pos)
+	}
+	copy(buf, span[pos-start:])
+
+	for _, i := range corrupt {
+		if _, err := dev.members[i].dev.WriteAt(span, start); err != nil {
+			dev.degrade(dev.members[i], err)
+			continue
+		}
+		log.Printf("Mirror::repair(): WARNING: Repaired %d bytes at offset %d of member %d from an intact copy", len(span), start, i)
+		repaired++
+	}
+	return repaired, nil
+}
@@ -0,0 +1,230 @@
+package mirror
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/bitmap"
+)
+
+//Progress is invoked after each region is copied during a resync with the number
+// of bytes copied so far and the total number of bytes to copy
+type Progress func(syncedBytes, totalBytes int64)
+
+//AddMember adds a new member to the mirror and copies the full contents of the
+// mirror to it, during which it receives writes but does not serve reads. The
+// new member is appended to the member list. IO continues during the resync.
+func (dev *Mirror) AddMember(newDev usbdlib.Device, progress Progress) error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+	if err := dev.checkNewMember(newDev); err != nil {
+		return err
+	}
+
+	dev.syncMu.Lock()
+	defer dev.syncMu.Unlock()
+
+	mbr := newMember(newDev, MemberSyncing)
+	dev.membersMu.Lock()
+	err := dev.updateStates(func() bool {
+		dev.members = append(dev.members, mbr)
+		return true
+	})
+	dev.membersMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return dev.resync(mbr, nil, progress)
+}
+
+//ReplaceMember closes the member at the provided index and replaces it with a new
+// device that is then fully resynced. The last active member can not be replaced.
+func (dev *Mirror) ReplaceMember(idx int, newDev usbdlib.Device, progress Progress) error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+	if err := dev.checkNewMember(newDev); err != nil {
+		return err
+	}
+
+	dev.syncMu.Lock()
+	defer dev.syncMu.Unlock()
+
+	dev.membersMu.Lock()
+	if idx < 0 || idx >= len(dev.members) {
+		dev.membersMu.Unlock()
+		return fmt.Errorf("Mirror has no member %d", idx)
+	}
+	old := dev.members[idx]
+	if old.state() == MemberActive && dev.activeCount() < 2 {
+		dev.membersMu.Unlock()
+		return fmt.Errorf("Member %d is the last active member", idx)
+	}
+	mbr := newMember(newDev, MemberSyncing)
+	err := dev.updateStates(func() bool {
+		dev.members[idx] = mbr
+		return true
+	})
+	dev.membersMu.Unlock()
+
+	if closeErr := old.dev.Close(); closeErr != nil {
+		log.Printf("Mirror::ReplaceMember(): WARNING: Could not close replaced member %d; Details: %s", idx, closeErr)
+	}
+	if err != nil {
+		return err
+	}
+	return dev.resync(mbr, nil, progress)
+}
+
+//ReaddMember returns a degraded member to service by resyncing only the regions
+// written since it was degraded (or all regions if it is stale)
+func (dev *Mirror) ReaddMember(idx int, progress Progress) error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	dev.syncMu.Lock()
+	defer dev.syncMu.Unlock()
+
+	dev.membersMu.Lock()
+	if idx < 0 || idx >= len(dev.members) {
+		dev.membersMu.Unlock()
+		return fmt.Errorf("Mirror has no member %d", idx)
+	}
+	mbr := dev.members[idx]
+	if state := mbr.state(); state != MemberDegraded && state != MemberStale {
+		dev.membersMu.Unlock()
+		return fmt.Errorf("Member %d is %s rather than degraded", idx, state)
+	}
+	var regions *bitmap.Bitmap
+	err := dev.updateStates(func() bool {
+		if mbr.state() == MemberDegraded {
+			regions = dev.intent.Clone()
+		}
+		mbr.setState(MemberSyncing)
+		return true
+	})
+	dev.membersMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return dev.resync(mbr, regions, progress)
+}
+
+func (dev *Mirror) checkNewMember(newDev usbdlib.Device) error {
+	switch {
+	case newDev.Size() < dev.size:
+		return fmt.Errorf("New member size %d is smaller than the mirror size %d", newDev.Size(), dev.size)
+	case dev.blockSize%newDev.BlockSize() != 0:
+		return fmt.Errorf("New member block size %d is incompatible with block size %d", newDev.BlockSize(), dev.blockSize)
+	}
+	return nil
+}
+
+//resyncAfterCrash copies the regions that were being written when the mirror was
+// last shut down from the first active member to the other active members
+func (dev *Mirror) resyncAfterCrash() error {
+	if dev.intent.Count() < 1 {
+		return nil
+	}
+
+	//The first active member is the source, so the others stop serving reads
+	var targets []*member
+	for _, mbr := range dev.members {
+		if mbr.state() == MemberActive {
+			targets = append(targets, mbr)
+		}
+	}
+	targets = targets[1:]
+	for _, mbr := range targets {
+		mbr.setState(MemberSyncing)
+	}
+	for _, mbr := range targets {
+		if err := dev.resync(mbr, dev.intent.Clone(), nil); err != nil {
+			log.Printf("Mirror::resyncAfterCrash(): WARNING: %s", err)
+		}
+	}
+
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+	return dev.flush()
+}
+
+//resync copies the provided regions (or all regions if nil) to a syncing member
+// and then marks it active
+func (dev *Mirror) resync(mbr *member, regions *bitmap.Bitmap, progress Progress) error {
+	if regions == nil {
+		regions = bitmap.New(dev.intent.Len())
+		regions.SetRange(0, regions.Len())
+	}
+
+	var synced, total int64
+	for region := regions.NextSet(0); region >= 0; region = regions.NextSet(region + 1) {
+		total += dev.regionLen(region)
+	}
+	if progress != nil {
+		progress(0, total)
+	}
+
+	buf := make([]byte, dev.regionBytes)
+	for region := regions.NextSet(0); region >= 0; region = regions.NextSet(region + 1) {
+		if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+			return errClosed
+		}
+		if err := dev.copyRegion(mbr, region, buf); err != nil {
+			return fmt.Errorf("Resync failed: %w", err)
+		}
+		if synced += dev.regionLen(region); progress != nil {
+			progress(synced, total)
+		}
+	}
+
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+	activated := false
+	err := dev.updateStates(func() bool {
+		activated = atomic.CompareAndSwapUint32(&mbr.atomicState, uint32(MemberSyncing), uint32(MemberActive))
+		return activated
+	})
+	if !activated {
+		return fmt.Errorf("Member failed during resync: %w", mbr.status().Err)
+	}
+	return err
+}
+
+func (dev *Mirror) regionLen(region int64) int64 {
+	if start := region * dev.regionBytes; start+dev.regionBytes > dev.size {
+		return dev.size - start
+	}
+	return dev.regionBytes
+}
+
+//copyRegion copies a region from an active member to a syncing member while
+// writes to the region are blocked
+func (dev *Mirror) copyRegion(mbr *member, region int64, buf []byte) error {
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+
+	lock := &dev.regionLocks[region%lockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	if mbr.state() != MemberSyncing {
+		return fmt.Errorf("Member failed during resync: %w", mbr.status().Err)
+	}
+
+	pos := region * dev.regionBytes
+	buf = buf[:dev.regionLen(region)]
+	if _, err := dev.readMember(buf, pos, nil, true); err != nil && err != io.EOF {
+		return fmt.Errorf("Could not read region %d: %w", region, err)
+	}
+	if _, err := mbr.dev.WriteAt(buf, pos); err != nil {
+		dev.degrade(mbr, err)
+		return fmt.Errorf("Could not write region %d: %w", region, err)
+	}
+	return nil
+}
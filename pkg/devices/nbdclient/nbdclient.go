@@ -0,0 +1,560 @@
+package nbdclient
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed   = consterr.ConstErr("Device is shutdown")
+	errReadOnly = consterr.ConstErr("Export is read-only")
+)
+
+const (
+	//DefMaxInFlight is the default number of outstanding requests per Client
+	DefMaxInFlight = 64
+	//DefMaxRequestBytes is the default largest read or write request sent
+	DefMaxRequestBytes = 1024 * 1024
+	//DefDialTimeout is the default time allowed to connect and negotiate
+	DefDialTimeout = 10 * time.Second
+	//DefReconnectAttempts is the default number of reconnection attempts
+	DefReconnectAttempts = 5
+	//DefReconnectDelay is the default delay before the first reconnection attempt
+	DefReconnectDelay = 100 * time.Millisecond
+
+	maxReconnectDelay = 10 * time.Second
+)
+
+//Client is a device that proxies an export of a remote NBD server (ex. qemu-nbd,
+// nbdkit or another usbd) over TCP or a Unix socket. Requests are pipelined and
+// lost connections are reestablished with outstanding requests being resent.
+type Client struct {
+	network, addr     string
+	exportName        string
+	export            usbdlib.NbdExport
+	blockSize         int64
+	maxInFlight       int
+	maxRequest        int64
+	dialTimeout       time.Duration
+	reconnectAttempts int
+	reconnectDelay    time.Duration
+
+	inFlight chan struct{}
+	//Aligned requests RLock, read-modify-write of partial blocks Locks
+	rmwMu sync.RWMutex
+
+	mu         sync.Mutex
+	conn       *clientConn //nil while reconnecting
+	pending    map[uint64]*call
+	nextHandle uint64
+	failErr    error
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	closeOnce sync.Once
+	runDone   chan struct{}
+}
+
+var _ usbdlib.Device = (*Client)(nil)
+
+type clientConn struct {
+	net.Conn
+	rdr   *bufio.Reader
+	wtrMu sync.Mutex
+	wtr   *bufio.Writer
+}
+
+type call struct {
+	handle uint64
+	cmd    usbdlib.NbdCmd
+	pos    int64
+	count  int
+	buf    []byte //Destination of reads and source of writes
+	done   chan error
+}
+
+//NewClient connects to the NBD server at the provided address (ex. "tcp",
+// "host:10809" or "unix", "/run/nbd.sock") and negotiates an export
+func NewClient(ctx context.Context, network, addr string, options ...Option) (*Client, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	client := &Client{
+		network:           network,
+		addr:              addr,
+		maxInFlight:       DefMaxInFlight,
+		maxRequest:        DefMaxRequestBytes,
+		dialTimeout:       DefDialTimeout,
+		reconnectAttempts: DefReconnectAttempts,
+		reconnectDelay:    DefReconnectDelay,
+		pending:           make(map[uint64]*call),
+		ctx:               ctx,
+		ctxCancel:         cancel,
+		runDone:           make(chan struct{}),
+	}
+	for _, opt := range options {
+		opt.apply(client)
+	}
+
+	switch {
+	case client.maxInFlight < 1:
+		cancel()
+		return nil, fmt.Errorf("Maximum in-flight requests must be at least one")
+	case client.maxRequest < 1:
+		cancel()
+		return nil, fmt.Errorf("Maximum request size must be at least one byte")
+	}
+	client.inFlight = make(chan struct{}, client.maxInFlight)
+
+	conn, err := client.dial()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	client.blockSize = exportBlockSize(client.export)
+
+	//Requests must be aligned to the export's minimum block size
+	if client.maxRequest > client.export.MaxBlockSize {
+		client.maxRequest = client.export.MaxBlockSize
+	}
+	if client.maxRequest -= client.maxRequest % client.export.MinBlockSize; client.maxRequest < 1 {
+		client.maxRequest = client.export.MinBlockSize
+	}
+
+	client.conn = conn
+	go client.run(conn)
+	go func() {
+		<-ctx.Done()
+		client.shutdown()
+	}()
+	return client, nil
+}
+
+//dial connects and negotiates the export, populating client.export the first
+// time and ensuring it has not changed on subsequent calls
+func (client *Client) dial() (*clientConn, error) {
+	dialer := net.Dialer{Timeout: client.dialTimeout}
+	netConn, err := dialer.DialContext(client.ctx, client.network, client.addr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to NBD server %s %q: %w", client.network, client.addr, err)
+	}
+
+	netConn.SetDeadline(time.Now().Add(client.dialTimeout))
+	exp, err := usbdlib.NbdClientHandshake(netConn, client.exportName)
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("Could not negotiate export %q with NBD server %q: %w", client.exportName, client.addr, err)
+	}
+	netConn.SetDeadline(time.Time{})
+	if err = validateExport(exp); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	if client.export.Size == 0 {
+		client.export = exp
+	} else if exp.Size != client.export.Size || exp.MinBlockSize > client.export.MinBlockSize {
+		netConn.Close()
+		return nil, fmt.Errorf("Export %q changed since the initial connection", client.exportName)
+	}
+
+	return &clientConn{
+		Conn: netConn,
+		rdr:  bufio.NewReaderSize(netConn, 256*1024),
+		wtr:  bufio.NewWriterSize(netConn, 256*1024),
+	}, nil
+}
+
+//validateExport checks the size and block size constraints of an export
+func validateExport(exp usbdlib.NbdExport) error {
+	switch {
+	case exp.Size < 1:
+		return fmt.Errorf("Export %q is empty", exp.Name)
+	case !isPowerOfTwo(exp.MinBlockSize) || !isPowerOfTwo(exp.PrefBlockSize) || !isPowerOfTwo(exp.MaxBlockSize):
+		return fmt.Errorf("Export %q block sizes (minimum %d, preferred %d, maximum %d) are not powers of two", exp.Name, exp.MinBlockSize, exp.PrefBlockSize, exp.MaxBlockSize)
+	case exp.MinBlockSize > exp.PrefBlockSize || exp.PrefBlockSize > exp.MaxBlockSize:
+		return fmt.Errorf("Export %q block sizes (minimum %d, preferred %d, maximum %d) are out of order", exp.Name, exp.MinBlockSize, exp.PrefBlockSize, exp.MaxBlockSize)
+	case exp.Size%exp.MinBlockSize != 0:
+		return fmt.Errorf("Export %q size %d is not a multiple of its minimum block size %d", exp.Name, exp.Size, exp.MinBlockSize)
+	}
+	return nil
+}
+
+//exportBlockSize returns the preferred block size of a valid export, or the
+// largest smaller one its size is a multiple of
+func exportBlockSize(exp usbdlib.NbdExport) int64 {
+	blockSize := exp.PrefBlockSize
+	for exp.Size%blockSize != 0 {
+		blockSize /= 2
+	}
+	return blockSize
+}
+
+func isPowerOfTwo(val int64) bool {
+	return val > 0 && val&(val-1) == 0
+}
+
+//Size of this device in bytes
+func (client *Client) Size() int64 {
+	return client.export.Size
+}
+
+//BlockSize is the preferred block size of the remote export, or if the export
+// size is not a multiple of it the largest smaller size that it is
+func (client *Client) BlockSize() int64 {
+	return client.blockSize
+}
+
+//Export returns details about the remote export as negotiated with the server
+func (client *Client) Export() usbdlib.NbdExport {
+	return client.export
+}
+
+//ReadOnly is true if the remote export is read-only, fulfilling usbdlib.ReadOnlyDevice
+func (client *Client) ReadOnly() bool {
+	return client.export.ReadOnly()
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (client *Client) ReadAt(buf []byte, pos int64) (count int, err error) {
+	if client.ctx.Err() != nil {
+		return 0, errClosed
+	} else if pos >= client.export.Size {
+		return 0, io.EOF
+	}
+	if end := pos + int64(len(buf)); end > client.export.Size {
+		buf, err = buf[:client.export.Size-pos], io.EOF
+	}
+
+	start, end := client.alignedSpan(pos, len(buf))
+	client.rmwMu.RLock()
+	defer client.rmwMu.RUnlock()
+
+	if start == pos && end == pos+int64(len(buf)) {
+		if rwErr := client.transfer(usbdlib.NbdCmdRead, buf, pos); rwErr != nil {
+			return 0, rwErr
+		}
+		return len(buf), err
+	}
+
+	span := make([]byte, end-start)
+	if rwErr := client.transfer(usbdlib.NbdCmdRead, span, start); rwErr != nil {
+		return 0, rwErr
+	}
+	return copy(buf, span[pos-start:]), err
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (client *Client) WriteAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case client.ctx.Err() != nil:
+		return 0, errClosed
+	case client.export.ReadOnly():
+		return 0, errReadOnly
+	case pos+int64(len(buf)) > client.export.Size:
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	start, end := client.alignedSpan(pos, len(buf))
+	if start == pos && end == pos+int64(len(buf)) {
+		client.rmwMu.RLock()
+		defer client.rmwMu.RUnlock()
+
+		if err = client.transfer(usbdlib.NbdCmdWrite, buf, pos); err != nil {
+			return 0, err
+		}
+		return len(buf), nil
+	}
+
+	//Partial blocks require read-modify-write which must exclude other writers
+	client.rmwMu.Lock()
+	defer client.rmwMu.Unlock()
+
+	span := make([]byte, end-start)
+	if err = client.transfer(usbdlib.NbdCmdRead, span, start); err != nil {
+		return 0, fmt.Errorf("Could not read partial block to be modified: %w", err)
+	}
+	copy(span[pos-start:], buf)
+	if err = client.transfer(usbdlib.NbdCmdWrite, span, start); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+//Trim fufills part of usbdlib.Device; only whole minimum sized blocks of the
+// export are trimmed and trim is a no-op if the server does not support it
+func (client *Client) Trim(pos int64, count int) error {
+	switch {
+	case client.ctx.Err() != nil:
+		return errClosed
+	case !client.export.CanTrim() || client.export.ReadOnly():
+		return nil
+	}
+
+	minBlock := client.export.MinBlockSize
+	maxLen := int64(^uint32(0)) / minBlock * minBlock
+	start := (pos + minBlock - 1) / minBlock * minBlock
+	end := (pos + int64(count)) / minBlock * minBlock
+	for start < end {
+		length := end - start
+		if length > maxLen {
+			length = maxLen
+		}
+		if err := client.do(usbdlib.NbdCmdTrim, start, int(length), nil); err != nil {
+			return err
+		}
+		start += length
+	}
+	return nil
+}
+
+//Flush fufills part of usbdlib.Device
+func (client *Client) Flush() error {
+	switch {
+	case client.ctx.Err() != nil:
+		return errClosed
+	case !client.export.CanFlush():
+		return nil
+	}
+	return client.do(usbdlib.NbdCmdFlush, 0, 0, nil)
+}
+
+//Close disconnects from the server, requests that have not completed fail
+func (client *Client) Close() error {
+	client.shutdown()
+	<-client.runDone
+	return nil
+}
+
+func (client *Client) shutdown() {
+	client.closeOnce.Do(func() {
+		client.mu.Lock()
+		client.ctxCancel()
+		conn := client.conn
+		client.mu.Unlock()
+
+		if conn != nil {
+			conn.send(&call{cmd: usbdlib.NbdCmdDisconnect})
+			conn.Close()
+		}
+	})
+}
+
+//alignedSpan returns the range, aligned to the minimum block size of the export,
+// that covers count bytes from pos
+func (client *Client) alignedSpan(pos int64, count int) (start, end int64) {
+	minBlock := client.export.MinBlockSize
+	return pos / minBlock * minBlock, (pos + int64(count) + minBlock - 1) / minBlock * minBlock
+}
+
+//transfer splits reads and writes into requests no larger than the maximum
+// request size and issues them concurrently
+func (client *Client) transfer(cmd usbdlib.NbdCmd, buf []byte, pos int64) error {
+	if int64(len(buf)) <= client.maxRequest {
+		return client.do(cmd, pos, len(buf), buf)
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 1)
+	for offset := int64(0); offset < int64(len(buf)); offset += client.maxRequest {
+		end := offset + client.maxRequest
+		if end > int64(len(buf)) {
+			end = int64(len(buf))
+		}
+
+		wg.Add(1)
+		go func(chunk []byte, chunkPos int64) {
+			defer wg.Done()
+			if err := client.do(cmd, chunkPos, len(chunk), chunk); err != nil {
+				select {
+				case errCh <- err:
+				default:
+				}
+			}
+		}(buf[offset:end], pos+offset)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return nil
+	}
+}
+
+//do sends a request to the server and waits for its reply
+func (client *Client) do(cmd usbdlib.NbdCmd, pos int64, count int, buf []byte) error {
+	select {
+	case client.inFlight <- struct{}{}:
+		defer func() { <-client.inFlight }()
+	case <-client.ctx.Done():
+		return errClosed
+	}
+
+	req := &call{cmd: cmd, pos: pos, count: count, buf: buf, done: make(chan error, 1)}
+
+	client.mu.Lock()
+	switch {
+	case client.ctx.Err() != nil:
+		client.mu.Unlock()
+		return errClosed
+	case client.failErr != nil:
+		client.mu.Unlock()
+		return client.failErr
+	}
+	client.nextHandle++
+	req.handle = client.nextHandle
+	client.pending[req.handle] = req
+	conn := client.conn
+	client.mu.Unlock()
+
+	//If disconnected the request will be sent upon reconnection
+	if conn != nil {
+		if err := conn.send(req); err != nil {
+			conn.Close() //The reply reader will notice and reconnect
+		}
+	}
+
+	if err := <-req.done; err != nil {
+		return fmt.Errorf("NBD request (cmd = %d, pos = %d, count = %d) failed: %w", cmd, pos, count, err)
+	}
+	return nil
+}
+
+func (conn *clientConn) send(req *call) error {
+	conn.wtrMu.Lock()
+	defer conn.wtrMu.Unlock()
+
+	var data []byte
+	if req.cmd == usbdlib.NbdCmdWrite {
+		data = req.buf
+	}
+	if err := usbdlib.WriteNbdRequest(conn.wtr, req.cmd, req.handle, req.pos, req.count, data); err != nil {
+		return err
+	}
+	return conn.wtr.Flush()
+}
+
+//run reads replies, completing outstanding requests, and reconnects if the
+// connection to the server is lost
+func (client *Client) run(conn *clientConn) {
+	defer close(client.runDone)
+
+	for {
+		err := client.readReplies(conn)
+		conn.Close()
+		if client.ctx.Err() != nil {
+			client.failPending(errClosed)
+			return
+		}
+
+		log.Printf("nbdclient::run(): WARNING: Lost connection to NBD server %q, reconnecting; Details: %s", client.addr, err)
+		client.mu.Lock()
+		client.conn = nil
+		client.mu.Unlock()
+
+		if conn, err = client.reconnect(); err != nil {
+			if client.ctx.Err() != nil {
+				err = errClosed
+			} else {
+				err = fmt.Errorf("Could not reconnect to NBD server %q: %w", client.addr, err)
+				log.Printf("nbdclient::run(): ERROR: %s", err)
+			}
+			client.mu.Lock()
+			client.failErr = err
+			client.mu.Unlock()
+			client.failPending(err)
+			return
+		}
+
+		//Resend everything that was outstanding, oldest first
+		client.mu.Lock()
+		client.conn = conn
+		resend := make([]*call, 0, len(client.pending))
+		for _, req := range client.pending {
+			resend = append(resend, req)
+		}
+		client.mu.Unlock()
+
+		sort.Slice(resend, func(i, j int) bool { return resend[i].handle < resend[j].handle })
+		for _, req := range resend {
+			if err = conn.send(req); err != nil {
+				conn.Close()
+				break
+			}
+		}
+	}
+}
+
+func (client *Client) reconnect() (*clientConn, error) {
+	delay := client.reconnectDelay
+	var err error
+	for attempt := 0; attempt < client.reconnectAttempts; attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-client.ctx.Done():
+			return nil, errClosed
+		}
+
+		var conn *clientConn
+		if conn, err = client.dial(); err == nil {
+			return conn, nil
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("Reconnection is disabled")
+	}
+	return nil, err
+}
+
+func (client *Client) readReplies(conn *clientConn) error {
+	for {
+		handle, replyErr, err := usbdlib.ReadNbdReply(conn.rdr)
+		if err != nil {
+			return err
+		}
+
+		client.mu.Lock()
+		req := client.pending[handle]
+		client.mu.Unlock()
+		if req == nil {
+			return fmt.Errorf("Server replied to unknown request handle %d", handle)
+		}
+
+		if req.cmd == usbdlib.NbdCmdRead && replyErr == nil {
+			if _, err = io.ReadFull(conn.rdr, req.buf); err != nil {
+				return fmt.Errorf("Could not read data of reply: %w", err)
+			}
+		}
+
+		client.mu.Lock()
+		if client.pending[handle] == req {
+			delete(client.pending, handle)
+			req.done <- replyErr
+		}
+		client.mu.Unlock()
+	}
+}
+
+func (client *Client) failPending(err error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	for handle, req := range client.pending {
+		delete(client.pending, handle)
+		req.done <- err
+	}
+}
@@ -0,0 +1,267 @@
+package nbdclient
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+func TestNBDClient(t *testing.T) {
+	const sizeBytes = 128 * 1024 //128 KB
+
+	t.Run("tcp", func(t *testing.T) {
+		_, addr := startServer(t, "tcp", "127.0.0.1:0", map[string]int64{"": sizeBytes})
+		client, err := NewClient(testutil.CreateContext(t), "tcp", addr)
+		if err != nil {
+			t.Fatalf("Could not connect to NBD server: %s", err)
+		}
+		testutil.TestUserspace(t, client, sizeBytes)
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		sockPath := filepath.Join(t.TempDir(), "nbd.sock")
+		startServer(t, "unix", sockPath, map[string]int64{"small": sizeBytes / 2, "test": sizeBytes})
+		client, err := NewClient(testutil.CreateContext(t), "unix", sockPath, OptExportName("test"))
+		if err != nil {
+			t.Fatalf("Could not connect to NBD server: %s", err)
+		}
+		testutil.TestUserspace(t, client, sizeBytes)
+	})
+
+	t.Run("nbd", func(t *testing.T) {
+		_, addr := startServer(t, "tcp", "127.0.0.1:0", map[string]int64{"": sizeBytes})
+		client, err := NewClient(testutil.CreateContext(t), "tcp", addr)
+		if err != nil {
+			t.Fatalf("Could not connect to NBD server: %s", err)
+		}
+		testutil.TestNBD(t, client, sizeBytes)
+	})
+}
+
+func TestUnknownExport(t *testing.T) {
+	_, addr := startServer(t, "tcp", "127.0.0.1:0", map[string]int64{"a": 4096, "b": 4096})
+
+	if client, err := NewClient(context.Background(), "tcp", addr, OptExportName("c")); err == nil {
+		client.Close()
+		t.Fatalf("Connecting to an unknown export succeeded")
+	}
+	if client, err := NewClient(context.Background(), "tcp", addr); err == nil {
+		client.Close()
+		t.Fatalf("Connecting to the default export succeeded when there are several exports")
+	}
+}
+
+func TestBlockSizes(t *testing.T) {
+	//Servers not sending block sizes imply a preferred size of 4096 bytes, exports
+	// need only be a multiple of the minimum
+	exp := usbdlib.NbdExport{Size: 64*1024 + 512, MinBlockSize: 1, PrefBlockSize: 4096, MaxBlockSize: 1 << 25}
+	if err := validateExport(exp); err != nil {
+		t.Fatalf("Valid export was refused: %s", err)
+	}
+	if blockSize := exportBlockSize(exp); blockSize != 512 {
+		t.Fatalf("Block size of export of %d bytes was %d rather than 512", exp.Size, blockSize)
+	}
+
+	for _, exp := range []usbdlib.NbdExport{
+		{Size: 4096, MinBlockSize: 0, PrefBlockSize: 4096, MaxBlockSize: 1 << 25},
+		{Size: 4096, MinBlockSize: 512, PrefBlockSize: 0, MaxBlockSize: 1 << 25},
+		{Size: 4096, MinBlockSize: 512, PrefBlockSize: 4096, MaxBlockSize: 0},
+		{Size: 4096, MinBlockSize: 768, PrefBlockSize: 4096, MaxBlockSize: 1 << 25},
+		{Size: 4096, MinBlockSize: 4096, PrefBlockSize: 512, MaxBlockSize: 1 << 25},
+		{Size: 4096, MinBlockSize: 512, PrefBlockSize: 4096, MaxBlockSize: 1024},
+		{Size: 4000, MinBlockSize: 512, PrefBlockSize: 4096, MaxBlockSize: 1 << 25},
+		{Size: 0, MinBlockSize: 1, PrefBlockSize: 4096, MaxBlockSize: 1 << 25},
+	} {
+		if err := validateExport(exp); err == nil {
+			t.Fatalf("Export with invalid size or block sizes was accepted: %+v", exp)
+		}
+	}
+}
+
+func TestReadOnlyExport(t *testing.T) {
+	const sizeBytes = 64 * 1024
+
+	srv := usbdlib.NewNbdServer(context.Background())
+	defer srv.Close()
+	if err := srv.AddExport("", readOnlyDev{ramdisk.NewRAMDisk(sizeBytes)}); err != nil {
+		t.Fatalf("Could not add export: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	go srv.Serve(ln)
+
+	client, err := NewClient(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect to NBD server: %s", err)
+	}
+	defer client.Close()
+
+	if !usbdlib.IsReadOnly(client) {
+		t.Fatalf("Read-only export was not reported as read-only")
+	}
+	if _, err = client.ReadAt(make([]byte, 4096), 0); err != nil {
+		t.Fatalf("Could not read from read-only export: %s", err)
+	}
+	if _, err = client.WriteAt(make([]byte, 4096), 0); err == nil {
+		t.Fatalf("Write to read-only export succeeded")
+	}
+
+	//The server must refuse writes even if the client ignores the flag
+	if err = client.do(usbdlib.NbdCmdWrite, 0, 4096, make([]byte, 4096)); err == nil {
+		t.Fatalf("Server accepted a write to a read-only export")
+	}
+}
+
+type readOnlyDev struct {
+	usbdlib.Device
+}
+
+func (readOnlyDev) ReadOnly() bool {
+	return true
+}
+
+func TestPipelinedIO(t *testing.T) {
+	const (
+		sizeBytes   = 8 * 1024 * 1024
+		workerCount = 16
+		chunkBytes  = sizeBytes / workerCount
+	)
+
+	_, addr := startServer(t, "tcp", "127.0.0.1:0", map[string]int64{"": sizeBytes})
+	client, err := NewClient(context.Background(), "tcp", addr, OptMaxRequestBytes(64*1024), OptMaxInFlight(8))
+	if err != nil {
+		t.Fatalf("Could not connect to NBD server: %s", err)
+	}
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(workerCount)
+	for i := 0; i < workerCount; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			expected := bytes.Repeat([]byte{byte(i + 1)}, chunkBytes)
+			if _, err := client.WriteAt(expected, int64(i*chunkBytes)); err != nil {
+				t.Errorf("Worker %d could not write: %s", i, err)
+				return
+			}
+			actual := make([]byte, chunkBytes)
+			if _, err := client.ReadAt(actual, int64(i*chunkBytes)); err != nil {
+				t.Errorf("Worker %d could not read: %s", i, err)
+			} else if !bytes.Equal(expected, actual) {
+				t.Errorf("Worker %d read back different data than it wrote", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err = client.Trim(0, sizeBytes); err != nil {
+		t.Fatalf("Could not trim: %s", err)
+	}
+	if err = client.Flush(); err != nil {
+		t.Fatalf("Could not flush: %s", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	const sizeBytes = 1024 * 1024
+
+	ln, addr := startServer(t, "tcp", "127.0.0.1:0", map[string]int64{"": sizeBytes})
+	client, err := NewClient(context.Background(), "tcp", addr, OptReconnect{Attempts: 3, Delay: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Could not connect to NBD server: %s", err)
+	}
+	defer client.Close()
+
+	expected := bytes.Repeat([]byte("usbd"), 1024)
+	if _, err = client.WriteAt(expected, 0); err != nil {
+		t.Fatalf("Could not write: %s", err)
+	}
+
+	//Sever the connection server side, the next requests should be retried on a new one
+	ln.closeConns()
+	actual := make([]byte, len(expected))
+	for i := 0; i < 3; i++ {
+		if _, err = client.ReadAt(actual, 0); err != nil {
+			t.Fatalf("Read after connection loss failed: %s", err)
+		} else if !bytes.Equal(expected, actual) {
+			t.Fatalf("Read after connection loss returned the wrong data")
+		}
+	}
+	if ln.acceptCount() < 2 {
+		t.Fatalf("Client did not reconnect")
+	}
+
+	//With the server gone requests should eventually fail
+	ln.Close()
+	ln.closeConns()
+	if _, err = client.ReadAt(actual, 0); err == nil {
+		t.Fatalf("Read succeeded without a server")
+	}
+}
+
+//trackingListener records accepted connections so tests can sever them
+type trackingListener struct {
+	net.Listener
+	mu       sync.Mutex
+	conns    []net.Conn
+	accepted int
+}
+
+func (ln *trackingListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err == nil {
+		ln.mu.Lock()
+		ln.conns = append(ln.conns, conn)
+		ln.accepted++
+		ln.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (ln *trackingListener) closeConns() {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	for _, conn := range ln.conns {
+		conn.Close()
+	}
+	ln.conns = nil
+}
+
+func (ln *trackingListener) acceptCount() int {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	return ln.accepted
+}
+
+func startServer(t *testing.T, network, addr string, exports map[string]int64) (*trackingListener, string) {
+	srv := usbdlib.NewNbdServer(context.Background())
+	for name, size := range exports {
+		if err := srv.AddExport(name, ramdisk.NewRAMDisk(size)); err != nil {
+			t.Fatalf("Could not add export %q: %s", name, err)
+		}
+	}
+
+	rawLn, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatalf("Could not listen on %s %q: %s", network, addr, err)
+	}
+	ln := &trackingListener{Listener: rawLn}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		if err := srv.Close(); err != nil {
+			t.Errorf("Could not close NBD server: %s", err)
+		}
+	})
+	return ln, rawLn.Addr().String()
+}
@@ -0,0 +1,55 @@
+package nbdclient
+
+import (
+	"time"
+)
+
+//Option is an NBD client device option
+type Option interface {
+	apply(*Client)
+}
+
+//OptExportName instructs a Client to negotiate the named export rather than the
+// server's default export
+type OptExportName string
+
+func (name OptExportName) apply(client *Client) {
+	client.exportName = string(name)
+}
+
+//OptMaxInFlight instructs a Client to allow at most this many requests to be
+// outstanding with the server at once
+type OptMaxInFlight uint
+
+func (count OptMaxInFlight) apply(client *Client) {
+	client.maxInFlight = int(count)
+}
+
+//OptMaxRequestBytes instructs a Client to split reads and writes into requests
+// no larger than this (servers may impose a smaller limit)
+type OptMaxRequestBytes uint
+
+func (size OptMaxRequestBytes) apply(client *Client) {
+	client.maxRequest = int64(size)
+}
+
+//OptDialTimeout instructs a Client to abandon connection attempts that take
+// longer than this
+type OptDialTimeout time.Duration
+
+func (timeout OptDialTimeout) apply(client *Client) {
+	client.dialTimeout = time.Duration(timeout)
+}
+
+//OptReconnect instructs a Client how many times to try to reestablish a lost
+// connection before failing outstanding requests. The delay between attempts
+// starts at Delay and doubles after each failed attempt.
+type OptReconnect struct {
+	Attempts uint
+	Delay    time.Duration
+}
+
+func (reconnect OptReconnect) apply(client *Client) {
+	client.reconnectAttempts = int(reconnect.Attempts)
+	client.reconnectDelay = reconnect.Delay
+}
@@ -0,0 +1,464 @@
+package erasure
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	rs "github.com/tarndt/usbd/pkg/util/erasure"
+
+	"github.com/graymeta/stow"
+)
+
+//DefRepairQueueLen is the default number of objects that can be queued for
+// background repair, further objects are repaired when next read
+const DefRepairQueueLen = 256
+
+//Container is a stow.Container that erasure codes each object put into it into
+// data and parity shards stored in separate member containers (ideally with
+// different providers) so that objects survive the loss of as many members as
+// there are parity shards. Reads reassemble objects from any data-count valid
+// shards and shards found to be missing, corrupt or stale are repaired in the
+// background. Puts succeed as long as one more than data-count shards are stored
+// and never disturb the version being replaced until they do. Object metadata is
+// stored (as JSON) within the shards so members need not support metadata.
+type Container struct {
+	ctx        context.Context
+	members    []stow.Container
+	coder      *rs.Coder
+	dataCount  int
+	repairCh   chan string
+	onRepair   func(name string, repaired int, err error)
+	pendingMu  sync.Mutex
+	pending    map[string]bool
+	repairQLen int
+}
+
+var _ stow.Container = (*Container)(nil)
+
+//NewContainer constructs an erasure coded container storing shard i of each object
+// in members[i], so there must be exactly dataShards+parityShards members. Members
+// must be provided in the same order each time. Background repair stops when the
+// provided context is done.
+func NewContainer(ctx context.Context, dataShards, parityShards int, members []stow.Container, options ...Option) (*Container, error) {
+	switch {
+	case ctx == nil:
+		return nil, fmt.Errorf("Provided context was nil")
+	case len(members) != dataShards+parityShards:
+		return nil, fmt.Errorf("%d data and %d parity shards require %d member containers, not %d", dataShards, parityShards, dataShards+parityShards, len(members))
+	}
+	coder, err := rs.NewCoder(dataShards, parityShards)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create erasure coder: %w", err)
+	}
+
+	cont := &Container{
+		ctx:        ctx,
+		members:    members,
+		coder:      coder,
+		dataCount:  dataShards,
+		pending:    make(map[string]bool),
+		repairQLen: DefRepairQueueLen,
+	}
+	for _, opt := range options {
+		opt.apply(cont)
+	}
+	cont.repairCh = make(chan string, cont.repairQLen)
+	go cont.repairWorker()
+	return cont, nil
+}
+
+//ID of the container is derived from those of its members
+func (cont *Container) ID() string {
+	ids := make([]string, len(cont.members))
+	for i, member := range cont.members {
+		ids[i] = member.ID()
+	}
+	return "erasure(" + strings.Join(ids, ",") + ")"
+}
+
+//Name of the container is derived from those of its members, when all members
+// share a name it is used as is
+func (cont *Container) Name() string {
+	names := make([]string, len(cont.members))
+	for i, member := range cont.members {
+		names[i] = member.Name()
+	}
+	for _, name := range names[1:] {
+		if name != names[0] {
+			return strings.Join(names, "_")
+		}
+	}
+	return names[0]
+}
+
+//Item returns the object with the provided ID (name) if any of its shards exist
+func (cont *Container) Item(id string) (stow.Item, error) {
+	shards, err := cont.findShards(id)
+	if err != nil {
+		return nil, err
+	}
+	return &item{cont: cont, name: id, shards: shards}, nil
+}
+
+//Items lists objects with the provided prefix that have shards in any member. The
+// cursor is the name of the last object in the previous page. As many members as
+// there are parity shards may be unavailable.
+func (cont *Container) Items(prefix, cursor string, count int) ([]stow.Item, string, error) {
+	listings := make([][]stow.Item, len(cont.members))
+	errs := make([]error, len(cont.members))
+	cont.parallel(func(i int) {
+		listings[i], errs[i] = listAll(cont.members[i], prefix)
+	})
+	failed := 0
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if failed++; failed > len(cont.members)-cont.dataCount {
+			return nil, "", fmt.Errorf("Could not list member %d (%s): %w", i, cont.members[i].Name(), err)
+		}
+		log.Printf("Container::Items(): WARNING: Could not list member %d (%s); Details: %s", i, cont.members[i].Name(), err)
+	}
+
+	objects := make(map[string][][]shardRef)
+	for i, shards := range listings {
+		for _, shard := range shards {
+			name, index, generation, ok := parseShardName(shard.Name())
+			if !ok || index != i {
+				continue
+			}
+			if objects[name] == nil {
+				objects[name] = make([][]shardRef, len(cont.members))
+			}
+			objects[name][i] = append(objects[name][i], shardRef{item: shard, generation: generation})
+		}
+	}
+
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		if cursor == stow.CursorStart || name > cursor {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	next := stow.CursorStart
+	if count > 0 && len(names) > count {
+		names = names[:count]
+		next = names[count-1]
+	}
+	items := make([]stow.Item, len(names))
+	for i, name := range names {
+		items[i] = &item{cont: cont, name: name, shards: objects[name]}
+	}
+	return items, next, nil
+}
+
+func listAll(member stow.Container, prefix string) (all []stow.Item, err error) {
+	const pageSize = 1000
+	for cursor := stow.CursorStart; ; {
+		var items []stow.Item
+		if items, cursor, err = member.Items(prefix, cursor, pageSize); err != nil {
+			return nil, err
+		}
+		if all = append(all, items...); stow.IsCursorEnd(cursor) {
+			return all, nil
+		}
+	}
+}
+
+//shardRef is a shard object found in a member and the generation its name records
+type shardRef struct {
+	item       stow.Item
+	generation uint64
+}
+
+//listShards lists the shard objects of all versions of an object in each member
+func (cont *Container) listShards(name string) ([][]shardRef, []error) {
+	shards := make([][]shardRef, len(cont.members))
+	errs := make([]error, len(cont.members))
+	cont.parallel(func(i int) {
+		var listing []stow.Item
+		if listing, errs[i] = listAll(cont.members[i], name+shardSuffix); errs[i] != nil {
+			return
+		}
+		for _, shard := range listing {
+			if shardOf, index, generation, ok := parseShardName(shard.Name()); ok && shardOf == name && index == i {
+				shards[i] = append(shards[i], shardRef{item: shard, generation: generation})
+			}
+		}
+	})
+	return shards, errs
+}
+
+//findShards lists the shard objects of all versions of an object, as many members
+// as there are parity shards may be unavailable
+func (cont *Container) findShards(name string) ([][]shardRef, error) {
+	shards, errs := cont.listShards(name)
+	failed := 0
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if failed++; failed > len(cont.members)-cont.dataCount {
+			return nil, fmt.Errorf("Could not list shards of %q in member %d (%s): %w", name, i, cont.members[i].Name(), err)
+		}
+	}
+	for _, refs := range shards {
+		if len(refs) > 0 {
+			return shards, nil
+		}
+	}
+	return nil, stow.ErrNotFound
+}
+
+//olderShards returns the shards of versions older than the provided generation,
+// or nil if there are none
+func olderShards(shards [][]shardRef, generation uint64) [][]shardRef {
+	var older [][]shardRef
+	for i, refs := range shards {
+		for _, ref := range refs {
+			if ref.generation >= generation {
+				continue
+			}
+			if older == nil {
+				older = make([][]shardRef, len(shards))
+			}
+			older[i] = append(older[i], ref)
+		}
+	}
+	return older
+}
+
+//removeShards removes the provided shard objects from their members
+func (cont *Container) removeShards(name string, shards [][]shardRef) error {
+	errs := make([]error, len(cont.members))
+	cont.parallel(func(i int) {
+		for _, ref := range shards[i] {
+			if err := cont.members[i].RemoveItem(ref.item.ID()); err != nil && errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	})
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("Could not remove shard %d of %q: %w", i, name, err)
+		}
+	}
+	return nil
+}
+
+//RemoveItem removes all shards of an object
+func (cont *Container) RemoveItem(id string) error {
+	shards, errs := cont.listShards(id)
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("Could not list shards of %q in member %d (%s): %w", id, i, cont.members[i].Name(), err)
+		}
+	}
+	return cont.removeShards(id, shards)
+}
+
+//Put erasure codes an object and stores its shards in the members under names
+// unique to the new version. It succeeds if at least one more than data-count
+// shards are stored (all of them when there is no parity), so losing another
+// member leaves the object readable, and shards that could not be stored are
+// queued for repair. The shards of the versions replaced are only removed once
+// the Put succeeds, so a failed Put leaves the previous version intact.
+func (cont *Container) Put(name string, rdr io.Reader, size int64, metadata map[string]interface{}) (stow.Item, error) {
+	var data bytes.Buffer
+	if size > 0 {
+		data.Grow(int(size))
+	}
+	if _, err := data.ReadFrom(rdr); err != nil {
+		return nil, fmt.Errorf("Could not read object %q to erasure code: %w", name, err)
+	}
+
+	meta, err := encodeMeta(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode metadata of %q: %w", name, err)
+	}
+	hdr := shardHeader{
+		dataCount:   uint16(cont.dataCount),
+		parityCount: uint16(len(cont.members) - cont.dataCount),
+		size:        uint64(data.Len()),
+		generation:  uint64(time.Now().UnixNano()),
+		sum:         sha256.Sum256(data.Bytes()),
+	}
+	shards, err := cont.split(data.Bytes(), hdr.shardBytes())
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &item{cont: cont, name: name, shards: make([][]shardRef, len(cont.members)), hdr: &hdr, meta: metadata}
+	errs := make([]error, len(cont.members))
+	cont.parallel(func(i int) {
+		var shard stow.Item
+		if shard, errs[i] = cont.putShard(name, i, hdr, meta, shards[i]); errs[i] == nil {
+			obj.shards[i] = []shardRef{{item: shard, generation: hdr.generation}}
+		}
+	})
+
+	stored, firstErr := 0, error(nil)
+	for _, err := range errs {
+		if err == nil {
+			stored++
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	required := cont.dataCount + 1
+	if required > len(cont.members) {
+		required = len(cont.members)
+	}
+	if stored < required {
+		if err = cont.removeShards(name, obj.shards); err != nil {
+			log.Printf("Container::Put(): WARNING: Could not remove the shards of failed put of %q; Details: %s", name, err)
+		}
+		return nil, fmt.Errorf("Only %d of %d shards of %q were stored, at least %d are required: %w", stored, len(cont.members), name, required, firstErr)
+	}
+
+	//The new version is stored, so the versions it replaces can be removed
+	existing, _ := cont.listShards(name) //Versions in members that cannot be listed are removed by repair
+	if older := olderShards(existing, hdr.generation); older != nil {
+		if err = cont.removeShards(name, older); err != nil {
+			log.Printf("Container::Put(): WARNING: Could not remove replaced versions of %q, queuing repair; Details: %s", name, err)
+			cont.queueRepair(name)
+		}
+	}
+	if firstErr != nil {
+		log.Printf("Container::Put(): WARNING: Only %d of %d shards of %q were stored, queuing repair; Details: %s", stored, len(cont.members), name, firstErr)
+		cont.queueRepair(name)
+	}
+	return obj, nil
+}
+
+//split divides data into padded data shards and computes the parity shards
+func (cont *Container) split(data []byte, shardBytes int64) ([][]byte, error) {
+	padded := make([]byte, shardBytes*int64(len(cont.members)))
+	copy(padded, data)
+	shards := make([][]byte, len(cont.members))
+	for i := range shards {
+		shards[i] = padded[int64(i)*shardBytes : int64(i+1)*shardBytes]
+	}
+	if err := cont.coder.Encode(shards); err != nil {
+		return nil, fmt.Errorf("Could not erasure code object: %w", err)
+	}
+	return shards, nil
+}
+
+func encodeMeta(metadata map[string]interface{}) ([]byte, error) {
+	if len(metadata) < 1 {
+		return nil, nil
+	}
+	return json.Marshal(metadata)
+}
+
+func (cont *Container) putShard(name string, index int, hdr shardHeader, meta, payload []byte) (stow.Item, error) {
+	hdr.index, hdr.payloadCRC = uint16(index), crc32.ChecksumIEEE(payload)
+	prefix := hdr.marshal(meta)
+	rdr := io.MultiReader(bytes.NewReader(prefix), bytes.NewReader(payload))
+	shard, err := cont.members[index].Put(shardName(name, index, hdr.generation), rdr, int64(len(prefix)+len(payload)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not store shard %d of %q in %s: %w", index, name, cont.members[index].Name(), err)
+	}
+	return shard, nil
+}
+
+//Repair reads all shards of an object and rewrites any that are missing, corrupt
+// or stale, returning the number of shards rewritten. Shards left behind by
+// versions the current one replaced are removed.
+func (cont *Container) Repair(name string) (int, error) {
+	obj, err := cont.fetch(name, nil, true)
+	if err != nil {
+		return 0, err
+	}
+
+	repaired := 0
+	if len(obj.stale) > 0 {
+		if err = cont.coder.Reconstruct(obj.shards); err != nil {
+			return 0, fmt.Errorf("Could not reconstruct shards of %q: %w", name, err)
+		}
+		meta, err := encodeMeta(obj.meta)
+		if err != nil {
+			return 0, fmt.Errorf("Could not encode metadata of %q: %w", name, err)
+		}
+
+		for _, index := range obj.stale {
+			if _, err = cont.putShard(name, index, obj.hdr, meta, obj.shards[index]); err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+	}
+	if obj.obsolete != nil {
+		if err = cont.removeShards(name, obj.obsolete); err != nil {
+			return repaired, fmt.Errorf("Could not remove replaced versions of %q: %w", name, err)
+		}
+	}
+	return repaired, nil
+}
+
+//queueRepair schedules a background repair of an object unless one is pending
+func (cont *Container) queueRepair(name string) {
+	cont.pendingMu.Lock()
+	defer cont.pendingMu.Unlock()
+	if cont.pending[name] {
+		return
+	}
+
+	select {
+	case cont.repairCh <- name:
+		cont.pending[name] = true
+	default: //Queue is full, the object will be requeued when next read
+	}
+}
+
+func (cont *Container) repairWorker() {
+	for {
+		select {
+		case <-cont.ctx.Done():
+			return
+		case name := <-cont.repairCh:
+			cont.pendingMu.Lock()
+			delete(cont.pending, name)
+			cont.pendingMu.Unlock()
+
+			repaired, err := cont.Repair(name)
+			if err != nil {
+				log.Printf("Container::repairWorker(): WARNING: Could not repair %q; Details: %s", name, err)
+			}
+			if cont.onRepair != nil {
+				cont.onRepair(name, repaired, err)
+			}
+		}
+	}
+}
+
+//parallel runs op concurrently for each member index and waits for them
+func (cont *Container) parallel(op func(i int)) {
+	cont.parallelN(len(cont.members), op)
+}
+
+//parallelN runs op concurrently for each index in [0, count) and waits for them
+func (cont *Container) parallelN(count int, op func(i int)) {
+	var wg sync.WaitGroup
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			defer wg.Done()
+			op(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,276 @@
+package erasure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	rs "github.com/tarndt/usbd/pkg/util/erasure"
+
+	"github.com/graymeta/stow"
+	"github.com/graymeta/stow/local"
+)
+
+const (
+	dataShards   = 3
+	parityShards = 2
+)
+
+//testMember wraps a container so its puts can be made to fail
+type testMember struct {
+	stow.Container
+	dir     string
+	failing testutil.Switch
+}
+
+func (mbr *testMember) Put(name string, rdr io.Reader, size int64, metadata map[string]interface{}) (stow.Item, error) {
+	if mbr.failing.On() {
+		return nil, fmt.Errorf("Injected put failure")
+	}
+	return mbr.Container.Put(name, rdr, size, metadata)
+}
+
+//shardPath returns the local file holding a shard, or "" unless exactly one version
+// of it is stored
+func (mbr *testMember) shardPath(name string, index int) string {
+	matches, _ := filepath.Glob(filepath.Join(mbr.dir, "test", name+shardSuffix+strconv.Itoa(index)+".*"))
+	if len(matches) != 1 {
+		return ""
+	}
+	return matches[0]
+}
+
+//createContainer creates an erasure coded container whose members are each in a
+// separate local store, repairs are reported on the returned channel
+func createContainer(t *testing.T) (*Container, []*testMember, chan string) {
+	mbrs := make([]*testMember, dataShards+parityShards)
+	members := make([]stow.Container, len(mbrs))
+	for i := range mbrs {
+		dir := t.TempDir()
+		store, err := stow.Dial(local.Kind, stow.ConfigMap{local.ConfigKeyPath: dir})
+		if err != nil {
+			t.Fatalf("Could not create local store: %s", err)
+		}
+		member, err := store.CreateContainer("test")
+		if err != nil {
+			t.Fatalf("Could not create container: %s", err)
+		}
+		mbrs[i] = &testMember{Container: member, dir: dir}
+		members[i] = mbrs[i]
+	}
+
+	repairs := make(chan string, 16)
+	onRepair := func(name string, repaired int, err error) {
+		if err != nil {
+			repairs <- fmt.Sprintf("%s: %s", name, err)
+		} else {
+			repairs <- fmt.Sprintf("%s: %d", name, repaired)
+		}
+	}
+	cont, err := NewContainer(testutil.CreateContext(t), dataShards, parityShards, members, OptRepairCallback(onRepair))
+	if err != nil {
+		t.Fatalf("Could not create erasure coded container: %s", err)
+	}
+	return cont, mbrs, repairs
+}
+
+func putRandom(t *testing.T, cont *Container, name string, size int) []byte {
+	t.Helper()
+
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	if _, err := cont.Put(name, bytes.NewReader(data), int64(size), nil); err != nil {
+		t.Fatalf("Could not put %q: %s", name, err)
+	}
+	return data
+}
+
+func expectObject(t *testing.T, cont *Container, name string, expected []byte) {
+	t.Helper()
+
+	item, err := cont.Item(name)
+	if err != nil {
+		t.Fatalf("Could not get %q: %s", name, err)
+	}
+	if size, err := item.Size(); err != nil || size != int64(len(expected)) {
+		t.Fatalf("Size of %q was %d rather than %d: %v", name, size, len(expected), err)
+	}
+	rdr, err := item.Open()
+	if err != nil {
+		t.Fatalf("Could not open %q: %s", name, err)
+	}
+	defer rdr.Close()
+	if actual, err := io.ReadAll(rdr); err != nil {
+		t.Fatalf("Could not read %q: %s", name, err)
+	} else if !bytes.Equal(actual, expected) {
+		t.Fatalf("Contents of %q were not as expected", name)
+	}
+}
+
+func expectRepair(t *testing.T, repairs chan string, expected string) {
+	t.Helper()
+
+	select {
+	case actual := <-repairs:
+		if actual != expected {
+			t.Fatalf("Repair was %q rather than %q", actual, expected)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for repair %q", expected)
+	}
+}
+
+func TestContainer(t *testing.T) {
+	cont, _, _ := createContainer(t)
+
+	objects := make(map[string][]byte)
+	for _, size := range []int{0, 1, 1000, 100003} {
+		name := fmt.Sprintf("obj-%d", size)
+		objects[name] = putRandom(t, cont, name, size)
+	}
+	for name, data := range objects {
+		expectObject(t, cont, name, data)
+	}
+
+	//List a page at a time
+	var names []string
+	for cursor := stow.CursorStart; ; {
+		items, next, err := cont.Items("obj-", cursor, 3)
+		if err != nil {
+			t.Fatalf("Could not list items: %s", err)
+		}
+		for _, item := range items {
+			names = append(names, item.Name())
+		}
+		if cursor = next; stow.IsCursorEnd(cursor) {
+			break
+		}
+	}
+	if expected := []string{"obj-0", "obj-1", "obj-1000", "obj-100003"}; fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("Listed %v rather than %v", names, expected)
+	}
+
+	//Metadata is preserved and ETags reflect content
+	meta := map[string]interface{}{"x-test": "value"}
+	first, err := cont.Put("meta", bytes.NewReader([]byte("one")), 3, meta)
+	if err != nil {
+		t.Fatalf("Could not put object with metadata: %s", err)
+	}
+	item, err := cont.Item("meta")
+	if err != nil {
+		t.Fatalf("Could not get object with metadata: %s", err)
+	}
+	if md, err := item.Metadata(); err != nil || md["x-test"] != "value" {
+		t.Fatalf("Metadata was %v rather than %v: %v", md, meta, err)
+	}
+	second, err := cont.Put("meta", bytes.NewReader([]byte("two")), 3, meta)
+	if err != nil {
+		t.Fatalf("Could not overwrite object: %s", err)
+	}
+	firstTag, _ := first.ETag()
+	secondTag, _ := second.ETag()
+	if firstTag == secondTag {
+		t.Fatalf("ETag %q did not change when content changed", firstTag)
+	}
+
+	if err = cont.RemoveItem("meta"); err != nil {
+		t.Fatalf("Could not remove object: %s", err)
+	}
+	if _, err = cont.Item("meta"); err != stow.ErrNotFound {
+		t.Fatalf("Removed object was still found: %v", err)
+	}
+}
+
+func TestDegradedAndRepair(t *testing.T) {
+	cont, mbrs, repairs := createContainer(t)
+	data := putRandom(t, cont, "obj", 50000)
+
+	//Lose as many shards as there are parity shards, including a data shard
+	for _, idx := range []int{1, 4} {
+		if err := os.Remove(mbrs[idx].shardPath("obj", idx)); err != nil {
+			t.Fatalf("Could not remove shard %d: %s", idx, err)
+		}
+	}
+	expectObject(t, cont, "obj", data)
+	expectRepair(t, repairs, "obj: 2")
+	for _, idx := range []int{1, 4} {
+		if _, err := os.Stat(mbrs[idx].shardPath("obj", idx)); err != nil {
+			t.Fatalf("Shard %d was not repaired: %s", idx, err)
+		}
+	}
+
+	//Corrupt a shard's payload
+	shardFile, err := os.OpenFile(mbrs[0].shardPath("obj", 0), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Could not open shard: %s", err)
+	}
+	if _, err = shardFile.WriteAt([]byte("garbage"), int64(shardHdrBytes+100)); err != nil {
+		t.Fatalf("Could not corrupt shard: %s", err)
+	}
+	shardFile.Close()
+	expectObject(t, cont, "obj", data)
+	expectRepair(t, repairs, "obj: 1")
+	if repaired, err := cont.Repair("obj"); err != nil || repaired != 0 {
+		t.Fatalf("Repair of healthy object rewrote %d shards: %v", repaired, err)
+	}
+
+	//One too many lost shards
+	for idx := 0; idx <= parityShards; idx++ {
+		os.Remove(mbrs[idx].shardPath("obj", idx))
+	}
+	item, err := cont.Item("obj")
+	if err != nil {
+		t.Fatalf("Could not get object: %s", err)
+	}
+	if _, err = item.Open(); !errors.Is(err, rs.ErrTooFewShards) {
+		t.Fatalf("Open with too few shards did not fail as expected: %v", err)
+	}
+}
+
+func TestProviderOutage(t *testing.T) {
+	cont, mbrs, repairs := createContainer(t)
+	putRandom(t, cont, "obj", 1000)
+
+	//While a member is down puts still succeed, but leave a shard to repair behind
+	mbrs[2].failing.Set(true)
+	data := putRandom(t, cont, "obj", 2000)
+	expectRepair(t, repairs, "obj: Could not store shard 2 of \"obj\" in test: Injected put failure")
+	expectObject(t, cont, "obj", data)
+	<-repairs //Read found the missing shard and requeued, but the member is still down
+	for _, idx := range []int{0, 1, 3, 4} {
+		if mbrs[idx].shardPath("obj", idx) == "" {
+			t.Fatalf("Shard %d of the replaced version was not removed", idx)
+		}
+	}
+
+	//With as many members down as there are parity shards puts fail, rather than
+	// store a version that one more loss makes unreadable, and the previous version
+	// is left intact
+	mbrs[3].failing.Set(true)
+	if _, err := cont.Put("obj", bytes.NewReader(make([]byte, 3000)), 3000, nil); err == nil {
+		t.Fatalf("Put with %d members down succeeded", parityShards)
+	}
+	for _, idx := range []int{0, 1, 4} {
+		if mbrs[idx].shardPath("obj", idx) == "" {
+			t.Fatalf("Shard %d of the failed put was not removed", idx)
+		}
+	}
+	expectObject(t, cont, "obj", data)
+	<-repairs
+
+	for _, mbr := range mbrs {
+		mbr.failing.Set(false)
+	}
+	if repaired, err := cont.Repair("obj"); err != nil || repaired != 1 {
+		t.Fatalf("Repair after outage rewrote %d rather than 1 shard: %v", repaired, err)
+	}
+	expectObject(t, cont, "obj", data)
+}
@@ -0,0 +1,299 @@
+package erasure
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	rs "github.com/tarndt/usbd/pkg/util/erasure"
+
+	"github.com/graymeta/stow"
+)
+
+//item is an erasure coded object, its header is loaded from the shards on demand
+type item struct {
+	cont   *Container
+	name   string
+	shards [][]shardRef //Known shard objects of each version, indexed by shard, nil if unknown
+
+	mu   sync.Mutex
+	hdr  *shardHeader
+	meta map[string]interface{}
+}
+
+var _ stow.Item = (*item)(nil)
+
+func (obj *item) ID() string {
+	return obj.name
+}
+
+func (obj *item) Name() string {
+	return obj.name
+}
+
+func (obj *item) URL() *url.URL {
+	for _, refs := range obj.shards {
+		if len(refs) > 0 {
+			return refs[0].item.URL()
+		}
+	}
+	return &url.URL{Scheme: "erasure", Opaque: obj.name}
+}
+
+//Size of the object, not including parity
+func (obj *item) Size() (int64, error) {
+	hdr, _, err := obj.header()
+	if err != nil {
+		return 0, err
+	}
+	return int64(hdr.size), nil
+}
+
+//Open reassembles the object from its shards, queuing repair of any found to be
+// missing, corrupt or stale
+func (obj *item) Open() (io.ReadCloser, error) {
+	assembled, err := obj.cont.fetch(obj.name, obj.shards, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(assembled.stale) > 0 || assembled.obsolete != nil {
+		obj.cont.queueRepair(obj.name)
+	}
+
+	obj.mu.Lock()
+	obj.hdr, obj.meta = &assembled.hdr, assembled.meta
+	obj.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(assembled.data)), nil
+}
+
+//ETag is derived from the checksum of the object's contents
+func (obj *item) ETag() (string, error) {
+	hdr, _, err := obj.header()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hdr.sum[:16]), nil
+}
+
+//LastMod returns when the current version of the object was put
+func (obj *item) LastMod() (time.Time, error) {
+	hdr, _, err := obj.header()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(hdr.generation)), nil
+}
+
+//Metadata returns the metadata the object was put with
+func (obj *item) Metadata() (map[string]interface{}, error) {
+	_, meta, err := obj.header()
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		meta = make(map[string]interface{})
+	}
+	return meta, nil
+}
+
+//header returns the header of the current version of the object, reading the
+// shard headers if it has not been loaded
+func (obj *item) header() (shardHeader, map[string]interface{}, error) {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+	if obj.hdr != nil {
+		return *obj.hdr, obj.meta, nil
+	}
+
+	shards := obj.shards
+	if shards == nil {
+		var err error
+		if shards, err = obj.cont.findShards(obj.name); err != nil {
+			return shardHeader{}, nil, err
+		}
+	}
+	reads, current, err := obj.cont.openCurrent(obj.name, shards)
+	if err != nil {
+		return shardHeader{}, nil, err
+	}
+	defer closeShards(reads)
+	obj.hdr, obj.meta = &reads[current].hdr, reads[current].meta
+	return *obj.hdr, obj.meta, nil
+}
+
+//shardRead is a shard object opened for reading whose header has been read
+type shardRead struct {
+	item stow.Item
+	hdr  shardHeader
+	meta map[string]interface{}
+	rdr  io.ReadCloser
+	err  error
+}
+
+//openShards concurrently opens the shards of a version of an object and reads
+// their headers
+func (cont *Container) openShards(name string, shards [][]shardRef, generation uint64) []shardRead {
+	reads := make([]shardRead, len(cont.members))
+	cont.parallel(func(i int) {
+		read := &reads[i]
+		for _, ref := range shards[i] {
+			if ref.generation == generation {
+				read.item = ref.item
+			}
+		}
+		if read.item == nil {
+			read.err = fmt.Errorf("Shard %d of %q is missing", i, name)
+			return
+		}
+		if read.rdr, read.err = read.item.Open(); read.err != nil {
+			return
+		}
+
+		read.hdr, read.meta, read.err = readHeader(read.rdr)
+		switch {
+		case read.err != nil:
+		case int(read.hdr.index) != i || int(read.hdr.dataCount) != cont.dataCount || int(read.hdr.parityCount) != len(cont.members)-cont.dataCount:
+			read.err = fmt.Errorf("Shard %d of %q is from a different erasure coding layout", i, name)
+		case read.hdr.generation != generation:
+			read.err = fmt.Errorf("Shard %d of %q is not of the version its name records", i, name)
+		}
+	})
+	return reads
+}
+
+func closeShards(reads []shardRead) {
+	for _, read := range reads {
+		if read.rdr != nil {
+			read.rdr.Close()
+		}
+	}
+}
+
+//openCurrent opens the shards of the newest version of an object of which enough
+// shards can be read to reassemble it, returning the index of one of them
+func (cont *Container) openCurrent(name string, shards [][]shardRef) ([]shardRead, int, error) {
+	counts := make(map[uint64]int)
+	for _, refs := range shards {
+		for _, ref := range refs {
+			counts[ref.generation]++
+		}
+	}
+	generations := make([]uint64, 0, len(counts))
+	for generation, count := range counts {
+		if count >= cont.dataCount {
+			generations = append(generations, generation)
+		}
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i] > generations[j] })
+
+	for _, generation := range generations {
+		reads := cont.openShards(name, shards, generation)
+		valid, current := 0, -1
+		for i, read := range reads {
+			if read.err != nil {
+				continue
+			}
+			if valid++; current < 0 {
+				current = i
+			}
+		}
+		if valid >= cont.dataCount {
+			return reads, current, nil
+		}
+		closeShards(reads)
+	}
+	return nil, -1, fmt.Errorf("No version of %q has the %d shards required: %w", name, cont.dataCount, rs.ErrTooFewShards)
+}
+
+//assembled is an object reassembled from its shards
+type assembled struct {
+	hdr  shardHeader
+	data []byte
+	//shards are the payloads of the current version, nil if not read or invalid
+	shards [][]byte
+	//stale are the indexes of shards of the current version that are missing or corrupt
+	stale []int
+	//obsolete are the shards of versions the current one replaced, nil if none remain
+	obsolete [][]shardRef
+	meta     map[string]interface{}
+}
+
+//fetch reads the shards of the current version of an object and reassembles it.
+// Data shards are read in preference to parity shards unless all is true.
+func (cont *Container) fetch(name string, known [][]shardRef, all bool) (*assembled, error) {
+	if known == nil {
+		var err error
+		if known, err = cont.findShards(name); err != nil {
+			return nil, err
+		}
+	}
+	reads, current, err := cont.openCurrent(name, known)
+	if err != nil {
+		return nil, err
+	}
+	defer closeShards(reads)
+	obj := &assembled{hdr: reads[current].hdr, shards: make([][]byte, len(reads)), meta: reads[current].meta}
+	obj.obsolete = olderShards(known, obj.hdr.generation)
+
+	var candidates []int
+	for i, read := range reads {
+		if read.err != nil {
+			obj.stale = append(obj.stale, i)
+		} else {
+			candidates = append(candidates, i)
+		}
+	}
+
+	//Read data shards first and then parity shards as needed
+	good := 0
+	for len(candidates) > 0 && (all || good < cont.dataCount) {
+		batch := candidates
+		if !all {
+			if want := cont.dataCount - good; len(batch) > want {
+				batch = batch[:want]
+			}
+		}
+		candidates = candidates[len(batch):]
+
+		payloads := make([][]byte, len(batch))
+		cont.parallelN(len(batch), func(j int) {
+			payload := make([]byte, obj.hdr.shardBytes())
+			read := reads[batch[j]]
+			if _, err := io.ReadFull(read.rdr, payload); err == nil && crc32.ChecksumIEEE(payload) == read.hdr.payloadCRC {
+				payloads[j] = payload
+			}
+		})
+		for j, payload := range payloads {
+			if payload == nil {
+				obj.stale = append(obj.stale, batch[j])
+			} else {
+				obj.shards[batch[j]] = payload
+				good++
+			}
+		}
+	}
+	if good < cont.dataCount {
+		return nil, fmt.Errorf("Only %d valid shards of %q could be read, %d are required: %w", good, name, cont.dataCount, rs.ErrTooFewShards)
+	}
+
+	data := make([][]byte, len(obj.shards))
+	copy(data, obj.shards)
+	if err = cont.coder.ReconstructData(data); err != nil {
+		return nil, fmt.Errorf("Could not reconstruct %q: %w", name, err)
+	}
+	obj.data = make([]byte, 0, obj.hdr.shardBytes()*int64(cont.dataCount))
+	for _, shard := range data[:cont.dataCount] {
+		obj.data = append(obj.data, shard...)
+	}
+	if obj.data = obj.data[:obj.hdr.size]; sha256.Sum256(obj.data) != obj.hdr.sum {
+		return nil, fmt.Errorf("Reassembled %q does not match its checksum", name)
+	}
+	return obj, nil
+}
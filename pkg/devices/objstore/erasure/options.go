@@ -0,0 +1,22 @@
+package erasure
+
+//Option is an erasure coded container option
+type Option interface {
+	apply(*Container)
+}
+
+//OptRepairQueueLen instructs an erasure coded container to queue at most this many
+// objects for background repair
+type OptRepairQueueLen int
+
+func (qlen OptRepairQueueLen) apply(cont *Container) {
+	cont.repairQLen = int(qlen)
+}
+
+//OptRepairCallback instructs an erasure coded container to invoke the provided
+// function after each background repair with the number of shards rewritten
+type OptRepairCallback func(name string, repaired int, err error)
+
+func (callback OptRepairCallback) apply(cont *Container) {
+	cont.onRepair = callback
+}
@@ -0,0 +1,142 @@
+package erasure
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	shardMagic    = "USBDEC01"
+	shardHdrBytes = len(shardMagic) + 2 + 2 + 2 + 2 + 8 + 8 + sha256.Size + 4 + 4 + 4
+	shardSuffix   = ".ec"
+	maxMetaBytes  = 1024 * 1024
+)
+
+//shardHeader prefixes every shard object so that shards can be validated and the
+// object reassembled without relying on store metadata support. The header is
+// followed by the object's metadata (JSON) and then the shard's payload.
+type shardHeader struct {
+	dataCount, parityCount, index uint16
+	//size is that of the whole object, shards are padded
+	size uint64
+	//generation orders successive puts of an object so stale shards left by a
+	// failed put are never mixed with current ones
+	generation uint64
+	sum        [sha256.Size]byte
+	metaBytes  uint32
+	payloadCRC uint32
+}
+
+//marshal returns the header followed by the metadata, the header checksum covers both
+func (hdr *shardHeader) marshal(meta []byte) []byte {
+	hdr.metaBytes = uint32(len(meta))
+	buf := make([]byte, shardHdrBytes, shardHdrBytes+len(meta))
+	pos := copy(buf, shardMagic)
+	binary.LittleEndian.PutUint16(buf[pos:], hdr.dataCount)
+	binary.LittleEndian.PutUint16(buf[pos+2:], hdr.parityCount)
+	binary.LittleEndian.PutUint16(buf[pos+4:], hdr.index)
+	pos += 8
+	binary.LittleEndian.PutUint64(buf[pos:], hdr.size)
+	binary.LittleEndian.PutUint64(buf[pos+8:], hdr.generation)
+	pos += 16
+	pos += copy(buf[pos:], hdr.sum[:])
+	binary.LittleEndian.PutUint32(buf[pos:], hdr.metaBytes)
+	binary.LittleEndian.PutUint32(buf[pos+4:], hdr.payloadCRC)
+
+	crc := crc32.NewIEEE()
+	crc.Write(buf[:pos+8])
+	crc.Write(meta)
+	binary.LittleEndian.PutUint32(buf[pos+8:], crc.Sum32())
+	return append(buf, meta...)
+}
+
+//readHeader reads and validates a shard header and the metadata following it
+func readHeader(rdr io.Reader) (hdr shardHeader, meta map[string]interface{}, err error) {
+	buf := make([]byte, shardHdrBytes)
+	if _, err = io.ReadFull(rdr, buf); err != nil {
+		return hdr, nil, fmt.Errorf("Could not read shard header: %w", err)
+	}
+	if string(buf[:len(shardMagic)]) != shardMagic {
+		return hdr, nil, fmt.Errorf("Object is not an erasure coded shard")
+	}
+
+	pos := len(shardMagic)
+	hdr.dataCount = binary.LittleEndian.Uint16(buf[pos:])
+	hdr.parityCount = binary.LittleEndian.Uint16(buf[pos+2:])
+	hdr.index = binary.LittleEndian.Uint16(buf[pos+4:])
+	pos += 8
+	hdr.size = binary.LittleEndian.Uint64(buf[pos:])
+	hdr.generation = binary.LittleEndian.Uint64(buf[pos+8:])
+	pos += 16
+	pos += copy(hdr.sum[:], buf[pos:])
+	hdr.metaBytes = binary.LittleEndian.Uint32(buf[pos:])
+	hdr.payloadCRC = binary.LittleEndian.Uint32(buf[pos+4:])
+	if hdr.metaBytes > maxMetaBytes {
+		return hdr, nil, fmt.Errorf("Shard header is corrupt (metadata of %d bytes)", hdr.metaBytes)
+	}
+
+	metaBuf := make([]byte, hdr.metaBytes)
+	if _, err = io.ReadFull(rdr, metaBuf); err != nil {
+		return hdr, nil, fmt.Errorf("Could not read shard metadata: %w", err)
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(buf[:pos+8])
+	crc.Write(metaBuf)
+	if crc.Sum32() != binary.LittleEndian.Uint32(buf[pos+8:]) {
+		return hdr, nil, fmt.Errorf("Shard header is corrupt (checksum mismatch)")
+	}
+	if len(metaBuf) > 0 {
+		if err = json.Unmarshal(metaBuf, &meta); err != nil {
+			return hdr, nil, fmt.Errorf("Could not decode shard metadata: %w", err)
+		}
+	}
+	return hdr, meta, nil
+}
+
+//shardBytes returns the size of each shard's payload
+func (hdr *shardHeader) shardBytes() int64 {
+	return shardBytes(int64(hdr.size), int(hdr.dataCount))
+}
+
+func shardBytes(size int64, dataCount int) int64 {
+	if bytes := (size + int64(dataCount) - 1) / int64(dataCount); bytes > 0 {
+		return bytes
+	}
+	return 1 //Empty objects still have a shard to hold the header
+}
+
+//shardName returns the name of the object holding a shard of a version of the
+// named object, each version's shards are named uniquely so a put never overwrites
+// the shards of the version it replaces
+func shardName(name string, index int, generation uint64) string {
+	return name + shardSuffix + strconv.Itoa(index) + "." + strconv.FormatUint(generation, 10)
+}
+
+//parseShardName returns the object name, shard index and generation of a shard
+// object name
+func parseShardName(name string) (string, int, uint64, bool) {
+	pos := strings.LastIndex(name, shardSuffix)
+	if pos < 0 {
+		return "", 0, 0, false
+	}
+	suffix := name[pos+len(shardSuffix):]
+	sep := strings.IndexByte(suffix, '.')
+	if sep < 0 {
+		return "", 0, 0, false
+	}
+	index, err := strconv.Atoi(suffix[:sep])
+	if err != nil || index < 0 {
+		return "", 0, 0, false
+	}
+	generation, err := strconv.ParseUint(suffix[sep+1:], 10, 64)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	return name[:pos], index, generation, true
+}
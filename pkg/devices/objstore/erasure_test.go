@@ -0,0 +1,114 @@
+package objstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/objstore/compress"
+	"github.com/tarndt/usbd/pkg/devices/objstore/encrypt"
+	"github.com/tarndt/usbd/pkg/devices/objstore/erasure"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+
+	"github.com/graymeta/stow"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+const dataShards, parityShards = 3, 2
+
+//erasureLocation creates erasure coded containers spread across several stores
+type erasureLocation struct {
+	stow.Location
+	t      *testing.T
+	stores []stow.Location
+}
+
+func (loc erasureLocation) CreateContainer(name string) (stow.Container, error) {
+	members := make([]stow.Container, len(loc.stores))
+	for i, store := range loc.stores {
+		member, err := store.CreateContainer(name)
+		if err != nil {
+			return nil, err
+		}
+		members[i] = member
+	}
+	return erasure.NewContainer(testutil.CreateContext(loc.t), dataShards, parityShards, members)
+}
+
+//outageHandler simulates a provider that can be taken offline
+type outageHandler struct {
+	http.Handler
+	atomicDown uint32
+}
+
+func (hndlr *outageHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if atomic.LoadUint32(&hndlr.atomicDown) == 1 {
+		http.Error(resp, "Provider is down", http.StatusForbidden)
+		return
+	}
+	hndlr.Handler.ServeHTTP(resp, req)
+}
+
+//erasureStore creates a location whose containers are erasure coded across a
+// fake S3 provider per shard
+func erasureStore(t *testing.T) (stow.Location, []*outageHandler) {
+	hndlrs := make([]*outageHandler, dataShards+parityShards)
+	stores := make([]stow.Location, len(hndlrs))
+	for i := range hndlrs {
+		hndlrs[i] = &outageHandler{Handler: gofakes3.New(s3mem.New()).Server()}
+		srv := httptest.NewServer(hndlrs[i])
+		t.Cleanup(srv.Close)
+		stores[i] = s3Store(t, srv)
+	}
+	return erasureLocation{Location: stores[0], t: t, stores: stores}, hndlrs
+}
+
+func TestErasure(t *testing.T) {
+	t.Run("compress-none", func(t *testing.T) {
+		t.Parallel()
+
+		store, _ := erasureStore(t)
+		testDeviceSizes(t, store)
+	})
+	t.Run("compress-encrypt", func(t *testing.T) {
+		t.Parallel()
+
+		key, err := encrypt.MakeRandomAESKey()
+		if err != nil {
+			t.Fatalf("Could not create AES key: %s", err)
+		}
+		store, _ := erasureStore(t)
+		testDeviceSizes(t, store, OptCompressRemoteObjects(compress.ModeS2), OptEncrypt{Mode: encrypt.ModeAESRec, Key: key})
+	})
+	t.Run("provider-outage", func(t *testing.T) {
+		const (
+			totalBytes  = 4 * 1024 * 1024 //4 MB
+			objectBytes = 512 * 1024      //512 KB
+		)
+		t.Parallel()
+
+		store, hndlrs := erasureStore(t)
+		container := createContainer(t, store)
+		dev := createDevice(t, container, "", totalBytes, objectBytes)
+		devHash := testutil.TestWriteReadPattern(t, dev)
+		testutil.TestClose(t, dev)
+
+		//Take down as many providers as there are parity shards, reads still succeed
+		// but writes require one more shard to be stored than reads do
+		for _, hndlr := range hndlrs[len(hndlrs)-parityShards:] {
+			atomic.StoreUint32(&hndlr.atomicDown, 1)
+		}
+		t.Run("read-degraded", func(t *testing.T) {
+			dev := createDevice(t, container, "", totalBytes, objectBytes)
+			testutil.TestReadHash(t, dev, devHash)
+			if err := dev.Close(); err != nil {
+				t.Fatalf("Failed to close device: %s", err)
+			}
+		})
+
+		atomic.StoreUint32(&hndlrs[len(hndlrs)-1].atomicDown, 0)
+		testExistingRemote(t, container, "", totalBytes, objectBytes, devHash)
+	})
+}
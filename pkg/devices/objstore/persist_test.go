@@ -1,14 +1,20 @@
 package objstore
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/tarndt/usbd/pkg/devices/objstore/compress"
 	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
 	"github.com/tarndt/usbd/pkg/util/consterr"
 
 	"github.com/graymeta/stow"
+	"github.com/graymeta/stow/local"
 )
 
 const errNoDownloadAllowed = consterr.ConstErr("Downloads are disabled")
@@ -79,3 +85,37 @@ type noDownloadItem struct {
 func (item noDownloadItem) Open() (io.ReadCloser, error) {
 	return nil, errNoDownloadAllowed
 }
+
+func TestCrash(t *testing.T) {
+	const (
+		totalBytes  = 8 * 1024 * 1024 //8 MB
+		objectBytes = 512 * 1024      //512 KB
+	)
+
+	testutil.TestProcessKill(t, testutil.CrashConfig{}, func(dir string, create bool) (usbdlib.Device, error) {
+		storeDir, cacheDir := filepath.Join(dir, "store"), filepath.Join(dir, "cache")
+		if create {
+			for _, subDir := range []string{storeDir, cacheDir} {
+				if err := os.Mkdir(subDir, 0700); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		store, err := NewStore(KindLocalTest, stow.ConfigMap{local.ConfigKeyPath: storeDir})
+		if err != nil {
+			return nil, fmt.Errorf("Could not create local object store: %w", err)
+		}
+		var container stow.Container
+		if create {
+			container, err = store.CreateContainer("crash")
+		} else {
+			container, err = store.Container("crash")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not open container: %w", err)
+		}
+
+		return NewDevice(context.Background(), container, cacheDir, totalBytes, objectBytes, OptNoMetadataSupport(true), OptPersistCache(true))
+	})
+}
@@ -0,0 +1,358 @@
+package parity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	superMagic  = "USBDPAR1"
+	recordMagic = "USBDPJR1"
+
+	//journalHdrBytes is the space reserved for the superblock and for the header
+	// of each slot so that journaled shards stay block aligned
+	journalHdrBytes = 4096
+	superHdrBytes   = len(superMagic) + 4 + 4 + 8 + 8 + 4
+	recordHdrBytes  = len(recordMagic) + 8 + 8 + 8 + 8 + 8
+)
+
+//The journal closes the RAID write hole: a stripe's new data and parity shards are
+// written, and synced, to a journal slot before any of them are written to the
+// members, so after a crash every stripe that may have been partially written is
+// restored by replaying its journal records in sequence order. Slots are only
+// reused after a checkpoint has flushed the members, so the journal always holds
+// every stripe write since the members were last known to be durable.
+//
+// The journal file starts with a superblock describing the layout and holding the
+// member states, followed by the slots, each of which is a header and a chunk
+// sized area per member.
+
+type journal struct {
+	file       *os.File
+	name       string
+	chunkBytes int64
+	slotBytes  int64
+
+	stateMu sync.Mutex //Serializes superblock writes
+	super   []byte     //Layout portion of the superblock
+
+	mu          sync.Mutex
+	seq         uint64
+	completed   []int //Slots whose member writes finished but have not been checkpointed
+	free        chan int
+	completedCh chan struct{}
+
+	checkpointMu sync.Mutex
+}
+
+//record is a valid journal record found when opening a journal
+type record struct {
+	seq            uint64
+	stripe, offset int64    //offset is where within each chunk the shards start
+	shards         [][]byte //Indexed by shard, nil if the shard is not part of the record
+}
+
+//openJournal opens or creates the journal of the provided device returning the
+// persisted member states (if any) and the records that must be replayed
+func openJournal(name string, dev *Parity, slots int) (*journal, []MemberState, []record, error) {
+	memberCount := len(dev.members)
+	jrnl := &journal{
+		name:        name,
+		chunkBytes:  dev.chunkBytes,
+		slotBytes:   journalHdrBytes + int64(memberCount)*dev.chunkBytes,
+		super:       make([]byte, superHdrBytes),
+		free:        make(chan int, slots),
+		completedCh: make(chan struct{}, 1),
+	}
+	copy(jrnl.super, superMagic)
+	binary.LittleEndian.PutUint32(jrnl.super[len(superMagic):], uint32(memberCount))
+	binary.LittleEndian.PutUint32(jrnl.super[len(superMagic)+4:], uint32(dev.parityCount))
+	binary.LittleEndian.PutUint64(jrnl.super[len(superMagic)+8:], uint64(dev.chunkBytes))
+	binary.LittleEndian.PutUint64(jrnl.super[len(superMagic)+16:], uint64(dev.stripes))
+	binary.LittleEndian.PutUint32(jrnl.super[len(superMagic)+24:], uint32(slots))
+	for slot := 0; slot < slots; slot++ {
+		jrnl.free <- slot
+	}
+
+	var err error
+	if jrnl.file, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return nil, nil, nil, fmt.Errorf("Could not open journal file %q: %w", name, err)
+	}
+	states, records, err := jrnl.load(memberCount, slots)
+	if err != nil {
+		jrnl.file.Close()
+		return nil, nil, nil, err
+	}
+	return jrnl, states, records, nil
+}
+
+//load reads the superblock and the valid records of an existing journal or
+// initializes a new one
+func (jrnl *journal) load(memberCount, slots int) ([]MemberState, []record, error) {
+	info, err := jrnl.file.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not stat journal file %q: %w", jrnl.name, err)
+	}
+	expectedBytes := journalHdrBytes + int64(slots)*jrnl.slotBytes
+	if info.Size() == 0 {
+		if err = jrnl.file.Truncate(expectedBytes); err != nil {
+			return nil, nil, fmt.Errorf("Could not size journal file %q: %w", jrnl.name, err)
+		}
+		return nil, nil, nil
+	}
+
+	superBlock := make([]byte, superHdrBytes+memberCount+4)
+	if _, err = jrnl.file.ReadAt(superBlock, 0); err != nil {
+		return nil, nil, fmt.Errorf("Could not read journal file %q superblock: %w", jrnl.name, err)
+	}
+	crcPos := len(superBlock) - 4
+	switch {
+	case string(superBlock[:len(superMagic)]) != superMagic:
+		return nil, nil, fmt.Errorf("File %q is not a parity journal", jrnl.name)
+	case !bytes.Equal(superBlock[:superHdrBytes], jrnl.super):
+		return nil, nil, fmt.Errorf("Journal file %q is for a different parity layout (members, parity shards, chunk size, size or slots)", jrnl.name)
+	case crc32.ChecksumIEEE(superBlock[:crcPos]) != binary.LittleEndian.Uint32(superBlock[crcPos:]):
+		return nil, nil, fmt.Errorf("Journal file %q superblock is corrupt (checksum mismatch)", jrnl.name)
+	case info.Size() != expectedBytes:
+		return nil, nil, fmt.Errorf("Journal file %q is %d bytes; expected %d", jrnl.name, info.Size(), expectedBytes)
+	}
+	states := make([]MemberState, memberCount)
+	for i := range states {
+		states[i] = MemberState(superBlock[superHdrBytes+i])
+	}
+
+	var records []record
+	for slot := 0; slot < slots; slot++ {
+		rec, valid, err := jrnl.readRecord(slot, memberCount)
+		if err != nil {
+			return nil, nil, err
+		}
+		if valid {
+			records = append(records, rec)
+			if rec.seq > jrnl.seq {
+				jrnl.seq = rec.seq
+			}
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].seq < records[j].seq })
+	return states, records, nil
+}
+
+//readRecord reads the record in a slot, records that are absent or were torn by a
+// crash while being journaled are not valid
+func (jrnl *journal) readRecord(slot, memberCount int) (rec record, valid bool, err error) {
+	slotPos := journalHdrBytes + int64(slot)*jrnl.slotBytes
+	hdr := make([]byte, recordHdrBytes+4)
+	if _, err = jrnl.file.ReadAt(hdr, slotPos); err != nil {
+		return rec, false, fmt.Errorf("Could not read journal slot %d header: %w", slot, err)
+	}
+	if string(hdr[:len(recordMagic)]) != recordMagic {
+		return rec, false, nil
+	}
+
+	rec.seq = binary.LittleEndian.Uint64(hdr[len(recordMagic):])
+	rec.stripe = int64(binary.LittleEndian.Uint64(hdr[len(recordMagic)+8:]))
+	mask := binary.LittleEndian.Uint64(hdr[len(recordMagic)+16:])
+	rec.offset = int64(binary.LittleEndian.Uint64(hdr[len(recordMagic)+24:]))
+	length := int64(binary.LittleEndian.Uint64(hdr[len(recordMagic)+32:]))
+	if rec.offset < 0 || length < 0 || rec.offset+length > jrnl.chunkBytes {
+		return rec, false, nil
+	}
+	rec.shards = make([][]byte, memberCount)
+
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[:recordHdrBytes])
+	for shard := range rec.shards {
+		if mask&(1<<uint(shard)) == 0 {
+			continue
+		}
+		rec.shards[shard] = make([]byte, length)
+		if _, err = jrnl.file.ReadAt(rec.shards[shard], slotPos+journalHdrBytes+int64(shard)*jrnl.chunkBytes); err != nil && err != io.EOF {
+			return rec, false, fmt.Errorf("Could not read journal slot %d shard %d: %w", slot, shard, err)
+		}
+		crc.Write(rec.shards[shard])
+	}
+	return rec, crc.Sum32() == binary.LittleEndian.Uint32(hdr[recordHdrBytes:]), nil
+}
+
+//writeStates persists the member states to the superblock
+func (jrnl *journal) writeStates(states []MemberState) error {
+	jrnl.stateMu.Lock()
+	defer jrnl.stateMu.Unlock()
+
+	superBlock := make([]byte, superHdrBytes, superHdrBytes+len(states)+4)
+	copy(superBlock, jrnl.super)
+	for _, state := range states {
+		superBlock = append(superBlock, byte(state))
+	}
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(superBlock))
+	if _, err := jrnl.file.WriteAt(append(superBlock, crc...), 0); err != nil {
+		return fmt.Errorf("Could not write journal superblock: %w", err)
+	}
+	if err := jrnl.file.Sync(); err != nil {
+		return fmt.Errorf("Could not sync journal superblock: %w", err)
+	}
+	return nil
+}
+
+//write durably journals the target shards of a stripe, which start at offset
+// within their chunks, returning the slot used which must be passed to complete
+// once the shards have been written to the members. If no slots are free the
+// journal is checkpointed using flush.
+func (jrnl *journal) write(stripe, offset int64, shards [][]byte, targets []int, flush func() error) (int, error) {
+	slot, err := jrnl.acquire(flush)
+	if err != nil {
+		return -1, err
+	}
+
+	jrnl.mu.Lock()
+	jrnl.seq++
+	seq := jrnl.seq
+	jrnl.mu.Unlock()
+
+	var mask uint64
+	for _, shard := range targets {
+		mask |= 1 << uint(shard)
+	}
+	hdr := make([]byte, recordHdrBytes+4)
+	copy(hdr, recordMagic)
+	binary.LittleEndian.PutUint64(hdr[len(recordMagic):], seq)
+	binary.LittleEndian.PutUint64(hdr[len(recordMagic)+8:], uint64(stripe))
+	binary.LittleEndian.PutUint64(hdr[len(recordMagic)+16:], mask)
+	binary.LittleEndian.PutUint64(hdr[len(recordMagic)+24:], uint64(offset))
+	binary.LittleEndian.PutUint64(hdr[len(recordMagic)+32:], uint64(len(shards[targets[0]])))
+
+	slotPos := journalHdrBytes + int64(slot)*jrnl.slotBytes
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[:recordHdrBytes])
+	for shard := range shards { //Ascending order as the checksum is order dependent
+		if mask&(1<<uint(shard)) == 0 {
+			continue
+		}
+		crc.Write(shards[shard])
+		if _, err = jrnl.file.WriteAt(shards[shard], slotPos+journalHdrBytes+int64(shard)*jrnl.chunkBytes); err != nil {
+			jrnl.free <- slot
+			return -1, fmt.Errorf("Could not journal shard %d of stripe %d: %w", shard, stripe, err)
+		}
+	}
+	binary.LittleEndian.PutUint32(hdr[recordHdrBytes:], crc.Sum32())
+	if _, err = jrnl.file.WriteAt(hdr, slotPos); err != nil {
+		jrnl.free <- slot
+		return -1, fmt.Errorf("Could not journal stripe %d: %w", stripe, err)
+	}
+	if err = jrnl.file.Sync(); err != nil {
+		jrnl.free <- slot
+		return -1, fmt.Errorf("Could not sync journal: %w", err)
+	}
+	return slot, nil
+}
+
+//acquire returns a free slot, checkpointing if there are none
+func (jrnl *journal) acquire(flush func() error) (int, error) {
+	for {
+		select {
+		case slot := <-jrnl.free:
+			return slot, nil
+		default:
+		}
+
+		jrnl.mu.Lock()
+		pending := len(jrnl.completed) > 0
+		jrnl.mu.Unlock()
+		if pending {
+			if err := jrnl.checkpoint(flush); err != nil {
+				return -1, err
+			}
+		}
+
+		select {
+		case slot := <-jrnl.free:
+			return slot, nil
+		case <-jrnl.completedCh:
+		}
+	}
+}
+
+//complete records that the shards journaled in a slot have been written
+func (jrnl *journal) complete(slot int) {
+	jrnl.mu.Lock()
+	jrnl.completed = append(jrnl.completed, slot)
+	jrnl.mu.Unlock()
+
+	select {
+	case jrnl.completedCh <- struct{}{}:
+	default:
+	}
+}
+
+//checkpoint flushes the members using flush and then frees the slots of all
+// records whose member writes completed before the flush
+func (jrnl *journal) checkpoint(flush func() error) error {
+	jrnl.checkpointMu.Lock()
+	defer jrnl.checkpointMu.Unlock()
+
+	jrnl.mu.Lock()
+	done := jrnl.completed
+	jrnl.completed = nil
+	jrnl.mu.Unlock()
+
+	restore := func() {
+		jrnl.mu.Lock()
+		jrnl.completed = append(jrnl.completed, done...)
+		jrnl.mu.Unlock()
+	}
+	if err := flush(); err != nil {
+		restore()
+		return err
+	}
+	if len(done) < 1 {
+		return nil
+	}
+
+	if err := jrnl.clearSlots(done); err != nil {
+		restore()
+		return err
+	}
+	for _, slot := range done {
+		jrnl.free <- slot
+	}
+	return nil
+}
+
+//clearSlots durably invalidates the records in the provided slots
+func (jrnl *journal) clearSlots(slots []int) error {
+	blank := make([]byte, recordHdrBytes+4)
+	for _, slot := range slots {
+		if _, err := jrnl.file.WriteAt(blank, journalHdrBytes+int64(slot)*jrnl.slotBytes); err != nil {
+			return fmt.Errorf("Could not clear journal slot %d: %w", slot, err)
+		}
+	}
+	if err := jrnl.file.Sync(); err != nil {
+		return fmt.Errorf("Could not sync journal: %w", err)
+	}
+	return nil
+}
+
+//clearAll invalidates every record, it must only be used when no writes are in
+// progress (after replaying the journal)
+func (jrnl *journal) clearAll() error {
+	slots := make([]int, cap(jrnl.free))
+	for i := range slots {
+		slots[i] = i
+	}
+	return jrnl.clearSlots(slots)
+}
+
+func (jrnl *journal) close() error {
+	if err := jrnl.file.Close(); err != nil {
+		return fmt.Errorf("Could not close journal file %q: %w", jrnl.name, err)
+	}
+	return nil
+}
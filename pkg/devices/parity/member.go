@@ -0,0 +1,87 @@
+package parity
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+//MemberState is the state of a single parity member
+type MemberState uint32
+
+const (
+	//MemberActive members hold valid shards of every stripe
+	MemberActive MemberState = iota
+	//MemberRebuilding members receive all writes but do not serve reads until they
+	// have been rebuilt
+	MemberRebuilding
+	//MemberFailed members have been removed from service and their shards are
+	// reconstructed from the other members until they are replaced
+	MemberFailed
+)
+
+func (state MemberState) String() string {
+	switch state {
+	case MemberActive:
+		return "active"
+	case MemberRebuilding:
+		return "rebuilding"
+	case MemberFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+//MemberStatus describes a parity member
+type MemberStatus struct {
+	State MemberState
+	//Err is the failure that caused the member to be removed from service, if any
+	Err error
+}
+
+type member struct {
+	dev         usbdlib.Device
+	atomicState uint32
+	errMu       sync.Mutex
+	err         error
+}
+
+func newMember(dev usbdlib.Device, state MemberState) *member {
+	return &member{dev: dev, atomicState: uint32(state)}
+}
+
+func (mbr *member) state() MemberState {
+	return MemberState(atomic.LoadUint32(&mbr.atomicState))
+}
+
+func (mbr *member) setState(state MemberState) {
+	atomic.StoreUint32(&mbr.atomicState, uint32(state))
+}
+
+//writable members receive writes
+func (mbr *member) writable() bool {
+	return mbr.state() != MemberFailed
+}
+
+//fail removes the member from service returning true if it was in service
+func (mbr *member) fail(err error) bool {
+	for {
+		state := mbr.state()
+		if state == MemberFailed {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&mbr.atomicState, uint32(state), uint32(MemberFailed)) {
+			mbr.errMu.Lock()
+			mbr.err = err
+			mbr.errMu.Unlock()
+			return true
+		}
+	}
+}
+
+func (mbr *member) status() MemberStatus {
+	mbr.errMu.Lock()
+	defer mbr.errMu.Unlock()
+	return MemberStatus{State: mbr.state(), Err: mbr.err}
+}
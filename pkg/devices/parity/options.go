@@ -0,0 +1,24 @@
+package parity
+
+//Option is a parity device option
+type Option interface {
+	apply(*Parity)
+}
+
+//OptChunkBytes instructs a Parity device to place this many contiguous bytes on
+// each member before moving to the next member of a stripe. It must be a multiple
+// of the member block sizes.
+type OptChunkBytes int64
+
+func (size OptChunkBytes) apply(dev *Parity) {
+	dev.chunkBytes = int64(size)
+}
+
+//OptJournalSlots instructs a Parity device to allow this many stripe writes to be
+// journaled before the journal must be checkpointed by flushing the members. Each
+// slot occupies a chunk per member in the journal file.
+type OptJournalSlots int
+
+func (slots OptJournalSlots) apply(dev *Parity) {
+	dev.journalSlots = int(slots)
+}
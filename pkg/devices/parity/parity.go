@@ -0,0 +1,686 @@
+package parity
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+	"github.com/tarndt/usbd/pkg/util/erasure"
+)
+
+const (
+	errClosed         = consterr.ConstErr("Device is shutdown")
+	errStripeReadFail = consterr.ConstErr("Too few members could be read to reconstruct stripe")
+
+	//DefChunkBytes is the default number of contiguous bytes placed on each member
+	DefChunkBytes = 64 * 1024
+	//DefJournalSlots is the default number of stripe writes that can be journaled
+	// between checkpoints
+	DefJournalSlots = 16
+
+	lockStripes = 256
+	maxMembers  = 64
+)
+
+//Parity is a RAID5 (single parity) or RAID6 (dual parity) device. The device is
+// divided into stripes each of which has a chunk on every member; the chunks of a
+// stripe are its data shards followed by its parity shards, which are computed
+// using Reed-Solomon coding, and the shards rotate across the members from stripe
+// to stripe so parity IO is spread evenly. The device survives as many member
+// failures as it has parity shards by reconstructing the shards of failed members
+// and failed members can be replaced and rebuilt online.
+type Parity struct {
+	size, blockSize, chunkBytes, stripeBytes, stripes int64
+	dataCount, parityCount, journalSlots              int
+	coder                                             *erasure.Coder
+	atomicOnline                                      uint64
+
+	membersMu   sync.RWMutex
+	members     []*member
+	failMu      sync.Mutex
+	stripeLocks [lockStripes]sync.RWMutex //Reads share, modifications are exclusive
+	rebuildMu   sync.Mutex                //Held for the duration of a rebuild or scrub
+
+	journal *journal
+}
+
+var _ usbdlib.Device = (*Parity)(nil)
+
+//NewParity constructs a parity device from the provided members with parityCount
+// (1 for RAID5, 2 for RAID6) parity shards per stripe. Each member contributes as
+// many chunks as fit on the smallest member. If a journal file is provided stripe
+// writes are journaled there to avoid the RAID write hole and member states are
+// persisted; if it already exists any stripe writes interrupted by a crash are
+// replayed before returning. Members are identified by their position, so they
+// must be provided in the same order each time. The device owns the member
+// devices and closes them when it is closed.
+func NewParity(members []usbdlib.Device, parityCount int, journalFile string, options ...Option) (*Parity, error) {
+	switch {
+	case parityCount < 1:
+		return nil, fmt.Errorf("A parity device requires at least one parity shard")
+	case len(members) <= parityCount:
+		return nil, fmt.Errorf("A parity device with %d parity shards requires at least %d members", parityCount, parityCount+1)
+	case len(members) > maxMembers:
+		return nil, fmt.Errorf("A parity device can have at most %d members", maxMembers)
+	}
+
+	dev := &Parity{
+		chunkBytes:   DefChunkBytes,
+		journalSlots: DefJournalSlots,
+		dataCount:    len(members) - parityCount,
+		parityCount:  parityCount,
+		atomicOnline: 1,
+	}
+	for _, opt := range options {
+		opt.apply(dev)
+	}
+
+	var err error
+	if dev.coder, err = erasure.NewCoder(dev.dataCount, dev.parityCount); err != nil {
+		return nil, err
+	}
+
+	memberBytes := members[0].Size()
+	for _, mbrDev := range members {
+		if size := mbrDev.Size(); size < memberBytes {
+			memberBytes = size
+		}
+		if blockSize := mbrDev.BlockSize(); blockSize > dev.blockSize {
+			dev.blockSize = blockSize
+		}
+	}
+	for i, mbrDev := range members {
+		if dev.blockSize%mbrDev.BlockSize() != 0 {
+			return nil, fmt.Errorf("Block size %d of member %d is incompatible with block size %d", mbrDev.BlockSize(), i, dev.blockSize)
+		}
+		dev.members = append(dev.members, newMember(mbrDev, MemberActive))
+	}
+
+	switch {
+	case dev.chunkBytes < dev.blockSize || dev.chunkBytes%dev.blockSize != 0:
+		return nil, fmt.Errorf("Chunk size %d is not a multiple of the block size %d", dev.chunkBytes, dev.blockSize)
+	case dev.journalSlots < 1:
+		return nil, fmt.Errorf("At least one journal slot is required")
+	}
+	dev.stripeBytes = int64(dev.dataCount) * dev.chunkBytes
+	dev.stripes = memberBytes / dev.chunkBytes
+	if dev.size = dev.stripes * dev.stripeBytes; dev.size < 1 {
+		return nil, fmt.Errorf("Smallest parity member is smaller than a chunk")
+	}
+
+	if journalFile != "" {
+		if err = dev.openJournal(journalFile); err != nil {
+			return nil, err
+		}
+	}
+	return dev, nil
+}
+
+//openJournal opens the journal restoring member states and replaying records
+func (dev *Parity) openJournal(journalFile string) error {
+	jrnl, states, records, err := openJournal(journalFile, dev, dev.journalSlots)
+	if err != nil {
+		return err
+	}
+	dev.journal = jrnl
+
+	if states == nil {
+		err = dev.persistStates()
+	} else {
+		for i, state := range states {
+			if state == MemberRebuilding { //If interrupted the rebuild must start over
+				state = MemberFailed
+			}
+			dev.members[i].setState(state)
+		}
+		err = dev.replay(records)
+	}
+	if err != nil {
+		jrnl.close()
+		return err
+	}
+	return nil
+}
+
+//replay rewrites the shards of all journaled stripe writes in sequence order
+func (dev *Parity) replay(records []record) error {
+	if len(records) < 1 {
+		return nil
+	}
+	log.Printf("Parity::replay(): Replaying %d journaled stripe writes", len(records))
+
+	for _, rec := range records {
+		if rec.stripe < 0 || rec.stripe >= dev.stripes {
+			return fmt.Errorf("Journaled write %d is for stripe %d which is beyond the device", rec.seq, rec.stripe)
+		}
+		for shard, data := range rec.shards {
+			mbrIdx := dev.memberOf(rec.stripe, shard)
+			if data == nil || !dev.members[mbrIdx].writable() {
+				continue
+			}
+			if _, err := dev.members[mbrIdx].dev.WriteAt(data, rec.stripe*dev.chunkBytes+rec.offset); err != nil && !dev.fail(mbrIdx, err) {
+				return fmt.Errorf("Could not replay journaled write %d of stripe %d: %w", rec.seq, rec.stripe, err)
+			}
+		}
+	}
+	if err := dev.flushMembers(); err != nil {
+		return err
+	}
+	return dev.journal.clearAll()
+}
+
+//Size of this device in bytes
+func (dev *Parity) Size() int64 {
+	return dev.size
+}
+
+//BlockSize of this device is the largest member block size
+func (dev *Parity) BlockSize() int64 {
+	return dev.blockSize
+}
+
+//Members returns the status of each member in order
+func (dev *Parity) Members() []MemberStatus {
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+
+	statuses := make([]MemberStatus, len(dev.members))
+	for i, mbr := range dev.members {
+		statuses[i] = mbr.status()
+	}
+	return statuses
+}
+
+//memberOf returns the index of the member holding a shard of a stripe
+func (dev *Parity) memberOf(stripe int64, shard int) int {
+	return int((int64(shard) + stripe) % int64(len(dev.members)))
+}
+
+//shardOf returns the shard of a stripe held by a member
+func (dev *Parity) shardOf(stripe int64, mbrIdx int) int {
+	count := int64(len(dev.members))
+	return int((int64(mbrIdx) - stripe%count + count) % count)
+}
+
+//unavailableCount returns the number of members not serving reads, the caller
+// must hold membersMu
+func (dev *Parity) unavailableCount() (count int) {
+	for _, mbr := range dev.members {
+		if mbr.state() != MemberActive {
+			count++
+		}
+	}
+	return count
+}
+
+//fail removes a failed member from service unless it is active and the device
+// can not lose another member, in which case false is returned and the member
+// remains in service. The caller must hold membersMu.
+func (dev *Parity) fail(mbrIdx int, err error) bool {
+	dev.failMu.Lock()
+	defer dev.failMu.Unlock()
+
+	mbr := dev.members[mbrIdx]
+	if mbr.state() == MemberActive && dev.unavailableCount() >= dev.parityCount {
+		return false
+	}
+	if mbr.fail(err) {
+		log.Printf("Parity::fail(): WARNING: Member %d failed and is now %s; Details: %s", mbrIdx, mbr.state(), err)
+		if err = dev.persistStates(); err != nil {
+			log.Printf("Parity::fail(): ERROR: %s", err)
+		}
+	}
+	return true
+}
+
+//persistStates persists the member states if there is a journal, the caller must
+// hold membersMu
+func (dev *Parity) persistStates() error {
+	if dev.journal == nil {
+		return nil
+	}
+	states := make([]MemberState, len(dev.members))
+	for i, mbr := range dev.members {
+		states[i] = mbr.state()
+	}
+	if err := dev.journal.writeStates(states); err != nil {
+		return fmt.Errorf("Could not persist parity member states: %w", err)
+	}
+	return nil
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (dev *Parity) ReadAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case pos >= dev.size:
+		return 0, io.EOF
+	}
+	var eof error
+	if end := pos + int64(len(buf)); end > dev.size {
+		buf, eof = buf[:dev.size-pos], io.EOF
+	}
+
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+
+	err = dev.eachStripe(buf, pos, dev.readStripe)
+	if err != nil {
+		return 0, fmt.Errorf("Could not read %d bytes at offset %d: %w", len(buf), pos, err)
+	}
+	return len(buf), eof
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (dev *Parity) WriteAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case pos+int64(len(buf)) > dev.size:
+		return 0, io.ErrUnexpectedEOF
+	case len(buf) < 1:
+		return 0, nil
+	}
+
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+
+	if err = dev.eachStripe(buf, pos, dev.writeStripe); err != nil {
+		return 0, fmt.Errorf("Could not write %d bytes at offset %d: %w", len(buf), pos, err)
+	}
+	return len(buf), nil
+}
+
+//Trim fufills part of usbdlib.Device, trimmed ranges are not passed on to the
+// members as that would invalidate the parity of the stripes containing them
+func (dev *Parity) Trim(pos int64, count int) error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+	return nil
+}
+
+//eachStripe splits an IO into the portions within each stripe
+func (dev *Parity) eachStripe(buf []byte, pos int64, op func(stripe, offset int64, buf []byte) error) error {
+	for len(buf) > 0 {
+		stripe, offset := pos/dev.stripeBytes, pos%dev.stripeBytes
+		count := dev.stripeBytes - offset
+		if count > int64(len(buf)) {
+			count = int64(len(buf))
+		}
+		if err := op(stripe, offset, buf[:count]); err != nil {
+			return err
+		}
+		buf, pos = buf[count:], pos+count
+	}
+	return nil
+}
+
+//readStripe reads part of the data of a stripe, directly from the members holding
+// it if they are active and otherwise by reconstructing the stripe
+func (dev *Parity) readStripe(stripe, offset int64, buf []byte) error {
+	lock := &dev.stripeLocks[stripe%lockStripes]
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if dev.readDirect(stripe, offset, buf) {
+		return nil
+	}
+	shards, err := dev.loadStripe(stripe)
+	if err != nil {
+		return err
+	}
+	for done := 0; done < len(buf); {
+		cur := offset + int64(done)
+		done += copy(buf[done:], shards[cur/dev.chunkBytes][cur%dev.chunkBytes:])
+	}
+	return nil
+}
+
+//readDirect concurrently reads the portions of the data shards of a stripe covered
+// by buf from their members, returning false if any member is not active or fails
+func (dev *Parity) readDirect(stripe, offset int64, buf []byte) bool {
+	type part struct {
+		mbrIdx int
+		pos    int64
+		buf    []byte
+	}
+	var parts []part
+	for done := int64(0); done < int64(len(buf)); {
+		cur := offset + done
+		shard, shardOffset := int(cur/dev.chunkBytes), cur%dev.chunkBytes
+		count := dev.chunkBytes - shardOffset
+		if remaining := int64(len(buf)) - done; count > remaining {
+			count = remaining
+		}
+		mbrIdx := dev.memberOf(stripe, shard)
+		if dev.members[mbrIdx].state() != MemberActive {
+			return false
+		}
+		parts = append(parts, part{mbrIdx: mbrIdx, pos: stripe*dev.chunkBytes + shardOffset, buf: buf[done : done+count]})
+		done += count
+	}
+
+	errs := make([]error, len(parts))
+	parallel(len(parts), func(i int) {
+		if n, err := dev.members[parts[i].mbrIdx].dev.ReadAt(parts[i].buf, parts[i].pos); err != nil && !(err == io.EOF && n == len(parts[i].buf)) {
+			errs[i] = err
+		}
+	})
+
+	ok := true
+	for i, err := range errs {
+		if err != nil {
+			dev.fail(parts[i].mbrIdx, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+//loadStripe reads whole data shards of a stripe, reconstructing those on members
+// that are not active or fail from the parity shards. The returned parity shards
+// are nil. The caller must hold the stripe lock.
+func (dev *Parity) loadStripe(stripe int64) ([][]byte, error) {
+	shards := make([][]byte, len(dev.members))
+	tried := make([]bool, len(dev.members))
+	for {
+		//Prefer data shards as they need no reconstruction
+		have, pending := 0, make([]int, 0, dev.dataCount)
+		for shard := range shards {
+			if shards[shard] != nil {
+				have++
+			}
+		}
+		for shard := 0; shard < len(shards) && have+len(pending) < dev.dataCount; shard++ {
+			if shards[shard] == nil && !tried[shard] && dev.members[dev.memberOf(stripe, shard)].state() == MemberActive {
+				pending = append(pending, shard)
+			}
+		}
+		switch {
+		case have == dev.dataCount:
+			if err := dev.coder.ReconstructData(shards); err != nil {
+				return nil, fmt.Errorf("Could not reconstruct stripe %d: %w", stripe, err)
+			}
+			return shards, nil
+		case have+len(pending) < dev.dataCount:
+			return nil, errStripeReadFail
+		}
+
+		errs := make([]error, len(pending))
+		parallel(len(pending), func(i int) {
+			shard := pending[i]
+			tried[shard] = true
+			data := make([]byte, dev.chunkBytes)
+			if n, err := dev.members[dev.memberOf(stripe, shard)].dev.ReadAt(data, stripe*dev.chunkBytes); err != nil && !(err == io.EOF && n == len(data)) {
+				errs[i] = err
+				return
+			}
+			shards[shard] = data
+		})
+		for i, err := range errs {
+			if err != nil {
+				dev.fail(dev.memberOf(stripe, pending[i]), err)
+			}
+		}
+	}
+}
+
+//writeStripe writes part of the data of a stripe along with its updated parity.
+// Writes of whole stripes compute parity from the new data alone, partial writes
+// apply the difference between the old and new data to the old parity, and if
+// members are out of service the rest of the stripe is reconstructed and the
+// parity recomputed.
+func (dev *Parity) writeStripe(stripe, offset int64, buf []byte) error {
+	lock := &dev.stripeLocks[stripe%lockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	//Only the range [lo, hi) of the touched shards changes
+	first, last := int(offset/dev.chunkBytes), int((offset+int64(len(buf))-1)/dev.chunkBytes)
+	lo, hi := int64(0), dev.chunkBytes
+	if first == last {
+		lo = offset % dev.chunkBytes
+		hi = lo + int64(len(buf))
+	}
+
+	var (
+		shards [][]byte
+		err    error
+	)
+	switch {
+	case int64(len(buf)) == dev.stripeBytes:
+		shards = make([][]byte, len(dev.members))
+		for shard := 0; shard < dev.dataCount; shard++ {
+			shards[shard] = buf[int64(shard)*dev.chunkBytes : int64(shard+1)*dev.chunkBytes]
+		}
+		err = dev.encode(shards)
+
+	case dev.canUpdate(stripe, first, last):
+		if shards, err = dev.updateParity(stripe, first, last, lo, hi, offset, buf); shards != nil || err != nil {
+			break
+		}
+		fallthrough //A member failed, reconstruct instead
+
+	default:
+		lo, hi = 0, dev.chunkBytes
+		if shards, err = dev.loadStripe(stripe); err != nil {
+			return err
+		}
+		for shard := first; shard <= last; shard++ {
+			dev.overlay(shards[shard], shard, 0, offset, buf)
+		}
+		err = dev.encode(shards)
+	}
+	if err != nil {
+		return err
+	}
+
+	targets := make([]int, 0, last-first+1+dev.parityCount)
+	for shard := first; shard <= last; shard++ {
+		targets = append(targets, shard)
+	}
+	for shard := dev.dataCount; shard < len(shards); shard++ {
+		targets = append(targets, shard)
+	}
+	return dev.storeStripe(stripe, lo, shards, targets)
+}
+
+//canUpdate returns true if the touched data shards and the parity shards of a
+// stripe are all on active members so its parity can be updated in place
+func (dev *Parity) canUpdate(stripe int64, first, last int) bool {
+	for shard := first; shard < len(dev.members); shard++ {
+		if (shard <= last || shard >= dev.dataCount) && dev.members[dev.memberOf(stripe, shard)].state() != MemberActive {
+			return false
+		}
+	}
+	return true
+}
+
+//updateParity reads the range [lo, hi) of the touched data shards and the parity
+// shards of a stripe and applies the write to them (read-modify-write without
+// reading the untouched data shards). The returned shards are nil for untouched
+// data shards, and are nil altogether if a member failed.
+func (dev *Parity) updateParity(stripe int64, first, last int, lo, hi, offset int64, buf []byte) ([][]byte, error) {
+	var touched []int
+	for shard := first; shard < len(dev.members); shard++ {
+		if shard <= last || shard >= dev.dataCount {
+			touched = append(touched, shard)
+		}
+	}
+
+	shards := make([][]byte, len(dev.members))
+	errs := make([]error, len(touched))
+	parallel(len(touched), func(i int) {
+		data := make([]byte, hi-lo)
+		if n, err := dev.members[dev.memberOf(stripe, touched[i])].dev.ReadAt(data, stripe*dev.chunkBytes+lo); err != nil && !(err == io.EOF && n == len(data)) {
+			errs[i] = err
+			return
+		}
+		shards[touched[i]] = data
+	})
+	failed := false
+	for i, err := range errs {
+		if err != nil {
+			dev.fail(dev.memberOf(stripe, touched[i]), err)
+			failed = true
+		}
+	}
+	if failed {
+		return nil, nil
+	}
+
+	delta := make([]byte, hi-lo)
+	for shard := first; shard <= last; shard++ {
+		copy(delta, shards[shard])
+		dev.overlay(shards[shard], shard, lo, offset, buf)
+		for i, val := range shards[shard] {
+			delta[i] ^= val
+		}
+		if err := dev.coder.Update(shard, delta, shards[dev.dataCount:]); err != nil {
+			return nil, fmt.Errorf("Could not update parity: %w", err)
+		}
+	}
+	return shards, nil
+}
+
+//overlay copies the portion of buf, which is at offset within the stripe, that
+// falls within the data of a shard starting at lo into data
+func (dev *Parity) overlay(data []byte, shard int, lo, offset int64, buf []byte) {
+	start := int64(shard)*dev.chunkBytes + lo
+	end := start + int64(len(data))
+	if bufStart := offset; bufStart > start {
+		start = bufStart
+	}
+	if bufEnd := offset + int64(len(buf)); bufEnd < end {
+		end = bufEnd
+	}
+	if start < end {
+		copy(data[start-int64(shard)*dev.chunkBytes-lo:], buf[start-offset:end-offset])
+	}
+}
+
+//encode allocates and computes the parity shards of a stripe
+func (dev *Parity) encode(shards [][]byte) error {
+	for shard := dev.dataCount; shard < len(shards); shard++ {
+		shards[shard] = make([]byte, dev.chunkBytes)
+	}
+	if err := dev.coder.Encode(shards); err != nil {
+		return fmt.Errorf("Could not compute parity: %w", err)
+	}
+	return nil
+}
+
+//storeStripe journals and then concurrently writes the target shards of a stripe,
+// which must be in ascending order and the same size, to their members starting
+// at lo within each chunk. Members that fail are removed from service, which is
+// only an error if too many have failed. The caller must hold the stripe lock
+// exclusively.
+func (dev *Parity) storeStripe(stripe, lo int64, shards [][]byte, targets []int) error {
+	if dev.journal != nil {
+		slot, err := dev.journal.write(stripe, lo, shards, targets, dev.flushMembers)
+		if err != nil {
+			return err
+		}
+		defer dev.journal.complete(slot)
+	}
+
+	errs := make([]error, len(targets))
+	parallel(len(targets), func(i int) {
+		if mbr := dev.members[dev.memberOf(stripe, targets[i])]; mbr.writable() {
+			_, errs[i] = mbr.dev.WriteAt(shards[targets[i]], stripe*dev.chunkBytes+lo)
+		}
+	})
+	return dev.failAll(errs, func(i int) int { return dev.memberOf(stripe, targets[i]) })
+}
+
+//failAll removes the members whose operations failed from service returning the
+// first error of a member that could not be removed
+func (dev *Parity) failAll(errs []error, mbrIdx func(i int) int) (firstErr error) {
+	for i, err := range errs {
+		if err != nil && !dev.fail(mbrIdx(i), err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//Flush fufills part of usbdlib.Device by flushing all members and then
+// checkpointing the journal
+func (dev *Parity) Flush() error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+	return dev.flush()
+}
+
+//flush is Flush without the online check, the caller must hold membersMu
+func (dev *Parity) flush() error {
+	if dev.journal == nil {
+		return dev.flushMembers()
+	}
+	return dev.journal.checkpoint(dev.flushMembers)
+}
+
+//flushMembers concurrently flushes all writable members, the caller must hold
+// membersMu
+func (dev *Parity) flushMembers() error {
+	errs := make([]error, len(dev.members))
+	parallel(len(dev.members), func(i int) {
+		if mbr := dev.members[i]; mbr.writable() {
+			errs[i] = mbr.dev.Flush()
+		}
+	})
+	if err := dev.failAll(errs, func(i int) int { return i }); err != nil {
+		return fmt.Errorf("Could not flush members: %w", err)
+	}
+	return nil
+}
+
+//Close flushes and closes all members
+func (dev *Parity) Close() error {
+	if !atomic.CompareAndSwapUint64(&dev.atomicOnline, 1, 0) {
+		return errClosed
+	}
+
+	dev.membersMu.Lock() //Wait for outstanding IO
+	defer dev.membersMu.Unlock()
+
+	err := dev.flush()
+	for i, mbr := range dev.members {
+		if closeErr := mbr.dev.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("Could not close member %d: %w", i, closeErr)
+		}
+	}
+	if dev.journal != nil {
+		if closeErr := dev.journal.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+//parallel runs op for each index in [0, count) concurrently and waits for them
+func parallel(count int, op func(i int)) {
+	if count == 1 {
+		op(0)
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			defer wg.Done()
+			op(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,241 @@
+package parity
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const (
+	memberBytes = 4 * 1024 * 1024 //4 MB
+	memberCount = 4
+)
+
+func TestParity(t *testing.T) {
+	for parityCount := 1; parityCount <= 2; parityCount++ {
+		t.Run(fmt.Sprintf("parity-%d", parityCount), func(t *testing.T) {
+			sizeBytes := uint(memberCount-parityCount) * memberBytes
+			testutil.TestUserspace(t, createDevice(t, parityCount), sizeBytes)
+			testutil.TestNBD(t, createDevice(t, parityCount), sizeBytes)
+		})
+	}
+}
+
+func createDevice(t *testing.T, parityCount int) usbdlib.Device {
+	members := make([]usbdlib.Device, memberCount)
+	for i := range members {
+		members[i] = ramdisk.NewRAMDisk(memberBytes)
+	}
+	dev, err := NewParity(members, parityCount, "")
+	if err != nil {
+		t.Fatalf("Could not create parity test device: %s", err)
+	}
+	return dev
+}
+
+//newTestMembers creates members that can be made to fail or silently drop writes
+func newTestMembers(count int) ([]*testutil.FailingDevice, []usbdlib.Device) {
+	mbrs, devs := make([]*testutil.FailingDevice, count), make([]usbdlib.Device, count)
+	for i := range mbrs {
+		mbrs[i] = testutil.NewFailingDevice(ramdisk.NewRAMDisk(memberBytes))
+		devs[i] = mbrs[i]
+	}
+	return mbrs, devs
+}
+
+//writeRandom writes random data of random sizes (partial and whole stripes) at
+// random offsets, updating the expected contents of the device
+func writeRandom(t *testing.T, dev usbdlib.Device, contents []byte, seed int64, count int) {
+	t.Helper()
+
+	rnd := rand.New(rand.NewSource(seed))
+	for i := 0; i < count; i++ {
+		data := make([]byte, 512*(1+rnd.Intn(1024)))
+		rnd.Read(data)
+		pos := rnd.Int63n(int64(len(contents)-len(data))) / 512 * 512
+		if _, err := dev.WriteAt(data, pos); err != nil {
+			t.Fatalf("Write of %d bytes at %d failed: %s", len(data), pos, err)
+		}
+		copy(contents[pos:], data)
+	}
+}
+
+func expectContents(t *testing.T, desc string, dev usbdlib.Device, expected []byte) {
+	t.Helper()
+
+	actual := make([]byte, len(expected))
+	if _, err := dev.ReadAt(actual, 0); err != nil {
+		t.Fatalf("Could not read %s: %s", desc, err)
+	} else if !bytes.Equal(actual, expected) {
+		t.Fatalf("Contents of %s were not as expected", desc)
+	}
+}
+
+func expectStates(t *testing.T, dev *Parity, expected ...MemberState) {
+	t.Helper()
+
+	for i, status := range dev.Members() {
+		if status.State != expected[i] {
+			t.Fatalf("Member %d is %s rather than %s (error: %v)", i, status.State, expected[i], status.Err)
+		}
+	}
+}
+
+func expectClean(t *testing.T, dev *Parity) {
+	t.Helper()
+
+	result, err := dev.Scrub(false, nil)
+	switch {
+	case err != nil:
+		t.Fatalf("Scrub failed: %s", err)
+	case result.Mismatches != 0 || result.Skipped != 0:
+		t.Fatalf("Scrub found %d mismatched and %d skipped stripes", result.Mismatches, result.Skipped)
+	case result.Stripes != dev.stripes:
+		t.Fatalf("Scrub verified %d stripes rather than %d", result.Stripes, dev.stripes)
+	}
+}
+
+func TestDegradedAndRebuild(t *testing.T) {
+	for parityCount := 1; parityCount <= 2; parityCount++ {
+		t.Run(fmt.Sprintf("parity-%d", parityCount), func(t *testing.T) {
+			mbrs, devs := newTestMembers(memberCount)
+			dev, err := NewParity(devs, parityCount, filepath.Join(t.TempDir(), "journal"), OptChunkBytes(16*1024))
+			if err != nil {
+				t.Fatalf("Could not create parity device: %s", err)
+			}
+			defer dev.Close()
+
+			contents := make([]byte, dev.Size())
+			writeRandom(t, dev, contents, 1, 100)
+
+			//Fail as many members as there are parity shards
+			states := make([]MemberState, memberCount)
+			for i := 0; i < parityCount; i++ {
+				mbrs[i+1].Failing.Set(true)
+				states[i+1] = MemberFailed
+			}
+			expectContents(t, "degraded device", dev, contents)
+			expectStates(t, dev, states...)
+			writeRandom(t, dev, contents, 2, 100)
+			expectContents(t, "degraded device after writes", dev, contents)
+
+			//One more failure is one too many, so the member is kept in service
+			mbrs[0].Failing.Set(true)
+			if _, err = dev.ReadAt(make([]byte, dev.Size()), 0); err == nil {
+				t.Fatalf("Read succeeded with %d failed members", parityCount+1)
+			}
+			expectStates(t, dev, states...)
+			mbrs[0].Failing.Set(false)
+			expectContents(t, "recovered device", dev, contents)
+			if err = dev.ReplaceMember(0, ramdisk.NewRAMDisk(memberBytes), nil); err == nil {
+				t.Fatalf("Replacing an active member of a fully degraded device succeeded")
+			}
+
+			//Rebuild the failed members, including the shards of stripes written while degraded
+			for i := 1; i <= parityCount; i++ {
+				var lastDone, lastTotal int64
+				progress := func(done, total int64) { lastDone, lastTotal = done, total }
+				if err = dev.ReplaceMember(i, ramdisk.NewRAMDisk(memberBytes), progress); err != nil {
+					t.Fatalf("Could not replace member %d: %s", i, err)
+				}
+				if lastTotal < 1 || lastDone != lastTotal {
+					t.Fatalf("Rebuild progress ended at %d of %d bytes", lastDone, lastTotal)
+				}
+			}
+			expectStates(t, dev, make([]MemberState, memberCount)...)
+			expectContents(t, "rebuilt device", dev, contents)
+			expectClean(t, dev)
+
+			//Rebuilt members must hold valid shards, so lose others and check the data
+			for i := 0; i < parityCount; i++ {
+				mbrs[memberCount-1-i].Failing.Set(true)
+			}
+			expectContents(t, "rebuilt device with other members failed", dev, contents)
+		})
+	}
+}
+
+func TestScrub(t *testing.T) {
+	mbrs, devs := newTestMembers(memberCount)
+	dev, err := NewParity(devs, 2, "")
+	if err != nil {
+		t.Fatalf("Could not create parity device: %s", err)
+	}
+	defer dev.Close()
+
+	contents := make([]byte, dev.Size())
+	writeRandom(t, dev, contents, 1, 50)
+	expectClean(t, dev)
+
+	//Corrupt the P shard of stripe 3 and the Q shard of stripe 7 behind the device's back
+	for _, corrupt := range []struct {
+		stripe int64
+		shard  int
+	}{{3, 2}, {7, 3}} {
+		garbage := make([]byte, 100)
+		rand.New(rand.NewSource(corrupt.stripe)).Read(garbage)
+		if _, err = mbrs[dev.memberOf(corrupt.stripe, corrupt.shard)].Device.WriteAt(garbage, corrupt.stripe*DefChunkBytes); err != nil {
+			t.Fatalf("Could not corrupt member: %s", err)
+		}
+	}
+
+	result, err := dev.Scrub(false, nil)
+	switch {
+	case err != nil:
+		t.Fatalf("Scrub failed: %s", err)
+	case result.Mismatches != 2 || result.Repaired != 0:
+		t.Fatalf("Scrub found %d mismatches and repaired %d rather than finding 2 and repairing none", result.Mismatches, result.Repaired)
+	}
+	if result, err = dev.Scrub(true, nil); err != nil {
+		t.Fatalf("Repairing scrub failed: %s", err)
+	} else if result.Mismatches != 2 || result.Repaired != 2 {
+		t.Fatalf("Scrub found %d mismatches and repaired %d rather than 2 and 2", result.Mismatches, result.Repaired)
+	}
+	expectClean(t, dev)
+	expectContents(t, "scrubbed device", dev, contents)
+}
+
+func TestJournalReplay(t *testing.T) {
+	journalFile := filepath.Join(t.TempDir(), "journal")
+	mbrs, devs := newTestMembers(memberCount)
+	dev, err := NewParity(devs, 1, journalFile, OptJournalSlots(4))
+	if err != nil {
+		t.Fatalf("Could not create parity device: %s", err)
+	}
+
+	contents := make([]byte, dev.Size())
+	writeRandom(t, dev, contents, 1, 50)
+	if err = dev.Flush(); err != nil {
+		t.Fatalf("Flush failed: %s", err)
+	}
+
+	//Simulate a crash part way through writing a stripe: member 2 never receives
+	// its shard, opening the write hole
+	mbrs[2].Dropping.Set(true)
+	data := bytes.Repeat([]byte{0xAA}, 3*DefChunkBytes/2)
+	if _, err = dev.WriteAt(data, 5*3*DefChunkBytes+1024); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	copy(contents[5*3*DefChunkBytes+1024:], data)
+
+	//Reopen the unflushed members without closing the device, as after a crash
+	for i := range devs {
+		devs[i] = testutil.NewFailingDevice(mbrs[i].Device)
+	}
+	if dev, err = NewParity(devs, 1, journalFile, OptJournalSlots(4)); err != nil {
+		t.Fatalf("Could not reopen parity device: %s", err)
+	}
+	defer dev.Close()
+	expectContents(t, "replayed device", dev, contents)
+	expectClean(t, dev)
+
+	if _, err = NewParity(devs, 2, journalFile, OptJournalSlots(4)); err == nil {
+		t.Fatalf("Journal for a different layout was accepted")
+	}
+}
@@ -0,0 +1,206 @@
+package parity
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+//Progress is invoked after each stripe is processed during a rebuild or scrub with
+// the number of bytes processed so far and the total number of bytes to process
+type Progress func(doneBytes, totalBytes int64)
+
+//ScrubResult summarizes a scrub
+type ScrubResult struct {
+	//Stripes is the number of stripes verified
+	Stripes int64
+	//Skipped is the number of stripes that could not be verified because they have
+	// shards on members that are out of service or failed during the scrub
+	Skipped int64
+	//Mismatches is the number of stripes whose parity did not match their data
+	Mismatches int64
+	//Repaired is the number of mismatched stripes whose parity was rewritten
+	Repaired int64
+}
+
+//ReplaceMember closes the member at the provided index and replaces it with a new
+// device onto which the shards of the old member are then rebuilt from the other
+// members. The new member receives writes during the rebuild but does not serve
+// reads until it completes. An active member can only be replaced if doing so
+// leaves the device able to reconstruct its data.
+func (dev *Parity) ReplaceMember(idx int, newDev usbdlib.Device, progress Progress) error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+	switch {
+	case newDev.Size() < dev.stripes*dev.chunkBytes:
+		return fmt.Errorf("New member of %d bytes is smaller than the %d bytes required", newDev.Size(), dev.stripes*dev.chunkBytes)
+	case dev.blockSize%newDev.BlockSize() != 0:
+		return fmt.Errorf("Block size %d of new member is incompatible with block size %d", newDev.BlockSize(), dev.blockSize)
+	}
+
+	dev.rebuildMu.Lock()
+	defer dev.rebuildMu.Unlock()
+
+	dev.membersMu.Lock()
+	if idx < 0 || idx >= len(dev.members) {
+		dev.membersMu.Unlock()
+		return fmt.Errorf("Parity device has no member %d", idx)
+	}
+	old := dev.members[idx]
+	if old.state() == MemberActive && dev.unavailableCount() >= dev.parityCount {
+		dev.membersMu.Unlock()
+		return fmt.Errorf("Member %d is active and the device can not lose another member", idx)
+	}
+	mbr := newMember(newDev, MemberRebuilding)
+	dev.members[idx] = mbr
+	err := dev.persistStates()
+	dev.membersMu.Unlock()
+
+	if closeErr := old.dev.Close(); closeErr != nil {
+		log.Printf("Parity::ReplaceMember(): WARNING: Could not close replaced member %d; Details: %s", idx, closeErr)
+	}
+	if err != nil {
+		return err
+	}
+	return dev.rebuild(idx, mbr, progress)
+}
+
+//rebuild reconstructs the shards of every stripe held by a rebuilding member
+func (dev *Parity) rebuild(idx int, mbr *member, progress Progress) error {
+	totalBytes := dev.stripes * dev.chunkBytes
+	for stripe := int64(0); stripe < dev.stripes; stripe++ {
+		if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+			return errClosed
+		}
+		if err := dev.rebuildStripe(stripe, idx, mbr); err != nil {
+			return fmt.Errorf("Could not rebuild member %d: %w", idx, err)
+		}
+		if progress != nil {
+			progress((stripe+1)*dev.chunkBytes, totalBytes)
+		}
+	}
+
+	dev.membersMu.Lock()
+	defer dev.membersMu.Unlock()
+	if mbr.state() != MemberRebuilding {
+		return fmt.Errorf("Member %d failed while being rebuilt: %w", idx, mbr.status().Err)
+	}
+	mbr.setState(MemberActive)
+	return dev.persistStates()
+}
+
+func (dev *Parity) rebuildStripe(stripe int64, idx int, mbr *member) error {
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+
+	lock := &dev.stripeLocks[stripe%lockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	if mbr.state() != MemberRebuilding {
+		return fmt.Errorf("Member is %s", mbr.state())
+	}
+	shards, err := dev.loadStripe(stripe)
+	if err != nil {
+		return err
+	}
+	if err = dev.encode(shards); err != nil {
+		return err
+	}
+	if _, err = mbr.dev.WriteAt(shards[dev.shardOf(stripe, idx)], stripe*dev.chunkBytes); err != nil {
+		dev.fail(idx, err)
+		return err
+	}
+	return nil
+}
+
+//Scrub reads every stripe and verifies its parity shards match its data shards. If
+// repair is true the parity of mismatched stripes is recomputed from their data and
+// rewritten. IO continues during the scrub.
+func (dev *Parity) Scrub(repair bool, progress Progress) (result ScrubResult, err error) {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return result, errClosed
+	}
+
+	dev.rebuildMu.Lock()
+	defer dev.rebuildMu.Unlock()
+
+	for stripe := int64(0); stripe < dev.stripes; stripe++ {
+		if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+			return result, errClosed
+		}
+		if err = dev.scrubStripe(stripe, repair, &result); err != nil {
+			return result, fmt.Errorf("Could not scrub stripe %d: %w", stripe, err)
+		}
+		if progress != nil {
+			progress((stripe+1)*dev.stripeBytes, dev.size)
+		}
+	}
+	if result.Mismatches > 0 {
+		log.Printf("Parity::Scrub(): WARNING: %d of %d stripes had mismatched parity, %d were repaired", result.Mismatches, result.Stripes, result.Repaired)
+	}
+	return result, nil
+}
+
+func (dev *Parity) scrubStripe(stripe int64, repair bool, result *ScrubResult) error {
+	dev.membersMu.RLock()
+	defer dev.membersMu.RUnlock()
+
+	lock := &dev.stripeLocks[stripe%lockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	if dev.unavailableCount() > 0 {
+		result.Skipped++
+		return nil
+	}
+
+	shards := make([][]byte, len(dev.members))
+	errs := make([]error, len(shards))
+	parallel(len(shards), func(shard int) {
+		data := make([]byte, dev.chunkBytes)
+		if n, err := dev.members[dev.memberOf(stripe, shard)].dev.ReadAt(data, stripe*dev.chunkBytes); err != nil && !(err == io.EOF && n == len(data)) {
+			errs[shard] = err
+			return
+		}
+		shards[shard] = data
+	})
+	failed := false
+	for shard, err := range errs {
+		if err != nil {
+			dev.fail(dev.memberOf(stripe, shard), err)
+			failed = true
+		}
+	}
+	if failed {
+		result.Skipped++
+		return nil
+	}
+
+	result.Stripes++
+	ok, err := dev.coder.Verify(shards)
+	if err != nil || ok {
+		return err
+	}
+	result.Mismatches++
+	if !repair {
+		return nil
+	}
+
+	if err = dev.encode(shards); err != nil {
+		return err
+	}
+	targets := make([]int, 0, dev.parityCount)
+	for shard := dev.dataCount; shard < len(shards); shard++ {
+		targets = append(targets, shard)
+	}
+	if err = dev.storeStripe(stripe, 0, shards, targets); err != nil {
+		return err
+	}
+	result.Repaired++
+	return nil
+}
@@ -0,0 +1,107 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const maxChainDepth = 64
+
+//defaultResolver returns a Resolver opening backing files relative to the
+// directory of the provided image, backing qcow2 images are opened with the same
+// default resolution
+func defaultResolver(filename string, depth int) Resolver {
+	return func(name, format string) (usbdlib.Device, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(filename), name)
+		}
+		switch format {
+		case "qcow2":
+		case "raw":
+			return openRaw(name)
+		case "":
+			if isQcow2, err := probe(name); err != nil {
+				return nil, err
+			} else if !isQcow2 {
+				return openRaw(name)
+			}
+		default:
+			return nil, fmt.Errorf("Backing file format %q is not supported: %w", format, ErrUnsupported)
+		}
+		return newImage(name, &config{readOnly: true, depth: depth + 1})
+	}
+}
+
+//probe returns if the named file is a qcow2 image
+func probe(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, fmt.Errorf("Could not open backing file %q: %w", filename, err)
+	}
+	defer f.Close()
+
+	var buf [4]byte
+	if _, err = f.ReadAt(buf[:], 0); err != nil && err != io.EOF {
+		return false, fmt.Errorf("Could not read backing file %q: %w", filename, err)
+	}
+	return binary.BigEndian.Uint32(buf[:]) == magic, nil
+}
+
+//rawFile is a read-only device backed by a raw image file
+type rawFile struct {
+	*os.File
+	size int64
+}
+
+var (
+	_ usbdlib.Device         = (*rawFile)(nil)
+	_ usbdlib.ReadOnlyDevice = (*rawFile)(nil)
+)
+
+func openRaw(filename string) (*rawFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open backing file %q: %w", filename, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Could not stat backing file %q: %w", filename, err)
+	}
+	return &rawFile{File: f, size: info.Size()}, nil
+}
+
+//Size of this device in bytes
+func (raw *rawFile) Size() int64 {
+	return raw.size
+}
+
+//BlockSize fufills part of usbdlib.Device
+func (raw *rawFile) BlockSize() int64 {
+	return int64(usbdlib.DefaultBlockSizeBytes)
+}
+
+//ReadOnly fufills usbdlib.ReadOnlyDevice, backing files are never written
+func (raw *rawFile) ReadOnly() bool {
+	return true
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (raw *rawFile) WriteAt(buf []byte, pos int64) (int, error) {
+	return 0, errReadOnly
+}
+
+//Trim fufills part of usbdlib.Device
+func (raw *rawFile) Trim(pos int64, count int) error {
+	return errReadOnly
+}
+
+//Flush fufills part of usbdlib.Device
+func (raw *rawFile) Flush() error {
+	return nil
+}
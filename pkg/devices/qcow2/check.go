@@ -0,0 +1,184 @@
+package qcow2
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+const maxCheckProblems = 100
+
+//CheckResult describes the consistency of an image's metadata
+type CheckResult struct {
+	Clusters    int64    //In the image file
+	Referenced  int64    //Clusters referenced by metadata
+	Leaks       int64    //Clusters whose reference count is higher than their references, which only wastes space
+	Corruptions int64    //Problems that may cause data to be lost or read incorrectly
+	Problems    []string //Descriptions of the first leaks and corruptions found
+}
+
+//OK returns if no corruptions were found
+func (res *CheckResult) OK() bool {
+	return res.Corruptions == 0
+}
+
+func (res *CheckResult) leak(format string, args ...interface{}) {
+	res.Leaks++
+	res.problem("Leaked "+format, args...)
+}
+
+func (res *CheckResult) corrupt(format string, args ...interface{}) {
+	res.Corruptions++
+	res.problem("ERROR "+format, args...)
+}
+
+func (res *CheckResult) problem(format string, args ...interface{}) {
+	if len(res.Problems) < maxCheckProblems {
+		res.Problems = append(res.Problems, fmt.Sprintf(format, args...))
+	}
+}
+
+//Check verifies the metadata of the image, including snapshots: that every
+// cluster referenced is within the file and aligned, that reference counts match
+// the references to each cluster and that copied flags are accurate. IO waits
+// while the image is checked. An error is only returned if the image can not be
+// read.
+func (img *Image) Check() (CheckResult, error) {
+	if atomic.LoadUint64(&img.atomicOnline) != 1 {
+		return CheckResult{}, errClosed
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	info, err := img.f.Stat()
+	if err != nil {
+		return CheckResult{}, fmt.Errorf("Could not stat image: %w", err)
+	}
+	res := CheckResult{Clusters: (info.Size() + img.clusterBytes - 1) / img.clusterBytes}
+	refs := make(map[int64]uint64)
+	addRange := func(what string, off uint64, bytes int64) bool {
+		switch {
+		case off%uint64(img.clusterBytes) != 0:
+			res.corrupt("%s at %d is not cluster aligned", what, off)
+			return false
+		case int64(off)+bytes > res.Clusters*img.clusterBytes:
+			res.corrupt("%s at %d is beyond the end of the image", what, off)
+			return false
+		}
+		for cluster := int64(off) / img.clusterBytes; cluster*img.clusterBytes < int64(off)+bytes; cluster++ {
+			refs[cluster]++
+		}
+		return true
+	}
+
+	addRange("Header", 0, img.clusterBytes)
+	addRange("Refcount table", img.hdr.refcountTableOffset, int64(len(img.refTable))*8)
+	for idx, entry := range img.refTable {
+		if off := entry & offsetMask; off != 0 {
+			addRange(fmt.Sprintf("Refcount block %d", idx), off, img.clusterBytes)
+		}
+	}
+	img.checkL1(&res, addRange, "Active", img.hdr.l1TableOffset, img.l1)
+	if len(img.snapshots) > 0 {
+		addRange("Snapshot table", img.hdr.snapshotsOffset, int64(len(marshalSnapshots(img.snapshots))))
+	}
+	for _, snap := range img.snapshots {
+		what := fmt.Sprintf("Snapshot %q", snap.ID)
+		l1, err := img.readTable(snap.l1TableOffset, int64(snap.l1Size))
+		if err != nil {
+			res.corrupt("%s L1 table could not be read: %s", what, err)
+			continue
+		}
+		img.checkL1(&res, addRange, what, snap.l1TableOffset, l1)
+	}
+
+	//Compare reference counts with the references found
+	last := res.Clusters
+	for idx, entry := range img.refTable {
+		if reach := int64(idx+1) * img.refBlockEntries; entry&offsetMask != 0 && reach > last {
+			last = reach
+		}
+	}
+	for cluster := int64(0); cluster < last; cluster++ {
+		count, err := img.refcount(cluster)
+		if err != nil {
+			res.corrupt("Refcount of cluster %d could not be read: %s", cluster, err)
+			continue
+		}
+		found := refs[cluster]
+		if found > 0 {
+			res.Referenced++
+		}
+		switch {
+		case count > found:
+			res.leak("cluster %d refcount=%d reference=%d", cluster, count, found)
+		case count < found:
+			res.corrupt("cluster %d refcount=%d reference=%d", cluster, count, found)
+		}
+	}
+
+	//Copied flags are only maintained in the active tables
+	for l1Idx, l1Entry := range img.l1 {
+		l2Off := l1Entry & offsetMask
+		if l2Off == 0 {
+			continue
+		}
+		if err = img.checkCopied(&res, "L2 table", l1Entry, l2Off); err != nil {
+			return res, err
+		}
+		table, err := img.readL2(l2Off)
+		if err != nil {
+			continue //Reported already
+		}
+		for idx, entry := range table {
+			if host := entry & offsetMask; host != 0 && entry&flagCompressed == 0 {
+				if err = img.checkCopied(&res, fmt.Sprintf("Data cluster %d", int64(l1Idx)*img.l2Entries+int64(idx)), entry, host); err != nil {
+					return res, err
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+//checkL1 adds the references made by an L1 table and the L2 tables it references
+func (img *Image) checkL1(res *CheckResult, addRange func(string, uint64, int64) bool, what string, l1Off uint64, l1 []uint64) {
+	addRange(what+" L1 table", l1Off, int64(len(l1))*8)
+	for l1Idx, l1Entry := range l1 {
+		l2Off := l1Entry & offsetMask
+		if l2Off == 0 {
+			continue
+		}
+		if !addRange(fmt.Sprintf("%s L2 table %d", what, l1Idx), l2Off, img.clusterBytes) {
+			continue
+		}
+		table, err := img.readL2(l2Off)
+		if err != nil {
+			res.corrupt("%s L2 table %d could not be read: %s", what, l1Idx, err)
+			continue
+		}
+		for idx, entry := range table {
+			cluster := int64(l1Idx)*img.l2Entries + int64(idx)
+			switch host := entry & offsetMask; {
+			case entry&flagCompressed != 0:
+				first, last, _, _ := img.compressedClusters(entry)
+				for c := first; c <= last; c++ {
+					addRange(fmt.Sprintf("%s compressed cluster %d", what, cluster), uint64(c*img.clusterBytes), img.clusterBytes)
+				}
+			case host != 0:
+				addRange(fmt.Sprintf("%s data cluster %d", what, cluster), host, img.clusterBytes)
+			}
+		}
+	}
+}
+
+//checkCopied verifies the copied flag of an active table entry
+func (img *Image) checkCopied(res *CheckResult, what string, entry, off uint64) error {
+	count, err := img.refcount(int64(off) / img.clusterBytes)
+	if err != nil {
+		return err
+	}
+	if copied := entry&flagCopied != 0; copied != (count == 1) {
+		res.corrupt("OFLAG_COPIED %s at %d: copied=%t refcount=%d", what, off, copied, count)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+//CreateImage creates a qcow2 image file of the provided virtual size with no
+// clusters allocated; see OptVersion, OptClusterBytes, OptRefcountBits,
+// OptBackingFile and OptBackingFormat. If the image has a backing file the size
+// may be zero to use that of the backing file. Existing files are not replaced.
+func CreateImage(filename string, size int64, options ...Option) error {
+	cfg := &config{version: 3, clusterBits: 16, refcountOrder: 4}
+	for _, opt := range options {
+		opt.apply(cfg)
+	}
+	if cfg.backingFile != "" && size < 1 {
+		resolve := cfg.resolver
+		if resolve == nil {
+			resolve = defaultResolver(filename, 0)
+		}
+		backing, err := resolve(cfg.backingFile, cfg.backingFormat)
+		if err != nil {
+			return fmt.Errorf("Could not open backing file %q to find its size: %w", cfg.backingFile, err)
+		}
+		size = backing.Size()
+		backing.Close()
+	}
+
+	clusterBytes := int64(1) << cfg.clusterBits
+	switch {
+	case cfg.version != 2 && cfg.version != 3:
+		return fmt.Errorf("Version %d images can not be created", cfg.version)
+	case cfg.clusterBits < minClusterBits || cfg.clusterBits > maxClusterBits:
+		return fmt.Errorf("Cluster size must be a power of two from %d to %d bytes", 1<<minClusterBits, 1<<maxClusterBits)
+	case cfg.refcountOrder > 6 || (cfg.version == 2 && cfg.refcountOrder != 4):
+		return fmt.Errorf("Refcount width must be a power of two from 1 to 64 bits, and 16 bits for version 2 images")
+	case size < 1:
+		return fmt.Errorf("Image size must be at least one byte")
+	case size%512 != 0:
+		return fmt.Errorf("Image size must be a multiple of 512 bytes")
+	}
+
+	hdr := header{
+		version:       cfg.version,
+		clusterBits:   cfg.clusterBits,
+		size:          uint64(size),
+		refcountOrder: cfg.refcountOrder,
+		headerLength:  v2HeaderBytes,
+	}
+	if cfg.version >= 3 {
+		hdr.headerLength = v3HeaderBytes
+	}
+
+	//Header extensions and the backing file name follow the header in the first
+	// cluster
+	var exts []byte
+	if cfg.backingFormat != "" {
+		ext := make([]byte, 8, 8+len(cfg.backingFormat)+7)
+		binary.BigEndian.PutUint32(ext, extBackingFormat)
+		binary.BigEndian.PutUint32(ext[4:], uint32(len(cfg.backingFormat)))
+		ext = append(ext, cfg.backingFormat...)
+		for len(ext)%8 != 0 {
+			ext = append(ext, 0)
+		}
+		exts = append(exts, ext...)
+	}
+	exts = append(exts, make([]byte, 8)...) //End of extensions
+	if cfg.backingFile != "" {
+		hdr.backingFileOffset = uint64(hdr.headerLength) + uint64(len(exts))
+		hdr.backingFileSize = uint32(len(cfg.backingFile))
+		if hdr.backingFileSize > 1023 || int64(hdr.backingFileOffset)+int64(hdr.backingFileSize) > clusterBytes {
+			return fmt.Errorf("Backing file name %q is too long", cfg.backingFile)
+		}
+	}
+
+	//Layout: header, refcount table, refcount blocks and then the L1 table, each
+	// sized to count the references to all of them
+	l2Coverage := clusterBytes * (clusterBytes / 8)
+	l1Entries := (size + l2Coverage - 1) / l2Coverage
+	if l1Entries*8 > maxL1Bytes {
+		return fmt.Errorf("Image size of %d bytes needs an L1 table larger than %d bytes, use larger clusters", size, maxL1Bytes)
+	}
+	hdr.l1Size = uint32(l1Entries)
+	l1Clusters := (int64(hdr.l1Size)*8 + clusterBytes - 1) / clusterBytes
+	refBlockEntries := clusterBytes * 8 / (int64(1) << cfg.refcountOrder)
+	var tableClusters, blockClusters int64
+	for {
+		total := 1 + tableClusters + blockClusters + l1Clusters
+		blocks := (total + refBlockEntries - 1) / refBlockEntries
+		tables := (blocks*8 + clusterBytes - 1) / clusterBytes
+		if blocks == blockClusters && tables == tableClusters {
+			break
+		}
+		blockClusters, tableClusters = blocks, tables
+	}
+	total := 1 + tableClusters + blockClusters + l1Clusters
+	hdr.refcountTableOffset, hdr.refcountTableClusters = uint64(clusterBytes), uint32(tableClusters)
+	hdr.l1TableOffset = uint64((1 + tableClusters + blockClusters) * clusterBytes)
+
+	meta := make([]byte, total*clusterBytes) //The L1 table is empty
+	copy(meta, hdr.marshal())
+	copy(meta[hdr.headerLength:], exts)
+	copy(meta[hdr.backingFileOffset:], cfg.backingFile)
+	for i := int64(0); i < blockClusters; i++ {
+		binary.BigEndian.PutUint64(meta[clusterBytes+i*8:], uint64((1+tableClusters+i)*clusterBytes))
+	}
+	img := &Image{refBits: int64(1) << cfg.refcountOrder}
+	for cluster := int64(0); cluster < total; cluster++ {
+		blockOff := (1 + tableClusters + cluster/refBlockEntries) * clusterBytes
+		img.setRefEntry(meta[blockOff:blockOff+clusterBytes], cluster%refBlockEntries, 1)
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("Could not create image %q: %w", filename, err)
+	}
+	if _, err = f.Write(meta); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return fmt.Errorf("Could not write image %q: %w", filename, err)
+	}
+	return nil
+}
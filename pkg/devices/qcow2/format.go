@@ -0,0 +1,315 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	//ErrCorrupt is returned when the metadata of an image is inconsistent
+	ErrCorrupt = consterr.ConstErr("Image is corrupt")
+	//ErrUnsupported is returned for images using features not implemented
+	ErrUnsupported = consterr.ConstErr("Image uses an unsupported feature")
+
+	magic = 0x514649fb //"QFI\xfb"
+
+	v2HeaderBytes = 72
+	v3HeaderBytes = 104
+
+	minClusterBits = 9
+	maxClusterBits = 21
+
+	//Limits on metadata read into memory, as qemu has, so untrusted images can not
+	// exhaust it
+	maxL1Bytes       = 32 << 20
+	maxRefTableBytes = 8 << 20
+	maxSnapshots     = 65536
+
+	//Incompatible feature bits
+	featDirty       = 1 << 0
+	featCorrupt     = 1 << 1
+	featCompression = 1 << 3 //Only the default, zlib, is supported
+
+	//Header extension types
+	extEnd           = 0
+	extBackingFormat = 0xe2792aca
+
+	//Table entry fields
+	flagCopied     = uint64(1) << 63
+	flagCompressed = uint64(1) << 62
+	flagZero       = uint64(1) << 0
+	offsetMask     = uint64(0x00fffffffffffe00)
+)
+
+//header is the fixed part of the image header
+type header struct {
+	version               uint32
+	backingFileOffset     uint64
+	backingFileSize       uint32
+	clusterBits           uint32
+	size                  uint64
+	cryptMethod           uint32
+	l1Size                uint32
+	l1TableOffset         uint64
+	refcountTableOffset   uint64
+	refcountTableClusters uint32
+	nbSnapshots           uint32
+	snapshotsOffset       uint64
+
+	//Version 3 and later
+	incompatible    uint64
+	compatible      uint64
+	autoclear       uint64
+	refcountOrder   uint32
+	headerLength    uint32
+	compressionType uint8
+}
+
+//readHeader reads and validates the header of an image file of the provided size
+func readHeader(r io.ReaderAt, fileBytes int64) (*header, error) {
+	buf := make([]byte, v3HeaderBytes+8)
+	n, err := r.ReadAt(buf, 0)
+	if n < v2HeaderBytes {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("Could not read header: %w", err)
+	}
+	if binary.BigEndian.Uint32(buf) != magic {
+		return nil, fmt.Errorf("Not a qcow2 image")
+	}
+
+	hdr := &header{
+		version:               binary.BigEndian.Uint32(buf[4:]),
+		backingFileOffset:     binary.BigEndian.Uint64(buf[8:]),
+		backingFileSize:       binary.BigEndian.Uint32(buf[16:]),
+		clusterBits:           binary.BigEndian.Uint32(buf[20:]),
+		size:                  binary.BigEndian.Uint64(buf[24:]),
+		cryptMethod:           binary.BigEndian.Uint32(buf[32:]),
+		l1Size:                binary.BigEndian.Uint32(buf[36:]),
+		l1TableOffset:         binary.BigEndian.Uint64(buf[40:]),
+		refcountTableOffset:   binary.BigEndian.Uint64(buf[48:]),
+		refcountTableClusters: binary.BigEndian.Uint32(buf[56:]),
+		nbSnapshots:           binary.BigEndian.Uint32(buf[60:]),
+		snapshotsOffset:       binary.BigEndian.Uint64(buf[64:]),
+		refcountOrder:         4,
+		headerLength:          v2HeaderBytes,
+	}
+	switch hdr.version {
+	case 2:
+	case 3:
+		if n < v3HeaderBytes {
+			return nil, fmt.Errorf("Could not read version 3 header: %w", io.ErrUnexpectedEOF)
+		}
+		hdr.incompatible = binary.BigEndian.Uint64(buf[72:])
+		hdr.compatible = binary.BigEndian.Uint64(buf[80:])
+		hdr.autoclear = binary.BigEndian.Uint64(buf[88:])
+		hdr.refcountOrder = binary.BigEndian.Uint32(buf[96:])
+		hdr.headerLength = binary.BigEndian.Uint32(buf[100:])
+		if hdr.headerLength > v3HeaderBytes && n > v3HeaderBytes {
+			hdr.compressionType = buf[104]
+		}
+	default:
+		return nil, fmt.Errorf("Version %d images are not supported: %w", hdr.version, ErrUnsupported)
+	}
+
+	switch {
+	case hdr.clusterBits < minClusterBits || hdr.clusterBits > maxClusterBits:
+		return nil, fmt.Errorf("Cluster size of 2^%d bytes is invalid: %w", hdr.clusterBits, ErrCorrupt)
+	case hdr.cryptMethod != 0:
+		return nil, fmt.Errorf("Encrypted images are not supported: %w", ErrUnsupported)
+	case hdr.incompatible&^(featDirty|featCorrupt|featCompression) != 0:
+		return nil, fmt.Errorf("Incompatible features %#x are not supported: %w", hdr.incompatible&^(featDirty|featCorrupt|featCompression), ErrUnsupported)
+	case hdr.compressionType != 0:
+		return nil, fmt.Errorf("Compression type %d is not supported: %w", hdr.compressionType, ErrUnsupported)
+	case hdr.refcountOrder > 6:
+		return nil, fmt.Errorf("Refcount order %d is invalid: %w", hdr.refcountOrder, ErrCorrupt)
+	case hdr.headerLength < v2HeaderBytes || (hdr.version >= 3 && hdr.headerLength < v3HeaderBytes) || hdr.headerLength > 1<<hdr.clusterBits:
+		return nil, fmt.Errorf("Header length %d is invalid: %w", hdr.headerLength, ErrCorrupt)
+	case int64(hdr.size) < 0:
+		return nil, fmt.Errorf("Virtual size %d is invalid: %w", hdr.size, ErrCorrupt)
+	}
+	l2Entries := uint64(1) << (hdr.clusterBits - 3)
+	if needed := (hdr.size + l2Entries<<hdr.clusterBits - 1) / (l2Entries << hdr.clusterBits); uint64(hdr.l1Size) < needed {
+		return nil, fmt.Errorf("L1 table of %d entries is too small for a %d byte image: %w", hdr.l1Size, hdr.size, ErrCorrupt)
+	}
+	if err := checkTable("L1 table", hdr.l1TableOffset, int64(hdr.l1Size)*8, maxL1Bytes, fileBytes); err != nil {
+		return nil, err
+	}
+	if err := checkTable("Refcount table", hdr.refcountTableOffset, int64(hdr.refcountTableClusters)<<hdr.clusterBits, maxRefTableBytes, fileBytes); err != nil {
+		return nil, err
+	}
+	if hdr.nbSnapshots > maxSnapshots {
+		return nil, fmt.Errorf("Snapshot table of %d entries exceeds the limit of %d: %w", hdr.nbSnapshots, maxSnapshots, ErrCorrupt)
+	}
+	return hdr, nil
+}
+
+//checkTable verifies a table of the provided size in bytes is within the limit
+// and the file
+func checkTable(what string, off uint64, bytes, maxBytes, fileBytes int64) error {
+	switch {
+	case bytes > maxBytes:
+		return fmt.Errorf("%s of %d bytes exceeds the limit of %d: %w", what, bytes, maxBytes, ErrCorrupt)
+	case off > uint64(fileBytes) || bytes > fileBytes-int64(off):
+		return fmt.Errorf("%s of %d bytes at %d is beyond the end of the image: %w", what, bytes, off, ErrCorrupt)
+	}
+	return nil
+}
+
+//marshal encodes the fixed part of the header, without any fields following it
+// that this package does not interpret
+func (hdr *header) marshal() []byte {
+	buf := make([]byte, v2HeaderBytes, v3HeaderBytes)
+	binary.BigEndian.PutUint32(buf, magic)
+	binary.BigEndian.PutUint32(buf[4:], hdr.version)
+	binary.BigEndian.PutUint64(buf[8:], hdr.backingFileOffset)
+	binary.BigEndian.PutUint32(buf[16:], hdr.backingFileSize)
+	binary.BigEndian.PutUint32(buf[20:], hdr.clusterBits)
+	binary.BigEndian.PutUint64(buf[24:], hdr.size)
+	binary.BigEndian.PutUint32(buf[32:], hdr.cryptMethod)
+	binary.BigEndian.PutUint32(buf[36:], hdr.l1Size)
+	binary.BigEndian.PutUint64(buf[40:], hdr.l1TableOffset)
+	binary.BigEndian.PutUint64(buf[48:], hdr.refcountTableOffset)
+	binary.BigEndian.PutUint32(buf[56:], hdr.refcountTableClusters)
+	binary.BigEndian.PutUint32(buf[60:], hdr.nbSnapshots)
+	binary.BigEndian.PutUint64(buf[64:], hdr.snapshotsOffset)
+	if hdr.version >= 3 {
+		buf = buf[:v3HeaderBytes]
+		binary.BigEndian.PutUint64(buf[72:], hdr.incompatible)
+		binary.BigEndian.PutUint64(buf[80:], hdr.compatible)
+		binary.BigEndian.PutUint64(buf[88:], hdr.autoclear)
+		binary.BigEndian.PutUint32(buf[96:], hdr.refcountOrder)
+		binary.BigEndian.PutUint32(buf[100:], hdr.headerLength)
+	}
+	return buf
+}
+
+//readExtensions reads the header extensions of an image and returns the format
+// of the backing file, if recorded
+func readExtensions(r io.ReaderAt, hdr *header) (backingFormat string, err error) {
+	end := int64(1) << hdr.clusterBits
+	if hdr.backingFileOffset != 0 && int64(hdr.backingFileOffset) < end {
+		end = int64(hdr.backingFileOffset)
+	}
+	var ext [8]byte
+	for off := int64(hdr.headerLength); off+8 <= end; {
+		if _, err = r.ReadAt(ext[:], off); err != nil {
+			return "", fmt.Errorf("Could not read header extension: %w", err)
+		}
+		typ, length := binary.BigEndian.Uint32(ext[:]), int64(binary.BigEndian.Uint32(ext[4:]))
+		if typ == extEnd {
+			break
+		}
+		if off+8+length > end {
+			return "", fmt.Errorf("Header extension %#x of %d bytes overruns the header: %w", typ, length, ErrCorrupt)
+		}
+		if typ == extBackingFormat {
+			data := make([]byte, length)
+			if _, err = r.ReadAt(data, off+8); err != nil {
+				return "", fmt.Errorf("Could not read backing file format: %w", err)
+			}
+			backingFormat = string(data)
+		}
+		off += 8 + (length+7)&^7
+	}
+	return backingFormat, nil
+}
+
+//SnapshotInfo describes an internal snapshot of an image
+type SnapshotInfo struct {
+	ID           string
+	Name         string
+	Date         time.Time
+	VMClock      time.Duration
+	VMStateBytes int64
+	Size         int64 //Of the disk when the snapshot was taken
+}
+
+//snapshot is an entry of the snapshot table
+type snapshot struct {
+	SnapshotInfo
+	l1TableOffset uint64
+	l1Size        uint32
+	extra         []byte
+}
+
+const snapshotHdrBytes = 40
+
+//readSnapshots reads the snapshot table of an image file of the provided size
+func readSnapshots(r io.ReaderAt, hdr *header, fileBytes int64) ([]snapshot, error) {
+	snaps := make([]snapshot, 0, hdr.nbSnapshots)
+	off := int64(hdr.snapshotsOffset)
+	var fixed [snapshotHdrBytes]byte
+	for i := uint32(0); i < hdr.nbSnapshots; i++ {
+		if _, err := r.ReadAt(fixed[:], off); err != nil {
+			return nil, fmt.Errorf("Could not read snapshot table entry %d: %w", i, err)
+		}
+		snap := snapshot{
+			l1TableOffset: binary.BigEndian.Uint64(fixed[0:]),
+			l1Size:        binary.BigEndian.Uint32(fixed[8:]),
+		}
+		idBytes, nameBytes := int64(binary.BigEndian.Uint16(fixed[12:])), int64(binary.BigEndian.Uint16(fixed[14:]))
+		snap.Date = time.Unix(int64(binary.BigEndian.Uint32(fixed[16:])), int64(binary.BigEndian.Uint32(fixed[20:])))
+		snap.VMClock = time.Duration(binary.BigEndian.Uint64(fixed[24:]))
+		snap.VMStateBytes = int64(binary.BigEndian.Uint32(fixed[32:]))
+		extraBytes := int64(binary.BigEndian.Uint32(fixed[36:]))
+		if extraBytes > 1024 {
+			return nil, fmt.Errorf("Snapshot table entry %d has %d bytes of extra data: %w", i, extraBytes, ErrCorrupt)
+		}
+		if err := checkTable(fmt.Sprintf("Snapshot %d L1 table", i), snap.l1TableOffset, int64(snap.l1Size)*8, maxL1Bytes, fileBytes); err != nil {
+			return nil, err
+		}
+
+		variable := make([]byte, extraBytes+idBytes+nameBytes)
+		if _, err := r.ReadAt(variable, off+snapshotHdrBytes); err != nil {
+			return nil, fmt.Errorf("Could not read snapshot table entry %d: %w", i, err)
+		}
+		snap.extra = variable[:extraBytes]
+		snap.ID = string(variable[extraBytes : extraBytes+idBytes])
+		snap.Name = string(variable[extraBytes+idBytes:])
+		snap.Size = int64(hdr.size)
+		if extraBytes >= 8 {
+			snap.VMStateBytes = int64(binary.BigEndian.Uint64(snap.extra))
+		}
+		if extraBytes >= 16 {
+			snap.Size = int64(binary.BigEndian.Uint64(snap.extra[8:]))
+		}
+		snaps = append(snaps, snap)
+		off += (snapshotHdrBytes + int64(len(variable)) + 7) &^ 7
+	}
+	return snaps, nil
+}
+
+//marshalSnapshots encodes a snapshot table
+func marshalSnapshots(snaps []snapshot) []byte {
+	var buf []byte
+	for _, snap := range snaps {
+		entry := make([]byte, snapshotHdrBytes, snapshotHdrBytes+len(snap.extra)+len(snap.ID)+len(snap.Name)+7)
+		binary.BigEndian.PutUint64(entry[0:], snap.l1TableOffset)
+		binary.BigEndian.PutUint32(entry[8:], snap.l1Size)
+		binary.BigEndian.PutUint16(entry[12:], uint16(len(snap.ID)))
+		binary.BigEndian.PutUint16(entry[14:], uint16(len(snap.Name)))
+		binary.BigEndian.PutUint32(entry[16:], uint32(snap.Date.Unix()))
+		binary.BigEndian.PutUint32(entry[20:], uint32(snap.Date.Nanosecond()))
+		binary.BigEndian.PutUint64(entry[24:], uint64(snap.VMClock))
+		vmState := uint32(snap.VMStateBytes)
+		if snap.VMStateBytes > int64(^uint32(0)) {
+			vmState = 0 //Recorded in the extra data
+		}
+		binary.BigEndian.PutUint32(entry[32:], vmState)
+		binary.BigEndian.PutUint32(entry[36:], uint32(len(snap.extra)))
+		entry = append(entry, snap.extra...)
+		entry = append(entry, snap.ID...)
+		entry = append(entry, snap.Name...)
+		for len(entry)%8 != 0 {
+			entry = append(entry, 0)
+		}
+		buf = append(buf, entry...)
+	}
+	return buf
+}
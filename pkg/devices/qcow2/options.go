@@ -0,0 +1,95 @@
+package qcow2
+
+import "github.com/tarndt/usbd/pkg/usbdlib"
+
+//Option is a qcow2 image option, those noted are only used by CreateImage
+type Option interface {
+	apply(*config)
+}
+
+//Resolver opens the backing file of an image, given its name and format as
+// recorded in the image (the format may be empty). The device returned is owned
+// by the image and closed when it is.
+type Resolver func(name, format string) (usbdlib.Device, error)
+
+type config struct {
+	readOnly      bool
+	resolver      Resolver
+	depth         int
+	version       uint32
+	clusterBits   uint32
+	refcountOrder uint32
+	backingFile   string
+	backingFormat string
+}
+
+//OptReadOnly instructs an Image to open the image read-only, refusing writes
+type OptReadOnly bool
+
+func (readOnly OptReadOnly) apply(cfg *config) {
+	cfg.readOnly = bool(readOnly)
+}
+
+//OptResolver instructs an Image to open its backing file with the provided
+// function. By default backing files are opened read-only relative to the image's
+// directory, as qcow2 images if they are (or are recorded as) qcow2, and as raw
+// images otherwise.
+type OptResolver Resolver
+
+func (resolver OptResolver) apply(cfg *config) {
+	cfg.resolver = Resolver(resolver)
+}
+
+//OptVersion instructs CreateImage to create an image of the provided version, 2
+// or 3, the default is 3. Version 2 images can not record zero clusters, so
+// discarding a cluster of an image with a backing file leaves it allocated.
+type OptVersion int
+
+func (version OptVersion) apply(cfg *config) {
+	cfg.version = uint32(version)
+}
+
+//OptClusterBytes instructs CreateImage to use clusters of this size, a power of
+// two from 512 bytes to 2MB, the default is DefClusterBytes
+type OptClusterBytes int64
+
+func (size OptClusterBytes) apply(cfg *config) {
+	cfg.clusterBits = 0
+	for int64(1)<<cfg.clusterBits < int64(size) && cfg.clusterBits < 63 {
+		cfg.clusterBits++
+	}
+	if int64(1)<<cfg.clusterBits != int64(size) {
+		cfg.clusterBits = 0 //Rejected by CreateImage
+	}
+}
+
+//OptRefcountBits instructs CreateImage to use reference counts of this width, a
+// power of two from 1 to 64, the default is 16 which version 2 images require
+type OptRefcountBits int
+
+func (bits OptRefcountBits) apply(cfg *config) {
+	cfg.refcountOrder = 0
+	for 1<<cfg.refcountOrder < int(bits) && cfg.refcountOrder < 7 {
+		cfg.refcountOrder++
+	}
+	if 1<<cfg.refcountOrder != int(bits) {
+		cfg.refcountOrder = 7 //Rejected by CreateImage
+	}
+}
+
+//OptBackingFile instructs CreateImage to create an image whose unallocated
+// clusters are read from the named backing file, which is opened (using any
+// OptResolver) to find its size if a size is not provided
+type OptBackingFile string
+
+func (name OptBackingFile) apply(cfg *config) {
+	cfg.backingFile = string(name)
+}
+
+//OptBackingFormat instructs CreateImage to record the format of the backing
+// file, such as "qcow2" or "raw", rather than leave it to be probed
+type OptBackingFormat string
+
+func (format OptBackingFormat) apply(cfg *config) {
+	cfg.backingFormat = string(format)
+}
@@ -0,0 +1,649 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed   = consterr.ConstErr("Device is shutdown")
+	errReadOnly = consterr.ConstErr("Image is read-only")
+	errNegative = consterr.ConstErr("Position is negative")
+
+	//DefClusterBytes is the default cluster size of images created
+	DefClusterBytes = 64 * 1024
+
+	maxCachedTables = 512
+)
+
+//Image is a device backed by a qcow2 (version 2 or 3) image file. Clusters are
+// allocated as they are written, reusing those freed by Trim. Clusters never
+// written are read from the backing file, if the image has one, or as zeros.
+// Compressed clusters and internal snapshots can be read but are not created by
+// writes; writing to a compressed cluster or one shared with a snapshot copies
+// it first. Encryption, external data files, extended L2 entries and compression
+// other than zlib are not supported.
+type Image struct {
+	f            *os.File
+	filename     string
+	readOnly     bool
+	hdr          header
+	clusterBytes int64
+	l2Entries    int64
+	l1           []uint64
+	snapshots    []snapshot
+	backing      usbdlib.Device
+	backingName  string
+	backingFmt   string
+	atomicOnline uint64
+	mu           sync.RWMutex //Held exclusively to change metadata or close
+
+	//Reference counts, guarded by mu
+	refBits         int64
+	refBlockEntries int64
+	refTable        []uint64
+	refBlocks       map[uint64][]byte
+	endCluster      int64 //Clusters past this are not in use
+	freeHint        int64 //Clusters before this are in use
+
+	cacheMu sync.Mutex
+	l2Cache map[uint64][]uint64
+}
+
+var (
+	_ usbdlib.Device         = (*Image)(nil)
+	_ usbdlib.ReadOnlyDevice = (*Image)(nil)
+)
+
+//NewImage opens the provided qcow2 image file as a device, and its backing file
+// if it has one (see OptResolver). Images whose dirty bit is set, as refcounts may
+// be out of date, or that are marked corrupt can only be opened read-only.
+func NewImage(filename string, options ...Option) (*Image, error) {
+	cfg := &config{}
+	for _, opt := range options {
+		opt.apply(cfg)
+	}
+	return newImage(filename, cfg)
+}
+
+func newImage(filename string, cfg *config) (*Image, error) {
+	if cfg.depth > maxChainDepth {
+		return nil, fmt.Errorf("Backing file chain is longer than %d images", maxChainDepth)
+	}
+	flags := os.O_RDWR
+	if cfg.readOnly {
+		flags = os.O_RDONLY
+	}
+	f, err := os.OpenFile(filename, flags, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open image %q: %w", filename, err)
+	}
+	img := &Image{
+		f:            f,
+		filename:     filename,
+		readOnly:     cfg.readOnly,
+		atomicOnline: 1,
+		refBlocks:    make(map[uint64][]byte),
+		l2Cache:      make(map[uint64][]uint64),
+	}
+	if err = img.load(cfg); err != nil {
+		img.f.Close()
+		if img.backing != nil {
+			img.backing.Close()
+		}
+		return nil, fmt.Errorf("Could not open image %q: %w", filename, err)
+	}
+	return img, nil
+}
+
+//load reads and validates the metadata of the image and opens its backing file
+func (img *Image) load(cfg *config) error {
+	info, err := img.f.Stat()
+	if err != nil {
+		return fmt.Errorf("Could not stat image: %w", err)
+	}
+	hdr, err := readHeader(img.f, info.Size())
+	if err != nil {
+		return err
+	}
+	img.hdr = *hdr
+	switch {
+	case img.readOnly:
+	case hdr.incompatible&featCorrupt != 0:
+		return fmt.Errorf("Image is marked corrupt, it can only be opened read-only: %w", ErrCorrupt)
+	case hdr.incompatible&featDirty != 0:
+		return fmt.Errorf("Image has the dirty bit set, its refcounts must be repaired before it can be written: %w", ErrUnsupported)
+	}
+
+	img.clusterBytes = int64(1) << hdr.clusterBits
+	img.l2Entries = img.clusterBytes / 8
+	img.refBits = int64(1) << hdr.refcountOrder
+	img.refBlockEntries = img.clusterBytes * 8 / img.refBits
+	img.endCluster = (info.Size() + img.clusterBytes - 1) / img.clusterBytes
+
+	if img.l1, err = img.readTable(hdr.l1TableOffset, int64(hdr.l1Size)); err != nil {
+		return fmt.Errorf("Could not read L1 table: %w", err)
+	}
+	if img.refTable, err = img.readTable(hdr.refcountTableOffset, int64(hdr.refcountTableClusters)*img.clusterBytes/8); err != nil {
+		return fmt.Errorf("Could not read refcount table: %w", err)
+	}
+	if img.snapshots, err = readSnapshots(img.f, hdr, info.Size()); err != nil {
+		return err
+	}
+	if img.backingFmt, err = readExtensions(img.f, hdr); err != nil {
+		return err
+	}
+
+	if hdr.backingFileOffset != 0 {
+		if hdr.backingFileSize > 1023 || int64(hdr.backingFileOffset)+int64(hdr.backingFileSize) > img.clusterBytes {
+			return fmt.Errorf("Backing file name of %d bytes is invalid: %w", hdr.backingFileSize, ErrCorrupt)
+		}
+		name := make([]byte, hdr.backingFileSize)
+		if _, err = img.f.ReadAt(name, int64(hdr.backingFileOffset)); err != nil {
+			return fmt.Errorf("Could not read backing file name: %w", err)
+		}
+		img.backingName = string(name)
+		resolve := cfg.resolver
+		if resolve == nil {
+			resolve = defaultResolver(img.filename, cfg.depth)
+		}
+		if img.backing, err = resolve(img.backingName, img.backingFmt); err != nil {
+			return fmt.Errorf("Could not open backing file %q: %w", img.backingName, err)
+		}
+	}
+
+	if !img.readOnly && hdr.autoclear != 0 {
+		//Features such as bitmaps are not maintained by writes, so are invalidated
+		img.hdr.autoclear = 0
+		if err = img.writeHeader(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//readTable reads a table of 64-bit entries
+func (img *Image) readTable(off uint64, entries int64) ([]uint64, error) {
+	if entries == 0 {
+		return nil, nil
+	}
+	if off%uint64(img.clusterBytes) != 0 {
+		return nil, fmt.Errorf("Table at %d is not cluster aligned: %w", off, ErrCorrupt)
+	}
+	buf := make([]byte, entries*8)
+	if _, err := img.f.ReadAt(buf, int64(off)); err != nil {
+		return nil, err
+	}
+	table := make([]uint64, entries)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	return table, nil
+}
+
+//writeTable writes a table of 64-bit entries
+func (img *Image) writeTable(off uint64, table []uint64) error {
+	buf := make([]byte, len(table)*8)
+	for i, entry := range table {
+		binary.BigEndian.PutUint64(buf[i*8:], entry)
+	}
+	_, err := img.f.WriteAt(buf, int64(off))
+	return err
+}
+
+//writeHeader writes the fixed part of the header
+func (img *Image) writeHeader() error {
+	if _, err := img.f.WriteAt(img.hdr.marshal(), 0); err != nil {
+		return fmt.Errorf("Could not write header: %w", err)
+	}
+	return nil
+}
+
+//Size of this device in bytes
+func (img *Image) Size() int64 {
+	return int64(img.hdr.size)
+}
+
+//BlockSize of this device is 4KB, or the 512 byte sector size if the image size
+// is not a multiple of 4KB
+func (img *Image) BlockSize() int64 {
+	if int64(img.hdr.size)%int64(usbdlib.DefaultBlockSizeBytes) != 0 {
+		return 512
+	}
+	return int64(usbdlib.DefaultBlockSizeBytes)
+}
+
+//ReadOnly returns if the image was opened read-only, fulfilling
+// usbdlib.ReadOnlyDevice
+func (img *Image) ReadOnly() bool {
+	return img.readOnly
+}
+
+//Version returns the qcow2 version of the image
+func (img *Image) Version() int {
+	return int(img.hdr.version)
+}
+
+//ClusterBytes returns the cluster size of the image
+func (img *Image) ClusterBytes() int64 {
+	return img.clusterBytes
+}
+
+//Backing returns the name and format of the backing file as recorded in the
+// image, and the device opened for it; all are empty if there is none
+func (img *Image) Backing() (name, format string, dev usbdlib.Device) {
+	return img.backingName, img.backingFmt, img.backing
+}
+
+//readL2 returns the L2 table at the provided offset, it must not be modified
+func (img *Image) readL2(off uint64) ([]uint64, error) {
+	img.cacheMu.Lock()
+	table, cached := img.l2Cache[off]
+	img.cacheMu.Unlock()
+	if cached {
+		return table, nil
+	}
+
+	table, err := img.readTable(off, img.l2Entries)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read L2 table at %d: %w", off, err)
+	}
+	img.cacheMu.Lock()
+	if len(img.l2Cache) >= maxCachedTables {
+		img.l2Cache = make(map[uint64][]uint64)
+	}
+	img.l2Cache[off] = table
+	img.cacheMu.Unlock()
+	return table, nil
+}
+
+//lookup returns the L2 entry of a guest cluster via the provided L1 table
+func (img *Image) lookup(l1 []uint64, cluster int64) (uint64, error) {
+	l1Idx := cluster / img.l2Entries
+	if l1Idx >= int64(len(l1)) || l1[l1Idx]&offsetMask == 0 {
+		return 0, nil
+	}
+	table, err := img.readL2(l1[l1Idx] & offsetMask)
+	if err != nil {
+		return 0, err
+	}
+	return table[cluster%img.l2Entries], nil
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (img *Image) ReadAt(buf []byte, pos int64) (int, error) {
+	switch {
+	case pos < 0:
+		return 0, errNegative
+	case atomic.LoadUint64(&img.atomicOnline) != 1:
+		return 0, errClosed
+	}
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+
+	return img.readFrom(img.l1, int64(img.hdr.size), buf, pos)
+}
+
+//readFrom reads the guest contents mapped by the provided L1 table, of a disk of
+// the provided size; the caller must hold mu
+func (img *Image) readFrom(l1 []uint64, size int64, buf []byte, pos int64) (count int, err error) {
+	if pos >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if end := pos + int64(len(buf)); end > size {
+		buf, eof = buf[:size-pos], io.EOF
+	}
+
+	for count < len(buf) {
+		offset := pos + int64(count)
+		inCluster := offset % img.clusterBytes
+		n := len(buf) - count
+		if remaining := img.clusterBytes - inCluster; int64(n) > remaining {
+			n = int(remaining)
+		}
+		entry, err := img.lookup(l1, offset/img.clusterBytes)
+		if err != nil {
+			return count, err
+		}
+		if err = img.readEntry(entry, buf[count:count+n], offset, inCluster); err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, eof
+}
+
+//readEntry reads part of the guest cluster mapped by the provided L2 entry
+func (img *Image) readEntry(entry uint64, buf []byte, offset, inCluster int64) error {
+	switch host := entry & offsetMask; {
+	case entry&flagCompressed != 0:
+		data, err := img.decompress(entry)
+		if err != nil {
+			return err
+		}
+		copy(buf, data[inCluster:])
+	case img.hdr.version >= 3 && entry&flagZero != 0:
+		util.ZeroFill(buf)
+	case host == 0:
+		return img.readBacking(buf, offset)
+	default:
+		n, err := img.f.ReadAt(buf, int64(host)+inCluster)
+		if err == io.EOF { //Past the end of a sparse file
+			util.ZeroFill(buf[n:])
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("Could not read cluster at %d: %w", host, err)
+		}
+	}
+	return nil
+}
+
+//readBacking reads unallocated guest contents from the backing file, if any
+func (img *Image) readBacking(buf []byte, offset int64) error {
+	if img.backing == nil || offset >= img.backing.Size() {
+		util.ZeroFill(buf)
+		return nil
+	}
+	n := int64(len(buf))
+	if remaining := img.backing.Size() - offset; n > remaining {
+		n = remaining
+	}
+	if read, err := img.backing.ReadAt(buf[:n], offset); err != nil && (err != io.EOF || int64(read) < n) {
+		return fmt.Errorf("Could not read backing file: %w", err)
+	}
+	util.ZeroFill(buf[n:])
+	return nil
+}
+
+//decompress reads and inflates a compressed cluster
+func (img *Image) decompress(entry uint64) ([]byte, error) {
+	_, _, off, length := img.compressedClusters(entry)
+	compressed := make([]byte, length)
+	n, err := img.f.ReadAt(compressed, off)
+	if err != nil && err != io.EOF { //The final compressed cluster may end early
+		return nil, fmt.Errorf("Could not read compressed cluster at %d: %w", off, err)
+	}
+
+	data := make([]byte, img.clusterBytes)
+	rdr := flate.NewReader(bytes.NewReader(compressed[:n]))
+	defer rdr.Close()
+	if _, err = io.ReadFull(rdr, data); err != nil {
+		return nil, fmt.Errorf("Could not inflate compressed cluster at %d: %v: %w", off, err, ErrCorrupt)
+	}
+	return data, nil
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (img *Image) WriteAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case pos < 0:
+		return 0, errNegative
+	case atomic.LoadUint64(&img.atomicOnline) != 1:
+		return 0, errClosed
+	case img.readOnly:
+		return 0, errReadOnly
+	case pos+int64(len(buf)) > int64(img.hdr.size):
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	for count < len(buf) {
+		offset := pos + int64(count)
+		inCluster := offset % img.clusterBytes
+		n := len(buf) - count
+		if remaining := img.clusterBytes - inCluster; int64(n) > remaining {
+			n = int(remaining)
+		}
+		if err = img.writeCluster(offset/img.clusterBytes, buf[count:count+n], inCluster); err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+//writableL2 returns the offset and contents of the L2 table mapping the provided
+// guest cluster, allocating it or copying it if shared with a snapshot; the caller
+// must hold mu exclusively
+func (img *Image) writableL2(cluster int64) (uint64, []uint64, error) {
+	l1Idx := cluster / img.l2Entries
+	entry := img.l1[l1Idx]
+	old := entry & offsetMask
+	if old != 0 && entry&flagCopied != 0 {
+		table, err := img.readL2(old)
+		return old, table, err
+	}
+
+	var table []uint64
+	if old != 0 {
+		refs, err := img.refcount(int64(old) / img.clusterBytes)
+		if err != nil {
+			return 0, nil, err
+		}
+		if table, err = img.readL2(old); err != nil {
+			return 0, nil, err
+		}
+		if refs == 1 { //Not actually shared
+			return old, table, img.setL1Entry(l1Idx, old|flagCopied)
+		}
+		table = append([]uint64(nil), table...)
+	} else {
+		table = make([]uint64, img.l2Entries)
+	}
+
+	off, err := img.allocCluster()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = img.writeTable(off, table); err != nil {
+		return 0, nil, fmt.Errorf("Could not write L2 table: %w", err)
+	}
+	img.cacheMu.Lock()
+	img.l2Cache[off] = table
+	img.cacheMu.Unlock()
+	if err = img.setL1Entry(l1Idx, off|flagCopied); err != nil {
+		return 0, nil, err
+	}
+	if old != 0 {
+		if err = img.decRef(int64(old) / img.clusterBytes); err != nil {
+			return 0, nil, err
+		}
+	}
+	return off, table, nil
+}
+
+func (img *Image) setL1Entry(l1Idx int64, entry uint64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], entry)
+	if _, err := img.f.WriteAt(buf[:], int64(img.hdr.l1TableOffset)+l1Idx*8); err != nil {
+		return fmt.Errorf("Could not write L1 table: %w", err)
+	}
+	img.l1[l1Idx] = entry
+	return nil
+}
+
+//setL2Entry sets an entry of a writable L2 table, the caller must hold mu
+// exclusively
+func (img *Image) setL2Entry(off uint64, table []uint64, idx int64, entry uint64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], entry)
+	if _, err := img.f.WriteAt(buf[:], int64(off)+idx*8); err != nil {
+		return fmt.Errorf("Could not write L2 table: %w", err)
+	}
+	table[idx] = entry
+	return nil
+}
+
+//writeCluster writes part of a guest cluster, allocating a host cluster for it if
+// it does not have one to itself; the caller must hold mu exclusively
+func (img *Image) writeCluster(cluster int64, data []byte, inCluster int64) error {
+	l2Off, table, err := img.writableL2(cluster)
+	if err != nil {
+		return err
+	}
+	idx := cluster % img.l2Entries
+	entry := table[idx]
+	host := entry & offsetMask
+	full := int64(len(data)) == img.clusterBytes || (inCluster == 0 && cluster*img.clusterBytes+int64(len(data)) == int64(img.hdr.size))
+
+	if full && img.hdr.version >= 3 && util.IsZeros(data) {
+		if entry == flagZero || (entry == 0 && img.backing == nil) {
+			return nil
+		}
+		if err = img.setL2Entry(l2Off, table, idx, flagZero); err != nil {
+			return err
+		}
+		return img.freeEntry(entry)
+	}
+
+	if host != 0 && entry&flagCompressed == 0 {
+		exclusive := entry&flagCopied != 0
+		if !exclusive {
+			refs, err := img.refcount(int64(host) / img.clusterBytes)
+			if err != nil {
+				return err
+			}
+			exclusive = refs == 1
+		}
+		if exclusive && (img.hdr.version < 3 || entry&flagZero == 0) {
+			if _, err = img.f.WriteAt(data, int64(host)+inCluster); err != nil {
+				return fmt.Errorf("Could not write cluster at %d: %w", host, err)
+			}
+			if entry&flagCopied == 0 {
+				return img.setL2Entry(l2Off, table, idx, host|flagCopied)
+			}
+			return nil
+		}
+	}
+
+	//Copy the current contents, if any remain, to a newly allocated cluster
+	contents := make([]byte, img.clusterBytes)
+	if !full {
+		guestBytes := img.clusterBytes
+		if remaining := int64(img.hdr.size) - cluster*img.clusterBytes; remaining < guestBytes {
+			guestBytes = remaining
+		}
+		if err = img.readEntry(entry, contents[:guestBytes], cluster*img.clusterBytes, 0); err != nil {
+			return err
+		}
+	}
+	copy(contents[inCluster:], data)
+	newHost, err := img.allocCluster()
+	if err != nil {
+		return err
+	}
+	if _, err = img.f.WriteAt(contents, int64(newHost)); err != nil {
+		return fmt.Errorf("Could not write cluster at %d: %w", newHost, err)
+	}
+	if err = img.setL2Entry(l2Off, table, idx, newHost|flagCopied); err != nil {
+		return err
+	}
+	return img.freeEntry(entry)
+}
+
+//Trim fufills part of usbdlib.Device. Whole clusters in the range are released,
+// and read as zeros afterwards unless a version 2 image has a backing file, in
+// which case they are left as they are.
+func (img *Image) Trim(pos int64, count int) error {
+	switch {
+	case pos < 0:
+		return errNegative
+	case atomic.LoadUint64(&img.atomicOnline) != 1:
+		return errClosed
+	case img.readOnly:
+		return errReadOnly
+	case img.hdr.version < 3 && img.backing != nil:
+		return nil
+	}
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	first, last := (pos+img.clusterBytes-1)/img.clusterBytes, (pos+int64(count))/img.clusterBytes
+	if pos+int64(count) >= int64(img.hdr.size) { //The final cluster may be short
+		last = (int64(img.hdr.size) + img.clusterBytes - 1) / img.clusterBytes
+	}
+	for cluster := first; cluster < last; cluster++ {
+		if err := img.discard(cluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//discard releases a guest cluster, the caller must hold mu exclusively
+func (img *Image) discard(cluster int64) error {
+	entry, err := img.lookup(img.l1, cluster)
+	if err != nil {
+		return err
+	}
+	discarded := uint64(0)
+	if img.backing != nil {
+		discarded = flagZero
+	}
+	if entry == discarded || (img.backing == nil && entry&^flagCopied == 0) {
+		return nil
+	}
+
+	l2Off, table, err := img.writableL2(cluster)
+	if err != nil {
+		return err
+	}
+	if err = img.setL2Entry(l2Off, table, cluster%img.l2Entries, discarded); err != nil {
+		return err
+	}
+	return img.freeEntry(entry)
+}
+
+//Flush fufills part of usbdlib.Device
+func (img *Image) Flush() error {
+	if atomic.LoadUint64(&img.atomicOnline) != 1 {
+		return errClosed
+	}
+	if img.readOnly {
+		return nil
+	}
+	return img.f.Sync()
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device, the backing file is
+// closed too
+func (img *Image) Close() error {
+	if !atomic.CompareAndSwapUint64(&img.atomicOnline, 1, 0) {
+		return errClosed
+	}
+	img.mu.Lock() //Wait for outstanding IO
+	defer img.mu.Unlock()
+
+	var syncErr error
+	if !img.readOnly {
+		syncErr = img.f.Sync()
+	}
+	if err := img.f.Close(); err != nil {
+		return fmt.Errorf("Could not close image %q: %w", img.filename, err)
+	}
+	if img.backing != nil {
+		if err := img.backing.Close(); err != nil {
+			log.Printf("Image::Close(): WARNING: Could not close backing file %q; Details: %s", img.backingName, err)
+		}
+	}
+	if syncErr != nil {
+		return fmt.Errorf("Could not sync image %q: %w", img.filename, syncErr)
+	}
+	return nil
+}
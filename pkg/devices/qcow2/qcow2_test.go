@@ -0,0 +1,484 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+func TestImage(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	testutil.TestUserspace(t, createImage(t, filepath.Join(t.TempDir(), "userspace.qcow2"), sizeBytes), sizeBytes)
+	testutil.TestNBD(t, createImage(t, filepath.Join(t.TempDir(), "nbd.qcow2"), sizeBytes), sizeBytes)
+}
+
+//createImage creates and opens an image
+func createImage(t *testing.T, filename string, size int64, options ...Option) *Image {
+	t.Helper()
+
+	if err := CreateImage(filename, size, options...); err != nil {
+		t.Fatalf("Could not create image: %s", err)
+	}
+	return openImage(t, filename)
+}
+
+func openImage(t *testing.T, filename string, options ...Option) *Image {
+	t.Helper()
+
+	img, err := NewImage(filename, options...)
+	if err != nil {
+		t.Fatalf("Could not open image: %s", err)
+	}
+	return img
+}
+
+//writeRandom writes random extents to a device and its model
+func writeRandom(t *testing.T, rnd *rand.Rand, dev usbdlib.Device, model []byte, writes, maxBytes int) {
+	t.Helper()
+
+	for i := 0; i < writes; i++ {
+		buf := make([]byte, 1+rnd.Intn(maxBytes))
+		rnd.Read(buf)
+		if rnd.Intn(4) == 0 {
+			buf = make([]byte, len(buf)) //Zeros
+		}
+		pos := rnd.Int63n(int64(len(model) - len(buf) + 1))
+		if _, err := dev.WriteAt(buf, pos); err != nil {
+			t.Fatalf("Could not write %d bytes at %d: %s", len(buf), pos, err)
+		}
+		copy(model[pos:], buf)
+	}
+}
+
+func expectContents(t *testing.T, dev usbdlib.Device, expected []byte) {
+	t.Helper()
+
+	if dev.Size() != int64(len(expected)) {
+		t.Fatalf("Device is %d bytes rather than %d", dev.Size(), len(expected))
+	}
+	actual := make([]byte, len(expected))
+	if n, err := dev.ReadAt(actual, 0); err != nil || n != len(actual) {
+		t.Fatalf("Could not read device: %d, %v", n, err)
+	}
+	if !bytes.Equal(actual, expected) {
+		for i := range actual {
+			if actual[i] != expected[i] {
+				t.Fatalf("Device contents differ from byte %d", i)
+			}
+		}
+	}
+}
+
+func expectCheck(t *testing.T, img *Image, leaks, corruptions int64) {
+	t.Helper()
+
+	res, err := img.Check()
+	if err != nil {
+		t.Fatalf("Could not check image: %s", err)
+	}
+	if res.Leaks != leaks || res.Corruptions != corruptions {
+		t.Fatalf("Check found %d leaks and %d corruptions rather than %d and %d: %v", res.Leaks, res.Corruptions, leaks, corruptions, res.Problems)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	const sizeBytes = 4*1024*1024 + 512 //Not a multiple of the cluster size
+
+	for _, test := range []struct {
+		version      int
+		clusterBytes int64
+		refcountBits int
+	}{
+		{2, DefClusterBytes, 16},
+		{2, 512, 16},
+		{3, DefClusterBytes, 16},
+		{3, 4096, 1},
+		{3, 512, 64}, //Grows the refcount table
+		{3, 2 * 1024 * 1024, 8},
+	} {
+		test := test
+		t.Run(fmt.Sprintf("v%d-%d-%d", test.version, test.clusterBytes, test.refcountBits), func(t *testing.T) {
+			t.Parallel()
+			rnd := rand.New(rand.NewSource(test.clusterBytes))
+			filename := filepath.Join(t.TempDir(), "test.qcow2")
+			img := createImage(t, filename, sizeBytes, OptVersion(test.version), OptClusterBytes(test.clusterBytes), OptRefcountBits(test.refcountBits))
+			if img.Version() != test.version || img.ClusterBytes() != test.clusterBytes || img.Size() != sizeBytes {
+				t.Fatalf("Image was not created as requested: version %d, %d byte clusters, %d bytes", img.Version(), img.ClusterBytes(), img.Size())
+			}
+			model := make([]byte, sizeBytes)
+			expectContents(t, img, model)
+
+			writeRandom(t, rnd, img, model, 200, 64*1024)
+			buf := make([]byte, 3*test.clusterBytes)
+			if len(buf) > sizeBytes {
+				buf = buf[:sizeBytes]
+			}
+			rnd.Read(buf)
+			if _, err := img.WriteAt(buf, 0); err != nil {
+				t.Fatalf("Could not write: %s", err)
+			}
+			copy(model, buf)
+			expectContents(t, img, model)
+			expectCheck(t, img, 0, 0)
+
+			//Discarded clusters read as zeros and are reused
+			if err := img.Trim(0, 2*int(test.clusterBytes)); err != nil {
+				t.Fatalf("Could not trim: %s", err)
+			}
+			copy(model, make([]byte, 2*test.clusterBytes))
+			writeRandom(t, rnd, img, model, 20, 8*1024)
+			expectContents(t, img, model)
+			expectCheck(t, img, 0, 0)
+
+			if err := img.Close(); err != nil {
+				t.Fatalf("Could not close image: %s", err)
+			}
+			img = openImage(t, filename, OptReadOnly(true))
+			defer img.Close()
+			expectContents(t, img, model)
+			if _, err := img.WriteAt([]byte{1}, 0); err == nil {
+				t.Fatalf("Read-only image was written")
+			}
+		})
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	const sizeBytes = 8 * 1024 * 1024
+
+	rnd := rand.New(rand.NewSource(1))
+	filename := filepath.Join(t.TempDir(), "snap.qcow2")
+	img := createImage(t, filename, sizeBytes, OptClusterBytes(4096))
+	model := make([]byte, sizeBytes)
+
+	//Each snapshot keeps the contents it was taken with as the image is written
+	var models [][]byte
+	for _, name := range []string{"first", "second", "third"} {
+		writeRandom(t, rnd, img, model, 100, 32*1024)
+		info, err := img.CreateSnapshot(name)
+		if err != nil {
+			t.Fatalf("Could not create snapshot: %s", err)
+		}
+		if info.Name != name || info.ID != fmt.Sprint(len(models)+1) || info.Size != sizeBytes {
+			t.Fatalf("Snapshot was not as expected: %+v", info)
+		}
+		models = append(models, append([]byte(nil), model...))
+	}
+	writeRandom(t, rnd, img, model, 100, 32*1024)
+	img.Trim(0, sizeBytes/2)
+	copy(model, make([]byte, sizeBytes/2))
+	if _, err := img.CreateSnapshot("second"); err == nil {
+		t.Fatalf("Snapshot with an existing name was created")
+	}
+	expectCheck(t, img, 0, 0)
+
+	check := func(img *Image) {
+		t.Helper()
+		expectContents(t, img, model)
+		for i, info := range img.Snapshots() {
+			snap, err := img.OpenSnapshot(info.Name)
+			if err != nil {
+				t.Fatalf("Could not open snapshot: %s", err)
+			}
+			expectContents(t, snap, models[i])
+			if _, err = snap.WriteAt([]byte{1}, 0); err == nil {
+				t.Fatalf("Snapshot was written")
+			}
+			snap.Close()
+		}
+	}
+	check(img)
+	if err := img.Close(); err != nil {
+		t.Fatalf("Could not close image: %s", err)
+	}
+
+	img = openImage(t, filename, OptReadOnly(true))
+	defer img.Close()
+	if snaps := img.Snapshots(); len(snaps) != 3 || snaps[1].Name != "second" || snaps[1].ID != "2" {
+		t.Fatalf("Snapshots were not persisted: %+v", snaps)
+	}
+	check(img)
+	if _, err := img.OpenSnapshot("2"); err != nil {
+		t.Fatalf("Could not open snapshot by ID: %s", err)
+	} else if _, err = img.OpenSnapshot("fourth"); err == nil {
+		t.Fatalf("Nonexistent snapshot was opened")
+	}
+	expectCheck(t, img, 0, 0)
+}
+
+func TestBacking(t *testing.T) {
+	const sizeBytes = 4 * 1024 * 1024
+
+	rnd := rand.New(rand.NewSource(2))
+	dir := t.TempDir()
+
+	//A raw base file, a qcow2 image over it and a second image over that
+	rawModel := make([]byte, sizeBytes-64*1024) //Shorter than the images
+	rnd.Read(rawModel)
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), rawModel, 0644); err != nil {
+		t.Fatalf("Could not write raw file: %s", err)
+	}
+	mid := createImage(t, filepath.Join(dir, "mid.qcow2"), sizeBytes, OptBackingFile("base.raw"), OptBackingFormat("raw"))
+	model := make([]byte, sizeBytes)
+	copy(model, rawModel)
+	expectContents(t, mid, model)
+	writeRandom(t, rnd, mid, model, 50, 16*1024)
+	if err := mid.Close(); err != nil {
+		t.Fatalf("Could not close image: %s", err)
+	}
+	midModel := append([]byte(nil), model...)
+
+	top := createImage(t, filepath.Join(dir, "top.qcow2"), 0, OptBackingFile("mid.qcow2"))
+	if name, format, dev := top.Backing(); name != "mid.qcow2" || format != "" || !usbdlib.IsReadOnly(dev) {
+		t.Fatalf("Backing file was not as expected: %q, %q", name, format)
+	}
+	expectContents(t, top, model)
+	writeRandom(t, rnd, top, model, 50, 16*1024)
+
+	//Discarded clusters read as zeros rather than from the backing file
+	if err := top.Trim(DefClusterBytes, 2*DefClusterBytes); err != nil {
+		t.Fatalf("Could not trim: %s", err)
+	}
+	copy(model[DefClusterBytes:], make([]byte, 2*DefClusterBytes))
+	expectContents(t, top, model)
+	expectCheck(t, top, 0, 0)
+	top.Close()
+
+	//The backing file is not changed
+	mid = openImage(t, filepath.Join(dir, "mid.qcow2"), OptReadOnly(true))
+	expectContents(t, mid, midModel)
+	mid.Close()
+
+	//Version 2 images can not discard clusters with a backing file
+	old := createImage(t, filepath.Join(dir, "old.qcow2"), 0, OptVersion(2), OptBackingFile("mid.qcow2"), OptBackingFormat("qcow2"))
+	defer old.Close()
+	old.Trim(0, DefClusterBytes)
+	expectContents(t, old, midModel)
+
+	//Backing files can be resolved by the caller
+	var resolved string
+	resolver := OptResolver(func(name, format string) (usbdlib.Device, error) {
+		resolved = name
+		return NewImage(filepath.Join(dir, name), OptReadOnly(true))
+	})
+	custom := openImage(t, filepath.Join(dir, "old.qcow2"), resolver)
+	defer custom.Close()
+	if resolved != "mid.qcow2" {
+		t.Fatalf("Resolver was called for %q", resolved)
+	}
+
+	if err := CreateImage(filepath.Join(dir, "loop.qcow2"), 0, OptBackingFile("loop.qcow2")); err == nil {
+		t.Fatalf("Image was created over a nonexistent backing file")
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	const sizeBytes = 1024 * 1024
+
+	img := createImage(t, filepath.Join(t.TempDir(), "compressed.qcow2"), sizeBytes, OptClusterBytes(4096))
+	defer img.Close()
+	model := make([]byte, sizeBytes)
+	for i := range model {
+		model[i] = byte(i / 100)
+	}
+	for cluster := int64(0); cluster < sizeBytes/4096; cluster++ {
+		writeCompressed(t, img, cluster, model[cluster*4096:(cluster+1)*4096])
+	}
+	expectContents(t, img, model)
+	expectCheck(t, img, 0, 0)
+
+	//Writing to a compressed cluster copies it
+	writeRandom(t, rand.New(rand.NewSource(3)), img, model, 50, 8*1024)
+	expectContents(t, img, model)
+	expectCheck(t, img, 0, 0)
+}
+
+//writeCompressed writes a compressed guest cluster as qemu-img convert -c does,
+// packing the compressed data of consecutive clusters together
+func writeCompressed(t *testing.T, img *Image, cluster int64, data []byte) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	wtr, _ := flate.NewWriter(&buf, flate.BestCompression)
+	wtr.Write(data)
+	wtr.Close()
+	compressed := buf.Bytes()
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	l2Off, table, err := img.writableL2(cluster)
+	if err != nil {
+		t.Fatalf("Could not allocate L2 table: %s", err)
+	}
+
+	//Continue after the previous compressed cluster if it fits in the same host
+	// cluster, which is then referenced by both
+	var off int64
+	if cluster > 0 {
+		if prev := table[(cluster-1)%img.l2Entries]; prev&flagCompressed != 0 {
+			_, last, prevOff, length := img.compressedClusters(prev)
+			if end := prevOff + length; end/img.clusterBytes == last && end%img.clusterBytes+int64(len(compressed)) <= img.clusterBytes {
+				off = end
+				if err = img.incRef(last); err != nil {
+					t.Fatalf("Could not reference cluster: %s", err)
+				}
+			}
+		}
+	}
+	if off == 0 {
+		host, err := img.allocCluster()
+		if err != nil {
+			t.Fatalf("Could not allocate cluster: %s", err)
+		}
+		off = int64(host)
+	}
+	if _, err = img.f.WriteAt(compressed, off); err != nil {
+		t.Fatalf("Could not write compressed cluster: %s", err)
+	}
+	sectors := (off%512+int64(len(compressed))+511)/512 - 1
+	entry := flagCompressed | uint64(sectors)<<(62-(img.hdr.clusterBits-8)) | uint64(off)
+	if err = img.setL2Entry(l2Off, table, cluster%img.l2Entries, entry); err != nil {
+		t.Fatalf("Could not write L2 entry: %s", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	const sizeBytes = 1024 * 1024
+
+	filename := filepath.Join(t.TempDir(), "check.qcow2")
+	img := createImage(t, filename, sizeBytes)
+	defer img.Close()
+	img.WriteAt(bytes.Repeat([]byte{1}, 3*DefClusterBytes), 0)
+	expectCheck(t, img, 0, 0)
+
+	//A cluster allocated but not referenced is leaked
+	img.mu.Lock()
+	leaked, err := img.allocCluster()
+	if err == nil {
+		_, err = img.f.WriteAt(make([]byte, img.clusterBytes), int64(leaked))
+	}
+	img.mu.Unlock()
+	if err != nil {
+		t.Fatalf("Could not allocate cluster: %s", err)
+	}
+	expectCheck(t, img, 1, 0)
+
+	//A cluster referenced without a reference count is corrupt, as are copied flags
+	// that do not match
+	entry, _ := img.lookup(img.l1, 1)
+	img.mu.Lock()
+	err = img.setRefcount(int64(entry&offsetMask)/img.clusterBytes, 0)
+	img.mu.Unlock()
+	if err != nil {
+		t.Fatalf("Could not change reference count: %s", err)
+	}
+	expectCheck(t, img, 1, 2)
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "dirty.qcow2")
+	if err := CreateImage(filename, 1024*1024); err != nil {
+		t.Fatalf("Could not create image: %s", err)
+	}
+	if err := CreateImage(filename, 1024*1024); err == nil {
+		t.Fatalf("Existing image was replaced")
+	}
+
+	//Images with the dirty bit set can only be read
+	img := openImage(t, filename)
+	img.hdr.incompatible |= featDirty
+	img.writeHeader()
+	img.Close()
+	if _, err := NewImage(filename); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("Opening an image with the dirty bit set returned %v rather than %s", err, ErrUnsupported)
+	}
+	img = openImage(t, filename, OptReadOnly(true))
+	img.Close()
+
+	//Unknown incompatible features are refused
+	img = openImage(t, filename, OptReadOnly(true))
+	img.hdr.incompatible = 1 << 40
+	raw, _ := os.OpenFile(filename, os.O_RDWR, 0)
+	raw.WriteAt(img.hdr.marshal(), 0)
+	raw.Close()
+	img.Close()
+	if _, err := NewImage(filename, OptReadOnly(true)); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("Opening an image with unknown features returned %v rather than %s", err, ErrUnsupported)
+	}
+
+	//Tables larger than the limits or the file are refused before being read
+	filename = filepath.Join(dir, "oversized.qcow2")
+	if err := CreateImage(filename, 1024*1024); err != nil {
+		t.Fatalf("Could not create image: %s", err)
+	}
+	img = openImage(t, filename)
+	if _, err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatalf("Could not create snapshot: %s", err)
+	}
+	hdr := img.hdr
+	img.Close()
+	raw, _ = os.OpenFile(filename, os.O_RDWR, 0)
+	defer raw.Close()
+	for _, corrupt := range []struct {
+		name  string
+		apply func(hdr *header)
+	}{
+		{"l1-limit", func(hdr *header) { hdr.l1Size = 1 << 30 }},
+		{"l1-file", func(hdr *header) { hdr.l1Size = 1 << 20 }},
+		{"refcount-limit", func(hdr *header) { hdr.refcountTableClusters = 1 << 20 }},
+		{"refcount-file", func(hdr *header) { hdr.refcountTableOffset = 1 << 40 }},
+		{"snapshots", func(hdr *header) { hdr.nbSnapshots = 1 << 30 }},
+	} {
+		bad := hdr
+		corrupt.apply(&bad)
+		raw.WriteAt(bad.marshal(), 0)
+		if _, err := NewImage(filename, OptReadOnly(true)); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("Opening an image with a corrupt header (%s) returned %v rather than %s", corrupt.name, err, ErrCorrupt)
+		}
+	}
+	raw.WriteAt(hdr.marshal(), 0)
+	var l1Size [4]byte
+	binary.BigEndian.PutUint32(l1Size[:], 1<<30)
+	raw.WriteAt(l1Size[:], int64(hdr.snapshotsOffset)+8)
+	if _, err := NewImage(filename, OptReadOnly(true)); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Opening an image with an oversized snapshot L1 table returned %v rather than %s", err, ErrCorrupt)
+	}
+
+	os.WriteFile(filepath.Join(dir, "not.qcow2"), make([]byte, 4096), 0644)
+	if _, err := NewImage(filepath.Join(dir, "not.qcow2")); err == nil {
+		t.Fatalf("File that is not an image was opened")
+	}
+	for _, opt := range []Option{OptVersion(4), OptClusterBytes(1000), OptClusterBytes(256), OptRefcountBits(3)} {
+		if err := CreateImage(filepath.Join(dir, "invalid.qcow2"), 1024*1024, opt); err == nil {
+			t.Fatalf("Image was created with invalid option %#v", opt)
+		}
+	}
+}
+
+func TestNegativePos(t *testing.T) {
+	img := createImage(t, filepath.Join(t.TempDir(), "negative.qcow2"), 1024*1024)
+	defer img.Close()
+
+	buf := make([]byte, 4096)
+	if _, err := img.ReadAt(buf, -1); !errors.Is(err, errNegative) {
+		t.Fatalf("Read at a negative position returned %v rather than %s", err, errNegative)
+	}
+	if _, err := img.WriteAt(buf, -4096); !errors.Is(err, errNegative) {
+		t.Fatalf("Write at a negative position returned %v rather than %s", err, errNegative)
+	}
+	if err := img.Trim(-65536, 2*65536); !errors.Is(err, errNegative) {
+		t.Fatalf("Trim at a negative position returned %v rather than %s", err, errNegative)
+	}
+	expectCheck(t, img, 0, 0)
+}
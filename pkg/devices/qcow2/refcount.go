@@ -0,0 +1,258 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+//refcount returns the reference count of a cluster, the caller must hold mu
+func (img *Image) refcount(cluster int64) (uint64, error) {
+	tableIdx := cluster / img.refBlockEntries
+	if tableIdx >= int64(len(img.refTable)) || img.refTable[tableIdx]&offsetMask == 0 {
+		return 0, nil
+	}
+	block, err := img.refBlock(img.refTable[tableIdx] & offsetMask)
+	if err != nil {
+		return 0, err
+	}
+	return img.getRefEntry(block, cluster%img.refBlockEntries), nil
+}
+
+//refBlock returns the refcount block at the provided offset, loading it if needed
+func (img *Image) refBlock(off uint64) ([]byte, error) {
+	if block, cached := img.refBlocks[off]; cached {
+		return block, nil
+	}
+	block := make([]byte, img.clusterBytes)
+	if _, err := img.f.ReadAt(block, int64(off)); err != nil {
+		return nil, fmt.Errorf("Could not read refcount block at %d: %w", off, err)
+	}
+	img.refBlocks[off] = block
+	return block, nil
+}
+
+func (img *Image) getRefEntry(block []byte, idx int64) uint64 {
+	switch bits := img.refBits; {
+	case bits < 8:
+		perByte := 8 / bits
+		return uint64(block[idx/perByte]>>((idx%perByte)*bits)) & (1<<bits - 1)
+	case bits == 8:
+		return uint64(block[idx])
+	case bits == 16:
+		return uint64(binary.BigEndian.Uint16(block[idx*2:]))
+	case bits == 32:
+		return uint64(binary.BigEndian.Uint32(block[idx*4:]))
+	default:
+		return binary.BigEndian.Uint64(block[idx*8:])
+	}
+}
+
+//setRefEntry sets an entry of a refcount block and returns the range of the block
+// that changed
+func (img *Image) setRefEntry(block []byte, idx int64, val uint64) (start, end int64) {
+	switch bits := img.refBits; {
+	case bits < 8:
+		perByte := 8 / bits
+		shift, mask := uint((idx%perByte)*bits), byte(1<<bits-1)
+		block[idx/perByte] = block[idx/perByte]&^(mask<<shift) | byte(val)<<shift
+		return idx / perByte, idx/perByte + 1
+	case bits == 8:
+		block[idx] = byte(val)
+	case bits == 16:
+		binary.BigEndian.PutUint16(block[idx*2:], uint16(val))
+	case bits == 32:
+		binary.BigEndian.PutUint32(block[idx*4:], uint32(val))
+	default:
+		binary.BigEndian.PutUint64(block[idx*8:], val)
+	}
+	width := img.refBits / 8
+	return idx * width, (idx + 1) * width
+}
+
+//setRefcount sets the reference count of a cluster, allocating a refcount block
+// for it if needed; the caller must hold mu exclusively
+func (img *Image) setRefcount(cluster int64, val uint64) error {
+	if img.refBits < 64 && val > 1<<img.refBits-1 {
+		return fmt.Errorf("Reference count of cluster %d would exceed the %d bit maximum", cluster, img.refBits)
+	}
+	tableIdx := cluster / img.refBlockEntries
+	if err := img.ensureRefBlock(tableIdx); err != nil {
+		return err
+	}
+	off := img.refTable[tableIdx] & offsetMask
+	block, err := img.refBlock(off)
+	if err != nil {
+		return err
+	}
+	start, end := img.setRefEntry(block, cluster%img.refBlockEntries, val)
+	if _, err = img.f.WriteAt(block[start:end], int64(off)+start); err != nil {
+		return fmt.Errorf("Could not write refcount block at %d: %w", off, err)
+	}
+	if val == 0 && cluster < img.freeHint {
+		img.freeHint = cluster
+	}
+	return nil
+}
+
+//incRef increments the reference count of a cluster, the caller must hold mu
+// exclusively
+func (img *Image) incRef(cluster int64) error {
+	count, err := img.refcount(cluster)
+	if err != nil {
+		return err
+	}
+	return img.setRefcount(cluster, count+1)
+}
+
+//decRef decrements the reference count of a cluster, the caller must hold mu
+// exclusively
+func (img *Image) decRef(cluster int64) error {
+	count, err := img.refcount(cluster)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("Reference count of cluster %d is already zero: %w", cluster, ErrCorrupt)
+	}
+	return img.setRefcount(cluster, count-1)
+}
+
+//ensureRefBlock allocates the refcount block of the refcount table entry
+// provided, growing the table if needed; the caller must hold mu exclusively
+func (img *Image) ensureRefBlock(tableIdx int64) error {
+	if tableIdx >= int64(len(img.refTable)) {
+		if err := img.growRefTable(tableIdx + 1); err != nil {
+			return err
+		}
+	}
+	if img.refTable[tableIdx]&offsetMask != 0 {
+		return nil
+	}
+
+	cluster := img.appendClusters(1)
+	off := uint64(cluster * img.clusterBytes)
+	block := make([]byte, img.clusterBytes)
+	if _, err := img.f.WriteAt(block, int64(off)); err != nil {
+		return fmt.Errorf("Could not write refcount block: %w", err)
+	}
+	img.refBlocks[off] = block
+	img.refTable[tableIdx] = off
+	if err := img.writeRefTableEntry(tableIdx); err != nil {
+		return err
+	}
+	return img.setRefcount(cluster, 1) //In this block or a later one
+}
+
+func (img *Image) writeRefTableEntry(tableIdx int64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], img.refTable[tableIdx])
+	if _, err := img.f.WriteAt(buf[:], int64(img.hdr.refcountTableOffset)+tableIdx*8); err != nil {
+		return fmt.Errorf("Could not write refcount table: %w", err)
+	}
+	return nil
+}
+
+//growRefTable moves the refcount table to the end of the image, with room for at
+// least the provided number of entries; the caller must hold mu exclusively
+func (img *Image) growRefTable(entries int64) error {
+	if entries*8 > maxRefTableBytes {
+		return fmt.Errorf("Refcount table of %d entries would exceed the limit of %d bytes", entries, maxRefTableBytes)
+	}
+	if doubled := 2 * int64(len(img.refTable)); entries < doubled {
+		entries = doubled
+		if entries*8 > maxRefTableBytes {
+			entries = maxRefTableBytes / 8
+		}
+	}
+	clusters := (entries*8 + img.clusterBytes - 1) / img.clusterBytes
+	oldOff, oldClusters := img.hdr.refcountTableOffset, int64(img.hdr.refcountTableClusters)
+
+	first := img.appendClusters(clusters)
+	table := make([]uint64, clusters*img.clusterBytes/8)
+	copy(table, img.refTable)
+	img.refTable = table
+	img.hdr.refcountTableOffset, img.hdr.refcountTableClusters = uint64(first*img.clusterBytes), uint32(clusters)
+	if err := img.writeTable(img.hdr.refcountTableOffset, table); err != nil {
+		return fmt.Errorf("Could not write refcount table: %w", err)
+	}
+	for cluster := first; cluster < first+clusters; cluster++ {
+		if err := img.setRefcount(cluster, 1); err != nil { //May add refcount blocks
+			return err
+		}
+	}
+	if err := img.writeHeader(); err != nil {
+		return err
+	}
+
+	for cluster := int64(oldOff) / img.clusterBytes; cluster < int64(oldOff)/img.clusterBytes+oldClusters; cluster++ {
+		if err := img.decRef(cluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//appendClusters reserves clusters at the end of the image and returns the first
+func (img *Image) appendClusters(count int64) int64 {
+	first := img.endCluster
+	img.endCluster += count
+	return first
+}
+
+//allocCluster allocates a cluster, reusing a free one if there is one, and
+// returns its offset; the caller must hold mu exclusively and write the cluster
+func (img *Image) allocCluster() (uint64, error) {
+	for cluster := img.freeHint; cluster < img.endCluster; cluster++ {
+		count, err := img.refcount(cluster)
+		if err != nil {
+			return 0, err
+		}
+		if count == 0 {
+			img.freeHint = cluster + 1
+			return uint64(cluster * img.clusterBytes), img.setRefcount(cluster, 1)
+		}
+	}
+	img.freeHint = img.endCluster
+	cluster := img.appendClusters(1)
+	return uint64(cluster * img.clusterBytes), img.setRefcount(cluster, 1)
+}
+
+//allocContiguous allocates consecutive clusters at the end of the image and
+// returns the offset of the first; the caller must hold mu exclusively
+func (img *Image) allocContiguous(count int64) (uint64, error) {
+	first := img.appendClusters(count)
+	for cluster := first; cluster < first+count; cluster++ {
+		if err := img.setRefcount(cluster, 1); err != nil {
+			return 0, err
+		}
+	}
+	return uint64(first * img.clusterBytes), nil
+}
+
+//compressedClusters returns the clusters holding the data of a compressed
+// cluster, and the offset and length of its data
+func (img *Image) compressedClusters(entry uint64) (first, last int64, off, length int64) {
+	offBits := 62 - (img.hdr.clusterBits - 8)
+	off = int64(entry & (1<<offBits - 1))
+	sectors := int64(entry>>offBits) & (1<<(img.hdr.clusterBits-8) - 1)
+	length = (sectors+1)*512 - off%512
+	return off / img.clusterBytes, (off + length - 1) / img.clusterBytes, off, length
+}
+
+//freeEntry releases the clusters referenced by an L2 entry, the caller must hold
+// mu exclusively
+func (img *Image) freeEntry(entry uint64) error {
+	if entry&flagCompressed != 0 {
+		first, last, _, _ := img.compressedClusters(entry)
+		for cluster := first; cluster <= last; cluster++ {
+			if err := img.decRef(cluster); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if host := entry & offsetMask; host != 0 {
+		return img.decRef(int64(host) / img.clusterBytes)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+//Snapshot is a read-only device presenting an internal snapshot of an image, it
+// must be closed before the image is
+type Snapshot struct {
+	img          *Image
+	info         SnapshotInfo
+	l1           []uint64
+	atomicOnline uint64
+}
+
+var (
+	_ usbdlib.Device         = (*Snapshot)(nil)
+	_ usbdlib.ReadOnlyDevice = (*Snapshot)(nil)
+)
+
+//Snapshots returns the internal snapshots of the image, oldest first
+func (img *Image) Snapshots() []SnapshotInfo {
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+
+	infos := make([]SnapshotInfo, len(img.snapshots))
+	for i := range img.snapshots {
+		infos[i] = img.snapshots[i].SnapshotInfo
+	}
+	return infos
+}
+
+//findSnapshot returns the index of the snapshot with the provided ID or name, or
+// -1; the caller must hold mu
+func (img *Image) findSnapshot(idOrName string) int {
+	for i := range img.snapshots {
+		if img.snapshots[i].ID == idOrName {
+			return i
+		}
+	}
+	for i := range img.snapshots {
+		if img.snapshots[i].Name == idOrName {
+			return i
+		}
+	}
+	return -1
+}
+
+//OpenSnapshot returns a device presenting the internal snapshot with the provided
+// ID or name. Unallocated clusters of snapshots are read from the backing file of
+// the image, as qemu does.
+func (img *Image) OpenSnapshot(idOrName string) (*Snapshot, error) {
+	if atomic.LoadUint64(&img.atomicOnline) != 1 {
+		return nil, errClosed
+	}
+	img.mu.RLock()
+	defer img.mu.RUnlock()
+
+	idx := img.findSnapshot(idOrName)
+	if idx < 0 {
+		return nil, fmt.Errorf("Image has no snapshot %q", idOrName)
+	}
+	snap := &img.snapshots[idx]
+	l1, err := img.readTable(snap.l1TableOffset, int64(snap.l1Size))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read L1 table of snapshot %q: %w", idOrName, err)
+	}
+	return &Snapshot{img: img, info: snap.SnapshotInfo, l1: l1, atomicOnline: 1}, nil
+}
+
+//CreateSnapshot creates an internal snapshot of the current contents of the
+// image with the provided name, sharing its clusters until they are written. No VM
+// state is saved.
+func (img *Image) CreateSnapshot(name string) (SnapshotInfo, error) {
+	switch {
+	case atomic.LoadUint64(&img.atomicOnline) != 1:
+		return SnapshotInfo{}, errClosed
+	case img.readOnly:
+		return SnapshotInfo{}, errReadOnly
+	case name == "" || len(name) > 0xffff:
+		return SnapshotInfo{}, fmt.Errorf("Snapshot name %q is invalid", name)
+	}
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	var lastID int64
+	for i := range img.snapshots {
+		if img.snapshots[i].Name == name {
+			return SnapshotInfo{}, fmt.Errorf("Image already has a snapshot %q", name)
+		}
+		if id, err := strconv.ParseInt(img.snapshots[i].ID, 10, 64); err == nil && id > lastID {
+			lastID = id
+		}
+	}
+	if err := img.shareActive(); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("Could not share clusters with snapshot: %w", err)
+	}
+
+	//Copy the L1 table
+	l1Clusters := (int64(len(img.l1))*8 + img.clusterBytes - 1) / img.clusterBytes
+	l1Off := uint64(0)
+	if l1Clusters > 0 {
+		var err error
+		if l1Off, err = img.allocContiguous(l1Clusters); err != nil {
+			return SnapshotInfo{}, err
+		}
+		if err = img.writeTable(l1Off, img.l1); err != nil {
+			return SnapshotInfo{}, fmt.Errorf("Could not write snapshot L1 table: %w", err)
+		}
+	}
+
+	now := time.Now()
+	snap := snapshot{
+		SnapshotInfo: SnapshotInfo{
+			ID:   strconv.FormatInt(lastID+1, 10),
+			Name: name,
+			Date: time.Unix(now.Unix(), int64(now.Nanosecond())),
+			Size: int64(img.hdr.size),
+		},
+		l1TableOffset: l1Off,
+		l1Size:        uint32(len(img.l1)),
+		extra:         make([]byte, 16),
+	}
+	binary.BigEndian.PutUint64(snap.extra[8:], img.hdr.size)
+	snaps := append(append([]snapshot(nil), img.snapshots...), snap)
+	if err := img.writeSnapshots(snaps); err != nil {
+		return SnapshotInfo{}, err
+	}
+	return snap.SnapshotInfo, img.f.Sync()
+}
+
+//shareActive increments the reference counts of the clusters the active L1 table
+// references, and clears their copied flags, so they are copied before being
+// written; the caller must hold mu exclusively
+func (img *Image) shareActive() error {
+	for l1Idx, l1Entry := range img.l1 {
+		l2Off := l1Entry & offsetMask
+		if l2Off == 0 {
+			continue
+		}
+		if err := img.incRef(int64(l2Off) / img.clusterBytes); err != nil {
+			return err
+		}
+		table, err := img.readL2(l2Off)
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		for idx, entry := range table {
+			switch host := entry & offsetMask; {
+			case entry&flagCompressed != 0:
+				first, last, _, _ := img.compressedClusters(entry)
+				for cluster := first; cluster <= last; cluster++ {
+					if err = img.incRef(cluster); err != nil {
+						return err
+					}
+				}
+			case host != 0:
+				if err = img.incRef(int64(host) / img.clusterBytes); err != nil {
+					return err
+				}
+			}
+			if entry&flagCopied != 0 {
+				table[idx], changed = entry&^flagCopied, true
+			}
+		}
+		if changed {
+			if err = img.writeTable(l2Off, table); err != nil {
+				return fmt.Errorf("Could not write L2 table: %w", err)
+			}
+		}
+		if l1Entry&flagCopied != 0 {
+			if err = img.setL1Entry(int64(l1Idx), l2Off); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//writeSnapshots writes a new snapshot table and frees the previous one, the
+// caller must hold mu exclusively
+func (img *Image) writeSnapshots(snaps []snapshot) error {
+	table := marshalSnapshots(snaps)
+	clusters := (int64(len(table)) + img.clusterBytes - 1) / img.clusterBytes
+	off, err := img.allocContiguous(clusters)
+	if err != nil {
+		return err
+	}
+	if _, err = img.f.WriteAt(table, int64(off)); err != nil {
+		return fmt.Errorf("Could not write snapshot table: %w", err)
+	}
+
+	oldOff, oldBytes := img.hdr.snapshotsOffset, int64(len(marshalSnapshots(img.snapshots)))
+	img.hdr.snapshotsOffset, img.hdr.nbSnapshots = off, uint32(len(snaps))
+	if err = img.writeHeader(); err != nil {
+		return err
+	}
+	img.snapshots = snaps
+	if oldBytes > 0 {
+		first := int64(oldOff) / img.clusterBytes
+		for cluster := first; cluster < first+(oldBytes+img.clusterBytes-1)/img.clusterBytes; cluster++ {
+			if err = img.decRef(cluster); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//Info describes the snapshot
+func (snap *Snapshot) Info() SnapshotInfo {
+	return snap.info
+}
+
+//Size of this device in bytes, that of the image when the snapshot was taken
+func (snap *Snapshot) Size() int64 {
+	return snap.info.Size
+}
+
+//BlockSize of this device is that of the image
+func (snap *Snapshot) BlockSize() int64 {
+	return snap.img.BlockSize()
+}
+
+//ReadOnly fufills usbdlib.ReadOnlyDevice, snapshots are always read-only
+func (snap *Snapshot) ReadOnly() bool {
+	return true
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (snap *Snapshot) ReadAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&snap.atomicOnline) != 1 || atomic.LoadUint64(&snap.img.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	snap.img.mu.RLock()
+	defer snap.img.mu.RUnlock()
+
+	return snap.img.readFrom(snap.l1, snap.info.Size, buf, pos)
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device, snapshots can
+// not be written
+func (snap *Snapshot) WriteAt(buf []byte, pos int64) (int, error) {
+	return 0, errReadOnly
+}
+
+//Trim fufills part of usbdlib.Device, snapshots can not be trimmed
+func (snap *Snapshot) Trim(pos int64, count int) error {
+	return errReadOnly
+}
+
+//Flush fufills part of usbdlib.Device, there is never anything to flush
+func (snap *Snapshot) Flush() error {
+	if atomic.LoadUint64(&snap.atomicOnline) != 1 {
+		return errClosed
+	}
+	return nil
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device
+func (snap *Snapshot) Close() error {
+	if !atomic.CompareAndSwapUint64(&snap.atomicOnline, 1, 0) {
+		return errClosed
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package qos
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+	"time"
+)
+
+//flow is the state of one device's use of a bucket, protected by the bucket's lock
+type flow struct {
+	weight float64
+	finish float64 //Virtual time at which its last request finishes
+}
+
+//waiter is a request blocked until a bucket grants its tokens
+type waiter struct {
+	cost      float64
+	start     float64 //Virtual start time, the order requests are granted in
+	seq       uint64  //Breaks ties in arrival order
+	cancelled bool
+	ready     chan struct{}
+}
+
+type waiterHeap []*waiter
+
+func (wh waiterHeap) Len() int { return len(wh) }
+func (wh waiterHeap) Less(i, j int) bool {
+	return wh[i].start < wh[j].start || (wh[i].start == wh[j].start && wh[i].seq < wh[j].seq)
+}
+func (wh waiterHeap) Swap(i, j int)       { wh[i], wh[j] = wh[j], wh[i] }
+func (wh *waiterHeap) Push(x interface{}) { *wh = append(*wh, x.(*waiter)) }
+func (wh *waiterHeap) Pop() interface{} {
+	old := *wh
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*wh = old[:len(old)-1]
+	return w
+}
+
+//bucket is a token bucket which may be shared by several flows. Tokens accumulate
+// at a fixed rate up to a burst limit. Requests are granted immediately while
+// tokens are available and nobody is waiting, otherwise they queue and are granted
+// in order of their virtual start time (start-time fair queuing) so that, under
+// contention, each flow receives tokens in proportion to its weight. Requests for
+// more tokens than the burst limit are granted once the bucket is full, leaving it
+// in debt, so they are never starved.
+type bucket struct {
+	mu          sync.Mutex
+	rate, burst float64 //A rate of 0 is unlimited
+	tokens      float64
+	last        time.Time //Tokens were last accumulated
+	vtime       float64   //Virtual start time of the last request granted
+	seq         uint64
+	waiters     waiterHeap
+	dispatching bool
+	kick        chan struct{}
+}
+
+func newBucket(lim Limit) *bucket {
+	b := &bucket{kick: make(chan struct{}, 1)}
+	b.setLimit(lim)
+	return b
+}
+
+//setLimit changes the rate and burst limit of the bucket, waking any waiters so
+// they are granted according to the new limit
+func (b *bucket) setLimit(lim Limit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 { //Was unlimited, start full
+		b.tokens = lim.burst()
+	}
+	b.refill(time.Now())
+	b.rate, b.burst = lim.PerSecond, lim.burst()
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.wake()
+}
+
+func (b *bucket) limit() Limit {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return Limit{PerSecond: b.rate, Burst: b.burst}
+}
+
+//setWeight changes the weight of a flow through the bucket
+func (b *bucket) setWeight(fl *flow, weight float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fl.weight = weight
+}
+
+//refill accumulates the tokens earned since they were last accumulated
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 && b.rate > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+//need returns the tokens that must be available to grant a request
+func (b *bucket) need(cost float64) float64 {
+	return math.Min(cost, b.burst)
+}
+
+func (b *bucket) wake() {
+	select {
+	case b.kick <- struct{}{}:
+	default:
+	}
+}
+
+//take blocks until the bucket grants the provided flow cost tokens or cancel is
+// closed, and returns how long it waited and if the tokens were granted
+func (b *bucket) take(fl *flow, cost float64, cancel <-chan struct{}) (time.Duration, bool) {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return 0, true
+	}
+
+	began := time.Now()
+	b.refill(began)
+	start := math.Max(b.vtime, fl.finish)
+	fl.finish = start + cost/fl.weight
+	if len(b.waiters) == 0 && b.tokens >= b.need(cost) {
+		b.tokens -= cost
+		b.vtime = start
+		b.mu.Unlock()
+		return 0, true
+	}
+
+	b.seq++
+	w := &waiter{cost: cost, start: start, seq: b.seq, ready: make(chan struct{})}
+	heap.Push(&b.waiters, w)
+	if !b.dispatching {
+		b.dispatching = true
+		go b.dispatch()
+	} else {
+		b.wake() //It may now be first
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return time.Since(began), true
+	case <-cancel:
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		select {
+		case <-w.ready: //Granted regardless
+			return time.Since(began), true
+		default:
+			w.cancelled = true
+			return time.Since(began), false
+		}
+	}
+}
+
+//dispatch grants the tokens requested by waiters as they accumulate, it exits
+// once there are no waiters
+func (b *bucket) dispatch() {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		b.mu.Lock()
+		var wait time.Duration
+		for wait == 0 {
+			if len(b.waiters) == 0 {
+				b.dispatching = false
+				b.mu.Unlock()
+				return
+			}
+
+			w := b.waiters[0]
+			switch {
+			case w.cancelled:
+				heap.Pop(&b.waiters)
+				continue
+			case b.rate > 0:
+				b.refill(time.Now())
+				if need := b.need(w.cost); b.tokens < need {
+					wait = time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+					if wait < time.Microsecond {
+						wait = time.Microsecond
+					}
+					continue
+				}
+				b.tokens -= w.cost
+			}
+			heap.Pop(&b.waiters)
+			b.vtime = w.start
+			close(w.ready)
+		}
+		b.mu.Unlock()
+
+		if timer == nil {
+			timer = time.NewTimer(wait)
+		} else {
+			timer.Reset(wait)
+		}
+		select {
+		case <-timer.C:
+		case <-b.kick:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+	}
+}
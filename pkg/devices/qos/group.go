@@ -0,0 +1,32 @@
+package qos
+
+//Group is a set of limits shared by the QoS devices that are members of it (see
+// OptGroup). Under contention each member receives a share of the group's limits
+// in proportion to its weight, while idle members' shares are available to the
+// others. Members are also limited by their own limits.
+type Group struct {
+	lmt *limiter
+}
+
+//NewGroup constructs a group with the provided limits
+func NewGroup(limits Limits) (*Group, error) {
+	if err := limits.validate(); err != nil {
+		return nil, err
+	}
+	return &Group{lmt: newLimiter(limits)}, nil
+}
+
+//Limits returns the current limits of this group
+func (grp *Group) Limits() Limits {
+	return grp.lmt.limits()
+}
+
+//SetLimits changes the limits of this group, operations already throttled are
+// delayed according to the new limits
+func (grp *Group) SetLimits(limits Limits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	grp.lmt.setLimits(limits)
+	return nil
+}
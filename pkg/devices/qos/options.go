@@ -0,0 +1,21 @@
+package qos
+
+//Option is a QoS device option
+type Option interface {
+	apply(*QoS)
+}
+
+//OptGroup instructs a QoS device to join the provided group, receiving a share of
+// its limits in proportion to the provided weight (0 implies 1) relative to the
+// other members
+type OptGroup struct {
+	Group  *Group
+	Weight float64
+}
+
+func (opt OptGroup) apply(qdev *QoS) {
+	qdev.group = opt.Group
+	if opt.Weight != 0 {
+		qdev.weight = opt.Weight
+	}
+}
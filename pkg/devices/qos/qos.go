@@ -0,0 +1,359 @@
+package qos
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const errClosed = consterr.ConstErr("Device is shutdown")
+
+//Limit is a token bucket limit: tokens accumulate at PerSecond, up to Burst tokens
+// which may be spent at once after a period of idleness
+type Limit struct {
+	PerSecond float64 //0 is unlimited
+	Burst     float64 //0 implies PerSecond (one second of burst credit)
+}
+
+func (lim Limit) burst() float64 {
+	if lim.Burst <= 0 {
+		return lim.PerSecond
+	}
+	return lim.Burst
+}
+
+func (lim Limit) validate(name string) error {
+	if lim.PerSecond < 0 || lim.Burst < 0 {
+		return fmt.Errorf("%s limit of %g per second with a burst of %g is negative", name, lim.PerSecond, lim.Burst)
+	}
+	return nil
+}
+
+//Limits are the limits on the operations and bytes read and written. Reads and
+// writes each consume one operation and bytes for their length, trims consume
+// one write operation and flushes are not limited.
+type Limits struct {
+	ReadIOPS, WriteIOPS   Limit
+	ReadBytes, WriteBytes Limit
+}
+
+func (lims *Limits) validate() error {
+	for _, lim := range []struct {
+		name string
+		Limit
+	}{{"Read IOPS", lims.ReadIOPS}, {"Write IOPS", lims.WriteIOPS}, {"Read bytes", lims.ReadBytes}, {"Write bytes", lims.WriteBytes}} {
+		if err := lim.validate(lim.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//limiter is a set of buckets enforcing Limits
+type limiter struct {
+	readIOPS, writeIOPS   *bucket
+	readBytes, writeBytes *bucket
+}
+
+func newLimiter(lims Limits) *limiter {
+	return &limiter{
+		readIOPS:   newBucket(lims.ReadIOPS),
+		writeIOPS:  newBucket(lims.WriteIOPS),
+		readBytes:  newBucket(lims.ReadBytes),
+		writeBytes: newBucket(lims.WriteBytes),
+	}
+}
+
+//pick returns the operation and byte buckets limiting reads or writes
+func (lmt *limiter) pick(write bool) (iops, bytes *bucket) {
+	if write {
+		return lmt.writeIOPS, lmt.writeBytes
+	}
+	return lmt.readIOPS, lmt.readBytes
+}
+
+func (lmt *limiter) setLimits(lims Limits) {
+	lmt.readIOPS.setLimit(lims.ReadIOPS)
+	lmt.writeIOPS.setLimit(lims.WriteIOPS)
+	lmt.readBytes.setLimit(lims.ReadBytes)
+	lmt.writeBytes.setLimit(lims.WriteBytes)
+}
+
+func (lmt *limiter) limits() Limits {
+	return Limits{
+		ReadIOPS:   lmt.readIOPS.limit(),
+		WriteIOPS:  lmt.writeIOPS.limit(),
+		ReadBytes:  lmt.readBytes.limit(),
+		WriteBytes: lmt.writeBytes.limit(),
+	}
+}
+
+//flows are the flows of a device through each bucket of a limiter
+type flows struct {
+	readIOPS, writeIOPS   flow
+	readBytes, writeBytes flow
+}
+
+func newFlows(weight float64) *flows {
+	return &flows{flow{weight: weight}, flow{weight: weight}, flow{weight: weight}, flow{weight: weight}}
+}
+
+//pick returns the operation and byte flows of reads or writes
+func (fls *flows) pick(write bool) (iops, bytes *flow) {
+	if write {
+		return &fls.writeIOPS, &fls.writeBytes
+	}
+	return &fls.readIOPS, &fls.readBytes
+}
+
+//Stats describes the operations passed through a QoS device and how they were
+// throttled
+type Stats struct {
+	Reads, Writes, Trims  int64
+	ReadBytes, WriteBytes int64
+	ReadsThrottled        int64 //Reads delayed by a limit
+	WritesThrottled       int64 //Writes and trims delayed by a limit
+	ReadDelay, WriteDelay time.Duration
+}
+
+//QoS wraps a device and limits the rate of operations and bytes read and written
+// using token buckets, so bursts are permitted after periods of idleness. A device
+// may also be a member of a Group whose limits are shared by all its members in
+// proportion to their weights. Operations that would exceed a limit are delayed
+// until it permits them. All limits may be changed at any time.
+type QoS struct {
+	dev          usbdlib.Device
+	atomicOnline uint64
+	ioMu         sync.RWMutex  //Held exclusively to close
+	closing      chan struct{} //Closed to release throttled operations
+
+	own      *limiter
+	ownFlows *flows
+	group    *Group
+	grpFlows *flows
+	weightMu sync.Mutex
+	weight   float64
+	stats    Stats //Accessed atomically
+}
+
+var (
+	_ usbdlib.Device         = (*QoS)(nil)
+	_ usbdlib.ReadOnlyDevice = (*QoS)(nil)
+)
+
+//NewQoS constructs a device limiting the operations passed to the provided device,
+// which it owns and closes when closed
+func NewQoS(dev usbdlib.Device, limits Limits, options ...Option) (*QoS, error) {
+	if err := limits.validate(); err != nil {
+		return nil, err
+	}
+
+	qdev := &QoS{
+		dev:          dev,
+		atomicOnline: 1,
+		closing:      make(chan struct{}),
+		own:          newLimiter(limits),
+		ownFlows:     newFlows(1),
+		weight:       1,
+	}
+	for _, opt := range options {
+		opt.apply(qdev)
+	}
+	if qdev.weight <= 0 {
+		return nil, fmt.Errorf("Group weight %g is not positive", qdev.weight)
+	}
+	if qdev.group != nil {
+		qdev.grpFlows = newFlows(qdev.weight)
+	}
+	return qdev, nil
+}
+
+//Size of this device in bytes
+func (qdev *QoS) Size() int64 {
+	return qdev.dev.Size()
+}
+
+//BlockSize of this device is that of the wrapped device
+func (qdev *QoS) BlockSize() int64 {
+	return qdev.dev.BlockSize()
+}
+
+//ReadOnly returns if the wrapped device is read-only, fulfilling
+// usbdlib.ReadOnlyDevice
+func (qdev *QoS) ReadOnly() bool {
+	return usbdlib.IsReadOnly(qdev.dev)
+}
+
+//Limits returns the current limits of this device, not including those of its group
+func (qdev *QoS) Limits() Limits {
+	return qdev.own.limits()
+}
+
+//SetLimits changes the limits of this device, operations already throttled are
+// delayed according to the new limits
+func (qdev *QoS) SetLimits(limits Limits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	qdev.own.setLimits(limits)
+	return nil
+}
+
+//Group returns the group this device is a member of, if any
+func (qdev *QoS) Group() *Group {
+	return qdev.group
+}
+
+//Weight returns the share of its group's limits this device receives relative to
+// the other members
+func (qdev *QoS) Weight() float64 {
+	qdev.weightMu.Lock()
+	defer qdev.weightMu.Unlock()
+	return qdev.weight
+}
+
+//SetWeight changes the share of its group's limits this device receives relative to
+// the other members
+func (qdev *QoS) SetWeight(weight float64) error {
+	if weight <= 0 {
+		return fmt.Errorf("Group weight %g is not positive", weight)
+	}
+	qdev.weightMu.Lock()
+	defer qdev.weightMu.Unlock()
+
+	qdev.weight = weight
+	if qdev.group != nil {
+		for _, write := range []bool{false, true} {
+			iopsBucket, bytesBucket := qdev.group.lmt.pick(write)
+			iopsFlow, bytesFlow := qdev.grpFlows.pick(write)
+			iopsBucket.setWeight(iopsFlow, weight)
+			bytesBucket.setWeight(bytesFlow, weight)
+		}
+	}
+	return nil
+}
+
+//Stats returns the operations passed through this device and how they were throttled
+func (qdev *QoS) Stats() Stats {
+	return Stats{
+		Reads:           atomic.LoadInt64(&qdev.stats.Reads),
+		Writes:          atomic.LoadInt64(&qdev.stats.Writes),
+		Trims:           atomic.LoadInt64(&qdev.stats.Trims),
+		ReadBytes:       atomic.LoadInt64(&qdev.stats.ReadBytes),
+		WriteBytes:      atomic.LoadInt64(&qdev.stats.WriteBytes),
+		ReadsThrottled:  atomic.LoadInt64(&qdev.stats.ReadsThrottled),
+		WritesThrottled: atomic.LoadInt64(&qdev.stats.WritesThrottled),
+		ReadDelay:       time.Duration(atomic.LoadInt64((*int64)(&qdev.stats.ReadDelay))),
+		WriteDelay:      time.Duration(atomic.LoadInt64((*int64)(&qdev.stats.WriteDelay))),
+	}
+}
+
+//throttle waits for the limits of the device, and its group, to permit an
+// operation of the provided length, and records any delay
+func (qdev *QoS) throttle(write bool, length int64) error {
+	var delay time.Duration
+	take := func(lmt *limiter, fls *flows) bool {
+		iopsBucket, bytesBucket := lmt.pick(write)
+		iopsFlow, bytesFlow := fls.pick(write)
+		waited, granted := iopsBucket.take(iopsFlow, 1, qdev.closing)
+		delay += waited
+		if granted && length > 0 {
+			waited, granted = bytesBucket.take(bytesFlow, float64(length), qdev.closing)
+			delay += waited
+		}
+		return granted
+	}
+	granted := take(qdev.own, qdev.ownFlows)
+	if granted && qdev.group != nil {
+		granted = take(qdev.group.lmt, qdev.grpFlows)
+	}
+
+	if delay > 0 {
+		if write {
+			atomic.AddInt64(&qdev.stats.WritesThrottled, 1)
+			atomic.AddInt64((*int64)(&qdev.stats.WriteDelay), int64(delay))
+		} else {
+			atomic.AddInt64(&qdev.stats.ReadsThrottled, 1)
+			atomic.AddInt64((*int64)(&qdev.stats.ReadDelay), int64(delay))
+		}
+	}
+	if !granted {
+		return errClosed
+	}
+	return nil
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (qdev *QoS) ReadAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&qdev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	qdev.ioMu.RLock()
+	defer qdev.ioMu.RUnlock()
+
+	if err := qdev.throttle(false, int64(len(buf))); err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&qdev.stats.Reads, 1)
+	atomic.AddInt64(&qdev.stats.ReadBytes, int64(len(buf)))
+	return qdev.dev.ReadAt(buf, pos)
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (qdev *QoS) WriteAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&qdev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	qdev.ioMu.RLock()
+	defer qdev.ioMu.RUnlock()
+
+	if err := qdev.throttle(true, int64(len(buf))); err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&qdev.stats.Writes, 1)
+	atomic.AddInt64(&qdev.stats.WriteBytes, int64(len(buf)))
+	return qdev.dev.WriteAt(buf, pos)
+}
+
+//Trim fufills part of usbdlib.Device, trims consume a write operation but no bytes
+func (qdev *QoS) Trim(pos int64, count int) error {
+	if atomic.LoadUint64(&qdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	qdev.ioMu.RLock()
+	defer qdev.ioMu.RUnlock()
+
+	if err := qdev.throttle(true, 0); err != nil {
+		return err
+	}
+	atomic.AddInt64(&qdev.stats.Trims, 1)
+	return qdev.dev.Trim(pos, count)
+}
+
+//Flush fufills part of usbdlib.Device, flushes are not limited
+func (qdev *QoS) Flush() error {
+	if atomic.LoadUint64(&qdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	qdev.ioMu.RLock()
+	defer qdev.ioMu.RUnlock()
+
+	return qdev.dev.Flush()
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device, throttled operations
+// fail rather than delaying it
+func (qdev *QoS) Close() error {
+	if !atomic.CompareAndSwapUint64(&qdev.atomicOnline, 1, 0) {
+		return errClosed
+	}
+	close(qdev.closing)
+	qdev.ioMu.Lock() //Wait for outstanding IO
+	defer qdev.ioMu.Unlock()
+
+	return qdev.dev.Close()
+}
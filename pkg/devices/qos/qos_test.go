@@ -0,0 +1,228 @@
+package qos
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+)
+
+func TestQoS(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	limits := Limits{ReadIOPS: Limit{PerSecond: 10000000}, WriteBytes: Limit{PerSecond: 1 << 32}}
+	testutil.TestUserspace(t, createDevice(t, sizeBytes, limits), sizeBytes)
+	testutil.TestNBD(t, createDevice(t, sizeBytes, limits), sizeBytes)
+}
+
+func createDevice(t *testing.T, sizeBytes int64, limits Limits, options ...Option) *QoS {
+	t.Helper()
+
+	dev, err := NewQoS(ramdisk.NewRAMDisk(sizeBytes), limits, options...)
+	if err != nil {
+		t.Fatalf("Could not create QoS device: %s", err)
+	}
+	return dev
+}
+
+func TestLimits(t *testing.T) {
+	dev := createDevice(t, 1024*1024, Limits{
+		ReadIOPS:   Limit{PerSecond: 50, Burst: 10},
+		WriteBytes: Limit{PerSecond: 256 * 1024},
+	})
+	defer dev.Close()
+	buf := make([]byte, 64*1024)
+
+	//The burst is available immediately, then operations are limited to the rate
+	began := time.Now()
+	for i := 0; i < 10; i++ {
+		dev.ReadAt(buf[:512], 0)
+	}
+	if elapsed := time.Since(began); elapsed > 50*time.Millisecond {
+		t.Fatalf("Burst of 10 reads took %s", elapsed)
+	}
+	for i := 0; i < 10; i++ {
+		dev.ReadAt(buf[:512], 0)
+	}
+	if elapsed := time.Since(began); elapsed < 180*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatalf("10 reads beyond the burst at 50 IOPS took %s, expected 200ms", elapsed)
+	}
+
+	//Bytes are limited separately, operations larger than the burst are permitted
+	began = time.Now()
+	for i := 0; i < 8; i++ {
+		dev.WriteAt(buf, 0)
+	}
+	big := make([]byte, 512*1024)
+	if _, err := dev.WriteAt(big, 0); err != nil {
+		t.Fatalf("Could not write more than the burst: %s", err)
+	}
+	if elapsed := time.Since(began); elapsed < 1800*time.Millisecond || elapsed > 2500*time.Millisecond {
+		t.Fatalf("Writing 1 MiB at 256 KiB/s after a 256 KiB burst took %s, expected 2s (the last write waits for a full burst)", elapsed)
+	}
+
+	stats := dev.Stats()
+	switch {
+	case stats.Reads != 20 || stats.ReadBytes != 20*512 || stats.Writes != 9 || stats.WriteBytes != 8*64*1024+512*1024:
+		t.Fatalf("Operations were not counted as expected: %+v", stats)
+	case stats.ReadsThrottled < 9 || stats.ReadsThrottled > 10 || stats.ReadDelay < 150*time.Millisecond:
+		t.Fatalf("Read throttling was not recorded as expected: %+v", stats)
+	case stats.WritesThrottled < 4 || stats.WriteDelay < 1800*time.Millisecond:
+		t.Fatalf("Write throttling was not recorded as expected: %+v", stats)
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	dev := createDevice(t, 1024*1024, Limits{WriteIOPS: Limit{PerSecond: 1}})
+	defer dev.Close()
+	buf := make([]byte, 512)
+
+	//An operation throttled by a low limit completes once the limit is raised
+	dev.WriteAt(buf, 0)
+	done := make(chan error)
+	go func() {
+		_, err := dev.WriteAt(buf, 0)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := dev.SetLimits(Limits{WriteIOPS: Limit{PerSecond: 1000}}); err != nil {
+		t.Fatalf("Could not set limits: %s", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Throttled write failed: %s", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("Throttled write was not released by raising the limit")
+	}
+	if lims := dev.Limits(); lims.WriteIOPS.PerSecond != 1000 || lims.WriteIOPS.Burst != 1000 {
+		t.Fatalf("Limits were not updated: %+v", lims)
+	}
+
+	//Removing the limit releases operations immediately
+	dev.SetLimits(Limits{WriteIOPS: Limit{PerSecond: 1}})
+	dev.WriteAt(buf, 0)
+	go func() {
+		_, err := dev.WriteAt(buf, 0)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	dev.SetLimits(Limits{})
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("Throttled write was not released by removing the limit")
+	}
+
+	if err := dev.SetLimits(Limits{ReadBytes: Limit{PerSecond: -1}}); err == nil {
+		t.Fatalf("Negative limit was accepted")
+	}
+}
+
+func TestClose(t *testing.T) {
+	dev := createDevice(t, 1024*1024, Limits{ReadIOPS: Limit{PerSecond: 0.1}})
+	buf := make([]byte, 512)
+
+	dev.ReadAt(buf, 0)
+	done := make(chan error)
+	go func() {
+		_, err := dev.ReadAt(buf, 0)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	began := time.Now()
+	if err := dev.Close(); err != nil {
+		t.Fatalf("Could not close device: %s", err)
+	} else if elapsed := time.Since(began); elapsed > time.Second {
+		t.Fatalf("Close was delayed %s by a throttled operation", elapsed)
+	}
+	if err := <-done; !errors.Is(err, errClosed) {
+		t.Fatalf("Throttled read returned %v rather than %s", err, errClosed)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	const duration = time.Second
+
+	grp, err := NewGroup(Limits{WriteIOPS: Limit{PerSecond: 400, Burst: 8}})
+	if err != nil {
+		t.Fatalf("Could not create group: %s", err)
+	}
+	light := createDevice(t, 1024*1024, Limits{}, OptGroup{Group: grp})
+	heavy := createDevice(t, 1024*1024, Limits{}, OptGroup{Group: grp, Weight: 3})
+	defer light.Close()
+	defer heavy.Close()
+	if light.Group() != grp || light.Weight() != 1 || heavy.Weight() != 3 {
+		t.Fatalf("Group membership was not as expected")
+	}
+
+	//Saturate the group from both devices, each with several writers
+	hammer := func(devs ...*QoS) []int64 {
+		counts := make([]int64, len(devs))
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for i, dev := range devs {
+			for j := 0; j < 4; j++ {
+				wg.Add(1)
+				go func(dev *QoS, count *int64) {
+					defer wg.Done()
+					buf := make([]byte, 512)
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						if _, err := dev.WriteAt(buf, 0); err == nil {
+							atomic.AddInt64(count, 1)
+						}
+					}
+				}(dev, &counts[i])
+			}
+		}
+		time.Sleep(duration)
+		close(stop)
+		wg.Wait()
+		return counts
+	}
+
+	counts := hammer(light, heavy)
+	total := counts[0] + counts[1]
+	ratio := float64(counts[1]) / float64(counts[0])
+	t.Logf("Light: %d writes, heavy: %d writes", counts[0], counts[1])
+	switch {
+	case total < 300 || total > 500:
+		t.Fatalf("Group permitted %d writes in %s at 400 IOPS", total, duration)
+	case math.Abs(ratio-3) > 0.6:
+		t.Fatalf("Writes were shared %d:%d between weights 1 and 3", counts[0], counts[1])
+	}
+
+	//Weights can be changed, and an idle member's share is available to the others
+	if err = heavy.SetWeight(1); err != nil {
+		t.Fatalf("Could not set weight: %s", err)
+	}
+	counts = hammer(light, heavy)
+	if ratio = float64(counts[1]) / float64(counts[0]); math.Abs(ratio-1) > 0.3 {
+		t.Fatalf("Writes were shared %d:%d between equal weights", counts[0], counts[1])
+	}
+	if counts = hammer(light); counts[0] < 300 {
+		t.Fatalf("Sole active member of the group permitted only %d writes in %s at 400 IOPS", counts[0], duration)
+	}
+
+	//Members are also limited by their own limits, while others use the remainder
+	light.SetLimits(Limits{WriteIOPS: Limit{PerSecond: 50, Burst: 8}})
+	counts = hammer(light, heavy)
+	if counts[0] > 75 || counts[1] < 250 {
+		t.Fatalf("Writes were shared %d:%d with the light member limited to 50 IOPS", counts[0], counts[1])
+	}
+	if stats := light.Stats(); stats.WritesThrottled == 0 {
+		t.Fatalf("Group throttling was not recorded: %+v", stats)
+	}
+}
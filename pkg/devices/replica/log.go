@@ -0,0 +1,418 @@
+package replica
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errLogGap = consterr.ConstErr("Write log no longer holds the records requested")
+
+	logSuffix = ".log"
+	//Record header: checksum, op, sequence, time (unix nanoseconds), position, length
+	recHdrBytes = 4 + 1 + 8 + 8 + 8 + 4
+)
+
+//op is the type of a log record
+type op uint8
+
+const (
+	opWrite op = iota + 1
+	opTrim
+	opFlush
+)
+
+func (o op) String() string {
+	switch o {
+	case opWrite:
+		return "write"
+	case opTrim:
+		return "trim"
+	case opFlush:
+		return "flush"
+	}
+	return "unknown"
+}
+
+//record is a write, trim or flush in the write log; only writes have a payload
+type record struct {
+	op     op
+	seq    uint64
+	at     time.Time
+	pos    int64
+	length int64
+	data   []byte
+}
+
+//segment is a file of the write log holding consecutive records
+type segment struct {
+	first, last uint64 //last is first-1 if the segment is empty
+	bytes       int64
+}
+
+func (seg *segment) path(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seg.first, logSuffix))
+}
+
+//writeLog is an ordered, append-only log of records split into segment files
+// named by the sequence number of their first record. Segments are deleted once
+// every record in them is durable on the secondary.
+type writeLog struct {
+	dir      string
+	segBytes int64
+
+	mu       sync.Mutex
+	segs     []*segment //Oldest first, the last is being appended to
+	cur      *os.File
+	nextSeq  uint64
+	bytes    int64
+	appended chan struct{} //Closed and replaced when a record is appended
+}
+
+//openLog opens the write log in the provided directory, creating it if needed. A
+// torn record at the end of the last segment, left by a crash, is truncated.
+func openLog(dir string, segBytes int64) (*writeLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Could not create write log directory %q: %w", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list write log directory %q: %w", dir, err)
+	}
+
+	wl := &writeLog{dir: dir, segBytes: segBytes, nextSeq: 1, appended: make(chan struct{})}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), logSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), logSuffix), 10, 64)
+		if err != nil || first < 1 {
+			return nil, fmt.Errorf("Write log directory %q has unexpected file %q", dir, entry.Name())
+		}
+		wl.segs = append(wl.segs, &segment{first: first, last: first - 1})
+	}
+	sort.Slice(wl.segs, func(i, j int) bool { return wl.segs[i].first < wl.segs[j].first })
+
+	for i, seg := range wl.segs {
+		if err = wl.scan(seg, i == len(wl.segs)-1); err != nil {
+			return nil, err
+		}
+		if i > 0 && seg.first != wl.segs[i-1].last+1 {
+			return nil, fmt.Errorf("Write log segment %q does not follow the previous segment", seg.path(dir))
+		}
+		wl.bytes += seg.bytes
+		wl.nextSeq = seg.last + 1
+	}
+
+	if len(wl.segs) == 0 {
+		err = wl.startSegment()
+	} else {
+		wl.cur, err = os.OpenFile(wl.segs[len(wl.segs)-1].path(dir), os.O_WRONLY|os.O_APPEND, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not open write log segment: %w", err)
+	}
+	return wl, nil
+}
+
+//scan validates the records of a segment to find its last sequence number and
+// size, truncating an invalid tail if it is the last segment
+func (wl *writeLog) scan(seg *segment, last bool) error {
+	path := seg.path(wl.dir)
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not open write log segment %q: %w", path, err)
+	}
+	defer f.Close()
+
+	for {
+		rec, recBytes, err := readRecord(f, seg.bytes)
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case err == nil && rec.seq != seg.last+1:
+			err = fmt.Errorf("record %d follows record %d", rec.seq, seg.last)
+		}
+		if err != nil {
+			if !last {
+				return fmt.Errorf("Write log segment %q is corrupt: %w", path, err)
+			}
+			if err = f.Truncate(seg.bytes); err != nil {
+				return fmt.Errorf("Could not truncate torn write log segment %q: %w", path, err)
+			}
+			return nil
+		}
+		seg.last, seg.bytes = rec.seq, seg.bytes+recBytes
+	}
+}
+
+//startSegment closes the current segment and starts a new one at nextSeq, the
+// caller must hold mu
+func (wl *writeLog) startSegment() error {
+	if wl.cur != nil {
+		if err := wl.cur.Sync(); err != nil {
+			return err
+		}
+		if err := wl.cur.Close(); err != nil {
+			return err
+		}
+		wl.cur = nil
+	}
+	seg := &segment{first: wl.nextSeq, last: wl.nextSeq - 1}
+	f, err := os.OpenFile(seg.path(wl.dir), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	wl.cur, wl.segs = f, append(wl.segs, seg)
+	return nil
+}
+
+//append adds a record to the log and returns its sequence number
+func (wl *writeLog) append(o op, pos, length int64, data []byte) (uint64, error) {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	if wl.cur == nil {
+		return 0, errClosed
+	}
+	seg := wl.segs[len(wl.segs)-1]
+	if seg.bytes >= wl.segBytes {
+		if err := wl.startSegment(); err != nil {
+			return 0, fmt.Errorf("Could not start write log segment: %w", err)
+		}
+		seg = wl.segs[len(wl.segs)-1]
+	}
+
+	rec := record{op: o, seq: wl.nextSeq, at: time.Now(), pos: pos, length: length, data: data}
+	buf := encodeRecord(&rec)
+	if _, err := wl.cur.Write(buf); err != nil {
+		//Remove any partial record so later appends are not lost behind it
+		wl.cur.Truncate(seg.bytes)
+		return 0, fmt.Errorf("Could not append to write log: %w", err)
+	}
+	seg.last, seg.bytes = rec.seq, seg.bytes+int64(len(buf))
+	wl.bytes += int64(len(buf))
+	wl.nextSeq++
+
+	close(wl.appended)
+	wl.appended = make(chan struct{})
+	return rec.seq, nil
+}
+
+//sync makes the appended records durable
+func (wl *writeLog) sync() error {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	if wl.cur == nil {
+		return errClosed
+	}
+	return wl.cur.Sync()
+}
+
+//lastSeq returns the sequence number of the last record appended
+func (wl *writeLog) lastSeq() uint64 {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	return wl.nextSeq - 1
+}
+
+//firstSeq returns the sequence number of the oldest record held
+func (wl *writeLog) firstSeq() uint64 {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	return wl.segs[0].first
+}
+
+//size returns the total bytes of the segments held
+func (wl *writeLog) size() int64 {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	return wl.bytes
+}
+
+//discardThrough deletes segments whose records all have sequence numbers no
+// greater than the provided one, the segment being appended to is kept
+func (wl *writeLog) discardThrough(seq uint64) error {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	for len(wl.segs) > 1 && wl.segs[0].last <= seq {
+		if err := os.Remove(wl.segs[0].path(wl.dir)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not delete write log segment: %w", err)
+		}
+		wl.bytes -= wl.segs[0].bytes
+		wl.segs = wl.segs[1:]
+	}
+	return nil
+}
+
+//reset discards every record held, the next record appended starts a new segment
+func (wl *writeLog) reset() error {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	if wl.cur == nil {
+		return errClosed
+	}
+	if err := wl.startSegment(); err != nil {
+		return fmt.Errorf("Could not start write log segment: %w", err)
+	}
+	for _, seg := range wl.segs[:len(wl.segs)-1] {
+		if err := os.Remove(seg.path(wl.dir)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Could not delete write log segment: %w", err)
+		}
+	}
+	wl.segs, wl.bytes = wl.segs[len(wl.segs)-1:], 0
+	return nil
+}
+
+func (wl *writeLog) close() error {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	if wl.cur == nil {
+		return errClosed
+	}
+	err := wl.cur.Sync()
+	if closeErr := wl.cur.Close(); err == nil {
+		err = closeErr
+	}
+	wl.cur = nil
+	return err
+}
+
+//logReader reads records from the log in order, waiting for them to be appended
+type logReader struct {
+	wl       *writeLog
+	seq      uint64 //Next record to return
+	segFirst uint64 //First sequence number of the open segment
+	f        *os.File
+	off      int64
+}
+
+//reader returns a logReader starting at the provided sequence number
+func (wl *writeLog) reader(seq uint64) *logReader {
+	return &logReader{wl: wl, seq: seq}
+}
+
+//next returns the next record, if none is available it invokes idle and then
+// waits until one is appended or the context is done. If the log no longer holds
+// the next record errLogGap is returned.
+func (lr *logReader) next(ctx context.Context, idle func() error) (*record, error) {
+	for {
+		lr.wl.mu.Lock()
+		if lr.seq < lr.wl.segs[0].first {
+			lr.wl.mu.Unlock()
+			return nil, errLogGap
+		}
+		if lr.seq >= lr.wl.nextSeq {
+			appended := lr.wl.appended
+			lr.wl.mu.Unlock()
+			if idle != nil {
+				if err := idle(); err != nil {
+					return nil, err
+				}
+			}
+			select {
+			case <-appended:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		idx := sort.Search(len(lr.wl.segs), func(i int) bool { return lr.wl.segs[i].first > lr.seq }) - 1
+		seg := *lr.wl.segs[idx]
+		lr.wl.mu.Unlock()
+
+		if lr.f == nil || lr.segFirst != seg.first {
+			if lr.f != nil {
+				lr.f.Close()
+			}
+			f, err := os.Open(seg.path(lr.wl.dir))
+			if os.IsNotExist(err) {
+				return nil, errLogGap //Discarded since it was found
+			} else if err != nil {
+				return nil, fmt.Errorf("Could not open write log segment: %w", err)
+			}
+			lr.f, lr.segFirst, lr.off = f, seg.first, 0
+		}
+
+		rec, recBytes, err := readRecord(lr.f, lr.off)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read write log segment %q: %w", seg.path(lr.wl.dir), err)
+		}
+		lr.off += recBytes
+		switch {
+		case rec.seq < lr.seq:
+			continue
+		case rec.seq > lr.seq:
+			return nil, fmt.Errorf("Write log record %d was found rather than %d", rec.seq, lr.seq)
+		}
+		lr.seq++
+		return rec, nil
+	}
+}
+
+func (lr *logReader) close() {
+	if lr.f != nil {
+		lr.f.Close()
+		lr.f = nil
+	}
+}
+
+func encodeRecord(rec *record) []byte {
+	buf := make([]byte, recHdrBytes+len(rec.data))
+	buf[4] = byte(rec.op)
+	binary.LittleEndian.PutUint64(buf[5:], rec.seq)
+	binary.LittleEndian.PutUint64(buf[13:], uint64(rec.at.UnixNano()))
+	binary.LittleEndian.PutUint64(buf[21:], uint64(rec.pos))
+	binary.LittleEndian.PutUint32(buf[29:], uint32(rec.length))
+	copy(buf[recHdrBytes:], rec.data)
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+//readRecord reads the record at the provided offset and returns it and its size,
+// io.EOF is returned if there are no more records
+func readRecord(rdr io.ReaderAt, off int64) (*record, int64, error) {
+	var hdr [recHdrBytes]byte
+	if n, err := rdr.ReadAt(hdr[:], off); n == 0 && errors.Is(err, io.EOF) {
+		return nil, 0, io.EOF
+	} else if n < len(hdr) {
+		return nil, 0, fmt.Errorf("record header is truncated")
+	}
+
+	rec := &record{
+		op:     op(hdr[4]),
+		seq:    binary.LittleEndian.Uint64(hdr[5:]),
+		at:     time.Unix(0, int64(binary.LittleEndian.Uint64(hdr[13:]))),
+		pos:    int64(binary.LittleEndian.Uint64(hdr[21:])),
+		length: int64(binary.LittleEndian.Uint32(hdr[29:])),
+	}
+	crc := crc32.ChecksumIEEE(hdr[4:])
+	if rec.op == opWrite {
+		rec.data = make([]byte, rec.length)
+		if n, _ := rdr.ReadAt(rec.data, off+recHdrBytes); int64(n) < rec.length {
+			return nil, 0, fmt.Errorf("record payload is truncated")
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, rec.data)
+	}
+	if crc != binary.LittleEndian.Uint32(hdr[:4]) {
+		return nil, 0, fmt.Errorf("record checksum mismatch")
+	}
+	return rec, recHdrBytes + int64(len(rec.data)), nil
+}
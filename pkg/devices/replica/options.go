@@ -0,0 +1,44 @@
+package replica
+
+import (
+	"time"
+)
+
+//Option is a replication primary option
+type Option interface {
+	apply(*Primary)
+}
+
+//OptSemiSync instructs a Primary to wait up to the provided time in each flush for
+// the secondary to acknowledge it has applied and flushed every write before it.
+// If it does not, replication is asynchronous until the secondary catches up.
+type OptSemiSync time.Duration
+
+func (timeout OptSemiSync) apply(pdev *Primary) {
+	pdev.semiSync = time.Duration(timeout)
+}
+
+//OptMaxLogBytes instructs a Primary to discard its write log and resync the
+// secondary when the log grows beyond this size while the secondary is behind
+type OptMaxLogBytes int64
+
+func (size OptMaxLogBytes) apply(pdev *Primary) {
+	pdev.maxLogBytes = int64(size)
+}
+
+//OptDialTimeout instructs a Primary to abandon connection attempts to the
+// secondary that take longer than this
+type OptDialTimeout time.Duration
+
+func (timeout OptDialTimeout) apply(pdev *Primary) {
+	pdev.dialTimeout = time.Duration(timeout)
+}
+
+//OptReconnectDelay instructs a Primary to wait this long before reconnecting to
+// the secondary after replication is interrupted, doubling the delay after each
+// failed attempt up to 10 seconds
+type OptReconnectDelay time.Duration
+
+func (delay OptReconnectDelay) apply(pdev *Primary) {
+	pdev.reconnectDelay = time.Duration(delay)
+}
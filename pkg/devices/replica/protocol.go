@@ -0,0 +1,139 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+//The replication protocol: the primary connects and sends the protocol magic and
+// a hello, the secondary replies with a helloReply. The primary then sends a
+// stream of frames and the secondary replies with acks as it applies them.
+const (
+	protoMagic    = "USBDREP1"
+	maxHelloBytes = 64 * 1024
+	//Frame header: type, sequence, position, length
+	frameHdrBytes = 1 + 8 + 8 + 4
+	ackBytes      = 8 + 8
+)
+
+//Frame types other than records (whose types are their op) are used for resyncs
+const (
+	frameResyncStart op = iota + 16
+	frameResyncData     //Device contents at a position
+	frameResyncZero     //Zeros at a position
+	frameResyncDone     //Sequence is that the resync started after, position that it ended after
+)
+
+//hello is sent by the primary when it connects
+type hello struct {
+	ReplicationID string `json:"replicationID"`
+	DeviceBytes   int64  `json:"deviceBytes"`
+}
+
+//helloReply is sent by the secondary in response to a hello
+type helloReply struct {
+	Error         string `json:"error,omitempty"`
+	ReplicationID string `json:"replicationID"` //Empty if never replicated to
+	DurableSeq    uint64 `json:"durableSeq"`
+	Resyncing     bool   `json:"resyncing"` //An interrupted resync must be restarted
+}
+
+//frame is a record or resync message sent from the primary to the secondary
+type frame struct {
+	typ    op
+	seq    uint64
+	pos    int64
+	length int64
+	data   []byte
+}
+
+//ack is sent by the secondary to report its progress
+type ack struct {
+	applied, durable uint64
+}
+
+func writeMsg(wtr io.Writer, msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	var hdr [4]byte
+	binary.LittleEndian.PutUint32(hdr[:], uint32(len(data)))
+	if _, err = wtr.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err = wtr.Write(data)
+	return err
+}
+
+func readMsg(rdr io.Reader, msg interface{}) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(rdr, hdr[:]); err != nil {
+		return err
+	}
+	msgBytes := binary.LittleEndian.Uint32(hdr[:])
+	if msgBytes > maxHelloBytes {
+		return fmt.Errorf("Message of %d bytes is too large", msgBytes)
+	}
+	data := make([]byte, msgBytes)
+	if _, err := io.ReadFull(rdr, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, msg)
+}
+
+func writeFrame(wtr *bufio.Writer, fr *frame) error {
+	var hdr [frameHdrBytes]byte
+	hdr[0] = byte(fr.typ)
+	binary.LittleEndian.PutUint64(hdr[1:], fr.seq)
+	binary.LittleEndian.PutUint64(hdr[9:], uint64(fr.pos))
+	binary.LittleEndian.PutUint32(hdr[17:], uint32(fr.length))
+	if _, err := wtr.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := wtr.Write(fr.data)
+	return err
+}
+
+//readFrame reads a frame, buf is used for its payload if it is large enough
+func readFrame(rdr *bufio.Reader, buf []byte) (*frame, error) {
+	var hdr [frameHdrBytes]byte
+	if _, err := io.ReadFull(rdr, hdr[:]); err != nil {
+		return nil, err
+	}
+	fr := &frame{
+		typ:    op(hdr[0]),
+		seq:    binary.LittleEndian.Uint64(hdr[1:]),
+		pos:    int64(binary.LittleEndian.Uint64(hdr[9:])),
+		length: int64(binary.LittleEndian.Uint32(hdr[17:])),
+	}
+	if fr.typ == opWrite || fr.typ == frameResyncData {
+		if int64(cap(buf)) < fr.length {
+			buf = make([]byte, fr.length)
+		}
+		fr.data = buf[:fr.length]
+		if _, err := io.ReadFull(rdr, fr.data); err != nil {
+			return nil, err
+		}
+	}
+	return fr, nil
+}
+
+func writeAck(wtr io.Writer, a ack) error {
+	var buf [ackBytes]byte
+	binary.LittleEndian.PutUint64(buf[:], a.applied)
+	binary.LittleEndian.PutUint64(buf[8:], a.durable)
+	_, err := wtr.Write(buf[:])
+	return err
+}
+
+func readAck(rdr io.Reader) (ack, error) {
+	var buf [ackBytes]byte
+	if _, err := io.ReadFull(rdr, buf[:]); err != nil {
+		return ack{}, err
+	}
+	return ack{applied: binary.LittleEndian.Uint64(buf[:]), durable: binary.LittleEndian.Uint64(buf[8:])}, nil
+}
@@ -0,0 +1,479 @@
+package replica
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed = consterr.ConstErr("Device is shutdown")
+
+	//DefMaxLogBytes is the default size the write log may grow to while the
+	// secondary is behind, beyond it the log is discarded and the secondary resynced
+	DefMaxLogBytes = 1024 * 1024 * 1024
+	//DefDialTimeout is the default time allowed to connect to the secondary
+	DefDialTimeout = 10 * time.Second
+	//DefReconnectDelay is the default delay before the first reconnection attempt
+	DefReconnectDelay = 100 * time.Millisecond
+
+	maxSegmentBytes   = 64 * 1024 * 1024
+	maxReconnectDelay = 10 * time.Second
+	regionBytes       = 1024 * 1024
+	lockStripes       = 64
+	resyncChunkBytes  = 1024 * 1024
+	lagMarkEvery      = 100 * time.Millisecond
+	stateName         = "state"
+)
+
+//primaryState is persisted in the log directory
+type primaryState struct {
+	ReplicationID string `json:"replicationID"`
+	DeviceBytes   int64  `json:"deviceBytes"`
+	Clean         bool   `json:"clean"`        //Shutdown cleanly
+	ResyncNeeded  bool   `json:"resyncNeeded"` //The write log is missing records the secondary needs
+}
+
+//Stats describes the state of replication from a Primary
+type Stats struct {
+	Connected   bool   //To the secondary
+	Resyncing   bool   //A full copy of the device to the secondary is in progress
+	ResyncBytes int64  //Bytes copied by the resync in progress
+	Degraded    bool   //Semi-synchronous flushes timed out and are asynchronous until the secondary catches up
+	LastSeq     uint64 //Sequence number of the last record logged
+	AppliedSeq  uint64 //Sequence number of the last record applied by the secondary
+	DurableSeq  uint64 //Sequence number of the last flush applied by the secondary
+	//LagRecords is the number of records logged but not yet applied by the secondary
+	LagRecords uint64
+	//LagTime is approximately how long ago the oldest record not yet applied by the
+	// secondary was logged
+	LagTime   time.Duration
+	LogBytes  int64  //Size of the write log on disk
+	LastError string //Reason replication was last interrupted
+}
+
+//lagMark records when a record was logged, for estimating replication lag
+type lagMark struct {
+	seq uint64
+	at  time.Time
+}
+
+//Primary wraps a device and replicates every write and trim made to it to a
+// Secondary over TCP, similar to DRBD protocol A. Writes and trims are applied to
+// the wrapped device and appended to an ordered write log on disk, which is
+// shipped asynchronously to the secondary and applied there in the same order.
+// Flushes are also logged and are consistency points: the secondary flushes its
+// device when it applies one and acknowledges it, after which the log up to it is
+// discarded. With OptSemiSync flushes also wait for the secondary's
+// acknowledgement.
+//
+// After a disconnect the secondary catches up from the log. If the log grows
+// beyond OptMaxLogBytes, the primary was not shutdown cleanly (so records it lost
+// may have been applied by the secondary) or the secondary is new, the entire
+// device is copied to the secondary instead (a resync), after which it catches up
+// from the log. The secondary is not consistent until the first flush after a
+// resync is applied.
+type Primary struct {
+	dev            usbdlib.Device
+	logDir         string
+	network, addr  string
+	size           int64
+	maxLogBytes    int64
+	semiSync       time.Duration
+	dialTimeout    time.Duration
+	reconnectDelay time.Duration
+	atomicOnline   uint64
+	ioMu           sync.RWMutex //Held exclusively to close
+	regionLocks    [lockStripes]sync.Mutex
+	wl             *writeLog
+	persistMu      sync.Mutex
+
+	mu          sync.Mutex
+	state       primaryState
+	resyncGen   uint64 //Incremented each time a resync becomes needed
+	connected   bool
+	resyncing   bool
+	resyncBytes int64
+	applied     uint64
+	durable     uint64
+	acked       chan struct{} //Closed and replaced when an ack is received
+	degraded    bool
+	lagMarks    []lagMark
+	lastErr     string
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	shipDone  chan struct{}
+}
+
+var (
+	_ usbdlib.Device         = (*Primary)(nil)
+	_ usbdlib.ReadOnlyDevice = (*Primary)(nil)
+)
+
+//NewPrimary constructs a device replicating the provided device to the secondary
+// at the provided address (ex. "tcp", "backup-host:10900"). The write log and
+// replication state are kept in logDir, which is created if it does not exist.
+// The primary owns the device and closes it when closed. It connects to the
+// secondary in the background, reconnecting as needed; see Stats.
+func NewPrimary(dev usbdlib.Device, logDir, network, addr string, options ...Option) (*Primary, error) {
+	pdev := &Primary{
+		dev:            dev,
+		logDir:         logDir,
+		network:        network,
+		addr:           addr,
+		size:           dev.Size(),
+		maxLogBytes:    DefMaxLogBytes,
+		dialTimeout:    DefDialTimeout,
+		reconnectDelay: DefReconnectDelay,
+		atomicOnline:   1,
+		acked:          make(chan struct{}),
+		shipDone:       make(chan struct{}),
+	}
+	for _, opt := range options {
+		opt.apply(pdev)
+	}
+	if pdev.maxLogBytes < 1 {
+		return nil, fmt.Errorf("Maximum write log size must be at least one byte")
+	}
+	segBytes := pdev.maxLogBytes / 4
+	if segBytes > maxSegmentBytes {
+		segBytes = maxSegmentBytes
+	}
+
+	var err error
+	if pdev.wl, err = openLog(logDir, segBytes); err != nil {
+		return nil, err
+	}
+	if err = pdev.loadState(); err != nil {
+		pdev.wl.close()
+		return nil, err
+	}
+
+	pdev.ctx, pdev.ctxCancel = context.WithCancel(context.Background())
+	go pdev.ship()
+	return pdev, nil
+}
+
+//loadState loads the replication state from the log directory, or creates it
+func (pdev *Primary) loadState() error {
+	stateFile := filepath.Join(pdev.logDir, stateName)
+	data, err := os.ReadFile(stateFile)
+	switch {
+	case os.IsNotExist(err):
+		var id [16]byte
+		if _, err = io.ReadFull(rand.Reader, id[:]); err != nil {
+			return fmt.Errorf("Could not generate replication ID: %w", err)
+		}
+		pdev.state = primaryState{ReplicationID: hex.EncodeToString(id[:]), DeviceBytes: pdev.size}
+	case err != nil:
+		return fmt.Errorf("Could not read replication state file %q: %w", stateFile, err)
+	default:
+		if err = json.Unmarshal(data, &pdev.state); err != nil {
+			return fmt.Errorf("Could not decode replication state file %q: %w", stateFile, err)
+		}
+		if pdev.state.DeviceBytes != pdev.size {
+			return fmt.Errorf("Replication state file %q is for a device of %d bytes rather than %d", stateFile, pdev.state.DeviceBytes, pdev.size)
+		}
+		if !pdev.state.Clean && !pdev.state.ResyncNeeded {
+			log.Printf("Primary::loadState(): WARNING: Device replicated to %q was not shutdown cleanly, it will be resynced", pdev.addr)
+			pdev.state.ResyncNeeded = true
+		}
+	}
+
+	pdev.state.Clean = false //Record that the device is in use
+	return pdev.persist()
+}
+
+//persist writes the replication state to the log directory
+func (pdev *Primary) persist() error {
+	pdev.persistMu.Lock()
+	defer pdev.persistMu.Unlock()
+
+	pdev.mu.Lock()
+	data, err := json.MarshalIndent(&pdev.state, "", "\t")
+	pdev.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("Could not encode replication state: %w", err)
+	}
+	if err = util.WriteFileAtomic(filepath.Join(pdev.logDir, stateName), data, 0600); err != nil {
+		return fmt.Errorf("Could not persist replication state: %w", err)
+	}
+	return nil
+}
+
+//needResync records that the secondary must be resynced as the log is missing
+// records it needs
+func (pdev *Primary) needResync() {
+	pdev.mu.Lock()
+	pdev.resyncGen++
+	alreadyNeeded := pdev.state.ResyncNeeded
+	pdev.state.ResyncNeeded = true
+	pdev.mu.Unlock()
+
+	if !alreadyNeeded {
+		if err := pdev.persist(); err != nil {
+			log.Printf("Primary::needResync(): WARNING: Resync required but could not be recorded; Details: %s", err)
+		}
+	}
+}
+
+//Size of this device in bytes
+func (pdev *Primary) Size() int64 {
+	return pdev.size
+}
+
+//BlockSize of this device is that of the wrapped device
+func (pdev *Primary) BlockSize() int64 {
+	return pdev.dev.BlockSize()
+}
+
+//ReadOnly returns if the wrapped device is read-only, fulfilling
+// usbdlib.ReadOnlyDevice
+func (pdev *Primary) ReadOnly() bool {
+	return usbdlib.IsReadOnly(pdev.dev)
+}
+
+//ReplicationID returns the identifier of this replication relationship, a
+// secondary only accepts records from the primary it was first resynced from
+func (pdev *Primary) ReplicationID() string {
+	return pdev.state.ReplicationID
+}
+
+//Stats returns the current state of replication
+func (pdev *Primary) Stats() Stats {
+	lastSeq, logBytes := pdev.wl.lastSeq(), pdev.wl.size()
+
+	pdev.mu.Lock()
+	defer pdev.mu.Unlock()
+
+	stats := Stats{
+		Connected:   pdev.connected,
+		Resyncing:   pdev.resyncing,
+		ResyncBytes: pdev.resyncBytes,
+		Degraded:    pdev.degraded,
+		LastSeq:     lastSeq,
+		AppliedSeq:  pdev.applied,
+		DurableSeq:  pdev.durable,
+		LogBytes:    logBytes,
+		LastError:   pdev.lastErr,
+	}
+	if lastSeq > pdev.applied {
+		stats.LagRecords = lastSeq - pdev.applied
+		if len(pdev.lagMarks) > 0 {
+			stats.LagTime = time.Since(pdev.lagMarks[0].at)
+		}
+	}
+	return stats
+}
+
+//lockRange locks the regions overlapping the provided range so that the order
+// overlapping writes are applied to the device matches their order in the log
+func (pdev *Primary) lockRange(pos, count int64) (unlock func()) {
+	first, last := pos/regionBytes, (pos+count-1)/regionBytes
+	if last < first {
+		last = first
+	}
+	var stripes []int
+	if last-first+1 >= lockStripes {
+		for i := 0; i < lockStripes; i++ {
+			stripes = append(stripes, i)
+		}
+	} else {
+		for region := first; region <= last; region++ {
+			stripes = append(stripes, int(region%lockStripes))
+		}
+		sort.Ints(stripes) //Consistent order to avoid deadlock
+	}
+
+	for _, stripe := range stripes {
+		pdev.regionLocks[stripe].Lock()
+	}
+	return func() {
+		for _, stripe := range stripes {
+			pdev.regionLocks[stripe].Unlock()
+		}
+	}
+}
+
+//log appends a record to the write log and returns its sequence number. If the
+// log cannot be appended to, or has grown too large, it is discarded and the
+// secondary will be resynced; 0 is returned if the record was not logged.
+func (pdev *Primary) log(o op, pos, length int64, data []byte) uint64 {
+	seq, err := pdev.wl.append(o, pos, length, data)
+	if err != nil {
+		log.Printf("Primary::log(): WARNING: Could not log %s, the secondary will be resynced; Details: %s", o, err)
+		pdev.needResync()
+		return 0
+	}
+
+	now := time.Now()
+	pdev.mu.Lock()
+	if marks := pdev.lagMarks; len(marks) == 0 || now.Sub(marks[len(marks)-1].at) >= lagMarkEvery {
+		pdev.lagMarks = append(marks, lagMark{seq: seq, at: now})
+	}
+	durable := pdev.durable
+	pdev.mu.Unlock()
+
+	if pdev.wl.size() > pdev.maxLogBytes {
+		if err = pdev.wl.discardThrough(durable); err == nil && pdev.wl.size() > pdev.maxLogBytes {
+			log.Printf("Primary::log(): WARNING: Write log exceeds %d bytes, it is discarded and the secondary will be resynced", pdev.maxLogBytes)
+			pdev.needResync()
+			err = pdev.wl.reset()
+		}
+		if err != nil {
+			log.Printf("Primary::log(): WARNING: Could not trim write log; Details: %s", err)
+		}
+	}
+	return seq
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (pdev *Primary) ReadAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&pdev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	pdev.ioMu.RLock()
+	defer pdev.ioMu.RUnlock()
+
+	return pdev.dev.ReadAt(buf, pos)
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device. Writes that fail
+// are not replicated, so any part of them applied to the wrapped device is not.
+func (pdev *Primary) WriteAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&pdev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	pdev.ioMu.RLock()
+	defer pdev.ioMu.RUnlock()
+	if len(buf) < 1 {
+		return 0, nil
+	}
+
+	unlock := pdev.lockRange(pos, int64(len(buf)))
+	defer unlock()
+	n, err := pdev.dev.WriteAt(buf, pos)
+	if err != nil {
+		return n, err
+	}
+	pdev.log(opWrite, pos, int64(len(buf)), buf)
+	return n, nil
+}
+
+//Trim fufills part of usbdlib.Device
+func (pdev *Primary) Trim(pos int64, count int) error {
+	if atomic.LoadUint64(&pdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	pdev.ioMu.RLock()
+	defer pdev.ioMu.RUnlock()
+	if count < 1 {
+		return nil
+	}
+
+	unlock := pdev.lockRange(pos, int64(count))
+	defer unlock()
+	if err := pdev.dev.Trim(pos, count); err != nil {
+		return err
+	}
+	pdev.log(opTrim, pos, int64(count), nil)
+	return nil
+}
+
+//Flush fufills part of usbdlib.Device. It flushes the wrapped device and the write
+// log, and logs a consistency point for the secondary. With OptSemiSync it then
+// waits for the secondary to acknowledge it.
+func (pdev *Primary) Flush() error {
+	if atomic.LoadUint64(&pdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	pdev.ioMu.RLock()
+	defer pdev.ioMu.RUnlock()
+
+	if err := pdev.dev.Flush(); err != nil {
+		return err
+	}
+	seq := pdev.log(opFlush, 0, 0, nil)
+	if err := pdev.wl.sync(); err != nil {
+		log.Printf("Primary::Flush(): WARNING: Could not sync write log, the secondary will be resynced; Details: %s", err)
+		pdev.needResync()
+	}
+	if pdev.semiSync > 0 && seq > 0 {
+		pdev.waitDurable(seq)
+	}
+	return nil
+}
+
+//waitDurable waits for the secondary to acknowledge the provided flush. If it does
+// not within the semi-synchronous timeout replication is degraded to asynchronous
+// until the secondary catches up.
+func (pdev *Primary) waitDurable(seq uint64) {
+	timer := time.NewTimer(pdev.semiSync)
+	defer timer.Stop()
+
+	for {
+		pdev.mu.Lock()
+		if pdev.durable >= seq || pdev.degraded {
+			pdev.mu.Unlock()
+			return
+		}
+		acked := pdev.acked
+		pdev.mu.Unlock()
+
+		select {
+		case <-acked:
+		case <-pdev.ctx.Done():
+			return
+		case <-timer.C:
+			pdev.mu.Lock()
+			pdev.degraded = true
+			pdev.mu.Unlock()
+			log.Printf("Primary::waitDurable(): WARNING: Secondary %q did not acknowledge a flush within %s, replication is asynchronous until it catches up", pdev.addr, pdev.semiSync)
+			return
+		}
+	}
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device. Records not yet
+// shipped to the secondary remain in the write log and are shipped once the
+// primary is reopened.
+func (pdev *Primary) Close() error {
+	if !atomic.CompareAndSwapUint64(&pdev.atomicOnline, 1, 0) {
+		return errClosed
+	}
+	pdev.ioMu.Lock() //Wait for outstanding IO
+	defer pdev.ioMu.Unlock()
+
+	pdev.ctxCancel()
+	<-pdev.shipDone
+
+	err := pdev.dev.Flush()
+	if logErr := pdev.wl.close(); err == nil {
+		err = logErr
+	}
+	if err == nil {
+		pdev.mu.Lock()
+		pdev.state.Clean = true
+		pdev.mu.Unlock()
+		err = pdev.persist()
+	}
+	if closeErr := pdev.dev.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
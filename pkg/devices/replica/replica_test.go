@@ -0,0 +1,286 @@
+package replica
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const sizeBytes = 8 * 1024 * 1024 //8 MB
+
+func TestReplica(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	_, addr := startSecondary(t, ramdisk.NewRAMDisk(sizeBytes), "")
+	testutil.TestUserspace(t, createPrimary(t, ramdisk.NewRAMDisk(sizeBytes), t.TempDir(), addr), sizeBytes)
+	_, addr = startSecondary(t, ramdisk.NewRAMDisk(sizeBytes), "")
+	testutil.TestNBD(t, createPrimary(t, ramdisk.NewRAMDisk(sizeBytes), t.TempDir(), addr), sizeBytes)
+}
+
+func createPrimary(t *testing.T, dev usbdlib.Device, logDir, addr string, options ...Option) *Primary {
+	t.Helper()
+
+	options = append([]Option{OptReconnectDelay(10 * time.Millisecond), OptDialTimeout(time.Second)}, options...)
+	pdev, err := NewPrimary(dev, logDir, "tcp", addr, options...)
+	if err != nil {
+		t.Fatalf("Could not create primary: %s", err)
+	}
+	return pdev
+}
+
+//startSecondary starts a secondary serving on the provided loopback address, or
+// any free port if none is provided, and returns it and the address
+func startSecondary(t *testing.T, dev usbdlib.Device, addr string) (*Secondary, string) {
+	t.Helper()
+
+	sec, err := NewSecondary(dev, filepath.Join(t.TempDir(), "secondary.state"))
+	if err != nil {
+		t.Fatalf("Could not create secondary: %s", err)
+	}
+	return sec, serve(t, sec, addr)
+}
+
+func serve(t *testing.T, sec *Secondary, addr string) string {
+	t.Helper()
+
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	go sec.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+//disconnect stops a secondary from serving so the primary can not reconnect
+func disconnect(sec *Secondary) {
+	sec.mu.Lock()
+	for ln := range sec.listeners {
+		ln.Close()
+	}
+	sec.mu.Unlock()
+	sec.dropConn()
+}
+
+//waitCaughtUp waits for the secondary to have flushed every record logged
+func waitCaughtUp(t *testing.T, pdev *Primary) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		stats := pdev.Stats()
+		if stats.Connected && !stats.Resyncing && stats.DurableSeq == stats.LastSeq {
+			if stats.LagRecords != 0 || stats.LagTime != 0 {
+				t.Fatalf("Secondary is caught up but lag is reported: %+v", stats)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Secondary did not catch up: %+v", stats)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func randomWrites(t *testing.T, dev usbdlib.Device, rnd *rand.Rand, count int) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		buf := make([]byte, 512*(1+rnd.Intn(64)))
+		rnd.Read(buf)
+		pos := rnd.Int63n(dev.Size()-int64(len(buf))) &^ 511
+		if _, err := dev.WriteAt(buf, pos); err != nil {
+			t.Fatalf("Could not write: %s", err)
+		}
+		if i%10 == 0 {
+			if err := dev.Trim(pos, 4096); err != nil {
+				t.Fatalf("Could not trim: %s", err)
+			}
+		}
+	}
+	if err := dev.Flush(); err != nil {
+		t.Fatalf("Could not flush: %s", err)
+	}
+}
+
+//noClose is a device that outlives the primary wrapping it
+type noClose struct {
+	usbdlib.Device
+}
+
+func (noClose) Close() error { return nil }
+
+func expectSame(t *testing.T, expected, actual usbdlib.Device) {
+	t.Helper()
+
+	expBuf, actBuf := make([]byte, expected.Size()), make([]byte, expected.Size())
+	if _, err := expected.ReadAt(expBuf, 0); err != nil {
+		t.Fatalf("Could not read primary: %s", err)
+	}
+	if _, err := actual.ReadAt(actBuf, 0); err != nil {
+		t.Fatalf("Could not read secondary: %s", err)
+	}
+	if !bytes.Equal(expBuf, actBuf) {
+		t.Fatalf("Secondary does not match primary")
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	const maxLogBytes = 4 * 1024 * 1024
+
+	rnd := rand.New(rand.NewSource(1))
+	secDisk := ramdisk.NewRAMDisk(sizeBytes)
+	sec, addr := startSecondary(t, secDisk, "")
+	defer sec.Close()
+
+	//Existing contents of the primary are resynced
+	priDisk := noClose{ramdisk.NewRAMDisk(sizeBytes)}
+	randomWrites(t, priDisk, rnd, 100)
+	logDir := t.TempDir()
+	pdev := createPrimary(t, priDisk, logDir, addr, OptMaxLogBytes(maxLogBytes))
+	randomWrites(t, pdev, rnd, 100)
+	waitCaughtUp(t, pdev)
+	expectSame(t, pdev, secDisk)
+	if status := sec.Status(); !status.Consistent || !status.Connected || status.ReplicationID != pdev.ReplicationID() {
+		t.Fatalf("Secondary status was not as expected: %+v", status)
+	}
+
+	//Writes while disconnected are caught up from the log
+	disconnect(sec)
+	randomWrites(t, pdev, rnd, 100)
+	time.Sleep(50 * time.Millisecond)
+	if stats := pdev.Stats(); stats.Connected || stats.LagRecords == 0 || stats.LagTime == 0 || stats.LastError == "" {
+		t.Fatalf("Primary stats while disconnected were not as expected: %+v", stats)
+	}
+	serve(t, sec, addr)
+	waitCaughtUp(t, pdev)
+	expectSame(t, pdev, secDisk)
+
+	//Records not shipped before a clean shutdown are shipped once reopened
+	disconnect(sec)
+	randomWrites(t, pdev, rnd, 100)
+	if err := pdev.Close(); err != nil {
+		t.Fatalf("Could not close primary: %s", err)
+	}
+	serve(t, sec, addr)
+	pdev = createPrimary(t, priDisk, logDir, addr, OptMaxLogBytes(maxLogBytes))
+	defer pdev.Close()
+	waitCaughtUp(t, pdev)
+	if stats := pdev.Stats(); stats.LogBytes > maxLogBytes/4+64*1024 { //Only the segment being appended to remains
+		t.Fatalf("Acknowledged records were not discarded: %+v", stats)
+	}
+	expectSame(t, pdev, secDisk)
+}
+
+func TestResync(t *testing.T) {
+	const maxLogBytes = 1024 * 1024
+
+	rnd := rand.New(rand.NewSource(2))
+	secDisk := ramdisk.NewRAMDisk(sizeBytes)
+	sec, addr := startSecondary(t, secDisk, "")
+	defer sec.Close()
+	priDisk := ramdisk.NewRAMDisk(sizeBytes)
+	logDir := t.TempDir()
+	pdev := createPrimary(t, priDisk, logDir, addr, OptMaxLogBytes(maxLogBytes))
+	waitCaughtUp(t, pdev)
+
+	//The log overflowing while disconnected causes a resync
+	disconnect(sec)
+	randomWrites(t, pdev, rnd, 200)
+	if stats := pdev.Stats(); stats.LogBytes > maxLogBytes {
+		t.Fatalf("Write log grew beyond its maximum: %+v", stats)
+	}
+	serve(t, sec, addr)
+	waitCaughtUp(t, pdev)
+	expectSame(t, pdev, secDisk)
+
+	//An unclean shutdown causes a resync, as the secondary may have records the
+	// primary lost
+	randomWrites(t, pdev, rnd, 10)
+	waitCaughtUp(t, pdev)
+	pdev.ctxCancel() //Crash, but stop shipping
+	<-pdev.shipDone
+	pdev.wl.close()
+	disconnect(sec)
+	priDisk.WriteAt(make([]byte, 64*1024), 0) //Lost by the primary's log
+	serve(t, sec, addr)
+	pdev = createPrimary(t, priDisk, logDir, addr, OptMaxLogBytes(maxLogBytes))
+	defer pdev.Close()
+	waitCaughtUp(t, pdev)
+	expectSame(t, pdev, secDisk)
+
+	//A secondary only accepts records from its primary
+	other := createPrimary(t, ramdisk.NewRAMDisk(sizeBytes), t.TempDir(), addr)
+	defer other.Close()
+	time.Sleep(100 * time.Millisecond)
+	if stats := other.Stats(); stats.Connected || stats.LastError == "" {
+		t.Fatalf("Secondary accepted another primary: %+v", stats)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	secDisk := ramdisk.NewRAMDisk(sizeBytes)
+	stateFile := filepath.Join(t.TempDir(), "secondary.state")
+	sec, err := NewSecondary(secDisk, stateFile)
+	if err != nil {
+		t.Fatalf("Could not create secondary: %s", err)
+	}
+	if _, err = sec.Promote(false); !errors.Is(err, ErrInconsistent) {
+		t.Fatalf("Promoting a secondary that was never resynced returned %v rather than %s", err, ErrInconsistent)
+	}
+	addr := serve(t, sec, "")
+
+	//Semi-synchronous flushes wait for the secondary
+	priDisk := noClose{ramdisk.NewRAMDisk(sizeBytes)}
+	pdev := createPrimary(t, priDisk, t.TempDir(), addr, OptSemiSync(10*time.Second))
+	waitCaughtUp(t, pdev)
+	randomWrites(t, pdev, rnd, 100)
+	if stats := pdev.Stats(); stats.DurableSeq != stats.LastSeq || stats.Degraded {
+		t.Fatalf("Semi-synchronous flush returned before the secondary acknowledged it: %+v", stats)
+	}
+	expectSame(t, pdev, secDisk)
+
+	//Unless it is unavailable, then they are asynchronous until it catches up
+	disconnect(sec)
+	pdev.semiSync = 50 * time.Millisecond
+	randomWrites(t, pdev, rnd, 10)
+	if stats := pdev.Stats(); !stats.Degraded {
+		t.Fatalf("Semi-synchronous replication was not degraded: %+v", stats)
+	}
+	serve(t, sec, addr)
+	waitCaughtUp(t, pdev)
+	if stats := pdev.Stats(); stats.Degraded {
+		t.Fatalf("Semi-synchronous replication remained degraded: %+v", stats)
+	}
+
+	//Failover
+	if err = pdev.Close(); err != nil {
+		t.Fatalf("Could not close primary: %s", err)
+	}
+	dev, err := sec.Promote(false)
+	if err != nil {
+		t.Fatalf("Could not promote secondary: %s", err)
+	}
+	expectSame(t, priDisk, dev)
+	if _, err = sec.Promote(false); !errors.Is(err, ErrPromoted) {
+		t.Fatalf("Promoting a promoted secondary returned %v rather than %s", err, ErrPromoted)
+	}
+	if _, err = NewSecondary(secDisk, stateFile); !errors.Is(err, ErrPromoted) {
+		t.Fatalf("Reusing a promoted secondary's state returned %v rather than %s", err, ErrPromoted)
+	}
+	if _, err = dev.WriteAt([]byte{1}, 0); err != nil {
+		t.Fatalf("Could not write to promoted device: %s", err)
+	}
+}
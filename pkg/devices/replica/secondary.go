@@ -0,0 +1,419 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	//ErrInconsistent is returned when promoting a secondary whose device is not
+	// consistent, because it has not completed a resync
+	ErrInconsistent = consterr.ConstErr("Secondary is not consistent")
+	//ErrPromoted is returned when using a secondary that has been promoted
+	ErrPromoted = consterr.ConstErr("Secondary has been promoted")
+
+	handshakeTimeout = 10 * time.Second
+)
+
+//secondaryState is persisted in the secondary's state file
+type secondaryState struct {
+	ReplicationID string `json:"replicationID"` //Empty if never resynced
+	DurableSeq    uint64 `json:"durableSeq"`    //Last flush applied
+	//ConsistentSeq is non-zero after a resync until a flush at or after it is
+	// applied, before which the device is not consistent
+	ConsistentSeq uint64 `json:"consistentSeq"`
+	Resyncing     bool   `json:"resyncing"`
+	Promoted      bool   `json:"promoted"`
+}
+
+//SecondaryStatus describes the state of a Secondary
+type SecondaryStatus struct {
+	ReplicationID string
+	Connected     bool   //To a primary
+	AppliedSeq    uint64 //Sequence number of the last record applied
+	DurableSeq    uint64 //Sequence number of the last flush applied
+	Resyncing     bool
+	Consistent    bool //The device holds the contents of the primary at some point
+	Promoted      bool
+}
+
+//Secondary receives records from a Primary and applies them to a device. The
+// device must not be used otherwise until the secondary is promoted.
+type Secondary struct {
+	dev       usbdlib.Device
+	stateFile string
+
+	mu        sync.Mutex
+	state     secondaryState
+	applied   uint64
+	listeners map[net.Listener]struct{}
+	conn      net.Conn
+	connDone  chan struct{}
+	stopped   bool //Promoted or closed
+}
+
+//NewSecondary constructs a secondary applying records to the provided device, its
+// replication state is persisted to stateFile. A secondary that has been promoted
+// can not be used again; its device is no longer a replica.
+func NewSecondary(dev usbdlib.Device, stateFile string) (*Secondary, error) {
+	sec := &Secondary{dev: dev, stateFile: stateFile, listeners: make(map[net.Listener]struct{})}
+
+	data, err := os.ReadFile(stateFile)
+	switch {
+	case os.IsNotExist(err):
+		if err = sec.persist(); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, fmt.Errorf("Could not read secondary state file %q: %w", stateFile, err)
+	default:
+		if err = json.Unmarshal(data, &sec.state); err != nil {
+			return nil, fmt.Errorf("Could not decode secondary state file %q: %w", stateFile, err)
+		}
+		if sec.state.Promoted {
+			return nil, fmt.Errorf("Could not use secondary state file %q: %w", stateFile, ErrPromoted)
+		}
+	}
+	sec.applied = sec.state.DurableSeq
+	return sec, nil
+}
+
+//persist writes the state to the state file, the caller must hold mu or be the
+// only goroutine applying records
+func (sec *Secondary) persist() error {
+	data, err := json.MarshalIndent(&sec.state, "", "\t")
+	if err != nil {
+		return fmt.Errorf("Could not encode secondary state: %w", err)
+	}
+	if err = util.WriteFileAtomic(sec.stateFile, data, 0600); err != nil {
+		return fmt.Errorf("Could not persist secondary state: %w", err)
+	}
+	return nil
+}
+
+//Status returns the current state of the secondary
+func (sec *Secondary) Status() SecondaryStatus {
+	sec.mu.Lock()
+	defer sec.mu.Unlock()
+
+	return SecondaryStatus{
+		ReplicationID: sec.state.ReplicationID,
+		Connected:     sec.conn != nil,
+		AppliedSeq:    sec.applied,
+		DurableSeq:    sec.state.DurableSeq,
+		Resyncing:     sec.state.Resyncing,
+		Consistent:    sec.consistent(),
+		Promoted:      sec.state.Promoted,
+	}
+}
+
+//consistent returns if the device is consistent, the caller must hold mu
+func (sec *Secondary) consistent() bool {
+	return sec.state.ReplicationID != "" && !sec.state.Resyncing && sec.state.ConsistentSeq == 0
+}
+
+//ListenAndServe listens on the provided network address (ex. "tcp", ":10900")
+// and serves a primary until the secondary is promoted or closed
+func (sec *Secondary) ListenAndServe(network, addr string) error {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("Could not listen on %s %q: %w", network, addr, err)
+	}
+	return sec.Serve(ln)
+}
+
+//Serve accepts connections from a primary on the provided listener until the
+// secondary is promoted or closed, when it returns nil. A new connection replaces
+// any existing one, as the primary only reconnects if it lost the previous one.
+func (sec *Secondary) Serve(ln net.Listener) error {
+	sec.mu.Lock()
+	if sec.stopped {
+		sec.mu.Unlock()
+		ln.Close()
+		return ErrPromoted
+	}
+	sec.listeners[ln] = struct{}{}
+	sec.mu.Unlock()
+	defer func() {
+		sec.mu.Lock()
+		delete(sec.listeners, ln)
+		sec.mu.Unlock()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			sec.mu.Lock()
+			stopped := sec.stopped
+			sec.mu.Unlock()
+			if stopped {
+				return nil
+			}
+			return fmt.Errorf("Could not accept connection: %w", err)
+		}
+
+		sec.dropConn()
+		sec.mu.Lock()
+		if sec.stopped {
+			sec.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		done := make(chan struct{})
+		sec.conn, sec.connDone = conn, done
+		sec.mu.Unlock()
+
+		go func() {
+			defer close(done)
+			err := sec.handle(conn)
+			sec.mu.Lock()
+			if sec.conn == conn {
+				sec.conn, sec.connDone = nil, nil
+			}
+			stopped := sec.stopped
+			sec.mu.Unlock()
+			if err != nil && !stopped && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Secondary::Serve(): WARNING: Replication from %q failed; Details: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+//dropConn closes the current connection, if any, and waits for its records to
+// stop being applied
+func (sec *Secondary) dropConn() {
+	sec.mu.Lock()
+	conn, done := sec.conn, sec.connDone
+	sec.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+		<-done
+	}
+}
+
+//handle negotiates with a primary and applies the frames it sends until the
+// connection fails
+func (sec *Secondary) handle(conn net.Conn) error {
+	defer conn.Close()
+	rdr, wtr := bufio.NewReaderSize(conn, 256*1024), bufio.NewWriterSize(conn, 4096)
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	magic := make([]byte, len(protoMagic))
+	if _, err := io.ReadFull(rdr, magic); err != nil {
+		return err
+	} else if string(magic) != protoMagic {
+		return fmt.Errorf("Connection is not from a replication primary")
+	}
+	var hi hello
+	if err := readMsg(rdr, &hi); err != nil {
+		return fmt.Errorf("Could not read hello: %w", err)
+	}
+
+	sec.mu.Lock()
+	reply := helloReply{ReplicationID: sec.state.ReplicationID, DurableSeq: sec.state.DurableSeq, Resyncing: sec.state.Resyncing}
+	switch {
+	case sec.state.ReplicationID != "" && sec.state.ReplicationID != hi.ReplicationID:
+		reply.Error = fmt.Sprintf("secondary is a replica of %s, not %s", sec.state.ReplicationID, hi.ReplicationID)
+	case hi.DeviceBytes > sec.dev.Size():
+		reply.Error = fmt.Sprintf("device of %d bytes is smaller than the primary of %d bytes", sec.dev.Size(), hi.DeviceBytes)
+	}
+	sec.applied = sec.state.DurableSeq
+	sec.mu.Unlock()
+
+	err := writeMsg(wtr, &reply)
+	if err == nil {
+		err = wtr.Flush()
+	}
+	switch {
+	case err != nil:
+		return fmt.Errorf("Could not reply to hello: %w", err)
+	case reply.Error != "":
+		return fmt.Errorf("Refused primary: %s", reply.Error)
+	}
+	conn.SetDeadline(time.Time{})
+
+	var (
+		buf     []byte
+		lastAck ack
+	)
+	for {
+		fr, err := readFrame(rdr, buf)
+		if err != nil {
+			return err
+		}
+		if fr.data != nil {
+			buf = fr.data
+		}
+		if err = sec.apply(fr, hi.ReplicationID); err != nil {
+			return err
+		}
+
+		//Acknowledge flushes, and progress once the frames received have been applied
+		if rdr.Buffered() == 0 || fr.typ == opFlush || fr.typ == frameResyncDone {
+			sec.mu.Lock()
+			cur := ack{applied: sec.applied, durable: sec.state.DurableSeq}
+			sec.mu.Unlock()
+			if cur != lastAck {
+				if err = writeAck(wtr, cur); err == nil {
+					err = wtr.Flush()
+				}
+				if err != nil {
+					return fmt.Errorf("Could not send acknowledgement: %w", err)
+				}
+				lastAck = cur
+			}
+		}
+	}
+}
+
+//apply applies a frame to the device
+func (sec *Secondary) apply(fr *frame, replicationID string) error {
+	switch fr.typ {
+	case opWrite, opTrim, opFlush:
+		sec.mu.Lock()
+		applied := sec.applied
+		sec.mu.Unlock()
+		switch {
+		case fr.seq <= applied:
+			return nil //Already applied before reconnecting
+		case fr.seq != applied+1:
+			return fmt.Errorf("Received %s %d after %d", fr.typ, fr.seq, applied)
+		}
+
+		var err error
+		switch fr.typ {
+		case opWrite:
+			_, err = sec.dev.WriteAt(fr.data, fr.pos)
+		case opTrim:
+			err = sec.dev.Trim(fr.pos, int(fr.length))
+		case opFlush:
+			err = sec.dev.Flush()
+		}
+		if err != nil {
+			return fmt.Errorf("Could not apply %s %d: %w", fr.typ, fr.seq, err)
+		}
+
+		sec.mu.Lock()
+		defer sec.mu.Unlock()
+		sec.applied = fr.seq
+		if fr.typ != opFlush {
+			return nil
+		}
+		sec.state.DurableSeq = fr.seq
+		if sec.state.ConsistentSeq != 0 && fr.seq >= sec.state.ConsistentSeq {
+			sec.state.ConsistentSeq = 0
+		}
+		return sec.persist()
+
+	case frameResyncStart:
+		sec.mu.Lock()
+		defer sec.mu.Unlock()
+		sec.state = secondaryState{ReplicationID: replicationID, Resyncing: true}
+		sec.applied = 0
+		return sec.persist()
+
+	case frameResyncData:
+		if _, err := sec.dev.WriteAt(fr.data, fr.pos); err != nil {
+			return fmt.Errorf("Could not apply resync data: %w", err)
+		}
+		return nil
+
+	case frameResyncZero:
+		//Avoid allocating zeros on thin or sparse devices that already hold them
+		buf := make([]byte, fr.length)
+		if _, err := sec.dev.ReadAt(buf, fr.pos); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("Could not read device for resync: %w", err)
+		}
+		if util.IsZeros(buf) {
+			return nil
+		}
+		util.ZeroFill(buf)
+		if _, err := sec.dev.WriteAt(buf, fr.pos); err != nil {
+			return fmt.Errorf("Could not apply resync zeros: %w", err)
+		}
+		return nil
+
+	case frameResyncDone:
+		if err := sec.dev.Flush(); err != nil {
+			return fmt.Errorf("Could not flush device after resync: %w", err)
+		}
+		sec.mu.Lock()
+		defer sec.mu.Unlock()
+		sec.state.Resyncing = false
+		sec.state.DurableSeq, sec.state.ConsistentSeq = fr.seq, uint64(fr.pos)+1
+		sec.applied = fr.seq
+		return sec.persist()
+	}
+	return fmt.Errorf("Received unknown frame type %d", fr.typ)
+}
+
+//stop stops serving primaries and waits for records to stop being applied
+func (sec *Secondary) stop() error {
+	sec.mu.Lock()
+	if sec.stopped {
+		sec.mu.Unlock()
+		return ErrPromoted
+	}
+	sec.stopped = true
+	for ln := range sec.listeners {
+		ln.Close()
+	}
+	sec.mu.Unlock()
+
+	sec.dropConn()
+	return nil
+}
+
+//Promote stops replication and returns the device for use, for example when
+// failing over from a primary that is lost. A secondary whose device is not
+// consistent is only promoted if force is set. After promotion the device is no
+// longer a replica; to replicate it back construct a Primary of it, and a
+// Secondary with a new state file for the former primary's device. The caller
+// owns the device returned.
+func (sec *Secondary) Promote(force bool) (usbdlib.Device, error) {
+	sec.mu.Lock()
+	consistent := sec.consistent()
+	sec.mu.Unlock()
+	if !consistent && !force {
+		return nil, ErrInconsistent
+	}
+	if err := sec.stop(); err != nil {
+		return nil, err
+	}
+
+	if err := sec.dev.Flush(); err != nil {
+		return nil, fmt.Errorf("Could not flush device: %w", err)
+	}
+	sec.mu.Lock()
+	defer sec.mu.Unlock()
+	sec.state.Promoted = true
+	if err := sec.persist(); err != nil {
+		return nil, err
+	}
+	return sec.dev, nil
+}
+
+//Close stops replication and closes the device
+func (sec *Secondary) Close() error {
+	if err := sec.stop(); err != nil {
+		return err
+	}
+	err := sec.dev.Flush()
+	if closeErr := sec.dev.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
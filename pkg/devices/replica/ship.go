@@ -0,0 +1,255 @@
+package replica
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/util"
+)
+
+//ship connects to the secondary and ships the write log to it until the primary
+// is closed, reconnecting with increasing delays when replication is interrupted
+func (pdev *Primary) ship() {
+	defer close(pdev.shipDone)
+
+	delay := pdev.reconnectDelay
+	for {
+		established, err := pdev.session()
+		if pdev.ctx.Err() != nil {
+			return
+		}
+
+		pdev.mu.Lock()
+		pdev.connected, pdev.resyncing, pdev.lastErr = false, false, err.Error()
+		pdev.mu.Unlock()
+		if established {
+			delay = pdev.reconnectDelay
+			log.Printf("Primary::ship(): WARNING: Replication to %s %q was interrupted; Details: %s", pdev.network, pdev.addr, err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-pdev.ctx.Done():
+			return
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+//session connects to the secondary, resyncs it if needed and ships records to it
+// until the connection fails or the primary is closed. It returns if the
+// connection was established.
+func (pdev *Primary) session() (bool, error) {
+	dialer := net.Dialer{Timeout: pdev.dialTimeout}
+	conn, err := dialer.DialContext(pdev.ctx, pdev.network, pdev.addr)
+	if err != nil {
+		return false, fmt.Errorf("Could not connect to secondary %s %q: %w", pdev.network, pdev.addr, err)
+	}
+	ctx, cancel := context.WithCancel(pdev.ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	rdr, wtr := bufio.NewReaderSize(conn, 64*1024), bufio.NewWriterSize(conn, 256*1024)
+	conn.SetDeadline(time.Now().Add(pdev.dialTimeout))
+	wtr.WriteString(protoMagic)
+	err = writeMsg(wtr, hello{ReplicationID: pdev.state.ReplicationID, DeviceBytes: pdev.size})
+	if err == nil {
+		err = wtr.Flush()
+	}
+	var reply helloReply
+	if err == nil {
+		err = readMsg(rdr, &reply)
+	}
+	switch {
+	case err != nil:
+		return false, fmt.Errorf("Could not negotiate with secondary %q: %w", pdev.addr, err)
+	case reply.Error != "":
+		return false, fmt.Errorf("Secondary %q refused replication: %s", pdev.addr, reply.Error)
+	}
+	conn.SetDeadline(time.Time{})
+
+	pdev.mu.Lock()
+	resync := pdev.state.ResyncNeeded || reply.Resyncing || reply.ReplicationID != pdev.state.ReplicationID ||
+		reply.DurableSeq+1 < pdev.wl.firstSeq() || reply.DurableSeq > pdev.wl.lastSeq()
+	resyncGen := pdev.resyncGen
+	pdev.connected, pdev.lastErr = true, ""
+	pdev.applied, pdev.durable = reply.DurableSeq, reply.DurableSeq
+	pdev.mu.Unlock()
+
+	ackErr := make(chan error, 1)
+	go func() {
+		ackErr <- pdev.readAcks(rdr)
+		cancel()
+	}()
+	sessionErr := func(err error) error {
+		select {
+		case ackErr := <-ackErr:
+			if ackErr != nil {
+				return ackErr
+			}
+		default:
+		}
+		return err
+	}
+
+	next := reply.DurableSeq + 1
+	if resync {
+		after, err := pdev.resync(ctx, wtr, resyncGen)
+		if err != nil {
+			return true, sessionErr(err)
+		}
+		next = after + 1
+	}
+
+	lr := pdev.wl.reader(next)
+	defer lr.close()
+	for {
+		rec, err := lr.next(ctx, wtr.Flush)
+		if err != nil {
+			return true, sessionErr(err)
+		}
+		fr := frame{typ: rec.op, seq: rec.seq, pos: rec.pos, length: rec.length, data: rec.data}
+		if err = writeFrame(wtr, &fr); err != nil {
+			return true, sessionErr(fmt.Errorf("Could not send %s %d to secondary: %w", rec.op, rec.seq, err))
+		}
+	}
+}
+
+//resync copies the entire device to the secondary and returns the sequence
+// number the copy started after; the secondary must then apply the records after
+// it. Each region is read while holding its lock, so the copy of every region
+// includes exactly the writes to it logged before it was read.
+func (pdev *Primary) resync(ctx context.Context, wtr *bufio.Writer, resyncGen uint64) (uint64, error) {
+	pdev.mu.Lock()
+	pdev.resyncing, pdev.resyncBytes = true, 0
+	pdev.mu.Unlock()
+	defer func() {
+		pdev.mu.Lock()
+		pdev.resyncing = false
+		pdev.mu.Unlock()
+	}()
+
+	after := pdev.wl.lastSeq()
+	if err := writeFrame(wtr, &frame{typ: frameResyncStart, seq: after}); err != nil {
+		return 0, fmt.Errorf("Could not start resync: %w", err)
+	}
+
+	buf := make([]byte, resyncChunkBytes)
+	for pos := int64(0); pos < pdev.size; pos += resyncChunkBytes {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		chunk := buf
+		if remaining := pdev.size - pos; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+
+		unlock := pdev.lockRange(pos, int64(len(chunk)))
+		_, err := pdev.dev.ReadAt(chunk, pos)
+		unlock()
+		if err != nil {
+			return 0, fmt.Errorf("Could not read device for resync: %w", err)
+		}
+
+		fr := frame{typ: frameResyncData, pos: pos, length: int64(len(chunk)), data: chunk}
+		if util.IsZeros(chunk) {
+			fr.typ, fr.data = frameResyncZero, nil
+		}
+		if err = writeFrame(wtr, &fr); err != nil {
+			return 0, fmt.Errorf("Could not send resync data: %w", err)
+		}
+		pdev.mu.Lock()
+		pdev.resyncBytes += int64(len(chunk))
+		pdev.mu.Unlock()
+	}
+
+	//The secondary is consistent once it applies a flush logged after the copy
+	ended := pdev.wl.lastSeq()
+	pdev.log(opFlush, 0, 0, nil)
+	if err := writeFrame(wtr, &frame{typ: frameResyncDone, seq: after, pos: int64(ended)}); err != nil {
+		return 0, fmt.Errorf("Could not complete resync: %w", err)
+	}
+	if err := wtr.Flush(); err != nil {
+		return 0, fmt.Errorf("Could not complete resync: %w", err)
+	}
+
+	//Once the secondary acknowledges the resync the log has every record it needs,
+	// unless it was discarded again during the resync
+	if err := pdev.waitAck(ctx, after); err != nil {
+		return 0, err
+	}
+	pdev.mu.Lock()
+	cleared := pdev.resyncGen == resyncGen
+	if cleared {
+		pdev.state.ResyncNeeded = false
+	}
+	pdev.mu.Unlock()
+	if cleared {
+		if err := pdev.persist(); err != nil {
+			return 0, err
+		}
+	}
+	return after, nil
+}
+
+//waitAck waits for the secondary to acknowledge the provided record is durable
+func (pdev *Primary) waitAck(ctx context.Context, seq uint64) error {
+	for {
+		pdev.mu.Lock()
+		if pdev.durable >= seq {
+			pdev.mu.Unlock()
+			return nil
+		}
+		acked := pdev.acked
+		pdev.mu.Unlock()
+
+		select {
+		case <-acked:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//readAcks processes acknowledgements from the secondary until the connection fails
+func (pdev *Primary) readAcks(rdr *bufio.Reader) error {
+	for {
+		a, err := readAck(rdr)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("Could not read acknowledgement from secondary: %w", err)
+		}
+		lastSeq := pdev.wl.lastSeq()
+
+		pdev.mu.Lock()
+		pdev.applied, pdev.durable = a.applied, a.durable
+		if a.applied >= lastSeq {
+			pdev.lagMarks, pdev.degraded = pdev.lagMarks[:0], false
+		} else {
+			marks := pdev.lagMarks
+			for len(marks) > 1 && marks[1].seq <= a.applied+1 {
+				marks = marks[1:]
+			}
+			pdev.lagMarks = marks
+		}
+		close(pdev.acked)
+		pdev.acked = make(chan struct{})
+		pdev.mu.Unlock()
+
+		if err = pdev.wl.discardThrough(a.durable); err != nil {
+			log.Printf("Primary::readAcks(): WARNING: Could not discard acknowledged records; Details: %s", err)
+		}
+	}
+}
@@ -0,0 +1,538 @@
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/crashsim"
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const (
+	crashSectorBytes = crashsim.SectorBytes
+
+	//Environment variables instructing a test binary started by TestProcessKill to
+	// run a workload until it is killed
+	envCrashDir   = "USBD_CRASH_DIR"
+	envCrashSeed  = "USBD_CRASH_SEED"
+	envCrashRound = "USBD_CRASH_ROUND"
+)
+
+//CrashConfig configures a crash-consistency test, zero values are replaced with
+// defaults
+type CrashConfig struct {
+	//Rounds is the number of crashes, default 8
+	Rounds int
+	//Ops is the number of operations in each round's workload, default 256
+	Ops int
+	//BlockBytes is the granularity of the workload's writes, default 4096
+	BlockBytes int64
+	//DiskBytes is the size of the disk under the device for TestPowerLoss, default
+	// 16 MB
+	DiskBytes int64
+	//Seed decides the workload and crashes, default is the current time
+	Seed int64
+	//Modes are those TestPowerLoss crashes with, one is chosen at random for each
+	// round, default crashsim.CrashModes
+	Modes []crashsim.CrashMode
+}
+
+func (cfg CrashConfig) withDefaults() CrashConfig {
+	if cfg.Rounds < 1 {
+		cfg.Rounds = 8
+	}
+	if cfg.Ops < 1 {
+		cfg.Ops = 256
+	}
+	if cfg.BlockBytes < 1 {
+		cfg.BlockBytes = 4096
+	}
+	if cfg.DiskBytes < 1 {
+		cfg.DiskBytes = 16 * 1024 * 1024
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	if len(cfg.Modes) < 1 {
+		cfg.Modes = crashsim.CrashModes
+	}
+	return cfg
+}
+
+//OpenOnDisk opens the device under test of TestPowerLoss on the provided disk,
+// which is zero filled if create is true
+type OpenOnDisk func(disk usbdlib.Device, create bool) (usbdlib.Device, error)
+
+//OpenInDir opens the device under test of TestProcessKill, which keeps its state
+// in the provided directory, which is empty if create is true
+type OpenInDir func(dir string, create bool) (usbdlib.Device, error)
+
+//TestPowerLoss runs a random workload of writes and flushes against the device
+// opened on a disk wrapped by a crashsim.CrashSim, which loses power at a random
+// point, possibly part way through an operation of the device. The device is then
+// reopened and it is verified that all flushed data is intact and that data written
+// after the last flush is either present or the data it overwrote is. This repeats
+// for each round of the provided configuration.
+func TestPowerLoss(t *testing.T, cfg CrashConfig, open OpenOnDisk) {
+	t.Run("power-loss", func(t *testing.T) {
+		cfg := cfg.withDefaults()
+		t.Logf("Using seed %d", cfg.Seed)
+		rnd := rand.New(rand.NewSource(cfg.Seed))
+		diskPath := filepath.Join(t.TempDir(), "disk.bin")
+
+		var model *crashModel
+		for round := 0; round <= cfg.Rounds; round++ {
+			disk, err := filedisk.NewFileDisk(diskPath, cfg.DiskBytes)
+			if err != nil {
+				t.Fatalf("Could not open disk: %s", err)
+			}
+			sim := crashsim.NewCrashSim(disk, rnd.Int63())
+			dev, err := open(sim, round == 0)
+			if err != nil {
+				t.Fatalf("Could not open device after round %d: %s", round-1, err)
+			}
+
+			if round == 0 {
+				if err = dev.Flush(); err != nil { //Creating the device must be durable
+					t.Fatalf("Could not flush new device: %s", err)
+				}
+				model = newCrashModel(cfg.Seed, dev.Size(), cfg.BlockBytes)
+			} else if err = model.verify(dev); err != nil {
+				dev.Close()
+				t.Fatalf("After round %d: %s", round-1, err)
+			}
+			if round == cfg.Rounds {
+				if err = dev.Close(); err != nil {
+					t.Fatalf("Could not close device: %s", err)
+				}
+				break
+			}
+
+			mode := cfg.Modes[rnd.Intn(len(cfg.Modes))]
+			if err = sim.ArmCrash(1+rnd.Intn(2*cfg.Ops), mode); err != nil {
+				t.Fatalf("Could not arm crash: %s", err)
+			}
+			ops := crashWorkload(cfg.Seed, round, cfg.Ops, model.blocks)
+			lastStarted, lastFlushed, err := model.run(dev, round, ops, nil)
+			if err != nil && !sim.Crashed() {
+				t.Fatalf("Round %d operation %d failed without a crash: %s", round, lastStarted, err)
+			}
+			if !sim.Crashed() {
+				if _, err = sim.Crash(mode); err != nil {
+					t.Fatalf("Could not crash: %s", err)
+				}
+			}
+			dev.Close() //Fails as the disk has crashed but releases the device's resources
+
+			model.apply(round, ops, lastStarted, lastFlushed)
+			t.Logf("Round %d: Crashed with %s during operation %d of %d, last flushed at %d", round, mode, lastStarted, len(ops), lastFlushed)
+		}
+	})
+}
+
+//Partitions divides a device into the provided number of equally sized partitions
+// so a device stacked on several members can keep them all on the disk of
+// TestPowerLoss. The device is closed once all of its partitions are.
+func Partitions(dev usbdlib.Device, count int) []usbdlib.Device {
+	blockSize := dev.BlockSize()
+	size := dev.Size() / int64(count) / blockSize * blockSize
+	open := int32(count)
+	parts := make([]usbdlib.Device, count)
+	for i := range parts {
+		parts[i] = &partition{Device: dev, start: int64(i) * size, size: size, atomicOpen: &open}
+	}
+	return parts
+}
+
+//partition is a range of a device shared with other partitions
+type partition struct {
+	usbdlib.Device
+	start, size  int64
+	atomicClosed uint32
+	atomicOpen   *int32 //Partitions of the device left open
+}
+
+//Size of this device in bytes
+func (part *partition) Size() int64 {
+	return part.size
+}
+
+func (part *partition) checkRange(pos int64, count int) error {
+	switch {
+	case atomic.LoadUint32(&part.atomicClosed) == 1:
+		return fmt.Errorf("Partition is closed")
+	case pos < 0 || pos+int64(count) > part.size:
+		return fmt.Errorf("Range of %d bytes at %d is outside of the %d byte partition", count, pos, part.size)
+	}
+	return nil
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (part *partition) ReadAt(buf []byte, pos int64) (int, error) {
+	if err := part.checkRange(pos, len(buf)); err != nil {
+		return 0, err
+	}
+	return part.Device.ReadAt(buf, part.start+pos)
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (part *partition) WriteAt(buf []byte, pos int64) (int, error) {
+	if err := part.checkRange(pos, len(buf)); err != nil {
+		return 0, err
+	}
+	return part.Device.WriteAt(buf, part.start+pos)
+}
+
+//Trim fufills part of usbdlib.Device
+func (part *partition) Trim(pos int64, count int) error {
+	if err := part.checkRange(pos, count); err != nil {
+		return err
+	}
+	return part.Device.Trim(part.start+pos, count)
+}
+
+//Flush fufills part of usbdlib.Device, the whole device is flushed
+func (part *partition) Flush() error {
+	if err := part.checkRange(0, 0); err != nil {
+		return err
+	}
+	return part.Device.Flush()
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device, the device is closed
+// with its last open partition
+func (part *partition) Close() error {
+	if !atomic.CompareAndSwapUint32(&part.atomicClosed, 0, 1) {
+		return fmt.Errorf("Partition is already closed")
+	}
+	if atomic.AddInt32(part.atomicOpen, -1) == 0 {
+		return part.Device.Close()
+	}
+	return nil
+}
+
+//TestProcessKill runs a random workload of writes and flushes against the device in
+// a child process, a copy of the test binary, that is killed at a random point. The
+// device is then reopened and it is verified that all flushed data is intact and
+// that data written after the last flush is either present or the data it
+// overwrote is. This repeats for each round of the provided configuration. Unlike
+// TestPowerLoss data reaching the operating system survives, so this checks the
+// consistency of devices whose state is spread over several files when a crash
+// interrupts updating them.
+func TestProcessKill(t *testing.T, cfg CrashConfig, open OpenInDir) {
+	t.Run("process-kill", func(t *testing.T) {
+		if dir := os.Getenv(envCrashDir); dir != "" {
+			runCrashChild(t, cfg, open, dir)
+			return
+		}
+
+		cfg := cfg.withDefaults()
+		t.Logf("Using seed %d", cfg.Seed)
+		rnd := rand.New(rand.NewSource(cfg.Seed))
+		dir := t.TempDir()
+
+		var model *crashModel
+		for round := 0; round < cfg.Rounds; round++ {
+			lastStarted, lastFlushed := killCrashChild(t, cfg, dir, round, rnd.Intn(cfg.Ops))
+
+			dev, err := open(dir, false)
+			if err != nil {
+				t.Fatalf("Could not open device after round %d: %s", round, err)
+			}
+			if model == nil {
+				model = newCrashModel(cfg.Seed, dev.Size(), cfg.BlockBytes)
+			}
+			model.apply(round, crashWorkload(cfg.Seed, round, cfg.Ops, model.blocks), lastStarted, lastFlushed)
+			if err = model.verify(dev); err != nil {
+				dev.Close()
+				t.Fatalf("After round %d: %s", round, err)
+			}
+			if err = dev.Close(); err != nil {
+				t.Fatalf("Could not close device after round %d: %s", round, err)
+			}
+			t.Logf("Round %d: Killed during operation %d of %d, last flushed at %d", round, lastStarted, cfg.Ops, lastFlushed)
+		}
+	})
+}
+
+//killCrashChild runs a round of the workload in a child process, killing it once it
+// starts the provided operation, and returns the last operation it started and
+// flushed
+func killCrashChild(t *testing.T, cfg CrashConfig, dir string, round, killAt int) (lastStarted, lastFlushed int) {
+	t.Helper()
+
+	progressRdr, progressWtr, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Could not create pipe: %s", err)
+	}
+	defer progressRdr.Close()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(CreateContext(t), os.Args[0], "-test.run="+runPattern(t.Name()), "-test.count=1")
+	cmd.Env = append(os.Environ(),
+		envCrashDir+"="+dir,
+		envCrashSeed+"="+strconv.FormatInt(cfg.Seed, 10),
+		envCrashRound+"="+strconv.Itoa(round),
+	)
+	cmd.ExtraFiles = []*os.File{progressWtr}
+	cmd.Stdout, cmd.Stderr = &output, &output
+	err = cmd.Start()
+	progressWtr.Close()
+	if err != nil {
+		t.Fatalf("Could not start child process: %s", err)
+	}
+
+	lastStarted, lastFlushed = -1, -1
+	killed := false
+	lines := bufio.NewScanner(progressRdr)
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) == 2 {
+			idx, _ := strconv.Atoi(fields[1])
+			switch fields[0] {
+			case "started":
+				lastStarted = idx
+			case "flushed":
+				lastFlushed = idx
+			}
+		}
+		if !killed && (lastStarted >= killAt || fields[0] == "done") {
+			cmd.Process.Kill()
+			killed = true
+		}
+	}
+
+	if err = cmd.Wait(); !killed {
+		t.Fatalf("Child process of round %d exited before being killed (%v), output:\n%s", round, err, output.String())
+	}
+	return lastStarted, lastFlushed
+}
+
+//runCrashChild runs the workload of the round in the environment until the process
+// is killed, reporting its progress on file descriptor 3
+func runCrashChild(t *testing.T, cfg CrashConfig, open OpenInDir, dir string) {
+	seed, err := strconv.ParseInt(os.Getenv(envCrashSeed), 10, 64)
+	if err != nil {
+		t.Fatalf("Invalid seed: %s", err)
+	}
+	round, err := strconv.Atoi(os.Getenv(envCrashRound))
+	if err != nil {
+		t.Fatalf("Invalid round: %s", err)
+	}
+	cfg.Seed = seed
+	cfg = cfg.withDefaults()
+	progress := os.NewFile(3, "progress")
+
+	dev, err := open(dir, round == 0)
+	if err != nil {
+		t.Fatalf("Could not open device: %s", err)
+	}
+	if round == 0 {
+		if err = dev.Flush(); err != nil { //Creating the device must be durable
+			t.Fatalf("Could not flush new device: %s", err)
+		}
+	}
+
+	model := newCrashModel(cfg.Seed, dev.Size(), cfg.BlockBytes)
+	if _, _, err = model.run(dev, round, crashWorkload(cfg.Seed, round, cfg.Ops, model.blocks), progress); err != nil {
+		t.Fatalf("Workload failed: %s", err)
+	}
+	fmt.Fprintln(progress, "done")
+	time.Sleep(time.Hour) //Wait to be killed without closing the device
+}
+
+func runPattern(testName string) string {
+	parts := strings.Split(testName, "/")
+	for i := range parts {
+		parts[i] = "^" + regexp.QuoteMeta(parts[i]) + "$"
+	}
+	return strings.Join(parts, "/")
+}
+
+//crashVersion identifies the data written to a block by an operation of a round's
+// workload
+type crashVersion struct {
+	round, op int32
+}
+
+//zeroVersion is the version of data never written
+var zeroVersion = crashVersion{-1, -1}
+
+func (ver crashVersion) String() string {
+	if ver == zeroVersion {
+		return "zeros"
+	}
+	return fmt.Sprintf("round %d operation %d", ver.round, ver.op)
+}
+
+//crashOp is an operation of a workload, a flush or a write of one or more blocks
+type crashOp struct {
+	flush         bool
+	block, blocks int64
+}
+
+//crashWorkload generates the operations of a round
+func crashWorkload(seed int64, round, ops int, totalBlocks int64) []crashOp {
+	rnd := rand.New(rand.NewSource(seed + int64(round)*7919))
+	workload := make([]crashOp, ops)
+	for i := range workload {
+		if rnd.Intn(8) == 0 {
+			workload[i].flush = true
+			continue
+		}
+		workload[i].block = rnd.Int63n(totalBlocks)
+		workload[i].blocks = 1 + rnd.Int63n(4)
+		if over := workload[i].block + workload[i].blocks - totalBlocks; over > 0 {
+			workload[i].blocks -= over
+		}
+	}
+	return workload
+}
+
+//crashModel tracks the data a device may hold after a crash
+type crashModel struct {
+	seed               int64
+	blockBytes, blocks int64
+	sectorsPerBlock    int64
+	sectors            []crashVersion   //Durable version of each sector
+	pending            [][]crashVersion //Versions written to each block since it was durable
+}
+
+func newCrashModel(seed, sizeBytes, blockBytes int64) *crashModel {
+	blocks := sizeBytes / blockBytes
+	model := &crashModel{
+		seed:            seed,
+		blockBytes:      blockBytes,
+		blocks:          blocks,
+		sectorsPerBlock: blockBytes / crashSectorBytes,
+		pending:         make([][]crashVersion, blocks),
+	}
+	model.sectors = make([]crashVersion, blocks*model.sectorsPerBlock)
+	for i := range model.sectors {
+		model.sectors[i] = zeroVersion
+	}
+	return model
+}
+
+//data returns the data of a block written by the provided version
+func (model *crashModel) data(ver crashVersion, block int64) []byte {
+	buf := make([]byte, model.blockBytes)
+	if ver == zeroVersion {
+		return buf
+	}
+
+	//SplitMix64 keyed by the version and block
+	state := uint64(model.seed) ^ uint64(ver.round)<<48 ^ uint64(ver.op)<<32 ^ uint64(block)
+	for i := 0; i+8 <= len(buf); i += 8 {
+		state += 0x9E3779B97F4A7C15
+		z := state
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		binary.LittleEndian.PutUint64(buf[i:], z^(z>>31))
+	}
+	return buf
+}
+
+//run performs the operations of a round on the device until one fails, returning
+// the last operation started and the last flush to succeed. If progress is not nil
+// each operation is reported to it before it starts and each flush after it
+// succeeds.
+func (model *crashModel) run(dev usbdlib.Device, round int, ops []crashOp, progress io.Writer) (lastStarted, lastFlushed int, err error) {
+	lastStarted, lastFlushed = -1, -1
+	for i, op := range ops {
+		lastStarted = i
+		if progress != nil {
+			fmt.Fprintln(progress, "started", i)
+		}
+
+		if op.flush {
+			if err = dev.Flush(); err != nil {
+				return lastStarted, lastFlushed, fmt.Errorf("Flush failed: %w", err)
+			}
+			lastFlushed = i
+			if progress != nil {
+				fmt.Fprintln(progress, "flushed", i)
+			}
+			continue
+		}
+
+		buf := make([]byte, 0, op.blocks*model.blockBytes)
+		for block := op.block; block < op.block+op.blocks; block++ {
+			buf = append(buf, model.data(crashVersion{int32(round), int32(i)}, block)...)
+		}
+		if _, err = dev.WriteAt(buf, op.block*model.blockBytes); err != nil {
+			return lastStarted, lastFlushed, fmt.Errorf("Write of %d blocks at block %d failed: %w", op.blocks, op.block, err)
+		}
+	}
+	return lastStarted, lastFlushed, nil
+}
+
+//apply records the writes of a round up to the last operation started, those up to
+// the last flush are durable
+func (model *crashModel) apply(round int, ops []crashOp, lastStarted, lastFlushed int) {
+	for i := 0; i <= lastStarted && i < len(ops); i++ {
+		if ops[i].flush {
+			continue
+		}
+		ver := crashVersion{int32(round), int32(i)}
+		for block := ops[i].block; block < ops[i].block+ops[i].blocks; block++ {
+			if i > lastFlushed {
+				model.pending[block] = append(model.pending[block], ver)
+				continue
+			}
+			for sector := block * model.sectorsPerBlock; sector < (block+1)*model.sectorsPerBlock; sector++ {
+				model.sectors[sector] = ver
+			}
+		}
+	}
+}
+
+//verify checks each sector of the device holds its durable version or one written
+// since, which becomes its durable version
+func (model *crashModel) verify(dev usbdlib.Device) error {
+	buf := make([]byte, model.blockBytes)
+	for block := int64(0); block < model.blocks; block++ {
+		if _, err := dev.ReadAt(buf, block*model.blockBytes); err != nil {
+			return fmt.Errorf("Could not read block %d: %w", block, err)
+		}
+
+		datas := make(map[crashVersion][]byte)
+		for i := int64(0); i < model.sectorsPerBlock; i++ {
+			sector := block*model.sectorsPerBlock + i
+			actual := buf[i*crashSectorBytes : (i+1)*crashSectorBytes]
+			matched := false
+			for _, ver := range append([]crashVersion{model.sectors[sector]}, model.pending[block]...) {
+				data, cached := datas[ver]
+				if !cached {
+					data = model.data(ver, block)
+					datas[ver] = data
+				}
+				if bytes.Equal(actual, data[i*crashSectorBytes:(i+1)*crashSectorBytes]) {
+					model.sectors[sector], matched = ver, true
+					break
+				}
+			}
+			if !matched {
+				return fmt.Errorf("Sector at offset %d holds data that was never written or was lost after being flushed, expected %s or one of %v", sector*crashSectorBytes, model.sectors[sector], model.pending[block])
+			}
+		}
+		model.pending[block] = nil
+	}
+	return nil
+}
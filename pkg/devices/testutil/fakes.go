@@ -0,0 +1,111 @@
+package testutil
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+//Switch turns a fault injected by a test fake on or off, it is safe for
+// concurrent use
+type Switch struct {
+	atomicOn uint32
+}
+
+//Set turns the switch on or off
+func (sw *Switch) Set(on bool) {
+	val := uint32(0)
+	if on {
+		val = 1
+	}
+	atomic.StoreUint32(&sw.atomicOn, val)
+}
+
+//On returns if the switch is on
+func (sw *Switch) On() bool {
+	return atomic.LoadUint32(&sw.atomicOn) == 1
+}
+
+//FailingDevice wraps a device so tests can make it fail, silently drop writes or
+// respond slowly, as members of redundant devices do
+type FailingDevice struct {
+	usbdlib.Device
+	Failing     Switch        //Reads, writes and flushes fail while on
+	Dropping    Switch        //Writes succeed without being made while on
+	Delay       time.Duration //Added to every read, set before use
+	atomicReads uint64
+}
+
+//NewFailingDevice wraps the provided device, it does not fail until told to
+func NewFailingDevice(dev usbdlib.Device) *FailingDevice {
+	return &FailingDevice{Device: dev}
+}
+
+//Reads returns the number of reads requested of the device
+func (dev *FailingDevice) Reads() uint64 {
+	return atomic.LoadUint64(&dev.atomicReads)
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (dev *FailingDevice) ReadAt(buf []byte, pos int64) (int, error) {
+	atomic.AddUint64(&dev.atomicReads, 1)
+	time.Sleep(dev.Delay)
+	if dev.Failing.On() {
+		return 0, fmt.Errorf("Injected read failure")
+	}
+	return dev.Device.ReadAt(buf, pos)
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (dev *FailingDevice) WriteAt(buf []byte, pos int64) (int, error) {
+	switch {
+	case dev.Failing.On():
+		return 0, fmt.Errorf("Injected write failure")
+	case dev.Dropping.On():
+		return len(buf), nil
+	}
+	return dev.Device.WriteAt(buf, pos)
+}
+
+//Flush fufills part of usbdlib.Device
+func (dev *FailingDevice) Flush() error {
+	if dev.Failing.On() {
+		return fmt.Errorf("Injected flush failure")
+	}
+	return dev.Device.Flush()
+}
+
+//Unclosable wraps a device so closing it does nothing and it can be reopened, and
+// can fail all writes after a number of them to simulate a crash
+type Unclosable struct {
+	usbdlib.Device
+	atomicWritesLeft int64
+}
+
+//NewUnclosable wraps the provided device, it does not fail writes until told to
+func NewUnclosable(dev usbdlib.Device) *Unclosable {
+	return &Unclosable{Device: dev, atomicWritesLeft: math.MaxInt64}
+}
+
+//FailWritesAfter makes writes fail once the provided number more have been made,
+// math.MaxInt64 stops them failing
+func (dev *Unclosable) FailWritesAfter(writes int64) {
+	atomic.StoreInt64(&dev.atomicWritesLeft, writes)
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (dev *Unclosable) WriteAt(buf []byte, pos int64) (int, error) {
+	if atomic.AddInt64(&dev.atomicWritesLeft, -1) < 0 {
+		return 0, fmt.Errorf("Simulated crash")
+	}
+	return dev.Device.WriteAt(buf, pos)
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device, the wrapped device is
+// not closed
+func (dev *Unclosable) Close() error {
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"math/rand"
 	"testing"
 	"time"
 
@@ -230,6 +231,32 @@ func TestClose(t *testing.T, dev usbdlib.Device) {
 	})
 }
 
+//WriteRandom writes the provided number of random bytes generated from the seed
+// at the provided position of the device and returns them
+func WriteRandom(t *testing.T, dev usbdlib.Device, pos, count int64, seed int64) []byte {
+	t.Helper()
+
+	data := make([]byte, count)
+	rand.New(rand.NewSource(seed)).Read(data)
+	if _, err := dev.WriteAt(data, pos); err != nil {
+		t.Fatalf("Could not write %d bytes at %d: %s", count, pos, err)
+	}
+	return data
+}
+
+//ExpectContents verifies the device holds the expected bytes at the provided
+// position, desc describes them in failures
+func ExpectContents(t *testing.T, desc string, dev usbdlib.Device, pos int64, expected []byte) {
+	t.Helper()
+
+	actual := make([]byte, len(expected))
+	if n, err := dev.ReadAt(actual, pos); err != nil && !(err == io.EOF && n == len(actual)) {
+		t.Fatalf("Could not read %s: %s", desc, err)
+	} else if !bytes.Equal(actual, expected) {
+		t.Fatalf("Contents of %s were not as expected", desc)
+	}
+}
+
 func unbufCount(count uint) uint {
 	const ThreeMB = 3 * 1024 * 1024
 	unbufCount := count / 3
@@ -0,0 +1,122 @@
+package thinpool
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+//The mapping index is a Pebble database holding:
+//  superKey:                 the pool superblock
+//  volPrefix+<name>:         a volume record
+//  mapPrefix+<vol>+<chunk>:  the pool chunk backing a chunk of a volume
+// Volume IDs and chunk numbers in mapping keys are big-endian so that all chunks of
+// a volume are contiguous and ordered in the index.
+
+const (
+	superMagic = "USBDTHN1"
+	superBytes = len(superMagic) + 8 + 8 + 4
+	volBytes   = 8 + 8 + 8
+	mapKeyLen  = 1 + 8 + 8
+)
+
+var (
+	superKey  = []byte("\x00super")
+	volPrefix = []byte("v")
+	mapPrefix = []byte("m")
+)
+
+//superblock describes the layout of a pool's data device
+type superblock struct {
+	chunkBytes, chunkCount int64
+}
+
+func (sb superblock) marshal() []byte {
+	buf := make([]byte, superBytes)
+	copy(buf, superMagic)
+	binary.LittleEndian.PutUint64(buf[len(superMagic):], uint64(sb.chunkBytes))
+	binary.LittleEndian.PutUint64(buf[len(superMagic)+8:], uint64(sb.chunkCount))
+	binary.LittleEndian.PutUint32(buf[superBytes-4:], crc32.ChecksumIEEE(buf[:superBytes-4]))
+	return buf
+}
+
+func (sb *superblock) unmarshal(buf []byte) error {
+	switch {
+	case len(buf) != superBytes || string(buf[:len(superMagic)]) != superMagic:
+		return fmt.Errorf("Index is not that of a thin pool")
+	case crc32.ChecksumIEEE(buf[:superBytes-4]) != binary.LittleEndian.Uint32(buf[superBytes-4:]):
+		return fmt.Errorf("Thin pool superblock is corrupt (checksum mismatch)")
+	}
+	sb.chunkBytes = int64(binary.LittleEndian.Uint64(buf[len(superMagic):]))
+	sb.chunkCount = int64(binary.LittleEndian.Uint64(buf[len(superMagic)+8:]))
+	return nil
+}
+
+//volRecord is the persisted description of a volume
+type volRecord struct {
+	id                    uint64
+	sizeBytes, limitBytes int64
+}
+
+func volKey(name string) []byte {
+	return append(append([]byte(nil), volPrefix...), name...)
+}
+
+func (rec volRecord) marshal() []byte {
+	buf := make([]byte, volBytes)
+	binary.LittleEndian.PutUint64(buf, rec.id)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(rec.sizeBytes))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(rec.limitBytes))
+	return buf
+}
+
+func (rec *volRecord) unmarshal(buf []byte) error {
+	if len(buf) != volBytes {
+		return fmt.Errorf("Volume record is %d bytes rather than %d", len(buf), volBytes)
+	}
+	rec.id = binary.LittleEndian.Uint64(buf)
+	rec.sizeBytes = int64(binary.LittleEndian.Uint64(buf[8:]))
+	rec.limitBytes = int64(binary.LittleEndian.Uint64(buf[16:]))
+	return nil
+}
+
+//mapKey is the index key of a chunk of a volume
+type mapKey struct {
+	vol   uint64
+	chunk int64
+}
+
+func (key mapKey) marshal() []byte {
+	buf := make([]byte, mapKeyLen)
+	copy(buf, mapPrefix)
+	binary.BigEndian.PutUint64(buf[1:], key.vol)
+	binary.BigEndian.PutUint64(buf[9:], uint64(key.chunk))
+	return buf
+}
+
+func (key *mapKey) unmarshal(buf []byte) error {
+	if len(buf) != mapKeyLen {
+		return fmt.Errorf("Mapping key is %d bytes rather than %d", len(buf), mapKeyLen)
+	}
+	key.vol = binary.BigEndian.Uint64(buf[1:])
+	key.chunk = int64(binary.BigEndian.Uint64(buf[9:]))
+	return nil
+}
+
+//volMapBounds returns the range of index keys holding the mapping of a volume
+func volMapBounds(vol uint64) (lower, upper []byte) {
+	return mapKey{vol: vol}.marshal(), mapKey{vol: vol + 1}.marshal()
+}
+
+func marshalChunk(chunk int64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(chunk))
+	return buf
+}
+
+func unmarshalChunk(buf []byte) (int64, error) {
+	if len(buf) != 8 {
+		return 0, fmt.Errorf("Mapping value is %d bytes rather than 8", len(buf))
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
@@ -0,0 +1,39 @@
+package thinpool
+
+//Option is a thin pool option
+type Option interface {
+	apply(*Pool)
+}
+
+//OptChunkBytes instructs a new Pool to allocate space to volumes in chunks of this
+// many bytes; it must be a multiple of the data device's block size. It is ignored
+// when opening an existing pool, which retains the chunk size it was created with.
+type OptChunkBytes int64
+
+func (size OptChunkBytes) apply(pool *Pool) {
+	pool.chunkBytes = int64(size)
+}
+
+//OptCacheBytes instructs a Pool to use this much memory to cache its mapping index
+type OptCacheBytes int64
+
+func (size OptCacheBytes) apply(pool *Pool) {
+	pool.cacheBytes = int64(size)
+}
+
+//OptLowWaterBytes instructs a Pool to invoke its low watermark callback when its
+// free space falls below this many bytes
+type OptLowWaterBytes int64
+
+func (size OptLowWaterBytes) apply(pool *Pool) {
+	pool.lowWaterBytes = int64(size)
+}
+
+//OptLowWaterCallback instructs a Pool to invoke the provided function when its free
+// space falls below the low watermark. It is invoked once each time the watermark
+// is crossed, not again until free space has risen back above the watermark.
+type OptLowWaterCallback func(stats Stats)
+
+func (callback OptLowWaterCallback) apply(pool *Pool) {
+	pool.onLowWater = callback
+}
@@ -0,0 +1,611 @@
+package thinpool
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/bitmap"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+
+	"github.com/cockroachdb/pebble"
+)
+
+const (
+	errPoolClosed = consterr.ConstErr("Pool is shutdown")
+
+	//ErrPoolFull is returned by writes needing space when the pool has none left
+	ErrPoolFull = consterr.ConstErr("Thin pool has no free space")
+	//ErrVolumeLimit is returned by writes needing space when the volume has already
+	// been allocated as much space as its limit allows
+	ErrVolumeLimit = consterr.ConstErr("Volume has reached its allocation limit")
+	//ErrVolumeExists is returned when creating a volume whose name is in use
+	ErrVolumeExists = consterr.ConstErr("Volume already exists")
+	//ErrVolumeNotFound is returned when opening or deleting a non-existent volume
+	ErrVolumeNotFound = consterr.ConstErr("Volume does not exist")
+	//ErrVolumeBusy is returned when opening or deleting a volume that is open
+	ErrVolumeBusy = consterr.ConstErr("Volume is in use")
+
+	//DefChunkBytes is the default allocation unit of new pools
+	DefChunkBytes = 64 * 1024
+	//DefCacheBytes is the default amount of memory used to cache the mapping index
+	DefCacheBytes = 64 * 1024 * 1024
+
+	maxNameBytes = 255
+	unmapped     = -1
+)
+
+//Stats describes the space usage of a pool
+type Stats struct {
+	ChunkBytes     int64
+	TotalBytes     int64
+	FreeBytes      int64
+	AllocatedBytes int64
+	//ReleasingBytes have been trimmed from volumes and become free on the next flush
+	ReleasingBytes int64
+	//VirtualBytes is the sum of the sizes of all volumes, it may exceed TotalBytes
+	VirtualBytes int64
+	Volumes      int
+}
+
+//VolumeInfo describes a volume of a pool
+type VolumeInfo struct {
+	Name           string
+	SizeBytes      int64
+	LimitBytes     int64
+	AllocatedBytes int64
+	Open           bool
+}
+
+type volState struct {
+	volRecord
+	name      string
+	allocated int64
+	open      bool
+}
+
+//Pool is a thin provisioned storage pool carving a single data device into many
+// volumes. Space is allocated to volumes a chunk at a time on first write and
+// returned to the pool when trimmed. Which pool chunk backs each chunk of each
+// volume is kept in a Pebble index, changes to which are committed when the pool
+// (or any of its volumes) is flushed, after flushing the data device. Trimmed
+// chunks are not reused until then, so a crash never exposes the data of one
+// volume to another.
+type Pool struct {
+	data                   usbdlib.Device
+	db                     *pebble.DB
+	indexDir               string
+	chunkBytes, chunkCount int64
+	cacheBytes             int64
+	lowWaterBytes          int64
+	onLowWater             func(Stats)
+	atomicOnline           uint64
+	ioMu                   sync.RWMutex //Held exclusively to close
+	commitMu               sync.Mutex
+
+	mu                   sync.Mutex
+	used                 *bitmap.Bitmap //Chunks allocated or being released
+	freeCount, allocHint int64
+	volumes              map[string]*volState
+	nextID               uint64
+	pending, committing  map[mapKey]int64 //Uncommitted mapping changes
+	releasing            []int64
+	belowWater           bool
+}
+
+//NewPool opens the thin pool whose index is in the provided directory, or creates
+// a new pool spanning the provided data device if the directory holds no index.
+// The data device of an existing pool may have grown since it was created, in
+// which case the pool grows with it. The pool owns the data device and closes it
+// when closed.
+func NewPool(data usbdlib.Device, indexDir string, options ...Option) (*Pool, error) {
+	pool := &Pool{
+		data:         data,
+		indexDir:     indexDir,
+		chunkBytes:   DefChunkBytes,
+		cacheBytes:   DefCacheBytes,
+		atomicOnline: 1,
+		volumes:      make(map[string]*volState),
+		nextID:       1,
+		pending:      make(map[mapKey]int64),
+	}
+	for _, opt := range options {
+		opt.apply(pool)
+	}
+
+	db, err := pebble.Open(indexDir, &pebble.Options{Cache: pebble.NewCache(pool.cacheBytes)})
+	if err != nil {
+		return nil, fmt.Errorf("Could not open thin pool index %q: %w", indexDir, err)
+	}
+	pool.db = db
+
+	if err = pool.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+//load reads or creates the superblock and then loads the volumes and mapping
+func (pool *Pool) load() error {
+	var sb superblock
+	val, closer, err := pool.db.Get(superKey)
+	switch err {
+	case nil:
+		err = sb.unmarshal(val)
+		closer.Close()
+		if err != nil {
+			return fmt.Errorf("Could not load thin pool index %q: %w", pool.indexDir, err)
+		}
+		pool.chunkBytes = sb.chunkBytes
+	case pebble.ErrNotFound:
+		sb.chunkBytes = pool.chunkBytes
+	default:
+		return fmt.Errorf("Could not read thin pool superblock: %w", err)
+	}
+
+	blockBytes := pool.data.BlockSize()
+	switch {
+	case pool.chunkBytes < 1 || pool.chunkBytes%blockBytes != 0:
+		return fmt.Errorf("Chunk size %d is not a multiple of the data device block size %d", pool.chunkBytes, blockBytes)
+	case pool.data.Size()/pool.chunkBytes < 1:
+		return fmt.Errorf("Data device of %d bytes is smaller than a single %d byte chunk", pool.data.Size(), pool.chunkBytes)
+	case pool.data.Size()/pool.chunkBytes < sb.chunkCount:
+		return fmt.Errorf("Data device holds %d chunks but the pool was created with %d", pool.data.Size()/pool.chunkBytes, sb.chunkCount)
+	}
+	if pool.chunkCount = pool.data.Size() / pool.chunkBytes; pool.chunkCount != sb.chunkCount {
+		sb.chunkCount = pool.chunkCount
+		if err = pool.db.Set(superKey, sb.marshal(), pebble.Sync); err != nil {
+			return fmt.Errorf("Could not write thin pool superblock: %w", err)
+		}
+	}
+	pool.used = bitmap.New(pool.chunkCount)
+
+	if err = pool.loadVolumes(); err != nil {
+		return fmt.Errorf("Could not load thin pool volumes: %w", err)
+	}
+	if err = pool.loadMapping(); err != nil {
+		return fmt.Errorf("Could not load thin pool mapping: %w", err)
+	}
+	pool.freeCount = pool.chunkCount - pool.used.Count()
+	pool.belowWater = pool.freeCount*pool.chunkBytes < pool.lowWaterBytes
+	return nil
+}
+
+func (pool *Pool) loadVolumes() error {
+	iter := pool.db.NewIter(&pebble.IterOptions{LowerBound: volPrefix, UpperBound: []byte{volPrefix[0] + 1}})
+	for iter.First(); iter.Valid(); iter.Next() {
+		vs := &volState{name: string(iter.Key()[len(volPrefix):])}
+		if err := vs.unmarshal(iter.Value()); err != nil {
+			iter.Close()
+			return fmt.Errorf("Could not decode volume %q: %w", vs.name, err)
+		}
+		pool.volumes[vs.name] = vs
+		if vs.id >= pool.nextID {
+			pool.nextID = vs.id + 1
+		}
+	}
+	return iter.Close()
+}
+
+func (pool *Pool) loadMapping() error {
+	byID := make(map[uint64]*volState, len(pool.volumes))
+	for _, vs := range pool.volumes {
+		byID[vs.id] = vs
+	}
+
+	iter := pool.db.NewIter(&pebble.IterOptions{LowerBound: mapPrefix, UpperBound: []byte{mapPrefix[0] + 1}})
+	for iter.First(); iter.Valid(); iter.Next() {
+		var key mapKey
+		err := key.unmarshal(iter.Key())
+		var chunk int64
+		if err == nil {
+			chunk, err = unmarshalChunk(iter.Value())
+		}
+		vs := byID[key.vol]
+		switch {
+		case err != nil:
+		case vs == nil:
+			err = fmt.Errorf("Chunk %d is mapped to unknown volume %d", chunk, key.vol)
+		case chunk < 0 || chunk >= pool.chunkCount:
+			err = fmt.Errorf("Chunk %d of volume %q is mapped beyond the end of the pool (chunk %d)", key.chunk, vs.name, chunk)
+		case pool.used.Test(chunk):
+			err = fmt.Errorf("Chunk %d is mapped more than once", chunk)
+		}
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		pool.used.Set(chunk)
+		vs.allocated++
+	}
+	return iter.Close()
+}
+
+//ChunkBytes returns the allocation unit of the pool
+func (pool *Pool) ChunkBytes() int64 {
+	return pool.chunkBytes
+}
+
+//Stats returns the current space usage of the pool
+func (pool *Pool) Stats() Stats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.statsLocked()
+}
+
+func (pool *Pool) statsLocked() Stats {
+	stats := Stats{
+		ChunkBytes:     pool.chunkBytes,
+		TotalBytes:     pool.chunkCount * pool.chunkBytes,
+		FreeBytes:      pool.freeCount * pool.chunkBytes,
+		ReleasingBytes: int64(len(pool.releasing)) * pool.chunkBytes,
+		Volumes:        len(pool.volumes),
+	}
+	for _, vs := range pool.volumes {
+		stats.AllocatedBytes += vs.allocated * pool.chunkBytes
+		stats.VirtualBytes += vs.sizeBytes
+	}
+	return stats
+}
+
+//Volumes returns a description of every volume in the pool ordered by name
+func (pool *Pool) Volumes() []VolumeInfo {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	infos := make([]VolumeInfo, 0, len(pool.volumes))
+	for _, vs := range pool.volumes {
+		infos = append(infos, pool.infoLocked(vs))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (pool *Pool) infoLocked(vs *volState) VolumeInfo {
+	return VolumeInfo{
+		Name:           vs.name,
+		SizeBytes:      vs.sizeBytes,
+		LimitBytes:     vs.limitBytes,
+		AllocatedBytes: vs.allocated * pool.chunkBytes,
+		Open:           vs.open,
+	}
+}
+
+//CreateVolume creates a new volume of the provided size, which must be a multiple
+// of the data device block size. Volumes may in total be larger than the pool. If
+// limitBytes is positive the volume may not be allocated more than this much space.
+func (pool *Pool) CreateVolume(name string, sizeBytes, limitBytes int64) error {
+	if atomic.LoadUint64(&pool.atomicOnline) != 1 {
+		return errPoolClosed
+	}
+	switch blockBytes := pool.data.BlockSize(); {
+	case len(name) < 1 || len(name) > maxNameBytes:
+		return fmt.Errorf("Volume name %q must be between 1 and %d bytes", name, maxNameBytes)
+	case sizeBytes < 1 || sizeBytes%blockBytes != 0:
+		return fmt.Errorf("Volume size %d is not a positive multiple of the block size %d", sizeBytes, blockBytes)
+	case limitBytes < 0:
+		return fmt.Errorf("Volume allocation limit %d is negative", limitBytes)
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if _, exists := pool.volumes[name]; exists {
+		return fmt.Errorf("Could not create volume %q: %w", name, ErrVolumeExists)
+	}
+	vs := &volState{volRecord: volRecord{id: pool.nextID, sizeBytes: sizeBytes, limitBytes: limitBytes}, name: name}
+	if err := pool.db.Set(volKey(name), vs.marshal(), pebble.Sync); err != nil {
+		return fmt.Errorf("Could not persist volume %q: %w", name, err)
+	}
+	pool.nextID++
+	pool.volumes[name] = vs
+	return nil
+}
+
+//OpenVolume opens an existing volume for IO, a volume may only be opened once
+// until it is closed
+func (pool *Pool) OpenVolume(name string) (*Volume, error) {
+	if atomic.LoadUint64(&pool.atomicOnline) != 1 {
+		return nil, errPoolClosed
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	vs := pool.volumes[name]
+	switch {
+	case vs == nil:
+		return nil, fmt.Errorf("Could not open volume %q: %w", name, ErrVolumeNotFound)
+	case vs.open:
+		return nil, fmt.Errorf("Could not open volume %q: %w", name, ErrVolumeBusy)
+	}
+	vs.open = true
+	return newVolume(pool, vs), nil
+}
+
+//DeleteVolume deletes a volume, which must not be open, and returns its space to
+// the pool
+func (pool *Pool) DeleteVolume(name string) error {
+	if atomic.LoadUint64(&pool.atomicOnline) != 1 {
+		return errPoolClosed
+	}
+
+	pool.commitMu.Lock()
+	defer pool.commitMu.Unlock()
+
+	pool.mu.Lock()
+	vs := pool.volumes[name]
+	switch {
+	case vs == nil:
+		pool.mu.Unlock()
+		return fmt.Errorf("Could not delete volume %q: %w", name, ErrVolumeNotFound)
+	case vs.open:
+		pool.mu.Unlock()
+		return fmt.Errorf("Could not delete volume %q: %w", name, ErrVolumeBusy)
+	}
+	vs.open = true //Prevent opening while being deleted
+	pool.mu.Unlock()
+
+	chunks, err := pool.deleteVolume(vs)
+	pool.mu.Lock()
+	if err != nil {
+		vs.open = false
+		pool.mu.Unlock()
+		return fmt.Errorf("Could not delete volume %q: %w", name, err)
+	}
+	delete(pool.volumes, name)
+	pool.mu.Unlock()
+
+	pool.release(chunks)
+	return nil
+}
+
+//deleteVolume removes a volume and its mapping from the index returning the chunks
+// it occupied, the caller must hold commitMu
+func (pool *Pool) deleteVolume(vs *volState) ([]int64, error) {
+	if err := pool.commitLocked(); err != nil { //Any uncommitted changes of the volume
+		return nil, err
+	}
+
+	lower, upper := volMapBounds(vs.id)
+	var chunks []int64
+	iter := pool.db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	for iter.First(); iter.Valid(); iter.Next() {
+		chunk, err := unmarshalChunk(iter.Value())
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("Could not read mapping: %w", err)
+	}
+
+	batch := pool.db.NewBatch()
+	batch.DeleteRange(lower, upper, nil)
+	batch.Delete(volKey(vs.name), nil)
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return nil, fmt.Errorf("Could not remove volume from index: %w", err)
+	}
+	return chunks, nil
+}
+
+//lookup returns the pool chunk backing a chunk of a volume, if any
+func (pool *Pool) lookup(key mapKey) (int64, bool, error) {
+	pool.mu.Lock()
+	chunk, found := pool.pending[key]
+	if !found {
+		chunk, found = pool.committing[key]
+	}
+	pool.mu.Unlock()
+	if found {
+		return chunk, chunk != unmapped, nil
+	}
+
+	val, closer, err := pool.db.Get(key.marshal())
+	switch err {
+	case nil:
+		chunk, err = unmarshalChunk(val)
+		closer.Close()
+		if err != nil {
+			return 0, false, fmt.Errorf("Could not decode mapping of chunk %d of volume %d: %w", key.chunk, key.vol, err)
+		}
+		return chunk, true, nil
+	case pebble.ErrNotFound:
+		return 0, false, nil
+	}
+	return 0, false, fmt.Errorf("Could not read mapping of chunk %d of volume %d: %w", key.chunk, key.vol, err)
+}
+
+//allocate reserves a free chunk for a volume, if the pool is full but trimmed
+// chunks are awaiting release they are committed to free them
+func (pool *Pool) allocate(vs *volState) (int64, error) {
+	for committed := false; ; committed = true {
+		pool.mu.Lock()
+		if vs.limitBytes > 0 && (vs.allocated+1)*pool.chunkBytes > vs.limitBytes {
+			pool.mu.Unlock()
+			return 0, ErrVolumeLimit
+		}
+
+		chunk := pool.used.NextClear(pool.allocHint)
+		if chunk < 0 {
+			chunk = pool.used.NextClear(0)
+		}
+		if chunk < 0 {
+			canRelease := len(pool.releasing) > 0
+			pool.mu.Unlock()
+			if committed || !canRelease {
+				return 0, ErrPoolFull
+			}
+			if err := pool.commit(); err != nil {
+				return 0, fmt.Errorf("Could not release trimmed chunks: %w", err)
+			}
+			continue
+		}
+
+		pool.used.Set(chunk)
+		pool.freeCount--
+		vs.allocated++
+		if pool.allocHint = chunk + 1; pool.allocHint >= pool.chunkCount {
+			pool.allocHint = 0
+		}
+		stats, alert := pool.checkWaterLocked()
+		pool.mu.Unlock()
+
+		if alert {
+			pool.onLowWater(stats)
+		}
+		return chunk, nil
+	}
+}
+
+//unallocate returns a chunk allocated to a volume that was never mapped
+func (pool *Pool) unallocate(vs *volState, chunk int64) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.used.Clear(chunk)
+	pool.freeCount++
+	vs.allocated--
+	pool.checkWaterLocked()
+}
+
+//checkWaterLocked returns true (and the current stats) if free space has just
+// fallen below the low watermark, the caller must hold mu
+func (pool *Pool) checkWaterLocked() (Stats, bool) {
+	below := pool.freeCount*pool.chunkBytes < pool.lowWaterBytes
+	alert := below && !pool.belowWater && pool.onLowWater != nil
+	pool.belowWater = below
+	if !alert {
+		return Stats{}, false
+	}
+	return pool.statsLocked(), true
+}
+
+//mapChunk records that a chunk of a volume is backed by the provided pool chunk
+func (pool *Pool) mapChunk(key mapKey, chunk int64) {
+	pool.mu.Lock()
+	pool.pending[key] = chunk
+	pool.mu.Unlock()
+}
+
+//unmapChunk removes the pool chunk backing a chunk of a volume, the pool chunk is
+// released once this is committed
+func (pool *Pool) unmapChunk(vs *volState, key mapKey, chunk int64) {
+	pool.mu.Lock()
+	pool.pending[key] = unmapped
+	pool.releasing = append(pool.releasing, chunk)
+	vs.allocated--
+	pool.mu.Unlock()
+}
+
+//Flush flushes the data device and commits all changes to the mapping
+func (pool *Pool) Flush() error {
+	if atomic.LoadUint64(&pool.atomicOnline) != 1 {
+		return errPoolClosed
+	}
+	return pool.commit()
+}
+
+func (pool *Pool) commit() error {
+	pool.commitMu.Lock()
+	defer pool.commitMu.Unlock()
+	return pool.commitLocked()
+}
+
+//commitLocked flushes the data device, so all data written to newly mapped chunks
+// is durable, and then commits the mapping changes made before the flush. The
+// caller must hold commitMu.
+func (pool *Pool) commitLocked() error {
+	pool.mu.Lock()
+	changes, releasing := pool.pending, pool.releasing
+	pool.committing, pool.pending, pool.releasing = changes, make(map[mapKey]int64), nil
+	pool.mu.Unlock()
+
+	err := pool.data.Flush()
+	if err != nil {
+		err = fmt.Errorf("Could not flush data device: %w", err)
+	} else if len(changes) > 0 {
+		batch := pool.db.NewBatch()
+		for key, chunk := range changes {
+			if chunk == unmapped {
+				batch.Delete(key.marshal(), nil)
+			} else {
+				batch.Set(key.marshal(), marshalChunk(chunk), nil)
+			}
+		}
+		if err = batch.Commit(pebble.Sync); err != nil {
+			err = fmt.Errorf("Could not commit mapping changes: %w", err)
+		}
+	}
+
+	pool.mu.Lock()
+	if err != nil { //Retain the changes for the next commit unless superseded
+		for key, chunk := range changes {
+			if _, newer := pool.pending[key]; !newer {
+				pool.pending[key] = chunk
+			}
+		}
+		pool.releasing = append(releasing, pool.releasing...)
+	}
+	pool.committing = nil
+	pool.mu.Unlock()
+
+	if err == nil {
+		pool.release(releasing)
+	}
+	return err
+}
+
+//release returns chunks, which must no longer be mapped, to the pool
+func (pool *Pool) release(chunks []int64) {
+	if len(chunks) < 1 {
+		return
+	}
+	for _, chunk := range chunks {
+		if err := pool.data.Trim(chunk*pool.chunkBytes, int(pool.chunkBytes)); err != nil {
+			log.Printf("Pool::release(): WARNING: Could not trim chunk %d of data device; Details: %s", chunk, err)
+		}
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for _, chunk := range chunks {
+		pool.used.Clear(chunk)
+	}
+	pool.freeCount += int64(len(chunks))
+	pool.checkWaterLocked()
+}
+
+//closeVolume marks a volume as no longer open
+func (pool *Pool) closeVolume(vs *volState) {
+	pool.mu.Lock()
+	vs.open = false
+	pool.mu.Unlock()
+}
+
+//Close commits all changes and closes the index and data device. Any volumes
+// still open can no longer be used.
+func (pool *Pool) Close() error {
+	if !atomic.CompareAndSwapUint64(&pool.atomicOnline, 1, 0) {
+		return errPoolClosed
+	}
+
+	pool.ioMu.Lock() //Wait for outstanding IO
+	defer pool.ioMu.Unlock()
+
+	err := pool.commit()
+	if closeErr := pool.db.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("Could not close thin pool index: %w", closeErr)
+	}
+	if closeErr := pool.data.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("Could not close data device: %w", closeErr)
+	}
+	return err
+}
@@ -0,0 +1,313 @@
+package thinpool
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const chunkBytes = 64 * 1024
+
+func TestVolume(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	testutil.TestUserspace(t, createVolume(t, sizeBytes), sizeBytes)
+	testutil.TestNBD(t, createVolume(t, sizeBytes), sizeBytes)
+}
+
+func createPool(t *testing.T, data usbdlib.Device, indexDir string, options ...Option) *Pool {
+	t.Helper()
+
+	pool, err := NewPool(data, indexDir, append([]Option{OptChunkBytes(chunkBytes), OptCacheBytes(1024 * 1024)}, options...)...)
+	if err != nil {
+		t.Fatalf("Could not create thin pool: %s", err)
+	}
+	return pool
+}
+
+func createVolume(t *testing.T, sizeBytes int64) usbdlib.Device {
+	pool := createPool(t, ramdisk.NewRAMDisk(2*sizeBytes), t.TempDir())
+	t.Cleanup(func() { pool.Close() })
+
+	//Another volume sharing the pool
+	if err := pool.CreateVolume("other", sizeBytes, 0); err != nil {
+		t.Fatalf("Could not create volume: %s", err)
+	}
+	other := openVolume(t, pool, "other")
+	if _, err := other.WriteAt(bytes.Repeat([]byte{0xff}, 3*chunkBytes), chunkBytes/2); err != nil {
+		t.Fatalf("Could not write to other volume: %s", err)
+	}
+
+	if err := pool.CreateVolume("test", sizeBytes, 0); err != nil {
+		t.Fatalf("Could not create volume: %s", err)
+	}
+	return openVolume(t, pool, "test")
+}
+
+func openVolume(t *testing.T, pool *Pool, name string) *Volume {
+	t.Helper()
+
+	vol, err := pool.OpenVolume(name)
+	if err != nil {
+		t.Fatalf("Could not open volume %q: %s", name, err)
+	}
+	return vol
+}
+
+func expectFree(t *testing.T, pool *Pool, expectedChunks int64) {
+	t.Helper()
+
+	if stats := pool.Stats(); stats.FreeBytes != expectedChunks*chunkBytes {
+		t.Fatalf("Pool had %d free chunks rather than %d", stats.FreeBytes/chunkBytes, expectedChunks)
+	}
+}
+
+func TestThinProvisioning(t *testing.T) {
+	const poolChunks = 16
+
+	var alerts []Stats
+	pool := createPool(t, ramdisk.NewRAMDisk(poolChunks*chunkBytes), t.TempDir(),
+		OptLowWaterBytes(4*chunkBytes), OptLowWaterCallback(func(stats Stats) { alerts = append(alerts, stats) }),
+	)
+	defer pool.Close()
+
+	//Volumes may be larger than the pool in total
+	if err := pool.CreateVolume("a", 4*poolChunks*chunkBytes, 0); err != nil {
+		t.Fatalf("Could not create volume: %s", err)
+	}
+	if err := pool.CreateVolume("b", 2*poolChunks*chunkBytes, 4*chunkBytes); err != nil {
+		t.Fatalf("Could not create volume: %s", err)
+	}
+	if err := pool.CreateVolume("a", chunkBytes, 0); !errors.Is(err, ErrVolumeExists) {
+		t.Fatalf("Duplicate volume was created: %v", err)
+	}
+	if stats := pool.Stats(); stats.VirtualBytes != 6*poolChunks*chunkBytes || stats.Volumes != 2 {
+		t.Fatalf("Pool stats were not as expected: %+v", stats)
+	}
+	a, b := openVolume(t, pool, "a"), openVolume(t, pool, "b")
+	if _, err := pool.OpenVolume("a"); !errors.Is(err, ErrVolumeBusy) {
+		t.Fatalf("Volume was opened twice: %v", err)
+	}
+
+	//Space is only allocated as written, unaligned writes allocate every chunk touched
+	expectFree(t, pool, poolChunks)
+	dataA := testutil.WriteRandom(t, a, chunkBytes/2, 2*chunkBytes, 1)
+	expectFree(t, pool, poolChunks-3)
+	testutil.WriteRandom(t, a, chunkBytes, chunkBytes, 2) //Already allocated
+	expectFree(t, pool, poolChunks-3)
+	copy(dataA[chunkBytes/2:], make([]byte, chunkBytes)) //Overwritten below
+	if _, err := a.WriteAt(make([]byte, chunkBytes), chunkBytes); err != nil {
+		t.Fatalf("Could not write zeros: %s", err)
+	}
+	testutil.ExpectContents(t, "volume a", a, chunkBytes/2, dataA)
+	testutil.ExpectContents(t, "unwritten region", a, 8*chunkBytes, make([]byte, chunkBytes))
+
+	//Per volume limit
+	testutil.WriteRandom(t, b, 0, 4*chunkBytes, 3)
+	if _, err := b.WriteAt([]byte{1}, 10*chunkBytes); !errors.Is(err, ErrVolumeLimit) {
+		t.Fatalf("Write beyond volume limit did not fail as expected: %v", err)
+	}
+	if info := b.Info(); info.AllocatedBytes != 4*chunkBytes || info.LimitBytes != 4*chunkBytes {
+		t.Fatalf("Volume info was not as expected: %+v", info)
+	}
+	expectFree(t, pool, poolChunks-7)
+	if len(alerts) != 0 {
+		t.Fatalf("Low watermark alert was raised with %d bytes free", pool.Stats().FreeBytes)
+	}
+
+	//Low watermark and pool exhaustion
+	testutil.WriteRandom(t, a, 16*chunkBytes, 6*chunkBytes, 4)
+	if len(alerts) != 1 || alerts[0].FreeBytes != 3*chunkBytes {
+		t.Fatalf("Low watermark alerts were not as expected: %+v", alerts)
+	}
+	testutil.WriteRandom(t, a, 22*chunkBytes, 3*chunkBytes, 5)
+	if _, err := a.WriteAt([]byte{1}, 30*chunkBytes); !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("Write to full pool did not fail as expected: %v", err)
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("Low watermark alert was raised repeatedly: %+v", alerts)
+	}
+
+	//Trim returns whole chunks to the pool, they are freed when flushed or needed
+	if err := a.Trim(16*chunkBytes+1, 6*chunkBytes); err != nil {
+		t.Fatalf("Could not trim: %s", err)
+	}
+	if stats := pool.Stats(); stats.ReleasingBytes != 5*chunkBytes || stats.FreeBytes != 0 {
+		t.Fatalf("Pool stats after trim were not as expected: %+v", stats)
+	}
+	testutil.ExpectContents(t, "trimmed region", a, 17*chunkBytes, make([]byte, 5*chunkBytes))
+	if err := a.Flush(); err != nil {
+		t.Fatalf("Could not flush: %s", err)
+	}
+	expectFree(t, pool, 5)
+
+	//Rising above the watermark rearms the alert
+	if err := a.Trim(22*chunkBytes, 3*chunkBytes); err != nil {
+		t.Fatalf("Could not trim: %s", err)
+	}
+	testutil.WriteRandom(t, b, 0, chunkBytes, 6) //Does not need space
+	testutil.WriteRandom(t, a, 30*chunkBytes, 8*chunkBytes, 7)
+	expectFree(t, pool, 0)
+	if len(alerts) != 2 || alerts[1].FreeBytes != 3*chunkBytes {
+		t.Fatalf("Low watermark alert was not raised again: %+v", alerts)
+	}
+
+	if err := a.Trim(0, int(a.Size())); err != nil {
+		t.Fatalf("Could not trim: %s", err)
+	}
+	if err := a.Flush(); err != nil {
+		t.Fatalf("Could not flush: %s", err)
+	}
+	expectFree(t, pool, poolChunks-4)
+	testutil.WriteRandom(t, a, 0, (poolChunks-6)*chunkBytes, 8)
+	if len(alerts) != 3 {
+		t.Fatalf("Low watermark alert was not raised again: %+v", alerts)
+	}
+
+	//Deletion
+	if err := pool.DeleteVolume("b"); !errors.Is(err, ErrVolumeBusy) {
+		t.Fatalf("Open volume was deleted: %v", err)
+	}
+	testutil.TestClose(t, b)
+	if err := pool.DeleteVolume("b"); err != nil {
+		t.Fatalf("Could not delete volume: %s", err)
+	}
+	expectFree(t, pool, 6)
+	if err := pool.DeleteVolume("b"); !errors.Is(err, ErrVolumeNotFound) {
+		t.Fatalf("Deleted volume was deleted again: %v", err)
+	}
+	if vols := pool.Volumes(); len(vols) != 1 || vols[0].Name != "a" || !vols[0].Open {
+		t.Fatalf("Volumes were not as expected: %+v", vols)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	const (
+		poolBytes = 64 * chunkBytes
+		volBytes  = 32 * chunkBytes
+	)
+	dir := t.TempDir()
+	dataFile, indexDir := filepath.Join(dir, "pool.bin"), filepath.Join(dir, "index")
+	openPool := func() *Pool {
+		data, err := filedisk.NewFileDisk(dataFile, poolBytes)
+		if err != nil {
+			t.Fatalf("Could not create file disk: %s", err)
+		}
+		return createPool(t, data, indexDir)
+	}
+
+	pool := openPool()
+	expected := make(map[string][]byte)
+	for i, name := range []string{"x", "y", "z"} {
+		if err := pool.CreateVolume(name, volBytes, 0); err != nil {
+			t.Fatalf("Could not create volume: %s", err)
+		}
+		vol := openVolume(t, pool, name)
+		expected[name] = make([]byte, volBytes)
+		for j := int64(0); j < 8; j++ {
+			pos := (j*4 + int64(i)) * chunkBytes / 2
+			copy(expected[name][pos:], testutil.WriteRandom(t, vol, pos, chunkBytes+100, int64(i*10)+j))
+		}
+		if err := vol.Trim(0, 2*chunkBytes); err != nil {
+			t.Fatalf("Could not trim: %s", err)
+		}
+		copy(expected[name], make([]byte, 2*chunkBytes))
+		if i == 0 { //Left open, closing the pool commits its changes
+			continue
+		}
+		if err := vol.Close(); err != nil {
+			t.Fatalf("Could not close volume: %s", err)
+		}
+	}
+	stats := pool.Stats()
+	if err := pool.Close(); err != nil {
+		t.Fatalf("Could not close pool: %s", err)
+	}
+
+	pool = openPool()
+	if reopened := pool.Stats(); reopened != stats {
+		t.Fatalf("Reopened pool stats were %+v rather than %+v", reopened, stats)
+	}
+	for name, data := range expected {
+		vol := openVolume(t, pool, name)
+		testutil.ExpectContents(t, "volume "+name, vol, 0, data)
+		vol.Close()
+	}
+
+	if err := pool.DeleteVolume("y"); err != nil {
+		t.Fatalf("Could not delete volume: %s", err)
+	}
+	if err := pool.CreateVolume("w", volBytes, 0); err != nil {
+		t.Fatalf("Could not create volume: %s", err)
+	}
+	stats = pool.Stats()
+	if err := pool.Close(); err != nil {
+		t.Fatalf("Could not close pool: %s", err)
+	}
+
+	//Reopening with a larger data device grows the pool
+	if err := os.Truncate(dataFile, 2*poolBytes); err != nil {
+		t.Fatalf("Could not grow data file: %s", err)
+	}
+	data, err := filedisk.NewFileDisk(dataFile, 2*poolBytes)
+	if err != nil {
+		t.Fatalf("Could not create file disk: %s", err)
+	}
+	pool = createPool(t, data, indexDir, OptChunkBytes(2*chunkBytes))
+	defer pool.Close()
+	if reopened := pool.Stats(); reopened.TotalBytes != 2*poolBytes || reopened.FreeBytes != stats.FreeBytes+poolBytes {
+		t.Fatalf("Grown pool stats were %+v, previously %+v", reopened, stats)
+	}
+	if vols := pool.Volumes(); len(vols) != 3 || vols[0].Name != "w" || vols[0].AllocatedBytes != 0 || vols[1].Name != "x" || vols[2].Name != "z" {
+		t.Fatalf("Volumes were not as expected: %+v", vols)
+	}
+	vol := openVolume(t, pool, "w")
+	testutil.ExpectContents(t, "new volume", vol, 0, make([]byte, volBytes))
+	vol = openVolume(t, pool, "z")
+	testutil.ExpectContents(t, "volume z", vol, 0, expected["z"])
+}
+
+//poolVolume is a volume that closes its pool when it is closed
+type poolVolume struct {
+	*Volume
+	pool *Pool
+}
+
+func (vol poolVolume) Close() error {
+	err := vol.Volume.Close()
+	if closeErr := vol.pool.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func TestPowerLoss(t *testing.T) {
+	const volumeBytes = 8 * 1024 * 1024 //8 MB
+
+	indexDir := t.TempDir()
+	testutil.TestPowerLoss(t, testutil.CrashConfig{}, func(disk usbdlib.Device, create bool) (usbdlib.Device, error) {
+		pool, err := NewPool(disk, indexDir, OptChunkBytes(chunkBytes))
+		if err != nil {
+			return nil, err
+		}
+		if create {
+			if err = pool.CreateVolume("test", volumeBytes, 0); err != nil {
+				pool.Close()
+				return nil, err
+			}
+		}
+		vol, err := pool.OpenVolume("test")
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		return poolVolume{Volume: vol, pool: pool}, nil
+	})
+}
@@ -0,0 +1,259 @@
+package thinpool
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed = consterr.ConstErr("Device is shutdown")
+
+	lockStripes = 64
+)
+
+//Volume is a thin provisioned device whose space is allocated from a Pool as it
+// is written. Regions that have never been written (or have been trimmed) read
+// as zeros.
+type Volume struct {
+	pool         *Pool
+	state        *volState
+	size         int64
+	chunkLocks   [lockStripes]sync.RWMutex
+	ioMu         sync.RWMutex //Held exclusively to close
+	atomicOnline uint64
+}
+
+var _ usbdlib.Device = (*Volume)(nil)
+
+func newVolume(pool *Pool, vs *volState) *Volume {
+	return &Volume{pool: pool, state: vs, size: vs.sizeBytes, atomicOnline: 1}
+}
+
+//Name of the volume within its pool
+func (vol *Volume) Name() string {
+	return vol.state.name
+}
+
+//Info returns a description of the volume
+func (vol *Volume) Info() VolumeInfo {
+	vol.pool.mu.Lock()
+	defer vol.pool.mu.Unlock()
+	return vol.pool.infoLocked(vol.state)
+}
+
+//Size of this device in bytes
+func (vol *Volume) Size() int64 {
+	return vol.size
+}
+
+//BlockSize of this device is that of the pool's data device
+func (vol *Volume) BlockSize() int64 {
+	return vol.pool.data.BlockSize()
+}
+
+//begin checks the volume and pool are online and holds them so until end is called
+func (vol *Volume) begin() error {
+	if atomic.LoadUint64(&vol.atomicOnline) != 1 {
+		return errClosed
+	}
+	vol.ioMu.RLock()
+	vol.pool.ioMu.RLock()
+	if atomic.LoadUint64(&vol.pool.atomicOnline) != 1 {
+		vol.end()
+		return errPoolClosed
+	}
+	return nil
+}
+
+func (vol *Volume) end() {
+	vol.pool.ioMu.RUnlock()
+	vol.ioMu.RUnlock()
+}
+
+//eachChunk invokes the provided function for each chunk spanned by a range with
+// the chunk number, the offset within the chunk and the portion of the buffer
+func (vol *Volume) eachChunk(buf []byte, pos int64, fn func(chunk, offset int64, part []byte) error) (count int, err error) {
+	chunkBytes := vol.pool.chunkBytes
+	for count < len(buf) {
+		chunk, offset := (pos+int64(count))/chunkBytes, (pos+int64(count))%chunkBytes
+		n := len(buf) - count
+		if remaining := chunkBytes - offset; int64(n) > remaining {
+			n = int(remaining)
+		}
+		if err = fn(chunk, offset, buf[count:count+n]); err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (vol *Volume) ReadAt(buf []byte, pos int64) (count int, err error) {
+	if pos >= vol.size {
+		if atomic.LoadUint64(&vol.atomicOnline) != 1 {
+			return 0, errClosed
+		}
+		return 0, io.EOF
+	}
+	var eof error
+	if end := pos + int64(len(buf)); end > vol.size {
+		buf, eof = buf[:vol.size-pos], io.EOF
+	}
+
+	if err = vol.begin(); err != nil {
+		return 0, err
+	}
+	defer vol.end()
+
+	count, err = vol.eachChunk(buf, pos, vol.readChunk)
+	if err != nil {
+		return count, err
+	}
+	return count, eof
+}
+
+func (vol *Volume) readChunk(chunk, offset int64, part []byte) error {
+	lock := &vol.chunkLocks[chunk%lockStripes]
+	lock.RLock()
+	defer lock.RUnlock()
+
+	poolChunk, mapped, err := vol.pool.lookup(mapKey{vol: vol.state.id, chunk: chunk})
+	switch {
+	case err != nil:
+		return err
+	case !mapped:
+		util.ZeroFill(part)
+		return nil
+	}
+
+	pos := poolChunk*vol.pool.chunkBytes + offset
+	if n, err := vol.pool.data.ReadAt(part, pos); err != nil && !(err == io.EOF && n == len(part)) {
+		return fmt.Errorf("Could not read %d bytes at offset %d of data device: %w", len(part), pos, err)
+	}
+	return nil
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (vol *Volume) WriteAt(buf []byte, pos int64) (count int, err error) {
+	if pos+int64(len(buf)) > vol.size {
+		if atomic.LoadUint64(&vol.atomicOnline) != 1 {
+			return 0, errClosed
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	if err = vol.begin(); err != nil {
+		return 0, err
+	}
+	defer vol.end()
+
+	return vol.eachChunk(buf, pos, vol.writeChunk)
+}
+
+//writeChunk writes within a single chunk, allocating it from the pool on its first
+// write. Newly allocated chunks are written in full so that nothing previously
+// stored in them can be read through this volume.
+func (vol *Volume) writeChunk(chunk, offset int64, part []byte) error {
+	lock := &vol.chunkLocks[chunk%lockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	key := mapKey{vol: vol.state.id, chunk: chunk}
+	poolChunk, mapped, err := vol.pool.lookup(key)
+	if err != nil {
+		return err
+	}
+
+	if !mapped {
+		if poolChunk, err = vol.pool.allocate(vol.state); err != nil {
+			return fmt.Errorf("Could not allocate chunk %d of volume %q: %w", chunk, vol.state.name, err)
+		}
+		if int64(len(part)) != vol.pool.chunkBytes {
+			full := make([]byte, vol.pool.chunkBytes)
+			copy(full[offset:], part)
+			part, offset = full, 0
+		}
+	}
+
+	pos := poolChunk*vol.pool.chunkBytes + offset
+	if _, err = vol.pool.data.WriteAt(part, pos); err != nil {
+		if !mapped {
+			vol.pool.unallocate(vol.state, poolChunk)
+		}
+		return fmt.Errorf("Could not write %d bytes at offset %d of data device: %w", len(part), pos, err)
+	}
+	if !mapped {
+		vol.pool.mapChunk(key, poolChunk)
+	}
+	return nil
+}
+
+//Trim releases all chunks entirely within the provided range back to the pool,
+// they are available for reuse once the volume or pool is next flushed
+func (vol *Volume) Trim(pos int64, count int) error {
+	if err := vol.begin(); err != nil {
+		return err
+	}
+	defer vol.end()
+
+	chunkBytes := vol.pool.chunkBytes
+	first, last := (pos+chunkBytes-1)/chunkBytes, (pos+int64(count))/chunkBytes
+	if pos+int64(count) >= vol.size { //The final chunk may be short
+		last = (vol.size + chunkBytes - 1) / chunkBytes
+	}
+	for chunk := first; chunk < last; chunk++ {
+		if err := vol.trimChunk(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vol *Volume) trimChunk(chunk int64) error {
+	lock := &vol.chunkLocks[chunk%lockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	key := mapKey{vol: vol.state.id, chunk: chunk}
+	poolChunk, mapped, err := vol.pool.lookup(key)
+	if err == nil && mapped {
+		vol.pool.unmapChunk(vol.state, key, poolChunk)
+	}
+	return err
+}
+
+//Flush flushes the pool, committing the changes of all of its volumes
+func (vol *Volume) Flush() error {
+	if err := vol.begin(); err != nil {
+		return err
+	}
+	defer vol.end()
+
+	return vol.pool.commit()
+}
+
+//Close flushes the volume and allows it to be opened again or deleted; the pool is
+// not closed
+func (vol *Volume) Close() error {
+	if !atomic.CompareAndSwapUint64(&vol.atomicOnline, 1, 0) {
+		return errClosed
+	}
+
+	vol.ioMu.Lock() //Wait for outstanding IO
+	defer vol.ioMu.Unlock()
+	defer vol.pool.closeVolume(vol.state)
+
+	vol.pool.ioMu.RLock()
+	defer vol.pool.ioMu.RUnlock()
+	if atomic.LoadUint64(&vol.pool.atomicOnline) != 1 {
+		return nil //The pool committed all changes when it was closed
+	}
+	return vol.pool.commit()
+}
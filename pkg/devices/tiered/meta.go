@@ -0,0 +1,85 @@
+package tiered
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+const (
+	mapMagic      = "USBDTIR1"
+	mapHdrBytes   = len(mapMagic) + 8 + 8
+	mapEntryBytes = 8
+
+	slowBit = 1 << 62 //Set in persisted locations on the slow tier
+)
+
+//encodeMap serializes the extent map, the caller must hold mu. Locations are
+// persisted relative to their tier so that members may grow.
+func (dev *Tiered) encodeMap() []byte {
+	meta := make([]byte, mapHdrBytes+len(dev.locs)*mapEntryBytes+4)
+	copy(meta, mapMagic)
+	binary.LittleEndian.PutUint64(meta[len(mapMagic):], uint64(dev.extentBytes))
+	binary.LittleEndian.PutUint64(meta[len(mapMagic)+8:], uint64(dev.size))
+
+	rec := meta[mapHdrBytes:]
+	for _, loc := range dev.locs {
+		switch {
+		case loc == unmapped:
+		case loc >= dev.fastSlots:
+			loc = (loc - dev.fastSlots) | slowBit
+		}
+		binary.LittleEndian.PutUint64(rec, uint64(loc))
+		rec = rec[mapEntryBytes:]
+	}
+	binary.LittleEndian.PutUint32(rec, crc32.ChecksumIEEE(meta[:len(meta)-4]))
+	return meta
+}
+
+//loadMap restores the extent map from the map file if it exists
+func (dev *Tiered) loadMap() error {
+	meta, err := os.ReadFile(dev.mapFile)
+	switch {
+	case os.IsNotExist(err):
+		return nil //New device
+	case err != nil:
+		return fmt.Errorf("Could not read extent map file %q: %w", dev.mapFile, err)
+	}
+
+	switch expected := mapHdrBytes + len(dev.locs)*mapEntryBytes + 4; {
+	case len(meta) < mapHdrBytes || string(meta[:len(mapMagic)]) != mapMagic:
+		return fmt.Errorf("File %q is not an extent map", dev.mapFile)
+	case int64(binary.LittleEndian.Uint64(meta[len(mapMagic):])) != dev.extentBytes:
+		return fmt.Errorf("Extent map file %q has an extent size of %d rather than %d", dev.mapFile, binary.LittleEndian.Uint64(meta[len(mapMagic):]), dev.extentBytes)
+	case int64(binary.LittleEndian.Uint64(meta[len(mapMagic)+8:])) != dev.size:
+		return fmt.Errorf("Extent map file %q is for a device of %d bytes rather than %d", dev.mapFile, binary.LittleEndian.Uint64(meta[len(mapMagic)+8:]), dev.size)
+	case len(meta) != expected:
+		return fmt.Errorf("Extent map file %q is %d bytes; expected %d", dev.mapFile, len(meta), expected)
+	case crc32.ChecksumIEEE(meta[:len(meta)-4]) != binary.LittleEndian.Uint32(meta[len(meta)-4:]):
+		return fmt.Errorf("Extent map file %q is corrupt (checksum mismatch)", dev.mapFile)
+	}
+
+	rec := meta[mapHdrBytes:]
+	for ext := range dev.locs {
+		loc := int64(binary.LittleEndian.Uint64(rec))
+		rec = rec[mapEntryBytes:]
+		if loc == unmapped {
+			continue
+		}
+
+		slot, limit := loc&^slowBit, dev.fastSlots
+		if loc&slowBit != 0 {
+			slot, limit = dev.fastSlots+slot, dev.fastSlots+dev.slowSlots
+		}
+		switch {
+		case slot < 0 || slot >= limit:
+			return fmt.Errorf("Extent map file %q maps extent %d beyond the end of its tier", dev.mapFile, ext)
+		case dev.used.Test(slot):
+			return fmt.Errorf("Extent map file %q maps more than one extent to slot %d", dev.mapFile, slot)
+		}
+		dev.locs[ext] = slot
+		dev.used.Set(slot)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package tiered
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type extentHeat struct {
+	ext  int64
+	heat uint32
+}
+
+func (dev *Tiered) migrateLoop() {
+	defer close(dev.migrateDone)
+
+	ticker := time.NewTicker(dev.migrateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dev.migrateStop:
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := dev.rebalance(true); err != nil {
+			log.Printf("Tiered::migrateLoop(): WARNING: Could not rebalance tiers; Details: %s", err)
+		}
+	}
+}
+
+//Rebalance promotes extents that have become hot to the fast tier, demoting the
+// coldest extents from it to make room, and then decays the heat map. It returns
+// the number of extents migrated. Rebalancing is normally done periodically in the
+// background, this is not rate limited.
+func (dev *Tiered) Rebalance() (migrated int, err error) {
+	return dev.rebalance(false)
+}
+
+func (dev *Tiered) rebalance(limit bool) (migrated int, err error) {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+
+	dev.migrateMu.Lock()
+	defer dev.migrateMu.Unlock()
+	defer dev.decay()
+
+	hot, cold := dev.candidates()
+	for _, promote := range hot {
+		//Make room on the fast tier by demoting an extent that is much colder
+		if !dev.hasFree(TierFast) {
+			if len(cold) < 1 || cold[0].heat > promote.heat/2 {
+				break
+			}
+			if err = dev.migrate(cold[0].ext, TierSlow); err != nil {
+				return migrated, err
+			}
+			cold = cold[1:]
+			if migrated++; !dev.pace(limit) {
+				return migrated, nil
+			}
+		}
+
+		if err = dev.migrate(promote.ext, TierFast); err != nil {
+			return migrated, err
+		}
+		if migrated++; !dev.pace(limit) {
+			return migrated, nil
+		}
+	}
+	return migrated, nil
+}
+
+//candidates returns the extents on the slow tier hot enough to promote, hottest
+// first, and those on the fast tier, coldest first
+func (dev *Tiered) candidates() (hot, cold []extentHeat) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	for ext, slot := range dev.locs {
+		switch {
+		case slot == unmapped:
+		case slot < dev.fastSlots:
+			cold = append(cold, extentHeat{ext: int64(ext), heat: dev.heat[ext]})
+		case dev.heat[ext] >= dev.promoteHeat:
+			hot = append(hot, extentHeat{ext: int64(ext), heat: dev.heat[ext]})
+		}
+	}
+	sort.Slice(hot, func(i, j int) bool { return hot[i].heat > hot[j].heat })
+	sort.Slice(cold, func(i, j int) bool { return cold[i].heat < cold[j].heat })
+	return hot, cold
+}
+
+//hasFree returns if a tier has a free slot, or one that is being released
+func (dev *Tiered) hasFree(tier Tier) bool {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	first, end := dev.slotRange(tier)
+	if slot := dev.used.NextClear(first); slot >= 0 && slot < end {
+		return true
+	}
+	for _, slot := range dev.releasing {
+		if dev.tierOf(slot) == tier {
+			return true
+		}
+	}
+	return false
+}
+
+//pace sleeps to limit the migration rate if requested, returning false if
+// migration is being stopped
+func (dev *Tiered) pace(limit bool) bool {
+	if !limit || dev.migrateRate < 1 {
+		return true
+	}
+	select {
+	case <-dev.migrateStop:
+		return false
+	case <-time.After(time.Duration(dev.extentBytes * int64(time.Second) / dev.migrateRate)):
+		return true
+	}
+}
+
+//decay halves the heat of every extent so that heat reflects recent accesses
+func (dev *Tiered) decay() {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	for ext := range dev.heat {
+		dev.heat[ext] /= 2
+	}
+}
+
+//migrate moves an extent to the provided tier and persists the extent map so its
+// previous slot is released. The extent is locked during the copy.
+func (dev *Tiered) migrate(ext int64, tier Tier) error {
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	if err := dev.moveExtent(ext, tier); err != nil {
+		return err
+	}
+	return dev.persist()
+}
+
+func (dev *Tiered) moveExtent(ext int64, tier Tier) error {
+	lock := &dev.extentLocks[ext%lockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	dev.mu.Lock()
+	src := dev.locs[ext]
+	dev.mu.Unlock()
+	if src == unmapped || dev.tierOf(src) == tier { //Trimmed or already moved
+		return nil
+	}
+
+	dst, ok := dev.allocate(tier)
+	if !ok {
+		return fmt.Errorf("Could not migrate extent %d as the %s tier is full", ext, tier)
+	}
+	buf := make([]byte, dev.extentBytes)
+	srcMember, srcBase := dev.member(src)
+	if _, err := srcMember.ReadAt(buf, srcBase); err != nil {
+		dev.unallocate(dst)
+		return fmt.Errorf("Could not read extent %d from %s tier to migrate it: %w", ext, dev.tierOf(src), err)
+	}
+	dstMember, dstBase := dev.member(dst)
+	if _, err := dstMember.WriteAt(buf, dstBase); err != nil {
+		dev.unallocate(dst)
+		return fmt.Errorf("Could not write extent %d to %s tier to migrate it: %w", ext, tier, err)
+	}
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	dev.locs[ext] = dst
+	dev.releasing = append(dev.releasing, src)
+	if tier == TierFast {
+		dev.stats.PromotedBytes += dev.extentBytes
+	} else {
+		dev.stats.DemotedBytes += dev.extentBytes
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package tiered
+
+import "time"
+
+//Option is a tiered device option
+type Option interface {
+	apply(*Tiered)
+}
+
+//OptExtentBytes instructs a Tiered device to place and migrate data in extents of
+// this size; it must be a multiple of the block sizes of both members and match
+// that of any persisted extent map.
+type OptExtentBytes int64
+
+func (size OptExtentBytes) apply(dev *Tiered) {
+	dev.extentBytes = int64(size)
+}
+
+//OptSizeBytes instructs a Tiered device to present a device of this size rather
+// than the combined capacity of its members (less one extent kept free so extents
+// can always be swapped between tiers)
+type OptSizeBytes int64
+
+func (size OptSizeBytes) apply(dev *Tiered) {
+	dev.size = int64(size)
+}
+
+//OptMigrateInterval instructs a Tiered device to rebalance extents between its
+// tiers in the background at this interval, 0 disables background migration
+type OptMigrateInterval time.Duration
+
+func (interval OptMigrateInterval) apply(dev *Tiered) {
+	dev.migrateInterval = time.Duration(interval)
+}
+
+//OptMigrateRate instructs a Tiered device to limit background migration to this
+// many bytes per second. 0 is unlimited.
+type OptMigrateRate int64
+
+func (rate OptMigrateRate) apply(dev *Tiered) {
+	dev.migrateRate = int64(rate)
+}
+
+//OptPromoteHeat instructs a Tiered device to only promote extents to the fast tier
+// once they have been accessed this many times since heat last decayed (heat is
+// halved after each rebalance)
+type OptPromoteHeat uint32
+
+func (heat OptPromoteHeat) apply(dev *Tiered) {
+	dev.promoteHeat = uint32(heat)
+}
@@ -0,0 +1,515 @@
+package tiered
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/bitmap"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed = consterr.ConstErr("Device is shutdown")
+
+	//ErrNoSpace is returned when an extent is written for the first time and
+	// neither tier has a free slot for it
+	ErrNoSpace = consterr.ConstErr("No free space in either tier")
+
+	//DefExtentBytes is the default size of the extents data is placed in
+	DefExtentBytes = 1024 * 1024
+	//DefMigrateInterval is the default interval between background rebalances
+	DefMigrateInterval = time.Minute
+	//DefPromoteHeat is the default number of accesses after which an extent is hot
+	DefPromoteHeat = 4
+
+	unmapped    = -1
+	lockStripes = 64
+)
+
+//Tier identifies a member of a tiered device
+type Tier int
+
+const (
+	//TierFast is the fast (and typically small and expensive) member
+	TierFast Tier = iota
+	//TierSlow is the slow (and typically large and cheap) member
+	TierSlow
+)
+
+func (tier Tier) String() string {
+	switch tier {
+	case TierFast:
+		return "fast"
+	case TierSlow:
+		return "slow"
+	}
+	return "unknown"
+}
+
+//TierStats describes the usage of one tier of a tiered device
+type TierStats struct {
+	TotalBytes   int64
+	UsedBytes    int64
+	ReadBytes    int64
+	WrittenBytes int64
+}
+
+//Stats describes the usage of a tiered device and its migrations
+type Stats struct {
+	ExtentBytes   int64
+	Fast, Slow    TierStats
+	PromotedBytes int64
+	DemotedBytes  int64
+}
+
+//Tiered is a device spread across a fast and a slow member. Each extent of the
+// device is stored on one member, as recorded in an extent map persisted to a
+// file. Extents are first placed on the fast tier while it has space, accesses to
+// each extent are counted in a heat map and extents are periodically migrated in
+// the background so that the hottest extents occupy the fast tier.
+type Tiered struct {
+	fast, slow      usbdlib.Device
+	mapFile         string
+	size            int64
+	extentBytes     int64
+	migrateInterval time.Duration
+	migrateRate     int64
+	promoteHeat     uint32
+	extentLocks     [lockStripes]sync.RWMutex
+	ioMu            sync.RWMutex //Held exclusively to close
+	persistMu       sync.Mutex
+	migrateMu       sync.Mutex
+	atomicOnline    uint64
+	migrateStop     chan struct{}
+	migrateDone     chan struct{}
+
+	mu                   sync.Mutex
+	fastSlots, slowSlots int64
+	locs                 []int64 //Slot of each extent, fast slots precede slow ones
+	heat                 []uint32
+	used                 *bitmap.Bitmap
+	releasing            []int64
+	stats                Stats
+}
+
+var _ usbdlib.Device = (*Tiered)(nil)
+
+//NewTiered constructs a tiered device across the provided fast and slow members,
+// loading its extent map from the provided file if it exists. The device owns
+// both members and closes them when it is closed.
+func NewTiered(fast, slow usbdlib.Device, mapFile string, options ...Option) (*Tiered, error) {
+	dev := &Tiered{
+		fast:            fast,
+		slow:            slow,
+		mapFile:         mapFile,
+		extentBytes:     DefExtentBytes,
+		migrateInterval: DefMigrateInterval,
+		promoteHeat:     DefPromoteHeat,
+		atomicOnline:    1,
+		migrateStop:     make(chan struct{}),
+		migrateDone:     make(chan struct{}),
+	}
+	for _, opt := range options {
+		opt.apply(dev)
+	}
+
+	if dev.extentBytes < 1 || dev.extentBytes%fast.BlockSize() != 0 || dev.extentBytes%slow.BlockSize() != 0 {
+		return nil, fmt.Errorf("Extent size %d is not a multiple of the fast and slow member block sizes (%d and %d)", dev.extentBytes, fast.BlockSize(), slow.BlockSize())
+	}
+	dev.fastSlots, dev.slowSlots = fast.Size()/dev.extentBytes, slow.Size()/dev.extentBytes
+	capacity := (dev.fastSlots + dev.slowSlots - 1) * dev.extentBytes
+	switch {
+	case dev.size == 0:
+		dev.size = capacity
+	case dev.size < 0 || dev.size > capacity:
+		return nil, fmt.Errorf("Size of %d bytes is not between 0 and the %d bytes the members can hold (leaving one extent free)", dev.size, capacity)
+	}
+	if dev.size < 1 {
+		return nil, fmt.Errorf("Members of %d and %d bytes are too small to hold %d byte extents", fast.Size(), slow.Size(), dev.extentBytes)
+	}
+
+	extentCount := (dev.size + dev.extentBytes - 1) / dev.extentBytes
+	dev.locs, dev.heat = make([]int64, extentCount), make([]uint32, extentCount)
+	for ext := range dev.locs {
+		dev.locs[ext] = unmapped
+	}
+	dev.used = bitmap.New(dev.fastSlots + dev.slowSlots)
+	if err := dev.loadMap(); err != nil {
+		return nil, err
+	}
+	dev.stats.ExtentBytes = dev.extentBytes
+
+	if dev.migrateInterval > 0 {
+		go dev.migrateLoop()
+	} else {
+		close(dev.migrateDone)
+	}
+	return dev, nil
+}
+
+//Size of this device in bytes
+func (dev *Tiered) Size() int64 {
+	return dev.size
+}
+
+//BlockSize of this device is the larger of its members
+func (dev *Tiered) BlockSize() int64 {
+	blockSize := dev.fast.BlockSize()
+	if slowBlock := dev.slow.BlockSize(); slowBlock > blockSize {
+		blockSize = slowBlock
+	}
+	return blockSize
+}
+
+//Stats returns the usage of each tier and the volume of data migrated
+func (dev *Tiered) Stats() Stats {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	stats := dev.stats
+	stats.Fast.TotalBytes, stats.Slow.TotalBytes = dev.fastSlots*dev.extentBytes, dev.slowSlots*dev.extentBytes
+	for _, loc := range dev.locs {
+		switch {
+		case loc == unmapped:
+		case loc < dev.fastSlots:
+			stats.Fast.UsedBytes += dev.extentBytes
+		default:
+			stats.Slow.UsedBytes += dev.extentBytes
+		}
+	}
+	return stats
+}
+
+//Locate returns the tier holding the extent containing the provided offset, if
+// it has been written
+func (dev *Tiered) Locate(pos int64) (tier Tier, mapped bool) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	if pos < 0 || pos >= dev.size {
+		return 0, false
+	}
+	loc := dev.locs[pos/dev.extentBytes]
+	return dev.tierOf(loc), loc != unmapped
+}
+
+func (dev *Tiered) tierOf(slot int64) Tier {
+	if slot < dev.fastSlots {
+		return TierFast
+	}
+	return TierSlow
+}
+
+//slotRange returns the range of slots on a tier
+func (dev *Tiered) slotRange(tier Tier) (first, end int64) {
+	if tier == TierFast {
+		return 0, dev.fastSlots
+	}
+	return dev.fastSlots, dev.fastSlots + dev.slowSlots
+}
+
+//member returns the device and offset within it of a slot
+func (dev *Tiered) member(slot int64) (usbdlib.Device, int64) {
+	if slot < dev.fastSlots {
+		return dev.fast, slot * dev.extentBytes
+	}
+	return dev.slow, (slot - dev.fastSlots) * dev.extentBytes
+}
+
+func (dev *Tiered) tierStats(slot int64) *TierStats {
+	if slot < dev.fastSlots {
+		return &dev.stats.Fast
+	}
+	return &dev.stats.Slow
+}
+
+//eachExtent invokes the provided function for each extent spanned by a range with
+// the extent number, the offset within the extent and the portion of the buffer
+func (dev *Tiered) eachExtent(buf []byte, pos int64, fn func(ext, offset int64, part []byte) error) (count int, err error) {
+	for count < len(buf) {
+		ext, offset := (pos+int64(count))/dev.extentBytes, (pos+int64(count))%dev.extentBytes
+		n := len(buf) - count
+		if remaining := dev.extentBytes - offset; int64(n) > remaining {
+			n = int(remaining)
+		}
+		if err = fn(ext, offset, buf[count:count+n]); err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+//access returns the slot of an extent and records the access in the heat map
+func (dev *Tiered) access(ext int64, count int, write bool) int64 {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	if dev.heat[ext] < ^uint32(0) {
+		dev.heat[ext]++
+	}
+	slot := dev.locs[ext]
+	if slot != unmapped {
+		if stats := dev.tierStats(slot); write {
+			stats.WrittenBytes += int64(count)
+		} else {
+			stats.ReadBytes += int64(count)
+		}
+	}
+	return slot
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (dev *Tiered) ReadAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case pos >= dev.size:
+		return 0, io.EOF
+	}
+	var eof error
+	if end := pos + int64(len(buf)); end > dev.size {
+		buf, eof = buf[:dev.size-pos], io.EOF
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	count, err = dev.eachExtent(buf, pos, dev.readExtent)
+	if err != nil {
+		return count, err
+	}
+	return count, eof
+}
+
+func (dev *Tiered) readExtent(ext, offset int64, part []byte) error {
+	lock := &dev.extentLocks[ext%lockStripes]
+	lock.RLock()
+	defer lock.RUnlock()
+
+	slot := dev.access(ext, len(part), false)
+	if slot == unmapped {
+		util.ZeroFill(part)
+		return nil
+	}
+
+	member, base := dev.member(slot)
+	if n, err := member.ReadAt(part, base+offset); err != nil && !(err == io.EOF && n == len(part)) {
+		return fmt.Errorf("Could not read %d bytes of extent %d from %s tier: %w", len(part), ext, dev.tierOf(slot), err)
+	}
+	return nil
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device
+func (dev *Tiered) WriteAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case pos+int64(len(buf)) > dev.size:
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	return dev.eachExtent(buf, pos, dev.writeExtent)
+}
+
+//writeExtent writes within a single extent, placing it on the fast tier if it has
+// space (otherwise the slow tier) on its first write. Newly placed extents are
+// written in full so nothing previously stored in the slot can be read.
+func (dev *Tiered) writeExtent(ext, offset int64, part []byte) error {
+	lock := &dev.extentLocks[ext%lockStripes]
+	lock.Lock()
+	defer lock.Unlock()
+
+	slot := dev.access(ext, len(part), true)
+	placed := slot == unmapped
+	if placed {
+		var err error
+		if slot, err = dev.place(); err != nil {
+			return fmt.Errorf("Could not place extent %d: %w", ext, err)
+		}
+		if int64(len(part)) != dev.extentBytes {
+			full := make([]byte, dev.extentBytes)
+			copy(full[offset:], part)
+			part, offset = full, 0
+		}
+	}
+
+	member, base := dev.member(slot)
+	if _, err := member.WriteAt(part, base+offset); err != nil {
+		if placed {
+			dev.unallocate(slot)
+		}
+		return fmt.Errorf("Could not write %d bytes of extent %d to %s tier: %w", len(part), ext, dev.tierOf(slot), err)
+	}
+
+	if placed {
+		dev.mu.Lock()
+		dev.locs[ext] = slot
+		dev.tierStats(slot).WrittenBytes += int64(len(part))
+		dev.mu.Unlock()
+	}
+	return nil
+}
+
+//place allocates a slot for a new extent, preferring the fast tier
+func (dev *Tiered) place() (int64, error) {
+	if slot, ok := dev.allocate(TierFast); ok {
+		return slot, nil
+	}
+	if slot, ok := dev.allocate(TierSlow); ok {
+		return slot, nil
+	}
+	return 0, ErrNoSpace
+}
+
+//allocate a free slot on the provided tier. Released slots may only be reused once
+// the extent map no longer records them, so it is persisted if there are any when
+// the tier is full.
+func (dev *Tiered) allocate(tier Tier) (int64, bool) {
+	first, end := dev.slotRange(tier)
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	for persisted := false; ; persisted = true {
+		if slot := dev.used.NextClear(first); slot >= 0 && slot < end {
+			dev.used.Set(slot)
+			return slot, true
+		}
+
+		releasing := false
+		for _, slot := range dev.releasing {
+			releasing = releasing || dev.tierOf(slot) == tier
+		}
+		if persisted || !releasing {
+			return 0, false
+		}
+
+		dev.mu.Unlock()
+		err := dev.persist()
+		dev.mu.Lock()
+		if err != nil {
+			log.Printf("Tiered::allocate(): WARNING: Could not persist extent map to reuse released slots; Details: %s", err)
+			return 0, false
+		}
+	}
+}
+
+//unallocate returns a slot obtained from allocate that was never mapped
+func (dev *Tiered) unallocate(slot int64) {
+	dev.mu.Lock()
+	dev.used.Clear(slot)
+	dev.mu.Unlock()
+}
+
+//Trim releases all extents entirely within the provided range, their slots are
+// trimmed and available for reuse once the device is next flushed
+func (dev *Tiered) Trim(pos int64, count int) error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	first, last := (pos+dev.extentBytes-1)/dev.extentBytes, (pos+int64(count))/dev.extentBytes
+	if pos+int64(count) >= dev.size { //The final extent may be short
+		last = int64(len(dev.locs))
+	}
+	for ext := first; ext < last; ext++ {
+		lock := &dev.extentLocks[ext%lockStripes]
+		lock.Lock()
+		dev.mu.Lock()
+		if slot := dev.locs[ext]; slot != unmapped {
+			dev.locs[ext], dev.heat[ext] = unmapped, 0
+			dev.releasing = append(dev.releasing, slot)
+		}
+		dev.mu.Unlock()
+		lock.Unlock()
+	}
+	return nil
+}
+
+//Flush flushes both members and persists the extent map
+func (dev *Tiered) Flush() error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	return dev.persist()
+}
+
+//persist encodes the extent map, flushes both members so the data of all extents
+// it maps is durable, and then persists it. Slots released before the map was
+// encoded are then trimmed and become free.
+func (dev *Tiered) persist() error {
+	dev.persistMu.Lock()
+	defer dev.persistMu.Unlock()
+
+	dev.mu.Lock()
+	meta, releasing := dev.encodeMap(), dev.releasing
+	dev.releasing = nil
+	dev.mu.Unlock()
+
+	err := dev.fast.Flush()
+	if err != nil {
+		err = fmt.Errorf("Could not flush fast tier: %w", err)
+	} else if err = dev.slow.Flush(); err != nil {
+		err = fmt.Errorf("Could not flush slow tier: %w", err)
+	} else if err = util.WriteFileAtomic(dev.mapFile, meta, 0600); err != nil {
+		err = fmt.Errorf("Could not persist extent map: %w", err)
+	}
+	if err != nil {
+		dev.mu.Lock()
+		dev.releasing = append(dev.releasing, releasing...)
+		dev.mu.Unlock()
+		return err
+	}
+
+	for _, slot := range releasing {
+		member, base := dev.member(slot)
+		if err := member.Trim(base, int(dev.extentBytes)); err != nil {
+			log.Printf("Tiered::persist(): WARNING: Could not trim released slot of %s tier; Details: %s", dev.tierOf(slot), err)
+		}
+	}
+	dev.mu.Lock()
+	for _, slot := range releasing {
+		dev.used.Clear(slot)
+	}
+	dev.mu.Unlock()
+	return nil
+}
+
+//Close stops background migration, persists the extent map and closes both members
+func (dev *Tiered) Close() error {
+	if !atomic.CompareAndSwapUint64(&dev.atomicOnline, 1, 0) {
+		return errClosed
+	}
+
+	close(dev.migrateStop)
+	<-dev.migrateDone
+
+	dev.ioMu.Lock() //Wait for outstanding IO
+	defer dev.ioMu.Unlock()
+
+	err := dev.persist()
+	if closeErr := dev.fast.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("Could not close fast tier: %w", closeErr)
+	}
+	if closeErr := dev.slow.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("Could not close slow tier: %w", closeErr)
+	}
+	return err
+}
@@ -0,0 +1,175 @@
+package tiered
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const extentBytes = 64 * 1024
+
+func TestTiered(t *testing.T) {
+	const fastBytes, slowBytes = 4 * 1024 * 1024, 13 * 1024 * 1024
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	testutil.TestUserspace(t, createTiered(t, fastBytes, slowBytes, sizeBytes), sizeBytes)
+	testutil.TestNBD(t, createTiered(t, fastBytes, slowBytes, sizeBytes), sizeBytes)
+}
+
+//createTiered creates a tiered device on ramdisks that rebalances frequently so
+// migrations race with the IO being tested
+func createTiered(t *testing.T, fastBytes, slowBytes, sizeBytes int64) usbdlib.Device {
+	t.Helper()
+
+	dev, err := NewTiered(ramdisk.NewRAMDisk(fastBytes), ramdisk.NewRAMDisk(slowBytes), filepath.Join(t.TempDir(), "extents"),
+		OptExtentBytes(extentBytes), OptSizeBytes(sizeBytes), OptMigrateInterval(10*time.Millisecond), OptPromoteHeat(2))
+	if err != nil {
+		t.Fatalf("Could not create tiered device: %s", err)
+	}
+	return dev
+}
+
+func expectTier(t *testing.T, dev *Tiered, ext int64, expected Tier) {
+	t.Helper()
+
+	if tier, mapped := dev.Locate(ext * extentBytes); !mapped {
+		t.Fatalf("Extent %d was not mapped", ext)
+	} else if tier != expected {
+		t.Fatalf("Extent %d was on the %s tier rather than the %s tier", ext, tier, expected)
+	}
+}
+
+func rebalance(t *testing.T, dev *Tiered, expected int) {
+	t.Helper()
+
+	if migrated, err := dev.Rebalance(); err != nil {
+		t.Fatalf("Could not rebalance: %s", err)
+	} else if migrated != expected {
+		t.Fatalf("Rebalance migrated %d extents rather than %d", migrated, expected)
+	}
+}
+
+func TestMigration(t *testing.T) {
+	const fastExtents, slowExtents = 4, 12
+
+	dev, err := NewTiered(ramdisk.NewRAMDisk(fastExtents*extentBytes), ramdisk.NewRAMDisk(slowExtents*extentBytes), filepath.Join(t.TempDir(), "extents"),
+		OptExtentBytes(extentBytes), OptMigrateInterval(0), OptPromoteHeat(4))
+	if err != nil {
+		t.Fatalf("Could not create tiered device: %s", err)
+	}
+	if size := dev.Size(); size != (fastExtents+slowExtents-1)*extentBytes {
+		t.Fatalf("Size was %d rather than the capacity less one extent", size)
+	}
+
+	//The first extents written fill the fast tier
+	data := testutil.WriteRandom(t, dev, 0, dev.Size(), 1)
+	for ext := int64(0); ext < fastExtents+slowExtents-1; ext++ {
+		if ext < fastExtents {
+			expectTier(t, dev, ext, TierFast)
+		} else {
+			expectTier(t, dev, ext, TierSlow)
+		}
+	}
+	rebalance(t, dev, 0) //Nothing is hot enough
+
+	//Heat up extents on the slow tier, the cold fast extents are swapped out
+	buf := make([]byte, 512)
+	for i := 0; i < 8; i++ {
+		for _, ext := range []int64{9, 10, 11} {
+			if _, err = dev.ReadAt(buf, ext*extentBytes); err != nil {
+				t.Fatalf("Could not read extent %d: %s", ext, err)
+			}
+		}
+		if _, err = dev.ReadAt(buf, 0); err != nil {
+			t.Fatalf("Could not read extent 0: %s", err)
+		}
+	}
+	rebalance(t, dev, 6)
+	for _, ext := range []int64{0, 9, 10, 11} {
+		expectTier(t, dev, ext, TierFast)
+	}
+	for _, ext := range []int64{1, 2, 3} {
+		expectTier(t, dev, ext, TierSlow)
+	}
+	stats := dev.Stats()
+	switch {
+	case stats.PromotedBytes != 3*extentBytes || stats.DemotedBytes != 3*extentBytes:
+		t.Fatalf("%d bytes were promoted and %d demoted rather than %d of each", stats.PromotedBytes, stats.DemotedBytes, 3*extentBytes)
+	case stats.Fast.UsedBytes != fastExtents*extentBytes || stats.Slow.UsedBytes != (slowExtents-1)*extentBytes:
+		t.Fatalf("Tiers used %d and %d bytes rather than %d and %d", stats.Fast.UsedBytes, stats.Slow.UsedBytes, fastExtents*extentBytes, (slowExtents-1)*extentBytes)
+	case stats.Fast.TotalBytes != fastExtents*extentBytes || stats.Slow.TotalBytes != slowExtents*extentBytes:
+		t.Fatalf("Tiers had %d and %d bytes rather than %d and %d", stats.Fast.TotalBytes, stats.Slow.TotalBytes, fastExtents*extentBytes, slowExtents*extentBytes)
+	case stats.Slow.ReadBytes != 24*512 || stats.Fast.ReadBytes < 8*512:
+		t.Fatalf("Tiers had %d and %d bytes read", stats.Fast.ReadBytes, stats.Slow.ReadBytes)
+	}
+	testutil.ExpectContents(t, "migrated data", dev, 0, data)
+
+	//Heat decays so without further access nothing moves
+	rebalance(t, dev, 0)
+
+	//Trimmed extents are placed on the fast tier when rewritten if there is space
+	if err = dev.Trim(9*extentBytes, extentBytes); err != nil {
+		t.Fatalf("Could not trim: %s", err)
+	}
+	if _, mapped := dev.Locate(9 * extentBytes); mapped {
+		t.Fatalf("Trimmed extent was still mapped")
+	}
+	testutil.ExpectContents(t, "trimmed extent", dev, 9*extentBytes, make([]byte, extentBytes))
+	testutil.WriteRandom(t, dev, 9*extentBytes, 16, 2)
+	expectTier(t, dev, 9, TierFast)
+	testutil.TestClose(t, dev)
+}
+
+func TestPersistence(t *testing.T) {
+	const fastExtents, slowExtents = 4, 12
+
+	dir := t.TempDir()
+	open := func() *Tiered {
+		t.Helper()
+
+		fast, err := filedisk.NewFileDisk(filepath.Join(dir, "fast"), fastExtents*extentBytes)
+		if err != nil {
+			t.Fatalf("Could not open fast tier: %s", err)
+		}
+		slow, err := filedisk.NewFileDisk(filepath.Join(dir, "slow"), slowExtents*extentBytes)
+		if err != nil {
+			t.Fatalf("Could not open slow tier: %s", err)
+		}
+		dev, err := NewTiered(fast, slow, filepath.Join(dir, "extents"), OptExtentBytes(extentBytes), OptMigrateInterval(0), OptPromoteHeat(1))
+		if err != nil {
+			t.Fatalf("Could not open tiered device: %s", err)
+		}
+		return dev
+	}
+
+	dev := open()
+	data := testutil.WriteRandom(t, dev, extentBytes/2, 8*extentBytes, 3)
+	testutil.ExpectContents(t, "hot extent", dev, 8*extentBytes, data[len(data)-extentBytes/2:])
+	rebalance(t, dev, 2) //Extent 8 is swapped with the coldest fast extent
+	expectTier(t, dev, 8, TierFast)
+	testutil.TestClose(t, dev)
+
+	dev = open()
+	expectTier(t, dev, 8, TierFast)
+	for ext := int64(4); ext < 8; ext++ {
+		expectTier(t, dev, ext, TierSlow)
+	}
+	if _, mapped := dev.Locate(9 * extentBytes); mapped {
+		t.Fatalf("Unwritten extent was mapped after reopening")
+	}
+	testutil.ExpectContents(t, "reopened tiered device", dev, extentBytes/2, data)
+	testutil.TestClose(t, dev)
+}
+
+func TestPowerLoss(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "extents")
+	testutil.TestPowerLoss(t, testutil.CrashConfig{}, func(disk usbdlib.Device, create bool) (usbdlib.Device, error) {
+		parts := testutil.Partitions(disk, 2)
+		return NewTiered(parts[0], parts[1], mapFile, OptExtentBytes(extentBytes), OptMigrateInterval(10*time.Millisecond), OptPromoteHeat(2))
+	})
+}
@@ -0,0 +1,368 @@
+package timetravel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	//ErrCorrupt is returned when a version read from the undo log is damaged
+	ErrCorrupt = consterr.ConstErr("Undo log is corrupt")
+
+	logSuffix = ".log"
+	//Record header: checksum, sequence, time (unix nanoseconds), block, length
+	recHdrBytes = 4 + 8 + 8 + 8 + 4
+)
+
+//segment is a file of the undo log holding consecutive records
+type segment struct {
+	first, last uint64 //last is first-1 if the segment is empty
+	newest      int64  //Time of the last record
+	bytes       int64
+	f           *os.File
+}
+
+func (seg *segment) path(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seg.first, logSuffix))
+}
+
+//version is a record of the contents of a block before it was overwritten
+type version struct {
+	seq uint64
+	at  int64 //When it was overwritten, unix nanoseconds
+	seg *segment
+	off int64 //Of the record in the segment
+}
+
+//undoLog is an ordered, append-only log of the previous contents of blocks split
+// into segment files named by the sequence number of their first record. The
+// versions of each block are indexed in memory. Segments are deleted once they
+// only hold versions older than the retention window.
+type undoLog struct {
+	dir      string
+	segBytes int64
+
+	mu       sync.RWMutex
+	segs     []*segment //Oldest first, the last is being appended to
+	versions map[int64][]version
+	nextSeq  uint64
+	lastAt   int64
+	records  int64
+	bytes    int64
+}
+
+//openLog opens the undo log in the provided directory, creating it if needed. A
+// torn record at the end of the last segment, left by a crash, is truncated.
+func openLog(dir string, segBytes int64) (*undoLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Could not create undo log directory %q: %w", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list undo log directory %q: %w", dir, err)
+	}
+
+	ul := &undoLog{dir: dir, segBytes: segBytes, versions: make(map[int64][]version), nextSeq: 1}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), logSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), logSuffix), 10, 64)
+		if err != nil || first < 1 {
+			return nil, fmt.Errorf("Undo log directory %q has unexpected file %q", dir, entry.Name())
+		}
+		ul.segs = append(ul.segs, &segment{first: first, last: first - 1})
+	}
+	sort.Slice(ul.segs, func(i, j int) bool { return ul.segs[i].first < ul.segs[j].first })
+
+	for i, seg := range ul.segs {
+		if err = ul.scan(seg, i == len(ul.segs)-1); err != nil {
+			ul.close()
+			return nil, err
+		}
+		if i > 0 && seg.first != ul.segs[i-1].last+1 {
+			ul.close()
+			return nil, fmt.Errorf("Undo log segment %q does not follow the previous segment", seg.path(dir))
+		}
+		ul.nextSeq = seg.last + 1
+	}
+
+	if len(ul.segs) == 0 {
+		if err = ul.startSegment(); err != nil {
+			return nil, fmt.Errorf("Could not start undo log segment: %w", err)
+		}
+	}
+	return ul, nil
+}
+
+//scan indexes the records of a segment, validating the contents of those in the
+// last segment and truncating an invalid tail
+func (ul *undoLog) scan(seg *segment, last bool) error {
+	path := seg.path(ul.dir)
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not open undo log segment %q: %w", path, err)
+	}
+	seg.f = f //Closed by close
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Could not stat undo log segment %q: %w", path, err)
+	}
+
+	var hdr [recHdrBytes]byte
+	for {
+		seq, at, block, length, err := readHeader(f, seg.bytes, fi.Size(), hdr[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil && seq != seg.last+1 {
+			err = fmt.Errorf("record %d follows record %d", seq, seg.last)
+		}
+		if err == nil && last {
+			data := make([]byte, length)
+			if _, err = f.ReadAt(data, seg.bytes+recHdrBytes); err == nil && checksum(hdr[4:], data) != binary.BigEndian.Uint32(hdr[:]) {
+				err = fmt.Errorf("record %d checksum does not match", seq)
+			}
+		}
+		if err != nil {
+			if !last {
+				return fmt.Errorf("Undo log segment %q is corrupt: %w", path, err)
+			}
+			if err = f.Truncate(seg.bytes); err != nil {
+				return fmt.Errorf("Could not truncate torn undo log segment %q: %w", path, err)
+			}
+			return nil
+		}
+
+		ul.versions[block] = append(ul.versions[block], version{seq: seq, at: at, seg: seg, off: seg.bytes})
+		seg.last, seg.newest = seq, at
+		seg.bytes += recHdrBytes + int64(length)
+		ul.records++
+		ul.bytes += recHdrBytes + int64(length)
+		if at > ul.lastAt {
+			ul.lastAt = at
+		}
+	}
+}
+
+//readHeader reads and decodes the header of the record at the provided offset of
+// a segment of the provided size
+func readHeader(f *os.File, off, size int64, hdr []byte) (seq uint64, at, block int64, length uint32, err error) {
+	switch {
+	case off == size:
+		return 0, 0, 0, 0, io.EOF
+	case off+recHdrBytes > size:
+		return 0, 0, 0, 0, fmt.Errorf("record header is truncated")
+	}
+	if _, err = f.ReadAt(hdr, off); err != nil {
+		return 0, 0, 0, 0, err
+	}
+	seq = binary.BigEndian.Uint64(hdr[4:])
+	at = int64(binary.BigEndian.Uint64(hdr[12:]))
+	block = int64(binary.BigEndian.Uint64(hdr[20:]))
+	length = binary.BigEndian.Uint32(hdr[28:])
+	if off+recHdrBytes+int64(length) > size {
+		return 0, 0, 0, 0, fmt.Errorf("record %d is truncated", seq)
+	}
+	return seq, at, block, length, nil
+}
+
+func checksum(hdr, data []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(hdr), crc32.IEEETable, data)
+}
+
+//startSegment starts a new segment at nextSeq, the caller must hold mu
+func (ul *undoLog) startSegment() error {
+	if len(ul.segs) > 0 {
+		if err := ul.segs[len(ul.segs)-1].f.Sync(); err != nil {
+			return err
+		}
+	}
+	seg := &segment{first: ul.nextSeq, last: ul.nextSeq - 1}
+	f, err := os.OpenFile(seg.path(ul.dir), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	seg.f, ul.segs = f, append(ul.segs, seg)
+	return nil
+}
+
+//append records the contents of a block before it is overwritten at the provided
+// time, which is advanced if needed so versions are ordered by time. It returns
+// if a new segment was started.
+func (ul *undoLog) append(block int64, data []byte, at int64) (bool, error) {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	if ul.segs == nil {
+		return false, errClosed
+	}
+	seg, started := ul.segs[len(ul.segs)-1], false
+	if seg.bytes >= ul.segBytes {
+		if err := ul.startSegment(); err != nil {
+			return false, fmt.Errorf("Could not start undo log segment: %w", err)
+		}
+		seg, started = ul.segs[len(ul.segs)-1], true
+	}
+	if at <= ul.lastAt {
+		at = ul.lastAt + 1
+	}
+
+	rec := make([]byte, recHdrBytes+len(data))
+	binary.BigEndian.PutUint64(rec[4:], ul.nextSeq)
+	binary.BigEndian.PutUint64(rec[12:], uint64(at))
+	binary.BigEndian.PutUint64(rec[20:], uint64(block))
+	binary.BigEndian.PutUint32(rec[28:], uint32(len(data)))
+	copy(rec[recHdrBytes:], data)
+	binary.BigEndian.PutUint32(rec, checksum(rec[4:recHdrBytes], data))
+	if _, err := seg.f.WriteAt(rec, seg.bytes); err != nil {
+		//Remove any partial record so later appends are not lost behind it
+		seg.f.Truncate(seg.bytes)
+		return started, fmt.Errorf("Could not append to undo log: %w", err)
+	}
+
+	ul.versions[block] = append(ul.versions[block], version{seq: ul.nextSeq, at: at, seg: seg, off: seg.bytes})
+	seg.last, seg.newest = ul.nextSeq, at
+	seg.bytes += int64(len(rec))
+	ul.nextSeq++
+	ul.lastAt = at
+	ul.records++
+	ul.bytes += int64(len(rec))
+	return started, nil
+}
+
+//sync makes the appended records durable
+func (ul *undoLog) sync() error {
+	ul.mu.RLock()
+	defer ul.mu.RUnlock()
+
+	if ul.segs == nil {
+		return errClosed
+	}
+	return ul.segs[len(ul.segs)-1].f.Sync()
+}
+
+//readAsOf reads the contents a block had at the provided time into buf, if it
+// has been overwritten at or since it, and returns if it was
+func (ul *undoLog) readAsOf(block, at int64, buf []byte) (bool, error) {
+	ul.mu.RLock()
+	defer ul.mu.RUnlock()
+
+	if ul.segs == nil {
+		return false, errClosed
+	}
+	versions := ul.versions[block]
+	idx := sort.Search(len(versions), func(i int) bool { return versions[i].at >= at })
+	if idx == len(versions) {
+		return false, nil
+	}
+	v := versions[idx]
+
+	var hdr [recHdrBytes]byte
+	if _, err := v.seg.f.ReadAt(hdr[:], v.off); err != nil {
+		return false, fmt.Errorf("Could not read undo log record %d: %w", v.seq, err)
+	}
+	if length := binary.BigEndian.Uint32(hdr[28:]); int(length) != len(buf) || binary.BigEndian.Uint64(hdr[4:]) != v.seq {
+		return false, fmt.Errorf("Undo log record %d is not as indexed: %w", v.seq, ErrCorrupt)
+	}
+	if _, err := v.seg.f.ReadAt(buf, v.off+recHdrBytes); err != nil {
+		return false, fmt.Errorf("Could not read undo log record %d: %w", v.seq, err)
+	}
+	if checksum(hdr[4:], buf) != binary.BigEndian.Uint32(hdr[:]) {
+		return false, fmt.Errorf("Undo log record %d checksum does not match: %w", v.seq, ErrCorrupt)
+	}
+	return true, nil
+}
+
+//changedSince returns the blocks overwritten at or after the provided time, in
+// order
+func (ul *undoLog) changedSince(at int64) []int64 {
+	ul.mu.RLock()
+	defer ul.mu.RUnlock()
+
+	var blocks []int64
+	for block, versions := range ul.versions {
+		if versions[len(versions)-1].at >= at {
+			blocks = append(blocks, block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	return blocks
+}
+
+//discardBefore deletes segments whose records were all written before the
+// provided time, the segment being appended to is kept. It returns the time of
+// the newest record deleted, or 0 if none were.
+func (ul *undoLog) discardBefore(at int64) (int64, error) {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	var newest int64
+	var lastSeq uint64
+	for len(ul.segs) > 1 && ul.segs[0].newest < at {
+		seg := ul.segs[0]
+		seg.f.Close()
+		if err := os.Remove(seg.path(ul.dir)); err != nil && !os.IsNotExist(err) {
+			return newest, fmt.Errorf("Could not delete undo log segment: %w", err)
+		}
+		if seg.last >= seg.first {
+			newest, lastSeq = seg.newest, seg.last
+			ul.records -= int64(seg.last - seg.first + 1)
+		}
+		ul.bytes -= seg.bytes
+		ul.segs = ul.segs[1:]
+	}
+	if lastSeq == 0 {
+		return 0, nil
+	}
+
+	for block, versions := range ul.versions {
+		idx := sort.Search(len(versions), func(i int) bool { return versions[i].seq > lastSeq })
+		if idx == len(versions) {
+			delete(ul.versions, block)
+		} else if idx > 0 {
+			ul.versions[block] = append([]version(nil), versions[idx:]...)
+		}
+	}
+	return newest, nil
+}
+
+//stats returns the number of records and bytes held
+func (ul *undoLog) stats() (records, bytes int64) {
+	ul.mu.RLock()
+	defer ul.mu.RUnlock()
+	return ul.records, ul.bytes
+}
+
+//close closes the segments, the log can not be used afterwards
+func (ul *undoLog) close() error {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	var firstErr error
+	for i, seg := range ul.segs {
+		if seg.f == nil {
+			continue
+		}
+		if i == len(ul.segs)-1 {
+			if err := seg.f.Sync(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if err := seg.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	ul.segs = nil
+	return firstErr
+}
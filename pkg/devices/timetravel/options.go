@@ -0,0 +1,44 @@
+package timetravel
+
+import "time"
+
+//Option is a time-travel device option
+type Option interface {
+	apply(*TimeTravel)
+}
+
+//OptBlockBytes instructs a TimeTravel device to version blocks of this size, the
+// default is DefBlockBytes. It must match that of any existing history. Writes
+// smaller than a block log the whole block.
+type OptBlockBytes int64
+
+func (size OptBlockBytes) apply(tdev *TimeTravel) {
+	tdev.blockBytes = int64(size)
+}
+
+//OptRetention instructs a TimeTravel device to retain history for at least the
+// provided duration, the default is DefRetention
+type OptRetention time.Duration
+
+func (retention OptRetention) apply(tdev *TimeTravel) {
+	tdev.retention = time.Duration(retention)
+}
+
+//OptSegmentBytes instructs a TimeTravel device to split its undo log into files
+// of about this size, the default is DefSegmentBytes. History is discarded a
+// segment at a time, so smaller segments discard it more precisely at the cost of
+// more files.
+type OptSegmentBytes int64
+
+func (size OptSegmentBytes) apply(tdev *TimeTravel) {
+	tdev.segBytes = int64(size)
+}
+
+//OptSyncLog instructs a TimeTravel device to make each version durable before
+// the block is overwritten, so history survives an unclean shutdown at the cost
+// of a sync per write
+type OptSyncLog bool
+
+func (syncLog OptSyncLog) apply(tdev *TimeTravel) {
+	tdev.syncLog = bool(syncLog)
+}
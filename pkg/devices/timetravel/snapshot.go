@@ -0,0 +1,205 @@
+package timetravel
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const errReadOnly = consterr.ConstErr("Snapshot is read-only")
+
+//Snapshot is a read-only device presenting the contents a TimeTravel device had
+// at a past time. The versions it needs are retained until it is closed.
+type Snapshot struct {
+	tdev         *TimeTravel
+	at           time.Time
+	atomicOnline uint64
+}
+
+var (
+	_ usbdlib.Device         = (*Snapshot)(nil)
+	_ usbdlib.ReadOnlyDevice = (*Snapshot)(nil)
+)
+
+//AsOf returns a read-only device with the contents this device had at the
+// provided time, which can be served alongside it, for example to recover files
+// deleted or encrypted since. Times in the future are treated as now. ErrExpired
+// is returned if the time is before the history retained.
+func (tdev *TimeTravel) AsOf(at time.Time) (*Snapshot, error) {
+	if atomic.LoadUint64(&tdev.atomicOnline) != 1 {
+		return nil, errClosed
+	}
+	if now := tdev.now(); at.After(now) {
+		at = now
+	}
+	if err := tdev.pin(at); err != nil {
+		return nil, err
+	}
+	return &Snapshot{tdev: tdev, at: at, atomicOnline: 1}, nil
+}
+
+//pin retains the versions needed to read as of the provided time until unpinned
+func (tdev *TimeTravel) pin(at time.Time) error {
+	tdev.mu.Lock()
+	defer tdev.mu.Unlock()
+
+	if at.Before(tdev.meta.Horizon) {
+		return fmt.Errorf("Could not read as of %s, history is retained from %s: %w", at.Format(time.RFC3339Nano), tdev.meta.Horizon.Format(time.RFC3339Nano), ErrExpired)
+	}
+	tdev.pins[at.UnixNano()]++
+	return nil
+}
+
+func (tdev *TimeTravel) unpin(at time.Time) {
+	tdev.mu.Lock()
+	defer tdev.mu.Unlock()
+
+	if tdev.pins[at.UnixNano()]--; tdev.pins[at.UnixNano()] < 1 {
+		delete(tdev.pins, at.UnixNano())
+	}
+}
+
+//readAsOf reads the contents the device had at the provided time, ioMu must be
+// held
+func (tdev *TimeTravel) readAsOf(buf []byte, pos int64, at int64) (int, error) {
+	switch {
+	case pos < 0:
+		return 0, fmt.Errorf("Read at negative position %d", pos)
+	case pos >= tdev.size:
+		return 0, io.EOF
+	case len(buf) < 1:
+		return 0, nil
+	}
+	count, eof := int64(len(buf)), error(nil)
+	if pos+count > tdev.size {
+		count, eof = tdev.size-pos, io.EOF
+	}
+	unlock := tdev.lockRange(pos, count, false)
+	defer unlock()
+
+	first, last := pos/tdev.blockBytes, (pos+count-1)/tdev.blockBytes
+	start, end := first*tdev.blockBytes, (last+1)*tdev.blockBytes
+	if end > tdev.size {
+		end = tdev.size
+	}
+	blocks := make([]byte, end-start)
+	if n, err := tdev.dev.ReadAt(blocks, start); err != nil && (err != io.EOF || n < len(blocks)) {
+		return 0, err
+	}
+	for block := first; block <= last; block++ {
+		blockBuf := blocks[(block-first)*tdev.blockBytes:]
+		if int64(len(blockBuf)) > tdev.blockBytes {
+			blockBuf = blockBuf[:tdev.blockBytes]
+		}
+		if _, err := tdev.ul.readAsOf(block, at, blockBuf); err != nil {
+			return 0, fmt.Errorf("Could not read version of block %d: %w", block, err)
+		}
+	}
+	return copy(buf[:count], blocks[pos-start:]), eof
+}
+
+//Rollback restores the contents the device had at the provided time. Rolling
+// back is itself recorded, so it can be undone by rolling back to a time before
+// it. ErrExpired is returned if the time is before the history retained. IO waits
+// while the device is rolled back.
+func (tdev *TimeTravel) Rollback(at time.Time) error {
+	if atomic.LoadUint64(&tdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	if at.After(tdev.now()) {
+		return nil
+	}
+	tdev.ioMu.Lock()
+	defer tdev.ioMu.Unlock()
+	if err := tdev.pin(at); err != nil { //Versions needed are retained while writing
+		return err
+	}
+	defer tdev.unpin(at)
+
+	buf := make([]byte, tdev.blockBytes)
+	for _, block := range tdev.ul.changedSince(at.UnixNano()) {
+		pos := block * tdev.blockBytes
+		if pos >= tdev.size {
+			continue
+		}
+		blockBuf := buf
+		if remaining := tdev.size - pos; remaining < tdev.blockBytes {
+			blockBuf = buf[:remaining]
+		}
+		if _, err := tdev.readAsOf(blockBuf, pos, at.UnixNano()); err != nil {
+			return fmt.Errorf("Could not read block %d as of %s: %w", block, at.Format(time.RFC3339Nano), err)
+		}
+		if _, err := tdev.write(blockBuf, pos); err != nil {
+			return fmt.Errorf("Could not roll back block %d: %w", block, err)
+		}
+	}
+
+	if err := tdev.ul.sync(); err != nil {
+		return fmt.Errorf("Could not sync undo log: %w", err)
+	}
+	return tdev.dev.Flush()
+}
+
+//At returns the time this snapshot presents the device as of
+func (snap *Snapshot) At() time.Time {
+	return snap.at
+}
+
+//Size of this device in bytes
+func (snap *Snapshot) Size() int64 {
+	return snap.tdev.size
+}
+
+//BlockSize of this device is that of the device it is a snapshot of
+func (snap *Snapshot) BlockSize() int64 {
+	return snap.tdev.BlockSize()
+}
+
+//ReadOnly fufills usbdlib.ReadOnlyDevice, snapshots are always read-only
+func (snap *Snapshot) ReadOnly() bool {
+	return true
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (snap *Snapshot) ReadAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&snap.atomicOnline) != 1 || atomic.LoadUint64(&snap.tdev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	snap.tdev.ioMu.RLock()
+	defer snap.tdev.ioMu.RUnlock()
+
+	return snap.tdev.readAsOf(buf, pos, snap.at.UnixNano())
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device, snapshots can
+// not be written
+func (snap *Snapshot) WriteAt(buf []byte, pos int64) (int, error) {
+	return 0, errReadOnly
+}
+
+//Trim fufills part of usbdlib.Device, snapshots can not be trimmed
+func (snap *Snapshot) Trim(pos int64, count int) error {
+	return errReadOnly
+}
+
+//Flush fufills part of usbdlib.Device, there is never anything to flush
+func (snap *Snapshot) Flush() error {
+	if atomic.LoadUint64(&snap.atomicOnline) != 1 {
+		return errClosed
+	}
+	return nil
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device, the versions needed
+// by this snapshot are no longer retained
+func (snap *Snapshot) Close() error {
+	if !atomic.CompareAndSwapUint64(&snap.atomicOnline, 1, 0) {
+		return errClosed
+	}
+	snap.tdev.unpin(snap.at)
+	return nil
+}
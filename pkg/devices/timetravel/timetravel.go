@@ -0,0 +1,436 @@
+package timetravel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed = consterr.ConstErr("Device is shutdown")
+
+	//ErrExpired is returned for times before the history retained
+	ErrExpired = consterr.ConstErr("Time is before the history retained")
+
+	//DefBlockBytes is the default size of the blocks versioned
+	DefBlockBytes = 4096
+	//DefRetention is the default minimum age of the history retained
+	DefRetention = 24 * time.Hour
+	//DefSegmentBytes is the default size the undo log is split into files of, and
+	// discarded in
+	DefSegmentBytes = 64 * 1024 * 1024
+
+	lockStripes = 64
+	metaName    = "meta"
+)
+
+//meta is persisted in the log directory
+type meta struct {
+	BlockBytes  int64     `json:"blockBytes"`
+	DeviceBytes int64     `json:"deviceBytes"`
+	Horizon     time.Time `json:"horizon"` //History is retained from this time
+	Clean       bool      `json:"clean"`   //Shutdown cleanly
+}
+
+//History describes the history retained by a TimeTravel device
+type History struct {
+	Oldest   time.Time //Earliest time the device can be read as of
+	Versions int64     //Of blocks retained
+	LogBytes int64     //Size of the undo log
+}
+
+//TimeTravel wraps a device and records the previous contents of every block
+// written, with the time it was overwritten, in an append-only undo log. The
+// device can then be read as it was at any time within the retention window
+// (see AsOf) or rolled back to such a time (see Rollback). The wrapped device
+// holds the current contents so reads and writes of it are not slowed beyond the
+// cost of reading each block before it is overwritten and logging it. Versions
+// older than the retention window are discarded a segment at a time as the log
+// grows, or by Compact.
+type TimeTravel struct {
+	dev          usbdlib.Device
+	logDir       string
+	size         int64
+	blockBytes   int64
+	retention    time.Duration
+	segBytes     int64
+	syncLog      bool
+	now          func() time.Time
+	atomicOnline uint64
+	ioMu         sync.RWMutex //Held exclusively to close or roll back
+	regionLocks  [lockStripes]sync.RWMutex
+	ul           *undoLog
+	persistMu    sync.Mutex
+
+	mu   sync.Mutex //Held to change meta or pins, and while compacting
+	meta meta
+	pins map[int64]int //Times of the snapshots open, versions from which are kept
+}
+
+var (
+	_ usbdlib.Device         = (*TimeTravel)(nil)
+	_ usbdlib.ReadOnlyDevice = (*TimeTravel)(nil)
+)
+
+//NewTimeTravel constructs a device recording the history of the provided device,
+// which it owns and closes when closed, in logDir, which is created if it does
+// not exist. History begins when the device is first wrapped; writes to the
+// device while it is not wrapped are not recorded and make the history before
+// them incorrect. Unless OptSyncLog is used, history before an unclean shutdown
+// is discarded, as versions not yet flushed may have been lost.
+func NewTimeTravel(dev usbdlib.Device, logDir string, options ...Option) (*TimeTravel, error) {
+	tdev := &TimeTravel{
+		dev:          dev,
+		logDir:       logDir,
+		size:         dev.Size(),
+		blockBytes:   DefBlockBytes,
+		retention:    DefRetention,
+		segBytes:     DefSegmentBytes,
+		now:          time.Now,
+		atomicOnline: 1,
+		pins:         make(map[int64]int),
+	}
+	for _, opt := range options {
+		opt.apply(tdev)
+	}
+	switch {
+	case tdev.blockBytes < 1:
+		return nil, fmt.Errorf("Block size must be at least one byte")
+	case tdev.retention < 0:
+		return nil, fmt.Errorf("Retention can not be negative")
+	case tdev.segBytes < 1:
+		return nil, fmt.Errorf("Undo log segment size must be at least one byte")
+	}
+
+	var err error
+	if tdev.ul, err = openLog(logDir, tdev.segBytes); err != nil {
+		return nil, err
+	}
+	if err = tdev.loadMeta(); err != nil {
+		tdev.ul.close()
+		return nil, err
+	}
+	return tdev, nil
+}
+
+//loadMeta loads the metadata from the log directory, or creates it
+func (tdev *TimeTravel) loadMeta() error {
+	metaFile := filepath.Join(tdev.logDir, metaName)
+	data, err := os.ReadFile(metaFile)
+	switch {
+	case os.IsNotExist(err):
+		tdev.meta = meta{BlockBytes: tdev.blockBytes, DeviceBytes: tdev.size, Horizon: tdev.now()}
+	case err != nil:
+		return fmt.Errorf("Could not read metadata file %q: %w", metaFile, err)
+	default:
+		if err = json.Unmarshal(data, &tdev.meta); err != nil {
+			return fmt.Errorf("Could not decode metadata file %q: %w", metaFile, err)
+		}
+		switch {
+		case tdev.meta.DeviceBytes != tdev.size:
+			return fmt.Errorf("Metadata file %q is for a device of %d bytes rather than %d", metaFile, tdev.meta.DeviceBytes, tdev.size)
+		case tdev.meta.BlockBytes != tdev.blockBytes:
+			return fmt.Errorf("Metadata file %q is for blocks of %d bytes rather than %d", metaFile, tdev.meta.BlockBytes, tdev.blockBytes)
+		}
+		if !tdev.meta.Clean && !tdev.syncLog {
+			log.Printf("TimeTravel::loadMeta(): WARNING: Device was not shutdown cleanly, history before now is discarded")
+			tdev.meta.Horizon = tdev.now()
+		}
+	}
+
+	tdev.meta.Clean = false //Record that the device is in use
+	return tdev.persist()
+}
+
+//persist writes the metadata to the log directory
+func (tdev *TimeTravel) persist() error {
+	tdev.persistMu.Lock()
+	defer tdev.persistMu.Unlock()
+
+	tdev.mu.Lock()
+	data, err := json.MarshalIndent(&tdev.meta, "", "\t")
+	tdev.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("Could not encode metadata: %w", err)
+	}
+	if err = util.WriteFileAtomic(filepath.Join(tdev.logDir, metaName), data, 0600); err != nil {
+		return fmt.Errorf("Could not persist metadata: %w", err)
+	}
+	return nil
+}
+
+//Size of this device in bytes
+func (tdev *TimeTravel) Size() int64 {
+	return tdev.size
+}
+
+//BlockSize of this device is that of the wrapped device
+func (tdev *TimeTravel) BlockSize() int64 {
+	return tdev.dev.BlockSize()
+}
+
+//ReadOnly returns if the wrapped device is read-only, fulfilling
+// usbdlib.ReadOnlyDevice
+func (tdev *TimeTravel) ReadOnly() bool {
+	return usbdlib.IsReadOnly(tdev.dev)
+}
+
+//History returns the history currently retained
+func (tdev *TimeTravel) History() History {
+	records, logBytes := tdev.ul.stats()
+
+	tdev.mu.Lock()
+	defer tdev.mu.Unlock()
+	return History{Oldest: tdev.meta.Horizon, Versions: records, LogBytes: logBytes}
+}
+
+//lockRange locks the regions overlapping the provided range, exclusively to write
+// and shared to read as of a past time, so that a block and its versions are
+// always consistent
+func (tdev *TimeTravel) lockRange(pos, count int64, exclusive bool) (unlock func()) {
+	first, last := pos/tdev.blockBytes, (pos+count-1)/tdev.blockBytes
+	if last < first {
+		last = first
+	}
+	var stripes []int
+	if last-first+1 >= lockStripes {
+		for i := 0; i < lockStripes; i++ {
+			stripes = append(stripes, i)
+		}
+	} else {
+		for block := first; block <= last; block++ {
+			stripes = append(stripes, int(block%lockStripes))
+		}
+		sort.Ints(stripes) //Consistent order to avoid deadlock
+	}
+
+	for _, stripe := range stripes {
+		if exclusive {
+			tdev.regionLocks[stripe].Lock()
+		} else {
+			tdev.regionLocks[stripe].RLock()
+		}
+	}
+	return func() {
+		for _, stripe := range stripes {
+			if exclusive {
+				tdev.regionLocks[stripe].Unlock()
+			} else {
+				tdev.regionLocks[stripe].RUnlock()
+			}
+		}
+	}
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (tdev *TimeTravel) ReadAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&tdev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	tdev.ioMu.RLock()
+	defer tdev.ioMu.RUnlock()
+
+	return tdev.dev.ReadAt(buf, pos)
+}
+
+//WriteAt fufills io.WriterAt and in turn part of usbdlib.Device. The previous
+// contents of each block the write changes are logged before it is written.
+func (tdev *TimeTravel) WriteAt(buf []byte, pos int64) (int, error) {
+	if atomic.LoadUint64(&tdev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	tdev.ioMu.RLock()
+	defer tdev.ioMu.RUnlock()
+
+	return tdev.write(buf, pos)
+}
+
+//write logs the blocks a write changes and then writes it, ioMu must be held
+func (tdev *TimeTravel) write(buf []byte, pos int64) (int, error) {
+	if len(buf) < 1 {
+		return 0, nil
+	}
+	unlock := tdev.lockRange(pos, int64(len(buf)), true)
+	defer unlock()
+
+	if err := tdev.logBlocks(pos, int64(len(buf)), buf); err != nil {
+		return 0, err
+	}
+	return tdev.dev.WriteAt(buf, pos)
+}
+
+//Trim fufills part of usbdlib.Device. The contents of trimmed blocks are logged
+// first, as they may read differently afterwards.
+func (tdev *TimeTravel) Trim(pos int64, count int) error {
+	if atomic.LoadUint64(&tdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	tdev.ioMu.RLock()
+	defer tdev.ioMu.RUnlock()
+	if count < 1 {
+		return nil
+	}
+
+	unlock := tdev.lockRange(pos, int64(count), true)
+	defer unlock()
+	if err := tdev.logBlocks(pos, int64(count), nil); err != nil {
+		return err
+	}
+	return tdev.dev.Trim(pos, count)
+}
+
+//logBlocks logs the current contents of each block overlapping the provided
+// range that will change, data is what will be written or nil if trimmed. The
+// caller must hold the range's locks exclusively.
+func (tdev *TimeTravel) logBlocks(pos, count int64, data []byte) error {
+	first, last := pos/tdev.blockBytes, (pos+count-1)/tdev.blockBytes
+	start, end := first*tdev.blockBytes, (last+1)*tdev.blockBytes
+	if end > tdev.size {
+		end = tdev.size
+	}
+	if start >= end {
+		return nil //Beyond the device, let it fail the operation
+	}
+	current := make([]byte, end-start)
+	if n, err := tdev.dev.ReadAt(current, start); err != nil && (err != io.EOF || n < len(current)) {
+		return fmt.Errorf("Could not read blocks to be overwritten: %w", err)
+	}
+
+	at := tdev.now().UnixNano()
+	var rolled bool
+	for block := first; block <= last; block++ {
+		blockStart := (block - first) * tdev.blockBytes
+		if blockStart >= int64(len(current)) {
+			break
+		}
+		old := current[blockStart:]
+		if int64(len(old)) > tdev.blockBytes {
+			old = old[:tdev.blockBytes]
+		}
+		if data != nil && tdev.unchanged(old, block*tdev.blockBytes, data, pos) {
+			continue
+		}
+		started, err := tdev.ul.append(block, old, at)
+		if err != nil {
+			return err
+		}
+		rolled = rolled || started
+	}
+	if tdev.syncLog {
+		if err := tdev.ul.sync(); err != nil {
+			return fmt.Errorf("Could not sync undo log: %w", err)
+		}
+	}
+
+	if rolled {
+		if err := tdev.compact(); err != nil {
+			log.Printf("TimeTravel::logBlocks(): WARNING: Could not discard versions older than the retention window; Details: %s", err)
+		}
+	}
+	return nil
+}
+
+//unchanged returns if writing data at pos leaves the block starting at blockPos,
+// whose contents are old, unchanged
+func (tdev *TimeTravel) unchanged(old []byte, blockPos int64, data []byte, pos int64) bool {
+	oldStart, dataStart := int64(0), blockPos-pos
+	if dataStart < 0 {
+		oldStart, dataStart = -dataStart, 0
+	}
+	overlap := int64(len(old)) - oldStart
+	if remaining := int64(len(data)) - dataStart; remaining < overlap {
+		overlap = remaining
+	}
+	return bytes.Equal(old[oldStart:oldStart+overlap], data[dataStart:dataStart+overlap])
+}
+
+//Flush fufills part of usbdlib.Device. The undo log is made durable before the
+// wrapped device is flushed.
+func (tdev *TimeTravel) Flush() error {
+	if atomic.LoadUint64(&tdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	tdev.ioMu.RLock()
+	defer tdev.ioMu.RUnlock()
+
+	if err := tdev.ul.sync(); err != nil {
+		return fmt.Errorf("Could not sync undo log: %w", err)
+	}
+	return tdev.dev.Flush()
+}
+
+//Compact discards versions older than the retention window, except those needed
+// by snapshots that are open. Versions are discarded a segment at a time, so some
+// older versions may be retained.
+func (tdev *TimeTravel) Compact() error {
+	if atomic.LoadUint64(&tdev.atomicOnline) != 1 {
+		return errClosed
+	}
+	tdev.ioMu.RLock()
+	defer tdev.ioMu.RUnlock()
+
+	return tdev.compact()
+}
+
+func (tdev *TimeTravel) compact() error {
+	tdev.mu.Lock()
+	cutoff := tdev.now().Add(-tdev.retention).UnixNano()
+	for at := range tdev.pins {
+		if at < cutoff {
+			cutoff = at
+		}
+	}
+	newest, err := tdev.ul.discardBefore(cutoff)
+	if horizon := time.Unix(0, newest+1); newest != 0 && horizon.After(tdev.meta.Horizon) {
+		tdev.meta.Horizon = horizon
+	}
+	tdev.mu.Unlock()
+	if newest == 0 {
+		return err
+	}
+
+	if persistErr := tdev.persist(); err == nil {
+		err = persistErr
+	}
+	return err
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device
+func (tdev *TimeTravel) Close() error {
+	if !atomic.CompareAndSwapUint64(&tdev.atomicOnline, 1, 0) {
+		return errClosed
+	}
+	tdev.ioMu.Lock() //Wait for outstanding IO
+	defer tdev.ioMu.Unlock()
+
+	logErr := tdev.ul.close()
+	devErr := tdev.dev.Flush()
+	if logErr == nil && devErr == nil {
+		tdev.mu.Lock()
+		tdev.meta.Clean = true
+		tdev.mu.Unlock()
+		logErr = tdev.persist()
+	}
+	if err := tdev.dev.Close(); err != nil {
+		return err
+	}
+	if devErr != nil {
+		return devErr
+	}
+	if logErr != nil {
+		return fmt.Errorf("Could not close undo log: %w", logErr)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package timetravel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+func TestTimeTravel(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024 //16 MB
+
+	testutil.TestUserspace(t, createDevice(t, ramdisk.NewRAMDisk(sizeBytes), t.TempDir()), sizeBytes)
+	testutil.TestNBD(t, createDevice(t, ramdisk.NewRAMDisk(sizeBytes), t.TempDir()), sizeBytes)
+}
+
+func createDevice(t *testing.T, dev usbdlib.Device, logDir string, options ...Option) *TimeTravel {
+	t.Helper()
+
+	tdev, err := NewTimeTravel(dev, logDir, options...)
+	if err != nil {
+		t.Fatalf("Could not create time-travel device: %s", err)
+	}
+	return tdev
+}
+
+//optNow instructs a TimeTravel device to use the provided clock
+type optNow func() time.Time
+
+func (now optNow) apply(tdev *TimeTravel) {
+	tdev.now = now
+}
+
+//clock is advanced explicitly by tests
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) time.Time {
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+func TestAsOf(t *testing.T) {
+	const sizeBytes = 1024*1024 + 1000 //Not a multiple of the block size
+
+	clk := &clock{now: time.Now()}
+	tdev := createDevice(t, ramdisk.NewRAMDisk(sizeBytes), t.TempDir(), OptSegmentBytes(64*1024), optNow(clk.Now))
+	defer tdev.Close()
+	rnd := rand.New(rand.NewSource(1))
+
+	//Write random extents, recording the contents after each round
+	var times []time.Time
+	var contents [][]byte
+	model := make([]byte, sizeBytes)
+	for round := 0; round < 8; round++ {
+		clk.Advance(time.Minute)
+		for i := 0; i < 20; i++ {
+			buf := make([]byte, 1+rnd.Intn(3*DefBlockBytes))
+			rnd.Read(buf)
+			pos := rnd.Int63n(sizeBytes - int64(len(buf)))
+			if i == 0 {
+				pos = sizeBytes - int64(len(buf)) //The partial block at the end
+			}
+			if _, err := tdev.WriteAt(buf, pos); err != nil {
+				t.Fatalf("Could not write: %s", err)
+			}
+			copy(model[pos:], buf)
+		}
+		times = append(times, clk.Advance(time.Second))
+		contents = append(contents, append([]byte(nil), model...))
+	}
+
+	for i, at := range times {
+		expectAsOf(t, tdev, at, contents[i])
+	}
+	before := times[0].Add(-time.Minute + time.Second) //After creation, before any writes
+	expectAsOf(t, tdev, before, make([]byte, sizeBytes))
+
+	//Snapshots can not be changed and read unaligned ranges
+	snap, err := tdev.AsOf(times[2])
+	if err != nil {
+		t.Fatalf("Could not open snapshot: %s", err)
+	}
+	if _, err = snap.WriteAt([]byte{1}, 0); err == nil {
+		t.Fatalf("Snapshot was written")
+	} else if err = snap.Trim(0, DefBlockBytes); err == nil {
+		t.Fatalf("Snapshot was trimmed")
+	} else if !usbdlib.IsReadOnly(snap) {
+		t.Fatalf("Snapshot is not read-only")
+	}
+	buf := make([]byte, 3*DefBlockBytes)
+	if n, err := snap.ReadAt(buf, 1234); err != nil || n != len(buf) || !bytes.Equal(buf, contents[2][1234:1234+len(buf)]) {
+		t.Fatalf("Unaligned read of snapshot was not as expected: %d, %v", n, err)
+	}
+	if n, err := snap.ReadAt(buf, sizeBytes-100); err != io.EOF || n != 100 || !bytes.Equal(buf[:100], contents[2][sizeBytes-100:]) {
+		t.Fatalf("Read of the end of snapshot was not as expected: %d, %v", n, err)
+	}
+	if err = snap.Close(); err != nil {
+		t.Fatalf("Could not close snapshot: %s", err)
+	}
+
+	//Rolling back restores the contents, and can itself be undone
+	clk.Advance(time.Minute)
+	if err = tdev.Rollback(times[3]); err != nil {
+		t.Fatalf("Could not roll back: %s", err)
+	}
+	expectContents(t, tdev, contents[3])
+	afterRollback := clk.Advance(time.Second)
+	if err = tdev.Rollback(times[len(times)-1]); err != nil {
+		t.Fatalf("Could not roll back the roll back: %s", err)
+	}
+	expectContents(t, tdev, contents[len(contents)-1])
+	expectAsOf(t, tdev, afterRollback, contents[3])
+	expectAsOf(t, tdev, times[1], contents[1])
+
+	if _, err = tdev.AsOf(before.Add(-time.Hour)); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Reading before the device was created returned %v rather than %s", err, ErrExpired)
+	}
+}
+
+func expectAsOf(t *testing.T, tdev *TimeTravel, at time.Time, expected []byte) {
+	t.Helper()
+
+	snap, err := tdev.AsOf(at)
+	if err != nil {
+		t.Fatalf("Could not open snapshot as of %s: %s", at, err)
+	}
+	defer snap.Close()
+	expectContents(t, snap, expected)
+}
+
+func expectContents(t *testing.T, dev usbdlib.Device, expected []byte) {
+	t.Helper()
+
+	actual := make([]byte, len(expected))
+	if _, err := dev.ReadAt(actual, 0); err != nil {
+		t.Fatalf("Could not read device: %s", err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("Device contents were not as expected")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	const sizeBytes = 256 * 1024
+
+	clk := &clock{now: time.Now()}
+	tdev := createDevice(t, ramdisk.NewRAMDisk(sizeBytes), t.TempDir(), OptRetention(time.Hour), OptSegmentBytes(16*1024), optNow(clk.Now))
+	defer tdev.Close()
+	buf := make([]byte, DefBlockBytes)
+
+	//Each hour rewrite the device, the first hour is retained while a snapshot of it
+	// is open
+	start := clk.Advance(time.Minute)
+	snap, err := tdev.AsOf(start)
+	if err != nil {
+		t.Fatalf("Could not open snapshot: %s", err)
+	}
+	var times []time.Time
+	for hour := 1; hour <= 4; hour++ {
+		clk.Advance(time.Hour)
+		for pos := int64(0); pos < sizeBytes; pos += DefBlockBytes {
+			buf[0] = byte(hour)
+			tdev.WriteAt(buf, pos)
+		}
+		times = append(times, clk.Advance(time.Minute))
+	}
+	expectContents(t, snap, make([]byte, sizeBytes))
+	if history := tdev.History(); history.Versions != 4*sizeBytes/DefBlockBytes || !history.Oldest.Before(start) {
+		t.Fatalf("Snapshot did not retain history: %+v", history)
+	}
+
+	//Once closed history older than the retention window is discarded
+	snap.Close()
+	if err = tdev.Compact(); err != nil {
+		t.Fatalf("Could not compact: %s", err)
+	}
+	history := tdev.History()
+	if history.Versions >= 2*sizeBytes/DefBlockBytes || history.Oldest.Before(times[1]) || !history.Oldest.Before(times[2]) {
+		t.Fatalf("History was not discarded as expected: %+v", history)
+	}
+	if _, err = tdev.AsOf(times[1]); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Reading discarded history returned %v rather than %s", err, ErrExpired)
+	} else if err = tdev.Rollback(times[1]); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Rolling back to discarded history returned %v rather than %s", err, ErrExpired)
+	}
+	expected := make([]byte, sizeBytes)
+	for pos := 0; pos < sizeBytes; pos += DefBlockBytes {
+		expected[pos] = 3
+	}
+	expectAsOf(t, tdev, times[2], expected)
+
+	//Discarding happens as the log grows too
+	clk.Advance(2 * time.Hour)
+	buf[0] = 5
+	for pos := int64(0); pos < sizeBytes; pos += DefBlockBytes {
+		tdev.WriteAt(buf[:1], pos)
+	}
+	if history = tdev.History(); !history.Oldest.After(times[2]) {
+		t.Fatalf("History was not discarded as the log grew: %+v", history)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	const sizeBytes = 1024 * 1024
+
+	dir := t.TempDir()
+	diskFile, logDir := filepath.Join(dir, "disk.bin"), filepath.Join(dir, "history")
+	clk := &clock{now: time.Now()}
+	open := func(options ...Option) (*TimeTravel, usbdlib.Device) {
+		disk, err := filedisk.NewFileDisk(diskFile, sizeBytes)
+		if err != nil {
+			t.Fatalf("Could not open file disk: %s", err)
+		}
+		return createDevice(t, disk, logDir, append(options, optNow(clk.Now))...), disk
+	}
+	one, two := bytes.Repeat([]byte{1}, sizeBytes), bytes.Repeat([]byte{2}, sizeBytes)
+
+	//History survives a clean shutdown
+	tdev, _ := open()
+	clk.Advance(time.Second)
+	tdev.WriteAt(one, 0)
+	first := clk.Advance(time.Second)
+	tdev.WriteAt(two, 0)
+	if err := tdev.Close(); err != nil {
+		t.Fatalf("Could not close device: %s", err)
+	}
+	tdev, disk := open()
+	expectAsOf(t, tdev, first, one)
+
+	//After a crash history may be incomplete so is discarded
+	clk.Advance(time.Second)
+	tdev.WriteAt(one[:100], 0)
+	disk.Close() //Crash
+	tdev, _ = open()
+	if _, err := tdev.AsOf(first); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Reading history from before a crash returned %v rather than %s", err, ErrExpired)
+	}
+	if err := tdev.Close(); err != nil {
+		t.Fatalf("Could not close device: %s", err)
+	}
+
+	if _, err := NewTimeTravel(ramdisk.NewRAMDisk(sizeBytes), logDir, OptBlockBytes(8192)); err == nil {
+		t.Fatalf("History with a different block size was accepted")
+	}
+}
@@ -0,0 +1,46 @@
+package verity
+
+//Option is an option for formatting or opening a verity device
+type Option interface {
+	apply(*config)
+}
+
+type config struct {
+	blockBytes int64
+	salt       []byte
+	cacheBytes int64
+}
+
+func newConfig(options []Option) config {
+	cfg := config{blockBytes: DefBlockBytes, cacheBytes: DefCacheBytes}
+	for _, opt := range options {
+		opt.apply(&cfg)
+	}
+	return cfg
+}
+
+//OptBlockBytes instructs Format to hash data in blocks of this size, which is
+// also the size of the blocks of the hash tree, rather than DefBlockBytes. It
+// must be a power of two of at least 512 bytes and at most MaxBlockBytes.
+type OptBlockBytes int64
+
+func (size OptBlockBytes) apply(cfg *config) {
+	cfg.blockBytes = int64(size)
+}
+
+//OptSalt instructs Format to salt every hash with the provided bytes (at most
+// MaxSaltBytes) rather than random ones, so the same image always produces the
+// same root hash
+type OptSalt []byte
+
+func (salt OptSalt) apply(cfg *config) {
+	cfg.salt = []byte(salt)
+}
+
+//OptCacheBytes instructs a Verity device to cache up to this many bytes of
+// verified hash tree blocks rather than DefCacheBytes
+type OptCacheBytes int64
+
+func (size OptCacheBytes) apply(cfg *config) {
+	cfg.cacheBytes = int64(size)
+}
@@ -0,0 +1,231 @@
+package verity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const (
+	headerMagic   = "USBDVRTY"
+	headerVersion = 1
+	headerBytes   = len(headerMagic) + 2 + 4 + 8 + 2 + MaxSaltBytes
+
+	//MaxSaltBytes is the largest salt supported
+	MaxSaltBytes = 64
+	//MaxBlockBytes is the largest block size supported, block sizes are read from
+	// the header of a hash tree so this bounds what opening a corrupt one allocates
+	MaxBlockBytes = 64 * 1024
+	//DigestBytes is the size of the hashes (SHA-256) in the tree, including the root
+	DigestBytes = sha256.Size
+)
+
+//The hash device holds a header block followed by the levels of the hash tree,
+// the top level (a single block) first. Each block of the lowest level holds the
+// digests of consecutive data blocks and each block of the levels above holds the
+// digests of consecutive blocks of the level below. Every digest is the SHA-256 of
+// the salt followed by the block. The root hash is the SHA-256 of the header block
+// followed by the top block, so the geometry and salt in the header are trusted
+// once the root hash is.
+
+//level is a level of the hash tree
+type level struct {
+	offset int64 //Within the hash device
+	blocks int64
+}
+
+//geometry describes the layout of a hash tree
+type geometry struct {
+	blockBytes, dataSize int64
+	salt                 []byte
+	levels               []level //Lowest first
+}
+
+func newGeometry(blockBytes, dataSize int64, salt []byte) (*geometry, error) {
+	switch {
+	case blockBytes < 512 || blockBytes&(blockBytes-1) != 0:
+		return nil, fmt.Errorf("Block size %d is not a power of two of at least 512 bytes", blockBytes)
+	case blockBytes > MaxBlockBytes:
+		return nil, fmt.Errorf("Block size %d is larger than the maximum of %d", blockBytes, MaxBlockBytes)
+	case dataSize < blockBytes || dataSize%blockBytes != 0:
+		return nil, fmt.Errorf("Data size %d is not a non-zero multiple of the block size %d", dataSize, blockBytes)
+	case len(salt) > MaxSaltBytes:
+		return nil, fmt.Errorf("Salt of %d bytes is longer than the maximum of %d", len(salt), MaxSaltBytes)
+	}
+
+	geo := &geometry{blockBytes: blockBytes, dataSize: dataSize, salt: salt}
+	perBlock := blockBytes / DigestBytes
+	for count := dataSize / blockBytes; ; {
+		blocks := (count + perBlock - 1) / perBlock
+		geo.levels = append(geo.levels, level{blocks: blocks})
+		if blocks == 1 {
+			break
+		}
+		count = blocks
+	}
+	offset := blockBytes //The header block
+	for i := len(geo.levels) - 1; i >= 0; i-- {
+		geo.levels[i].offset = offset
+		offset += geo.levels[i].blocks * blockBytes
+	}
+	return geo, nil
+}
+
+//hashSize returns the size of the header and hash tree
+func (geo *geometry) hashSize() int64 {
+	return geo.levels[0].offset + geo.levels[0].blocks*geo.blockBytes
+}
+
+func (geo *geometry) top() level {
+	return geo.levels[len(geo.levels)-1]
+}
+
+func (geo *geometry) digest(block []byte) []byte {
+	hash := sha256.New()
+	hash.Write(geo.salt)
+	hash.Write(block)
+	return hash.Sum(nil)
+}
+
+//rootHash computes the root hash from the header and top blocks
+func (geo *geometry) rootHash(header, top []byte) []byte {
+	hash := sha256.New()
+	hash.Write(header)
+	hash.Write(top)
+	return hash.Sum(nil)
+}
+
+func (geo *geometry) header() []byte {
+	raw := make([]byte, geo.blockBytes)
+	copy(raw, headerMagic)
+	hdr := raw[len(headerMagic):]
+	binary.LittleEndian.PutUint16(hdr, headerVersion)
+	binary.LittleEndian.PutUint32(hdr[2:], uint32(geo.blockBytes))
+	binary.LittleEndian.PutUint64(hdr[6:], uint64(geo.dataSize))
+	binary.LittleEndian.PutUint16(hdr[14:], uint16(len(geo.salt)))
+	copy(hdr[16:], geo.salt)
+	return raw
+}
+
+//readHeader reads the header block of a hash device and the geometry it describes,
+// neither can be trusted until the root hash has been checked
+func readHeader(hashDev usbdlib.Device) ([]byte, *geometry, error) {
+	hdr := make([]byte, headerBytes)
+	if err := readFull(hashDev, hdr, 0); err != nil {
+		return nil, nil, fmt.Errorf("Could not read hash tree header: %w", err)
+	}
+	if string(hdr[:len(headerMagic)]) != headerMagic {
+		return nil, nil, fmt.Errorf("Device does not hold a hash tree")
+	}
+	hdr = hdr[len(headerMagic):]
+	if version := binary.LittleEndian.Uint16(hdr); version != headerVersion {
+		return nil, nil, fmt.Errorf("Hash tree version %d is not supported", version)
+	}
+	saltBytes := int(binary.LittleEndian.Uint16(hdr[14:]))
+	if saltBytes > MaxSaltBytes {
+		return nil, nil, fmt.Errorf("Hash tree header has an invalid salt length of %d", saltBytes)
+	}
+	geo, err := newGeometry(int64(binary.LittleEndian.Uint32(hdr[2:])), int64(binary.LittleEndian.Uint64(hdr[6:])), append([]byte(nil), hdr[16:16+saltBytes]...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Hash tree header is invalid: %w", err)
+	}
+
+	raw := make([]byte, geo.blockBytes)
+	if err = readFull(hashDev, raw, 0); err != nil {
+		return nil, nil, fmt.Errorf("Could not read hash tree header: %w", err)
+	}
+	return raw, geo, nil
+}
+
+//HashSize returns the number of bytes of hash device Format requires to hold the
+// hash tree of a data device of the provided size
+func HashSize(dataSize int64, options ...Option) (int64, error) {
+	cfg := newConfig(options)
+	geo, err := newGeometry(cfg.blockBytes, dataSize, cfg.salt)
+	if err != nil {
+		return 0, err
+	}
+	return geo.hashSize(), nil
+}
+
+//Format builds the hash tree of the data device on the hash device, which must be
+// at least HashSize bytes, and returns the root hash. The root hash must be kept
+// somewhere trusted, it is required to open the device with NewVerity.
+func Format(dataDev, hashDev usbdlib.Device, options ...Option) ([]byte, error) {
+	cfg := newConfig(options)
+	if cfg.salt == nil {
+		cfg.salt = make([]byte, DigestBytes)
+		if _, err := rand.Read(cfg.salt); err != nil {
+			return nil, fmt.Errorf("Could not generate salt: %w", err)
+		}
+	}
+	geo, err := newGeometry(cfg.blockBytes, dataDev.Size(), cfg.salt)
+	if err != nil {
+		return nil, err
+	}
+	if size := hashDev.Size(); size < geo.hashSize() {
+		return nil, fmt.Errorf("Hash device is %d bytes, at least %d are required", size, geo.hashSize())
+	}
+
+	//Each level is built from the data, or the level below, a chunk at a time
+	src, srcOffset, srcBlocks := dataDev, int64(0), dataDev.Size()/geo.blockBytes
+	for _, lvl := range geo.levels {
+		if err = geo.buildLevel(src, srcOffset, srcBlocks, hashDev, lvl); err != nil {
+			return nil, err
+		}
+		src, srcOffset, srcBlocks = hashDev, lvl.offset, lvl.blocks
+	}
+
+	header, top := geo.header(), make([]byte, geo.blockBytes)
+	if err = readFull(hashDev, top, geo.top().offset); err != nil {
+		return nil, fmt.Errorf("Could not read top of hash tree: %w", err)
+	}
+	if _, err = hashDev.WriteAt(header, 0); err != nil {
+		return nil, fmt.Errorf("Could not write hash tree header: %w", err)
+	}
+	if err = hashDev.Flush(); err != nil {
+		return nil, fmt.Errorf("Could not flush hash device: %w", err)
+	}
+	return geo.rootHash(header, top), nil
+}
+
+//buildLevel writes the digests of the source blocks to a level of the hash tree
+func (geo *geometry) buildLevel(src usbdlib.Device, srcOffset, srcBlocks int64, hashDev usbdlib.Device, lvl level) error {
+	const chunkBlocks = 256
+	perBlock := geo.blockBytes / DigestBytes
+	buf, out := make([]byte, chunkBlocks*geo.blockBytes), make([]byte, 0, chunkBlocks*DigestBytes)
+	written := int64(0)
+	for block := int64(0); block < srcBlocks; {
+		count := srcBlocks - block
+		if count > chunkBlocks {
+			count = chunkBlocks
+		}
+		chunk := buf[:count*geo.blockBytes]
+		if err := readFull(src, chunk, srcOffset+block*geo.blockBytes); err != nil {
+			return fmt.Errorf("Could not read blocks to hash: %w", err)
+		}
+		out = out[:0]
+		for i := int64(0); i < count; i++ {
+			out = append(out, geo.digest(chunk[i*geo.blockBytes:(i+1)*geo.blockBytes])...)
+		}
+		if block += count; block == srcBlocks { //Digests of the final block are padded with zeros
+			out = append(out, make([]byte, lvl.blocks*perBlock*DigestBytes-written-int64(len(out)))...)
+		}
+		if _, err := hashDev.WriteAt(out, lvl.offset+written); err != nil {
+			return fmt.Errorf("Could not write hash tree: %w", err)
+		}
+		written += int64(len(out))
+	}
+	return nil
+}
+
+func readFull(dev usbdlib.Device, buf []byte, pos int64) error {
+	if n, err := dev.ReadAt(buf, pos); err != nil && !(err == io.EOF && n == len(buf)) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package verity
+
+import (
+	"container/list"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	errClosed   = consterr.ConstErr("Device is shutdown")
+	errReadOnly = consterr.ConstErr("Device is read-only")
+
+	//ErrVerify is wrapped by the errors returned when data, or the hash tree, does
+	// not match the root hash; use errors.Is to detect it
+	ErrVerify = consterr.ConstErr("Data failed verification against the hash tree")
+
+	//DefBlockBytes is the default size of data and hash tree blocks
+	DefBlockBytes = 4096
+	//DefCacheBytes is the default amount of memory used to cache verified blocks
+	// of the hash tree
+	DefCacheBytes = 4 * 1024 * 1024
+)
+
+//Verity is a read-only device that verifies every block read from a data device
+// against a Merkle hash tree, built by Format, on a separate hash device. Only the
+// root hash needs to be trusted: the hash tree blocks needed to verify each read
+// are themselves verified up to the root, and cached once verified. Any change
+// to the data or hash tree causes reads of the affected blocks to fail with an
+// error wrapping ErrVerify.
+type Verity struct {
+	data, hashDev usbdlib.Device
+	geo           *geometry
+	top           []byte //Verified against the root hash when opened
+	atomicOnline  uint64
+	ioMu          sync.RWMutex //Held exclusively to close
+
+	cacheMu       sync.Mutex
+	cacheCapacity int
+	cacheEntries  map[int64]*list.Element
+	cacheLRU      *list.List
+}
+
+type cacheEntry struct {
+	idx   int64 //Of the block within the hash device
+	block []byte
+}
+
+var (
+	_ usbdlib.Device         = (*Verity)(nil)
+	_ usbdlib.ReadOnlyDevice = (*Verity)(nil)
+)
+
+//NewVerity constructs a device verifying the data device against the hash tree on
+// the hash device, which must have been built by Format with the same data and
+// return the provided root hash. The device owns both devices and closes them
+// when it is closed.
+func NewVerity(data, hashDev usbdlib.Device, rootHash []byte, options ...Option) (*Verity, error) {
+	cfg := newConfig(options)
+	header, geo, err := readHeader(hashDev)
+	if err != nil {
+		return nil, err
+	}
+
+	dev := &Verity{
+		data:         data,
+		hashDev:      hashDev,
+		geo:          geo,
+		top:          make([]byte, geo.blockBytes),
+		atomicOnline: 1,
+		cacheEntries: make(map[int64]*list.Element),
+		cacheLRU:     list.New(),
+	}
+	if err = readFull(hashDev, dev.top, geo.top().offset); err != nil {
+		return nil, fmt.Errorf("Could not read top of hash tree: %w", err)
+	}
+	if subtle.ConstantTimeCompare(geo.rootHash(header, dev.top), rootHash) != 1 {
+		return nil, fmt.Errorf("Hash tree does not match the root hash: %w", ErrVerify)
+	}
+	if data.Size() != geo.dataSize {
+		return nil, fmt.Errorf("Data device is %d bytes but the hash tree is for %d bytes", data.Size(), geo.dataSize)
+	}
+	if dev.cacheCapacity = int(cfg.cacheBytes / geo.blockBytes); dev.cacheCapacity < 1 {
+		dev.cacheCapacity = 1
+	}
+	return dev, nil
+}
+
+//Size of this device in bytes
+func (dev *Verity) Size() int64 {
+	return dev.geo.dataSize
+}
+
+//BlockSize of this device is the size of the blocks hashed
+func (dev *Verity) BlockSize() int64 {
+	return dev.geo.blockBytes
+}
+
+//ReadOnly is always true, fulfilling usbdlib.ReadOnlyDevice
+func (dev *Verity) ReadOnly() bool {
+	return true
+}
+
+//ReadAt fufills io.ReaderAt and in turn part of usbdlib.Device
+func (dev *Verity) ReadAt(buf []byte, pos int64) (count int, err error) {
+	switch {
+	case atomic.LoadUint64(&dev.atomicOnline) != 1:
+		return 0, errClosed
+	case pos >= dev.geo.dataSize:
+		return 0, io.EOF
+	}
+	var eof error
+	if end := pos + int64(len(buf)); end > dev.geo.dataSize {
+		buf, eof = buf[:dev.geo.dataSize-pos], io.EOF
+	}
+	if len(buf) < 1 {
+		return 0, eof
+	}
+
+	dev.ioMu.RLock()
+	defer dev.ioMu.RUnlock()
+
+	blockBytes := dev.geo.blockBytes
+	first, last := pos/blockBytes, (pos+int64(len(buf))-1)/blockBytes
+	span, start := buf, first*blockBytes
+	if start != pos || int64(len(buf))%blockBytes != 0 {
+		span = make([]byte, (last-first+1)*blockBytes)
+	}
+	if err = readFull(dev.data, span, start); err != nil {
+		return 0, fmt.Errorf("Could not read %d bytes at offset %d: %w", len(buf), pos, err)
+	}
+	for block := first; block <= last; block++ {
+		if err = dev.verify(block, span[(block-first)*blockBytes:(block-first+1)*blockBytes]); err != nil {
+			return 0, fmt.Errorf("Could not read %d bytes at offset %d: %w", len(buf), pos, err)
+		}
+	}
+	if len(span) != len(buf) {
+		copy(buf, span[pos-start:])
+	}
+	return len(buf), eof
+}
+
+//verify checks a data block against its digest in the lowest level of the tree
+func (dev *Verity) verify(num int64, block []byte) error {
+	perBlock := dev.geo.blockBytes / DigestBytes
+	parent, err := dev.node(0, num/perBlock)
+	if err != nil {
+		return err
+	}
+	slot := num % perBlock * DigestBytes
+	if subtle.ConstantTimeCompare(dev.geo.digest(block), parent[slot:slot+DigestBytes]) != 1 {
+		return fmt.Errorf("Block %d at offset %d: %w", num, num*dev.geo.blockBytes, ErrVerify)
+	}
+	return nil
+}
+
+//node returns a block of the hash tree once it has been verified against its
+// parent, which is verified in turn unless cached
+func (dev *Verity) node(lvl int, idx int64) ([]byte, error) {
+	if lvl == len(dev.geo.levels)-1 {
+		return dev.top, nil
+	}
+	offset := dev.geo.levels[lvl].offset + idx*dev.geo.blockBytes
+	if block := dev.cached(offset / dev.geo.blockBytes); block != nil {
+		return block, nil
+	}
+
+	perBlock := dev.geo.blockBytes / DigestBytes
+	parent, err := dev.node(lvl+1, idx/perBlock)
+	if err != nil {
+		return nil, err
+	}
+	block := make([]byte, dev.geo.blockBytes)
+	if err = readFull(dev.hashDev, block, offset); err != nil {
+		return nil, fmt.Errorf("Could not read hash tree: %w", err)
+	}
+	slot := idx % perBlock * DigestBytes
+	if subtle.ConstantTimeCompare(dev.geo.digest(block), parent[slot:slot+DigestBytes]) != 1 {
+		return nil, fmt.Errorf("Hash tree block at offset %d: %w", offset, ErrVerify)
+	}
+	dev.insert(offset/dev.geo.blockBytes, block)
+	return block, nil
+}
+
+func (dev *Verity) cached(idx int64) []byte {
+	dev.cacheMu.Lock()
+	defer dev.cacheMu.Unlock()
+
+	if elem, cached := dev.cacheEntries[idx]; cached {
+		dev.cacheLRU.MoveToFront(elem)
+		return elem.Value.(*cacheEntry).block
+	}
+	return nil
+}
+
+//insert adds a verified block evicting the least recently used ones if over
+// capacity
+func (dev *Verity) insert(idx int64, block []byte) {
+	dev.cacheMu.Lock()
+	defer dev.cacheMu.Unlock()
+
+	if _, cached := dev.cacheEntries[idx]; cached {
+		return
+	}
+	dev.cacheEntries[idx] = dev.cacheLRU.PushFront(&cacheEntry{idx: idx, block: block})
+	for dev.cacheLRU.Len() > dev.cacheCapacity {
+		oldest := dev.cacheLRU.Back()
+		dev.cacheLRU.Remove(oldest)
+		delete(dev.cacheEntries, oldest.Value.(*cacheEntry).idx)
+	}
+}
+
+//WriteAt always fails as the device is read-only
+func (dev *Verity) WriteAt(buf []byte, pos int64) (count int, err error) {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return 0, errClosed
+	}
+	return 0, errReadOnly
+}
+
+//Trim always fails as the device is read-only
+func (dev *Verity) Trim(pos int64, count int) error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+	return errReadOnly
+}
+
+//Flush is a no-op as the device is read-only
+func (dev *Verity) Flush() error {
+	if atomic.LoadUint64(&dev.atomicOnline) != 1 {
+		return errClosed
+	}
+	return nil
+}
+
+//Close fufills io.Closer and in turn part of usbdlib.Device
+func (dev *Verity) Close() error {
+	if !atomic.CompareAndSwapUint64(&dev.atomicOnline, 1, 0) {
+		return errClosed
+	}
+
+	dev.ioMu.Lock() //Wait for outstanding IO
+	defer dev.ioMu.Unlock()
+
+	err := dev.data.Close()
+	if err != nil {
+		err = fmt.Errorf("Could not close data device: %w", err)
+	}
+	if closeErr := dev.hashDev.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("Could not close hash device: %w", closeErr)
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+package verity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/filedisk"
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+//createImage creates a file disk of random data and its hash tree
+func createImage(t *testing.T, sizeBytes int64, options ...Option) (data *filedisk.FileDisk, hashDev usbdlib.Device, image, root []byte) {
+	t.Helper()
+
+	data, err := filedisk.NewFileDisk(filepath.Join(t.TempDir(), "image.bin"), sizeBytes)
+	if err != nil {
+		t.Fatalf("Could not create file disk: %s", err)
+	}
+	t.Cleanup(func() { data.Close() })
+	image = make([]byte, sizeBytes)
+	rand.New(rand.NewSource(sizeBytes)).Read(image)
+	if _, err = data.WriteAt(image, 0); err != nil {
+		t.Fatalf("Could not write image: %s", err)
+	}
+
+	hashSize, err := HashSize(sizeBytes, options...)
+	if err != nil {
+		t.Fatalf("Could not size hash tree: %s", err)
+	}
+	hashDev = ramdisk.NewRAMDisk(hashSize)
+	if root, err = Format(data, hashDev, options...); err != nil {
+		t.Fatalf("Could not build hash tree: %s", err)
+	}
+	return data, hashDev, image, root
+}
+
+func openDev(t *testing.T, data, hashDev usbdlib.Device, root []byte, options ...Option) *Verity {
+	t.Helper()
+
+	dev, err := NewVerity(testutil.NewUnclosable(data), testutil.NewUnclosable(hashDev), root, options...)
+	if err != nil {
+		t.Fatalf("Could not open verity device: %s", err)
+	}
+	return dev
+}
+
+func TestVerity(t *testing.T) {
+	const sizeBytes = 1024 * 1024
+
+	for _, blockBytes := range []int64{512, 4096} {
+		t.Run(fmt.Sprintf("%d-byte-blocks", blockBytes), func(t *testing.T) {
+			data, hashDev, image, root := createImage(t, sizeBytes, OptBlockBytes(blockBytes))
+			dev := openDev(t, data, hashDev, root, OptCacheBytes(8*blockBytes))
+
+			testutil.TestDevSize(t, dev, sizeBytes)
+			if !usbdlib.IsReadOnly(dev) {
+				t.Fatalf("Device is not read-only")
+			}
+			sum := sha256.Sum256(image)
+			testutil.TestReadHash(t, dev, sum[:])
+
+			rnd := rand.New(rand.NewSource(1))
+			for i := 0; i < 200; i++ {
+				pos := rnd.Int63n(sizeBytes)
+				buf := make([]byte, 1+rnd.Intn(64*1024))
+				n, err := dev.ReadAt(buf, pos)
+				if err != nil && !(pos+int64(len(buf)) > sizeBytes && n == int(sizeBytes-pos)) {
+					t.Fatalf("Read of %d bytes at %d failed: %s", len(buf), pos, err)
+				} else if !bytes.Equal(buf[:n], image[pos:pos+int64(n)]) {
+					t.Fatalf("Read of %d bytes at %d returned the wrong data", len(buf), pos)
+				}
+			}
+
+			if _, err := dev.WriteAt([]byte{1}, 0); !errors.Is(err, errReadOnly) {
+				t.Fatalf("Write returned %v rather than %s", err, errReadOnly)
+			}
+			if err := dev.Trim(0, 4096); !errors.Is(err, errReadOnly) {
+				t.Fatalf("Trim returned %v rather than %s", err, errReadOnly)
+			}
+			testutil.TestClose(t, dev)
+		})
+	}
+}
+
+func TestTamper(t *testing.T) {
+	const (
+		sizeBytes  = 1024 * 1024
+		blockBytes = 512 //Small blocks so the tree has several levels
+	)
+
+	data, hashDev, image, root := createImage(t, sizeBytes, OptBlockBytes(blockBytes))
+	dev := openDev(t, data, hashDev, root)
+	defer dev.Close()
+
+	//Flipping any byte of the image causes reads of its block to fail
+	rnd := rand.New(rand.NewSource(1))
+	buf := make([]byte, 100)
+	for block := int64(0); block < sizeBytes/blockBytes; block++ {
+		pos := block*blockBytes + rnd.Int63n(blockBytes)
+		data.WriteAt([]byte{image[pos] ^ byte(1+rnd.Intn(255))}, pos)
+		if _, err := dev.ReadAt(buf, pos-pos%100); !errors.Is(err, ErrVerify) {
+			t.Fatalf("Read after flipping the byte at %d did not fail with ErrVerify: %v", pos, err)
+		}
+		data.WriteAt(image[pos:pos+1], pos)
+	}
+	if _, err := dev.ReadAt(make([]byte, sizeBytes), 0); err != nil {
+		t.Fatalf("Could not read restored image: %s", err)
+	}
+
+	//Flipping any byte of the hash tree is detected when it is opened or when the
+	// flipped block is verified
+	hashSize := hashDev.Size()
+	tree := make([]byte, hashSize)
+	hashDev.ReadAt(tree, 0)
+	for i := 0; i < 50; i++ {
+		pos := rnd.Int63n(hashSize)
+		hashDev.WriteAt([]byte{tree[pos] ^ 0x80}, pos)
+		if tampered, err := NewVerity(testutil.NewUnclosable(data), testutil.NewUnclosable(hashDev), root); err == nil {
+			if _, err = tampered.ReadAt(make([]byte, sizeBytes), 0); !errors.Is(err, ErrVerify) {
+				t.Fatalf("Read after flipping the byte at %d of the hash tree did not fail with ErrVerify: %v", pos, err)
+			}
+		}
+		hashDev.WriteAt(tree[pos:pos+1], pos)
+	}
+
+	wrongRoot := append([]byte{}, root...)
+	wrongRoot[0] ^= 1
+	if _, err := NewVerity(data, hashDev, wrongRoot); !errors.Is(err, ErrVerify) {
+		t.Fatalf("Opening with the wrong root hash did not fail with ErrVerify: %v", err)
+	}
+}
+
+func TestMaxBlockBytes(t *testing.T) {
+	const sizeBytes = 1024 * 1024
+
+	if _, err := HashSize(sizeBytes, OptBlockBytes(2*MaxBlockBytes)); err == nil {
+		t.Fatalf("Block size larger than %d was accepted", MaxBlockBytes)
+	}
+
+	//A header claiming huge blocks is refused before they are allocated
+	data, hashDev, _, root := createImage(t, sizeBytes)
+	huge := make([]byte, 12)
+	binary.LittleEndian.PutUint32(huge, 1<<30)
+	binary.LittleEndian.PutUint64(huge[4:], 1<<31)
+	hashDev.WriteAt(huge, int64(len(headerMagic)+2))
+	if _, err := NewVerity(data, hashDev, root); err == nil {
+		t.Fatalf("Hash tree with 1 GiB blocks was opened")
+	}
+}
@@ -0,0 +1,560 @@
+package iscsi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+//conn is a single initiator connection, since MaxConnections is always
+// negotiated to one it is also the session
+type conn struct {
+	tgt     *Target
+	netConn net.Conn
+	rdr     *bufio.Reader
+	params  sessionParams
+	isid    [6]byte
+	tsih    uint16
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	wtrMu          sync.Mutex
+	wtr            *bufio.Writer
+	statSN         uint32
+	atomicExpCmdSN uint32
+
+	taskMu   sync.Mutex
+	tasks    map[uint32]*task
+	nextTTT  uint32
+	taskSema chan struct{}
+	taskWg   sync.WaitGroup
+}
+
+//task is a SCSI write command awaiting solicited (R2T) data
+type task struct {
+	itt, ttt uint32
+	lun      uint64
+	dataCh   chan *pdu
+}
+
+func newConn(tgt *Target, netConn net.Conn) *conn {
+	ctx, cancel := context.WithCancel(tgt.ctx)
+	return &conn{
+		tgt:       tgt,
+		netConn:   netConn,
+		rdr:       bufio.NewReaderSize(netConn, 64*1024),
+		wtr:       bufio.NewWriterSize(netConn, 64*1024),
+		params:    newSessionParams(tgt.recvDataSegLen),
+		ctx:       ctx,
+		ctxCancel: cancel,
+		tasks:     make(map[uint32]*task),
+		taskSema:  make(chan struct{}, tgt.queueDepth),
+	}
+}
+
+//serve runs the login phase and then the full feature phase until logout or
+// connection failure
+func (c *conn) serve() error {
+	defer func() {
+		c.ctxCancel()
+		c.taskWg.Wait()
+		c.netConn.Close()
+	}()
+
+	if err := c.login(); err != nil {
+		return fmt.Errorf("Login failed: %w", err)
+	}
+	return c.fullFeature()
+}
+
+//maxLoginTextBytes limits the text of a login request spanning multiple PDUs
+const maxLoginTextBytes = 64 * 1024
+
+//login runs the login phase (security and operational negotiation stages)
+func (c *conn) login() error {
+	var (
+		pending      []byte
+		first        = true
+		declaredRecv bool
+	)
+
+	for {
+		req, err := readPDU(c.rdr, c.tgt.recvDataSegLen)
+		if err != nil {
+			return err
+		}
+		if req.opcode() != opLoginReq {
+			return fmt.Errorf("Received opcode %#x before login completed: %w", req.opcode(), errProtocol)
+		}
+
+		flags := req.flags()
+		transit, cont := flags&transitFlag != 0, flags&continueFlag != 0
+		csg, nsg := (flags>>2)&0x3, flags&0x3
+		cmdSN := req.uint32At(24)
+		if first {
+			copy(c.isid[:], req.bhs[8:14])
+			atomic.StoreUint32(&c.atomicExpCmdSN, cmdSN)
+			c.statSN = req.uint32At(28)
+			first = false
+		}
+
+		resp := newPDU(opLoginResp)
+		copy(resp.bhs[8:14], c.isid[:])
+		resp.putUint32(16, req.itt())
+
+		//Text spanning multiple PDUs is acknowledged with empty responses, up to a
+		// limit so unauthenticated initiators can not exhaust memory
+		if len(pending)+len(req.data) > maxLoginTextBytes {
+			return c.loginReject(resp, loginStatusInitErr, 0)
+		}
+		pending = append(pending, req.data...)
+		if cont {
+			resp.bhs[1] = csg<<2 | nsg
+			if err = c.sendLogin(resp); err != nil {
+				return err
+			}
+			continue
+		}
+
+		offered, err := parseText(pending)
+		pending = pending[:0]
+		if err != nil {
+			return c.loginReject(resp, loginStatusInitErr, 0)
+		}
+
+		var replies []keyVal
+		switch csg {
+		case stageSecurity, stageOperational:
+			if replies, err = c.params.negotiate(offered); err != nil {
+				return c.loginReject(resp, loginStatusInitErr, 0)
+			}
+		default:
+			return c.loginReject(resp, loginStatusInitErr, 0)
+		}
+
+		if c.params.sessionType == valNormal {
+			switch {
+			case c.params.targetName == "":
+				return c.loginReject(resp, loginStatusInitErr, loginDetailMissing)
+			case c.params.targetName != c.tgt.name:
+				return c.loginReject(resp, loginStatusInitErr, loginDetailNotFound)
+			}
+		}
+		if csg == stageSecurity {
+			if _, sent := lookupKey(offered, keyAuthMethod); !sent {
+				replies = append(replies, keyVal{key: keyAuthMethod, val: valNone})
+			}
+			replies = append(replies, keyVal{key: keyTargetPortalGroup, val: "1"})
+			if c.tgt.alias != "" {
+				replies = append(replies, keyVal{key: keyTargetAlias, val: c.tgt.alias})
+			}
+		}
+		if !declaredRecv && (csg == stageOperational || transit && nsg == stageFullFeature) {
+			replies = append(replies, keyVal{key: keyMaxRecvDataSegLen, val: fmt.Sprint(c.params.recvDataSegLen)})
+			declaredRecv = true
+		}
+		resp.data = encodeText(replies)
+
+		if !transit {
+			resp.bhs[1] = csg<<2 | nsg
+			if err = c.sendLogin(resp); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if nsg <= csg || nsg == 2 {
+			return c.loginReject(resp, loginStatusInitErr, 0)
+		}
+		resp.bhs[1] = transitFlag | csg<<2 | nsg
+		if nsg == stageFullFeature {
+			c.tsih = c.tgt.nextTSIH()
+			resp.putUint16(14, c.tsih)
+		}
+		if err = c.sendLogin(resp); err != nil {
+			return err
+		}
+		if nsg == stageFullFeature {
+			return nil
+		}
+	}
+}
+
+func (c *conn) sendLogin(resp *pdu) error {
+	resp.bhs[2], resp.bhs[3] = loginVersion, loginVersion
+	return c.send(resp, true)
+}
+
+//loginReject sends a failed login status and returns an error describing it
+func (c *conn) loginReject(resp *pdu, class, detail byte) error {
+	resp.bhs[1] = 0
+	resp.data = nil
+	resp.bhs[36], resp.bhs[37] = class, detail
+	if err := c.sendLogin(resp); err != nil {
+		return err
+	}
+	return fmt.Errorf("Login rejected with status class %#x detail %#x", class, detail)
+}
+
+//fullFeature processes PDUs until logout, failure or target shutdown
+func (c *conn) fullFeature() error {
+	for {
+		req, err := readPDU(c.rdr, c.tgt.recvDataSegLen)
+		if err != nil {
+			if errors.Is(err, io.EOF) || c.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		if req.opcode() != opDataOut && !req.immediate() {
+			atomic.CompareAndSwapUint32(&c.atomicExpCmdSN, req.uint32At(24), req.uint32At(24)+1)
+		}
+
+		switch req.opcode() {
+		case opNopOut:
+			err = c.handleNop(req)
+		case opSCSICmd:
+			err = c.handleCommand(req)
+		case opDataOut:
+			c.handleDataOut(req)
+		case opTextReq:
+			err = c.handleText(req)
+		case opTaskMgmtReq:
+			err = c.handleTaskMgmt(req)
+		case opLogoutReq:
+			return c.handleLogout(req)
+		default:
+			err = c.reject(req, rejectCmdNotSupported)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *conn) handleNop(req *pdu) error {
+	if req.itt() == reservedTag { //response to a target ping
+		return nil
+	}
+
+	resp := newPDU(opNopIn)
+	resp.bhs[1] = finalFlag
+	copy(resp.bhs[8:16], req.bhs[8:16])
+	resp.putUint32(16, req.itt())
+	resp.putUint32(20, reservedTag)
+	resp.data = req.data
+	return c.send(resp, true)
+}
+
+func (c *conn) handleText(req *pdu) error {
+	offered, err := parseText(req.data)
+	if err != nil {
+		return c.reject(req, rejectInvalidPDU)
+	}
+
+	var replies []keyVal
+	for _, kv := range offered {
+		if kv.key != keySendTargets {
+			replies = append(replies, keyVal{key: kv.key, val: valNotUnderstood})
+			continue
+		}
+		if kv.val == valAll || kv.val == c.tgt.name || kv.val == "" && c.params.sessionType == valNormal {
+			addr := c.tgt.advertiseAddr
+			if addr == "" {
+				addr = c.netConn.LocalAddr().String()
+			}
+			replies = append(replies,
+				keyVal{key: keyTargetName, val: c.tgt.name},
+				keyVal{key: keyTargetAddress, val: addr + ",1"},
+			)
+		}
+	}
+
+	resp := newPDU(opTextResp)
+	resp.bhs[1] = finalFlag
+	resp.putUint32(16, req.itt())
+	resp.putUint32(20, reservedTag)
+	resp.data = encodeText(replies)
+	return c.send(resp, true)
+}
+
+func (c *conn) handleTaskMgmt(req *pdu) error {
+	response := byte(tmfComplete)
+	switch req.flags() & 0x7f {
+	case tmfAbortTask:
+		c.taskMu.Lock()
+		if t := c.tasks[req.uint32At(20)]; t != nil {
+			close(t.dataCh)
+			delete(c.tasks, t.itt)
+		}
+		c.taskMu.Unlock()
+	case tmfLUNReset, tmfTargetReset:
+	default:
+		response = tmfNotSupported
+	}
+
+	resp := newPDU(opTaskMgmtResp)
+	resp.bhs[1] = finalFlag
+	resp.bhs[2] = response
+	resp.putUint32(16, req.itt())
+	return c.send(resp, true)
+}
+
+func (c *conn) handleLogout(req *pdu) error {
+	c.taskWg.Wait()
+
+	resp := newPDU(opLogoutResp)
+	resp.bhs[1] = finalFlag
+	resp.putUint32(16, req.itt())
+	return c.send(resp, true)
+}
+
+func (c *conn) reject(req *pdu, reason byte) error {
+	resp := newPDU(opReject)
+	resp.bhs[1] = finalFlag
+	resp.bhs[2] = reason
+	resp.putUint32(16, reservedTag)
+	resp.data = append([]byte(nil), req.bhs[:]...)
+	return c.send(resp, true)
+}
+
+//handleCommand dispatches a SCSI command for asynchronous execution, first
+// soliciting any write data not sent as immediate data
+func (c *conn) handleCommand(req *pdu) error {
+	if c.params.sessionType != valNormal {
+		return c.reject(req, rejectCmdNotSupported)
+	}
+
+	select {
+	case c.taskSema <- struct{}{}:
+	default: //initiator ignored our MaxCmdSN window
+		return c.sendStatus(req, scsiResult{status: scsiStatusTaskSetFull})
+	}
+	c.taskWg.Add(1)
+
+	expLen := int(req.uint32At(20))
+	write := req.flags()&cmdWriteFlag != 0
+	if !write || len(req.data) >= expLen {
+		go c.execute(req, req.data)
+		return nil
+	}
+
+	if expLen > maxTransferBytes {
+		c.finishTask()
+		return c.sendStatus(req, checkCondition(senseIllegalRequest, ascInvalidCDBField, 0))
+	}
+
+	c.taskMu.Lock()
+	c.nextTTT++
+	if c.nextTTT == reservedTag {
+		c.nextTTT = 0
+	}
+	t := &task{itt: req.itt(), ttt: c.nextTTT, lun: req.lun(), dataCh: make(chan *pdu, 16)}
+	c.tasks[t.itt] = t
+	c.taskMu.Unlock()
+
+	go func() {
+		data, err := c.solicitData(t, req.data, expLen)
+		c.taskMu.Lock()
+		if c.tasks[t.itt] == t {
+			delete(c.tasks, t.itt)
+		}
+		c.taskMu.Unlock()
+
+		if err != nil {
+			c.finishTask()
+			if !errors.Is(err, context.Canceled) {
+				c.netConn.Close()
+			}
+			return
+		}
+		c.execute(req, data)
+	}()
+	return nil
+}
+
+func (c *conn) handleDataOut(req *pdu) {
+	c.taskMu.Lock()
+	t := c.tasks[req.itt()]
+	c.taskMu.Unlock()
+	if t == nil || req.uint32At(20) != t.ttt {
+		return //stale data for an aborted or unknown task
+	}
+
+	select {
+	case t.dataCh <- req:
+	case <-c.ctx.Done():
+	}
+}
+
+//solicitData collects write data for a task by issuing R2Ts in bursts of at
+// most MaxBurstLength bytes
+func (c *conn) solicitData(t *task, immediate []byte, expLen int) ([]byte, error) {
+	data := make([]byte, expLen)
+	received := copy(data, immediate)
+
+	for r2tSN := uint32(0); received < expLen; r2tSN++ {
+		burst := expLen - received
+		if burst > c.params.maxBurstLen {
+			burst = c.params.maxBurstLen
+		}
+
+		r2t := newPDU(opR2T)
+		r2t.bhs[1] = finalFlag
+		r2t.setLUN(t.lun)
+		r2t.putUint32(16, t.itt)
+		r2t.putUint32(20, t.ttt)
+		r2t.putUint32(36, r2tSN)
+		r2t.putUint32(40, uint32(received))
+		r2t.putUint32(44, uint32(burst))
+		if err := c.send(r2t, false); err != nil {
+			return nil, err
+		}
+
+		got := 0
+		for got < burst {
+			var dataOut *pdu
+			var open bool
+			select {
+			case dataOut, open = <-t.dataCh:
+				if !open {
+					return nil, context.Canceled
+				}
+			case <-c.ctx.Done():
+				return nil, c.ctx.Err()
+			}
+
+			offset := int(dataOut.uint32At(40))
+			if offset < received || offset+len(dataOut.data) > received+burst {
+				return nil, fmt.Errorf("Data-Out at offset %d (%d bytes) was outside of solicited range: %w", offset, len(dataOut.data), errProtocol)
+			}
+			copy(data[offset:], dataOut.data)
+			got += len(dataOut.data)
+			if dataOut.final() {
+				break
+			}
+		}
+		if got != burst {
+			return nil, fmt.Errorf("Data-Out sequence ended after %d of %d solicited bytes: %w", got, burst, errProtocol)
+		}
+		received += burst
+	}
+	return data, nil
+}
+
+func (c *conn) finishTask() {
+	<-c.taskSema
+	c.taskWg.Done()
+}
+
+//execute runs a SCSI command against its logical unit and sends the results
+func (c *conn) execute(req *pdu, dataOut []byte) {
+	defer c.finishTask()
+
+	result := c.tgt.execSCSI(req.lun(), req.cdb(), dataOut)
+	var err error
+	if result.status == scsiStatusGood && len(result.data) > 0 && req.flags()&cmdReadFlag != 0 {
+		err = c.sendDataIn(req, result.data)
+	} else {
+		err = c.sendStatus(req, result)
+	}
+	if err != nil {
+		c.netConn.Close()
+	}
+}
+
+//sendDataIn sends read data in PDUs no larger than the initiator's declared
+// MaxRecvDataSegmentLength, with status collapsed into the final PDU
+func (c *conn) sendDataIn(req *pdu, data []byte) error {
+	expLen := int(req.uint32At(20))
+	var flags byte
+	var residual uint32
+	switch {
+	case len(data) > expLen:
+		flags, residual = respOverflowFlag, uint32(len(data)-expLen)
+		data = data[:expLen]
+	case len(data) < expLen:
+		flags, residual = respUnderflowFlag, uint32(expLen-len(data))
+	}
+
+	segLen := c.params.sendDataSegLen
+	for offset, dataSN := 0, uint32(0); ; dataSN++ {
+		end := offset + segLen
+		if end > len(data) {
+			end = len(data)
+		}
+		last := end == len(data)
+
+		resp := newPDU(opDataIn)
+		resp.putUint32(16, req.itt())
+		resp.putUint32(20, reservedTag)
+		resp.putUint32(36, dataSN)
+		resp.putUint32(40, uint32(offset))
+		resp.data = data[offset:end]
+		if last {
+			resp.bhs[1] = finalFlag | dataInStatusFlag | flags
+			resp.bhs[3] = scsiStatusGood
+			resp.putUint32(44, residual)
+		}
+		if err := c.send(resp, last); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		offset = end
+	}
+}
+
+//sendStatus sends a SCSI response PDU (with sense data if present)
+func (c *conn) sendStatus(req *pdu, result scsiResult) error {
+	resp := newPDU(opSCSIResp)
+	resp.bhs[1] = finalFlag
+	resp.bhs[3] = result.status
+	resp.putUint32(16, req.itt())
+
+	if expLen := int(req.uint32At(20)); req.flags()&cmdReadFlag != 0 && expLen > len(result.data) {
+		resp.bhs[1] |= respUnderflowFlag
+		resp.putUint32(44, uint32(expLen-len(result.data)))
+	}
+	if len(result.sense) > 0 {
+		resp.data = make([]byte, 2+len(result.sense))
+		binary.BigEndian.PutUint16(resp.data, uint16(len(result.sense)))
+		copy(resp.data[2:], result.sense)
+	}
+	return c.send(resp, true)
+}
+
+//send writes a PDU filling in sequence numbers, if withStatus is true the
+// PDU carries (and consumes) a StatSN
+func (c *conn) send(resp *pdu, withStatus bool) error {
+	c.wtrMu.Lock()
+	defer c.wtrMu.Unlock()
+
+	switch {
+	case withStatus:
+		resp.putUint32(24, c.statSN)
+		c.statSN++
+	case resp.opcode() == opR2T:
+		resp.putUint32(24, c.statSN)
+	}
+
+	//The command window only opens as far as we have free task slots
+	expCmdSN := atomic.LoadUint32(&c.atomicExpCmdSN)
+	free := uint32(cap(c.taskSema) - len(c.taskSema))
+	resp.putUint32(28, expCmdSN)
+	resp.putUint32(32, expCmdSN+free-1)
+
+	if err := resp.writeTo(c.wtr); err != nil {
+		return err
+	}
+	return c.wtr.Flush()
+}
@@ -0,0 +1,151 @@
+package iscsi
+
+import (
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+//iSCSI protocol details: https://datatracker.ietf.org/doc/html/rfc7143
+
+const (
+	errClosed    = consterr.ConstErr("Target is shutdown")
+	errLUNExists = consterr.ConstErr("LUN is already in use")
+	errProtocol  = consterr.ConstErr("iSCSI protocol violation")
+)
+
+//DefPort is the IANA assigned iSCSI port
+const DefPort = 3260
+
+//Initiator opcodes
+const (
+	opNopOut      = 0x00
+	opSCSICmd     = 0x01
+	opTaskMgmtReq = 0x02
+	opLoginReq    = 0x03
+	opTextReq     = 0x04
+	opDataOut     = 0x05
+	opLogoutReq   = 0x06
+	opSNACKReq    = 0x10
+)
+
+//Target opcodes
+const (
+	opNopIn        = 0x20
+	opSCSIResp     = 0x21
+	opTaskMgmtResp = 0x22
+	opLoginResp    = 0x23
+	opTextResp     = 0x24
+	opDataIn       = 0x25
+	opLogoutResp   = 0x26
+	opR2T          = 0x31
+	opReject       = 0x3f
+)
+
+//BHS (basic header segment) layout
+const (
+	bhsLen        = 48
+	immediateFlag = 0x40
+	opcodeMask    = 0x3f
+	finalFlag     = 0x80
+	continueFlag  = 0x40
+	reservedTag   = 0xffffffff
+)
+
+//SCSI command flags (BHS byte 1)
+const (
+	cmdReadFlag  = 0x40
+	cmdWriteFlag = 0x20
+)
+
+//Data-In / SCSI response flags
+const (
+	dataInStatusFlag    = 0x01
+	respOverflowFlag    = 0x04
+	respUnderflowFlag   = 0x02
+	transitFlag         = 0x80
+	stageSecurity       = 0
+	stageOperational    = 1
+	stageFullFeature    = 3
+	loginVersion        = 0x00
+	loginStatusSuccess  = 0x00
+	loginStatusInitErr  = 0x02
+	loginDetailNotFound = 0x03
+	loginDetailMissing  = 0x07
+)
+
+//Reject reasons
+const (
+	rejectCmdNotSupported = 0x05
+	rejectInvalidPDU      = 0x09
+)
+
+//Task management functions and responses
+const (
+	tmfComplete     = 0x00
+	tmfNotSupported = 0x05
+	tmfAbortTask    = 0x01
+	tmfLUNReset     = 0x05
+	tmfTargetReset  = 0x06
+)
+
+//SCSI status codes
+const (
+	scsiStatusGood           = 0x00
+	scsiStatusCheckCondition = 0x02
+	scsiStatusTaskSetFull    = 0x28
+)
+
+//SCSI sense keys, additional sense codes (ASC) and qualifiers (ASCQ)
+const (
+	senseNoSense        = 0x00
+	senseMediumError    = 0x03
+	senseIllegalRequest = 0x05
+	senseDataProtect    = 0x07
+
+	ascNone            = 0x00
+	ascWriteError      = 0x0c
+	ascReadError       = 0x11
+	ascInvalidOpcode   = 0x20
+	ascLBAOutOfRange   = 0x21
+	ascInvalidCDBField = 0x24
+	ascLUNNotSupported = 0x25
+	ascParamListLength = 0x1a
+	ascWriteProtected  = 0x27
+)
+
+//SCSI operation codes (SPC-4 & SBC-3)
+const (
+	scsiTestUnitReady  = 0x00
+	scsiRequestSense   = 0x03
+	scsiRead6          = 0x08
+	scsiWrite6         = 0x0a
+	scsiInquiry        = 0x12
+	scsiModeSelect6    = 0x15
+	scsiModeSense6     = 0x1a
+	scsiStartStopUnit  = 0x1b
+	scsiPreventAllow   = 0x1e
+	scsiReadCapacity10 = 0x25
+	scsiRead10         = 0x28
+	scsiWrite10        = 0x2a
+	scsiVerify10       = 0x2f
+	scsiSyncCache10    = 0x35
+	scsiUnmap          = 0x42
+	scsiModeSense10    = 0x5a
+	scsiRead16         = 0x88
+	scsiWrite16        = 0x8a
+	scsiVerify16       = 0x8f
+	scsiSyncCache16    = 0x91
+	scsiServiceIn16    = 0x9e
+	scsiReportLUNs     = 0xa0
+
+	saReadCapacity16 = 0x10
+)
+
+//Vital product data (VPD) pages returned by INQUIRY
+const (
+	vpdSupportedPages  = 0x00
+	vpdUnitSerial      = 0x80
+	vpdDeviceID        = 0x83
+	vpdBlockLimits     = 0xb0
+	vpdBlockDevChars   = 0xb1
+	vpdLogicalBlkProvn = 0xb2
+)
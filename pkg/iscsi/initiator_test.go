@@ -0,0 +1,426 @@
+package iscsi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	testInitiatorName = "iqn.2022-01.io.usbd.test:initiator"
+	errCmdFailed      = consterr.ConstErr("SCSI command did not complete with good status")
+)
+
+//initiator is a minimal iSCSI initiator used to test the target in-process,
+// commands are issued one at a time
+type initiator struct {
+	conn            net.Conn
+	rdr             *bufio.Reader
+	cmdMu           sync.Mutex
+	itt             uint32
+	cmdSN           uint32
+	expStatSN       uint32
+	tgtRecvSegLen   int
+	firstBurstLen   int
+	immediateData   bool
+	loginResponseKV []keyVal
+}
+
+func dialInitiator(addr, targetName, sessionType string) (*initiator, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not dial target: %w", err)
+	}
+
+	ini := &initiator{
+		conn:          conn,
+		rdr:           bufio.NewReader(conn),
+		tgtRecvSegLen: defMaxRecvDataSegLen,
+		firstBurstLen: defFirstBurstLen,
+	}
+
+	security := []keyVal{
+		{keyInitiatorName, testInitiatorName},
+		{keySessionType, sessionType},
+		{keyAuthMethod, valNone},
+	}
+	if targetName != "" {
+		security = append(security, keyVal{keyTargetName, targetName})
+	}
+	operational := []keyVal{
+		{keyHeaderDigest, valNone},
+		{keyDataDigest, valNone},
+		{keyInitialR2T, valYes},
+		{keyImmediateData, valYes},
+		{keyMaxRecvDataSegLen, "65536"},
+		{keyMaxBurstLen, "262144"},
+		{keyFirstBurstLen, "65536"},
+	}
+
+	if err = ini.loginStage(stageSecurity, stageOperational, security); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = ini.loginStage(stageOperational, stageFullFeature, operational); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ini, nil
+}
+
+func (ini *initiator) loginStage(csg, nsg byte, kvs []keyVal) error {
+	req := newPDU(opLoginReq | immediateFlag)
+	req.bhs[1] = transitFlag | csg<<2 | nsg
+	copy(req.bhs[8:14], []byte{0x80, 0, 0, 0, 0, 1})
+	req.putUint32(16, ini.itt)
+	req.putUint32(24, ini.cmdSN)
+	req.putUint32(28, ini.expStatSN)
+	req.data = encodeText(kvs)
+	ini.itt++
+
+	if err := req.writeTo(ini.conn); err != nil {
+		return err
+	}
+	resp, err := readPDU(ini.rdr, 1<<24)
+	if err != nil {
+		return fmt.Errorf("Could not read login response: %w", err)
+	}
+	switch {
+	case resp.opcode() != opLoginResp:
+		return fmt.Errorf("Expected login response but got opcode %#x", resp.opcode())
+	case resp.bhs[36] != loginStatusSuccess:
+		return fmt.Errorf("Login failed with status class %#x detail %#x", resp.bhs[36], resp.bhs[37])
+	case resp.flags()&transitFlag == 0 || resp.flags()&0x3 != nsg:
+		return fmt.Errorf("Target did not transition to stage %d", nsg)
+	case nsg == stageFullFeature && resp.uint16At(14) == 0:
+		return fmt.Errorf("Target did not assign a TSIH")
+	}
+	ini.expStatSN = resp.uint32At(24) + 1
+
+	replies, err := parseText(resp.data)
+	if err != nil {
+		return err
+	}
+	ini.loginResponseKV = append(ini.loginResponseKV, replies...)
+	for _, kv := range replies {
+		switch kv.key {
+		case keyMaxRecvDataSegLen:
+			ini.tgtRecvSegLen, _ = strconv.Atoi(kv.val)
+		case keyFirstBurstLen:
+			ini.firstBurstLen, _ = strconv.Atoi(kv.val)
+		case keyImmediateData:
+			ini.immediateData = kv.val == valYes
+		}
+	}
+	return nil
+}
+
+//command executes a SCSI command, returning read data and sense data if any
+func (ini *initiator) command(lun uint64, cdb []byte, dataOut []byte, readLen int) (data []byte, status byte, sense []byte, err error) {
+	ini.cmdMu.Lock()
+	defer ini.cmdMu.Unlock()
+
+	itt := ini.itt
+	ini.itt++
+
+	req := newPDU(opSCSICmd)
+	req.bhs[1] = finalFlag
+	expLen := readLen
+	if dataOut != nil {
+		req.bhs[1] |= cmdWriteFlag
+		expLen = len(dataOut)
+	} else if readLen > 0 {
+		req.bhs[1] |= cmdReadFlag
+	}
+	req.setLUN(lun)
+	req.putUint32(16, itt)
+	req.putUint32(20, uint32(expLen))
+	req.putUint32(24, ini.cmdSN)
+	req.putUint32(28, ini.expStatSN)
+	copy(req.cdb(), cdb)
+	if ini.immediateData && len(dataOut) > 0 {
+		req.data = dataOut[:min(len(dataOut), min(ini.firstBurstLen, ini.tgtRecvSegLen))]
+	}
+	ini.cmdSN++
+
+	if err = req.writeTo(ini.conn); err != nil {
+		return nil, 0, nil, err
+	}
+
+	data = make([]byte, readLen)
+	for {
+		resp, err := readPDU(ini.rdr, 1<<24)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("Could not read response: %w", err)
+		}
+
+		switch resp.opcode() {
+		case opDataIn:
+			offset := int(resp.uint32At(40))
+			if offset+len(resp.data) > len(data) {
+				return nil, 0, nil, fmt.Errorf("Data-In at offset %d exceeds expected length", offset)
+			}
+			copy(data[offset:], resp.data)
+			if resp.flags()&dataInStatusFlag != 0 {
+				ini.expStatSN = resp.uint32At(24) + 1
+				if resp.flags()&respUnderflowFlag != 0 {
+					data = data[:len(data)-int(resp.uint32At(44))]
+				}
+				return data, resp.bhs[3], nil, nil
+			}
+
+		case opR2T:
+			if err = ini.sendDataOut(resp, dataOut); err != nil {
+				return nil, 0, nil, err
+			}
+
+		case opSCSIResp:
+			ini.expStatSN = resp.uint32At(24) + 1
+			if len(resp.data) >= 2 {
+				senseLen := int(binary.BigEndian.Uint16(resp.data))
+				sense = resp.data[2 : 2+senseLen]
+			}
+			if resp.flags()&respUnderflowFlag != 0 {
+				data = data[:len(data)-int(resp.uint32At(44))]
+			}
+			return data, resp.bhs[3], sense, nil
+
+		case opNopIn, opReject:
+			if resp.opcode() == opReject {
+				return nil, 0, nil, fmt.Errorf("Target rejected command with reason %#x", resp.bhs[2])
+			}
+
+		default:
+			return nil, 0, nil, fmt.Errorf("Unexpected opcode %#x during command", resp.opcode())
+		}
+	}
+}
+
+//sendDataOut answers an R2T with Data-Out PDUs no larger than the target allows
+func (ini *initiator) sendDataOut(r2t *pdu, dataOut []byte) error {
+	offset, length := int(r2t.uint32At(40)), int(r2t.uint32At(44))
+	end := offset + length
+	for dataSN := uint32(0); offset < end; dataSN++ {
+		segEnd := min(offset+ini.tgtRecvSegLen, end)
+
+		out := newPDU(opDataOut)
+		if segEnd == end {
+			out.bhs[1] = finalFlag
+		}
+		copy(out.bhs[8:16], r2t.bhs[8:16])
+		out.putUint32(16, r2t.itt())
+		out.putUint32(20, r2t.uint32At(20))
+		out.putUint32(28, ini.expStatSN)
+		out.putUint32(36, dataSN)
+		out.putUint32(40, uint32(offset))
+		out.data = dataOut[offset:segEnd]
+		if err := out.writeTo(ini.conn); err != nil {
+			return err
+		}
+		offset = segEnd
+	}
+	return nil
+}
+
+//text sends a text request and returns the target's replies
+func (ini *initiator) text(kvs []keyVal) ([]keyVal, error) {
+	ini.cmdMu.Lock()
+	defer ini.cmdMu.Unlock()
+
+	req := newPDU(opTextReq)
+	req.bhs[1] = finalFlag
+	req.putUint32(16, ini.itt)
+	req.putUint32(20, reservedTag)
+	req.putUint32(24, ini.cmdSN)
+	req.putUint32(28, ini.expStatSN)
+	req.data = encodeText(kvs)
+	ini.itt++
+	ini.cmdSN++
+
+	if err := req.writeTo(ini.conn); err != nil {
+		return nil, err
+	}
+	resp, err := readPDU(ini.rdr, 1<<24)
+	if err != nil {
+		return nil, err
+	} else if resp.opcode() != opTextResp {
+		return nil, fmt.Errorf("Expected text response but got opcode %#x", resp.opcode())
+	}
+	ini.expStatSN = resp.uint32At(24) + 1
+	return parseText(resp.data)
+}
+
+//logout ends the session and closes the connection
+func (ini *initiator) logout() error {
+	ini.cmdMu.Lock()
+	defer ini.cmdMu.Unlock()
+	defer ini.conn.Close()
+
+	req := newPDU(opLogoutReq | immediateFlag)
+	req.bhs[1] = finalFlag
+	req.putUint32(16, ini.itt)
+	req.putUint32(24, ini.cmdSN)
+	req.putUint32(28, ini.expStatSN)
+	if err := req.writeTo(ini.conn); err != nil {
+		return err
+	}
+	resp, err := readPDU(ini.rdr, 1<<24)
+	if err != nil {
+		return err
+	} else if resp.opcode() != opLogoutResp || resp.bhs[2] != 0 {
+		return fmt.Errorf("Logout failed: opcode %#x, response %d", resp.opcode(), resp.bhs[2])
+	}
+	return nil
+}
+
+//initiatorDevice adapts a LUN accessed through an initiator to usbdlib.Device
+// so the standard device test suites can be run end-to-end over iSCSI
+type initiatorDevice struct {
+	ini             *initiator
+	lun             uint64
+	size, blockSize int64
+	closed          bool
+}
+
+func newInitiatorDevice(ini *initiator, lun uint64) (*initiatorDevice, error) {
+	cdb := make([]byte, 16)
+	cdb[0], cdb[1] = scsiServiceIn16, saReadCapacity16
+	binary.BigEndian.PutUint32(cdb[10:], 32)
+	data, status, _, err := ini.command(lun, cdb, nil, 32)
+	switch {
+	case err != nil:
+		return nil, err
+	case status != scsiStatusGood:
+		return nil, errCmdFailed
+	}
+
+	blockSize := int64(binary.BigEndian.Uint32(data[8:]))
+	return &initiatorDevice{
+		ini:       ini,
+		lun:       lun,
+		blockSize: blockSize,
+		size:      int64(binary.BigEndian.Uint64(data)+1) * blockSize,
+	}, nil
+}
+
+func (dev *initiatorDevice) Size() int64      { return dev.size }
+func (dev *initiatorDevice) BlockSize() int64 { return dev.blockSize }
+
+func (dev *initiatorDevice) rw(lba uint64, blocks int, dataOut []byte) ([]byte, error) {
+	if dev.closed {
+		return nil, errClosed
+	}
+
+	cdb := make([]byte, 16)
+	cdb[0] = scsiRead16
+	if dataOut != nil {
+		cdb[0] = scsiWrite16
+	}
+	binary.BigEndian.PutUint64(cdb[2:], lba)
+	binary.BigEndian.PutUint32(cdb[10:], uint32(blocks))
+
+	readLen := 0
+	if dataOut == nil {
+		readLen = blocks * int(dev.blockSize)
+	}
+	data, status, _, err := dev.ini.command(dev.lun, cdb, dataOut, readLen)
+	if err != nil {
+		return nil, err
+	} else if status != scsiStatusGood {
+		return nil, errCmdFailed
+	}
+	return data, nil
+}
+
+//alignedSpan returns the block aligned LBA range covering [pos, pos+count)
+func (dev *initiatorDevice) alignedSpan(pos int64, count int) (lba uint64, blocks int, skip int64) {
+	start := pos / dev.blockSize * dev.blockSize
+	end := (pos + int64(count) + dev.blockSize - 1) / dev.blockSize * dev.blockSize
+	return uint64(start / dev.blockSize), int((end - start) / dev.blockSize), pos - start
+}
+
+func (dev *initiatorDevice) ReadAt(buf []byte, pos int64) (int, error) {
+	if pos >= dev.size {
+		return 0, io.EOF
+	}
+	var err error
+	if end := pos + int64(len(buf)); end > dev.size {
+		buf, err = buf[:dev.size-pos], io.EOF
+	}
+
+	lba, blocks, skip := dev.alignedSpan(pos, len(buf))
+	data, rwErr := dev.rw(lba, blocks, nil)
+	if rwErr != nil {
+		return 0, rwErr
+	}
+	return copy(buf, data[skip:]), err
+}
+
+func (dev *initiatorDevice) WriteAt(buf []byte, pos int64) (int, error) {
+	if pos+int64(len(buf)) > dev.size {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	lba, blocks, skip := dev.alignedSpan(pos, len(buf))
+	data := buf
+	if skip != 0 || len(buf) != blocks*int(dev.blockSize) {
+		var err error
+		if data, err = dev.rw(lba, blocks, nil); err != nil {
+			return 0, err
+		}
+		copy(data[skip:], buf)
+	}
+	if _, err := dev.rw(lba, blocks, data); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (dev *initiatorDevice) Trim(pos int64, count int) error {
+	if dev.closed {
+		return errClosed
+	}
+
+	params := make([]byte, 24)
+	binary.BigEndian.PutUint16(params, 22)
+	binary.BigEndian.PutUint16(params[2:], 16)
+	binary.BigEndian.PutUint64(params[8:], uint64(pos/dev.blockSize))
+	binary.BigEndian.PutUint32(params[16:], uint32(int64(count)/dev.blockSize))
+
+	cdb := make([]byte, 10)
+	cdb[0] = scsiUnmap
+	binary.BigEndian.PutUint16(cdb[7:], uint16(len(params)))
+	_, status, _, err := dev.ini.command(dev.lun, cdb, params, 0)
+	if err == nil && status != scsiStatusGood {
+		err = errCmdFailed
+	}
+	return err
+}
+
+func (dev *initiatorDevice) Flush() error {
+	if dev.closed {
+		return errClosed
+	}
+
+	cdb := make([]byte, 16)
+	cdb[0] = scsiSyncCache16
+	_, status, _, err := dev.ini.command(dev.lun, cdb, nil, 0)
+	if err == nil && status != scsiStatusGood {
+		err = errCmdFailed
+	}
+	return err
+}
+
+func (dev *initiatorDevice) Close() error {
+	if dev.closed {
+		return nil
+	}
+	dev.closed = true
+	return dev.ini.logout()
+}
@@ -0,0 +1,395 @@
+package iscsi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/devices/testutil"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+const testTargetName = "iqn.2022-01.io.usbd.test:target"
+
+//recordingDev wraps a device recording trim and flush requests
+type recordingDev struct {
+	usbdlib.Device
+	mu      sync.Mutex
+	trims   [][2]int64
+	flushes int
+}
+
+func (dev *recordingDev) Trim(pos int64, count int) error {
+	dev.mu.Lock()
+	dev.trims = append(dev.trims, [2]int64{pos, int64(count)})
+	dev.mu.Unlock()
+	return dev.Device.Trim(pos, count)
+}
+
+func (dev *recordingDev) Flush() error {
+	dev.mu.Lock()
+	dev.flushes++
+	dev.mu.Unlock()
+	return dev.Device.Flush()
+}
+
+func startTarget(t *testing.T, luns map[uint64]usbdlib.Device) (tgt *Target, addr string) {
+	tgt, err := NewTarget(context.Background(), testTargetName, OptTargetAlias("usbd-test"))
+	if err != nil {
+		t.Fatalf("Could not create target: %s", err)
+	}
+	for id, dev := range luns {
+		if err = tgt.AddLUN(id, dev); err != nil {
+			t.Fatalf("Could not add LUN %d: %s", id, err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	go tgt.Serve(ln)
+	t.Cleanup(func() {
+		if err := tgt.Close(); err != nil {
+			t.Errorf("Could not close target: %s", err)
+		}
+	})
+	return tgt, ln.Addr().String()
+}
+
+func TestTarget(t *testing.T) {
+	const (
+		blockSize = 4096
+		lun0Size  = 128 * 1024
+		lun1Size  = 4 * 1024 * 1024
+	)
+
+	recorder := &recordingDev{Device: ramdisk.NewRAMDisk(lun1Size)}
+	tgt, addr := startTarget(t, map[uint64]usbdlib.Device{
+		0: ramdisk.NewRAMDisk(lun0Size),
+		1: recorder,
+	})
+
+	if _, err := NewTarget(context.Background(), "not-an-iqn"); err == nil {
+		t.Errorf("Invalid target name was accepted")
+	}
+	if err := tgt.AddLUN(1, ramdisk.NewRAMDisk(lun0Size)); err == nil {
+		t.Errorf("Duplicate LUN was accepted")
+	}
+
+	t.Run("discovery", func(t *testing.T) {
+		ini, err := dialInitiator(addr, "", valDiscovery)
+		if err != nil {
+			t.Fatalf("Discovery login failed: %s", err)
+		}
+		defer ini.logout()
+
+		replies, err := ini.text([]keyVal{{keySendTargets, valAll}})
+		if err != nil {
+			t.Fatalf("SendTargets failed: %s", err)
+		}
+		if name, ok := lookupKey(replies, keyTargetName); !ok || name != testTargetName {
+			t.Fatalf("SendTargets returned %v; expected target %q", replies, testTargetName)
+		}
+		if _, ok := lookupKey(replies, keyTargetAddress); !ok {
+			t.Fatalf("SendTargets did not return a TargetAddress: %v", replies)
+		}
+	})
+
+	t.Run("unknown-target", func(t *testing.T) {
+		if ini, err := dialInitiator(addr, "iqn.2022-01.io.usbd.test:missing", valNormal); err == nil {
+			ini.logout()
+			t.Fatalf("Login to an unknown target succeeded")
+		}
+	})
+
+	ini, err := dialInitiator(addr, testTargetName, valNormal)
+	if err != nil {
+		t.Fatalf("Login failed: %s", err)
+	}
+	if alias, _ := lookupKey(ini.loginResponseKV, keyTargetAlias); alias != "usbd-test" {
+		t.Errorf("Target alias was %q; expected %q", alias, "usbd-test")
+	}
+
+	t.Run("inquiry", func(t *testing.T) {
+		data := mustCommand(t, ini, 0, []byte{scsiInquiry, 0, 0, 0, 96, 0}, 96)
+		if data[0] != 0 || !bytes.Equal(data[8:16], []byte(vendorID)) {
+			t.Fatalf("Unexpected standard inquiry data: %q", data)
+		}
+
+		pages := mustCommand(t, ini, 0, []byte{scsiInquiry, 1, vpdSupportedPages, 0, 255, 0}, 255)
+		for _, page := range pages[4:] {
+			if resp := mustCommand(t, ini, 0, []byte{scsiInquiry, 1, page, 0, 255, 0}, 255); resp[1] != page {
+				t.Fatalf("Requested VPD page %#x but got %#x", page, resp[1])
+			}
+		}
+
+		serial0 := mustCommand(t, ini, 0, []byte{scsiInquiry, 1, vpdUnitSerial, 0, 255, 0}, 255)
+		serial1 := mustCommand(t, ini, 1, []byte{scsiInquiry, 1, vpdUnitSerial, 0, 255, 0}, 255)
+		if bytes.Equal(serial0, serial1) {
+			t.Fatalf("LUNs 0 and 1 have the same serial number %q", serial0[4:])
+		}
+
+		if data = mustCommand(t, ini, 7, []byte{scsiInquiry, 0, 0, 0, 36, 0}, 36); data[0] != 0x7f {
+			t.Fatalf("Absent LUN reported peripheral %#x; expected 0x7f", data[0])
+		}
+	})
+
+	t.Run("report-luns", func(t *testing.T) {
+		cdb := make([]byte, 12)
+		cdb[0] = scsiReportLUNs
+		binary.BigEndian.PutUint32(cdb[6:], 256)
+		data := mustCommand(t, ini, 0, cdb, 256)
+		if listLen := binary.BigEndian.Uint32(data); listLen != 16 {
+			t.Fatalf("REPORT LUNS list length was %d; expected 16", listLen)
+		}
+		if lun0, lun1 := decodeLUN(data[8:16]), decodeLUN(data[16:24]); lun0 != 0 || lun1 != 1 {
+			t.Fatalf("REPORT LUNS returned LUNs %d and %d; expected 0 and 1", lun0, lun1)
+		}
+	})
+
+	t.Run("read-capacity", func(t *testing.T) {
+		for lun, size := range map[uint64]int64{0: lun0Size, 1: lun1Size} {
+			data := mustCommand(t, ini, lun, make([]byte, 10), 0) //TEST UNIT READY
+			if len(data) != 0 {
+				t.Fatalf("TEST UNIT READY returned data")
+			}
+
+			cap10 := mustCommand(t, ini, lun, []byte{scsiReadCapacity10, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 8)
+			if lastLBA := int64(binary.BigEndian.Uint32(cap10)); (lastLBA+1)*blockSize != size {
+				t.Fatalf("READ CAPACITY(10) of LUN %d reported last LBA %d; expected size %d", lun, lastLBA, size)
+			}
+
+			dev, err := newInitiatorDevice(ini, lun)
+			if err != nil {
+				t.Fatalf("READ CAPACITY(16) failed: %s", err)
+			} else if dev.Size() != size || dev.BlockSize() != blockSize {
+				t.Fatalf("READ CAPACITY(16) of LUN %d reported %d x %d; expected size %d", lun, dev.Size()/dev.BlockSize(), dev.BlockSize(), size)
+			}
+		}
+	})
+
+	t.Run("large-io", func(t *testing.T) {
+		dev, err := newInitiatorDevice(ini, 1)
+		if err != nil {
+			t.Fatalf("Could not open LUN 1: %s", err)
+		}
+
+		//Larger than FirstBurstLength and MaxBurstLength to exercise R2Ts and
+		// larger than MaxRecvDataSegmentLength to exercise Data-In sequences
+		expected := make([]byte, 1024*1024+blockSize)
+		rand.New(rand.NewSource(1)).Read(expected)
+		if _, err = dev.WriteAt(expected, 3*blockSize); err != nil {
+			t.Fatalf("Large write failed: %s", err)
+		}
+		actual := make([]byte, len(expected))
+		if _, err = dev.ReadAt(actual, 3*blockSize); err != nil {
+			t.Fatalf("Large read failed: %s", err)
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Fatalf("Data read back does not match what was written")
+		}
+	})
+
+	t.Run("out-of-range", func(t *testing.T) {
+		cdb := make([]byte, 16)
+		cdb[0] = scsiRead16
+		binary.BigEndian.PutUint64(cdb[2:], lun1Size/blockSize)
+		binary.BigEndian.PutUint32(cdb[10:], 1)
+		_, status, sense, err := ini.command(1, cdb, nil, blockSize)
+		switch {
+		case err != nil:
+			t.Fatalf("Command failed: %s", err)
+		case status != scsiStatusCheckCondition:
+			t.Fatalf("Read past the end returned status %#x; expected CHECK CONDITION", status)
+		case len(sense) < 14 || sense[2]&0xf != senseIllegalRequest || sense[12] != ascLBAOutOfRange:
+			t.Fatalf("Read past the end returned unexpected sense data %x", sense)
+		}
+
+		if _, status, _, err = ini.command(1, []byte{0xff, 0, 0, 0, 0, 0}, nil, 0); err != nil || status != scsiStatusCheckCondition {
+			t.Fatalf("Unsupported opcode returned status %#x, err: %v", status, err)
+		}
+	})
+
+	t.Run("unmap-and-sync", func(t *testing.T) {
+		dev, err := newInitiatorDevice(ini, 1)
+		if err != nil {
+			t.Fatalf("Could not open LUN 1: %s", err)
+		}
+		if err = dev.Trim(8*blockSize, 4*blockSize); err != nil {
+			t.Fatalf("UNMAP failed: %s", err)
+		}
+		if err = dev.Flush(); err != nil {
+			t.Fatalf("SYNCHRONIZE CACHE failed: %s", err)
+		}
+
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		if expected := [2]int64{8 * blockSize, 4 * blockSize}; len(recorder.trims) != 1 || recorder.trims[0] != expected {
+			t.Fatalf("Device received trims %v; expected %v", recorder.trims, expected)
+		}
+		if recorder.flushes != 1 {
+			t.Fatalf("Device received %d flushes; expected 1", recorder.flushes)
+		}
+	})
+
+	if err = ini.logout(); err != nil {
+		t.Fatalf("Logout failed: %s", err)
+	}
+
+	t.Run("userspace", func(t *testing.T) {
+		ini, err := dialInitiator(addr, testTargetName, valNormal)
+		if err != nil {
+			t.Fatalf("Login failed: %s", err)
+		}
+		dev, err := newInitiatorDevice(ini, 0)
+		if err != nil {
+			t.Fatalf("Could not open LUN 0: %s", err)
+		}
+		testutil.TestUserspace(t, dev, lun0Size)
+	})
+}
+
+func mustCommand(t *testing.T, ini *initiator, lun uint64, cdb []byte, readLen int) []byte {
+	t.Helper()
+
+	data, status, sense, err := ini.command(lun, cdb, nil, readLen)
+	if err != nil {
+		t.Fatalf("Command %#x failed: %s", cdb[0], err)
+	} else if status != scsiStatusGood {
+		t.Fatalf("Command %#x returned status %#x with sense %x", cdb[0], status, sense)
+	}
+	return data
+}
+
+func TestLoginTextLimit(t *testing.T) {
+	_, addr := startTarget(t, map[uint64]usbdlib.Device{0: ramdisk.NewRAMDisk(64 * 1024)})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Could not dial target: %s", err)
+	}
+	defer conn.Close()
+	rdr := bufio.NewReader(conn)
+
+	//Send text that never ends until the target rejects the login
+	chunk := bytes.Repeat([]byte{'x'}, defMaxRecvDataSegLen)
+	for i := 0; i <= maxLoginTextBytes/len(chunk); i++ {
+		req := newPDU(opLoginReq | immediateFlag)
+		req.bhs[1] = continueFlag | stageSecurity<<2 | stageOperational
+		copy(req.bhs[8:14], []byte{0x80, 0, 0, 0, 0, 1})
+		req.data = chunk
+		if err = req.writeTo(conn); err != nil {
+			t.Fatalf("Could not send login request %d: %s", i, err)
+		}
+		resp, err := readPDU(rdr, 1<<24)
+		switch {
+		case err != nil:
+			t.Fatalf("Could not read login response %d: %s", i, err)
+		case resp.opcode() != opLoginResp:
+			t.Fatalf("Expected login response but got opcode %#x", resp.opcode())
+		case resp.bhs[36] == loginStatusInitErr:
+			if (i+1)*len(chunk) <= maxLoginTextBytes {
+				t.Fatalf("Login was rejected after only %d bytes of text", (i+1)*len(chunk))
+			}
+			return
+		case resp.bhs[36] != loginStatusSuccess:
+			t.Fatalf("Login failed with status class %#x detail %#x", resp.bhs[36], resp.bhs[37])
+		}
+	}
+	t.Fatalf("Login text larger than %d bytes was accepted", maxLoginTextBytes)
+}
+
+type readOnlyDev struct {
+	usbdlib.Device
+}
+
+func (readOnlyDev) ReadOnly() bool {
+	return true
+}
+
+func TestReadOnlyLUN(t *testing.T) {
+	const blockSize = 4096
+
+	_, addr := startTarget(t, map[uint64]usbdlib.Device{0: readOnlyDev{ramdisk.NewRAMDisk(64 * 1024)}})
+	ini, err := dialInitiator(addr, testTargetName, valNormal)
+	if err != nil {
+		t.Fatalf("Login failed: %s", err)
+	}
+	defer ini.logout()
+
+	if data := mustCommand(t, ini, 0, []byte{scsiModeSense6, 0, 0x3f, 0, 255, 0}, 255); data[2]&0x80 == 0 {
+		t.Fatalf("MODE SENSE did not report the LUN as write protected")
+	}
+
+	dev, err := newInitiatorDevice(ini, 0)
+	if err != nil {
+		t.Fatalf("Could not open LUN 0: %s", err)
+	}
+	if _, err = dev.ReadAt(make([]byte, blockSize), 0); err != nil {
+		t.Fatalf("Could not read from read-only LUN: %s", err)
+	}
+
+	cdb := make([]byte, 16)
+	cdb[0] = scsiWrite16
+	binary.BigEndian.PutUint32(cdb[10:], 1)
+	_, status, sense, err := ini.command(0, cdb, make([]byte, blockSize), 0)
+	switch {
+	case err != nil:
+		t.Fatalf("Command failed: %s", err)
+	case status != scsiStatusCheckCondition || len(sense) < 14 || sense[2]&0xf != senseDataProtect:
+		t.Fatalf("Write to read-only LUN returned status %#x with sense %x; expected DATA PROTECT", status, sense)
+	}
+	if err = dev.Trim(0, blockSize); err == nil {
+		t.Fatalf("UNMAP of read-only LUN succeeded")
+	}
+}
+
+func TestShortDataOut(t *testing.T) {
+	const blockSize = 4096
+
+	disk := ramdisk.NewRAMDisk(64 * 1024)
+	_, addr := startTarget(t, map[uint64]usbdlib.Device{0: disk})
+	ini, err := dialInitiator(addr, testTargetName, valNormal)
+	if err != nil {
+		t.Fatalf("Login failed: %s", err)
+	}
+	defer ini.conn.Close()
+
+	//Write two blocks without immediate data so the target solicits all of it
+	cdb := make([]byte, 16)
+	cdb[0] = scsiWrite16
+	binary.BigEndian.PutUint32(cdb[10:], 2)
+	req := newPDU(opSCSICmd)
+	req.bhs[1] = finalFlag | cmdWriteFlag
+	req.putUint32(16, 1)
+	req.putUint32(20, 2*blockSize)
+	req.putUint32(24, ini.cmdSN)
+	req.putUint32(28, ini.expStatSN)
+	copy(req.cdb(), cdb)
+	if err = req.writeTo(ini.conn); err != nil {
+		t.Fatalf("Could not send write command: %s", err)
+	}
+	r2t, err := readPDU(ini.rdr, 1<<24)
+	if err != nil {
+		t.Fatalf("Could not read R2T: %s", err)
+	} else if r2t.opcode() != opR2T {
+		t.Fatalf("Expected R2T but got opcode %#x", r2t.opcode())
+	}
+
+	//End the Data-Out sequence after only one of the solicited blocks
+	dataOut := bytes.Repeat([]byte{0xff}, 2*blockSize)
+	r2t.putUint32(44, blockSize)
+	if err = ini.sendDataOut(r2t, dataOut); err != nil {
+		t.Fatalf("Could not send Data-Out: %s", err)
+	}
+	if resp, err := readPDU(ini.rdr, 1<<24); err == nil {
+		t.Fatalf("Target responded with opcode %#x rather than dropping the connection", resp.opcode())
+	}
+	testutil.ExpectContents(t, "unwritten blocks", disk, 0, make([]byte, 2*blockSize))
+}
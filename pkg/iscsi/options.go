@@ -0,0 +1,36 @@
+package iscsi
+
+//Option is an iSCSI Target option
+type Option interface {
+	apply(*Target)
+}
+
+//OptMaxRecvDataSegmentLength sets the largest data segment the target is willing
+// to receive in a single PDU
+type OptMaxRecvDataSegmentLength uint32
+
+func (length OptMaxRecvDataSegmentLength) apply(tgt *Target) {
+	tgt.recvDataSegLen = int(length)
+}
+
+//OptQueueDepth sets the number of commands each session may have outstanding
+type OptQueueDepth uint32
+
+func (depth OptQueueDepth) apply(tgt *Target) {
+	tgt.queueDepth = uint32(depth)
+}
+
+//OptTargetAlias sets a human friendly alias reported to initiators
+type OptTargetAlias string
+
+func (alias OptTargetAlias) apply(tgt *Target) {
+	tgt.alias = string(alias)
+}
+
+//OptAdvertiseAddress sets the "host:port" reported to discovery sessions, if
+// absent the address of the accepting listener is used
+type OptAdvertiseAddress string
+
+func (addr OptAdvertiseAddress) apply(tgt *Target) {
+	tgt.advertiseAddr = string(addr)
+}
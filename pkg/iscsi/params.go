@@ -0,0 +1,228 @@
+package iscsi
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Text key values used during login and text negotiation
+const (
+	keyAuthMethod        = "AuthMethod"
+	keyHeaderDigest      = "HeaderDigest"
+	keyDataDigest        = "DataDigest"
+	keyMaxConnections    = "MaxConnections"
+	keySendTargets       = "SendTargets"
+	keyTargetName        = "TargetName"
+	keyInitiatorName     = "InitiatorName"
+	keyTargetAlias       = "TargetAlias"
+	keyTargetAddress     = "TargetAddress"
+	keyTargetPortalGroup = "TargetPortalGroupTag"
+	keyInitialR2T        = "InitialR2T"
+	keyImmediateData     = "ImmediateData"
+	keyMaxRecvDataSegLen = "MaxRecvDataSegmentLength"
+	keyMaxBurstLen       = "MaxBurstLength"
+	keyFirstBurstLen     = "FirstBurstLength"
+	keyDefaultTime2Wait  = "DefaultTime2Wait"
+	keyDefaultTime2Ret   = "DefaultTime2Retain"
+	keyMaxOutstandingR2T = "MaxOutstandingR2T"
+	keyDataPDUInOrder    = "DataPDUInOrder"
+	keyDataSeqInOrder    = "DataSequenceInOrder"
+	keyErrorRecoveryLvl  = "ErrorRecoveryLevel"
+	keySessionType       = "SessionType"
+	keyIFMarker          = "IFMarker"
+	keyOFMarker          = "OFMarker"
+
+	valNone          = "None"
+	valYes           = "Yes"
+	valNo            = "No"
+	valNotUnderstood = "NotUnderstood"
+	valIrrelevant    = "Irrelevant"
+	valDiscovery     = "Discovery"
+	valNormal        = "Normal"
+	valAll           = "All"
+)
+
+//Protocol default values (RFC 7143 section 13)
+const (
+	defMaxRecvDataSegLen = 8192
+	defMaxBurstLen       = 262144
+	defFirstBurstLen     = 65536
+)
+
+//keyVal is a single text key=value pair, order is significant on the wire so
+// these are kept in slices rather than maps
+type keyVal struct {
+	key, val string
+}
+
+//parseText decodes a null separated list of key=value pairs
+func parseText(data []byte) ([]keyVal, error) {
+	var kvs []keyVal
+	for _, raw := range bytes.Split(data, []byte{0}) {
+		if len(raw) == 0 {
+			continue
+		}
+		idx := bytes.IndexByte(raw, '=')
+		if idx < 1 {
+			return nil, fmt.Errorf("Malformed text key-value pair %q: %w", raw, errProtocol)
+		}
+		kvs = append(kvs, keyVal{key: string(raw[:idx]), val: string(raw[idx+1:])})
+	}
+	return kvs, nil
+}
+
+//encodeText is the inverse of parseText
+func encodeText(kvs []keyVal) []byte {
+	var buf bytes.Buffer
+	for _, kv := range kvs {
+		buf.WriteString(kv.key)
+		buf.WriteByte('=')
+		buf.WriteString(kv.val)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func lookupKey(kvs []keyVal, key string) (string, bool) {
+	for _, kv := range kvs {
+		if kv.key == key {
+			return kv.val, true
+		}
+	}
+	return "", false
+}
+
+//sessionParams are the operational parameters in effect for a session
+type sessionParams struct {
+	sessionType   string
+	initiatorName string
+	targetName    string
+
+	sendDataSegLen int //MaxRecvDataSegmentLength declared by the initiator
+	recvDataSegLen int //MaxRecvDataSegmentLength declared by us
+	maxBurstLen    int
+	firstBurstLen  int
+	initialR2T     bool
+	immediateData  bool
+}
+
+func newSessionParams(recvDataSegLen int) sessionParams {
+	return sessionParams{
+		sessionType:    valNormal,
+		sendDataSegLen: defMaxRecvDataSegLen,
+		recvDataSegLen: recvDataSegLen,
+		maxBurstLen:    defMaxBurstLen,
+		firstBurstLen:  defFirstBurstLen,
+		initialR2T:     true,
+		immediateData:  true,
+	}
+}
+
+//negotiate applies the initiator offered key-value pairs and returns the
+// target's replies
+func (sp *sessionParams) negotiate(offered []keyVal) ([]keyVal, error) {
+	replies := make([]keyVal, 0, len(offered))
+	reply := func(key, val string) {
+		replies = append(replies, keyVal{key: key, val: val})
+	}
+
+	for _, kv := range offered {
+		switch kv.key {
+		case keyInitiatorName:
+			sp.initiatorName = kv.val
+		case keyTargetName:
+			sp.targetName = kv.val
+		case keySessionType:
+			switch kv.val {
+			case valDiscovery, valNormal:
+				sp.sessionType = kv.val
+			default:
+				return nil, fmt.Errorf("Unknown session type %q: %w", kv.val, errProtocol)
+			}
+		case keyAuthMethod:
+			if !offersValue(kv.val, valNone) {
+				return nil, fmt.Errorf("Initiator requires authentication (%s), which is not supported", kv.val)
+			}
+			reply(kv.key, valNone)
+		case keyHeaderDigest, keyDataDigest:
+			if !offersValue(kv.val, valNone) {
+				return nil, fmt.Errorf("Initiator requires %s %s, which is not supported", kv.key, kv.val)
+			}
+			reply(kv.key, valNone)
+		case keyMaxConnections:
+			reply(kv.key, "1")
+		case keyInitialR2T:
+			//Result function is OR and we always require the initial R2T
+			reply(kv.key, valYes)
+		case keyImmediateData:
+			sp.immediateData = kv.val == valYes
+			reply(kv.key, kv.val)
+		case keyMaxRecvDataSegLen:
+			n, err := parsePositive(kv)
+			if err != nil {
+				return nil, err
+			}
+			sp.sendDataSegLen = n
+		case keyMaxBurstLen:
+			n, err := parsePositive(kv)
+			if err != nil {
+				return nil, err
+			}
+			sp.maxBurstLen = min(n, sp.maxBurstLen)
+			reply(kv.key, strconv.Itoa(sp.maxBurstLen))
+		case keyFirstBurstLen:
+			n, err := parsePositive(kv)
+			if err != nil {
+				return nil, err
+			}
+			sp.firstBurstLen = min(n, sp.firstBurstLen)
+			reply(kv.key, strconv.Itoa(sp.firstBurstLen))
+		case keyDefaultTime2Wait, keyDefaultTime2Ret:
+			reply(kv.key, "0")
+		case keyMaxOutstandingR2T:
+			reply(kv.key, "1")
+		case keyDataPDUInOrder, keyDataSeqInOrder:
+			reply(kv.key, valYes)
+		case keyErrorRecoveryLvl:
+			reply(kv.key, "0")
+		case keyIFMarker, keyOFMarker:
+			reply(kv.key, valNo)
+		case keyTargetAlias, keyTargetPortalGroup, keyTargetAddress:
+			reply(kv.key, valIrrelevant)
+		default:
+			reply(kv.key, valNotUnderstood)
+		}
+	}
+
+	if sp.firstBurstLen > sp.maxBurstLen {
+		sp.firstBurstLen = sp.maxBurstLen
+	}
+	return replies, nil
+}
+
+//offersValue reports if a comma separated list of values contains want
+func offersValue(list, want string) bool {
+	for _, val := range strings.Split(list, ",") {
+		if val == want {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePositive(kv keyVal) (int, error) {
+	n, err := strconv.Atoi(kv.val)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("Key %s had invalid numeric value %q: %w", kv.key, kv.val, errProtocol)
+	}
+	return n, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
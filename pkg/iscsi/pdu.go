@@ -0,0 +1,164 @@
+package iscsi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+//pdu is an iSCSI protocol data unit. Digests are never negotiated so a PDU is
+// only a basic header segment (BHS), optional additional header segments (AHS)
+// and an optional data segment, each padded to a 4 byte boundary on the wire.
+type pdu struct {
+	bhs  [bhsLen]byte
+	ahs  []byte
+	data []byte
+}
+
+func newPDU(opcode byte) *pdu {
+	p := new(pdu)
+	p.bhs[0] = opcode
+	return p
+}
+
+//readPDU decodes the next PDU from the provided stream rejecting data segments
+// larger than maxData bytes
+func readPDU(rdr io.Reader, maxData int) (*pdu, error) {
+	p := new(pdu)
+	if _, err := io.ReadFull(rdr, p.bhs[:]); err != nil {
+		return nil, fmt.Errorf("Could not read basic header segment: %w", err)
+	}
+
+	if ahsLen := int(p.bhs[4]) * 4; ahsLen > 0 {
+		p.ahs = make([]byte, ahsLen)
+		if _, err := io.ReadFull(rdr, p.ahs); err != nil {
+			return nil, fmt.Errorf("Could not read additional header segment: %w", err)
+		}
+	}
+
+	dataLen := p.dataLen()
+	if dataLen > maxData {
+		return nil, fmt.Errorf("Data segment of %d bytes exceeds maximum of %d bytes: %w", dataLen, maxData, errProtocol)
+	}
+	if dataLen > 0 {
+		p.data = make([]byte, padLen(dataLen))
+		if _, err := io.ReadFull(rdr, p.data); err != nil {
+			return nil, fmt.Errorf("Could not read data segment: %w", err)
+		}
+		p.data = p.data[:dataLen]
+	}
+	return p, nil
+}
+
+//writeTo encodes this PDU to the provided stream
+func (p *pdu) writeTo(wtr io.Writer) error {
+	p.bhs[4] = byte(len(p.ahs) / 4)
+	p.setDataLen(len(p.data))
+
+	if _, err := wtr.Write(p.bhs[:]); err != nil {
+		return fmt.Errorf("Could not write basic header segment: %w", err)
+	}
+	if len(p.ahs) > 0 {
+		if _, err := wtr.Write(p.ahs); err != nil {
+			return fmt.Errorf("Could not write additional header segment: %w", err)
+		}
+	}
+	if len(p.data) > 0 {
+		if _, err := wtr.Write(p.data); err != nil {
+			return fmt.Errorf("Could not write data segment: %w", err)
+		}
+		if pad := padLen(len(p.data)) - len(p.data); pad > 0 {
+			var zeros [4]byte
+			if _, err := wtr.Write(zeros[:pad]); err != nil {
+				return fmt.Errorf("Could not write data segment padding: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func padLen(n int) int {
+	return (n + 3) &^ 3
+}
+
+func (p *pdu) opcode() byte {
+	return p.bhs[0] & opcodeMask
+}
+
+func (p *pdu) immediate() bool {
+	return p.bhs[0]&immediateFlag != 0
+}
+
+func (p *pdu) flags() byte {
+	return p.bhs[1]
+}
+
+func (p *pdu) final() bool {
+	return p.bhs[1]&finalFlag != 0
+}
+
+func (p *pdu) dataLen() int {
+	return int(p.bhs[5])<<16 | int(p.bhs[6])<<8 | int(p.bhs[7])
+}
+
+func (p *pdu) setDataLen(n int) {
+	p.bhs[5], p.bhs[6], p.bhs[7] = byte(n>>16), byte(n>>8), byte(n)
+}
+
+func (p *pdu) lun() uint64 {
+	return decodeLUN(p.bhs[8:16])
+}
+
+func (p *pdu) setLUN(lun uint64) {
+	encodeLUN(p.bhs[8:16], lun)
+}
+
+func (p *pdu) itt() uint32 {
+	return p.uint32At(16)
+}
+
+func (p *pdu) uint32At(off int) uint32 {
+	return binary.BigEndian.Uint32(p.bhs[off:])
+}
+
+func (p *pdu) putUint32(off int, val uint32) {
+	binary.BigEndian.PutUint32(p.bhs[off:], val)
+}
+
+func (p *pdu) uint16At(off int) uint16 {
+	return binary.BigEndian.Uint16(p.bhs[off:])
+}
+
+func (p *pdu) putUint16(off int, val uint16) {
+	binary.BigEndian.PutUint16(p.bhs[off:], val)
+}
+
+//cdb returns the SCSI command descriptor block of a SCSI command PDU
+func (p *pdu) cdb() []byte {
+	return p.bhs[32:48]
+}
+
+//decodeLUN converts an 8 byte SAM LUN structure into a LUN number. Peripheral
+// and flat space addressing are understood, which covers LUNs 0 through 16383
+func decodeLUN(raw []byte) uint64 {
+	switch raw[0] >> 6 {
+	case 0: //peripheral device addressing
+		return uint64(raw[1])
+	case 1: //flat space addressing
+		return uint64(raw[0]&0x3f)<<8 | uint64(raw[1])
+	}
+	return binary.BigEndian.Uint64(raw)
+}
+
+//encodeLUN is the inverse of decodeLUN
+func encodeLUN(raw []byte, lun uint64) {
+	for i := range raw {
+		raw[i] = 0
+	}
+	if lun < 256 {
+		raw[1] = byte(lun)
+		return
+	}
+	raw[0] = 0x40 | byte(lun>>8)&0x3f
+	raw[1] = byte(lun)
+}
@@ -0,0 +1,360 @@
+package iscsi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+)
+
+//maxTransferBytes bounds the data a single command may read or write
+const maxTransferBytes = 32 * 1024 * 1024
+
+//Identification strings reported by INQUIRY
+const (
+	vendorID   = "USBD    "
+	productID  = "USBD LUN        "
+	productRev = "0001"
+)
+
+//scsiResult is the outcome of executing a SCSI command
+type scsiResult struct {
+	status byte
+	sense  []byte
+	data   []byte
+}
+
+func good(data []byte) scsiResult {
+	return scsiResult{status: scsiStatusGood, data: data}
+}
+
+//checkCondition constructs a result with fixed format sense data
+func checkCondition(key, asc, ascq byte) scsiResult {
+	sense := make([]byte, 18)
+	sense[0] = 0x70 //current error, fixed format
+	sense[2] = key
+	sense[7] = 10 //additional sense length
+	sense[12], sense[13] = asc, ascq
+	return scsiResult{status: scsiStatusCheckCondition, sense: sense}
+}
+
+//truncate limits returned data to the CDB's allocation length
+func truncate(data []byte, allocLen int) []byte {
+	if len(data) > allocLen {
+		return data[:allocLen]
+	}
+	return data
+}
+
+//execSCSI executes the provided CDB against a LUN
+func (tgt *Target) execSCSI(lun uint64, cdb []byte, dataOut []byte) scsiResult {
+	//Commands that are valid regardless of the LUN addressed
+	switch cdb[0] {
+	case scsiReportLUNs:
+		return tgt.reportLUNs(cdb)
+	case scsiInquiry:
+		return tgt.inquiry(tgt.lookupLUN(lun), cdb)
+	case scsiRequestSense:
+		return good(truncate(checkCondition(senseNoSense, ascNone, 0).sense, int(cdb[4])))
+	}
+
+	lu := tgt.lookupLUN(lun)
+	if lu == nil {
+		return checkCondition(senseIllegalRequest, ascLUNNotSupported, 0)
+	}
+
+	switch cdb[0] {
+	case scsiTestUnitReady, scsiStartStopUnit, scsiPreventAllow, scsiModeSelect6:
+		return good(nil)
+	case scsiReadCapacity10:
+		return lu.readCapacity10()
+	case scsiServiceIn16:
+		if cdb[1]&0x1f != saReadCapacity16 {
+			return checkCondition(senseIllegalRequest, ascInvalidCDBField, 0)
+		}
+		return lu.readCapacity16(cdb)
+	case scsiModeSense6, scsiModeSense10:
+		return lu.modeSense(cdb)
+	case scsiRead6:
+		lba, count := uint64(cdb[1]&0x1f)<<16|uint64(cdb[2])<<8|uint64(cdb[3]), uint64(cdb[4])
+		if count == 0 {
+			count = 256
+		}
+		return lu.read(lba, count)
+	case scsiRead10:
+		return lu.read(uint64(binary.BigEndian.Uint32(cdb[2:])), uint64(binary.BigEndian.Uint16(cdb[7:])))
+	case scsiRead16:
+		return lu.read(binary.BigEndian.Uint64(cdb[2:]), uint64(binary.BigEndian.Uint32(cdb[10:])))
+	case scsiWrite6:
+		lba, count := uint64(cdb[1]&0x1f)<<16|uint64(cdb[2])<<8|uint64(cdb[3]), uint64(cdb[4])
+		if count == 0 {
+			count = 256
+		}
+		return lu.write(lba, count, false, dataOut)
+	case scsiWrite10:
+		return lu.write(uint64(binary.BigEndian.Uint32(cdb[2:])), uint64(binary.BigEndian.Uint16(cdb[7:])), cdb[1]&0x08 != 0, dataOut)
+	case scsiWrite16:
+		return lu.write(binary.BigEndian.Uint64(cdb[2:]), uint64(binary.BigEndian.Uint32(cdb[10:])), cdb[1]&0x08 != 0, dataOut)
+	case scsiVerify10:
+		return lu.verify(uint64(binary.BigEndian.Uint32(cdb[2:])), uint64(binary.BigEndian.Uint16(cdb[7:])))
+	case scsiVerify16:
+		return lu.verify(binary.BigEndian.Uint64(cdb[2:]), uint64(binary.BigEndian.Uint32(cdb[10:])))
+	case scsiSyncCache10, scsiSyncCache16:
+		return lu.syncCache()
+	case scsiUnmap:
+		return lu.unmap(dataOut)
+	}
+	return checkCondition(senseIllegalRequest, ascInvalidOpcode, 0)
+}
+
+func (tgt *Target) reportLUNs(cdb []byte) scsiResult {
+	ids := tgt.lunIDs()
+	data := make([]byte, 8+8*len(ids))
+	binary.BigEndian.PutUint32(data, uint32(8*len(ids)))
+	for i, id := range ids {
+		encodeLUN(data[8+8*i:16+8*i], id)
+	}
+	return good(truncate(data, int(binary.BigEndian.Uint32(cdb[6:]))))
+}
+
+//inquiry returns standard INQUIRY data or a vital product data page. An absent
+// LUN is reported with a peripheral qualifier of "not capable"
+func (tgt *Target) inquiry(lu *logicalUnit, cdb []byte) scsiResult {
+	evpd, page, allocLen := cdb[1]&0x01 != 0, cdb[2], int(binary.BigEndian.Uint16(cdb[3:]))
+	peripheral := byte(0x00) //connected direct access block device
+	if lu == nil {
+		peripheral = 0x7f
+	}
+
+	if !evpd {
+		if page != 0 {
+			return checkCondition(senseIllegalRequest, ascInvalidCDBField, 0)
+		}
+		data := make([]byte, 36)
+		data[0] = peripheral
+		data[2] = 0x06        //SPC-4
+		data[3] = 0x10 | 0x02 //HiSup, response data format 2
+		data[4] = byte(len(data) - 5)
+		data[7] = 0x02 //CmdQue
+		copy(data[8:], vendorID)
+		copy(data[16:], productID)
+		copy(data[32:], productRev)
+		return good(truncate(data, allocLen))
+	}
+
+	if lu == nil {
+		return checkCondition(senseIllegalRequest, ascLUNNotSupported, 0)
+	}
+
+	var body []byte
+	switch page {
+	case vpdSupportedPages:
+		body = []byte{vpdSupportedPages, vpdUnitSerial, vpdDeviceID, vpdBlockLimits, vpdBlockDevChars, vpdLogicalBlkProvn}
+	case vpdUnitSerial:
+		body = []byte(tgt.serial(lu))
+	case vpdDeviceID:
+		body = tgt.deviceIdentifiers(lu)
+	case vpdBlockLimits:
+		body = make([]byte, 0x3c)
+		maxBlocks := uint32(maxTransferBytes / lu.blockSize)
+		binary.BigEndian.PutUint16(body[2:], 1)          //optimal transfer length granularity
+		binary.BigEndian.PutUint32(body[4:], maxBlocks)  //maximum transfer length
+		binary.BigEndian.PutUint32(body[8:], maxBlocks)  //optimal transfer length
+		binary.BigEndian.PutUint32(body[16:], maxBlocks) //maximum unmap LBA count
+		binary.BigEndian.PutUint32(body[20:], 256)       //maximum unmap block descriptor count
+		binary.BigEndian.PutUint32(body[24:], 1)         //optimal unmap granularity
+	case vpdBlockDevChars:
+		body = make([]byte, 0x3c)
+		binary.BigEndian.PutUint16(body[0:], 1) //non-rotating medium
+	case vpdLogicalBlkProvn:
+		body = make([]byte, 4)
+		body[1] = 0x80 //LBPU: UNMAP is supported
+	default:
+		return checkCondition(senseIllegalRequest, ascInvalidCDBField, 0)
+	}
+
+	data := make([]byte, 4+len(body))
+	data[0], data[1] = peripheral, page
+	binary.BigEndian.PutUint16(data[2:], uint16(len(body)))
+	copy(data[4:], body)
+	return good(truncate(data, allocLen))
+}
+
+func (tgt *Target) serial(lu *logicalUnit) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(tgt.name))
+	return fmt.Sprintf("%08x%04x", hash.Sum32(), lu.id)
+}
+
+//deviceIdentifiers builds the designators for the device identification VPD
+// page: a T10 vendor ID and a locally assigned NAA identifier
+func (tgt *Target) deviceIdentifiers(lu *logicalUnit) []byte {
+	serial := tgt.serial(lu)
+	t10 := append([]byte(vendorID), serial...)
+
+	hash := fnv.New64a()
+	hash.Write([]byte(tgt.name))
+	naa := (hash.Sum64()^lu.id)&^(0xf<<60) | 0x3<<60 //NAA 3: locally assigned
+
+	ids := make([]byte, 0, 4+len(t10)+4+8)
+	ids = append(ids, 0x02, 0x01, 0x00, byte(len(t10))) //ASCII, LU, T10 vendor ID
+	ids = append(ids, t10...)
+	ids = append(ids, 0x01, 0x03, 0x00, 0x08) //binary, LU, NAA
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], naa)
+	return append(ids, raw[:]...)
+}
+
+func (lu *logicalUnit) readCapacity10() scsiResult {
+	data := make([]byte, 8)
+	lastLBA := lu.blocks - 1
+	if lastLBA > 0xffffffff {
+		lastLBA = 0xffffffff //initiator must use READ CAPACITY (16)
+	}
+	binary.BigEndian.PutUint32(data, uint32(lastLBA))
+	binary.BigEndian.PutUint32(data[4:], uint32(lu.blockSize))
+	return good(data)
+}
+
+func (lu *logicalUnit) readCapacity16(cdb []byte) scsiResult {
+	data := make([]byte, 32)
+	binary.BigEndian.PutUint64(data, lu.blocks-1)
+	binary.BigEndian.PutUint32(data[8:], uint32(lu.blockSize))
+	data[14] = 0x80 //LBPME: logical block provisioning (UNMAP) is enabled
+	return good(truncate(data, int(binary.BigEndian.Uint32(cdb[10:]))))
+}
+
+//modeSense reports the caching (write-back cache enabled) and control pages
+func (lu *logicalUnit) modeSense(cdb []byte) scsiResult {
+	page := cdb[2] & 0x3f
+
+	caching := make([]byte, 20)
+	caching[0], caching[1], caching[2] = 0x08, 0x12, 0x04 //WCE
+	control := make([]byte, 12)
+	control[0], control[1] = 0x0a, 0x0a
+
+	var pages []byte
+	switch page {
+	case 0x08:
+		pages = caching
+	case 0x0a:
+		pages = control
+	case 0x3f:
+		pages = append(caching, control...)
+	default:
+		return checkCondition(senseIllegalRequest, ascInvalidCDBField, 0)
+	}
+
+	deviceSpecific := byte(0x10) //DPOFUA
+	if lu.readOnly {
+		deviceSpecific |= 0x80 //WP
+	}
+	if cdb[0] == scsiModeSense6 {
+		data := append(make([]byte, 4), pages...)
+		data[0] = byte(len(data) - 1)
+		data[2] = deviceSpecific
+		return good(truncate(data, int(cdb[4])))
+	}
+	data := append(make([]byte, 8), pages...)
+	binary.BigEndian.PutUint16(data, uint16(len(data)-2))
+	data[3] = deviceSpecific
+	return good(truncate(data, int(binary.BigEndian.Uint16(cdb[7:]))))
+}
+
+//checkRange validates an LBA range, returning its offset and length in bytes
+func (lu *logicalUnit) checkRange(lba, count uint64) (pos int64, length int, result *scsiResult) {
+	if lba > lu.blocks || count > lu.blocks-lba {
+		res := checkCondition(senseIllegalRequest, ascLBAOutOfRange, 0)
+		return 0, 0, &res
+	}
+	if count*uint64(lu.blockSize) > maxTransferBytes {
+		res := checkCondition(senseIllegalRequest, ascInvalidCDBField, 0)
+		return 0, 0, &res
+	}
+	return int64(lba) * lu.blockSize, int(count) * int(lu.blockSize), nil
+}
+
+func (lu *logicalUnit) read(lba, count uint64) scsiResult {
+	pos, length, res := lu.checkRange(lba, count)
+	if res != nil {
+		return *res
+	}
+
+	buf := make([]byte, length)
+	if _, err := lu.dev.ReadAt(buf, pos); err != nil {
+		log.Printf("Target::read(): WARNING: LUN %d read of %d bytes at %d failed; Details: %s", lu.id, length, pos, err)
+		return checkCondition(senseMediumError, ascReadError, 0)
+	}
+	return good(buf)
+}
+
+func (lu *logicalUnit) write(lba, count uint64, fua bool, dataOut []byte) scsiResult {
+	pos, length, res := lu.checkRange(lba, count)
+	if res != nil {
+		return *res
+	}
+	if len(dataOut) < length {
+		return checkCondition(senseIllegalRequest, ascInvalidCDBField, 0)
+	}
+	if lu.readOnly {
+		return checkCondition(senseDataProtect, ascWriteProtected, 0)
+	}
+
+	if _, err := lu.dev.WriteAt(dataOut[:length], pos); err != nil {
+		log.Printf("Target::write(): WARNING: LUN %d write of %d bytes at %d failed; Details: %s", lu.id, length, pos, err)
+		return checkCondition(senseMediumError, ascWriteError, 0)
+	}
+	if fua {
+		return lu.syncCache()
+	}
+	return good(nil)
+}
+
+//verify only checks the range is valid, the medium is not re-read (BYTCHK=0)
+func (lu *logicalUnit) verify(lba, count uint64) scsiResult {
+	if lba > lu.blocks || count > lu.blocks-lba {
+		return checkCondition(senseIllegalRequest, ascLBAOutOfRange, 0)
+	}
+	return good(nil)
+}
+
+func (lu *logicalUnit) syncCache() scsiResult {
+	if err := lu.dev.Flush(); err != nil {
+		log.Printf("Target::syncCache(): WARNING: LUN %d flush failed; Details: %s", lu.id, err)
+		return checkCondition(senseMediumError, ascWriteError, 0)
+	}
+	return good(nil)
+}
+
+//unmap trims each block descriptor of an UNMAP parameter list
+func (lu *logicalUnit) unmap(params []byte) scsiResult {
+	if lu.readOnly {
+		return checkCondition(senseDataProtect, ascWriteProtected, 0)
+	}
+	if len(params) == 0 {
+		return good(nil)
+	}
+	if len(params) < 8 {
+		return checkCondition(senseIllegalRequest, ascParamListLength, 0)
+	}
+
+	descLen := int(binary.BigEndian.Uint16(params[2:]))
+	if 8+descLen > len(params) || descLen%16 != 0 {
+		return checkCondition(senseIllegalRequest, ascParamListLength, 0)
+	}
+
+	for desc := params[8 : 8+descLen]; len(desc) >= 16; desc = desc[16:] {
+		lba, count := binary.BigEndian.Uint64(desc), uint64(binary.BigEndian.Uint32(desc[8:]))
+		if lba > lu.blocks || count > lu.blocks-lba {
+			return checkCondition(senseIllegalRequest, ascLBAOutOfRange, 0)
+		}
+		if count == 0 {
+			continue
+		}
+		if err := lu.dev.Trim(int64(lba)*lu.blockSize, int(count)*int(lu.blockSize)); err != nil {
+			log.Printf("Target::unmap(): WARNING: LUN %d trim of %d blocks at LBA %d failed; Details: %s", lu.id, count, lba, err)
+			return checkCondition(senseMediumError, ascWriteError, 0)
+		}
+	}
+	return good(nil)
+}
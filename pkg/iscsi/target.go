@@ -0,0 +1,261 @@
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+//DefRecvDataSegmentLength is the largest data segment the target will accept
+// from initiators unless OptMaxRecvDataSegmentLength is provided
+const DefRecvDataSegmentLength = 256 * 1024
+
+//DefQueueDepth is the number of commands a session may have outstanding unless
+// OptQueueDepth is provided
+const DefQueueDepth = 64
+
+//maxLUN is the largest LUN expressable with flat space addressing
+const maxLUN = 16383
+
+//Target is an iSCSI target exporting one or more usbdlib.Devices as logical
+// units (LUNs) to iSCSI initiators (ex. open-iscsi, VMware ESXi or Windows)
+type Target struct {
+	name, alias, advertiseAddr string
+	recvDataSegLen             int
+	queueDepth                 uint32
+
+	lunMu sync.RWMutex
+	luns  map[uint64]*logicalUnit
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	connMu    sync.Mutex
+	conns     map[*conn]struct{}
+	listeners map[net.Listener]struct{}
+	connWg    sync.WaitGroup
+	closeOnce sync.Once
+
+	atomicTSIH uint32
+}
+
+type logicalUnit struct {
+	id        uint64
+	dev       usbdlib.Device
+	blockSize int64
+	blocks    uint64
+	readOnly  bool
+}
+
+//NewTarget constructs an iSCSI target with the provided iSCSI qualified name
+// (ex. "iqn.2022-01.com.example:storage.lun1"). LUNs must be added with AddLUN
+// and the target started with Serve or ListenAndServe
+func NewTarget(ctx context.Context, name string, options ...Option) (*Target, error) {
+	switch {
+	case ctx == nil:
+		return nil, fmt.Errorf("Provided context was nil")
+	case !validName(name):
+		return nil, fmt.Errorf("Provided target name %q is not a valid iqn., eui. or naa. name", name)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	tgt := &Target{
+		name:           name,
+		recvDataSegLen: DefRecvDataSegmentLength,
+		queueDepth:     DefQueueDepth,
+		luns:           make(map[uint64]*logicalUnit),
+		ctx:            ctx,
+		ctxCancel:      cancel,
+		conns:          make(map[*conn]struct{}),
+		listeners:      make(map[net.Listener]struct{}),
+	}
+	for _, opt := range options {
+		opt.apply(tgt)
+	}
+
+	switch {
+	case tgt.recvDataSegLen < 512 || tgt.recvDataSegLen > 1<<24-1:
+		cancel()
+		return nil, fmt.Errorf("Maximum receive data segment length %d is out of range (512 to 16777215 bytes)", tgt.recvDataSegLen)
+	case tgt.queueDepth < 1:
+		cancel()
+		return nil, fmt.Errorf("Queue depth must be at least one")
+	}
+	return tgt, nil
+}
+
+func validName(name string) bool {
+	for _, prefix := range []string{"iqn.", "eui.", "naa."} {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) && len(name) <= 223 {
+			return true
+		}
+	}
+	return false
+}
+
+//Name returns the iSCSI qualified name of this target
+func (tgt *Target) Name() string {
+	return tgt.name
+}
+
+//AddLUN exports the provided device as the provided LUN number. The target
+// takes ownership of the device and closes it when the target is closed.
+// Devices implementing usbdlib.ReadOnlyDevice are reported as write protected
+func (tgt *Target) AddLUN(lun uint64, dev usbdlib.Device) error {
+	switch {
+	case dev == nil:
+		return fmt.Errorf("Provided device was nil")
+	case lun > maxLUN:
+		return fmt.Errorf("LUN %d exceeds the maximum supported LUN %d", lun, maxLUN)
+	case dev.BlockSize() < 512 || dev.BlockSize()&(dev.BlockSize()-1) != 0:
+		return fmt.Errorf("Device block size %d is not a power of two of at least 512 bytes", dev.BlockSize())
+	}
+
+	tgt.lunMu.Lock()
+	defer tgt.lunMu.Unlock()
+	if tgt.ctx.Err() != nil {
+		return errClosed
+	}
+	if _, exists := tgt.luns[lun]; exists {
+		return fmt.Errorf("Could not add LUN %d: %w", lun, errLUNExists)
+	}
+
+	tgt.luns[lun] = &logicalUnit{
+		id:        lun,
+		dev:       dev,
+		blockSize: dev.BlockSize(),
+		blocks:    uint64(dev.Size() / dev.BlockSize()),
+		readOnly:  usbdlib.IsReadOnly(dev),
+	}
+	return nil
+}
+
+func (tgt *Target) lookupLUN(lun uint64) *logicalUnit {
+	tgt.lunMu.RLock()
+	defer tgt.lunMu.RUnlock()
+	return tgt.luns[lun]
+}
+
+func (tgt *Target) lunIDs() []uint64 {
+	tgt.lunMu.RLock()
+	defer tgt.lunMu.RUnlock()
+	return sortedKeys(tgt.luns)
+}
+
+//ListenAndServe listens on the provided TCP address (ex. ":3260") and then
+// calls Serve
+func (tgt *Target) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Could not listen on %q: %w", addr, err)
+	}
+	return tgt.Serve(ln)
+}
+
+//Serve accepts initiator connections on the provided listener, blocking until
+// the target is closed. The listener is closed upon return
+func (tgt *Target) Serve(ln net.Listener) error {
+	tgt.connMu.Lock()
+	if tgt.ctx.Err() != nil {
+		tgt.connMu.Unlock()
+		ln.Close()
+		return errClosed
+	}
+	tgt.listeners[ln] = struct{}{}
+	tgt.connMu.Unlock()
+
+	defer func() {
+		tgt.connMu.Lock()
+		delete(tgt.listeners, ln)
+		tgt.connMu.Unlock()
+		ln.Close()
+	}()
+
+	for {
+		netConn, err := ln.Accept()
+		if err != nil {
+			if tgt.ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				continue
+			}
+			return fmt.Errorf("Could not accept connection: %w", err)
+		}
+
+		c := newConn(tgt, netConn)
+		tgt.connMu.Lock()
+		if tgt.ctx.Err() != nil {
+			tgt.connMu.Unlock()
+			netConn.Close()
+			return nil
+		}
+		tgt.conns[c] = struct{}{}
+		tgt.connWg.Add(1)
+		tgt.connMu.Unlock()
+
+		go func() {
+			defer func() {
+				tgt.connMu.Lock()
+				delete(tgt.conns, c)
+				tgt.connMu.Unlock()
+				tgt.connWg.Done()
+			}()
+
+			if err := c.serve(); err != nil && tgt.ctx.Err() == nil {
+				log.Printf("Target::Serve(): WARNING: Connection from %s terminated; Details: %s", netConn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+//Close stops accepting connections, terminates existing sessions and closes
+// all exported devices
+func (tgt *Target) Close() (err error) {
+	tgt.closeOnce.Do(func() {
+		tgt.connMu.Lock()
+		tgt.ctxCancel()
+		for ln := range tgt.listeners {
+			ln.Close()
+		}
+		for c := range tgt.conns {
+			c.netConn.Close()
+		}
+		tgt.connMu.Unlock()
+		tgt.connWg.Wait()
+
+		tgt.lunMu.Lock()
+		defer tgt.lunMu.Unlock()
+		for _, id := range sortedKeys(tgt.luns) {
+			if closeErr := tgt.luns[id].dev.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("Could not close device backing LUN %d: %w", id, closeErr)
+			}
+		}
+	})
+	return err
+}
+
+func sortedKeys(luns map[uint64]*logicalUnit) []uint64 {
+	ids := make([]uint64, 0, len(luns))
+	for id := range luns {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (tgt *Target) nextTSIH() uint16 {
+	for {
+		if tsih := uint16(atomic.AddUint32(&tgt.atomicTSIH, 1)); tsih != 0 {
+			return tsih
+		}
+	}
+}
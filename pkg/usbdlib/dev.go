@@ -10,3 +10,17 @@ type Device interface {
 	Flush() error
 	Close() error
 }
+
+//ReadOnlyDevice may optionally be implemented by devices that do not accept
+// writes. The device is then advertised as read-only and writes are refused
+// without being passed to the device.
+type ReadOnlyDevice interface {
+	ReadOnly() bool
+}
+
+//IsReadOnly returns true if the provided device implements ReadOnlyDevice and
+// reports itself as read-only
+func IsReadOnly(dev Device) bool {
+	roDev, isRO := dev.(ReadOnlyDevice)
+	return isRO && roDev.ReadOnly()
+}
@@ -0,0 +1,589 @@
+package usbdlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+//NBD handshake details: https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md#fixed-newstyle-negotiation
+const (
+	nbdInitMagic     = uint64(0x4e42444d41474943) //"NBDMAGIC"
+	nbdOptMagic      = uint64(0x49484156454f5054) //"IHAVEOPT"
+	nbdOptReplyMagic = uint64(0x3e889045565a9)
+
+	//Handshake flags
+	nbdFlagFixedNewstyle = uint16(1 << 0)
+	nbdFlagNoZeroes      = uint16(1 << 1)
+
+	//Transmission flags
+	nbdTransFlagHasFlags  = uint16(1 << 0)
+	nbdTransFlagReadOnly  = uint16(1 << 1)
+	nbdTransFlagSendFlush = uint16(1 << 2)
+	nbdTransFlagSendTrim  = uint16(1 << 5)
+
+	//Options
+	nbdOptExportName = uint32(1)
+	nbdOptAbort      = uint32(2)
+	nbdOptList       = uint32(3)
+	nbdOptInfo       = uint32(6)
+	nbdOptGo         = uint32(7)
+
+	//Option replies
+	nbdRepAck        = uint32(1)
+	nbdRepServer     = uint32(2)
+	nbdRepInfo       = uint32(3)
+	nbdRepFlagError  = uint32(1 << 31)
+	nbdRepErrUnsup   = nbdRepFlagError | 1
+	nbdRepErrInvalid = nbdRepFlagError | 3
+	nbdRepErrUnknown = nbdRepFlagError | 6
+
+	//Information types
+	nbdInfoExport    = uint16(0)
+	nbdInfoBlockSize = uint16(3)
+
+	nbdMaxOptionLen  = 64 * 1024
+	nbdMaxPayloadLen = 32 * 1024 * 1024
+	nbdZeroPadLen    = 124
+)
+
+const (
+	errNbdServerClosed = consterr.ConstErr("NBD server is shutdown")
+	errNbdAbort        = consterr.ConstErr("Client aborted negotiation")
+)
+
+//NbdCmd is an NBD transmission phase command
+type NbdCmd uint32
+
+//NBD commands a client may send
+const (
+	NbdCmdRead       = NbdCmd(nbdRead)
+	NbdCmdWrite      = NbdCmd(nbdWrite)
+	NbdCmdDisconnect = NbdCmd(nbdDisconnect)
+	NbdCmdFlush      = NbdCmd(nbdFlush)
+	NbdCmdTrim       = NbdCmd(nbdTrim)
+)
+
+//NbdExport describes an export as negotiated with an NBD server
+type NbdExport struct {
+	Name                                      string
+	Size                                      int64
+	Flags                                     uint16
+	MinBlockSize, PrefBlockSize, MaxBlockSize int64
+}
+
+//ReadOnly is true if the server will reject writes and trims
+func (exp NbdExport) ReadOnly() bool {
+	return exp.Flags&nbdTransFlagHasFlags != 0 && exp.Flags&nbdTransFlagReadOnly != 0
+}
+
+//CanFlush is true if the server accepts flush commands
+func (exp NbdExport) CanFlush() bool {
+	return exp.Flags&nbdTransFlagHasFlags != 0 && exp.Flags&nbdTransFlagSendFlush != 0
+}
+
+//CanTrim is true if the server accepts trim commands
+func (exp NbdExport) CanTrim() bool {
+	return exp.Flags&nbdTransFlagHasFlags != 0 && exp.Flags&nbdTransFlagSendTrim != 0
+}
+
+//NbdClientHandshake performs fixed newstyle negotiation of the named export with
+// an NBD server (ex. qemu-nbd, nbdkit or an NbdServer) over the provided stream.
+// Upon success the stream is in the transmission phase and requests may be sent
+// with WriteNbdRequest
+func NbdClientHandshake(strm io.ReadWriter, exportName string) (NbdExport, error) {
+	exp := NbdExport{Name: exportName}
+
+	var greeting [18]byte
+	if _, err := io.ReadFull(strm, greeting[:]); err != nil {
+		return exp, fmt.Errorf("Could not read server greeting: %w", err)
+	}
+	switch {
+	case binary.BigEndian.Uint64(greeting[0:]) != nbdInitMagic:
+		return exp, fmt.Errorf("Server greeting did not have correct magic number")
+	case binary.BigEndian.Uint64(greeting[8:]) != nbdOptMagic:
+		return exp, fmt.Errorf("Server does not support newstyle negotiation")
+	}
+	srvFlags := binary.BigEndian.Uint16(greeting[16:])
+	if srvFlags&nbdFlagFixedNewstyle == 0 {
+		return exp, fmt.Errorf("Server does not support fixed newstyle negotiation")
+	}
+
+	cliFlags := uint32(nbdFlagFixedNewstyle | srvFlags&nbdFlagNoZeroes)
+	if err := binary.Write(strm, binary.BigEndian, cliFlags); err != nil {
+		return exp, fmt.Errorf("Could not write client flags: %w", err)
+	}
+
+	//Prefer NBD_OPT_GO so block size constraints are known
+	goData := make([]byte, 4+len(exportName)+2+2)
+	binary.BigEndian.PutUint32(goData, uint32(len(exportName)))
+	copy(goData[4:], exportName)
+	binary.BigEndian.PutUint16(goData[4+len(exportName):], 1)
+	binary.BigEndian.PutUint16(goData[6+len(exportName):], nbdInfoBlockSize)
+	if err := writeNbdOption(strm, nbdOptGo, goData); err != nil {
+		return exp, err
+	}
+
+	for {
+		repType, data, err := readNbdOptionReply(strm, nbdOptGo)
+		if err != nil {
+			return exp, err
+		}
+
+		switch repType {
+		case nbdRepAck:
+			if exp.MinBlockSize == 0 {
+				exp.MinBlockSize, exp.PrefBlockSize, exp.MaxBlockSize = 1, int64(DefaultBlockSizeBytes), nbdMaxPayloadLen
+			}
+			return exp, nil
+
+		case nbdRepInfo:
+			if len(data) < 2 {
+				return exp, fmt.Errorf("Server sent truncated information reply")
+			}
+			switch infoType := binary.BigEndian.Uint16(data); {
+			case infoType == nbdInfoExport && len(data) >= 12:
+				exp.Size = int64(binary.BigEndian.Uint64(data[2:]))
+				exp.Flags = binary.BigEndian.Uint16(data[10:])
+			case infoType == nbdInfoBlockSize && len(data) >= 14:
+				exp.MinBlockSize = int64(binary.BigEndian.Uint32(data[2:]))
+				exp.PrefBlockSize = int64(binary.BigEndian.Uint32(data[6:]))
+				exp.MaxBlockSize = int64(binary.BigEndian.Uint32(data[10:]))
+			}
+
+		case nbdRepErrUnsup: //Older server, fallback to NBD_OPT_EXPORT_NAME
+			return nbdClientExportName(strm, exp, srvFlags&nbdFlagNoZeroes != 0)
+
+		default:
+			if repType&nbdRepFlagError != 0 {
+				return exp, fmt.Errorf("Server refused export %q with error %#x: %s", exportName, repType, data)
+			}
+		}
+	}
+}
+
+func nbdClientExportName(strm io.ReadWriter, exp NbdExport, noZeroes bool) (NbdExport, error) {
+	if err := writeNbdOption(strm, nbdOptExportName, []byte(exp.Name)); err != nil {
+		return exp, err
+	}
+
+	reply := make([]byte, 10+nbdZeroPadLen)
+	if noZeroes {
+		reply = reply[:10]
+	}
+	if _, err := io.ReadFull(strm, reply); err != nil {
+		return exp, fmt.Errorf("Could not read export %q details (it may not exist): %w", exp.Name, err)
+	}
+	exp.Size = int64(binary.BigEndian.Uint64(reply))
+	exp.Flags = binary.BigEndian.Uint16(reply[8:])
+	exp.MinBlockSize, exp.PrefBlockSize, exp.MaxBlockSize = 1, int64(DefaultBlockSizeBytes), nbdMaxPayloadLen
+	return exp, nil
+}
+
+func writeNbdOption(strm io.Writer, option uint32, data []byte) error {
+	buf := make([]byte, 16+len(data))
+	binary.BigEndian.PutUint64(buf, nbdOptMagic)
+	binary.BigEndian.PutUint32(buf[8:], option)
+	binary.BigEndian.PutUint32(buf[12:], uint32(len(data)))
+	copy(buf[16:], data)
+	if _, err := strm.Write(buf); err != nil {
+		return fmt.Errorf("Could not write option %d: %w", option, err)
+	}
+	return nil
+}
+
+func readNbdOptionReply(strm io.Reader, option uint32) (repType uint32, data []byte, err error) {
+	var hdr [20]byte
+	if _, err = io.ReadFull(strm, hdr[:]); err != nil {
+		return 0, nil, fmt.Errorf("Could not read option reply: %w", err)
+	}
+	switch {
+	case binary.BigEndian.Uint64(hdr[0:]) != nbdOptReplyMagic:
+		return 0, nil, fmt.Errorf("Option reply did not have correct magic number")
+	case binary.BigEndian.Uint32(hdr[8:]) != option:
+		return 0, nil, fmt.Errorf("Option reply was for option %d rather than %d", binary.BigEndian.Uint32(hdr[8:]), option)
+	}
+
+	repType = binary.BigEndian.Uint32(hdr[12:])
+	if dataLen := binary.BigEndian.Uint32(hdr[16:]); dataLen > nbdMaxOptionLen {
+		return 0, nil, fmt.Errorf("Option reply length %d is too large", dataLen)
+	} else if data = make([]byte, dataLen); dataLen > 0 {
+		if _, err = io.ReadFull(strm, data); err != nil {
+			return 0, nil, fmt.Errorf("Could not read option reply data: %w", err)
+		}
+	}
+	return repType, data, nil
+}
+
+//WriteNbdRequest encodes a transmission phase request to the provided stream.
+// For writes data must be count bytes long, otherwise it must be nil
+func WriteNbdRequest(strm io.Writer, cmd NbdCmd, handle uint64, pos int64, count int, data []byte) error {
+	req := request{
+		reqType:     uint32(cmd),
+		handle:      newNbdHandle(),
+		pos:         pos,
+		count:       count,
+		writeBuffer: data,
+	}
+	binary.BigEndian.PutUint64(req.handle, handle)
+	return req.Encode(strm)
+}
+
+//ReadNbdReply reads a simple reply header from the provided stream. replyErr is
+// the error (if any) the server returned for the request while err is non-nil
+// if the stream itself failed. The data of successful reads follows the header
+// and must be consumed by the caller before reading the next reply.
+func ReadNbdReply(strm io.Reader) (handle uint64, replyErr error, err error) {
+	rawHandle := newNbdHandle()
+	errNo, err := decodeReply(strm, rawHandle)
+	if err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint64(rawHandle), newRespErr(uint32(errNo)), nil
+}
+
+//NbdServer exports Devices to NBD clients (ex. nbd-client, qemu or nbdclient)
+// over the network using fixed newstyle negotiation
+type NbdServer struct {
+	ctx         context.Context
+	ctxCancel   context.CancelFunc
+	workerCount int
+
+	mu        sync.Mutex
+	exports   map[string]Device
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	connWg    sync.WaitGroup
+	closeOnce sync.Once
+}
+
+//NewNbdServer constructs an NbdServer; exports must be added with AddExport and
+// the server started with Serve or ListenAndServe
+func NewNbdServer(ctx context.Context) *NbdServer {
+	ctx, cancel := context.WithCancel(ctx)
+	return &NbdServer{
+		ctx:         ctx,
+		ctxCancel:   cancel,
+		workerCount: RecommendWorkerCount(),
+		exports:     make(map[string]Device),
+		listeners:   make(map[net.Listener]struct{}),
+		conns:       make(map[net.Conn]struct{}),
+	}
+}
+
+//AddExport makes the provided device available to clients under the provided
+// name. If there is a single export clients may also request it with an empty
+// name. The server takes ownership of the device and closes it when the server
+// is closed
+func (srv *NbdServer) AddExport(name string, dev Device) error {
+	switch {
+	case dev == nil:
+		return fmt.Errorf("Provided device was nil")
+	case len(name) > 4096:
+		return fmt.Errorf("Export name is longer than 4096 bytes")
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.ctx.Err() != nil {
+		return errNbdServerClosed
+	} else if _, exists := srv.exports[name]; exists {
+		return fmt.Errorf("Export %q already exists", name)
+	}
+	srv.exports[name] = dev
+	return nil
+}
+
+func (srv *NbdServer) lookupExport(name string) Device {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if dev, exists := srv.exports[name]; exists {
+		return dev
+	} else if name == "" && len(srv.exports) == 1 {
+		for _, dev = range srv.exports {
+			return dev
+		}
+	}
+	return nil
+}
+
+func (srv *NbdServer) exportNames() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	names := make([]string, 0, len(srv.exports))
+	for name := range srv.exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//ListenAndServe listens on the provided network address (ex. "tcp", ":10809"
+// or "unix", "/run/usbd.sock") and then calls Serve
+func (srv *NbdServer) ListenAndServe(network, addr string) error {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("Could not listen on %s %q: %w", network, addr, err)
+	}
+	return srv.Serve(ln)
+}
+
+//Serve accepts client connections on the provided listener, blocking until the
+// server is closed. The listener is closed upon return
+func (srv *NbdServer) Serve(ln net.Listener) error {
+	srv.mu.Lock()
+	if srv.ctx.Err() != nil {
+		srv.mu.Unlock()
+		ln.Close()
+		return errNbdServerClosed
+	}
+	srv.listeners[ln] = struct{}{}
+	srv.mu.Unlock()
+
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, ln)
+		srv.mu.Unlock()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				continue
+			}
+			return fmt.Errorf("Could not accept connection: %w", err)
+		}
+
+		srv.mu.Lock()
+		if srv.ctx.Err() != nil {
+			srv.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		srv.conns[conn] = struct{}{}
+		srv.connWg.Add(1)
+		srv.mu.Unlock()
+
+		go func() {
+			defer func() {
+				conn.Close()
+				srv.mu.Lock()
+				delete(srv.conns, conn)
+				srv.mu.Unlock()
+				srv.connWg.Done()
+			}()
+
+			if err := srv.serveConn(conn); err != nil && srv.ctx.Err() == nil {
+				log.Printf("NbdServer::Serve(): WARNING: Connection from %s terminated; Details: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (srv *NbdServer) serveConn(conn net.Conn) error {
+	dev, err := srv.handshake(conn)
+	if err != nil {
+		if errors.Is(err, errNbdAbort) {
+			return nil
+		}
+		return fmt.Errorf("Negotiation failed: %w", err)
+	}
+
+	//Devices are shared by connections and closed by the server
+	return processRequests(srv.ctx, conn, sharedDevice{dev}, srv.workerCount)
+}
+
+//handshake performs server side fixed newstyle negotiation returning the device
+// the client selected
+func (srv *NbdServer) handshake(conn io.ReadWriter) (Device, error) {
+	var greeting [18]byte
+	binary.BigEndian.PutUint64(greeting[0:], nbdInitMagic)
+	binary.BigEndian.PutUint64(greeting[8:], nbdOptMagic)
+	binary.BigEndian.PutUint16(greeting[16:], nbdFlagFixedNewstyle|nbdFlagNoZeroes)
+	if _, err := conn.Write(greeting[:]); err != nil {
+		return nil, fmt.Errorf("Could not write greeting: %w", err)
+	}
+
+	var cliFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &cliFlags); err != nil {
+		return nil, fmt.Errorf("Could not read client flags: %w", err)
+	} else if cliFlags&^uint32(nbdFlagFixedNewstyle|nbdFlagNoZeroes) != 0 {
+		return nil, fmt.Errorf("Client sent unknown flags %#x", cliFlags)
+	}
+	noZeroes := cliFlags&uint32(nbdFlagNoZeroes) != 0
+
+	var hdr [16]byte
+	for {
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return nil, fmt.Errorf("Could not read option: %w", err)
+		}
+		option, optLen := binary.BigEndian.Uint32(hdr[8:]), binary.BigEndian.Uint32(hdr[12:])
+		switch {
+		case binary.BigEndian.Uint64(hdr[0:]) != nbdOptMagic:
+			return nil, fmt.Errorf("Option did not have correct magic number")
+		case optLen > nbdMaxOptionLen:
+			return nil, fmt.Errorf("Option length %d is too large", optLen)
+		}
+		data := make([]byte, optLen)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return nil, fmt.Errorf("Could not read option data: %w", err)
+		}
+
+		var err error
+		switch option {
+		case nbdOptExportName:
+			dev := srv.lookupExport(string(data))
+			if dev == nil {
+				return nil, fmt.Errorf("Client requested unknown export %q", data)
+			}
+			reply := make([]byte, 10+nbdZeroPadLen)
+			if noZeroes {
+				reply = reply[:10]
+			}
+			binary.BigEndian.PutUint64(reply, uint64(dev.Size()))
+			binary.BigEndian.PutUint16(reply[8:], nbdExportFlags(dev))
+			if _, err = conn.Write(reply); err != nil {
+				return nil, fmt.Errorf("Could not write export details: %w", err)
+			}
+			return dev, nil
+
+		case nbdOptInfo, nbdOptGo:
+			var dev Device
+			if dev, err = srv.replyInfo(conn, option, data); err != nil {
+				return nil, err
+			} else if dev != nil && option == nbdOptGo {
+				return dev, nil
+			}
+
+		case nbdOptList:
+			for _, name := range srv.exportNames() {
+				reply := make([]byte, 4+len(name))
+				binary.BigEndian.PutUint32(reply, uint32(len(name)))
+				copy(reply[4:], name)
+				if err = writeNbdOptionReply(conn, option, nbdRepServer, reply); err != nil {
+					return nil, err
+				}
+			}
+			err = writeNbdOptionReply(conn, option, nbdRepAck, nil)
+
+		case nbdOptAbort:
+			writeNbdOptionReply(conn, option, nbdRepAck, nil)
+			return nil, errNbdAbort
+
+		default:
+			err = writeNbdOptionReply(conn, option, nbdRepErrUnsup, []byte("Option is not supported"))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+//replyInfo answers NBD_OPT_INFO and NBD_OPT_GO, returning the requested device
+// or nil if it does not exist
+func (srv *NbdServer) replyInfo(conn io.Writer, option uint32, data []byte) (Device, error) {
+	if len(data) < 4 || int(binary.BigEndian.Uint32(data)) > len(data)-6 {
+		return nil, writeNbdOptionReply(conn, option, nbdRepErrInvalid, []byte("Malformed information request"))
+	}
+	name := string(data[4 : 4+binary.BigEndian.Uint32(data)])
+
+	dev := srv.lookupExport(name)
+	if dev == nil {
+		return nil, writeNbdOptionReply(conn, option, nbdRepErrUnknown, []byte(fmt.Sprintf("Unknown export %q", name)))
+	}
+
+	info := make([]byte, 12)
+	binary.BigEndian.PutUint16(info, nbdInfoExport)
+	binary.BigEndian.PutUint64(info[2:], uint64(dev.Size()))
+	binary.BigEndian.PutUint16(info[10:], nbdExportFlags(dev))
+	if err := writeNbdOptionReply(conn, option, nbdRepInfo, info); err != nil {
+		return nil, err
+	}
+
+	//Requests must be block aligned, so always advertise constraints
+	info = make([]byte, 14)
+	binary.BigEndian.PutUint16(info, nbdInfoBlockSize)
+	binary.BigEndian.PutUint32(info[2:], uint32(dev.BlockSize()))
+	binary.BigEndian.PutUint32(info[6:], uint32(dev.BlockSize()))
+	binary.BigEndian.PutUint32(info[10:], nbdMaxPayloadLen)
+	if err := writeNbdOptionReply(conn, option, nbdRepInfo, info); err != nil {
+		return nil, err
+	}
+	return dev, writeNbdOptionReply(conn, option, nbdRepAck, nil)
+}
+
+func writeNbdOptionReply(strm io.Writer, option, repType uint32, data []byte) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, nbdOptReplyMagic)
+	binary.Write(&buf, binary.BigEndian, option)
+	binary.Write(&buf, binary.BigEndian, repType)
+	binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+	if _, err := buf.WriteTo(strm); err != nil {
+		return fmt.Errorf("Could not write reply to option %d: %w", option, err)
+	}
+	return nil
+}
+
+//Close stops accepting connections, disconnects clients and closes all exported
+// devices
+func (srv *NbdServer) Close() (err error) {
+	srv.closeOnce.Do(func() {
+		srv.mu.Lock()
+		srv.ctxCancel()
+		for ln := range srv.listeners {
+			ln.Close()
+		}
+		for conn := range srv.conns {
+			conn.Close()
+		}
+		srv.mu.Unlock()
+		srv.connWg.Wait()
+
+		for _, name := range srv.exportNames() {
+			if closeErr := srv.lookupExport(name).Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("Could not close device backing export %q: %w", name, closeErr)
+			}
+		}
+	})
+	return err
+}
+
+func nbdExportFlags(dev Device) uint16 {
+	flags := nbdTransFlagHasFlags | nbdTransFlagSendFlush | nbdTransFlagSendTrim
+	if IsReadOnly(dev) {
+		flags |= nbdTransFlagReadOnly
+	}
+	return flags
+}
+
+//sharedDevice prevents request processing from closing a device that is
+// shared between connections
+type sharedDevice struct {
+	Device
+}
+
+func (sharedDevice) Close() error {
+	return nil
+}
+
+func (dev sharedDevice) ReadOnly() bool {
+	return IsReadOnly(dev.Device)
+}
@@ -234,11 +234,18 @@ func setupSycalls(blockDeviceName string, dev Device) (*os.File, int, int, error
 		return nil, 0, 0, fmt.Errorf("Could not inform NBD of which socket to use: %w", err)
 	}
 
-	//Ask NBD to send us trim commands, if supported
+	//Ask NBD to send us trim commands and to treat read-only devices as such, if supported
+	var flags uintptr
 	if ndbTrimSupported {
-		if _, _, err = sysCall(syscall.SYS_IOCTL, devFile.Fd(), nbdSetFlags, nbdFlagSendTrim); err != nil {
+		flags |= nbdFlagSendTrim
+	}
+	if ndbReadOnlySupported && IsReadOnly(dev) {
+		flags |= nbdFlagReadOnly
+	}
+	if flags != 0 {
+		if _, _, err = sysCall(syscall.SYS_IOCTL, devFile.Fd(), nbdSetFlags, flags); err != nil {
 			devFile.Close()
-			return nil, 0, 0, fmt.Errorf("Could not inform NBD to send TRIM commands: %w", err)
+			return nil, 0, 0, fmt.Errorf("Could not inform NBD of device flags (TRIM support, read-only): %w", err)
 		}
 	}
 
@@ -22,6 +22,12 @@ const int ndbHandleLen = sizeof(dummyReply.handle);
 	const int ndbTrimSupported = 0;
 #endif
 
+#if defined NBD_SET_FLAGS && defined NBD_FLAG_READ_ONLY
+	const int ndbReadOnlySupported = 1;
+#else
+	const int ndbReadOnlySupported = 0;
+#endif
+
 */
 import "C"
 
@@ -33,6 +39,7 @@ const (
 	nbdSetSock       = uintptr(C.NBD_SET_SOCK)
 	nbdSetFlags      = uintptr(C.NBD_SET_FLAGS)
 	nbdFlagSendTrim  = uintptr(C.NBD_FLAG_SEND_TRIM)
+	nbdFlagReadOnly  = uintptr(C.NBD_FLAG_READ_ONLY)
 	nbdDoIt          = uintptr(C.NBD_DO_IT)
 	nbdClearQueue    = uintptr(C.NBD_CLEAR_QUE)
 	ndbDisconnect    = uintptr(C.NBD_DISCONNECT)
@@ -101,7 +108,8 @@ var (
 	nbdReqMagic   = uint32(C.htonl(C.uint32_t(C.NBD_REQUEST_MAGIC)))
 	nbdReplyMagic = uint32(C.htonl(C.uint32_t(C.NBD_REPLY_MAGIC)))
 	//NBD features
-	ndbTrimSupported bool = C.ndbTrimSupported == 1
+	ndbTrimSupported     bool = C.ndbTrimSupported == 1
+	ndbReadOnlySupported bool = C.ndbReadOnlySupported == 1
 )
 
 func newNbdRawReq() []byte {
@@ -3,8 +3,6 @@ package usbdlib
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
-	"io"
 	"testing"
 )
 
@@ -85,44 +83,3 @@ func encodeHandle(x int64) []byte {
 	binary.BigEndian.PutUint64(buf, uint64(x))
 	return buf
 }
-
-func (req *request) Encode(wtr io.Writer) error {
-	//Write magic number
-	var err error
-	if err = binary.Write(wtr, binary.LittleEndian, nbdReqMagic); err != nil {
-		return fmt.Errorf("Could not encode request type: %w", err)
-	}
-
-	//Write request type
-	if err = binary.Write(wtr, binary.BigEndian, &req.reqType); err != nil {
-		return fmt.Errorf("Could not encode request type: %w", err)
-	}
-
-	//Write handle
-	if _, err = wtr.Write(req.handle); err != nil {
-		return fmt.Errorf("Could not write operation handle: %w", err)
-	}
-
-	//Write pos
-	pos := uint64(req.pos)
-	if err = binary.Write(wtr, binary.BigEndian, &pos); err != nil {
-		return fmt.Errorf("Could not encode position: %w", err)
-	}
-
-	//Write count
-	count := uint32(req.count)
-	if err = binary.Write(wtr, binary.BigEndian, &count); err != nil {
-		return fmt.Errorf("Could not encode count: %w", err)
-	}
-
-	if req.reqType == nbdWrite {
-		if len(req.writeBuffer) != int(count) {
-			return fmt.Errorf("Write count %d did not match size of write buffer %d", count, len(req.writeBuffer))
-		}
-		if _, err = wtr.Write(req.writeBuffer); err != nil {
-			return fmt.Errorf("Failed to write contents of write buffer: %w", err)
-		}
-	}
-
-	return nil
-}
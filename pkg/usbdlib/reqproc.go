@@ -21,6 +21,7 @@ func RecommendWorkerCount() int {
 // and then writes responses back to the command stream.
 type reqProcessor struct {
 	blockSize         int64
+	readOnly          bool
 	cmdStrm           io.ReadWriteCloser
 	dev               Device
 	reqQueue          chan *request
@@ -37,6 +38,7 @@ func processRequests(ctx context.Context, cmdStrm io.ReadWriteCloser, device Dev
 
 	this := &reqProcessor{
 		blockSize: device.BlockSize(),
+		readOnly:  IsReadOnly(device),
 		cmdStrm:   cmdStrm,
 		dev:       device,
 		reqQueue:  make(chan *request, 64),
@@ -200,6 +202,11 @@ func (proc *reqProcessor) execute(req *request, resp *response) *response {
 		}
 
 		defer req.flushMu.RUnlock()
+		if proc.readOnly {
+			err = fmt.Errorf("Write request for read-only device was refused")
+			errCode = ndbRespErrPerms
+			break
+		}
 		_, err = proc.dev.WriteAt(req.writeBuffer, req.pos)
 		if err != nil {
 			errCode = ndbRespErrIO
@@ -215,6 +222,11 @@ func (proc *reqProcessor) execute(req *request, resp *response) *response {
 
 	case nbdTrim:
 		defer req.flushMu.RUnlock()
+		if proc.readOnly {
+			err = fmt.Errorf("Trim request for read-only device was refused")
+			errCode = ndbRespErrPerms
+			break
+		}
 		err = proc.dev.Trim(req.pos, req.count)
 		if err != nil {
 			errCode = ndbRespErrIO
@@ -53,3 +53,19 @@ func (resp *response) Write(strm io.Writer) error {
 	}
 	return nil
 }
+
+//decodeReply reads a simple reply header from the provided stream into handle
+// and returns the error number the server replied with. If the reply is to a
+// read the caller must then consume the data read from the stream.
+func decodeReply(strm io.Reader, handle []byte) (nbdErr, error) {
+	rawResp := newNbdRawResp()[:ndbRespBytes]
+	if _, err := io.ReadFull(strm, rawResp); err != nil {
+		return 0, fmt.Errorf("Could not read reply: %w", err)
+	}
+
+	if magicNumber := binary.LittleEndian.Uint32(rawResp); magicNumber != nbdReplyMagic {
+		return 0, fmt.Errorf("Reply did not have correct magic number: %#x", magicNumber)
+	}
+	copy(handle, rawResp[8:])
+	return nbdErr(binary.BigEndian.Uint32(rawResp[4:])), nil
+}
@@ -0,0 +1,145 @@
+package usbdlib_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/tarndt/usbd/pkg/devices/ramdisk"
+	"github.com/tarndt/usbd/pkg/usbdlib"
+)
+
+func TestNbdServer(t *testing.T) {
+	const sizeBytes = 1024 * 1024
+
+	srv := usbdlib.NewNbdServer(context.Background())
+	defer srv.Close()
+	for _, name := range []string{"beta", "alpha"} {
+		if err := srv.AddExport(name, ramdisk.NewRAMDisk(sizeBytes)); err != nil {
+			t.Fatalf("Could not add export %q: %s", name, err)
+		}
+	}
+	if err := srv.AddExport("alpha", ramdisk.NewRAMDisk(sizeBytes)); err == nil {
+		t.Fatalf("Duplicate export was accepted")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	go srv.Serve(ln)
+
+	t.Run("list-and-export-name", func(t *testing.T) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Could not connect: %s", err)
+		}
+		defer conn.Close()
+
+		//Greeting, then client flags: fixed newstyle without NO_ZEROES
+		greeting := make([]byte, 18)
+		if _, err = io.ReadFull(conn, greeting); err != nil {
+			t.Fatalf("Could not read greeting: %s", err)
+		} else if string(greeting[:8]) != "NBDMAGIC" || string(greeting[8:16]) != "IHAVEOPT" {
+			t.Fatalf("Unexpected greeting: %q", greeting)
+		}
+		binary.Write(conn, binary.BigEndian, uint32(1))
+
+		//NBD_OPT_LIST
+		writeOption(t, conn, 3, nil)
+		var names []string
+		for {
+			repType, data := readOptionReply(t, conn, 3)
+			if repType == 1 { //NBD_REP_ACK
+				break
+			} else if repType != 2 { //NBD_REP_SERVER
+				t.Fatalf("Unexpected reply type %#x to list", repType)
+			}
+			names = append(names, string(data[4:4+binary.BigEndian.Uint32(data)]))
+		}
+		if len(names) != 2 || names[0] != "alpha" || names[1] != "beta" {
+			t.Fatalf("Server listed exports %q; expected alpha and beta", names)
+		}
+
+		//NBD_OPT_EXPORT_NAME, the reply is padded with zeros
+		writeOption(t, conn, 1, []byte("beta"))
+		reply := make([]byte, 8+2+124)
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("Could not read export details: %s", err)
+		} else if size := binary.BigEndian.Uint64(reply); size != sizeBytes {
+			t.Fatalf("Export size was %d; expected %d", size, sizeBytes)
+		}
+
+		expected := bytes.Repeat([]byte{0xa5}, 4096)
+		if err = usbdlib.WriteNbdRequest(conn, usbdlib.NbdCmdWrite, 1, 8192, len(expected), expected); err != nil {
+			t.Fatalf("Could not send write: %s", err)
+		}
+		if handle, replyErr, err := usbdlib.ReadNbdReply(conn); err != nil || replyErr != nil || handle != 1 {
+			t.Fatalf("Write reply was handle %d, error %v, stream error %v", handle, replyErr, err)
+		}
+		if err = usbdlib.WriteNbdRequest(conn, usbdlib.NbdCmdRead, 2, 8192, len(expected), nil); err != nil {
+			t.Fatalf("Could not send read: %s", err)
+		}
+		if handle, replyErr, err := usbdlib.ReadNbdReply(conn); err != nil || replyErr != nil || handle != 2 {
+			t.Fatalf("Read reply was handle %d, error %v, stream error %v", handle, replyErr, err)
+		}
+		actual := make([]byte, len(expected))
+		if _, err = io.ReadFull(conn, actual); err != nil {
+			t.Fatalf("Could not read data: %s", err)
+		} else if !bytes.Equal(expected, actual) {
+			t.Fatalf("Data read did not match data written")
+		}
+
+		//Unaligned requests are refused
+		if err = usbdlib.WriteNbdRequest(conn, usbdlib.NbdCmdRead, 3, 1, 1, nil); err != nil {
+			t.Fatalf("Could not send read: %s", err)
+		}
+		if _, replyErr, err := usbdlib.ReadNbdReply(conn); err != nil || replyErr == nil {
+			t.Fatalf("Unaligned read was not refused: error %v, stream error %v", replyErr, err)
+		}
+		usbdlib.WriteNbdRequest(conn, usbdlib.NbdCmdDisconnect, 4, 0, 0, nil)
+	})
+
+	t.Run("go", func(t *testing.T) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Could not connect: %s", err)
+		}
+		defer conn.Close()
+
+		if _, err = usbdlib.NbdClientHandshake(conn, "gamma"); err == nil {
+			t.Fatalf("Negotiating an unknown export succeeded")
+		}
+	})
+}
+
+func writeOption(t *testing.T, conn io.Writer, option uint32, data []byte) {
+	t.Helper()
+
+	hdr := make([]byte, 16)
+	copy(hdr, "IHAVEOPT")
+	binary.BigEndian.PutUint32(hdr[8:], option)
+	binary.BigEndian.PutUint32(hdr[12:], uint32(len(data)))
+	if _, err := conn.Write(append(hdr, data...)); err != nil {
+		t.Fatalf("Could not write option %d: %s", option, err)
+	}
+}
+
+func readOptionReply(t *testing.T, conn io.Reader, option uint32) (uint32, []byte) {
+	t.Helper()
+
+	hdr := make([]byte, 20)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		t.Fatalf("Could not read reply to option %d: %s", option, err)
+	} else if binary.BigEndian.Uint32(hdr[8:]) != option {
+		t.Fatalf("Reply was to option %d rather than %d", binary.BigEndian.Uint32(hdr[8:]), option)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(hdr[16:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatalf("Could not read reply data: %s", err)
+	}
+	return binary.BigEndian.Uint32(hdr[12:]), data
+}
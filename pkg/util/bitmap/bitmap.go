@@ -0,0 +1,167 @@
+package bitmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+//Bitmap is a fixed length set of bits, typically one per block of a device. It
+// is not safe for concurrent use.
+type Bitmap struct {
+	words  []uint64
+	length int64
+}
+
+//New constructs a bitmap of the provided length with all bits clear
+func New(length int64) *Bitmap {
+	return &Bitmap{
+		words:  make([]uint64, (length+63)/64),
+		length: length,
+	}
+}
+
+//Len returns the number of bits in the bitmap
+func (bm *Bitmap) Len() int64 {
+	return bm.length
+}
+
+//Test returns true if the bit at the provided index is set
+func (bm *Bitmap) Test(idx int64) bool {
+	return bm.words[idx/64]&(1<<uint(idx%64)) != 0
+}
+
+//Set sets the bit at the provided index
+func (bm *Bitmap) Set(idx int64) {
+	bm.words[idx/64] |= 1 << uint(idx%64)
+}
+
+//Clear clears the bit at the provided index
+func (bm *Bitmap) Clear(idx int64) {
+	bm.words[idx/64] &^= 1 << uint(idx%64)
+}
+
+//SetRange sets the bits in [start, end)
+func (bm *Bitmap) SetRange(start, end int64) {
+	for ; start < end && start%64 != 0; start++ {
+		bm.Set(start)
+	}
+	for ; start+64 <= end; start += 64 {
+		bm.words[start/64] = ^uint64(0)
+	}
+	for ; start < end; start++ {
+		bm.Set(start)
+	}
+}
+
+//ClearRange clears the bits in [start, end)
+func (bm *Bitmap) ClearRange(start, end int64) {
+	for ; start < end && start%64 != 0; start++ {
+		bm.Clear(start)
+	}
+	for ; start+64 <= end; start += 64 {
+		bm.words[start/64] = 0
+	}
+	for ; start < end; start++ {
+		bm.Clear(start)
+	}
+}
+
+//ClearAll clears every bit
+func (bm *Bitmap) ClearAll() {
+	for i := range bm.words {
+		bm.words[i] = 0
+	}
+}
+
+//Count returns the number of set bits
+func (bm *Bitmap) Count() (count int64) {
+	for _, word := range bm.words {
+		count += int64(bits.OnesCount64(word))
+	}
+	return count
+}
+
+//NextSet returns the index of the first set bit at or after the provided index,
+// or -1 if there is none
+func (bm *Bitmap) NextSet(from int64) int64 {
+	return bm.next(from, 0)
+}
+
+//NextClear returns the index of the first clear bit at or after the provided
+// index, or -1 if there is none
+func (bm *Bitmap) NextClear(from int64) int64 {
+	return bm.next(from, ^uint64(0))
+}
+
+func (bm *Bitmap) next(from int64, invert uint64) int64 {
+	if from < 0 {
+		from = 0
+	}
+	for wordIdx := from / 64; wordIdx < int64(len(bm.words)); wordIdx++ {
+		word := bm.words[wordIdx] ^ invert
+		if wordIdx == from/64 {
+			word &= ^uint64(0) << uint(from%64)
+		}
+		if word != 0 {
+			if idx := wordIdx*64 + int64(bits.TrailingZeros64(word)); idx < bm.length {
+				return idx
+			}
+			return -1
+		}
+	}
+	return -1
+}
+
+//Or sets every bit that is set in other, which must be of the same length
+func (bm *Bitmap) Or(other *Bitmap) {
+	for i, word := range other.words {
+		bm.words[i] |= word
+	}
+}
+
+//Clone returns a copy of the bitmap
+func (bm *Bitmap) Clone() *Bitmap {
+	return &Bitmap{
+		words:  append([]uint64(nil), bm.words...),
+		length: bm.length,
+	}
+}
+
+//MarshalBinary fufills encoding.BinaryMarshaler; the length is followed by the
+// bits as little endian 64-bit words
+func (bm *Bitmap) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 8+8*len(bm.words))
+	binary.LittleEndian.PutUint64(data, uint64(bm.length))
+	for i, word := range bm.words {
+		binary.LittleEndian.PutUint64(data[8+8*i:], word)
+	}
+	return data, nil
+}
+
+//UnmarshalBinary fufills encoding.BinaryUnmarshaler
+func (bm *Bitmap) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("Bitmap data is truncated (%d bytes)", len(data))
+	}
+	length := int64(binary.LittleEndian.Uint64(data))
+	wordCount := (length + 63) / 64
+	if length < 0 || int64(len(data)-8) != wordCount*8 {
+		return fmt.Errorf("Bitmap of %d bits can not be encoded in %d bytes", length, len(data))
+	}
+
+	bm.length, bm.words = length, make([]uint64, wordCount)
+	for i := range bm.words {
+		bm.words[i] = binary.LittleEndian.Uint64(data[8+8*i:])
+	}
+	if extra := length % 64; extra != 0 && bm.words[wordCount-1]>>uint(extra) != 0 {
+		return fmt.Errorf("Bitmap has bits set beyond its length of %d", length)
+	}
+	return nil
+}
+
+//MarshaledSize returns the number of bytes MarshalBinary produces for a bitmap
+// of the provided length
+func MarshaledSize(length int64) int64 {
+	return 8 + 8*((length+63)/64)
+}
@@ -0,0 +1,81 @@
+package bitmap
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestBitmap(t *testing.T) {
+	for _, length := range []int64{1, 63, 64, 65, 1000} {
+		bm, shadow := New(length), make([]bool, length)
+		rnd := rand.New(rand.NewSource(length))
+
+		for i := 0; i < 200; i++ {
+			start := rnd.Int63n(length)
+			end := start + rnd.Int63n(length-start+1)
+			switch rnd.Intn(4) {
+			case 0:
+				bm.Set(start)
+				shadow[start] = true
+			case 1:
+				bm.Clear(start)
+				shadow[start] = false
+			case 2:
+				bm.SetRange(start, end)
+				for j := start; j < end; j++ {
+					shadow[j] = true
+				}
+			case 3:
+				bm.ClearRange(start, end)
+				for j := start; j < end; j++ {
+					shadow[j] = false
+				}
+			}
+		}
+
+		var count int64
+		for idx, set := range shadow {
+			if set {
+				count++
+			}
+			if bm.Test(int64(idx)) != set {
+				t.Fatalf("Bit %d of %d was %t rather than %t", idx, length, !set, set)
+			}
+			if expected := nextIdx(shadow, idx, true); bm.NextSet(int64(idx)) != expected {
+				t.Fatalf("NextSet(%d) of %d was %d rather than %d", idx, length, bm.NextSet(int64(idx)), expected)
+			}
+			if expected := nextIdx(shadow, idx, false); bm.NextClear(int64(idx)) != expected {
+				t.Fatalf("NextClear(%d) of %d was %d rather than %d", idx, length, bm.NextClear(int64(idx)), expected)
+			}
+		}
+		if bm.Count() != count {
+			t.Fatalf("Count of %d was %d rather than %d", length, bm.Count(), count)
+		}
+
+		data, _ := bm.MarshalBinary()
+		if int64(len(data)) != MarshaledSize(length) {
+			t.Fatalf("Marshaled %d bytes rather than %d", len(data), MarshaledSize(length))
+		}
+		decoded := new(Bitmap)
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("Could not unmarshal bitmap: %s", err)
+		}
+		for idx, set := range shadow {
+			if decoded.Test(int64(idx)) != set {
+				t.Fatalf("Unmarshaled bit %d of %d was %t rather than %t", idx, length, !set, set)
+			}
+		}
+		if err := decoded.UnmarshalBinary(data[:len(data)-1]); err == nil {
+			t.Fatalf("Truncated bitmap was unmarshaled")
+		}
+	}
+}
+
+func nextIdx(shadow []bool, from int, set bool) int64 {
+	for idx := from; idx < len(shadow); idx++ {
+		if shadow[idx] == set {
+			return int64(idx)
+		}
+	}
+	return -1
+}
@@ -0,0 +1,254 @@
+package erasure
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tarndt/usbd/pkg/util/consterr"
+)
+
+const (
+	//ErrTooFewShards is returned when too many shards are missing to reconstruct
+	ErrTooFewShards = consterr.ConstErr("Too few shards to reconstruct data")
+	//ErrShardSize is returned when shards are not all the same size
+	ErrShardSize = consterr.ConstErr("Shards are not all the same size")
+)
+
+//Coder is a systematic Reed-Solomon erasure coder producing parity shards from
+// data shards such that the data can be recovered from any data-count shards.
+// With one parity shard the parity is the XOR of the data (as in RAID5) and with
+// two the parity shards are RAID6 P and Q; more parity shards use a Cauchy matrix.
+type Coder struct {
+	dataCount, parityCount int
+	parityRows             [][]byte
+}
+
+//NewCoder constructs a coder for the provided number of data and parity shards
+func NewCoder(dataCount, parityCount int) (*Coder, error) {
+	switch {
+	case dataCount < 1:
+		return nil, fmt.Errorf("At least one data shard is required")
+	case parityCount < 1:
+		return nil, fmt.Errorf("At least one parity shard is required")
+	case parityCount <= 2 && dataCount > 255:
+		return nil, fmt.Errorf("At most 255 data shards are supported, not %d", dataCount)
+	case dataCount+parityCount > 256:
+		return nil, fmt.Errorf("At most 256 shards are supported, not %d", dataCount+parityCount)
+	}
+
+	coder := &Coder{dataCount: dataCount, parityCount: parityCount, parityRows: make([][]byte, parityCount)}
+	for row := range coder.parityRows {
+		coder.parityRows[row] = make([]byte, dataCount)
+		for col := range coder.parityRows[row] {
+			switch {
+			case parityCount <= 2: //P is all ones, Q is powers of the generator
+				coder.parityRows[row][col] = gfExp(row * col)
+			default: //Cauchy, any square submatrix is invertible
+				coder.parityRows[row][col] = gfInv(byte(dataCount+row) ^ byte(col))
+			}
+		}
+	}
+	return coder, nil
+}
+
+//DataShards returns the number of data shards
+func (coder *Coder) DataShards() int {
+	return coder.dataCount
+}
+
+//ParityShards returns the number of parity shards
+func (coder *Coder) ParityShards() int {
+	return coder.parityCount
+}
+
+//Encode computes the parity shards, which follow the data shards and must be
+// allocated, from the data shards
+func (coder *Coder) Encode(shards [][]byte) error {
+	size, err := coder.checkShards(shards, false)
+	if err != nil {
+		return err
+	}
+	for row, coeffs := range coder.parityRows {
+		coder.encodeRow(coeffs, shards[:coder.dataCount], shards[coder.dataCount+row][:size])
+	}
+	return nil
+}
+
+func (coder *Coder) encodeRow(coeffs []byte, data [][]byte, out []byte) {
+	for i := range out {
+		out[i] = 0
+	}
+	for col, shard := range data {
+		mulAddSlice(coeffs[col], shard, out)
+	}
+}
+
+//Update applies a change to the data shard with the provided index, given as the
+// XOR of its old and new contents, to the parity shards. Only the changed portion
+// of the shards needs to be provided, so delta and parity may be any (equal) size.
+func (coder *Coder) Update(idx int, delta []byte, parity [][]byte) error {
+	switch {
+	case idx < 0 || idx >= coder.dataCount:
+		return fmt.Errorf("Shard %d is not a data shard", idx)
+	case len(parity) != coder.parityCount:
+		return fmt.Errorf("Expected %d parity shards but %d were provided", coder.parityCount, len(parity))
+	}
+	for row, coeffs := range coder.parityRows {
+		if len(parity[row]) != len(delta) {
+			return ErrShardSize
+		}
+		mulAddSlice(coeffs[idx], delta, parity[row])
+	}
+	return nil
+}
+
+//Verify returns true if the parity shards are consistent with the data shards
+func (coder *Coder) Verify(shards [][]byte) (bool, error) {
+	size, err := coder.checkShards(shards, false)
+	if err != nil {
+		return false, err
+	}
+	expected := make([]byte, size)
+	for row, coeffs := range coder.parityRows {
+		coder.encodeRow(coeffs, shards[:coder.dataCount], expected)
+		if !bytes.Equal(expected, shards[coder.dataCount+row]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+//Reconstruct recreates missing (nil or empty) shards, both data and parity, from
+// the shards present; at least as many shards as there are data shards must be
+// present. Missing shards are replaced with newly allocated slices.
+func (coder *Coder) Reconstruct(shards [][]byte) error {
+	return coder.reconstruct(shards, false)
+}
+
+//ReconstructData is like Reconstruct but only recreates missing data shards
+func (coder *Coder) ReconstructData(shards [][]byte) error {
+	return coder.reconstruct(shards, true)
+}
+
+func (coder *Coder) reconstruct(shards [][]byte, dataOnly bool) error {
+	size, err := coder.checkShards(shards, true)
+	if err != nil {
+		return err
+	}
+
+	//Select the first dataCount present shards and the rows that produced them
+	present := make([]int, 0, coder.dataCount)
+	dataMissing := false
+	for idx, shard := range shards {
+		if len(shard) == 0 {
+			dataMissing = dataMissing || idx < coder.dataCount
+		} else if len(present) < coder.dataCount {
+			present = append(present, idx)
+		}
+	}
+	if len(present) < coder.dataCount {
+		return ErrTooFewShards
+	}
+
+	if dataMissing {
+		matrix := make([][]byte, coder.dataCount)
+		for i, idx := range present {
+			matrix[i] = coder.row(idx)
+		}
+		decode, err := invert(matrix)
+		if err != nil {
+			return err
+		}
+
+		inputs := make([][]byte, coder.dataCount)
+		for i, idx := range present {
+			inputs[i] = shards[idx][:size]
+		}
+		for idx := 0; idx < coder.dataCount; idx++ {
+			if len(shards[idx]) == 0 {
+				shards[idx] = make([]byte, size)
+				coder.encodeRow(decode[idx], inputs, shards[idx])
+			}
+		}
+	}
+
+	if !dataOnly {
+		for row, coeffs := range coder.parityRows {
+			if idx := coder.dataCount + row; len(shards[idx]) == 0 {
+				shards[idx] = make([]byte, size)
+				coder.encodeRow(coeffs, shards[:coder.dataCount], shards[idx])
+			}
+		}
+	}
+	return nil
+}
+
+//row returns the encoding matrix row that produces the shard with the provided index
+func (coder *Coder) row(idx int) []byte {
+	if idx >= coder.dataCount {
+		return coder.parityRows[idx-coder.dataCount]
+	}
+	identity := make([]byte, coder.dataCount)
+	identity[idx] = 1
+	return identity
+}
+
+//checkShards validates the number of shards and returns their common size
+func (coder *Coder) checkShards(shards [][]byte, allowMissing bool) (int, error) {
+	if len(shards) != coder.dataCount+coder.parityCount {
+		return 0, fmt.Errorf("Expected %d shards but %d were provided", coder.dataCount+coder.parityCount, len(shards))
+	}
+	size := -1
+	for _, shard := range shards {
+		switch {
+		case len(shard) == 0 && allowMissing:
+		case size < 0:
+			size = len(shard)
+		case len(shard) != size:
+			return 0, ErrShardSize
+		}
+	}
+	if size < 1 {
+		return 0, ErrTooFewShards
+	}
+	return size, nil
+}
+
+//invert returns the inverse of a square matrix using Gauss-Jordan elimination
+func invert(matrix [][]byte) ([][]byte, error) {
+	size := len(matrix)
+	work := make([][]byte, size)
+	for i := range work {
+		work[i] = make([]byte, 2*size)
+		copy(work[i], matrix[i])
+		work[i][size+i] = 1
+	}
+
+	for col := 0; col < size; col++ {
+		pivot := col
+		for pivot < size && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == size {
+			return nil, fmt.Errorf("Decoding matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		if scale := gfInv(work[col][col]); scale != 1 {
+			for i := range work[col] {
+				work[col][i] = gfMul(work[col][i], scale)
+			}
+		}
+		for row := 0; row < size; row++ {
+			if row != col && work[row][col] != 0 {
+				mulAddSlice(work[row][col], work[col], work[row])
+			}
+		}
+	}
+
+	inverse := make([][]byte, size)
+	for i := range inverse {
+		inverse[i] = work[i][size:]
+	}
+	return inverse, nil
+}
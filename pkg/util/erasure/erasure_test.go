@@ -0,0 +1,116 @@
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestReconstruct(t *testing.T) {
+	const shardBytes = 1000
+
+	for _, tcase := range []struct{ data, parity int }{{1, 1}, {4, 1}, {4, 2}, {5, 3}, {10, 4}} {
+		coder, err := NewCoder(tcase.data, tcase.parity)
+		if err != nil {
+			t.Fatalf("Could not create %d+%d coder: %s", tcase.data, tcase.parity, err)
+		}
+
+		rnd := rand.New(rand.NewSource(int64(tcase.data*10 + tcase.parity)))
+		shards := make([][]byte, tcase.data+tcase.parity)
+		for i := range shards {
+			shards[i] = make([]byte, shardBytes)
+			if i < tcase.data {
+				rnd.Read(shards[i])
+			}
+		}
+		if err = coder.Encode(shards); err != nil {
+			t.Fatalf("Could not encode %d+%d: %s", tcase.data, tcase.parity, err)
+		}
+		if ok, err := coder.Verify(shards); err != nil || !ok {
+			t.Fatalf("Encoded %d+%d shards did not verify: %v", tcase.data, tcase.parity, err)
+		}
+
+		//Every combination of up to parity missing shards must be recoverable
+		for missing := 1; missing < 1<<uint(len(shards)); missing++ {
+			count := 0
+			damaged := make([][]byte, len(shards))
+			for i := range shards {
+				if missing&(1<<uint(i)) != 0 {
+					count++
+				} else {
+					damaged[i] = append([]byte(nil), shards[i]...)
+				}
+			}
+
+			err = coder.Reconstruct(damaged)
+			switch {
+			case count > tcase.parity:
+				if err != ErrTooFewShards {
+					t.Fatalf("%d+%d reconstruction missing %b should have failed but got: %v", tcase.data, tcase.parity, missing, err)
+				}
+				continue
+			case err != nil:
+				t.Fatalf("%d+%d reconstruction missing %b failed: %s", tcase.data, tcase.parity, missing, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(shards[i], damaged[i]) {
+					t.Fatalf("%d+%d reconstruction missing %b produced the wrong shard %d", tcase.data, tcase.parity, missing, i)
+				}
+			}
+		}
+
+		shards[0][0] ^= 1
+		if ok, err := coder.Verify(shards); err != nil || ok {
+			t.Fatalf("Corrupt %d+%d shards verified: %v", tcase.data, tcase.parity, err)
+		}
+	}
+}
+
+func TestRAID6(t *testing.T) {
+	coder, err := NewCoder(3, 2)
+	if err != nil {
+		t.Fatalf("Could not create coder: %s", err)
+	}
+	shards := [][]byte{{0x01}, {0x02}, {0x80}, {0}, {0}}
+	if err = coder.Encode(shards); err != nil {
+		t.Fatalf("Could not encode: %s", err)
+	}
+
+	//P is the XOR of the data and Q is the sum of 2^i * D_i
+	if expected := byte(0x01 ^ 0x02 ^ 0x80); shards[3][0] != expected {
+		t.Fatalf("P was %#x rather than %#x", shards[3][0], expected)
+	}
+	if expected := byte(0x01 ^ 0x04 ^ 0x3a); shards[4][0] != expected { //4 * 0x80 reduced by 0x11d
+		t.Fatalf("Q was %#x rather than %#x", shards[4][0], expected)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	coder, err := NewCoder(4, 2)
+	if err != nil {
+		t.Fatalf("Could not create coder: %s", err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	shards := make([][]byte, 6)
+	for i := range shards {
+		shards[i] = make([]byte, 100)
+		rnd.Read(shards[i])
+	}
+	if err = coder.Encode(shards); err != nil {
+		t.Fatalf("Could not encode: %s", err)
+	}
+
+	//Change part of data shard 2 and apply the difference to the parity
+	const lo, hi = 10, 30
+	delta := make([]byte, hi-lo)
+	rnd.Read(delta)
+	for i := range delta {
+		shards[2][lo+i] ^= delta[i]
+	}
+	if err = coder.Update(2, delta, [][]byte{shards[4][lo:hi], shards[5][lo:hi]}); err != nil {
+		t.Fatalf("Could not update parity: %s", err)
+	}
+	if ok, err := coder.Verify(shards); err != nil || !ok {
+		t.Fatalf("Updated shards did not verify: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package erasure
+
+//Arithmetic in GF(2^8) using the polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d)
+// with generator 2, as used by RAID6
+
+const fieldPoly = 0x11d
+
+var (
+	expTable [2 * 255]byte
+	logTable [256]byte
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i], expTable[i+255] = byte(x), byte(x)
+		logTable[x] = byte(i)
+		if x <<= 1; x&0x100 != 0 {
+			x ^= fieldPoly
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	return mulTable[a][b]
+}
+
+//gfInv returns the multiplicative inverse of a non-zero element
+func gfInv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+//gfExp returns the generator raised to the provided power
+func gfExp(power int) byte {
+	return expTable[power%255]
+}
+
+//mulAddSlice sets out[i] ^= c * in[i]
+func mulAddSlice(c byte, in, out []byte) {
+	switch c {
+	case 0:
+		return
+	case 1:
+		for i, val := range in {
+			out[i] ^= val
+		}
+		return
+	}
+	row := &mulTable[c]
+	for i, val := range in {
+		out[i] ^= row[val]
+	}
+}
@@ -0,0 +1,48 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+//WriteFileAtomic replaces the contents of the named file such that after a crash
+// it contains either the old or the new contents, never a mix
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("Could not create temporary file for %q: %w", filename, err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) //Fails harmlessly once renamed
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Could not write temporary file %q: %w", tmpName, err)
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Could not set permissions of temporary file %q: %w", tmpName, err)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Could not sync temporary file %q: %w", tmpName, err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("Could not close temporary file %q: %w", tmpName, err)
+	}
+	if err = os.Rename(tmpName, filename); err != nil {
+		return fmt.Errorf("Could not replace %q: %w", filename, err)
+	}
+
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("Could not open directory %q to sync it: %w", dir, err)
+	}
+	defer dirFile.Close()
+	if err = dirFile.Sync(); err != nil {
+		return fmt.Errorf("Could not sync directory %q: %w", dir, err)
+	}
+	return nil
+}